@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+)
+
+// cancelOn cancels the sync on SIGINT or SIGTERM, and on a POST to /cancel on
+// the control address if it is not empty. A second signal stops the command
+// without waiting for the sync to end.
+func cancelOn(sync blockrsync.Cancellable, controlAddress string, logger logr.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		logger.Info("Cancelling sync, signal again to stop immediately", "signal", sig.String())
+		sync.Cancel()
+	}()
+	if controlAddress == "" {
+		return
+	}
+	if _, _, err := blockrsync.ServeControl(controlAddress, sync, logger.WithName("control")); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to serve the control endpoint: %v\n", err)
+		os.Exit(1)
+	}
+}
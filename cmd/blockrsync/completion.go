@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/completion"
+)
+
+// completionCommand returns what the completion of the binary completes
+// besides the flags.
+func completionCommand(name string) completion.Command {
+	return completion.Command{
+		Name:        name,
+		Subcommands: []string{"sync-set", "rollback", "copy", "preflight", "wipe", "hash", "replay", "soak", "completion"},
+		Values: map[string][]string{
+			"hole-strategy": {"auto", string(blockrsync.HoleStrategyPunch), string(blockrsync.HoleStrategyZero),
+				string(blockrsync.HoleStrategyDiscard), string(blockrsync.HoleStrategySkip)},
+			"progress":       {"log", "bar"},
+			"summary-format": {"text", "json"},
+			"compat":         {codec.CompatV0},
+			"zap-encoder":    {"json", "console"},
+		},
+	}
+}
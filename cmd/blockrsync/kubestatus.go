@@ -0,0 +1,57 @@
+//go:build kubestatus
+
+package main
+
+import (
+	"flag"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/kubestatus"
+)
+
+var (
+	statusResource  = flag.String("status-resource", "", "<group>/<version>/<resource>/<name> of a custom resource whose status is patched with the phase, progress and error of the sync through the in-cluster API")
+	statusNamespace = flag.String("status-namespace", "", "namespace of the status-resource, the namespace of the pod if empty")
+)
+
+// startStatusReporting patches the status of the status resource with the
+// progress of the sync if it is a single sync, and with its outcome when
+// reportStatus is called.
+func startStatusReporting(opts *blockrsync.BlockRsyncOptions, progress bool, logger logr.Logger) error {
+	if *statusResource == "" {
+		return nil
+	}
+	resource, err := kubestatus.ParseResource(*statusResource)
+	if err != nil {
+		return err
+	}
+	resource.Namespace = *statusNamespace
+	client, err := kubestatus.NewInClusterClient(resource, logger)
+	if err != nil {
+		return err
+	}
+	if err := client.Report(kubestatus.Status{Phase: kubestatus.PhaseRunning}); err != nil {
+		logger.Error(err, "Unable to report the status")
+	}
+	if progress {
+		onProgress := opts.OnProgress
+		opts.OnProgress = func(percent float64) {
+			if onProgress != nil {
+				onProgress(percent)
+			}
+			client.Progress(percent)
+		}
+	}
+	reportStatus = func(status string, err error) {
+		s := kubestatus.Status{Phase: status}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		if err := client.Report(s); err != nil {
+			logger.Error(err, "Unable to report the status")
+		}
+	}
+	return nil
+}
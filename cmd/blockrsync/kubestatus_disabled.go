@@ -0,0 +1,15 @@
+//go:build !kubestatus
+
+package main
+
+import (
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+)
+
+// startStatusReporting does nothing, build with the kubestatus tag to report
+// the status into a custom resource.
+func startStatusReporting(opts *blockrsync.BlockRsyncOptions, progress bool, logger logr.Logger) error {
+	return nil
+}
@@ -1,20 +1,74 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
 
+	"github.com/go-logr/logr"
 	"go.uber.org/zap/zapcore"
 
 	"github.com/spf13/pflag"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/completion"
+	"github.com/awels/blockrsync/pkg/profiling"
+	"github.com/awels/blockrsync/pkg/syncset"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
+const (
+	// budgetExhaustedExitCode tells the caller the sync stopped early and can
+	// be run again to continue
+	budgetExhaustedExitCode = 3
+	// cancelledExitCode tells the caller the sync was cancelled, the blocks
+	// that were written are on disk and it can be run again to continue
+	cancelledExitCode = 4
+
+	statusRunning         = "running"
+	statusCompleted       = "completed"
+	statusBudgetExhausted = "budget-exhausted"
+	statusCancelled       = "cancelled"
+	statusFailed          = "failed"
+)
+
+// reportStatus reports the outcome of the sync outside of the logs, it is set
+// by startStatusReporting.
+var reportStatus = func(status string, err error) {}
+
+type arrayFlags []string
+
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ",")
+}
+
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
 func usage() {
 	_, _ = fmt.Fprintf(os.Stderr, "Usage: %s [devicepath] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s sync-set [manifest] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s rollback [devicepath] --undo-journal [journal]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s copy [source] [target] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s preflight [devicepath] [--target-address [address] | --target] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s wipe --target-address [address] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s hash [devicepath] --hashes-to [manifest] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s replay [recording] [devicepath] --source|--target [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s soak [source] [target] [flags]\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "       %s completion bash|zsh|fish\n", os.Args[0])
+	_, _ = fmt.Fprintf(os.Stderr, "Files can be given as fd:<number> for a descriptor inherited from the parent, fd:<name> for one passed by systemd, or fd:unix:<socket> for one received from the unix socket\n")
 	flag.PrintDefaults()
 	os.Exit(2)
 }
@@ -25,11 +79,106 @@ func main() {
 		targetMode    = flag.Bool("target", false, "Target mode")
 		targetAddress = flag.String("target-address", "", "address of the server, source only")
 		port          = flag.Int("port", 8000, "port to listen on or connect to")
+		pipe          = flag.Bool("pipe", false, "source and target only, talk to the peer over stdin and stdout instead of connecting or listening, to run the target at the other end of a command like ssh with both directions connected. Logs, the progress bar and the summary go to stderr")
+		statsFile     = flag.String("stats-file", "", "name and path to file to write sync statistics to when finished")
+		excludeRanges = flag.String("exclude-ranges", "", "source and copy only, regions that are neither hashed nor sent, like a swap partition, as comma separated offset:length pairs, or file:<file> with lines of offset and length. Only the blocks entirely within a region are excluded")
+		fillPatterns  = flag.String("fill-patterns", "", "comma separated hex patterns like ff or 0xdeadbeef that the unmapped regions of some arrays hold instead of zeroes, blocks filled with one of them are synced as holes. Each pattern must divide 4096 bytes, must be set on both sides")
+		priorityFile  = flag.String("priority-file", "", "file with lines of byte offset, length and optional weight of regions that change often, they are sent last in each pass")
+		bandwidth     = flag.Int64("bandwidth-limit", 0, "bytes per second shared by all the disks of a sync-set, 0 is unlimited")
+		compression   = flag.String("compression", "auto", "whether the hashes and blocks are compressed: auto skips compression on loopback connections and connections the transport compresses, snappy always compresses, none never does. They are only sent uncompressed if both sides skip compression")
+		tailPolicy    = flag.String("tail-policy", "punch", "target and copy only, what happens to the end of a target device larger than the source: punch empties it like a hole, zero writes zeroes, preserve leaves it alone")
+		holeStrategy  = flag.String("hole-strategy", "auto", "target only, how holes are applied: auto probes the target, punch deallocates the blocks, zero writes zeroes, discard discards the blocks of a device such as a zvol, skip leaves blocks that are known to be empty alone")
+		quiet         = flag.Bool("quiet", false, "only log errors, and print a one line summary once finished")
+		summaryFormat = flag.String("summary-format", "text", "format of the summary printed with quiet, text or json")
+		progressMode  = flag.String("progress", "log", "how the progress is shown: log logs the progress of the transfers, bar draws a progress bar per phase instead of logging when stdout is a terminal")
+		cpuProfile    = flag.String("cpu-profile", "", "write a CPU profile of the sync to this file, the samples are labeled with the blockrsync_stage they were taken in")
+		traceFile     = flag.String("trace", "", "write an execution trace of the sync to this file, with a region per stage")
+		pprofPort     = flag.Int("pprof-port", 0, "serve net/http/pprof on this port of localhost while running, 0 disables")
+		controlListen = flag.String("control-listen", "", "serve the status of the sync on GET /status and cancel it on a POST to /cancel on this address, not used by sync-set")
+		hashAlgorithm = flag.String("hash-algorithm", "blake2b", "how blocks are hashed, must match on both sides: blake2b, sha512, or auto to use sha512 where the CPU computes it like on s390x and arm64 with the SHA512 extension. A comma separated list of <arch>=<algorithm> sets the algorithm per architecture, blake2b for the others")
+		maxCPU        = flag.String("max-cpu", "", "CPUs the sync uses at most, as a number, a percentage like 200% or millicores like 500m, the hash workers are limited to it and hashing and compression pause while over it. Empty is unlimited")
+		seeds         = flag.String("seed-candidates", "", "target only, comma separated local images to hash, the one missing the fewest blocks of the source is copied onto the target before hashing it. The source sends its hashes to the target for it")
+		statusSinks   = flag.String("status-sink", "log", "comma separated sinks of the progress and outcome of the sync: log logs the progress, json:<file> keeps the latest status in a file, fd:<number> writes a JSON line per status to an inherited descriptor, termination-log[:<file>] writes the outcome to /dev/termination-log so kubectl describe pod shows it")
+		checkDuration = flag.Duration("bandwidth-check-duration", 3*time.Second, "preflight only, how long data is sent to measure the bandwidth to the target-address")
+		recordDir     = flag.String("record", "", "record the bytes every connection reads and writes with their timing to a file per connection in this directory, the session can be run again offline with replay")
+		recordElide   = flag.Bool("record-elide", false, "record only the length of what is read and written, so the recordings hold none of the data of the sync. Connections that read data cannot be replayed from such a recording")
+		replayTiming  = flag.Bool("replay-timing", false, "replay only, read the recorded data no earlier than it was read in the recorded session")
+		soakOpts      = blockrsync.SoakOptions{}
+		weights       = flag.String("progress-weights", "", "comma separated phase=weight shares of the phases in the logged overall progress, the phases are hash-source, hash-target, early-sync, sync and copy. The default is hash-source=1,hash-target=1,sync=2,copy=2")
 	)
+	var listeners arrayFlags
 	opts := blockrsync.BlockRsyncOptions{}
+	cutoverOpts := blockrsync.CutoverOptions{}
 
+	flag.IntVar(&soakOpts.Iterations, "soak-iterations", 0, "soak only, stop after this many syncs, 0 doesn't stop")
+	flag.DurationVar(&soakOpts.Duration, "soak-duration", 0, "soak only, stop once the soak test ran for this long, 0 doesn't stop")
+	flag.IntVar(&soakOpts.MutatedBlocks, "soak-mutations", blockrsync.DefaultSoakMutatedBlocks, "soak only, number of blocks of the source changed before every sync, a quarter of them are emptied")
+	flag.Int64Var(&soakOpts.SourceSize, "soak-source-size", blockrsync.DefaultSoakSourceSize, "soak only, size of the scratch source of random data created when it doesn't exist")
+	flag.Int64Var(&soakOpts.Seed, "soak-seed", 1, "soak only, seed of the blocks changed, the same seed changes the same blocks")
+	flag.BoolVar(&soakOpts.StopOnFailure, "soak-stop-on-failure", false, "soak only, stop at the first sync that fails or leaves the target different from the source")
+	flag.BoolVar(&opts.ZeroExcluded, "zero-excluded", false, "source and copy only, empty the excluded regions on the target like holes instead of leaving what it holds there")
 	flag.BoolVar(&opts.Preallocation, "preallocate", false, "Preallocate empty file space")
+	flag.BoolVar(&opts.StreamTarget, "stream-target", false, "target only, write the target in ascending offset order without hashing it, so it can be a pipe or an append only stream, every block of the source is sent")
+	flag.BoolVar(&opts.PreallocateTarget, "preallocate-target", false, "target only, allocate the whole target file before writing so the filesystem can't run out of space during the sync")
+	flag.BoolVar(&opts.TraceBlocks, "trace-blocks", false, "log every block at verbosity 5, otherwise the blocks are logged every 10000 blocks or once a second")
+	flag.BoolVar(&opts.Audit, "audit", false, "record the open flags, fallocate modes, ioctls, fsyncs and truncates of the synced files in the stats, and log the first of each at verbosity 2, to write a SELinux or AppArmor policy")
+	flag.BoolVar(&opts.SkipSpaceCheck, "skip-space-check", false, "target only, accept the sync without checking the filesystem has space for the source")
+	flag.Int64Var(&opts.MaxSourceSize, "max-source-size", 0, "target only, refuse a source larger than this many bytes, 0 is unlimited")
+	flag.Int64Var(&opts.MaxTargetGrowth, "max-target-growth", 0, "target only, refuse a source that grows the target file by more than this many bytes, 0 is unlimited")
+	flag.Float64Var(&opts.Guard.RatePerIP, "max-connection-rate", 0, "target only, new connections per second accepted from an IP until the client connected, 0 is unlimited")
+	flag.IntVar(&opts.Guard.BurstPerIP, "max-connection-burst", 1, "target only, connections an IP can open at once with max-connection-rate")
+	flag.IntVar(&opts.Guard.MaxPending, "max-pending-connections", 0, "target only, most connections handshaking at once until the client connected, 0 is unlimited")
+	flag.DurationVar(&opts.Guard.HandshakeTimeout, "handshake-timeout", 0, "target only, close connections that don't complete the handshake in time, 0 waits forever. Any of the connection limits keeps accepting connections until one completes the handshake")
 	flag.IntVar(&opts.BlockSize, "block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+	flag.IntVar(&opts.ApplyWindow, "apply-window", 0, "number of received blocks to buffer and write in offset order, for rotational targets. Uses apply-window * block-size memory")
+	flag.IntVar(&opts.CompressionChunkSize, "compression-chunk-size", blockrsync.MaxCompressionChunkSize, "uncompressed size of a compressed chunk, must be > 0 and <= 65536")
+	flag.BoolVar(&opts.ProbeRecordSize, "probe-record-size", false, "probe the path to the peer when the session starts, and write smaller records than --compression-chunk-size through tunnels like overlay networks and VPNs")
+	flag.DurationVar(&opts.FlushInterval, "flush-interval", blockrsync.DefaultFlushInterval, "flush partially filled compressed chunks when the sender pauses for this long, 0 disables")
+	flag.IntVar(&opts.HashLength, "hash-length", 0, "truncate the block hashes sent by the target to this many bytes, between 16 and 64, 0 sends complete hashes")
+	flag.BoolVar(&opts.BloomFilter, "bloom-filter", false, "exchange a bloom filter of the target first so definitely different blocks are sent early, must be set on both sides")
+	flag.BoolVar(&opts.SourceDigest, "source-digest", false, "compute a digest of the source while hashing it, the target compares it with a digest of what it wrote once the sync is on disk, must be set on both sides")
+	flag.BoolVar(&opts.StreamChecksum, "stream-checksum", false, "compare a CRC32C of the transferred records at the end of every pass, or a CRC32 with older peers, must be set on both sides")
+	flag.IntVar(&opts.Passes, "passes", 1, "maximum number of passes, more than 1 syncs blocks that changed during the previous pass until the passes converge")
+	flag.Int64Var(&opts.ConvergeBlocks, "converge-blocks", 0, "stop the passes once a pass has at most this many dirty blocks")
+	flag.StringVar(&cutoverOpts.File, "cutover-file", "", "after the passes converged, wait for this file to exist before the final pass. <file>.done is written when the final pass completes")
+	flag.BoolVar(&cutoverOpts.Signal, "cutover-signal", false, "after the passes converged, wait for SIGUSR1 before the final pass")
+	flag.StringVar(&cutoverOpts.ListenAddress, "cutover-listen", "", "after the passes converged, wait for a POST to /cutover on this address before the final pass, the request completes with the final pass report")
+	flag.DurationVar(&opts.MaxDuration, "max-duration", 0, "stop sending blocks once the sync ran for this long, 0 is unlimited")
+	flag.Int64Var(&opts.MaxBytes, "max-bytes", 0, "stop sending blocks once this many bytes were sent, 0 is unlimited")
+	flag.BoolVar(&opts.BestEffortHoles, "best-effort-holes", false, "target and copy only, record the holes that can't be applied as degraded regions in the stats instead of failing, they may hold stale data")
+	flag.StringVar(&opts.TLS.CertFile, "tls-cert", "", "PEM certificate presented to the peer, the target requires TLS with it, the source presents it for mutual TLS")
+	flag.StringVar(&opts.TLS.KeyFile, "tls-key", "", "PEM key of tls-cert")
+	flag.StringVar(&opts.TLS.CAFile, "tls-ca", "", "PEM file of the CA certificates the peer is verified with. The source connects with TLS and verifies the target with the system roots if empty, the target requires a client certificate signed by them")
+	flag.Var(&listeners, "listen", "target only, <host:port>[,cert=<file>,key=<file>][,ca=<file>] or <host:port>,plaintext another address to listen on besides port, like a migration network, with its own TLS settings, the TLS flags if none. Multiple allowed")
+	flag.Var((*arrayFlags)(&opts.AlternateTargets), "alternate-target", "source only, another host:port of the target, the source connects to all of them and syncs over the path that completes the handshake first. Multiple allowed")
+	flag.StringVar(&opts.ListenSocket, "listen-socket", "", "target only, listen on this unix domain socket instead of port, when the source runs on the same host")
+	flag.StringVar(&opts.ConnectSocket, "connect-socket", "", "source only, connect to the target on this unix domain socket instead of target-address and port")
+	flag.StringVar(&opts.TLS.ServerName, "tls-server-name", "", "source only, the name verified in the certificate of the target, the target address if empty")
+	flag.StringVar(&opts.DiffFile, "diff-file", "", "source and copy only, write a JSON line for every block that differs, with the reason and the hashes of the source and target, to this file")
+	flag.StringVar(&opts.BitmapFile, "bitmap-file", "", "source only, write a bitmap with a bit for every block sent in a pass to this file with the pass appended, like file.1")
+	flag.StringVar(&opts.SavingsFile, "savings-file", "", "add the bytes every completed sync did not send, because the target held them, they were holes or were cloned, to this file")
+	flag.StringVar(&opts.CheckpointFile, "checkpoint-file", "", "file to record the remaining blocks in when a budget stops the sync, removed once a sync completes")
+	flag.Int64Var(&opts.ReadLimit, "read-limit", 0, "bytes per second read from the device, 0 is unlimited")
+	flag.StringVar(&opts.UndoJournal, "undo-journal", "", "target only, save the blocks of the device before they are overwritten to this file, so the sync can be undone with rollback")
+	flag.StringVar(&opts.GenerationFile, "generation-file", "", "target only, record the generation, pass and source digest the device holds in this file after every pass")
+	flag.Int64Var(&opts.Generation, "generation", 0, "target only, generation being synced, 0 is the generation after the one the device holds, or the one it holds if its sync did not complete")
+	flag.BoolVar(&opts.AllowDowngrade, "allow-downgrade", false, "target only, allow syncing an older generation than the device holds")
+	flag.StringVar(&opts.HashesFrom, "hashes-from", "", "target only, use the hashes of this manifest written by hash or hashes-to instead of reading the target to hash it. The target must not have changed since, a target of another size is hashed")
+	flag.StringVar(&opts.HashesTo, "hashes-to", "", "target only, write the hashes of the target to this manifest after every completed pass, so the next sync can use it with hashes-from. With hash, the manifest the device is hashed to")
+	flag.StringVar(&opts.Seed, "seed", "", "target only, copy this local image onto the target before hashing it, so only the blocks the image is missing are sent. It is cloned on a reflink capable filesystem")
+	flag.IntVar(&opts.HashConcurrency, "hash-concurrency", blockrsync.DefaultHashConcurrency, "number of blocks hashed in parallel")
+	flag.StringVar(&opts.HashAffinity, "hash-affinity", "", "advanced, pin the hash workers to CPUs: device uses the CPUs of the NUMA node the device is attached to, or a CPU list like 0-7,16-23. Empty doesn't pin them")
+	flag.IntVar(&opts.ReadAhead, "read-ahead", blockrsync.DefaultReadAhead, "source only, number of runs of dirty blocks read ahead of the network")
+	flag.BoolVar(&opts.Adaptive, "adaptive", false, "tune the blocks hashed in parallel, the runs read ahead and the apply window while syncing from the throughput they see, hash-concurrency, read-ahead and apply-window are the starting values, apply-window is also the largest window")
+	flag.IntVar(&opts.MaxReadSize, "max-read-size", blockrsync.DefaultMaxReadSize, "source only, largest read of contiguous dirty blocks in bytes")
+	flag.Int64Var(&opts.ShardSize, "shard-size", 0, "sync in shards of this many bytes that are hashed, sent and acknowledged on their own, must be set on both sides, the source decides the size")
+	flag.StringVar(&opts.ShardStateFile, "shard-state", "", "target only, file recording the completed shards, so a sharded sync that stopped resumes after them")
+	flag.BoolVar(&opts.Resume, "resume", false, "hash the blocks the target applied before a sync of the same source stopped from the resume journal, must be set on both sides")
+	flag.StringVar(&opts.ResumeJournal, "resume-journal", "", "target only, file recording the blocks on disk for resume, <target>.resume by default")
+	flag.Int64Var(&opts.PipelineShardSize, "pipeline-shard-size", 0, "source only, diff and send the first pass in shards of this many bytes while the source is hashed, 0 hashes the source first")
+	flag.IntVar(&opts.ConnectRetries, "connect-retries", blockrsync.DefaultConnectRetries, "source only, number of attempts to connect to the target")
+	flag.DurationVar(&opts.RetryInterval, "retry-interval", blockrsync.DefaultRetryInterval, "source only, time between attempts to connect to the target")
+	flag.StringVar(&opts.Compat, "compat", "", "force an older protocol to talk to peers that were not upgraded, only v0 is supported")
 
 	zapopts := zap.Options{
 		Development: true,
@@ -42,31 +191,271 @@ func main() {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
 	pflag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		if len(os.Args) < 3 {
+			usage()
+		}
+		if err := completion.Write(os.Stdout, os.Args[2], completionCommand(filepath.Base(os.Args[0])), pflag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		return
+	}
+	// In pipe mode stdout carries the protocol
+	out := os.Stdout
+	if *pipe {
+		out = os.Stderr
+		zapopts.DestWriter = os.Stderr
+	}
+	if *progressMode != "log" && *progressMode != "bar" {
+		fmt.Fprintf(os.Stderr, "progress must be log or bar\n")
+		usage()
+	}
+	if *progressMode == "bar" && *quiet {
+		fmt.Fprintf(os.Stderr, "progress bar cannot be used with quiet\n")
+		usage()
+	}
+	// A bar is only drawn for a single sync on a terminal
+	progressBar := *progressMode == "bar" && isTerminal(out) && !(len(os.Args) > 1 && os.Args[1] == "sync-set")
+	if *quiet || progressBar {
+		zapopts.Level = zapcore.ErrorLevel
+	}
+	if progressBar {
+		opts.NewProgress = func(phase string) blockrsync.Progress {
+			return blockrsync.NewProgressBar(out, phase)
+		}
+	}
+	if *weights != "" {
+		var err error
+		if opts.ProgressWeights, err = blockrsync.ParseProgressWeights(*weights); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+	}
 	logger := zap.New(zap.UseFlagOptions(&zapopts))
+	if err := startSinks(*statusSinks, !(len(os.Args) > 1 && os.Args[1] == "sync-set"), progressBar, &opts.OnProgress, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	if err := startStatusReporting(&opts, !(len(os.Args) > 1 && os.Args[1] == "sync-set"), logger.WithName("status")); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to report the status: %v\n", err)
+		os.Exit(1)
+	}
+	if err := startProfiling(*cpuProfile, *traceFile, logger); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	if *pprofPort != 0 {
+		if _, err := profiling.Serve(*pprofPort, logger.WithName("pprof")); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to serve pprof: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	summary := &summaryPrinter{out: out, enabled: *quiet, format: *summaryFormat, start: time.Now()}
 
-	if opts.BlockSize <= 0 || opts.BlockSize%4096 != 0 {
-		fmt.Fprintf(os.Stderr, "block-size must be > 0 and a multiple of 4096\n")
+	if *summaryFormat != "text" && *summaryFormat != "json" {
+		fmt.Fprintf(os.Stderr, "summary-format must be text or json\n")
+		usage()
+	}
+	if opts.Passes < 1 {
+		fmt.Fprintf(os.Stderr, "passes must be >= 1\n")
+		usage()
+	}
+	strategy, err := blockrsync.ParseHoleStrategy(*holeStrategy)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	opts.HoleStrategy = strategy
+	if opts.TailPolicy, err = blockrsync.ParseTailPolicy(*tailPolicy); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		usage()
 	}
-	if *sourceMode && !*targetMode {
-		if targetAddress == nil || *targetAddress == "" {
-			fmt.Fprintf(os.Stderr, "target-address must be specified with source flag\n")
+	compressionMode, err := blockrsync.ParseCompressionMode(*compression)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	opts.Compression = compressionMode
+	if opts.HashAlgorithm, err = blockrsync.ParseHashAlgorithm(*hashAlgorithm); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	if *maxCPU != "" {
+		if opts.MaxCPU, err = blockrsync.ParseCPULimit(*maxCPU); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		// Keep the runtime from running more threads than the limit allows
+		runtime.GOMAXPROCS(int(math.Ceil(opts.MaxCPU)))
+	}
+	if *seeds != "" {
+		opts.SeedCandidates = strings.Split(*seeds, ",")
+	}
+	if *priorityFile != "" {
+		priorities, err := blockrsync.LoadBlockPrioritiesFile(*priorityFile, int64(opts.BlockSize))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load priority file: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Priorities = priorities
+	}
+	for _, value := range listeners {
+		listener, err := blockrsync.ParseListener(value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		opts.Listeners = append(opts.Listeners, listener)
+	}
+	if *excludeRanges != "" {
+		var excluded blockrsync.ExcludedRanges
+		var err error
+		if file, ok := strings.CutPrefix(*excludeRanges, "file:"); ok {
+			excluded, err = blockrsync.LoadExcludedRangesFile(file)
+		} else {
+			excluded, err = blockrsync.ParseExcludedRanges(*excludeRanges)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to load excluded ranges: %v\n", err)
+			os.Exit(1)
+		}
+		opts.ExcludeRanges = excluded
+	}
+	if *fillPatterns != "" {
+		patterns, err := blockrsync.ParseFillPatterns(*fillPatterns)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		opts.FillPatterns = patterns
+	}
+	if cutoverOpts != (blockrsync.CutoverOptions{}) {
+		barrier, err := blockrsync.NewCutoverBarrier(cutoverOpts, logger.WithName("cutover"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		opts.Cutover = barrier
+	}
+	if *pipe {
+		if err := checkPipe(&opts, *targetAddress); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			usage()
+		}
+		opts.Transport = transport.NewPipe(os.Stdin, os.Stdout)
+	}
+	if *recordDir != "" {
+		recorder, err := transport.NewRecorder(*recordDir, *recordElide)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to record: %v\n", err)
+			os.Exit(1)
+		}
+		opts.Transport = transport.Wrap(transport.OrDefault(opts.Transport), recorder)
+	}
+	if err := opts.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		usage()
+	}
+	if len(os.Args) > 2 && os.Args[1] == "rollback" {
+		if opts.UndoJournal == "" {
+			fmt.Fprintf(os.Stderr, "undo-journal must be specified with rollback\n")
+			usage()
+		}
+		if err := blockrsync.Rollback(opts.UndoJournal, os.Args[2], logger.WithName("rollback")); err != nil {
+			logger.Error(err, "Unable to roll back", "target file", os.Args[2], "journal", opts.UndoJournal)
+			os.Exit(1)
+		}
+		logger.Info("Successfully rolled back")
+		return
+	} else if len(os.Args) > 3 && os.Args[1] == "copy" {
+		localCopy := blockrsync.NewLocalCopy(os.Args[2], os.Args[3], &opts, logger)
+		cancelOn(localCopy, *controlListen, logger)
+		if err := localCopy.Copy(); errors.Is(err, blockrsync.ErrCancelled) {
+			exitCancelled(*statsFile, localCopy.Stats(), summary, logger)
+		} else if err != nil {
+			logger.Error(err, "Unable to copy", "source file", os.Args[2], "target file", os.Args[3])
+			finish(*statsFile, localCopy.Stats(), statusFailed, err, summary, logger)
+			os.Exit(1)
+		}
+		finish(*statsFile, localCopy.Stats(), statusCompleted, nil, summary, logger)
+	} else if len(os.Args) > 2 && os.Args[1] == "sync-set" {
+		if *bandwidth < 0 {
+			fmt.Fprintf(os.Stderr, "bandwidth-limit must be >= 0\n")
+			usage()
+		}
+		runSyncSet(os.Args[2], &opts, syncset.Options{BandwidthLimit: *bandwidth}, *statsFile, summary, logger)
+	} else if len(os.Args) > 2 && os.Args[1] == "preflight" {
+		runSelfCheck(os.Args[2], &opts, *targetAddress, *port, *targetMode, *checkDuration, *summaryFormat, logger)
+		return
+	} else if len(os.Args) > 2 && os.Args[1] == "hash" {
+		if opts.HashesTo == "" {
+			fmt.Fprintf(os.Stderr, "hashes-to must be specified with hash\n")
+			usage()
+		}
+		manifest, err := blockrsync.HashToManifest(os.Args[2], &opts, logger.WithName("hasher"))
+		if err == nil {
+			err = manifest.WriteFile(opts.HashesTo)
+		}
+		if err != nil {
+			logger.Error(err, "Unable to hash", "file", os.Args[2], "manifest", opts.HashesTo)
+			os.Exit(1)
+		}
+		logger.Info("Wrote hash manifest", "file", os.Args[2], "manifest", opts.HashesTo, "blocks", len(manifest.Hashes))
+		return
+	} else if len(os.Args) > 3 && os.Args[1] == "replay" {
+		runReplay(os.Args[2], os.Args[3], &opts, *sourceMode, *targetMode, *replayTiming, *statsFile, summary, logger)
+	} else if len(os.Args) > 3 && os.Args[1] == "soak" {
+		runSoak(os.Args[2], os.Args[3], soakOpts, &opts, *controlListen, *statsFile, *summaryFormat, logger)
+		return
+	} else if len(os.Args) > 1 && os.Args[1] == "wipe" {
+		if *targetAddress == "" && opts.ConnectSocket == "" && !*pipe {
+			fmt.Fprintf(os.Stderr, "target-address, connect-socket or pipe must be specified with wipe\n")
+			usage()
+		}
+		blockrsyncClient := blockrsync.NewBlockrsyncClient("", *targetAddress, *port, &opts, logger)
+		cancelOn(blockrsyncClient, *controlListen, logger)
+		if err := blockrsyncClient.Wipe(); errors.Is(err, blockrsync.ErrCancelled) {
+			exitCancelled(*statsFile, blockrsyncClient.Stats(), summary, logger)
+		} else if err != nil {
+			logger.Error(err, "Unable to wipe target", "target address", *targetAddress)
+			finish(*statsFile, blockrsyncClient.Stats(), statusFailed, err, summary, logger)
+			os.Exit(1)
+		}
+		finish(*statsFile, blockrsyncClient.Stats(), statusCompleted, nil, summary, logger)
+	} else if *sourceMode && !*targetMode {
+		if (targetAddress == nil || *targetAddress == "") && opts.ConnectSocket == "" && !*pipe {
+			fmt.Fprintf(os.Stderr, "target-address, connect-socket or pipe must be specified with source flag\n")
 			usage()
 			os.Exit(1)
 		}
 		blockrsyncClient := blockrsync.NewBlockrsyncClient(os.Args[1], *targetAddress, *port, &opts, logger)
-		if err := blockrsyncClient.ConnectToTarget(); err != nil {
+		cancelOn(blockrsyncClient, *controlListen, logger)
+		if err := blockrsyncClient.ConnectToTarget(); errors.Is(err, blockrsync.ErrBudgetExhausted) {
+			logger.Info("Transfer budget exhausted, run the sync again to continue")
+			finish(*statsFile, blockrsyncClient.Stats(), statusBudgetExhausted, err, summary, logger)
+			os.Exit(budgetExhaustedExitCode)
+		} else if errors.Is(err, blockrsync.ErrCancelled) {
+			exitCancelled(*statsFile, blockrsyncClient.Stats(), summary, logger)
+		} else if err != nil {
 			logger.Error(err, "Unable to connect to target", "source file", os.Args[1], "target address", *targetAddress)
 			// time.Sleep(5 * time.Minute)
+			finish(*statsFile, blockrsyncClient.Stats(), statusFailed, err, summary, logger)
 			os.Exit(1)
 		}
+		finish(*statsFile, blockrsyncClient.Stats(), statusCompleted, nil, summary, logger)
 	} else if *targetMode && !*sourceMode {
 		blockrsyncServer := blockrsync.NewBlockrsyncServer(os.Args[1], *port, &opts, logger)
-		if err := blockrsyncServer.StartServer(); err != nil {
+		cancelOn(blockrsyncServer, *controlListen, logger)
+		if err := blockrsyncServer.StartServer(); errors.Is(err, blockrsync.ErrCancelled) {
+			exitCancelled(*statsFile, blockrsyncServer.Stats(), summary, logger)
+		} else if err != nil {
 			logger.Error(err, "Unable to start server to write to file", "target file", os.Args[1])
 			// time.Sleep(5 * time.Minute)
+			finish(*statsFile, blockrsyncServer.Stats(), statusFailed, err, summary, logger)
 			os.Exit(1)
 		}
+		finish(*statsFile, blockrsyncServer.Stats(), statusCompleted, nil, summary, logger)
 	} else {
 		fmt.Fprintf(os.Stderr, "Either source or target must be defined\n")
 		usage()
@@ -75,3 +464,238 @@ func main() {
 	// time.Sleep(5 * time.Minute)
 	logger.Info("Successfully completed sync")
 }
+
+func runSyncSet(manifestFile string, opts *blockrsync.BlockRsyncOptions, setOpts syncset.Options, statsFile string, summary *summaryPrinter, logger logr.Logger) {
+	if opts.Cutover != nil {
+		fmt.Fprintf(os.Stderr, "cutover flags cannot be used with sync-set\n")
+		usage()
+	}
+	manifest, err := syncset.LoadManifest(manifestFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	result, err := syncset.NewSyncSet(manifest, opts, setOpts, logger.WithName("sync-set")).Run(context.Background())
+	stopProfiling()
+	if result != nil && statsFile != "" {
+		if serr := result.WriteFile(statsFile); serr != nil {
+			logger.Error(serr, "Unable to write stats file", "file", statsFile)
+		}
+	}
+	var setErr *syncset.SetError
+	if errors.As(err, &setErr) && setErr.BudgetExhausted() {
+		logger.Info("Transfer budget exhausted, run the sync set again to continue")
+		reportStatus(statusBudgetExhausted, err)
+		finishSinks(statusBudgetExhausted, err, result.Summary(), result)
+		summary.print(statusBudgetExhausted, result.Summary(), result)
+		os.Exit(budgetExhaustedExitCode)
+	} else if err != nil {
+		logger.Error(err, "Unable to sync set", "manifest", manifestFile)
+		reportStatus(statusFailed, err)
+		if result != nil {
+			finishSinks(statusFailed, err, result.Summary(), result)
+			summary.print(statusFailed, result.Summary(), result)
+		} else {
+			finishSinks(statusFailed, err, "", nil)
+		}
+		os.Exit(1)
+	}
+	reportStatus(statusCompleted, nil)
+	finishSinks(statusCompleted, nil, result.Summary(), result)
+	summary.print(statusCompleted, result.Summary(), result)
+}
+
+// runSelfCheck checks the device can be synced, and measures the bandwidth to
+// the target address or serves the bandwidth check to a source. It exits with
+// 1 if a check failed.
+func runSelfCheck(path string, opts *blockrsync.BlockRsyncOptions, targetAddress string, port int, serve bool, duration time.Duration, format string, logger logr.Logger) {
+	results := blockrsync.SelfCheck(path)
+	if targetAddress != "" {
+		results = append(results, blockrsync.CheckBandwidthTo(targetAddress, port, opts, duration))
+	} else if serve {
+		logger.Info("Serving the bandwidth check", "port", port)
+		result := blockrsync.CheckResult{Check: blockrsync.CheckBandwidth, Passed: true, Detail: "served to the source"}
+		if err := blockrsync.ServeBandwidthCheck(port, opts); err != nil {
+			result = blockrsync.CheckResult{Check: blockrsync.CheckBandwidth, Detail: err.Error()}
+		}
+		results = append(results, result)
+	}
+	failed := false
+	for _, result := range results {
+		failed = failed || !result.Passed
+	}
+	if format == "json" {
+		data, err := json.Marshal(struct {
+			Passed bool                     `json:"passed"`
+			Checks []blockrsync.CheckResult `json:"checks"`
+		}{!failed, results})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to marshal checks: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, result := range results {
+			status := "PASS"
+			if !result.Passed {
+				status = "FAIL"
+			}
+			fmt.Printf("%s %-10s %s\n", status, result.Check, result.Detail)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// runReplay runs the source or target of a recorded session again, reading
+// what the recorded connections read.
+func runReplay(recording, path string, opts *blockrsync.BlockRsyncOptions, source, target, timing bool, statsFile string, summary *summaryPrinter, logger logr.Logger) {
+	if source == target {
+		fmt.Fprintf(os.Stderr, "Either source or target must be defined with replay\n")
+		usage()
+	}
+	replay, err := transport.NewReplay(recording, timing)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	opts.Transport = replay
+	var stats *blockrsync.Stats
+	if source {
+		client := blockrsync.NewBlockrsyncClient(path, "replay", 0, opts, logger)
+		stats = client.Stats()
+		err = client.ConnectToTarget()
+	} else {
+		server := blockrsync.NewBlockrsyncServer(path, 0, opts, logger)
+		stats = server.Stats()
+		err = server.StartServer()
+	}
+	if written, recorded := replay.Written(); written != recorded {
+		logger.Info("The replay wrote a different number of bytes than the recorded session", "written", written, "recorded", recorded)
+	}
+	if err != nil {
+		logger.Error(err, "Replay failed", "recording", recording, "file", path)
+		finish(statsFile, stats, statusFailed, err, summary, logger)
+		os.Exit(1)
+	}
+	finish(statsFile, stats, statusCompleted, nil, summary, logger)
+}
+
+// exitCancelled finishes a cancelled sync and exits with cancelledExitCode.
+func exitCancelled(statsFile string, stats *blockrsync.Stats, summary *summaryPrinter, logger logr.Logger) {
+	logger.Info("Sync cancelled, run the sync again to continue")
+	finish(statsFile, stats, statusCancelled, blockrsync.ErrCancelled, summary, logger)
+	os.Exit(cancelledExitCode)
+}
+
+// finish writes the stats file, reports the status and prints the summary of
+// a sync.
+func finish(statsFile string, stats *blockrsync.Stats, status string, err error, summary *summaryPrinter, logger logr.Logger) {
+	stopProfiling()
+	writeStatsFile(statsFile, stats, logger)
+	reportStatus(status, err)
+	finishSinks(status, err, stats.Summary(), stats)
+	summary.print(status, stats.Summary(), stats)
+}
+
+// summaryPrinter prints the outcome of a sync on a single line in quiet mode,
+// as text or as JSON with the complete stats.
+type summaryPrinter struct {
+	out     io.Writer
+	enabled bool
+	format  string
+	start   time.Time
+}
+
+func (p *summaryPrinter) print(status, summary string, stats interface{}) {
+	if !p.enabled {
+		return
+	}
+	elapsed := time.Since(p.start)
+	if p.format == "json" {
+		data, err := json.Marshal(struct {
+			Status              string      `json:"status"`
+			ElapsedMilliseconds int64       `json:"elapsedMilliseconds"`
+			Stats               interface{} `json:"stats"`
+		}{status, elapsed.Milliseconds(), stats})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to marshal summary: %v\n", err)
+			return
+		}
+		fmt.Fprintln(p.out, string(data))
+		return
+	}
+	fmt.Fprintf(p.out, "%s in %s: %s\n", status, elapsed.Round(time.Millisecond), summary)
+}
+
+// checkPipe rejects the flags that connect or listen some other way than the
+// pipe.
+func checkPipe(opts *blockrsync.BlockRsyncOptions, targetAddress string) error {
+	switch {
+	case len(os.Args) > 1 && (os.Args[1] == "sync-set" || os.Args[1] == "preflight" || os.Args[1] == "replay" || os.Args[1] == "soak" || os.Args[1] == "copy"):
+		return fmt.Errorf("pipe cannot be used with %s", os.Args[1])
+	case targetAddress != "":
+		return errors.New("pipe cannot be used with target-address")
+	case opts.ListenSocket != "" || opts.ConnectSocket != "":
+		return errors.New("pipe cannot be used with a unix socket")
+	case len(opts.Listeners) > 0:
+		return errors.New("pipe cannot be used with listen")
+	case len(opts.AlternateTargets) > 0:
+		return errors.New("pipe cannot be used with alternate-target")
+	}
+	return nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func writeStatsFile(fileName string, stats *blockrsync.Stats, logger logr.Logger) {
+	if fileName == "" {
+		return
+	}
+	if err := stats.WriteFile(fileName); err != nil {
+		logger.Error(err, "Unable to write stats file", "file", fileName)
+	}
+}
+
+// runSoak mutates, syncs and verifies the scratch source until a limit is
+// reached or it is cancelled, and prints the report. It exits with 1 if an
+// iteration failed.
+func runSoak(source, target string, soakOpts blockrsync.SoakOptions, opts *blockrsync.BlockRsyncOptions, controlListen, statsFile, format string, logger logr.Logger) {
+	if soakOpts.Iterations < 0 || soakOpts.Duration < 0 || soakOpts.MutatedBlocks < 0 || soakOpts.SourceSize < 0 {
+		fmt.Fprintf(os.Stderr, "soak-iterations, soak-duration, soak-mutations and soak-source-size must be >= 0\n")
+		usage()
+	}
+	soakTest := blockrsync.NewSoakTest(source, target, soakOpts, opts, logger.WithName("soak"))
+	cancelOn(soakTest, controlListen, logger)
+	report, err := soakTest.Run()
+	stopProfiling()
+	if err != nil {
+		logger.Error(err, "Soak test failed", "source file", source, "target file", target)
+		os.Exit(1)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to marshal soak report: %v\n", err)
+		os.Exit(1)
+	}
+	if statsFile != "" {
+		if err := os.WriteFile(statsFile, data, 0644); err != nil {
+			logger.Error(err, "Unable to write stats file", "file", statsFile)
+		}
+	}
+	if format == "json" {
+		fmt.Println(string(data))
+	} else {
+		fmt.Println(report.Summary())
+		for _, failed := range report.Failed {
+			fmt.Printf("FAIL iteration %d: %d mismatched blocks %v %s\n", failed.Iteration, len(failed.Mismatches), failed.Mismatches, failed.Error)
+		}
+	}
+	if report.Failures > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/go-logr/logr"
+)
+
+// stopProfiling stops the CPU profile and the execution trace, it is called
+// once the sync finished since the command exits without running defers.
+var stopProfiling = func() {}
+
+// startProfiling writes a CPU profile to cpuProfile and an execution trace to
+// traceFile until stopProfiling is called, empty names are not written. The
+// samples are labeled with the blockrsync stage they were taken in.
+func startProfiling(cpuProfile, traceFile string, logger logr.Logger) error {
+	var stops []func()
+	if cpuProfile != "" {
+		f, err := os.Create(cpuProfile)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to start the CPU profile: %w", err)
+		}
+		stops = append(stops, func() {
+			pprof.StopCPUProfile()
+			closeProfile(f, logger)
+		})
+	}
+	if traceFile != "" {
+		f, err := os.Create(traceFile)
+		if err != nil {
+			return err
+		}
+		if err := trace.Start(f); err != nil {
+			f.Close()
+			return fmt.Errorf("unable to start the trace: %w", err)
+		}
+		stops = append(stops, func() {
+			trace.Stop()
+			closeProfile(f, logger)
+		})
+	}
+	stopProfiling = func() {
+		for _, stop := range stops {
+			stop()
+		}
+		stops = nil
+	}
+	return nil
+}
+
+func closeProfile(f *os.File, logger logr.Logger) {
+	if err := f.Close(); err != nil {
+		logger.Error(err, "Unable to write profile", "file", f.Name())
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// terminationLogFile is read by the kubelet into the termination message
+	// of the container
+	terminationLogFile = "/dev/termination-log"
+	// maxTerminationMessage is the most the kubelet reads of the termination
+	// log
+	maxTerminationMessage = 4096
+)
+
+// finishSinks reports the outcome of the sync to the status sinks, it is set
+// by startSinks.
+var finishSinks = func(status string, err error, summary string, stats interface{}) {}
+
+// statusSink receives the overall progress of a sync and its outcome.
+type statusSink interface {
+	progress(percent float64)
+	finish(status string, err error, summary string, stats interface{})
+}
+
+// statusEvent is written by the JSON sinks.
+type statusEvent struct {
+	Status  string      `json:"status"`
+	Percent float64     `json:"percent"`
+	Error   string      `json:"error,omitempty"`
+	Summary string      `json:"summary,omitempty"`
+	Stats   interface{} `json:"stats,omitempty"`
+}
+
+func newStatusEvent(status string, err error, summary string, stats interface{}) statusEvent {
+	event := statusEvent{Status: status, Summary: summary, Stats: stats}
+	if status == statusCompleted {
+		event.Percent = 100
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	return event
+}
+
+// parseSinks parses a comma separated list of status sinks: log logs the
+// progress, json:<file> keeps the latest status in a file, fd:<number> writes
+// a JSON line per status to an inherited descriptor, and
+// termination-log[:<file>] writes the outcome to the termination log of a
+// Kubernetes container.
+func parseSinks(spec string, logger logr.Logger) ([]statusSink, error) {
+	var sinks []statusSink
+	for _, entry := range strings.Split(spec, ",") {
+		kind, arg, _ := strings.Cut(entry, ":")
+		switch kind {
+		case "log":
+			sinks = append(sinks, &logSink{log: logger})
+		case "json":
+			if arg == "" {
+				return nil, fmt.Errorf("status sink %q needs a file", entry)
+			}
+			sinks = append(sinks, &jsonFileSink{file: arg})
+		case "fd":
+			fd, err := strconv.Atoi(arg)
+			if err != nil || fd < 0 {
+				return nil, fmt.Errorf("invalid descriptor in status sink %q", entry)
+			}
+			f := os.NewFile(uintptr(fd), entry)
+			if _, err := f.Stat(); err != nil {
+				return nil, fmt.Errorf("status sink %q: %w", entry, err)
+			}
+			sinks = append(sinks, &jsonLinesSink{w: f})
+		case "termination-log":
+			if arg == "" {
+				arg = terminationLogFile
+			}
+			sinks = append(sinks, &terminationLogSink{file: arg})
+		default:
+			return nil, fmt.Errorf("invalid status sink %q, must be log, json:<file>, fd:<number> or termination-log[:<file>]", entry)
+		}
+	}
+	return sinks, nil
+}
+
+// startSinks reports the progress of a single sync to the sinks, and the
+// outcome when finishSinks is called. Progress is not logged with a progress
+// bar.
+func startSinks(spec string, progress, progressBar bool, onProgress *func(percent float64), logger logr.Logger) error {
+	sinks, err := parseSinks(spec, logger)
+	if err != nil {
+		return err
+	}
+	if progress {
+		var reporting []statusSink
+		for _, sink := range sinks {
+			if _, ok := sink.(*logSink); ok && progressBar {
+				continue
+			}
+			reporting = append(reporting, sink)
+		}
+		if len(reporting) > 0 {
+			next := *onProgress
+			report := throttled(func(percent float64) {
+				for _, sink := range reporting {
+					sink.progress(percent)
+				}
+			})
+			*onProgress = func(percent float64) {
+				if next != nil {
+					next(percent)
+				}
+				report(percent)
+			}
+		}
+	}
+	finishSinks = func(status string, err error, summary string, stats interface{}) {
+		for _, sink := range sinks {
+			sink.finish(status, err, summary, stats)
+		}
+	}
+	return nil
+}
+
+// reportSinkError prints the error of a sink, a sink that fails doesn't fail
+// the sync.
+func reportSinkError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+	}
+}
+
+// throttled calls report at most once a second, and always at 100%.
+func throttled(report func(percent float64)) func(percent float64) {
+	var lastReport time.Time
+	return func(percent float64) {
+		if time.Since(lastReport) >= time.Second || percent == 100 {
+			report(percent)
+			lastReport = time.Now()
+		}
+	}
+}
+
+// logSink logs the progress, the outcome is logged by the sync.
+type logSink struct {
+	log logr.Logger
+}
+
+func (s *logSink) progress(percent float64) {
+	s.log.Info(fmt.Sprintf("Overall progress %.0f%%", percent))
+}
+
+func (s *logSink) finish(status string, err error, summary string, stats interface{}) {}
+
+// jsonFileSink replaces the file with the latest status.
+type jsonFileSink struct {
+	file string
+}
+
+func (s *jsonFileSink) progress(percent float64) {
+	reportSinkError(s.write(statusEvent{Status: statusRunning, Percent: percent}))
+}
+
+func (s *jsonFileSink) finish(status string, err error, summary string, stats interface{}) {
+	reportSinkError(s.write(newStatusEvent(status, err, summary, stats)))
+}
+
+func (s *jsonFileSink) write(event statusEvent) error {
+	data, err := json.MarshalIndent(event, "", "  ")
+	if err != nil {
+		return fmt.Errorf("unable to marshal status: %w", err)
+	}
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("unable to write status file: %w", err)
+	}
+	if err := os.Rename(tmp, s.file); err != nil {
+		return fmt.Errorf("unable to write status file: %w", err)
+	}
+	return nil
+}
+
+// jsonLinesSink writes a JSON line per status.
+type jsonLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonLinesSink) progress(percent float64) {
+	reportSinkError(s.write(statusEvent{Status: statusRunning, Percent: percent}))
+}
+
+func (s *jsonLinesSink) finish(status string, err error, summary string, stats interface{}) {
+	reportSinkError(s.write(newStatusEvent(status, err, summary, stats)))
+}
+
+func (s *jsonLinesSink) write(event statusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := json.NewEncoder(s.w).Encode(event); err != nil {
+		return fmt.Errorf("unable to write status: %w", err)
+	}
+	return nil
+}
+
+// terminationLogSink writes the outcome to the termination log, so it is shown
+// by kubectl describe pod. The stats are left out, the kubelet reads at most
+// maxTerminationMessage bytes.
+type terminationLogSink struct {
+	file string
+}
+
+func (s *terminationLogSink) progress(percent float64) {}
+
+func (s *terminationLogSink) finish(status string, err error, summary string, stats interface{}) {
+	reportSinkError(s.write(status, err, summary))
+}
+
+func (s *terminationLogSink) write(status string, err error, summary string) error {
+	message := fmt.Sprintf("%s: %s", status, summary)
+	if err != nil {
+		message += fmt.Sprintf(": %v", err)
+	}
+	if len(message) > maxTerminationMessage {
+		message = message[:maxTerminationMessage]
+	}
+	if err := os.WriteFile(s.file, []byte(message), 0644); err != nil {
+		return fmt.Errorf("unable to write termination log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("status sink tests", func() {
+	var tmpDir string
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+	})
+
+	readEvent := func(file string) statusEvent {
+		data, err := os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		var event statusEvent
+		Expect(json.Unmarshal(data, &event)).To(Succeed())
+		return event
+	}
+
+	It("should parse the sinks", func() {
+		r, w, err := os.Pipe()
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		defer w.Close()
+		// The sink owns the descriptor it is given
+		fd, err := syscall.Dup(int(w.Fd()))
+		Expect(err).ToNot(HaveOccurred())
+		sinks, err := parseSinks(fmt.Sprintf("log,json:%s,fd:%d,termination-log,termination-log:%s", filepath.Join(tmpDir, "status.json"), fd, filepath.Join(tmpDir, "termination-log")), logr.Discard())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sinks).To(HaveLen(5))
+		Expect(sinks[0]).To(BeAssignableToTypeOf(&logSink{}))
+		Expect(sinks[1]).To(Equal(&jsonFileSink{file: filepath.Join(tmpDir, "status.json")}))
+		Expect(sinks[2]).To(BeAssignableToTypeOf(&jsonLinesSink{}))
+		Expect(sinks[2].(*jsonLinesSink).w.(*os.File).Close()).To(Succeed())
+		Expect(sinks[3]).To(Equal(&terminationLogSink{file: terminationLogFile}))
+		Expect(sinks[4]).To(Equal(&terminationLogSink{file: filepath.Join(tmpDir, "termination-log")}))
+	})
+
+	DescribeTable("should reject invalid sinks", func(spec, message string) {
+		_, err := parseSinks(spec, logr.Discard())
+		Expect(err).To(MatchError(ContainSubstring(message)))
+	},
+		Entry("unknown", "syslog", "invalid status sink"),
+		Entry("json without a file", "json", "needs a file"),
+		Entry("invalid descriptor", "fd:three", "invalid descriptor"),
+		Entry("negative descriptor", "fd:-1", "invalid descriptor"),
+	)
+
+	It("should reject a closed descriptor", func() {
+		f, err := os.CreateTemp(tmpDir, "closed")
+		Expect(err).ToNot(HaveOccurred())
+		fd := f.Fd()
+		Expect(f.Close()).To(Succeed())
+		_, err = parseSinks(fmt.Sprintf("fd:%d", fd), logr.Discard())
+		Expect(err).To(MatchError(ContainSubstring("status sink")))
+	})
+
+	It("should log the progress", func() {
+		var lines []string
+		log := funcr.New(func(prefix, args string) {
+			lines = append(lines, args)
+		}, funcr.Options{})
+		sink := &logSink{log: log}
+		sink.progress(42.4)
+		sink.finish(statusCompleted, nil, "done", nil)
+		Expect(lines).To(Equal([]string{`"level"=0 "msg"="Overall progress 42%"`}))
+	})
+
+	It("should keep the latest status in the JSON file", func() {
+		file := filepath.Join(tmpDir, "status.json")
+		sink := &jsonFileSink{file: file}
+		sink.progress(50)
+		Expect(readEvent(file)).To(Equal(statusEvent{Status: statusRunning, Percent: 50}))
+		sink.finish(statusCompleted, nil, "synced 1 block", map[string]interface{}{"blocksTransferred": float64(1)})
+		Expect(readEvent(file)).To(Equal(statusEvent{
+			Status:  statusCompleted,
+			Percent: 100,
+			Summary: "synced 1 block",
+			Stats:   map[string]interface{}{"blocksTransferred": float64(1)},
+		}))
+		sink.finish(statusFailed, errors.New("connection reset"), "", nil)
+		Expect(readEvent(file)).To(Equal(statusEvent{Status: statusFailed, Error: "connection reset"}))
+		entries, err := os.ReadDir(tmpDir)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+	})
+
+	It("should fail to write the JSON file to an unwritable path", func() {
+		sink := &jsonFileSink{file: filepath.Join(tmpDir, "missing", "status.json")}
+		Expect(sink.write(statusEvent{Status: statusRunning})).To(MatchError(ContainSubstring("unable to write status file")))
+	})
+
+	It("should write a JSON line per status to the descriptor", func() {
+		r, w, err := os.Pipe()
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		sink := &jsonLinesSink{w: w}
+		sink.progress(25)
+		sink.finish(statusCompleted, nil, "done", nil)
+		Expect(w.Close()).To(Succeed())
+		var events []statusEvent
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var event statusEvent
+			Expect(json.Unmarshal(scanner.Bytes(), &event)).To(Succeed())
+			events = append(events, event)
+		}
+		Expect(scanner.Err()).ToNot(HaveOccurred())
+		Expect(events).To(Equal([]statusEvent{
+			{Status: statusRunning, Percent: 25},
+			{Status: statusCompleted, Percent: 100, Summary: "done"},
+		}))
+	})
+
+	It("should fail to write to a closed descriptor", func() {
+		r, w, err := os.Pipe()
+		Expect(err).ToNot(HaveOccurred())
+		defer r.Close()
+		Expect(w.Close()).To(Succeed())
+		sink := &jsonLinesSink{w: w}
+		Expect(sink.write(statusEvent{Status: statusRunning})).To(MatchError(os.ErrClosed))
+	})
+
+	It("should write the outcome to the termination log", func() {
+		file := filepath.Join(tmpDir, "termination-log")
+		sink := &terminationLogSink{file: file}
+		sink.progress(50)
+		Expect(file).ToNot(BeAnExistingFile())
+		sink.finish(statusFailed, errors.New("connection reset"), "synced 1 block", map[string]int{"blocks": 1})
+		data, err := os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("failed: synced 1 block: connection reset"))
+
+		sink.finish(statusCompleted, nil, strings.Repeat("x", 2*maxTerminationMessage), nil)
+		data, err = os.ReadFile(file)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data).To(HaveLen(maxTerminationMessage))
+		Expect(string(data)).To(HavePrefix("completed: xxx"))
+	})
+
+	It("should fail to write the termination log to an unwritable path", func() {
+		sink := &terminationLogSink{file: filepath.Join(tmpDir, "missing", "termination-log")}
+		Expect(sink.write(statusCompleted, nil, "done")).To(MatchError(ContainSubstring("unable to write termination log")))
+	})
+
+	It("should report the progress to the sinks but the log with a progress bar", func() {
+		file := filepath.Join(tmpDir, "status.json")
+		var logged []string
+		log := funcr.New(func(prefix, args string) {
+			logged = append(logged, args)
+		}, funcr.Options{})
+		var reported []float64
+		onProgress := func(percent float64) {
+			reported = append(reported, percent)
+		}
+		Expect(startSinks("log,json:"+file, true, true, &onProgress, log)).To(Succeed())
+		DeferCleanup(func() {
+			finishSinks = func(status string, err error, summary string, stats interface{}) {}
+		})
+		onProgress(10)
+		onProgress(100)
+		Expect(reported).To(Equal([]float64{10, 100}))
+		Expect(logged).To(BeEmpty())
+		Expect(readEvent(file)).To(Equal(statusEvent{Status: statusRunning, Percent: 100}))
+		finishSinks(statusCompleted, nil, "done", nil)
+		Expect(readEvent(file)).To(Equal(statusEvent{Status: statusCompleted, Percent: 100, Summary: "done"}))
+	})
+})
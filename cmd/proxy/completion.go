@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/awels/blockrsync/pkg/completion"
+	"github.com/awels/blockrsync/pkg/proxy"
+)
+
+// completionCommand returns what the completion of the binary completes
+// besides the flags, identifiers are the files of the identifier map
+// directory given on the command line.
+func completionCommand(name string) completion.Command {
+	return completion.Command{
+		Name:        name,
+		Subcommands: []string{"completion"},
+		Values: map[string][]string{
+			"missing-target-policy": {proxy.MissingTargetFail, proxy.MissingTargetCreate},
+			"tls-policy":            {proxy.TLSPolicyRequire, proxy.TLSPolicyPrefer, proxy.TLSPolicyDisable},
+			"zap-encoder":           {"json", "console"},
+		},
+		DirValues: map[string]string{
+			"identifier": "identifier-map-dir",
+		},
+	}
+}
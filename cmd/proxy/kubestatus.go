@@ -0,0 +1,47 @@
+//go:build kubestatus
+
+package main
+
+import (
+	"flag"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/kubestatus"
+)
+
+var (
+	statusResource  = flag.String("status-resource", "", "<group>/<version>/<resource>/<name> of a custom resource whose status is patched with the phase and error of the proxy through the in-cluster API")
+	statusNamespace = flag.String("status-namespace", "", "namespace of the status-resource, the namespace of the pod if empty")
+)
+
+// startStatusReporting patches the status of the status resource with the
+// running phase, and with the outcome of the proxy when reportStatus is
+// called.
+func startStatusReporting(logger logr.Logger) error {
+	if *statusResource == "" {
+		return nil
+	}
+	resource, err := kubestatus.ParseResource(*statusResource)
+	if err != nil {
+		return err
+	}
+	resource.Namespace = *statusNamespace
+	client, err := kubestatus.NewInClusterClient(resource, logger)
+	if err != nil {
+		return err
+	}
+	if err := client.Report(kubestatus.Status{Phase: kubestatus.PhaseRunning}); err != nil {
+		logger.Error(err, "Unable to report the status")
+	}
+	reportStatus = func(status string, err error) {
+		s := kubestatus.Status{Phase: status}
+		if err != nil {
+			s.Error = err.Error()
+		}
+		if err := client.Report(s); err != nil {
+			logger.Error(err, "Unable to report the status")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !kubestatus
+
+package main
+
+import (
+	"github.com/go-logr/logr"
+)
+
+// startStatusReporting does nothing, build with the kubestatus tag to report
+// the status into a custom resource.
+func startStatusReporting(logger logr.Logger) error {
+	return nil
+}
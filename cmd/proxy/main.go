@@ -1,19 +1,36 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"go.uber.org/zap/zapcore"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	"github.com/awels/blockrsync/pkg/completion"
+	"github.com/awels/blockrsync/pkg/profiling"
 	"github.com/awels/blockrsync/pkg/proxy"
 )
 
+const (
+	statusCompleted = "completed"
+	statusFailed    = "failed"
+)
+
+// reportStatus reports the outcome of the proxy outside of the logs, it is
+// set by startStatusReporting.
+var reportStatus = func(status string, err error) {}
+
 type arrayFlags []string
 
 func (i *arrayFlags) String() string {
@@ -35,11 +52,54 @@ func main() {
 		targetPort     = flag.Int("target-port", 9000, "target port to connect to")
 		blockrsyncPath = flag.String("blockrsync-path", "/blockrsync", "path to blockrsync binary")
 		blockSize      = flag.Int("block-size", 65536, "block size, must be > 0 and a multiple of 4096")
+		extraArgs      = flag.String("blockrsync-extra-args", "", "space separated extra arguments passed to every blockrsync server, target only")
+		pprofPort      = flag.Int("pprof-port", 0, "serve net/http/pprof on this port of localhost while running, 0 disables")
+		tlsServerName  = flag.String("tls-server-name", "", "connect to the target with TLS, asking for this server name, source only")
+		tlsCAFile      = flag.String("tls-ca-file", "", "PEM file of the CA certificates the target certificate is verified with, the system roots if empty, source only")
+		tlsCertFile    = flag.String("tls-cert-file", "", "PEM file of the client certificate presented to a target that verifies clients, its common name or a DNS name is the identifier, source only")
+		tlsKeyFile     = flag.String("tls-key-file", "", "PEM file of the key of tls-cert-file, source only")
+		clientCAFile   = flag.String("tls-client-ca-file", "", "PEM file of the CA certificates client certificates are verified with, clients must present one naming the identifier they sync, target only")
 	)
 
 	var identifiers arrayFlags
+	var identifierExtraArgs arrayFlags
+	var tlsRoutes arrayFlags
+	var identifierWindows arrayFlags
+	var listens arrayFlags
+	var listenTLSRoutes arrayFlags
+	opts := proxy.ProxyOptions{}
+
+	flag.BoolVar(&opts.ProxyProtocol, "proxy-protocol", false, "expect a PROXY protocol v2 header on inbound connections, target only")
+	flag.StringVar(&opts.MissingTargetPolicy, "missing-target-policy", proxy.MissingTargetFail, "what to do if the file of an identifier does not exist at startup, fail or create, target only")
+	flag.StringVar(&opts.ReadyFile, "ready-file", "", "name and path to file to write when all identifiers are validated and the server is listening, target only")
+	flag.BoolVar(&opts.Resumable, "resumable", false, "tunnel data through a session that survives reconnects, must be set on both source and target")
+	flag.DurationVar(&opts.ResumeTimeout, "resume-timeout", proxy.DefaultResumeTimeout, "how long to wait for a source to reconnect to a resumable session, target only")
+	flag.StringVar(&opts.AdvertiseName, "advertise-name", "", "advertise the proxy through DNS-SD with this instance name, target only")
+	flag.BoolVar(&opts.Discover, "discover", false, "discover the target through DNS-SD when no target-address is given, source only")
+	flag.DurationVar(&opts.DiscoverTimeout, "discover-timeout", 5*time.Second, "how long to wait for DNS-SD answers, source only")
+	flag.StringVar(&opts.TLSPolicy, "tls-policy", proxy.TLSPolicyRequire, "require, prefer or disable the TLS of tls-server-name, prefer falls back to plaintext if the target doesn't speak TLS, source only")
+	flag.BoolVar(&opts.SessionSummary, "session-summary", false, "relay the exit code and stats of the blockrsync server back to the source before the tunnel closes, the source records them in its control file, must be set on both source and target, not with resumable")
+	flag.BoolVar(&opts.SendProxyProtocol, "send-proxy-protocol", false, "send a PROXY protocol v2 header to the target, source only")
+	flag.BoolVar(&opts.SignIdentifiers, "sign-identifier", false, "send the identifier signed with the time and a nonce so a captured identifier can't be replayed, must be set on both source and target")
+	flag.StringVar(&opts.IdentifierMapDir, "identifier-map-dir", "", "directory with a file per identifier holding the path of its target, like a mounted ConfigMap, read before the environment on every connection. Its identifiers are synced if no identifier is given, target only")
+	flag.DurationVar(&opts.CredentialsReloadInterval, "credentials-reload-interval", 0, "how often the certificate files of the TLS routes are checked for changes, like a mounted Secret being updated, 0 only reloads on SIGHUP, target only")
+	flag.DurationVar(&opts.IdentifierWindow, "identifier-window", proxy.DefaultIdentifierWindow, "how far the time of a signed identifier may be from the clock of the target, target only")
+
+	flag.Float64Var(&opts.Guard.RatePerIP, "max-connection-rate", 0, "new connections per second accepted from an IP, the one of the PROXY protocol header with proxy-protocol, 0 is unlimited, target only")
+	flag.IntVar(&opts.Guard.BurstPerIP, "max-connection-burst", 1, "connections an IP can open at once with max-connection-rate, target only")
+	flag.IntVar(&opts.Guard.MaxPending, "max-pending-connections", 0, "most connections that did not send a valid identifier yet, 0 is unlimited, target only")
+	flag.StringVar(&opts.SocketDir, "blockrsync-socket-dir", "", "directory of the unix domain sockets the blockrsync servers listen on instead of a port each, when they run on the same host as the proxy, target only")
+	flag.StringVar(&opts.ListenSocket, "listen-socket", "", "listen for the blockrsync client on this unix domain socket instead of listen-port, the client connects with connect-socket, source only")
+	flag.IntVar(&opts.MaxConcurrentSessions, "max-concurrent-sessions", 0, "most identifiers synced at once, the sources of the others wait for a session to finish, 0 syncs all of them at once, target only")
+	flag.DurationVar(&opts.HandshakeTimeout, "handshake-timeout", proxy.DefaultHandshakeTimeout, "close connections that don't send their identifier in time, like port scanners, freeing the worker waiting on them, target only")
 
 	flag.Var(&identifiers, "identifier", "identifier of the file, multiple allowed")
+	flag.Var(&identifierExtraArgs, "identifier-extra-args", "<identifier>=<space separated arguments> passed to the blockrsync server of that identifier, multiple allowed, target only")
+	flag.Var(&identifierWindows, "identifier-window-of", "<identifier>=<duration> identifier-window of that identifier, multiple allowed, target only")
+	flag.Var(&listens, "listen", "<host:port>[,plaintext] another address to listen on besides listen-port, like a migration network, with the tls-route flags or plaintext, multiple allowed, target only")
+	flag.Var(&listenTLSRoutes, "listen-tls-route", "<host:port>@<tls-route> a TLS route of a listen address instead of the tls-route flags, multiple allowed, target only")
+	flag.Var((*arrayFlags)(&opts.AlternateTargets), "alternate-target", "another host:port of the target, the source connects to all of them and uses the path that completes the handshake first, multiple allowed, source only")
+	flag.Var(&tlsRoutes, "tls-route", "<server name>=<cert file>,<key file>[,<identifier>...] terminate TLS presenting the certificate to clients asking for the server name, limited to the identifiers if any, * matches any server name, certificates are reloaded on SIGHUP, multiple allowed, target only")
 
 	zapopts := zap.Options{
 		Development: true,
@@ -52,55 +112,255 @@ func main() {
 	pflag.CommandLine.AddGoFlagSet(flag.CommandLine)
 
 	pflag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		if len(os.Args) < 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %s completion bash|zsh|fish\n", os.Args[0])
+			os.Exit(2)
+		}
+		if err := completion.Write(os.Stdout, os.Args[2], completionCommand(filepath.Base(os.Args[0])), pflag.CommandLine); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(2)
+		}
+		return
+	}
 	logger := zap.New(zap.UseFlagOptions(&zapopts))
+	if *pprofPort != 0 {
+		if _, err := profiling.Serve(*pprofPort, logger.WithName("pprof")); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to serve pprof: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	if controlFile == nil || *controlFile == "" {
 		fmt.Fprintf(os.Stderr, "control-file must be specified\n")
 		os.Exit(1)
 	}
+	if err := startStatusReporting(logger.WithName("status")); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to report the status: %v\n", err)
+		os.Exit(1)
+	}
+	var server *proxy.ProxyServer
+	var client *proxy.ProxyClient
 	defer func() {
 		logger.Info("Writing control file", "file", *controlFile)
-		if err := createControlFile(*controlFile); err != nil {
+		var stats map[string]json.RawMessage
+		if server != nil {
+			stats = server.ChildStats()
+		} else if client != nil && client.Summary() != nil {
+			summary := client.Summary()
+			if data, err := json.Marshal(summary); err == nil {
+				stats = map[string]json.RawMessage{summary.Identifier: data}
+			}
+		}
+		if err := createControlFile(*controlFile, stats); err != nil {
 			logger.Error(err, "Unable to create control file")
 		}
 	}()
 
 	if *sourceMode && !*targetMode {
-		if targetAddress == nil || *targetAddress == "" {
-			fmt.Fprintf(os.Stderr, "target-address must be specified with source flag\n")
+		if (targetAddress == nil || *targetAddress == "") && !opts.Discover {
+			fmt.Fprintf(os.Stderr, "target-address or discover must be specified with source flag\n")
 			os.Exit(1)
 		}
 		if len(identifiers) > 1 || len(identifiers) == 0 {
 			fmt.Fprintf(os.Stderr, "Only one identifier must be specified in source mode\n")
 			os.Exit(1)
 		}
-		client := proxy.NewProxyClient(*listenPort, *targetPort, *targetAddress, logger)
+		if err := proxy.ValidTLSPolicy(opts.TLSPolicy); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if opts.TLSPolicy == proxy.TLSPolicyDisable && *tlsServerName != "" {
+			fmt.Fprintf(os.Stderr, "tls-server-name can't be used with tls-policy %s\n", proxy.TLSPolicyDisable)
+			os.Exit(1)
+		}
+		if *tlsServerName != "" {
+			tlsConfig, err := clientTLSConfig(*tlsServerName, *tlsCAFile, *tlsCertFile, *tlsKeyFile)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+			opts.TLSConfig = tlsConfig
+		}
+		client = proxy.NewProxyClient(*listenPort, *targetPort, *targetAddress, &opts, logger)
 
 		if err := client.ConnectToTarget(identifiers[0]); err != nil {
 			logger.Error(err, "Unable to connect to target", "identifier", identifiers[0], "target address", *targetAddress)
+			reportStatus(statusFailed, err)
 			os.Exit(1)
 		}
+		reportStatus(statusCompleted, nil)
 	} else if *targetMode && !*sourceMode {
+		if len(identifiers) == 0 && opts.IdentifierMapDir != "" {
+			mapped, err := proxy.IdentifiersFromDir(opts.IdentifierMapDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "unable to read identifier-map-dir: %v\n", err)
+				os.Exit(1)
+			}
+			identifiers = mapped
+		}
 		if len(identifiers) == 0 {
 			fmt.Fprintf(os.Stderr, "At least one identifier must be specified in target mode\n")
 			os.Exit(1)
 		}
-		server := proxy.NewProxyServer(*blockrsyncPath, *blockSize, *listenPort, identifiers, logger)
+		opts.BlockrsyncExtraArgs = strings.Fields(*extraArgs)
+		perIdentifierArgs, err := parseIdentifierExtraArgs(identifierExtraArgs)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		opts.IdentifierExtraArgs = perIdentifierArgs
+		if opts.TLSRoutes, err = parseTLSRoutes(tlsRoutes); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if opts.Listeners, err = parseListeners(listens, listenTLSRoutes); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if *clientCAFile != "" {
+			if opts.ClientCAs, err = loadCertPool("tls-client-ca-file", *clientCAFile); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				os.Exit(1)
+			}
+		}
+		if opts.IdentifierWindows, err = parseIdentifierWindows(identifierWindows); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		if opts.MissingTargetPolicy != proxy.MissingTargetFail && opts.MissingTargetPolicy != proxy.MissingTargetCreate {
+			fmt.Fprintf(os.Stderr, "missing-target-policy must be %s or %s\n", proxy.MissingTargetFail, proxy.MissingTargetCreate)
+			os.Exit(1)
+		}
+		server = proxy.NewProxyServer(*blockrsyncPath, *blockSize, *listenPort, identifiers, &opts, logger)
+		reloadOnHangup(server, logger)
 
 		if err := server.StartServer(); err != nil {
 			logger.Error(err, "Unable to start server")
+			reportStatus(statusFailed, err)
 			os.Exit(1)
 		}
+		reportStatus(statusCompleted, nil)
 	} else {
 		fmt.Fprintf(os.Stderr, "Must specify source or target, but not both\n")
 		os.Exit(1)
 	}
 }
 
-func createControlFile(fileName string) error {
-	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
-		return err
+func parseIdentifierExtraArgs(values []string) (map[string][]string, error) {
+	res := make(map[string][]string)
+	for _, value := range values {
+		identifier, args, found := strings.Cut(value, "=")
+		if !found || identifier == "" {
+			return nil, fmt.Errorf("invalid identifier-extra-args %q, expected <identifier>=<arguments>", value)
+		}
+		res[identifier] = append(res[identifier], strings.Fields(args)...)
+	}
+	return res, nil
+}
+
+func parseIdentifierWindows(values []string) (map[string]time.Duration, error) {
+	res := make(map[string]time.Duration)
+	for _, value := range values {
+		identifier, window, found := strings.Cut(value, "=")
+		if !found || identifier == "" {
+			return nil, fmt.Errorf("invalid identifier-window-of %q, expected <identifier>=<duration>", value)
+		}
+		duration, err := time.ParseDuration(window)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identifier-window-of %q: %w", value, err)
+		}
+		res[identifier] = duration
+	}
+	return res, nil
+}
+
+func parseTLSRoutes(values []string) ([]proxy.TLSRoute, error) {
+	var routes []proxy.TLSRoute
+	for _, value := range values {
+		serverName, files, found := strings.Cut(value, "=")
+		fields := strings.Split(files, ",")
+		if !found || serverName == "" || len(fields) < 2 {
+			return nil, fmt.Errorf("invalid tls-route %q, expected <server name>=<cert file>,<key file>[,<identifier>...]", value)
+		}
+		cert, err := tls.LoadX509KeyPair(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the certificate of server name %s: %w", serverName, err)
+		}
+		routes = append(routes, proxy.TLSRoute{ServerName: serverName, Certificate: cert, CertFile: fields[0], KeyFile: fields[1], Identifiers: fields[2:]})
+	}
+	return routes, nil
+}
+
+func parseListeners(values, routes []string) ([]proxy.ProxyListener, error) {
+	var listeners []proxy.ProxyListener
+	for _, value := range values {
+		address, plaintext := strings.CutSuffix(value, ",plaintext")
+		if address == "" || strings.Contains(address, ",") {
+			return nil, fmt.Errorf("invalid listen %q, expected <host:port>[,plaintext]", value)
+		}
+		listeners = append(listeners, proxy.ProxyListener{Address: address, Plaintext: plaintext})
+	}
+	for _, value := range routes {
+		address, route, found := strings.Cut(value, "@")
+		i := slices.IndexFunc(listeners, func(l proxy.ProxyListener) bool { return l.Address == address })
+		if !found || i < 0 || listeners[i].Plaintext {
+			return nil, fmt.Errorf("invalid listen-tls-route %q, expected <host:port>@<tls-route> of a listen address that is not plaintext", value)
+		}
+		parsed, err := parseTLSRoutes([]string{route})
+		if err != nil {
+			return nil, err
+		}
+		listeners[i].TLSRoutes = append(listeners[i].TLSRoutes, parsed...)
+	}
+	return listeners, nil
+}
+
+func clientTLSConfig(serverName, caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls-cert-file and tls-key-file must be specified together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile == "" {
+		return config, nil
+	}
+	var err error
+	if config.RootCAs, err = loadCertPool("tls-ca-file", caFile); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadCertPool returns a pool of the certificates of the PEM file of the flag.
+func loadCertPool(flagName, file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in %s %s", flagName, file)
+	}
+	return pool, nil
+}
+
+// createControlFile writes the control file, including the stats of the
+// blockrsync servers if any reported them, or the session summary the
+// source received.
+func createControlFile(fileName string, stats map[string]json.RawMessage) error {
+	var content []byte
+	if len(stats) > 0 {
+		var err error
+		if content, err = json.MarshalIndent(stats, "", "  "); err != nil {
+			return err
+		}
 	}
-	_, err := os.Create(fileName)
-	return err
+	return proxy.CreateFile(fileName, content)
 }
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/proxy"
+)
+
+// reloadOnHangup reloads the credentials of the server on every SIGHUP, so
+// rotated certificates are used without dropping the sessions in flight.
+func reloadOnHangup(server *proxy.ProxyServer, logger logr.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logger.Info("Reloading credentials")
+			if err := server.ReloadCredentials(); err != nil {
+				logger.Error(err, "Unable to reload credentials, keeping the current ones")
+			}
+		}
+	}()
+}
@@ -0,0 +1,181 @@
+package blockrsync
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// adaptiveInterval is how long a limit measures the throughput before it
+	// is tuned
+	adaptiveInterval = time.Second
+	// adaptiveTolerance is the relative change of the throughput that is
+	// more than noise
+	adaptiveTolerance = 0.05
+	// adaptiveMaxReadAhead is the most runs read ahead when adaptive
+	adaptiveMaxReadAhead = 16
+)
+
+// adaptiveLimit bounds the operations in flight, like the blocks hashed in
+// parallel, and is tuned by hill climbing on the throughput of the
+// operations. Every interval it moves the limit further in the direction that
+// raised the throughput, turns around when the throughput dropped, and backs
+// off when the throughput stayed the same, since more operations in flight
+// then only queue, like on a slow NFS server. A nil limit doesn't bound
+// anything.
+type adaptiveLimit struct {
+	name     string
+	min, max int
+	log      logr.Logger
+	now      func() time.Time
+	mu       sync.Mutex
+	limit    int
+	inFlight int
+	// changed is closed and replaced when an operation completes or the
+	// limit changes
+	changed chan struct{}
+	// measured since the interval started
+	started time.Time
+	bytes   int64
+	ops     int64
+	latency time.Duration
+	// the throughput of the last interval, and the direction the limit
+	// moves in
+	lastThroughput float64
+	direction      int
+}
+
+func newAdaptiveLimit(name string, initial, minLimit, maxLimit int, log logr.Logger) *adaptiveLimit {
+	l := &adaptiveLimit{
+		name:      name,
+		min:       minLimit,
+		max:       max(maxLimit, minLimit),
+		log:       log,
+		now:       time.Now,
+		changed:   make(chan struct{}),
+		direction: 1,
+	}
+	l.limit = min(max(initial, l.min), l.max)
+	l.started = l.now()
+	return l
+}
+
+// value returns the current limit.
+func (l *adaptiveLimit) value() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limit
+}
+
+// acquire waits until fewer operations than the limit are in flight, it
+// returns false if done was closed first.
+func (l *adaptiveLimit) acquire(done <-chan struct{}) bool {
+	if l == nil {
+		return true
+	}
+	for {
+		l.mu.Lock()
+		if l.inFlight < l.limit {
+			l.inFlight++
+			l.mu.Unlock()
+			return true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		select {
+		case <-changed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// release completes an acquired operation that moved bytes in latency.
+func (l *adaptiveLimit) release(bytes int64, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	l.observeLocked(bytes, latency)
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// observe records an operation the limit sizes without bounding it, like a
+// flush of the apply window.
+func (l *adaptiveLimit) observe(bytes int64, latency time.Duration) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.observeLocked(bytes, latency)
+}
+
+func (l *adaptiveLimit) observeLocked(bytes int64, latency time.Duration) {
+	l.bytes += bytes
+	l.ops++
+	l.latency += latency
+	now := l.now()
+	elapsed := now.Sub(l.started)
+	if elapsed < adaptiveInterval {
+		return
+	}
+	throughput := float64(l.bytes) / elapsed.Seconds()
+	averageLatency := l.latency / time.Duration(l.ops)
+	switch {
+	case l.lastThroughput == 0 || throughput > l.lastThroughput*(1+adaptiveTolerance):
+		// Keep going
+	case throughput < l.lastThroughput*(1-adaptiveTolerance):
+		l.direction = -l.direction
+	default:
+		l.direction = -1
+	}
+	previous := l.limit
+	l.limit = min(max(l.limit+l.direction*max(l.limit/4, 1), l.min), l.max)
+	if l.limit != previous {
+		l.log.V(3).Info("Tuned limit", "limit", l.name, "from", previous, "to", l.limit,
+			"bytesPerSecond", int64(throughput), "latency", averageLatency)
+	}
+	l.lastThroughput = throughput
+	l.started, l.bytes, l.ops, l.latency = now, 0, 0, 0
+}
+
+// hashLimit returns the limit of the blocks hashed in parallel when adaptive,
+// and the number of hash workers. The limit stays within MaxCPU.
+func (o *BlockRsyncOptions) hashLimit(log logr.Logger) (*adaptiveLimit, int) {
+	concurrency := o.hashConcurrency()
+	if !o.Adaptive {
+		return nil, concurrency
+	}
+	workers := concurrency
+	if o.MaxCPU <= 0 {
+		workers = max(concurrency, 4*runtime.NumCPU())
+	}
+	return newAdaptiveLimit("hash-workers", concurrency, 1, workers, log), workers
+}
+
+// readAheadLimit returns the limit of the runs read ahead when adaptive, and
+// the most runs read ahead.
+func (o *BlockRsyncOptions) readAheadLimit(log logr.Logger) (*adaptiveLimit, int) {
+	readAhead := o.readAhead()
+	if !o.Adaptive {
+		return nil, readAhead
+	}
+	maxReadAhead := max(readAhead, adaptiveMaxReadAhead)
+	return newAdaptiveLimit("read-ahead", readAhead, 1, maxReadAhead, log), maxReadAhead
+}
+
+// applyWindowLimit returns the limit of the apply window when adaptive, the
+// apply window is its maximum.
+func (o *BlockRsyncOptions) applyWindowLimit(log logr.Logger) *adaptiveLimit {
+	if !o.Adaptive || o.ApplyWindow <= 0 {
+		return nil
+	}
+	return newAdaptiveLimit("apply-window", o.ApplyWindow, 1, o.ApplyWindow, log)
+}
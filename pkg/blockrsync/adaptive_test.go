@@ -0,0 +1,112 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("adaptive limit tests", func() {
+	// tune runs the limit for intervals, every interval moves the bytes the
+	// throughput function returns for the limit.
+	tune := func(limit *adaptiveLimit, intervals int, throughput func(int) int64) {
+		now := time.Now()
+		limit.now = func() time.Time { return now }
+		limit.started = now
+		for i := 0; i < intervals; i++ {
+			now = now.Add(adaptiveInterval)
+			Expect(limit.acquire(nil)).To(BeTrue())
+			limit.release(throughput(limit.value()), time.Millisecond)
+		}
+	}
+
+	It("should climb to the limit with the most throughput", func() {
+		limit := newAdaptiveLimit("test", 2, 1, 64, GinkgoLogr)
+		// Throughput grows up to 8 operations, and drops past them
+		tune(limit, 50, func(n int) int64 {
+			if n <= 8 {
+				return int64(n) << 20
+			}
+			return max(16-int64(n), 1) << 20
+		})
+		Expect(limit.value()).To(BeNumerically(">=", 5))
+		Expect(limit.value()).To(BeNumerically("<=", 11))
+	})
+
+	It("should back off when more operations don't raise the throughput", func() {
+		limit := newAdaptiveLimit("test", 32, 1, 64, GinkgoLogr)
+		tune(limit, 30, func(n int) int64 {
+			return min(int64(n), 4) << 20
+		})
+		Expect(limit.value()).To(BeNumerically("<=", 6))
+	})
+
+	It("should stay within its bounds", func() {
+		limit := newAdaptiveLimit("test", 100, 2, 8, GinkgoLogr)
+		Expect(limit.value()).To(Equal(8))
+		tune(limit, 20, func(n int) int64 { return int64(n) << 20 })
+		Expect(limit.value()).To(Equal(8))
+		tune(limit, 20, func(n int) int64 { return 1 << 20 })
+		Expect(limit.value()).To(BeNumerically(">=", 2))
+	})
+
+	It("should wait for a release at the limit", func() {
+		limit := newAdaptiveLimit("test", 1, 1, 1, GinkgoLogr)
+		Expect(limit.acquire(nil)).To(BeTrue())
+		done := make(chan struct{})
+		close(done)
+		Expect(limit.acquire(done)).To(BeFalse())
+		acquired := make(chan bool)
+		go func() {
+			acquired <- limit.acquire(nil)
+		}()
+		Consistently(acquired, 50*time.Millisecond).ShouldNot(Receive())
+		limit.release(0, 0)
+		Eventually(acquired).Should(Receive(BeTrue()))
+	})
+
+	It("should not limit without adaptive", func() {
+		opts := &BlockRsyncOptions{HashConcurrency: 3, ApplyWindow: 4}
+		limit, workers := opts.hashLimit(GinkgoLogr)
+		Expect(limit).To(BeNil())
+		Expect(workers).To(Equal(3))
+		Expect(opts.applyWindowLimit(GinkgoLogr)).To(BeNil())
+		Expect(limit.acquire(nil)).To(BeTrue())
+		limit.release(0, 0)
+		opts.Adaptive, opts.MaxCPU = true, 2
+		limit, workers = opts.hashLimit(GinkgoLogr)
+		Expect(limit.value()).To(Equal(2))
+		Expect(workers).To(Equal(2))
+	})
+
+	It("should sync with adaptive limits", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, 256*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		adaptive := func(c *constructorConfig) {
+			c.opts.Adaptive = true
+			c.opts.ApplyWindow = 8
+			c.opts.MaxReadSize = 4 * 4096
+		}
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")), adaptive)
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")), adaptive)
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+})
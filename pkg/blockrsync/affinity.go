@@ -0,0 +1,128 @@
+package blockrsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// HashAffinityDevice pins the hash workers to the CPUs of the NUMA node
+	// the hashed device is attached to
+	HashAffinityDevice = "device"
+
+	maxAffinityCPUs = 1024
+)
+
+// sysDevicesNode holds the CPU lists of the NUMA nodes.
+var sysDevicesNode = "/sys/devices/system/node"
+
+// parseCPUList parses a list of CPUs like 0-7,16-23.
+func parseCPUList(s string) ([]int, error) {
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(s), ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q", s)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(last); err != nil {
+				return nil, fmt.Errorf("invalid CPU list %q", s)
+			}
+		}
+		if start < 0 || end < start || end >= maxAffinityCPUs {
+			return nil, fmt.Errorf("invalid CPU range %q in %q, CPUs must be between 0 and %d", part, s, maxAffinityCPUs-1)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
+
+// validateHashAffinity returns an error unless the affinity is empty, device
+// or a CPU list.
+func validateHashAffinity(affinity string) error {
+	if affinity == "" || affinity == HashAffinityDevice {
+		return nil
+	}
+	_, err := parseCPUList(affinity)
+	return err
+}
+
+// backingDevice returns the device number of a block device, or of the
+// device holding a file.
+func backingDevice(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	if info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		return uint64(stat.Rdev), true
+	}
+	return uint64(stat.Dev), true
+}
+
+// affinityCPUs returns the CPUs to pin the hash workers to, none if the
+// affinity is empty.
+func affinityCPUs(affinity string, device uint64) ([]int, error) {
+	switch affinity {
+	case "":
+		return nil, nil
+	case HashAffinityDevice:
+		node, err := deviceNUMANode(device)
+		if err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(sysDevicesNode, fmt.Sprintf("node%d", node), "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		return parseCPUList(string(data))
+	}
+	return parseCPUList(affinity)
+}
+
+// deviceNUMANode returns the NUMA node of the bus device, like the PCI
+// function of an NVMe controller, the block device is attached to.
+func deviceNUMANode(device uint64) (int64, error) {
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", major(device), minor(device))))
+	if err != nil {
+		return 0, err
+	}
+	return numaNodeOf(dir)
+}
+
+// numaNodeOf returns the first NUMA node set on the sysfs directory of a
+// device or its parents.
+func numaNodeOf(dir string) (int64, error) {
+	for d := dir; d != filepath.Dir(d); d = filepath.Dir(d) {
+		node, err := readSysfsInt(filepath.Join(d, "numa_node"))
+		if err == nil && node >= 0 {
+			return node, nil
+		}
+	}
+	return 0, fmt.Errorf("no NUMA node found for %s", dir)
+}
+
+// pinThread locks the goroutine to its thread and sets the CPUs the thread
+// runs on. The goroutine must exit without unlocking, so the pinned thread is
+// not reused by other goroutines.
+func pinThread(cpus []int) error {
+	runtime.LockOSThread()
+	var mask [maxAffinityCPUs / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << (cpu % 64)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask))); errno != 0 {
+		return errno
+	}
+	return nil
+}
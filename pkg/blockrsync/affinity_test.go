@@ -0,0 +1,58 @@
+package blockrsync
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("hash affinity tests", func() {
+	DescribeTable("should parse CPU lists", func(list string, expected []int) {
+		Expect(parseCPUList(list)).To(Equal(expected))
+	},
+		Entry("single", "3", []int{3}),
+		Entry("ranges", "0-2,8-9\n", []int{0, 1, 2, 8, 9}),
+	)
+
+	DescribeTable("should reject invalid CPU lists", func(list string) {
+		_, err := parseCPUList(list)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("empty", ""),
+		Entry("reversed", "4-2"),
+		Entry("too large", "0-4096"),
+		Entry("name", "numa"),
+	)
+
+	It("should find the CPUs of the NUMA node of a device", func() {
+		sysfs := GinkgoT().TempDir()
+		oldNode := sysDevicesNode
+		sysDevicesNode = filepath.Join(sysfs, "node")
+		DeferCleanup(func() { sysDevicesNode = oldNode })
+		controller := filepath.Join(sysfs, "devices", "pci0000:00", "0000:3d:00.0")
+		disk := filepath.Join(controller, "nvme", "nvme0", "nvme0n1")
+		Expect(os.MkdirAll(disk, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(controller, "numa_node"), []byte("1\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(controller, "nvme", "nvme0", "numa_node"), []byte("-1\n"), 0644)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(sysDevicesNode, "node1"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(sysDevicesNode, "node1", "cpulist"), []byte("4-5\n"), 0644)).To(Succeed())
+
+		Expect(numaNodeOf(disk)).To(Equal(int64(1)))
+		_, err := numaNodeOf(filepath.Join(sysfs, "devices", "virtual"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should hash a file with pinned workers", func() {
+		cpus, err := parseCPUList("0")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(affinityCPUs("", 0)).To(BeEmpty())
+		Expect(affinityCPUs("0", 0)).To(Equal(cpus))
+		hasher := (&BlockRsyncOptions{BlockSize: 4096, HashAffinity: "0"}).newHasher(nil, ProgressHashSource, nil, nil, nil, GinkgoLogr)
+		fileName := filepath.Join(GinkgoT().TempDir(), "file.raw")
+		Expect(os.WriteFile(fileName, make([]byte, 8*4096), 0644)).To(Succeed())
+		Expect(hasher.HashFile(fileName)).To(Equal(int64(8 * 4096)))
+		Expect(hasher.GetHashes()).To(HaveLen(8))
+	})
+})
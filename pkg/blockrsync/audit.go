@@ -0,0 +1,127 @@
+package blockrsync
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// AuditVerbosity is the verbosity the audited operations are logged at
+	AuditVerbosity = 2
+
+	AuditOpen      = "open"
+	AuditFallocate = "fallocate"
+	AuditIoctl     = "ioctl"
+	AuditFsync     = "fsync"
+	AuditTruncate  = "ftruncate"
+
+	punchHoleMode = "FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE"
+)
+
+// AuditRecord is an operation on a synced file that needs a permission, and
+// how many times it was done.
+type AuditRecord struct {
+	Operation string `json:"operation"`
+	// Detail is the open flags, fallocate mode or ioctl of the operation
+	Detail string `json:"detail,omitempty"`
+	File   string `json:"file"`
+	Count  int64  `json:"count"`
+}
+
+// auditor records the operations on the synced files that need a permission,
+// so a tight SELinux or AppArmor policy can be written for them. The first of
+// each operation is logged at AuditVerbosity, and all are counted in the
+// stats. A nil auditor records nothing.
+type auditor struct {
+	stats *Stats
+	log   logr.Logger
+}
+
+func newAuditor(enabled bool, stats *Stats, log logr.Logger) *auditor {
+	if !enabled {
+		return nil
+	}
+	return &auditor{stats: stats, log: log}
+}
+
+func (a *auditor) record(operation, detail, file string) {
+	if a == nil {
+		return
+	}
+	first := false
+	a.stats.Update(func(s *Stats) {
+		i := slices.IndexFunc(s.Audit, func(r AuditRecord) bool {
+			return r.Operation == operation && r.Detail == detail && r.File == file
+		})
+		if i < 0 {
+			s.Audit = append(s.Audit, AuditRecord{Operation: operation, Detail: detail, File: file, Count: 1})
+			first = true
+			return
+		}
+		s.Audit[i].Count++
+	})
+	if first {
+		a.log.V(AuditVerbosity).Info("Audit", "operation", operation, "detail", detail, "file", file)
+	}
+}
+
+// open records the flags the file is opened with and opens it.
+func (a *auditor) open(name string, flag int, perm os.FileMode) (*os.File, error) {
+	detail := openFlags(flag)
+	if IsPassedFile(name) {
+		// The descriptor is duplicated, not opened
+		detail += " passed"
+	}
+	a.record(AuditOpen, detail, name)
+	return openFile(name, flag, perm)
+}
+
+func (a *auditor) fsync(f *os.File) error {
+	a.record(AuditFsync, "", f.Name())
+	return f.Sync()
+}
+
+func (a *auditor) truncate(f *os.File, size int64) error {
+	a.record(AuditTruncate, "", f.Name())
+	return f.Truncate(size)
+}
+
+func (a *auditor) ioctl(f *os.File, request string) {
+	a.record(AuditIoctl, request, f.Name())
+}
+
+func (a *auditor) fallocate(f *os.File, mode string) {
+	a.record(AuditFallocate, mode, f.Name())
+}
+
+func openFlags(flag int) string {
+	var flags []string
+	switch flag & syscall.O_ACCMODE {
+	case os.O_RDONLY:
+		flags = append(flags, "O_RDONLY")
+	case os.O_WRONLY:
+		flags = append(flags, "O_WRONLY")
+	case os.O_RDWR:
+		flags = append(flags, "O_RDWR")
+	}
+	for _, f := range []struct {
+		flag int
+		name string
+	}{
+		{os.O_APPEND, "O_APPEND"},
+		{os.O_CREATE, "O_CREAT"},
+		{os.O_EXCL, "O_EXCL"},
+		{os.O_SYNC, "O_SYNC"},
+		{os.O_TRUNC, "O_TRUNC"},
+		{syscall.O_DIRECT, "O_DIRECT"},
+	} {
+		if flag&f.flag == f.flag {
+			flags = append(flags, f.name)
+		}
+	}
+	return strings.Join(flags, "|")
+}
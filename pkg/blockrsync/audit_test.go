@@ -0,0 +1,62 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("audit tests", func() {
+	DescribeTable("should name the open flags", func(flag int, expected string) {
+		Expect(openFlags(flag)).To(Equal(expected))
+	},
+		Entry("read only", os.O_RDONLY, "O_RDONLY"),
+		Entry("read write create", os.O_RDWR|os.O_CREATE, "O_RDWR|O_CREAT"),
+		Entry("direct write", os.O_WRONLY|os.O_TRUNC|syscall.O_DIRECT, "O_WRONLY|O_TRUNC|O_DIRECT"),
+	)
+
+	It("should count the same operation once", func() {
+		stats := NewStats()
+		audit := newAuditor(true, stats, GinkgoLogr)
+		audit.record(AuditFsync, "", "target")
+		audit.record(AuditFsync, "", "target")
+		audit.record(AuditIoctl, "BLKGETSIZE64", "target")
+		Expect(stats.Audit).To(Equal([]AuditRecord{
+			{Operation: AuditFsync, File: "target", Count: 2},
+			{Operation: AuditIoctl, Detail: "BLKGETSIZE64", File: "target", Count: 1},
+		}))
+	})
+
+	It("should record nothing unless enabled", func() {
+		stats := NewStats()
+		audit := newAuditor(false, stats, GinkgoLogr)
+		Expect(audit).To(BeNil())
+		audit.record(AuditFsync, "", "target")
+		Expect(stats.Audit).To(BeEmpty())
+	})
+
+	It("should record the operations of a local copy", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, 4*4096)
+		_, _ = rand.Read(source[:2*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		Expect(os.WriteFile(targetFile, make([]byte, 8*4096), 0644)).To(Succeed())
+		localCopy := NewLocalCopy(sourceFile, targetFile, &BlockRsyncOptions{BlockSize: 4096, Audit: true}, GinkgoLogr.WithName("copy"))
+		Expect(localCopy.Copy()).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		audit := localCopy.Stats().Audit
+		// The hashers open the files once per worker
+		Expect(audit).To(ContainElements(
+			And(HaveField("Operation", AuditOpen), HaveField("Detail", "O_RDONLY"), HaveField("File", sourceFile)),
+			AuditRecord{Operation: AuditOpen, Detail: "O_RDWR|O_CREAT", File: targetFile, Count: 1},
+			AuditRecord{Operation: AuditTruncate, File: targetFile, Count: 1},
+			AuditRecord{Operation: AuditFsync, File: targetFile, Count: 1},
+		))
+	})
+})
@@ -0,0 +1,175 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+const (
+	bitmapMagic   = "BRSYNCBM"
+	bitmapVersion = 1
+)
+
+var (
+	ErrInvalidBitmap = errors.New("invalid transfer bitmap")
+)
+
+// TransferBitmap has a bit for every block of the source, set if the block
+// was sent in a pass as data or as a hole. External tools merge it with their
+// own change tracking, or sample the blocks to verify.
+//
+// The file is little endian:
+//
+//	magic       8 bytes, "BRSYNCBM"
+//	version     uint32, 1
+//	pass        uint32, the pass, starting at 1
+//	block size  uint64, in bytes
+//	source size uint64, in bytes, at the end of the pass
+//	blocks      uint64, the source size divided by the block size, rounded up
+//	bitmap      blocks / 8 bytes, rounded up. Block i, at offset i * block
+//	            size, is bit i % 8 of byte i / 8, the least significant bit
+//	            first. The bits after the last block are zero
+type TransferBitmap struct {
+	Pass       int
+	BlockSize  int64
+	SourceSize int64
+	Bits       []byte
+}
+
+func newTransferBitmap(pass int, blockSize int64) *TransferBitmap {
+	return &TransferBitmap{Pass: pass, BlockSize: blockSize}
+}
+
+// Blocks returns the number of blocks of the source.
+func (m *TransferBitmap) Blocks() int64 {
+	return (m.SourceSize + m.BlockSize - 1) / m.BlockSize
+}
+
+// Has returns true if the block at offset was transferred.
+func (m *TransferBitmap) Has(offset int64) bool {
+	i := offset / m.BlockSize
+	return i/8 < int64(len(m.Bits)) && m.Bits[i/8]&(1<<(i%8)) != 0
+}
+
+// Offsets returns the offsets of the blocks that were transferred, in order.
+func (m *TransferBitmap) Offsets() []int64 {
+	var offsets []int64
+	for i := int64(0); i < m.Blocks(); i++ {
+		if offset := i * m.BlockSize; m.Has(offset) {
+			offsets = append(offsets, offset)
+		}
+	}
+	return offsets
+}
+
+// set marks the block at offset as transferred, it does nothing on a nil
+// bitmap.
+func (m *TransferBitmap) set(offset int64) {
+	if m == nil {
+		return
+	}
+	i := offset / m.BlockSize
+	if n := i/8 + 1; n > int64(len(m.Bits)) {
+		m.Bits = append(m.Bits, make([]byte, n-int64(len(m.Bits)))...)
+	}
+	m.Bits[i/8] |= 1 << (i % 8)
+}
+
+// WriteTo writes the bitmap in the documented format, the bits are sized to
+// the source size.
+func (m *TransferBitmap) WriteTo(w io.Writer) (int64, error) {
+	var header bytes.Buffer
+	header.WriteString(bitmapMagic)
+	_ = binary.Write(&header, binary.LittleEndian, uint32(bitmapVersion))
+	_ = binary.Write(&header, binary.LittleEndian, uint32(m.Pass))
+	_ = binary.Write(&header, binary.LittleEndian, uint64(m.BlockSize))
+	_ = binary.Write(&header, binary.LittleEndian, uint64(m.SourceSize))
+	_ = binary.Write(&header, binary.LittleEndian, uint64(m.Blocks()))
+	bits := make([]byte, (m.Blocks()+7)/8)
+	copy(bits, m.Bits)
+	if extra := m.Blocks() % 8; extra != 0 {
+		// The source shrank below blocks that were sent
+		bits[len(bits)-1] &= byte(1<<extra) - 1
+	}
+	header.Write(bits)
+	return header.WriteTo(w)
+}
+
+// WriteFile replaces the file atomically.
+func (m *TransferBitmap) WriteFile(fileName string) error {
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, buf.Bytes())
+}
+
+// ReadTransferBitmap reads a bitmap in the documented format.
+func ReadTransferBitmap(r io.Reader) (*TransferBitmap, error) {
+	var header struct {
+		Magic      [8]byte
+		Version    uint32
+		Pass       uint32
+		BlockSize  uint64
+		SourceSize uint64
+		Blocks     uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBitmap, err)
+	}
+	if string(header.Magic[:]) != bitmapMagic {
+		return nil, fmt.Errorf("%w: bad magic %q", ErrInvalidBitmap, header.Magic[:])
+	}
+	if header.Version != bitmapVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBitmap, header.Version)
+	}
+	if header.BlockSize == 0 || header.Blocks != (header.SourceSize+header.BlockSize-1)/header.BlockSize {
+		return nil, fmt.Errorf("%w: %d blocks of %d bytes for %d bytes", ErrInvalidBitmap, header.Blocks, header.BlockSize, header.SourceSize)
+	}
+	m := &TransferBitmap{
+		Pass:       int(header.Pass),
+		BlockSize:  int64(header.BlockSize),
+		SourceSize: int64(header.SourceSize),
+		Bits:       make([]byte, (header.Blocks+7)/8),
+	}
+	if _, err := io.ReadFull(r, m.Bits); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBitmap, err)
+	}
+	return m, nil
+}
+
+// ReadTransferBitmapFile reads a bitmap file.
+func ReadTransferBitmapFile(fileName string) (*TransferBitmap, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadTransferBitmap(f)
+}
+
+// bitmapFileName returns the file the bitmap of a pass is written to.
+func bitmapFileName(prefix string, pass int) string {
+	return prefix + "." + strconv.Itoa(pass)
+}
+
+// writeBitmap writes the bitmap of the pass that ended and starts the bitmap
+// of the next pass.
+func (b *BlockrsyncClient) writeBitmap() error {
+	if b.bitmap == nil {
+		return nil
+	}
+	b.bitmap.SourceSize = b.sourceSize
+	fileName := bitmapFileName(b.opts.BitmapFile, b.bitmap.Pass)
+	if err := b.bitmap.WriteFile(fileName); err != nil {
+		return err
+	}
+	b.log.V(3).Info("Wrote transfer bitmap", "file", fileName, "pass", b.bitmap.Pass)
+	b.bitmap = newTransferBitmap(b.bitmap.Pass+1, b.bitmap.BlockSize)
+	return nil
+}
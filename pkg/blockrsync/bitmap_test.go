@@ -0,0 +1,74 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("transfer bitmap tests", func() {
+	It("should write and read the documented format", func() {
+		bitmap := newTransferBitmap(2, 4096)
+		bitmap.set(0)
+		bitmap.set(9 * 4096)
+		// The source shrank below this block
+		bitmap.set(12 * 4096)
+		bitmap.SourceSize = 10*4096 + 100
+		var buf bytes.Buffer
+		_, err := bitmap.WriteTo(&buf)
+		Expect(err).ToNot(HaveOccurred())
+		data := buf.Bytes()
+		Expect(data).To(HaveLen(8 + 4 + 4 + 8 + 8 + 8 + 2))
+		Expect(string(data[:8])).To(Equal("BRSYNCBM"))
+		Expect(data[40:]).To(Equal([]byte{0x01, 0x02}))
+
+		read, err := ReadTransferBitmap(bytes.NewReader(data))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read.Pass).To(Equal(2))
+		Expect(read.Blocks()).To(Equal(int64(11)))
+		Expect(read.Offsets()).To(Equal([]int64{0, 9 * 4096}))
+
+		_, err = ReadTransferBitmap(bytes.NewReader(data[:41]))
+		Expect(err).To(MatchError(ErrInvalidBitmap))
+		data[0] = 'X'
+		_, err = ReadTransferBitmap(bytes.NewReader(data))
+		Expect(err).To(MatchError(ErrInvalidBitmap))
+	})
+
+	It("should write the blocks sent by a sync", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		bitmapFile := filepath.Join(tmpDir, "sync.bitmap")
+		source := make([]byte, 8*4096)
+		_, _ = rand.Read(source[:6*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		target := bytes.Clone(source)
+		_, _ = rand.Read(target[2*4096 : 3*4096])
+		_, _ = rand.Read(target[7*4096:])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, BitmapFile: bitmapFile}, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+
+		bitmap, err := ReadTransferBitmapFile(bitmapFile + ".1")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bitmap.Pass).To(Equal(1))
+		Expect(bitmap.SourceSize).To(Equal(int64(len(source))))
+		// The last block was sent as a hole
+		Expect(bitmap.Offsets()).To(Equal([]int64{2 * 4096, 7 * 4096}))
+		Expect(bitmapFile + ".2").ToNot(BeAnExistingFile())
+	})
+})
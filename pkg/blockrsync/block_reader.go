@@ -1,26 +1,36 @@
 package blockrsync
 
 import (
-	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/codec"
 )
 
 const (
-	Hole byte = iota
-	Block
+	Hole  = codec.RecordHole
+	Block = codec.RecordBlock
+	// recordEnd is the state of the reader once the stream ended between
+	// records, it is never sent.
+	recordEnd byte = 0xff
 )
 
 type BlockReader struct {
-	source     io.Reader
+	source     *codec.Decoder
 	buf        []byte
 	offset     int64
 	offsetType byte
+	sourceSize int64
 	log        logr.Logger
 }
 
 func NewBlockReader(source io.Reader, blockSize int, log logr.Logger) *BlockReader {
+	return newBlockReader(codec.NewDecoder(source, codec.CurrentVersion, 0), blockSize, log)
+}
+
+func newBlockReader(source *codec.Decoder, blockSize int, log logr.Logger) *BlockReader {
 	return &BlockReader{
 		source: source,
 		buf:    make([]byte, blockSize),
@@ -28,22 +38,51 @@ func NewBlockReader(source io.Reader, blockSize int, log logr.Logger) *BlockRead
 	}
 }
 
+// ReadSourceSize reads the size of the source that starts the record stream.
+func (b *BlockReader) ReadSourceSize() (int64, error) {
+	size, err := b.source.ReadSourceSize()
+	if err != nil {
+		return 0, err
+	}
+	b.sourceSize = size
+	return size, nil
+}
+
+// SetSourceSize sets the size of the source, so the length of a partial last
+// block is known without relying on the end of the stream.
+func (b *BlockReader) SetSourceSize(size int64) {
+	b.sourceSize = size
+}
+
+// Next reads the next record, it returns false at the end of the stream. The
+// stream ends between records, IsEnd is then true, or within a partial last
+// block without the record lengths feature, that block is still read.
 func (b *BlockReader) Next() (bool, error) {
-	var offset int64
-	if err := binary.Read(b.source, binary.LittleEndian, &offset); err != nil {
+	offset, err := b.source.ReadRecordOffset()
+	if err != nil {
 		b.log.V(5).Info("Failed to read offset", "error", err)
-		return handleReadError(err, nocallback)
+		return handleReadError(err, b.end)
 	}
 	b.offset = offset
 
-	offsetType := make([]byte, 1)
-	if n, err := b.source.Read(offsetType); err != nil || n != 1 {
-		b.log.V(5).Info("Failed to read offset type", "error", err, "bytes", n)
-		return handleReadError(err, nocallback)
+	offsetType, err := b.source.ReadRecordType()
+	if err != nil {
+		b.log.V(5).Info("Failed to read offset type", "error", err)
+		return handleReadError(err, b.end)
+	}
+	b.offsetType = offsetType
+	if b.source.Features().Has(codec.FeatureRecordLengths) && (b.offsetType == Block || b.offsetType == Hole) {
+		return b.readRecord()
 	}
-	b.offsetType = offsetType[0]
-	if !b.IsHole() {
-		if n, err := io.ReadFull(b.source, b.buf[:cap(b.buf)]); err != nil {
+	if b.offsetType == Block {
+		b.buf = b.buf[:cap(b.buf)]
+		if b.sourceSize > 0 {
+			if offset < 0 || offset >= b.sourceSize {
+				return false, fmt.Errorf("block offset %d is outside of the source size %d", offset, b.sourceSize)
+			}
+			b.buf = b.buf[:min(int64(len(b.buf)), b.sourceSize-offset)]
+		}
+		if n, err := b.source.ReadBlockData(b.buf); err != nil {
 			b.log.V(5).Info("Failed to read complete block", "error", err, "bytes", n)
 			return handleReadError(err, func() {
 				b.buf = b.buf[:n]
@@ -53,6 +92,44 @@ func (b *BlockReader) Next() (bool, error) {
 	return true, nil
 }
 
+// readRecord reads a block or hole record with an explicit length, the length
+// must be the block size or the rest of the source at its end. A stream that
+// ends within the record is an error.
+func (b *BlockReader) readRecord() (bool, error) {
+	length, err := b.source.ReadRecordLength()
+	if err != nil {
+		return false, err
+	}
+	if b.offset < 0 || b.offset >= b.sourceSize {
+		return false, fmt.Errorf("record offset %d is outside of the source size %d", b.offset, b.sourceSize)
+	}
+	if expected := min(int64(cap(b.buf)), b.sourceSize-b.offset); int64(length) != expected {
+		return false, fmt.Errorf("record at offset %d has length %d, expected %d", b.offset, length, expected)
+	}
+	if b.offsetType == Hole {
+		return true, nil
+	}
+	b.buf = b.buf[:length]
+	if _, err := b.source.ReadBlockData(b.buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// end records that the stream ended without a complete record header.
+func (b *BlockReader) end() {
+	b.offsetType = recordEnd
+}
+
+// IsEnd returns true if the stream ended between records, there is no record
+// to apply.
+func (b *BlockReader) IsEnd() bool {
+	return b.offsetType == recordEnd
+}
+
 func (b *BlockReader) Offset() int64 {
 	return b.offset
 }
@@ -61,6 +138,36 @@ func (b *BlockReader) IsHole() bool {
 	return b.offsetType == Hole
 }
 
+// IsPassEnd returns true if the record ends a pass in iterative mode, the
+// offset is the pass number.
+func (b *BlockReader) IsPassEnd() bool {
+	return b.offsetType == codec.RecordPassEnd
+}
+
+// PassChecksum reads the stream checksum following a pass end record, it
+// returns the checksum sent by the client and the checksum of the records
+// received.
+func (b *BlockReader) PassChecksum() (uint32, uint32, error) {
+	return b.source.ReadPassChecksum()
+}
+
+// Digest reads the digest of the source following the stream checksum of a
+// pass end record.
+func (b *BlockReader) Digest() ([]byte, error) {
+	return b.source.ReadDigest()
+}
+
+// IsResize returns true if the record changes the size of the source, the
+// offset is the new size.
+func (b *BlockReader) IsResize() bool {
+	return b.offsetType == codec.RecordResize
+}
+
+// IsCancel returns true if the client cancelled the sync, no record follows.
+func (b *BlockReader) IsCancel() bool {
+	return b.offsetType == codec.RecordCancel
+}
+
 func (b *BlockReader) Block() []byte {
 	return b.buf
 }
@@ -9,6 +9,8 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
 )
 
 const (
@@ -52,6 +54,7 @@ var _ = Describe(blockReader, func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(cont).To(BeFalse())
 		Expect(br.Offset()).To(Equal(int64(0)))
+		Expect(br.IsEnd()).To(BeTrue())
 	})
 
 	It("should handle not receiving offset type data", func() {
@@ -65,6 +68,7 @@ var _ = Describe(blockReader, func() {
 		Expect(err).ToNot(HaveOccurred())
 		Expect(cont).To(BeFalse())
 		Expect(br.Offset()).To(Equal(int64(4096)))
+		Expect(br.IsEnd()).To(BeTrue())
 	})
 
 	It("should skip reading data if receiving a hole", func() {
@@ -96,6 +100,117 @@ var _ = Describe(blockReader, func() {
 		Expect(br.Offset()).To(Equal(int64(4096)))
 		Expect(br.Block()).To(HaveLen(1))
 		Expect(br.Block()[0]).To(Equal(byte(255)), "%v", br.Block())
+		Expect(br.IsEnd()).To(BeFalse())
+	})
+
+	It("should read a partial last block followed by a pass end", func() {
+		buf := bytes.NewBuffer([]byte{})
+		Expect(binary.Write(buf, binary.LittleEndian, int64(4))).To(Succeed())
+		buf.Write([]byte{Block, 1, 2})
+		Expect(binary.Write(buf, binary.LittleEndian, int64(1))).To(Succeed())
+		buf.Write([]byte{codec.RecordPassEnd})
+		br := NewBlockReader(buf, 4, GinkgoLogr.WithName(blockReader))
+		br.SetSourceSize(6)
+		cont, err := br.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cont).To(BeTrue())
+		Expect(br.Block()).To(Equal([]byte{1, 2}))
+		cont, err = br.Next()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cont).To(BeTrue())
+		Expect(br.IsPassEnd()).To(BeTrue())
+	})
+
+	It("should end the stream after a pass end instead of returning it again", func() {
+		buf := bytes.NewBuffer([]byte{})
+		e := codec.NewEncoder(buf, codec.CurrentVersion, codec.FeatureIterative)
+		Expect(e.WriteBlock(0, []byte{1, 2, 3, 4})).To(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		br := newBlockReader(codec.NewDecoder(buf, codec.CurrentVersion, codec.FeatureIterative), 4, GinkgoLogr.WithName(blockReader))
+		Expect(br.Next()).To(BeTrue())
+		Expect(br.IsEnd()).To(BeFalse())
+		Expect(br.Next()).To(BeTrue())
+		Expect(br.IsPassEnd()).To(BeTrue())
+		Expect(br.PassChecksum()).Error().ToNot(HaveOccurred())
+		for i := 0; i < 2; i++ {
+			Expect(br.Next()).To(BeFalse())
+			Expect(br.IsEnd()).To(BeTrue())
+			Expect(br.IsPassEnd()).To(BeFalse())
+			Expect(br.IsHole()).To(BeFalse())
+		}
+	})
+
+	It("should reject a block past the source size", func() {
+		buf := bytes.NewBuffer([]byte{})
+		Expect(binary.Write(buf, binary.LittleEndian, int64(8))).To(Succeed())
+		buf.Write([]byte{Block, 1, 2})
+		br := NewBlockReader(buf, 4, GinkgoLogr.WithName(blockReader))
+		br.SetSourceSize(6)
+		_, err := br.Next()
+		Expect(err).To(MatchError(ContainSubstring("outside of the source size")))
+	})
+
+	Context("with record lengths", func() {
+		newReader := func(records func(e *codec.Encoder)) *BlockReader {
+			buf := bytes.NewBuffer([]byte{})
+			e := codec.NewEncoder(buf, codec.CurrentVersion, codec.FeatureRecordLengths)
+			Expect(e.WriteSourceSize(6)).To(Succeed())
+			records(e)
+			br := newBlockReader(codec.NewDecoder(buf, codec.CurrentVersion, codec.FeatureRecordLengths), 4, GinkgoLogr.WithName(blockReader))
+			Expect(br.ReadSourceSize()).To(Equal(int64(6)))
+			return br
+		}
+
+		It("should read a short last block and hole", func() {
+			br := newReader(func(e *codec.Encoder) {
+				Expect(e.WriteHole(0, 4)).To(Succeed())
+				Expect(e.WriteBlock(4, []byte{1, 2})).To(Succeed())
+				Expect(e.WriteHole(4, 2)).To(Succeed())
+			})
+			Expect(br.Next()).To(BeTrue())
+			Expect(br.IsHole()).To(BeTrue())
+			Expect(br.Next()).To(BeTrue())
+			Expect(br.Block()).To(Equal([]byte{1, 2}))
+			Expect(br.Next()).To(BeTrue())
+			Expect(br.IsHole()).To(BeTrue())
+			Expect(br.Offset()).To(Equal(int64(4)))
+			Expect(br.Next()).To(BeFalse())
+			Expect(br.IsEnd()).To(BeTrue())
+		})
+
+		It("should reject a record that does not end at the source size", func() {
+			br := newReader(func(e *codec.Encoder) {
+				Expect(e.WriteBlock(4, []byte{1})).To(Succeed())
+			})
+			_, err := br.Next()
+			Expect(err).To(MatchError(ContainSubstring("has length 1, expected 2")))
+			br = newReader(func(e *codec.Encoder) {
+				Expect(e.WriteHole(0, 2)).To(Succeed())
+			})
+			_, err = br.Next()
+			Expect(err).To(MatchError(ContainSubstring("has length 2, expected 4")))
+		})
+
+		It("should reject a record past the source size", func() {
+			br := newReader(func(e *codec.Encoder) {
+				Expect(e.WriteHole(8, 4)).To(Succeed())
+			})
+			_, err := br.Next()
+			Expect(err).To(MatchError(ContainSubstring("outside of the source size")))
+		})
+
+		It("should not apply a block the stream ended in", func() {
+			buf := bytes.NewBuffer([]byte{})
+			e := codec.NewEncoder(buf, codec.CurrentVersion, codec.FeatureRecordLengths)
+			Expect(e.WriteSourceSize(6)).To(Succeed())
+			Expect(e.WriteBlock(4, []byte{1, 2})).To(Succeed())
+			// Drop the last byte of the block
+			buf.Truncate(buf.Len() - 1)
+			br := newBlockReader(codec.NewDecoder(buf, codec.CurrentVersion, codec.FeatureRecordLengths), 4, GinkgoLogr.WithName(blockReader))
+			Expect(br.ReadSourceSize()).To(Equal(int64(6)))
+			_, err := br.Next()
+			Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		})
 	})
 })
 
@@ -0,0 +1,69 @@
+package blockrsync
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	blockLogEvery    = 10000
+	blockLogInterval = time.Second
+)
+
+// blockLogger logs the blocks of a transfer at V(5). A line per block slows
+// down large transfers, so unless tracing the blocks are counted and logged
+// every blockLogEvery blocks or once per blockLogInterval.
+type blockLogger struct {
+	log        logr.Logger
+	msg        string
+	tracing    bool
+	blocks     int64
+	bytes      int64
+	lastOffset int64
+	logged     int64
+	lastLog    time.Time
+}
+
+func newBlockLogger(log logr.Logger, msg string, tracing bool) *blockLogger {
+	return &blockLogger{
+		log:     log.V(5),
+		msg:     msg,
+		tracing: tracing,
+		lastLog: time.Now(),
+	}
+}
+
+// add records a block, it is logged right away when tracing.
+func (b *blockLogger) add(offset, size int64) {
+	if !b.log.Enabled() {
+		return
+	}
+	if b.tracing {
+		b.log.Info(b.msg, "offset", offset, "size", size)
+		return
+	}
+	b.blocks++
+	b.bytes += size
+	b.lastOffset = offset
+	if b.blocks-b.logged >= blockLogEvery || time.Since(b.lastLog) >= blockLogInterval {
+		b.flush()
+	}
+}
+
+// trace logs a per block line only when tracing.
+func (b *blockLogger) trace(msg string, keysAndValues ...interface{}) {
+	if b.tracing {
+		b.log.Info(msg, keysAndValues...)
+	}
+}
+
+// flush logs the blocks counted since the last line.
+func (b *blockLogger) flush() {
+	if b.tracing || b.blocks == b.logged {
+		return
+	}
+	b.log.Info(b.msg, "blocks", b.blocks, "bytes", b.bytes, "lastOffset", b.lastOffset)
+	b.logged = b.blocks
+	b.lastLog = time.Now()
+}
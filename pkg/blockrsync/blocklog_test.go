@@ -0,0 +1,51 @@
+package blockrsync
+
+import (
+	"github.com/go-logr/logr"
+	"github.com/go-logr/logr/funcr"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("block logger tests", func() {
+	var lines []string
+
+	newLogger := func(verbosity int) logr.Logger {
+		lines = nil
+		return funcr.New(func(prefix, args string) {
+			lines = append(lines, args)
+		}, funcr.Options{Verbosity: verbosity})
+	}
+
+	It("should sample blocks unless tracing", func() {
+		blockLog := newBlockLogger(newLogger(5), "Sending data", false)
+		for i := int64(0); i < 2*blockLogEvery+5; i++ {
+			blockLog.add(i*4096, 4096)
+		}
+		Expect(lines).To(HaveLen(2))
+		blockLog.flush()
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[2]).To(ContainSubstring(`"blocks"=20005`))
+		blockLog.flush()
+		Expect(lines).To(HaveLen(3))
+	})
+
+	It("should log every block when tracing", func() {
+		blockLog := newBlockLogger(newLogger(5), "Sending data", true)
+		for i := int64(0); i < 5; i++ {
+			blockLog.add(i*4096, 4096)
+		}
+		blockLog.trace("Skipping empty block", "offset", 0)
+		blockLog.flush()
+		Expect(lines).To(HaveLen(6))
+	})
+
+	It("should not log below verbosity 5", func() {
+		blockLog := newBlockLogger(newLogger(4), "Sending data", true)
+		blockLog.add(0, 4096)
+		blockLog.trace("Skipping empty block", "offset", 0)
+		blockLog.flush()
+		Expect(lines).To(BeEmpty())
+	})
+})
@@ -0,0 +1,60 @@
+package blockrsync
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	bloomFalsePositiveRate = 0.01
+	maxBloomHashCount      = 16
+)
+
+// bloomFilter is a set of block hashes keyed by offset. A block of the source
+// that is not in the target filter is known to be different before the
+// complete hash list is received.
+type bloomFilter struct {
+	words     []uint64
+	hashCount uint8
+}
+
+func newBloomFilter(entries int) *bloomFilter {
+	entries = max(entries, 1)
+	bits := math.Ceil(-float64(entries) * math.Log(bloomFalsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashCount := math.Round(bits / float64(entries) * math.Ln2)
+	return &bloomFilter{
+		words:     make([]uint64, int(bits)/64+1),
+		hashCount: uint8(min(max(hashCount, 1), maxBloomHashCount)),
+	}
+}
+
+// indexes derives the bit positions from the block hash itself, which is
+// already uniformly distributed, mixed with the offset.
+func (b *bloomFilter) indexes(offset int64, hash []byte, f func(bit uint64) bool) bool {
+	bits := uint64(len(b.words)) * 64
+	h1 := binary.LittleEndian.Uint64(hash[0:8]) ^ (uint64(offset) * 0x9e3779b97f4a7c15)
+	h2 := binary.LittleEndian.Uint64(hash[8:16]) | 1
+	for i := uint64(0); i < uint64(b.hashCount); i++ {
+		if !f((h1 + i*h2) % bits) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(offset int64, hash []byte) {
+	b.indexes(offset, hash, func(bit uint64) bool {
+		b.words[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain returns false if the block is definitely not in the filter.
+func (b *bloomFilter) mayContain(offset int64, hash []byte) bool {
+	if len(b.words) == 0 || len(hash) < 16 {
+		return true
+	}
+	return b.indexes(offset, hash, func(bit uint64) bool {
+		return b.words[bit/64]&(1<<(bit%64)) != 0
+	})
+}
@@ -0,0 +1,53 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bloom filter tests", func() {
+	randomHash := func() []byte {
+		hash := make([]byte, 64)
+		_, _ = rand.Read(hash)
+		return hash
+	}
+
+	It("should contain every added block and reject most others", func() {
+		filter := newBloomFilter(1000)
+		hashes := make([][]byte, 1000)
+		for i := range hashes {
+			hashes[i] = randomHash()
+			filter.add(int64(i)*4096, hashes[i])
+		}
+		for i, hash := range hashes {
+			Expect(filter.mayContain(int64(i)*4096, hash)).To(BeTrue())
+		}
+		falsePositives := 0
+		for i := range hashes {
+			if filter.mayContain(int64(i)*4096, randomHash()) {
+				falsePositives++
+			}
+		}
+		Expect(falsePositives).To(BeNumerically("<", 50))
+	})
+
+	It("should treat the same hash at another offset as different", func() {
+		filter := newBloomFilter(1000)
+		hash := randomHash()
+		filter.add(0, hash)
+		Expect(filter.mayContain(0, hash)).To(BeTrue())
+		Expect(filter.mayContain(1<<40, hash)).To(BeFalse())
+	})
+})
+
+var _ = Describe("early offsets tests", func() {
+	DescribeTable("should remove the blocks already sent", func(offsets, sent, expected []int64) {
+		Expect(subtractOffsets(offsets, sent)).To(Equal(expected))
+	},
+		Entry("nothing sent", []int64{0, 4}, nil, []int64{0, 4}),
+		Entry("some sent", []int64{0, 4, 8}, []int64{4}, []int64{0, 8}),
+		Entry("all sent", []int64{0, 4}, []int64{4, 0}, nil),
+	)
+})
@@ -0,0 +1,72 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	ErrBudgetExhausted = errors.New("transfer budget exhausted")
+)
+
+// Checkpoint is written when a sync stops because of its budget or is
+// cancelled. The blocks that were sent are on the target, so running the sync
+// again continues with the remaining blocks.
+type Checkpoint struct {
+	SourceFile string `json:"sourceFile"`
+	SourceSize int64  `json:"sourceSize"`
+	BlockSize  int64  `json:"blockSize"`
+	Pass       int    `json:"pass"`
+	SentBlocks int64  `json:"sentBlocks"`
+	// RemainingBlocks are the offsets of the blocks that were not sent, they
+	// are informational only. The next sync hashes and diffs both sides
+	// again, so it finds the remaining blocks itself and never reads them
+	// from the checkpoint
+	RemainingBlocks []int64 `json:"remainingBlocks"`
+	Time            string  `json:"time"`
+}
+
+// checkBudget returns ErrBudgetExhausted once the sync ran for longer than the
+// maximum duration or sent the maximum bytes, or ErrCancelled once it was
+// cancelled, remembering the blocks that were not sent.
+func (b *BlockrsyncClient) checkBudget(remaining []int64) error {
+	if b.ctx.Err() != nil {
+		b.remaining = remaining
+		b.log.Info("Stopping, sync cancelled", "remaining blocks", len(remaining))
+		return ErrCancelled
+	}
+	var sent int64
+	b.stats.Update(func(s *Stats) { sent = s.BytesTransferred })
+	if (b.opts.MaxDuration > 0 && time.Since(b.startTime) >= b.opts.MaxDuration) ||
+		(b.opts.MaxBytes > 0 && sent >= b.opts.MaxBytes) {
+		b.remaining = remaining
+		b.log.Info("Stopping, transfer budget exhausted", "bytes", sent, "elapsed", time.Since(b.startTime).String(), "remaining blocks", len(remaining))
+		return ErrBudgetExhausted
+	}
+	return nil
+}
+
+func (b *BlockrsyncClient) writeCheckpoint() error {
+	var sentBlocks int64
+	var pass int
+	b.stats.Update(func(s *Stats) {
+		sentBlocks = s.BlocksTransferred + s.HolesTransferred
+		pass = len(s.Passes) + 1
+	})
+	checkpoint := Checkpoint{
+		SourceFile:      b.sourceFile,
+		SourceSize:      b.sourceSize,
+		BlockSize:       b.hasher.BlockSize(),
+		Pass:            pass,
+		SentBlocks:      sentBlocks,
+		RemainingBlocks: b.remaining,
+		Time:            time.Now().UTC().Format(time.RFC3339),
+	}
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(b.opts.CheckpointFile, data, 0644)
+}
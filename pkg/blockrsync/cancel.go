@@ -0,0 +1,37 @@
+package blockrsync
+
+import (
+	"errors"
+	"os"
+
+	"github.com/go-logr/logr"
+)
+
+var (
+	ErrCancelled = errors.New("sync cancelled")
+)
+
+// cancelled returns true once the channel is closed.
+func cancelled(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	default:
+		return false
+	}
+}
+
+// syncCancelled flushes the blocks written to the target of a cancelled sync
+// to disk, so the next sync only sends the blocks that were not written.
+func syncCancelled(f *os.File, stats *Stats, audit *auditor, log logr.Logger) error {
+	stopPhase := stats.StartPhase(PhaseFsync, log)
+	err := audit.fsync(f)
+	stopPhase()
+	if err != nil {
+		return err
+	}
+	var written int64
+	stats.Update(func(s *Stats) { written = s.BlocksTransferred + s.HolesTransferred })
+	log.Info("Sync cancelled, the written blocks are on disk", "blocks", written)
+	return ErrCancelled
+}
@@ -0,0 +1,116 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cancel tests", func() {
+	var (
+		tmpDir     string
+		sourceFile string
+		targetFile string
+		source     []byte
+		target     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 16*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		target = bytes.Clone(source)
+		_, _ = rand.Read(target[4*4096 : 8*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+	})
+
+	newSync := func(opts ...Option) (*BlockrsyncClient, *BlockrsyncServer) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, append([]Option{WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client"))}, opts...)...)
+		Expect(err).ToNot(HaveOccurred())
+		return client, server
+	}
+
+	It("should cancel the target when the client is cancelled", func() {
+		var client *BlockrsyncClient
+		checkpointFile := filepath.Join(tmpDir, "checkpoint.json")
+		client, server := newSync(WithHooks(Hooks{
+			PostDiff: func(pass int, offsets []int64) error {
+				client.Cancel()
+				return nil
+			},
+		}), func(c *constructorConfig) { c.opts.CheckpointFile = checkpointFile })
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(MatchError(ErrCancelled))
+		Expect(<-serverDone).To(MatchError(ErrCancelled))
+		Expect(os.ReadFile(targetFile)).To(Equal(target))
+
+		data, err := os.ReadFile(checkpointFile)
+		Expect(err).ToNot(HaveOccurred())
+		checkpoint := Checkpoint{}
+		Expect(json.Unmarshal(data, &checkpoint)).To(Succeed())
+		Expect(checkpoint.RemainingBlocks).To(ConsistOf(int64(4*4096), int64(5*4096), int64(6*4096), int64(7*4096)))
+	})
+
+	It("should cancel the target when the client is cancelled before connecting", func() {
+		client, server := newSync()
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		client.Cancel()
+		Expect(client.ConnectToTarget()).To(MatchError(ErrCancelled))
+		Expect(<-serverDone).To(MatchError(ErrCancelled))
+		Expect(os.ReadFile(targetFile)).To(Equal(target))
+	})
+
+	It("should stop listening when the server is cancelled", func() {
+		_, server := newSync()
+		server.Cancel()
+		Expect(server.StartServer()).To(MatchError(ErrCancelled))
+	})
+
+	It("should sync the received blocks when the server is cancelled", func() {
+		client, server := newSync()
+		server.opts.Hooks.PreWrite = func(offset int64, data []byte) error {
+			server.Cancel()
+			return nil
+		}
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).ToNot(Succeed())
+		Expect(<-serverDone).To(MatchError(ErrCancelled))
+		written, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written[4*4096 : 5*4096]).To(Equal(source[4*4096 : 5*4096]))
+	})
+
+	It("should cancel a local copy", func() {
+		opts := &BlockRsyncOptions{BlockSize: 4096}
+		localCopy := NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy"))
+		opts.Hooks.PostDiff = func(pass int, offsets []int64) error {
+			localCopy.Cancel()
+			return nil
+		}
+		Expect(localCopy.Copy()).To(MatchError(ErrCancelled))
+		if localCopy.Stats().BytesCloned == 0 {
+			Expect(os.ReadFile(targetFile)).To(Equal(target))
+		}
+	})
+})
@@ -1,16 +1,24 @@
 package blockrsync
 
 import (
-	"encoding/binary"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"slices"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/golang/snappy"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 type BlockrsyncClient struct {
@@ -20,71 +28,476 @@ type BlockrsyncClient struct {
 	opts               *BlockRsyncOptions
 	log                logr.Logger
 	connectionProvider ConnectionProvider
+	stats              *Stats
+	protocol           codec.Hello
+	// sentHashes are the hashes of the blocks sent in the current pass
+	sentHashes map[int64][]byte
+	// bitmap has the blocks sent in the current pass with a bitmap file
+	bitmap *TransferBitmap
+	// excluded are the normalized ExcludeRanges of the options
+	excluded  ExcludedRanges
+	startTime time.Time
+	// remaining are the blocks not sent when the budget was exhausted
+	remaining   []int64
+	readLimiter *transport.Limiter
+	// readAhead tunes the runs read ahead when adaptive, up to maxReadAhead
+	readAhead    *adaptiveLimit
+	maxReadAhead int
+	blockLog     *blockLogger
+	overall      *overallProgress
+	audit        *auditor
+	// diffs records the blocks that differ with a diff file
+	diffs  *diffRecorder
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewBlockrsyncClient(sourceFile, targetAddress string, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncClient {
+	readLimiter := opts.readLimiter()
+	overall := opts.overallProgress(clientProgressPhases...)
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := NewStats()
+	audit := newAuditor(opts.Audit, stats, logger.WithName("audit"))
+	readAhead, maxReadAhead := opts.readAheadLimit(logger.WithName("adaptive"))
 	return &BlockrsyncClient{
-		sourceFile: sourceFile,
-		hasher:     NewFileHasher(int64(opts.BlockSize), logger.WithName("hasher")),
-		opts:       opts,
-		log:        logger,
-		connectionProvider: &NetworkConnectionProvider{
-			targetAddress: targetAddress,
-			port:          port,
-		},
+		sourceFile:         sourceFile,
+		readAhead:          readAhead,
+		maxReadAhead:       maxReadAhead,
+		hasher:             opts.newHasher(readLimiter, ProgressHashSource, overall, audit, ctx.Done(), logger.WithName("hasher")),
+		readLimiter:        readLimiter,
+		opts:               opts,
+		log:                logger,
+		connectionProvider: opts.connectionProvider(targetAddress, port),
+		stats:              stats,
+		excluded:           opts.ExcludeRanges.normalized(),
+		blockLog:           newBlockLogger(logger, "Sending data", opts.TraceBlocks),
+		overall:            overall,
+		audit:              audit,
+		ctx:                ctx,
+		cancel:             cancel,
 	}
 }
 
+// NewBlockrsyncClientWithOptions creates a client with a copy of opts, the
+// options that are not set use their defaults. It fails if the options are
+// invalid.
+func NewBlockrsyncClientWithOptions(sourceFile, targetAddress string, port int, opts *BlockRsyncOptions, logger logr.Logger) (*BlockrsyncClient, error) {
+	opts, err := opts.validated()
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockrsyncClient(sourceFile, targetAddress, port, opts, logger), nil
+}
+
+func (b *BlockrsyncClient) Stats() *Stats {
+	return b.stats
+}
+
+// Cancel stops the sync, ConnectToTarget returns ErrCancelled. The target
+// writes the blocks it received to disk before the sync ends, and a
+// checkpoint is written if the options have a checkpoint file.
+func (b *BlockrsyncClient) Cancel() {
+	b.cancel()
+}
+
 func (b *BlockrsyncClient) ConnectToTarget() error {
-	f, err := os.Open(b.sourceFile)
+	err := b.connectToTarget()
+	if err == nil && b.bitmap != nil && b.bitmap.Pass == 1 {
+		// The sync ended without a pass end
+		err = b.writeBitmap()
+	}
+	if err == nil {
+		b.overall.complete()
+		if serr := recordSavings(b.opts.SavingsFile, b.stats); serr != nil {
+			b.log.Error(serr, "Unable to record savings", "file", b.opts.SavingsFile)
+		}
+	}
+	if (errors.Is(err, ErrBudgetExhausted) || errors.Is(err, ErrCancelled)) && b.opts.CheckpointFile != "" {
+		if cerr := b.writeCheckpoint(); cerr != nil {
+			b.log.Error(cerr, "Unable to write checkpoint", "file", b.opts.CheckpointFile)
+		}
+	} else if err == nil && b.opts.CheckpointFile != "" {
+		// The sync completed, a previous checkpoint no longer applies
+		if rerr := os.Remove(b.opts.CheckpointFile); rerr != nil && !os.IsNotExist(rerr) {
+			b.log.Error(rerr, "Unable to remove checkpoint", "file", b.opts.CheckpointFile)
+		}
+	}
+	return b.opts.Hooks.postSync(b.stats, err)
+}
+
+func (b *BlockrsyncClient) connectToTarget() (err error) {
+	b.startTime = time.Now()
+	start := b.startTime
+	f, err := b.audit.open(b.sourceFile, os.O_RDONLY, 0)
 	if err != nil {
 		return err
 	}
 	b.log.Info("Opened file", "file", b.sourceFile)
 	defer f.Close()
+	if b.diffs, err = openDiffRecorder(b.opts.DiffFile); err != nil {
+		return err
+	}
+	defer b.diffs.close()
 
-	size, err := b.hasher.HashFile(b.sourceFile)
-	if err != nil {
+	if err := b.opts.Hooks.preHash(b.sourceFile); err != nil {
 		return err
 	}
+	var conn io.ReadWriteCloser
+	if b.opts.Resume {
+		// The target tells which blocks it applied before the source is
+		// hashed
+		if conn, err = b.connect(); err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := b.resume(conn); err != nil {
+			return err
+		}
+	}
+	if b.opts.SourceDigest {
+		digestHashes(b.hasher)
+	}
+	pipeline := b.pipelineHasher()
+	var size int64
+	var hashed <-chan error
+	var sharded *FileHasher
+	if b.opts.ShardSize > 0 {
+		// The shards are hashed as they are synced
+		if sharded, err = fileHasher(b.hasher); err != nil {
+			return err
+		}
+		if size, err = sharded.getFileSize(b.sourceFile); err != nil {
+			return err
+		}
+	} else if pipeline != nil {
+		hashCtx, stopHashing := context.WithCancel(b.ctx)
+		defer stopHashing()
+		if size, hashed, err = b.hashInBackground(pipeline, hashCtx.Done()); err != nil {
+			return err
+		}
+	} else {
+		stopPhase := b.stats.StartPhase(PhaseHashSource, b.log)
+		size, err = b.hasher.HashFile(b.sourceFile)
+		stopPhase()
+		if err != nil && !errors.Is(err, ErrCancelled) {
+			return err
+		}
+	}
+	// A sync cancelled while hashing still connects to cancel the target
 	b.sourceSize = size
+	b.stats.Update(func(s *Stats) { s.SourceSize = size })
 	b.log.V(5).Info("Hashed file", "filename", b.sourceFile, "size", size)
-	conn, err := b.connectionProvider.Connect()
-	if err != nil {
-		return err
+	if conn == nil {
+		if conn, err = b.connect(); err != nil {
+			return err
+		}
+		defer conn.Close()
 	}
-	defer conn.Close()
-	reader := snappy.NewReader(conn)
-	var diff []int64
-	if blockSize, sourceHashes, err := b.hasher.DeserializeHashes(reader); err != nil {
-		return err
+	if b.opts.StreamChecksum && !b.protocol.Features.Has(codec.FeatureStreamChecksum) {
+		b.log.Info("Target did not enable the stream checksum, records are not checked")
+	}
+	if b.opts.SourceDigest && !b.protocol.Features.Has(codec.FeatureSourceDigest) {
+		b.log.Info("Target did not enable the source digest, the target is not verified")
+	}
+	if b.opts.iterative() {
+		b.sentHashes = make(map[int64][]byte)
+	}
+	if b.opts.BitmapFile != "" {
+		b.bitmap = newTransferBitmap(1, b.hasher.BlockSize())
+	}
+	connReader := bufio.NewReader(conn)
+	if b.protocol.Features.Has(codec.FeatureSeedHashes) {
+		if err := b.sendSeedHashes(conn, connReader); err != nil {
+			return err
+		}
+	}
+	if b.protocol.Features.Has(codec.FeaturePreflight) {
+		if err := b.preflight(conn, connReader, f, pipeline != nil || sharded != nil); err != nil {
+			return err
+		}
+	}
+	var shards shardPlan
+	if sharded != nil {
+		if shards, err = b.startShards(conn, connReader); err != nil {
+			return err
+		}
+	}
+	var reader io.Reader = connReader
+	if !b.protocol.Features.Has(codec.FeatureCompactHashes) && !b.protocol.Features.Has(codec.FeatureNoCompression) {
+		reader = snappy.NewReader(connReader)
+	}
+	decoder := codec.NewDecoder(reader, b.protocol.Version, b.protocol.Features)
+	var early []int64
+	if b.protocol.Features.Has(codec.FeatureBloomFilter) {
+		if early, err = b.readBloomFilter(decoder); err != nil {
+			return err
+		}
+	}
+
+	// Receive the hashes while sending the blocks the Bloom filter found
+	diffChan := make(chan diffResult, 1)
+	diffStop := make(chan struct{})
+	defer close(diffStop)
+	if sharded != nil {
+		// The shards are diffed as they are synced
+		close(diffChan)
+	} else if pipeline != nil {
+		go b.diffShards(decoder, pipeline, diffChan, diffStop)
+	} else {
+		go func() {
+			diff, err := b.receiveDiff(decoder)
+			diffChan <- diffResult{diff: diff, err: err}
+			close(diffChan)
+		}()
+	}
+
+	recordSize := b.opts.recordSize(conn, b.stats, b.log)
+	var writer *compressedWriter
+	var encoder *codec.Encoder
+	startTransfer := func() error {
+		if b.protocol.Features.Has(codec.FeatureNoCompression) {
+			writer = newUncompressedWriter(conn, recordSize, b.opts.FlushInterval, StageSend)
+		} else {
+			writer = newCompressedWriter(conn, recordSize, b.opts.FlushInterval, StageSend, newCPUPacer(b.opts.MaxCPU))
+		}
+		encoder = codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
+		b.log.V(5).Info("Sending size of source file")
+		return encoder.WriteSourceSize(b.sourceSize)
+	}
+	defer func() {
+		if writer != nil {
+			writer.Close()
+		}
+	}()
+	defer func() {
+		if !errors.Is(err, ErrCancelled) || !b.protocol.Features.Has(codec.FeatureCancel) {
+			return
+		}
+		if encoder == nil {
+			if err := startTransfer(); err != nil {
+				return
+			}
+		}
+		b.cancelTarget(encoder, writer, diffChan, connReader)
+	}()
+	stopTransfer := b.stats.StartPhase(PhaseTransfer, b.log)
+	defer stopTransfer()
+
+	if len(early) > 0 {
+		b.log.Info("Sending blocks missing from the target bloom filter", "count", len(early))
+		if err := startTransfer(); err != nil {
+			return err
+		}
+		if err := b.sendBlocks(encoder, early, f, b.opts.progress(ProgressEarlySync, b.overall, b.log)); err != nil {
+			return err
+		}
+		b.stats.Update(func(s *Stats) { s.EarlyBlocks = int64(len(early)) })
+	}
+	var dirty int64
+	if sharded != nil {
+		if err := startTransfer(); err != nil {
+			return err
+		}
+		acks := codec.NewDecoder(connReader, b.protocol.Version, b.protocol.Features)
+		if dirty, err = b.sendShardByShard(shards, sharded, decoder, acks, encoder, writer, f); err != nil {
+			return err
+		}
+		b.log.Info("Sharded sync complete", "shards", shards.count-shards.first, "dirty blocks", dirty)
+		return nil
+	} else if pipeline != nil {
+		if err := startTransfer(); err != nil {
+			return err
+		}
+		if dirty, err = b.sendShards(encoder, diffChan, f); err != nil {
+			return err
+		}
+		if err := <-hashed; err != nil {
+			return err
+		}
+		b.log.Info("Differences found", "count", dirty)
 	} else {
-		diff, err = b.hasher.DiffHashes(blockSize, sourceHashes)
+		var res diffResult
+		select {
+		case res = <-diffChan:
+		case <-b.ctx.Done():
+			return ErrCancelled
+		}
+		if res.err != nil {
+			return res.err
+		}
+		offsets, err := b.reportDiff(1, res.diff)
 		if err != nil {
 			return err
 		}
-		if len(diff) == 0 {
+		diff := subtractOffsets(offsets, early)
+		if len(res.diff) == 0 {
+			// The source size is still sent, the target may be larger than a
+			// source that is a prefix of it
 			b.log.Info("No differences found")
-			return nil
 		} else {
-			b.log.Info("Differences found", "count", len(diff))
+			b.log.Info("Differences found", "count", len(res.diff), "remaining", len(diff))
+		}
+		if encoder == nil {
+			if err := startTransfer(); err != nil {
+				return err
+			}
 		}
-	}
-	writer := snappy.NewBufferedWriter(conn)
-	defer writer.Close()
 
-	syncProgress := &progress{
-		progressType: "sync progress",
-		logger:       b.log,
-		start:        float64(50),
+		if err := b.sendBlocks(encoder, diff, f, b.opts.progress(ProgressSync, b.overall, b.log)); err != nil {
+			return err
+		}
+		dirty = int64(len(res.diff))
+	}
+	if digest := b.sourceDigest(); digest != nil {
+		b.log.Info("Computed the digest of the source", "digest", hex.EncodeToString(digest))
+	}
+	acks := codec.NewDecoder(connReader, b.protocol.Version, b.protocol.Features)
+	if b.opts.iterative() {
+		return b.runPasses(f, encoder, writer, acks, start, dirty)
 	}
-	if err := b.writeBlocksToServer(writer, diff, f, syncProgress); err != nil {
+	if b.protocol.Features.Has(codec.FeatureIterative) {
+		// Tell the target the sync completed, so it can tell a complete sync
+		// from one that stopped early
+		_, err := b.endPass(1, start, 0, dirty, encoder, writer, acks)
 		return err
 	}
+	return nil
+}
 
+// connect connects to the target and negotiates the protocol.
+func (b *BlockrsyncClient) connect() (io.ReadWriteCloser, error) {
+	conn, err := b.connectionProvider.Connect()
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return nil, ErrCancelled
+		}
+		return nil, err
+	}
+	if b.protocol, err = clientHandshake(conn, b.opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	b.log.Info("Negotiated protocol", "version", b.protocol.Version, "features", b.protocol.Features)
+	return conn, nil
+}
+
+// cancelTarget tells the target the sync was cancelled, and waits for it to
+// write the blocks it received to disk and close the connection.
+func (b *BlockrsyncClient) cancelTarget(encoder *codec.Encoder, writer *compressedWriter, diffChan <-chan diffResult, connReader io.Reader) {
+	if err := encoder.WriteCancel(); err != nil {
+		b.log.V(3).Info("Unable to send cancel", "error", err.Error())
+		return
+	}
+	if err := writer.Flush(); err != nil {
+		b.log.V(3).Info("Unable to send cancel", "error", err.Error())
+		return
+	}
+	// The target writes all hashes before it reads the records
+	for range diffChan {
+	}
+	_, _ = io.Copy(io.Discard, connReader)
+}
+
+// preflight sends the size of the source, the target refuses the sync if it
+// has no space for it. The data of a source that is still hashed is the
+// space allocated to it.
+func (b *BlockrsyncClient) preflight(w io.Writer, r io.Reader, f *os.File, hashing bool) error {
+	var data int64
+	if hashing {
+		data = allocatedSize(f, b.sourceSize)
+	} else {
+		data = dataSize(b.hasher.GetHashes(), b.hasher.BlockSize(), b.sourceSize, hashAlgorithmOf(b.hasher))
+	}
+	if err := codec.NewEncoder(w, b.protocol.Version, b.protocol.Features).WritePreflight(b.sourceSize, data); err != nil {
+		return err
+	}
+	message, err := codec.NewDecoder(r, b.protocol.Version, b.protocol.Features).ReadPreflightResult()
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		return fmt.Errorf("%w: %s", ErrPreflightRefused, message)
+	}
 	return nil
 }
 
+type diffResult struct {
+	diff []BlockDiff
+	err  error
+	// end is the end of the shard of a pipelined diff
+	end int64
+}
+
+func (b *BlockrsyncClient) receiveDiff(decoder *codec.Decoder) ([]BlockDiff, error) {
+	stopPhase := b.stats.StartPhase(PhaseExchange, b.log)
+	endStage := enterStage("", StageExchange)
+	blockSize, sourceHashes, err := b.hasher.DeserializeHashes(decoder)
+	endStage()
+	stopPhase()
+	if err != nil {
+		return nil, err
+	}
+	stopPhase = b.stats.StartPhase(PhaseDiff, b.log)
+	endStage = enterStage("", StageDiff)
+	diff, err := b.hasher.DiffHashes(blockSize, sourceHashes)
+	endStage()
+	stopPhase()
+	if err != nil {
+		return nil, err
+	}
+	b.stats.Update(func(s *Stats) { s.DifferentBlocks = int64(len(diff)) })
+	return diff, nil
+}
+
+// reportDiff records the blocks that differ in the diff file and calls the
+// post diff hook, it returns their offsets.
+func (b *BlockrsyncClient) reportDiff(pass int, diff []BlockDiff) ([]int64, error) {
+	if err := b.diffs.record(pass, diff); err != nil {
+		return nil, fmt.Errorf("unable to record the diff: %w", err)
+	}
+	offsets := diffOffsets(diff)
+	if err := b.opts.Hooks.postDiff(pass, offsets); err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// readBloomFilter returns the sorted offsets of the source blocks that are
+// definitely not on the target.
+func (b *BlockrsyncClient) readBloomFilter(decoder *codec.Decoder) ([]int64, error) {
+	hashCount, words, err := decoder.ReadBloomFilter()
+	if err != nil {
+		return nil, err
+	}
+	filter := &bloomFilter{words: words, hashCount: hashCount}
+	var res []int64
+	err = iterateHashes(b.hasher, func(offset int64, hash []byte) error {
+		if !filter.mayContain(offset, hash) {
+			res = append(res, offset)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// subtractOffsets returns the offsets that are not in sent.
+func subtractOffsets(offsets, sent []int64) []int64 {
+	if len(sent) == 0 {
+		return offsets
+	}
+	sentSet := make(map[int64]struct{}, len(sent))
+	for _, offset := range sent {
+		sentSet[offset] = struct{}{}
+	}
+	var res []int64
+	for _, offset := range offsets {
+		if _, ok := sentSet[offset]; !ok {
+			res = append(res, offset)
+		}
+	}
+	return res
+}
+
 func (b *BlockrsyncClient) writeBlocksToServer(writer io.Writer, offsets []int64, f io.ReaderAt, syncProgress Progress) error {
 	b.log.V(3).Info("Writing blocks to server")
 	t := time.Now()
@@ -92,59 +505,195 @@ func (b *BlockrsyncClient) writeBlocksToServer(writer io.Writer, offsets []int64
 		b.log.V(3).Info("Writing blocks took", "milliseconds", time.Since(t).Milliseconds())
 	}()
 
+	encoder := codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
 	b.log.V(5).Info("Sending size of source file")
-	if err := binary.Write(writer, binary.LittleEndian, b.sourceSize); err != nil {
+	if err := encoder.WriteSourceSize(b.sourceSize); err != nil {
+		return err
+	}
+	return b.sendBlocks(encoder, offsets, f, syncProgress)
+}
+
+func (b *BlockrsyncClient) sendBlocks(encoder *codec.Encoder, offsets []int64, f io.ReaderAt, syncProgress Progress) error {
+	defer enterStage("", StageSend)()
+	offsets, err := b.sendExcluded(encoder, offsets)
+	if err != nil {
 		return err
 	}
 	b.log.V(5).Info("Sorting offsets")
 	// Sort diff
 	slices.SortFunc(offsets, int64SortFunc)
+	b.opts.Priorities.sort(offsets)
 	b.log.V(5).Info("offsets", "values", offsets)
 	if syncProgress != nil {
 		syncProgress.Start(int64(len(offsets)) * b.hasher.BlockSize())
 	}
-	buf := make([]byte, b.hasher.BlockSize())
-	for i, offset := range offsets {
-		b.log.V(5).Info("Sending data", "offset", offset, "index", i, "blocksize", b.hasher.BlockSize())
-		if err := binary.Write(writer, binary.LittleEndian, offset); err != nil {
-			return err
-		}
-		n, err := f.ReadAt(buf, offset)
-		if err != nil && err != io.EOF {
-			return err
+	blockSize := b.hasher.BlockSize()
+	runs := coalesceOffsets(offsets, blockSize, b.opts.maxCoalescedBlocks(blockSize))
+	done := make(chan struct{})
+	defer close(done)
+	defer b.blockLog.flush()
+	i := 0
+	for run := range b.readRuns(f, runs, blockSize, done) {
+		if run.err != nil {
+			return run.err
 		}
-		if isEmptyBlock(buf) {
-			b.log.V(5).Info("Skipping empty block", "offset", offset)
-			if _, err := writer.Write([]byte{Hole}); err != nil {
+		for j, offset := range run.offsets {
+			if err := b.checkBudget(offsets[i:]); err != nil {
 				return err
 			}
-		} else {
-			_, err := writer.Write([]byte{Block})
-			if err != nil {
+			start := min(int64(j)*blockSize, int64(run.n))
+			block := run.buf[start:min(start+blockSize, int64(run.n))]
+			b.blockLog.add(offset, int64(len(block)))
+			if err := b.writeBlock(encoder, offset, block); err != nil {
 				return err
 			}
-			if int64(n) != b.hasher.BlockSize() {
-				b.log.V(5).Info("read last bytes", "count", n)
+			if syncProgress != nil {
+				syncProgress.Update(int64(i+1) * blockSize)
+			}
+			i++
+		}
+		run.release()
+	}
+	return nil
+}
+
+type readRun struct {
+	offsets []int64
+	buf     []byte
+	n       int
+	err     error
+	release func()
+}
+
+// readRuns reads the runs from the source in the background, so reading the
+// next run overlaps with sending the current one. Each run must be released
+// once sent to free its buffer, at most ReadAhead runs are in flight, or as
+// many as the adaptive limit allows.
+func (b *BlockrsyncClient) readRuns(f io.ReaderAt, runs [][]int64, blockSize int64, done <-chan struct{}) <-chan readRun {
+	readAhead := b.opts.readAhead()
+	maxReadAhead := max(b.maxReadAhead, readAhead)
+	bufferSize := blockSize * int64(b.opts.maxCoalescedBlocks(blockSize))
+	free := make(chan []byte, maxReadAhead)
+	for i := 0; i < readAhead; i++ {
+		free <- make([]byte, bufferSize)
+	}
+	allocated := readAhead
+	ready := make(chan readRun, maxReadAhead)
+	go func() {
+		defer enterStage("", StageRead)()
+		defer close(ready)
+		for _, offsets := range runs {
+			if !b.readAhead.acquire(done) {
+				return
+			}
+			if len(free) == 0 && allocated < maxReadAhead {
+				free <- make([]byte, bufferSize)
+				allocated++
+			}
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			buf = buf[:int64(len(offsets))*blockSize]
+			b.blockLog.trace("Reading run", "offset", offsets[0], "blocks", len(offsets))
+			if b.readLimiter != nil {
+				b.readLimiter.WaitN(len(buf))
+			}
+			t := time.Now()
+			n, err := f.ReadAt(buf, offsets[0])
+			if err == io.EOF {
+				err = nil
+			}
+			latency := time.Since(t)
+			run := readRun{
+				offsets: offsets,
+				buf:     buf,
+				n:       n,
+				err:     err,
+				release: func() {
+					free <- buf[:cap(buf)]
+					b.readAhead.release(int64(n), latency)
+				},
+			}
+			select {
+			case ready <- run:
+			case <-done:
+				return
 			}
-			buf = buf[:n]
-			b.log.V(5).Info("Writing bytes", "count", len(buf))
-			_, err = writer.Write(buf)
 			if err != nil {
-				return err
+				return
 			}
 		}
-		if syncProgress != nil {
-			syncProgress.Update(int64(i) * b.hasher.BlockSize())
+	}()
+	return ready
+}
+
+func (b *BlockrsyncClient) writeBlock(encoder *codec.Encoder, offset int64, block []byte) error {
+	if b.opts.FillPatterns.isHole(block) {
+		b.blockLog.trace("Skipping empty block", "offset", offset)
+		if err := encoder.WriteHole(offset, len(block)); err != nil {
+			return err
+		}
+		if !isEmptyBlock(block) {
+			// The target holds the zeroes of the hole, not the pattern
+			block = make([]byte, len(block))
 		}
+		b.recordSent(offset, block)
+		b.stats.Update(func(s *Stats) {
+			s.HolesTransferred++
+			s.HoleBytes += int64(len(block))
+		})
+		return nil
+	}
+	if err := encoder.WriteBlock(offset, block); err != nil {
+		return err
 	}
+	b.recordSent(offset, block)
+	b.stats.Update(func(s *Stats) {
+		s.BlocksTransferred++
+		s.BytesTransferred += int64(len(block))
+	})
 	return nil
 }
 
+// recordSent remembers the hash of the data sent in iterative mode, the
+// source may have changed since it was hashed, and marks the block in the
+// bitmap.
+func (b *BlockrsyncClient) recordSent(offset int64, block []byte) {
+	b.bitmap.set(offset)
+	if b.sentHashes != nil {
+		b.sentHashes[offset] = hashAlgorithmOf(b.hasher).sum(block)
+	}
+}
+
+// coalesceOffsets splits sorted offsets into runs of contiguous blocks of at
+// most maxBlocks blocks.
+func coalesceOffsets(offsets []int64, blockSize int64, maxBlocks int) [][]int64 {
+	var runs [][]int64
+	start := 0
+	for i := 1; i <= len(offsets); i++ {
+		if i == len(offsets) || offsets[i] != offsets[i-1]+blockSize || i-start >= maxBlocks {
+			runs = append(runs, offsets[start:i])
+			start = i
+		}
+	}
+	return runs
+}
+
+// zeroes is compared with blocks by isEmptyBlock.
+var zeroes = make([]byte, 64*1024)
+
+// isEmptyBlock compares the block with zeroes using bytes.Equal, which
+// compares many bytes per instruction with SIMD on most architectures.
 func isEmptyBlock(buf []byte) bool {
-	for _, b := range buf {
-		if b != 0 {
+	for len(buf) > 0 {
+		n := min(len(buf), len(zeroes))
+		if !bytes.Equal(buf[:n], zeroes[:n]) {
 			return false
 		}
+		buf = buf[n:]
 	}
 	return true
 }
@@ -165,21 +714,59 @@ type ConnectionProvider interface {
 type NetworkConnectionProvider struct {
 	targetAddress string
 	port          int
+	transport     transport.Transport
+	retries       int
+	retryInterval time.Duration
+	// alternates are more host:port addresses of the target
+	alternates []string
 }
 
 func (n *NetworkConnectionProvider) Connect() (io.ReadWriteCloser, error) {
-	retryCount := 0
-	var conn io.ReadWriteCloser
-	var err error
-	for conn == nil {
-		conn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", n.targetAddress, n.port))
-		if err != nil {
-			if retryCount > 30 {
-				return nil, fmt.Errorf("unable to connect to target after %d retries", retryCount)
-			}
-			time.Sleep(time.Second)
-			retryCount++
+	return n.dial(nil)
+}
+
+// UnixConnectionProvider connects to a target listening on a unix domain
+// socket on the same host.
+type UnixConnectionProvider struct {
+	socket        string
+	retries       int
+	retryInterval time.Duration
+}
+
+func (u *UnixConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	return transport.DialRetry(transport.Unix, u.socket, u.retries, u.retryInterval)
+}
+
+// connectionProvider returns the provider of the connections to the target,
+// on the unix socket of the options if it is set.
+func (o *BlockRsyncOptions) connectionProvider(targetAddress string, port int) ConnectionProvider {
+	retries, retryInterval := o.connectRetries()
+	if o.ConnectSocket != "" {
+		return &UnixConnectionProvider{
+			socket:        o.ConnectSocket,
+			retries:       retries,
+			retryInterval: retryInterval,
 		}
 	}
-	return conn, nil
+	return o.TLS.connectionProvider(&NetworkConnectionProvider{
+		targetAddress: targetAddress,
+		port:          port,
+		transport:     transport.OrDefault(o.Transport),
+		retries:       retries,
+		retryInterval: retryInterval,
+		alternates:    o.AlternateTargets,
+	})
+}
+
+// dial connects to the target address and the alternates at once, and
+// returns the connection that completes the handshake first.
+func (n *NetworkConnectionProvider) dial(handshake func(conn net.Conn, address string) (net.Conn, error)) (net.Conn, error) {
+	addresses := append([]string{net.JoinHostPort(n.targetAddress, strconv.Itoa(n.port))}, n.alternates...)
+	return transport.DialFirst(addresses, func(address string) (net.Conn, error) {
+		conn, err := transport.DialRetry(n.transport, address, n.retries, n.retryInterval)
+		if err != nil || handshake == nil {
+			return conn, err
+		}
+		return handshake(conn, address)
+	})
 }
@@ -3,16 +3,24 @@ package blockrsync
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"slices"
+	"syscall"
 
+	"github.com/go-logr/logr"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 const (
@@ -42,7 +50,7 @@ var _ = Describe("blockrsync client tests", func() {
 		By("writing the blocks to the server")
 		err := client.writeBlocksToServer(buf, testOffsets, file, &TestProgress{
 			expectedStart:  2,
-			expectedUpdate: 0,
+			expectedUpdate: 2,
 		})
 		Expect(err).ToNot(HaveOccurred())
 
@@ -216,6 +224,320 @@ var _ = Describe("blockrsync client tests", func() {
 			hash := md5sum.Sum(nil)
 			Expect(hex.EncodeToString(hash)).To(Equal(testMD5))
 		})
+
+		It("should sync changes made between passes", func() {
+			tmpDir, err := os.MkdirTemp("", "blockrsync")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 8*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+
+			var reports []PassReport
+			opts := BlockRsyncOptions{
+				BlockSize: 4096,
+				Passes:    3,
+				OnPass: func(report PassReport) bool {
+					reports = append(reports, report)
+					if report.Pass == 1 {
+						// Change a block while the sync is running
+						source, err := os.OpenFile(sourceFile, os.O_WRONLY, 0)
+						Expect(err).ToNot(HaveOccurred())
+						_, err = source.WriteAt(bytes.Repeat([]byte{0xFF}, 4096), 2*4096)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(source.Close()).To(Succeed())
+					}
+					return true
+				},
+			}
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client = NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			Expect(reports).To(HaveLen(2))
+			Expect(reports[0].DirtyBlocks).To(Equal(int64(8)))
+			Expect(reports[1].DirtyBlocks).To(Equal(int64(1)))
+			Expect(reports[1].BytesTransferred).To(Equal(int64(4096)))
+			Expect(client.Stats().Passes).To(HaveLen(3))
+			Expect(client.Stats().Passes[2].DirtyBlocks).To(BeZero())
+			source, err := os.ReadFile(sourceFile)
+			Expect(err).ToNot(HaveOccurred())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(source))
+		})
+
+		It("should preallocate the whole target", func() {
+			tmpDir, err := os.MkdirTemp("", "blockrsync")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 64*4096)
+			_, _ = rand.Read(data[:4096])
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client = NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, PreallocateTarget: true}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(data))
+			info, err := os.Stat(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Sys().(*syscall.Stat_t).Blocks * 512).To(BeNumerically(">=", len(data)))
+		})
+
+		It("should compare the stream checksum at the end of every pass", func() {
+			tmpDir, err := os.MkdirTemp("", "blockrsync")
+			Expect(err).ToNot(HaveOccurred())
+			defer os.RemoveAll(tmpDir)
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 8*4096+100)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+
+			opts := BlockRsyncOptions{
+				BlockSize:      4096,
+				Passes:         2,
+				StreamChecksum: true,
+				OnPass: func(report PassReport) bool {
+					source, err := os.OpenFile(sourceFile, os.O_WRONLY, 0)
+					Expect(err).ToNot(HaveOccurred())
+					_, err = source.WriteAt(make([]byte, 4096), 4096)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(source.Close()).To(Succeed())
+					return true
+				},
+			}
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client = NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, StreamChecksum: true}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			Expect(client.protocol.Features.Has(codec.FeatureStreamChecksum | codec.FeatureCRC32C)).To(BeTrue())
+			Expect(client.Stats().Passes).To(HaveLen(2))
+			source, err := os.ReadFile(sourceFile)
+			Expect(err).ToNot(HaveOccurred())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(source))
+		})
+
+		It("should follow the source when it grows and shrinks between passes", func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 8*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+
+			opts := BlockRsyncOptions{
+				BlockSize: 4096,
+				Passes:    4,
+				OnPass: func(report PassReport) bool {
+					switch report.Pass {
+					case 1:
+						// Grow the source with data and a hole at the end
+						source, err := os.OpenFile(sourceFile, os.O_WRONLY|os.O_APPEND, 0)
+						Expect(err).ToNot(HaveOccurred())
+						tail := make([]byte, 3*4096)
+						_, _ = rand.Read(tail[:4096+100])
+						_, err = source.Write(tail)
+						Expect(err).ToNot(HaveOccurred())
+						Expect(source.Close()).To(Succeed())
+					case 2:
+						Expect(os.Truncate(sourceFile, 5*4096+100)).To(Succeed())
+					}
+					return true
+				},
+			}
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client = NewBlockrsyncClient(sourceFile, "localhost", port, &opts, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			Expect(client.Stats().SourceSize).To(Equal(int64(5*4096 + 100)))
+			Expect(client.Stats().Passes).To(HaveLen(4))
+			Expect(client.Stats().Passes[1].DirtyBlocks).To(Equal(int64(3)))
+			source, err := os.ReadFile(sourceFile)
+			Expect(err).ToNot(HaveOccurred())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(source))
+		})
+
+		It("should stop when the budget is exhausted and continue on the next run", func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			checkpointFile := filepath.Join(tmpDir, "checkpoint.json")
+			data := make([]byte, 8*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+
+			sync := func(opts *BlockRsyncOptions) error {
+				port, err := getFreePort()
+				Expect(err).ToNot(HaveOccurred())
+				client := NewBlockrsyncClient(sourceFile, "localhost", port, opts, GinkgoLogr.WithName("client"))
+				server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+				serverDone := make(chan error, 1)
+				go func() {
+					serverDone <- server.StartServer()
+				}()
+				err = client.ConnectToTarget()
+				Expect(<-serverDone).To(Succeed())
+				return err
+			}
+			err := sync(&BlockRsyncOptions{BlockSize: 4096, MaxBytes: 3 * 4096, CheckpointFile: checkpointFile})
+			Expect(err).To(MatchError(ErrBudgetExhausted))
+			checkpointData, err := os.ReadFile(checkpointFile)
+			Expect(err).ToNot(HaveOccurred())
+			checkpoint := Checkpoint{}
+			Expect(json.Unmarshal(checkpointData, &checkpoint)).To(Succeed())
+			Expect(checkpoint.RemainingBlocks).To(HaveLen(5))
+
+			Expect(sync(&BlockRsyncOptions{BlockSize: 4096, CheckpointFile: checkpointFile})).To(Succeed())
+			Expect(checkpointFile).ToNot(BeAnExistingFile())
+			target, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target).To(Equal(data))
+		})
+
+		It("should sync a target with precomputed hashes", func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 8*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+			target := bytes.Clone(data)
+			_, _ = rand.Read(target[2*4096 : 3*4096])
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+			manifest := NewFileHasher(4096, GinkgoLogr)
+			size, err := manifest.HashFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			// Only the manifest is used, a change after it was taken is not noticed
+			_, _ = rand.Read(target[5*4096 : 6*4096])
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client = NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{
+				BlockSize: 4096,
+				NewHasher: func(blockSize int64, log logr.Logger) Hasher {
+					return NewPrecomputedHasher(blockSize, size, manifest.GetHashes(), false, log)
+				},
+			}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			Expect(client.Stats().DifferentBlocks).To(Equal(int64(1)))
+			target, err = os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(target[:5*4096]).To(Equal(data[:5*4096]))
+			Expect(target[5*4096 : 6*4096]).ToNot(Equal(data[5*4096 : 6*4096]))
+		})
+
+		It("should sync over an in-memory transport", func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			data := make([]byte, 64*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+			memory := transport.NewMemory(64 * 1024)
+			server, err := NewServer(targetFile, WithBlockSize(4096), WithTransport(memory), WithLogger(GinkgoLogr.WithName("server")))
+			Expect(err).ToNot(HaveOccurred())
+			client, err := NewClient(sourceFile, WithBlockSize(4096), WithTransport(memory), WithLogger(GinkgoLogr.WithName("client")))
+			Expect(err).ToNot(HaveOccurred())
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			Expect(os.ReadFile(targetFile)).To(Equal(data))
+		})
+
+		It("should replay a recorded session", func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile := filepath.Join(tmpDir, "source.raw")
+			targetFile := filepath.Join(tmpDir, "target.raw")
+			recording := filepath.Join(tmpDir, "recording")
+			data := make([]byte, 64*4096)
+			_, _ = rand.Read(data)
+			Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+			target := slices.Clone(data)
+			_, _ = rand.Read(target[8*4096 : 12*4096])
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+			recorder, err := transport.NewRecorder(recording, false)
+			Expect(err).ToNot(HaveOccurred())
+			recorded := transport.Wrap(transport.NewMemory(64*1024), recorder)
+			sync := func(serverTransport, clientTransport transport.Transport) {
+				server, err := NewServer(targetFile, WithBlockSize(4096), WithTransport(serverTransport), WithLogger(GinkgoLogr.WithName("server")))
+				Expect(err).ToNot(HaveOccurred())
+				client, err := NewClient(sourceFile, WithBlockSize(4096), WithTransport(clientTransport), WithLogger(GinkgoLogr.WithName("client")))
+				Expect(err).ToNot(HaveOccurred())
+				serverDone := make(chan error, 1)
+				go func() {
+					serverDone <- server.StartServer()
+				}()
+				Expect(client.ConnectToTarget()).To(Succeed())
+				Expect(<-serverDone).To(Succeed())
+			}
+			sync(recorded, recorded)
+			Expect(os.ReadFile(targetFile)).To(Equal(data))
+
+			By("replaying the server on the original target")
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+			replay, err := transport.NewReplay(recording, false)
+			Expect(err).ToNot(HaveOccurred())
+			server, err := NewServer(targetFile, WithBlockSize(4096), WithTransport(replay), WithLogger(GinkgoLogr.WithName("server")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(server.StartServer()).To(Succeed())
+			Expect(os.ReadFile(targetFile)).To(Equal(data))
+			Expect(server.Stats().BlocksTransferred).To(Equal(int64(4)))
+
+			By("replaying the client")
+			replay, err = transport.NewReplay(recording, false)
+			Expect(err).ToNot(HaveOccurred())
+			client, err := NewClient(sourceFile, WithBlockSize(4096), WithTransport(replay), WithLogger(GinkgoLogr.WithName("client")))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(client.Stats().DifferentBlocks).To(Equal(int64(4)))
+		})
 	})
 })
 
@@ -257,3 +579,126 @@ func getFreePort() (port int, err error) {
 	}
 	return
 }
+
+var _ = Describe("read coalescing tests", func() {
+	DescribeTable("should split offsets into contiguous runs", func(offsets []int64, maxBlocks int, expected [][]int64) {
+		Expect(coalesceOffsets(offsets, 2, maxBlocks)).To(Equal(expected))
+	},
+		Entry("no offsets", []int64{}, 4, nil),
+		Entry("single run", []int64{0, 2, 4}, 4, [][]int64{{0, 2, 4}}),
+		Entry("gap", []int64{0, 2, 6, 8}, 4, [][]int64{{0, 2}, {6, 8}}),
+		Entry("limited run length", []int64{0, 2, 4, 6, 8}, 2, [][]int64{{0, 2}, {4, 6}, {8}}),
+	)
+
+	It("should send each block of a run as a record", func() {
+		opts := BlockRsyncOptions{BlockSize: 2}
+		client := NewBlockrsyncClient(filepath.Join(testImagePath, testFileName), "localhost", 8080, &opts, GinkgoLogr)
+		client.sourceSize = 5
+		buf := bytes.NewBuffer([]byte{})
+		err := client.writeBlocksToServer(buf, []int64{0, 2, 4}, bytes.NewReader([]byte{1, 2, 0, 0, 3}), nil)
+		Expect(err).ToNot(HaveOccurred())
+		expected := bytes.NewBuffer([]byte{})
+		_ = binary.Write(expected, binary.LittleEndian, int64(5))
+		_ = binary.Write(expected, binary.LittleEndian, int64(0))
+		expected.Write([]byte{Block, 1, 2})
+		_ = binary.Write(expected, binary.LittleEndian, int64(2))
+		expected.Write([]byte{Hole})
+		_ = binary.Write(expected, binary.LittleEndian, int64(4))
+		expected.Write([]byte{Block, 3})
+		Expect(buf.Bytes()).To(Equal(expected.Bytes()))
+	})
+})
+
+type errorReaderAt struct{}
+
+func (e *errorReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("read error")
+}
+
+var _ = Describe("read ahead tests", func() {
+	It("should read more runs than there are buffers", func() {
+		opts := BlockRsyncOptions{BlockSize: 2}
+		client := NewBlockrsyncClient(filepath.Join(testImagePath, testFileName), "localhost", 8080, &opts, GinkgoLogr)
+		source := bytes.NewReader([]byte{1, 1, 0, 0, 2, 2, 0, 0, 3, 3, 0, 0, 4, 4})
+		done := make(chan struct{})
+		defer close(done)
+		var offsets []int64
+		for run := range client.readRuns(source, [][]int64{{0}, {4}, {8}, {12}}, 2, done) {
+			Expect(run.err).ToNot(HaveOccurred())
+			Expect(run.buf[:run.n]).To(Equal([]byte{byte(len(offsets) + 1), byte(len(offsets) + 1)}))
+			offsets = append(offsets, run.offsets...)
+			run.release()
+		}
+		Expect(offsets).To(Equal([]int64{0, 4, 8, 12}))
+	})
+
+	It("should return read errors", func() {
+		opts := BlockRsyncOptions{BlockSize: 2}
+		client := NewBlockrsyncClient(filepath.Join(testImagePath, testFileName), "localhost", 8080, &opts, GinkgoLogr)
+		err := client.writeBlocksToServer(bytes.NewBuffer([]byte{}), []int64{0, 4}, &errorReaderAt{}, nil)
+		Expect(err).To(MatchError("read error"))
+	})
+})
+
+var _ = Describe("small source tests", func() {
+	DescribeTable("should sync sources smaller than a block", func(sourceSize, targetSize int, prefix bool, configure func(*constructorConfig)) {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, sourceSize)
+		_, _ = rand.Read(source)
+		target := make([]byte, targetSize)
+		if prefix {
+			copy(target, source)
+		} else {
+			_, _ = rand.Read(target)
+		}
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")), configure)
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")), configure)
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	},
+		Entry("empty source and target", 0, 0, false, func(*constructorConfig) {}),
+		Entry("empty source, larger target", 0, 3*4096, false, func(*constructorConfig) {}),
+		Entry("partial block source, empty target", 100, 0, false, func(*constructorConfig) {}),
+		Entry("partial block source, different target", 100, 100, false, func(*constructorConfig) {}),
+		Entry("partial block source, larger target", 100, 4096+100, false, func(*constructorConfig) {}),
+		Entry("partial block source, target it is a prefix of", 100, 2*4096, true, func(*constructorConfig) {}),
+		Entry("full block source, target it is a prefix of", 4096, 4096+1, true, func(*constructorConfig) {}),
+		Entry("partial block source, target prefix of it", 100, 50, true, func(*constructorConfig) {}),
+		Entry("partial block source, target it is a prefix of, compat v0", 100, 2*4096, true, func(c *constructorConfig) { c.opts.Compat = codec.CompatV0 }),
+		Entry("same partial block, compat v0", 100, 100, true, func(c *constructorConfig) { c.opts.Compat = codec.CompatV0 }),
+		Entry("empty source, larger target, pipelined", 0, 4096, false, func(c *constructorConfig) { c.opts.PipelineShardSize = 4096 }),
+		Entry("partial block source, larger target, pipelined", 100, 2*4096, true, func(c *constructorConfig) { c.opts.PipelineShardSize = 4096 }),
+		Entry("empty source, larger target, sharded", 0, 4096, false, func(c *constructorConfig) { c.opts.ShardSize = 4096 }),
+		Entry("partial block source, larger target, sharded", 100, 2*4096, true, func(c *constructorConfig) { c.opts.ShardSize = 4096 }),
+	)
+})
+
+var _ = Describe("empty block tests", func() {
+	DescribeTable("should find blocks that only hold zeroes", func(size, nonZero int, empty bool) {
+		block := make([]byte, size)
+		if nonZero >= 0 {
+			block[nonZero] = 1
+		}
+		Expect(isEmptyBlock(block)).To(Equal(empty))
+	},
+		Entry("empty", 0, -1, true),
+		Entry("short block", 100, -1, true),
+		Entry("block larger than the zeroes", 3*len(zeroes)+7, -1, true),
+		Entry("first byte", 4096, 0, false),
+		Entry("last byte past the zeroes", 3*len(zeroes)+7, 3*len(zeroes)+6, false),
+	)
+})
@@ -0,0 +1,200 @@
+package blockrsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	// MaxCompressionChunkSize is the largest uncompressed chunk snappy supports.
+	MaxCompressionChunkSize = 65536
+	DefaultFlushInterval    = time.Second
+)
+
+// CompressionMode is whether the hash list and the record stream are
+// compressed, they are only sent uncompressed if both sides skip compression.
+type CompressionMode string
+
+const (
+	// CompressionAuto skips compression on loopback connections, and
+	// connections the transport compresses
+	CompressionAuto   CompressionMode = ""
+	CompressionSnappy CompressionMode = "snappy"
+	CompressionNone   CompressionMode = "none"
+)
+
+func ParseCompressionMode(s string) (CompressionMode, error) {
+	switch mode := CompressionMode(s); mode {
+	case CompressionSnappy, CompressionNone:
+		return mode, nil
+	case "auto", CompressionAuto:
+		return CompressionAuto, nil
+	}
+	return "", fmt.Errorf("invalid compression %q, must be auto, snappy or none", s)
+}
+
+// skipCompression returns true if this side offers to skip compression on
+// the connection.
+func (m CompressionMode) skipCompression(conn io.ReadWriter) bool {
+	switch m {
+	case CompressionNone:
+		return true
+	case CompressionAuto:
+		netConn, ok := conn.(net.Conn)
+		return ok && (transport.IsLoopback(netConn) || transport.IsCompressed(netConn))
+	}
+	return false
+}
+
+// chunkWriter emits a snappy chunk of at most size bytes for every write it
+// receives, stage is the stage of the writer the data is compressed for.
+type chunkWriter struct {
+	w     *snappy.Writer
+	size  int
+	stage string
+	cpu   *cpuPacer
+}
+
+func (c *chunkWriter) Write(p []byte) (int, error) {
+	defer enterStage(c.stage, StageCompress)()
+	written := 0
+	// bufio passes writes larger than its buffer through, they are split so
+	// no chunk is larger than the chunk size
+	for len(p) > written {
+		c.cpu.pace()
+		n, err := c.w.Write(p[written:min(len(p), written+c.size)])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if err := c.w.Flush(); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// compressedWriter compresses to snappy chunks of chunkSize bytes, and
+// flushes any buffered data every flushInterval so the peer sees small final
+// blocks when the sender pauses. The compression is profiled as part of
+// stage, and paced by the CPU limit of the writer. Without snappy the chunks
+// are written uncompressed. It is safe for concurrent use.
+type compressedWriter struct {
+	mu     sync.Mutex
+	stage  string
+	snappy *snappy.Writer
+	buf    *bufio.Writer
+	err    error
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newCompressedWriter(w io.Writer, chunkSize int, flushInterval time.Duration, stage string, cpu *cpuPacer) *compressedWriter {
+	sw := snappy.NewBufferedWriter(w)
+	chunkSize = clampChunkSize(chunkSize)
+	c := newChunkedWriter(&chunkWriter{w: sw, size: chunkSize, stage: stage, cpu: cpu}, chunkSize, flushInterval, stage)
+	c.snappy = sw
+	return c
+}
+
+// newUncompressedWriter buffers chunks like a compressedWriter, and writes
+// them as they are.
+func newUncompressedWriter(w io.Writer, chunkSize int, flushInterval time.Duration, stage string) *compressedWriter {
+	return newChunkedWriter(w, chunkSize, flushInterval, stage)
+}
+
+func clampChunkSize(chunkSize int) int {
+	if chunkSize <= 0 || chunkSize > MaxCompressionChunkSize {
+		return MaxCompressionChunkSize
+	}
+	return chunkSize
+}
+
+func newChunkedWriter(w io.Writer, chunkSize int, flushInterval time.Duration, stage string) *compressedWriter {
+	c := &compressedWriter{
+		stage: stage,
+		buf:   bufio.NewWriterSize(w, clampChunkSize(chunkSize)),
+		stop:  make(chan struct{}),
+	}
+	if flushInterval > 0 {
+		c.wg.Add(1)
+		go c.flushPeriodically(flushInterval)
+	}
+	return c
+}
+
+func (c *compressedWriter) flushPeriodically(interval time.Duration) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.Flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *compressedWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.buf.Write(p)
+	c.err = err
+	return n, err
+}
+
+// Flush compresses the buffered data as part of the stage of the writer, it
+// can be called outside of the stage.
+func (c *compressedWriter) Flush() error {
+	defer enterStage("", c.stage)()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	if c.buf.Buffered() > 0 {
+		c.err = c.buf.Flush()
+	}
+	return c.err
+}
+
+func (c *compressedWriter) Close() error {
+	close(c.stop)
+	c.wg.Wait()
+	err := c.Flush()
+	if c.snappy == nil {
+		return err
+	}
+	if cerr := c.snappy.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// flushWriteCloser sends what it buffered on Flush and Close.
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// bufferedWriteCloser flushes the buffer on Close.
+type bufferedWriteCloser struct {
+	*bufio.Writer
+}
+
+func (b *bufferedWriteCloser) Close() error {
+	return b.Flush()
+}
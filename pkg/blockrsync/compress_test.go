@@ -0,0 +1,147 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *syncBuffer) Bytes() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return bytes.Clone(s.buf.Bytes())
+}
+
+func decompress(data []byte) []byte {
+	res, _ := io.ReadAll(snappy.NewReader(bytes.NewReader(data)))
+	return res
+}
+
+// chunkLengths parses the headers of the snappy framing format and returns
+// the uncompressed length of every data chunk.
+func chunkLengths(data []byte) []int {
+	var lengths []int
+	for len(data) > 0 {
+		Expect(len(data)).To(BeNumerically(">=", 4))
+		chunkType := data[0]
+		length := int(data[1]) | int(data[2])<<8 | int(data[3])<<16
+		Expect(len(data)).To(BeNumerically(">=", 4+length))
+		// Data chunks start with a checksum of the uncompressed data
+		chunk := data[4 : 4+length]
+		switch chunkType {
+		case 0x00:
+			decodedLength, err := snappy.DecodedLen(chunk[4:])
+			Expect(err).ToNot(HaveOccurred())
+			lengths = append(lengths, decodedLength)
+		case 0x01:
+			lengths = append(lengths, len(chunk)-4)
+		}
+		data = data[4+length:]
+	}
+	return lengths
+}
+
+var _ = Describe("compressed writer tests", func() {
+	It("should round trip data with small chunks", func() {
+		out := &syncBuffer{}
+		writer := newCompressedWriter(out, 4, 0, "", nil)
+		_, err := writer.Write([]byte("0123456789"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(decompress(out.Bytes())).To(Equal([]byte("0123456789")))
+	})
+
+	It("should split large writes into chunks of at most the chunk size", func() {
+		out := &syncBuffer{}
+		writer := newCompressedWriter(out, 1000, 0, "", nil)
+		data := make([]byte, 10500)
+		_, _ = rand.Read(data[:5000])
+		n, err := writer.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(len(data)))
+		Expect(writer.Close()).To(Succeed())
+		Expect(decompress(out.Bytes())).To(Equal(data))
+		lengths := chunkLengths(out.Bytes())
+		Expect(lengths).To(HaveLen(11))
+		for _, length := range lengths {
+			Expect(length).To(BeNumerically("<=", 1000))
+		}
+	})
+
+	It("should flush buffered data periodically", func() {
+		out := &syncBuffer{}
+		writer := newCompressedWriter(out, MaxCompressionChunkSize, 10*time.Millisecond, "", nil)
+		defer writer.Close()
+		_, err := writer.Write([]byte("small"))
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(func() []byte {
+			return decompress(out.Bytes())
+		}).Should(Equal([]byte("small")))
+	})
+
+	It("should write uncompressed chunks", func() {
+		out := &syncBuffer{}
+		writer := newUncompressedWriter(out, 4, 0, "")
+		_, err := writer.Write([]byte("012"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.Bytes()).To(BeEmpty())
+		_, err = writer.Write([]byte("3456789"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writer.Close()).To(Succeed())
+		Expect(out.Bytes()).To(Equal([]byte("0123456789")))
+	})
+
+	DescribeTable("should skip compression only if both sides skip it", func(client, server CompressionMode, skipped bool) {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		data := make([]byte, 8*4096)
+		_, _ = rand.Read(data[:4*4096])
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		serverSide := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, Compression: server}, GinkgoLogr.WithName("server"))
+		clientSide := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, Compression: client}, GinkgoLogr.WithName("client"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- serverSide.StartServer()
+		}()
+		Expect(clientSide.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+		Expect(clientSide.protocol.Features.Has(codec.FeatureNoCompression)).To(Equal(skipped))
+	},
+		Entry("auto on loopback", CompressionAuto, CompressionAuto, true),
+		Entry("none", CompressionNone, CompressionNone, true),
+		Entry("snappy on the client", CompressionSnappy, CompressionAuto, false),
+		Entry("snappy on the server", CompressionNone, CompressionSnappy, false),
+	)
+
+	It("should parse the compression mode", func() {
+		Expect(ParseCompressionMode("auto")).To(Equal(CompressionAuto))
+		Expect(ParseCompressionMode("none")).To(Equal(CompressionNone))
+		_, err := ParseCompressionMode("gzip")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,90 @@
+package blockrsync
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	controlStatusPath = "/status"
+	controlCancelPath = "/cancel"
+)
+
+// Cancellable is a sync that can be cancelled, the client, the server and a
+// local copy are cancellable.
+type Cancellable interface {
+	Cancel()
+	Stats() *Stats
+}
+
+// ControlStatus is the response of the status endpoint.
+type ControlStatus struct {
+	Cancelled bool   `json:"cancelled"`
+	Stats     *Stats `json:"stats"`
+}
+
+// ServeControl serves the status of the sync on GET /status and cancels it on
+// a POST to /cancel. It returns the address it listens on and a function that
+// stops serving.
+func ServeControl(address string, sync Cancellable, log logr.Logger) (net.Addr, func(), error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, nil, err
+	}
+	control := &controlServer{sync: sync, log: log}
+	mux := http.NewServeMux()
+	mux.HandleFunc(controlStatusPath, control.status)
+	mux.HandleFunc(controlCancelPath, control.cancelSync)
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error(err, "Control endpoint failed")
+		}
+	}()
+	log.Info("Serving control endpoint", "address", listener.Addr().String())
+	return listener.Addr(), func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}, nil
+}
+
+type controlServer struct {
+	mu        sync.Mutex
+	sync      Cancellable
+	cancelled bool
+	log       logr.Logger
+}
+
+func (c *controlServer) status(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.Lock()
+	status := ControlStatus{Cancelled: c.cancelled, Stats: c.sync.Stats()}
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func (c *controlServer) cancelSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	c.mu.Lock()
+	if !c.cancelled {
+		c.log.Info("Cancelling sync", "remote", r.RemoteAddr)
+		c.cancelled = true
+		c.sync.Cancel()
+	}
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,58 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("control endpoint tests", func() {
+	It("should report the status and cancel the sync", func() {
+		sync := &fakeCancellable{stats: NewStats()}
+		sync.stats.Update(func(s *Stats) { s.BlocksTransferred = 3 })
+		addr, stop, err := ServeControl("127.0.0.1:0", sync, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		defer stop()
+		url := "http://" + addr.String()
+
+		status := func() ControlStatus {
+			resp, err := http.Get(url + "/status")
+			Expect(err).ToNot(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			status := ControlStatus{Stats: NewStats()}
+			Expect(json.NewDecoder(resp.Body).Decode(&status)).To(Succeed())
+			return status
+		}
+		Expect(status().Cancelled).To(BeFalse())
+		Expect(status().Stats.BlocksTransferred).To(Equal(int64(3)))
+
+		resp, err := http.Get(url + "/cancel")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+		for i := 0; i < 2; i++ {
+			resp, err = http.Post(url+"/cancel", "", nil)
+			Expect(err).ToNot(HaveOccurred())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+		}
+		Expect(sync.cancels).To(Equal(1))
+		Expect(status().Cancelled).To(BeTrue())
+	})
+})
+
+type fakeCancellable struct {
+	stats   *Stats
+	cancels int
+}
+
+func (f *fakeCancellable) Cancel() {
+	f.cancels++
+}
+
+func (f *fakeCancellable) Stats() *Stats {
+	return f.stats
+}
@@ -0,0 +1,86 @@
+package blockrsync
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// cpuPaceInterval is how often the CPU time of the process is checked
+	cpuPaceInterval = 100 * time.Millisecond
+)
+
+// ParseCPULimit parses a number of CPUs like 2 or 1.5, a percentage like
+// 200%, or millicores like 500m.
+func ParseCPULimit(s string) (float64, error) {
+	value, scale := s, 1.0
+	if v, ok := strings.CutSuffix(s, "%"); ok {
+		value, scale = v, 100
+	} else if v, ok := strings.CutSuffix(s, "m"); ok {
+		value, scale = v, 1000
+	}
+	cpus, err := strconv.ParseFloat(value, 64)
+	if err != nil || cpus <= 0 || math.IsInf(cpus, 0) {
+		return 0, fmt.Errorf("invalid CPU limit %q, must be a number of CPUs, a percentage or millicores > 0", s)
+	}
+	return cpus / scale, nil
+}
+
+// cpuPacer pauses the hashing and compression loops while the process used
+// more CPU time than the limit allows, so a sync under a CPU limit is not
+// throttled by the kernel into latency spikes. Pacers measure the CPU time of
+// the whole process, so every paced loop pauses while it is over the limit. A
+// nil pacer doesn't pause.
+type cpuPacer struct {
+	limit float64
+	// used returns the CPU time of the process
+	used func() (time.Duration, error)
+
+	mu        sync.Mutex
+	start     time.Time
+	startUsed time.Duration
+}
+
+func newCPUPacer(limit float64) *cpuPacer {
+	if limit <= 0 {
+		return nil
+	}
+	used, _ := processCPUTime()
+	return &cpuPacer{limit: limit, used: processCPUTime, start: time.Now(), startUsed: used}
+}
+
+// pace sleeps off the CPU time used over the limit since the last check. The
+// lock is held while sleeping so the other paced loops wait too.
+func (p *cpuPacer) pace() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := time.Since(p.start)
+	if elapsed < cpuPaceInterval {
+		return
+	}
+	used, err := p.used()
+	if err != nil {
+		return
+	}
+	if over := used - p.startUsed - time.Duration(float64(elapsed)*p.limit); over > 0 {
+		time.Sleep(time.Duration(float64(over) / p.limit))
+	}
+	p.start, p.startUsed = time.Now(), used
+}
+
+// processCPUTime returns the user and system time used by the process.
+func processCPUTime() (time.Duration, error) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, err
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano()), nil
+}
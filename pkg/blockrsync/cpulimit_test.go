@@ -0,0 +1,55 @@
+package blockrsync
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CPU limit tests", func() {
+	DescribeTable("should parse CPU limits", func(value string, expected float64) {
+		Expect(ParseCPULimit(value)).To(BeNumerically("~", expected))
+	},
+		Entry("CPUs", "2", 2.0),
+		Entry("fraction", "1.5", 1.5),
+		Entry("percentage", "200%", 2.0),
+		Entry("millicores", "500m", 0.5),
+	)
+
+	DescribeTable("should reject invalid CPU limits", func(value string) {
+		_, err := ParseCPULimit(value)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("empty", ""),
+		Entry("zero", "0%"),
+		Entry("negative", "-1"),
+		Entry("unit", "2cpu"),
+	)
+
+	It("should limit the hash workers to the CPUs", func() {
+		opts := &BlockRsyncOptions{HashConcurrency: 10, MaxCPU: 1.5}
+		Expect(opts.hashConcurrency()).To(Equal(2))
+		opts.MaxCPU = 0
+		Expect(opts.hashConcurrency()).To(Equal(10))
+		Expect(newCPUPacer(0)).To(BeNil())
+	})
+
+	It("should sleep off the CPU time used over the limit", func() {
+		pacer := newCPUPacer(0.5)
+		pacer.start = time.Now().Add(-200 * time.Millisecond)
+		pacer.startUsed = time.Second
+		// 200ms of CPU time in 200ms is 100ms over the limit of half a CPU
+		pacer.used = func() (time.Duration, error) { return pacer.startUsed + 200*time.Millisecond, nil }
+		start := time.Now()
+		pacer.pace()
+		Expect(time.Since(start)).To(BeNumerically(">=", 200*time.Millisecond))
+		Expect(pacer.startUsed).To(Equal(1200 * time.Millisecond))
+
+		pacer.start = time.Now().Add(-200 * time.Millisecond)
+		pacer.used = func() (time.Duration, error) { return pacer.startUsed + 50*time.Millisecond, nil }
+		start = time.Now()
+		pacer.pace()
+		Expect(time.Since(start)).To(BeNumerically("<", 50*time.Millisecond))
+	})
+})
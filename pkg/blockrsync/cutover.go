@@ -0,0 +1,187 @@
+package blockrsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	cutoverPollInterval = time.Second
+	cutoverPath         = "/cutover"
+)
+
+// CutoverBarrier pauses an iterative sync once the passes converged, until an
+// external signal allows the final pass, for instance after the VM using the
+// source was stopped.
+type CutoverBarrier interface {
+	// Wait blocks until the final pass can start.
+	Wait(ctx context.Context) error
+	// Done is called once the final pass is on the target.
+	Done(report PassReport, err error)
+}
+
+// CutoverOptions selects the signals that trigger the final pass, the first
+// one received wins.
+type CutoverOptions struct {
+	// File starts the final pass once the file exists, <File>.done is written
+	// with the final pass report when it completes
+	File string
+	// Signal starts the final pass on SIGUSR1
+	Signal bool
+	// ListenAddress starts the final pass on a POST to /cutover, the request
+	// completes with the final pass report
+	ListenAddress string
+}
+
+type cutoverBarrier struct {
+	opts    CutoverOptions
+	log     logr.Logger
+	trigger chan string
+	once    sync.Once
+	done    chan struct{}
+	report  PassReport
+	err     error
+	server  *http.Server
+}
+
+func NewCutoverBarrier(opts CutoverOptions, log logr.Logger) (CutoverBarrier, error) {
+	if opts.File == "" && !opts.Signal && opts.ListenAddress == "" {
+		return nil, errors.New("no cutover signal configured")
+	}
+	return &cutoverBarrier{
+		opts:    opts,
+		log:     log,
+		trigger: make(chan string, 1),
+		done:    make(chan struct{}),
+	}, nil
+}
+
+func (c *cutoverBarrier) fire(source string) {
+	select {
+	case c.trigger <- source:
+	default:
+	}
+}
+
+func (c *cutoverBarrier) Wait(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if c.opts.Signal {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGUSR1)
+		defer signal.Stop(signals)
+		go func() {
+			select {
+			case <-signals:
+				c.fire("signal")
+			case <-ctx.Done():
+			}
+		}()
+	}
+	if c.opts.File != "" {
+		go c.pollFile(ctx)
+	}
+	if c.opts.ListenAddress != "" {
+		if err := c.listen(); err != nil {
+			return err
+		}
+	}
+	c.log.Info("Passes converged, waiting for cutover", "file", c.opts.File, "signal", c.opts.Signal, "address", c.opts.ListenAddress)
+	select {
+	case source := <-c.trigger:
+		c.log.Info("Starting final pass", "trigger", source)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *cutoverBarrier) pollFile(ctx context.Context) {
+	ticker := time.NewTicker(cutoverPollInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := os.Stat(c.opts.File); err == nil {
+			c.fire("file")
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *cutoverBarrier) listen() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(cutoverPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		c.fire("http")
+		select {
+		case <-c.done:
+		case <-r.Context().Done():
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if c.err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": c.err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(c.report)
+	})
+	c.server = &http.Server{Addr: c.opts.ListenAddress, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", c.opts.ListenAddress)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := c.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			c.log.Error(err, "Cutover endpoint failed")
+		}
+	}()
+	return nil
+}
+
+func (c *cutoverBarrier) Done(report PassReport, err error) {
+	c.once.Do(func() {
+		c.report, c.err = report, err
+		close(c.done)
+		if c.opts.File != "" {
+			c.writeDoneFile()
+		}
+		if c.server != nil {
+			// Shutdown waits for the pending cutover request to get its response
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = c.server.Shutdown(ctx)
+		}
+	})
+}
+
+func (c *cutoverBarrier) writeDoneFile() {
+	result := map[string]interface{}{"report": c.report}
+	if c.err != nil {
+		result["error"] = c.err.Error()
+	}
+	data, err := json.Marshal(result)
+	if err == nil {
+		err = os.WriteFile(c.opts.File+".done", data, 0644)
+	}
+	if err != nil {
+		c.log.Error(err, "Unable to write cutover done file")
+	}
+}
@@ -0,0 +1,70 @@
+package blockrsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("cutover barrier tests", func() {
+	It("should require a cutover signal", func() {
+		_, err := NewCutoverBarrier(CutoverOptions{}, GinkgoLogr)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should wait for the cutover file and write the done file", func() {
+		tmpDir := GinkgoT().TempDir()
+		file := filepath.Join(tmpDir, "cutover")
+		barrier, err := NewCutoverBarrier(CutoverOptions{File: file}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		waitDone := make(chan error, 1)
+		go func() {
+			waitDone <- barrier.Wait(context.Background())
+		}()
+		Consistently(waitDone, 100*time.Millisecond).ShouldNot(Receive())
+		Expect(os.WriteFile(file, nil, 0644)).To(Succeed())
+		Eventually(waitDone, 5*time.Second).Should(Receive(BeNil()))
+		barrier.Done(PassReport{Pass: 3, DirtyBlocks: 2}, nil)
+		data, err := os.ReadFile(file + ".done")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(ContainSubstring(`"pass":3`))
+	})
+
+	It("should answer the cutover request with the final pass report", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		address := fmt.Sprintf("localhost:%d", port)
+		barrier, err := NewCutoverBarrier(CutoverOptions{ListenAddress: address}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		waitDone := make(chan error, 1)
+		go func() {
+			waitDone <- barrier.Wait(context.Background())
+		}()
+		var report PassReport
+		responseDone := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			defer close(responseDone)
+			var resp *http.Response
+			Eventually(func() error {
+				var err error
+				resp, err = http.Post("http://"+address+cutoverPath, "", nil)
+				return err
+			}).Should(Succeed())
+			defer resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			Expect(json.NewDecoder(resp.Body).Decode(&report)).To(Succeed())
+		}()
+		Eventually(waitDone, 5*time.Second).Should(Receive(BeNil()))
+		barrier.Done(PassReport{Pass: 2, DirtyBlocks: 7}, nil)
+		Eventually(responseDone, 5*time.Second).Should(BeClosed())
+		Expect(report.DirtyBlocks).To(Equal(int64(7)))
+	})
+})
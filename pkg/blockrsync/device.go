@@ -0,0 +1,143 @@
+package blockrsync
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	BLKGETSIZE64 = 0x80081272 /* return device size in bytes (u64 *arg) */
+	BLKDISCARD   = 0x1277     /* discard sectors (u64 [2] *arg) */
+)
+
+// isDevice returns true for block and character devices, they can't be
+// truncated.
+func isDevice(info os.FileInfo) bool {
+	return info.Mode()&(os.ModeDevice|os.ModeCharDevice) != 0
+}
+
+// deviceSize returns the size of a block device as reported by the kernel.
+func deviceSize(f *os.File) (int64, error) {
+	var size uint64
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKGETSIZE64, uintptr(unsafe.Pointer(&size))); errno != 0 {
+		return 0, errno
+	}
+	return int64(size), nil
+}
+
+// sysDevBlock links the device numbers of block devices to their sysfs
+// directory.
+var sysDevBlock = "/sys/dev/block"
+
+// deviceProperties are the properties of a block device that decide how holes
+// are applied.
+type deviceProperties struct {
+	name string
+	// discardGranularity and discardMaxBytes are 0 if the device does not
+	// support discard
+	discardGranularity int64
+	discardMaxBytes    int64
+	// discardZeroes is true if discarded blocks read back as zeroes, a zvol
+	// frees discarded blocks
+	discardZeroes bool
+}
+
+func (d *deviceProperties) canDiscard() bool {
+	return d.discardGranularity > 0 && d.discardMaxBytes > 0
+}
+
+func readDeviceProperties(f *os.File) (*deviceProperties, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("unable to get the device number of %s", f.Name())
+	}
+	rdev := uint64(stat.Rdev)
+	dir, err := filepath.EvalSymlinks(filepath.Join(sysDevBlock, fmt.Sprintf("%d:%d", major(rdev), minor(rdev))))
+	if err != nil {
+		return nil, err
+	}
+	return readDevicePropertiesDir(dir)
+}
+
+// readDevicePropertiesDir reads the properties from the sysfs directory of
+// the device, a partition uses the queue of its disk.
+func readDevicePropertiesDir(dir string) (*deviceProperties, error) {
+	queue := filepath.Join(dir, "queue")
+	if _, err := os.Stat(queue); err != nil {
+		queue = filepath.Join(filepath.Dir(dir), "queue")
+	}
+	name := filepath.Base(dir)
+	props := &deviceProperties{
+		name:          name,
+		discardZeroes: strings.HasPrefix(name, "zd"),
+	}
+	var err error
+	if props.discardGranularity, err = readSysfsInt(filepath.Join(queue, "discard_granularity")); err != nil {
+		return nil, err
+	}
+	if props.discardMaxBytes, err = readSysfsInt(filepath.Join(queue, "discard_max_bytes")); err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func readSysfsInt(fileName string) (int64, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func major(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+}
+
+func minor(dev uint64) uint32 {
+	return uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+}
+
+// discard tells the device the range is no longer used.
+func discard(f *os.File, offset, size int64) error {
+	r := [2]uint64{uint64(offset), uint64(size)}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), BLKDISCARD, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// alignDiscard returns the part of the range aligned to the discard
+// granularity, start is not before end if no part is aligned.
+func alignDiscard(offset, size, granularity int64) (int64, int64) {
+	start := (offset + granularity - 1) / granularity * granularity
+	end := (offset + size) / granularity * granularity
+	return start, end
+}
+
+// discardRange discards the aligned part of the range, and writes zeroes to
+// the rest.
+func discardRange(f *os.File, device *deviceProperties, offset, size int64) error {
+	start, end := alignDiscard(offset, size, device.discardGranularity)
+	if start >= end {
+		return writeZeroes(f, offset, size)
+	}
+	if err := writeZeroes(f, offset, start-offset); err != nil {
+		return err
+	}
+	maxBytes := max(device.discardMaxBytes/device.discardGranularity*device.discardGranularity, device.discardGranularity)
+	for pos := start; pos < end; pos += maxBytes {
+		if err := discard(f, pos, min(maxBytes, end-pos)); err != nil {
+			return err
+		}
+	}
+	return writeZeroes(f, end, offset+size-end)
+}
@@ -0,0 +1,98 @@
+package blockrsync
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// DiffReason is why a block differs between the source and the target.
+type DiffReason string
+
+const (
+	// DiffMissing is a block of the source the target has no hash for
+	DiffMissing DiffReason = "missing"
+	// DiffMismatch is a block whose hashes differ
+	DiffMismatch DiffReason = "mismatch"
+	// DiffExtra is a block within the source the target has a hash for, but
+	// the source doesn't
+	DiffExtra DiffReason = "extra"
+)
+
+// BlockDiff is a block that differs, OldHash is its hash on the target and
+// NewHash its hash on the source. A hash is nil if the side doesn't have it.
+type BlockDiff struct {
+	Offset  int64
+	Reason  DiffReason
+	OldHash []byte
+	NewHash []byte
+}
+
+// diffOffsets returns the offsets of the blocks, in the same order.
+func diffOffsets(diff []BlockDiff) []int64 {
+	if diff == nil {
+		return nil
+	}
+	offsets := make([]int64, len(diff))
+	for i, block := range diff {
+		offsets[i] = block.Offset
+	}
+	return offsets
+}
+
+// diffRecord is a line of the diff file.
+type diffRecord struct {
+	Pass    int        `json:"pass"`
+	Offset  int64      `json:"offset"`
+	Reason  DiffReason `json:"reason"`
+	OldHash string     `json:"oldHash,omitempty"`
+	NewHash string     `json:"newHash,omitempty"`
+}
+
+// diffRecorder writes a JSON line for every block that differs to the diff
+// file. A nil recorder records nothing.
+type diffRecorder struct {
+	mu      sync.Mutex
+	f       *os.File
+	encoder *json.Encoder
+}
+
+// openDiffRecorder truncates the diff file, it returns nil without a file.
+func openDiffRecorder(fileName string) (*diffRecorder, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &diffRecorder{f: f, encoder: json.NewEncoder(f)}, nil
+}
+
+func (r *diffRecorder) record(pass int, diff []BlockDiff) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, block := range diff {
+		if err := r.encoder.Encode(diffRecord{
+			Pass:    pass,
+			Offset:  block.Offset,
+			Reason:  block.Reason,
+			OldHash: hex.EncodeToString(block.OldHash),
+			NewHash: hex.EncodeToString(block.NewHash),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *diffRecorder) close() error {
+	if r == nil {
+		return nil
+	}
+	return r.f.Close()
+}
@@ -0,0 +1,65 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("diff file tests", func() {
+	It("should record the reason and hashes of every block that differs", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		diffFile := filepath.Join(tmpDir, "diff.jsonl")
+		source := make([]byte, 8*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		// The target has a changed block and misses the last 2 blocks
+		target := bytes.Clone(source[:6*4096])
+		_, _ = rand.Read(target[2*4096 : 3*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")),
+			func(c *constructorConfig) { c.opts.DiffFile = diffFile })
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+
+		f, err := os.Open(diffFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		records := make(map[int64]diffRecord)
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record diffRecord
+			Expect(json.Unmarshal(scanner.Bytes(), &record)).To(Succeed())
+			Expect(record.Pass).To(Equal(1))
+			Expect(record.NewHash).ToNot(BeEmpty())
+			records[record.Offset] = record
+		}
+		Expect(scanner.Err()).ToNot(HaveOccurred())
+		Expect(records).To(HaveLen(3))
+		Expect(records[2*4096].Reason).To(Equal(DiffMismatch))
+		Expect(records[2*4096].OldHash).ToNot(BeEmpty())
+		Expect(records[2*4096].OldHash).ToNot(Equal(records[2*4096].NewHash))
+		Expect(records[6*4096].Reason).To(Equal(DiffMissing))
+		Expect(records[6*4096].OldHash).To(BeEmpty())
+		Expect(records[7*4096].Reason).To(Equal(DiffMissing))
+	})
+})
@@ -0,0 +1,170 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// digestSegmentSize is the size of the segments of a file digested on their
+// own, the digest of the file is the digest of its segments. The segments
+// don't depend on the shards the file was hashed in.
+const digestSegmentSize = 1 << 30
+
+var ErrDigestMismatch = errors.New("digest of the target does not match the source")
+
+// fileDigest folds the block hashes of a file into a digest of the whole file
+// as the hasher computes them in offset order, so the digest costs no read of
+// its own. The hashes of a segment are digested, and the digests of the
+// segments are combined at the end.
+type fileDigest struct {
+	blockSize     int64
+	segmentBlocks int64
+	segment       hash.Hash
+	root          hash.Hash
+	// next is the offset of the next block, blocks the segment digest holds
+	next   int64
+	blocks int64
+	// incomplete is set once a block was skipped
+	incomplete bool
+	digest     []byte
+}
+
+func newFileDigest(algorithm HashAlgorithm, blockSize int64) *fileDigest {
+	return &fileDigest{
+		blockSize:     blockSize,
+		segmentBlocks: max(digestSegmentSize/blockSize, 1),
+		segment:       algorithm.new(),
+		root:          algorithm.new(),
+	}
+}
+
+// add folds the hash of the block at offset, a block that isn't the next one
+// or has no hash leaves the digest incomplete.
+func (d *fileDigest) add(offset int64, hash []byte) {
+	if d == nil || d.incomplete {
+		return
+	}
+	if hash == nil || offset != d.next {
+		d.incomplete = true
+		return
+	}
+	d.segment.Write(hash)
+	d.next += d.blockSize
+	if d.blocks++; d.blocks == d.segmentBlocks {
+		d.root.Write(d.segment.Sum(nil))
+		d.segment.Reset()
+		d.blocks = 0
+	}
+}
+
+// sum returns the digest of a file of size bytes, nil if a block of it was not
+// folded.
+func (d *fileDigest) sum(size int64) []byte {
+	if d.digest != nil {
+		return d.digest
+	}
+	if d.incomplete || d.next < size {
+		return nil
+	}
+	if d.blocks > 0 {
+		d.root.Write(d.segment.Sum(nil))
+	}
+	_ = binary.Write(d.root, binary.LittleEndian, size)
+	_ = binary.Write(d.root, binary.LittleEndian, d.blockSize)
+	d.digest = d.root.Sum(nil)
+	return d.digest
+}
+
+// digestHashes makes the hasher fold the hashes it computes into a digest of
+// the file.
+func digestHashes(hasher Hasher) {
+	if f, ok := hasher.(*FileHasher); ok {
+		f.digest = newFileDigest(f.algorithm, f.blockSize)
+	}
+}
+
+// sourceDigest returns the digest of the source once it was hashed, nil if it
+// was not computed.
+func (b *BlockrsyncClient) sourceDigest() []byte {
+	f, ok := b.hasher.(*FileHasher)
+	if !ok || f.digest == nil {
+		return nil
+	}
+	digest := f.digest.sum(b.sourceSize)
+	if digest != nil {
+		b.stats.Update(func(s *Stats) { s.SourceDigest = hex.EncodeToString(digest) })
+	}
+	return digest
+}
+
+// compareDigests compares the digest of the source with the digest of the
+// target the target computed once the sync was on disk.
+func compareDigests(source, target []byte, stats *Stats) error {
+	if len(source) == 0 || len(target) == 0 {
+		return nil
+	}
+	stats.Update(func(s *Stats) { s.TargetDigest = hex.EncodeToString(target) })
+	if !bytes.Equal(source, target) {
+		return fmt.Errorf("%w, source %x, target %x", ErrDigestMismatch, source, target)
+	}
+	return nil
+}
+
+// digestTarget hashes the bytes of the target the source was synced to once
+// they are on disk, and returns their digest.
+func (b *BlockrsyncServer) digestTarget() ([]byte, error) {
+	stopPhase := b.stats.StartPhase(PhaseVerify, b.log)
+	defer stopPhase()
+	hasher, ok := b.opts.newHasher(b.opts.readLimiter(), ProgressVerify, nil, b.audit, b.ctx.Done(), b.log.WithName("verify")).(*FileHasher)
+	if !ok {
+		return nil, errors.New("a digest of the target needs the file hasher")
+	}
+	hasher.algorithm = hashAlgorithmOf(b.hasher)
+	hasher.excluded = nil
+	hasher.digest = newFileDigest(hasher.algorithm, hasher.blockSize)
+	if b.sourceSize > 0 {
+		hasher.end = b.sourceSize
+		if _, err := hasher.HashFile(b.targetFile); err != nil {
+			return nil, err
+		}
+	}
+	digest := hasher.digest.sum(b.sourceSize)
+	if digest == nil {
+		return nil, fmt.Errorf("unable to digest the %d bytes of the source on the target", b.sourceSize)
+	}
+	return digest, nil
+}
+
+// verifyTarget compares the digest of the source the client sent with the
+// digest of the target, and returns the digest of the target to send back.
+func (b *BlockrsyncServer) verifyTarget(source []byte) ([]byte, error) {
+	if len(source) == 0 {
+		b.log.Info("Client did not compute a digest of the source, the target is not verified")
+		return nil, nil
+	}
+	target, err := b.digestTarget()
+	if err != nil {
+		return nil, err
+	}
+	b.stats.Update(func(s *Stats) { s.SourceDigest = hex.EncodeToString(source) })
+	if err := compareDigests(source, target, b.stats); err != nil {
+		return target, err
+	}
+	b.log.Info("Target matches the digest of the source", "digest", hex.EncodeToString(target))
+	return target, nil
+}
+
+// writeDigest follows a pass ack with the digest of the target, if the
+// client asked for it.
+func (b *BlockrsyncServer) writeDigest(encoder *codec.Encoder, digest []byte) error {
+	if !b.protocol.Features.Has(codec.FeatureSourceDigest) {
+		return nil
+	}
+	return encoder.WriteDigest(digest)
+}
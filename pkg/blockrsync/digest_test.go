@@ -0,0 +1,121 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("source digest tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 16*4096+100)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	// sync syncs the source to the target, and returns the errors of the
+	// client and the server
+	sync := func(clientOpts, serverOpts *BlockRsyncOptions) (*BlockrsyncClient, *BlockrsyncServer, error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, clientOpts, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, serverOpts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return client, server, clientErr, <-serverDone
+	}
+
+	It("should fold the hashes of the segments into the digest", func() {
+		hashes := [][]byte{{1}, {2}, {3}}
+		d := newFileDigest(HashBLAKE2b, 4096)
+		d.segmentBlocks = 2
+		for i, hash := range hashes {
+			d.add(int64(i)*4096, hash)
+		}
+		first, second := HashBLAKE2b.new(), HashBLAKE2b.new()
+		first.Write([]byte{1, 2})
+		second.Write([]byte{3})
+		root := HashBLAKE2b.new()
+		root.Write(first.Sum(nil))
+		root.Write(second.Sum(nil))
+		_ = binary.Write(root, binary.LittleEndian, int64(3*4096-1))
+		_ = binary.Write(root, binary.LittleEndian, int64(4096))
+		Expect(d.sum(3*4096 - 1)).To(Equal(root.Sum(nil)))
+
+		skipped := newFileDigest(HashBLAKE2b, 4096)
+		skipped.add(0, hashes[0])
+		skipped.add(2*4096, hashes[2])
+		Expect(skipped.sum(3 * 4096)).To(BeNil())
+		short := newFileDigest(HashBLAKE2b, 4096)
+		short.add(0, hashes[0])
+		Expect(short.sum(2 * 4096)).To(BeNil())
+	})
+
+	It("should digest the same file the same way however it is hashed", func() {
+		digest := func(concurrency int) []byte {
+			hasher := newFileHasher(4096, nil, GinkgoLogr)
+			hasher.concurrency = concurrency
+			hasher.digest = newFileDigest(hasher.algorithm, hasher.blockSize)
+			size, err := hasher.HashFile(sourceFile)
+			Expect(err).ToNot(HaveOccurred())
+			return hasher.digest.sum(size)
+		}
+		Expect(digest(1)).ToNot(BeEmpty())
+		Expect(digest(1)).To(Equal(digest(8)))
+	})
+
+	DescribeTable("should compare the digest of the source with the target", func(pipelineShardSize int64) {
+		Expect(os.WriteFile(targetFile, source[:8*4096], 0644)).To(Succeed())
+		opts := &BlockRsyncOptions{BlockSize: 4096, SourceDigest: true, PipelineShardSize: pipelineShardSize}
+		client, server, clientErr, serverErr := sync(opts, opts)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(client.Stats().SourceDigest).ToNot(BeEmpty())
+		Expect(client.Stats().TargetDigest).To(Equal(client.Stats().SourceDigest))
+		Expect(server.Stats().SourceDigest).To(Equal(client.Stats().SourceDigest))
+		Expect(server.Stats().TargetDigest).To(Equal(client.Stats().SourceDigest))
+	},
+		Entry("hashed before the sync", int64(0)),
+		Entry("hashed while syncing", int64(4*4096)),
+	)
+
+	It("should fail both sides when the target doesn't match the source", func() {
+		serverOpts := &BlockRsyncOptions{BlockSize: 4096, SourceDigest: true}
+		serverOpts.Hooks.PreWrite = func(offset int64, data []byte) error {
+			if offset == 4096 {
+				data[0] ^= 0xff
+			}
+			return nil
+		}
+		client, _, clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096, SourceDigest: true}, serverOpts)
+		Expect(clientErr).To(MatchError(ErrDigestMismatch))
+		Expect(serverErr).To(MatchError(ErrDigestMismatch))
+		Expect(client.Stats().TargetDigest).ToNot(Equal(client.Stats().SourceDigest))
+	})
+
+	It("should only compute the digest of the source without the target", func() {
+		client, server, clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096, SourceDigest: true}, &BlockRsyncOptions{BlockSize: 4096})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(client.Stats().SourceDigest).ToNot(BeEmpty())
+		Expect(client.Stats().TargetDigest).To(BeEmpty())
+		Expect(server.Stats().TargetDigest).To(BeEmpty())
+	})
+})
@@ -0,0 +1,216 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// DiffExcluded is an excluded block the target holds data in, it is emptied
+// with ZeroExcluded
+const DiffExcluded DiffReason = "excluded"
+
+// ByteRange is a range of bytes of a file.
+type ByteRange struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// ExcludedRanges are regions of the source that change all the time and
+// don't need to be synced, like a swap partition or a scratch area. The blocks
+// entirely within a range are neither hashed nor sent, a block that is only
+// partly excluded is synced.
+type ExcludedRanges []ByteRange
+
+// ParseExcludedRanges parses a comma separated list of offset:length pairs.
+func ParseExcludedRanges(s string) (ExcludedRanges, error) {
+	var res ExcludedRanges
+	for _, pair := range strings.Split(s, ",") {
+		offset, length, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid excluded range %q, expected offset:length", pair)
+		}
+		r, err := parseByteRange(offset, length)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+	return res.normalized(), nil
+}
+
+// LoadExcludedRanges reads lines with a byte offset and a length, empty lines
+// and lines starting with # are ignored.
+func LoadExcludedRanges(r io.Reader) (ExcludedRanges, error) {
+	var res ExcludedRanges
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected offset and length", lineNumber)
+		}
+		r, err := parseByteRange(fields[0], fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		res = append(res, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res.normalized(), nil
+}
+
+func LoadExcludedRangesFile(fileName string) (ExcludedRanges, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadExcludedRanges(f)
+}
+
+func parseByteRange(offset, length string) (ByteRange, error) {
+	var values [2]int64
+	for i, field := range []string{offset, length} {
+		value, err := strconv.ParseInt(field, 0, 64)
+		if err != nil || value < 0 {
+			return ByteRange{}, fmt.Errorf("invalid value %q", field)
+		}
+		values[i] = value
+	}
+	return ByteRange{Offset: values[0], Length: values[1]}, nil
+}
+
+// normalized returns the ranges sorted by offset with overlapping and
+// adjacent ranges merged.
+func (r ExcludedRanges) normalized() ExcludedRanges {
+	if len(r) == 0 {
+		return nil
+	}
+	sorted := slices.Clone(r)
+	slices.SortFunc(sorted, func(a, b ByteRange) int {
+		return int64SortFunc(a.Offset, b.Offset)
+	})
+	res := ExcludedRanges{}
+	for _, next := range sorted {
+		if next.Length == 0 {
+			continue
+		}
+		if last := len(res) - 1; last >= 0 && next.Offset <= res[last].Offset+res[last].Length {
+			res[last].Length = max(res[last].Length, next.Offset+next.Length-res[last].Offset)
+			continue
+		}
+		res = append(res, next)
+	}
+	return res
+}
+
+// coversBlock returns true if the block at offset of a file of size bytes is
+// entirely within a range, the ranges must be normalized.
+func (r ExcludedRanges) coversBlock(offset, blockSize, size int64) bool {
+	if len(r) == 0 || offset >= size {
+		return false
+	}
+	end := min(offset+blockSize, size)
+	i, found := slices.BinarySearchFunc(r, offset, func(e ByteRange, offset int64) int {
+		return int64SortFunc(e.Offset, offset)
+	})
+	if !found {
+		i--
+	}
+	return i >= 0 && r[i].Offset <= offset && r[i].Offset+r[i].Length >= end
+}
+
+// excludedDiff returns the excluded blocks to empty on the target, those it
+// has no hash for or a hash of data for.
+func (f *FileHasher) excludedDiff(cmpHash map[int64][]byte) []BlockDiff {
+	var diff []BlockDiff
+	emptyHash := f.algorithm.sum(make([]byte, f.blockSize))
+	for offset := int64(0); offset < f.fileSize; offset += f.blockSize {
+		if !f.excluded.coversBlock(offset, f.blockSize, f.fileSize) {
+			continue
+		}
+		empty := emptyHash
+		if offset+f.blockSize > f.fileSize {
+			empty = f.algorithm.sum(make([]byte, f.fileSize-offset))
+		}
+		cmp, ok := cmpHash[offset]
+		if !ok || !bytes.Equal(empty[:min(len(empty), len(cmp))], cmp) {
+			diff = append(diff, BlockDiff{Offset: offset, Reason: DiffExcluded, OldHash: cmp})
+		}
+	}
+	return diff
+}
+
+// sendExcluded sends a hole for every excluded block with ZeroExcluded, and
+// returns the offsets that are not excluded.
+func (b *BlockrsyncClient) sendExcluded(encoder *codec.Encoder, offsets []int64) ([]int64, error) {
+	if len(b.excluded) == 0 {
+		return offsets, nil
+	}
+	blockSize := b.hasher.BlockSize()
+	var res []int64
+	for _, offset := range offsets {
+		if !b.excluded.coversBlock(offset, blockSize, b.sourceSize) {
+			res = append(res, offset)
+			continue
+		}
+		if !b.opts.ZeroExcluded {
+			continue
+		}
+		length := min(blockSize, b.sourceSize-offset)
+		b.blockLog.trace("Emptying excluded block", "offset", offset)
+		if err := encoder.WriteHole(offset, int(length)); err != nil {
+			return nil, err
+		}
+		b.recordSent(offset, make([]byte, length))
+		b.stats.Update(func(s *Stats) {
+			s.HolesTransferred++
+			s.HoleBytes += length
+		})
+	}
+	return res, nil
+}
+
+// emptyExcluded empties the excluded blocks of the diff of a local copy, and
+// returns the offsets that are not excluded.
+func (l *LocalCopy) emptyExcluded(holes *holeWriter, offsets []int64, sourceSize int64) ([]int64, error) {
+	excluded := l.opts.ExcludeRanges.normalized()
+	if len(excluded) == 0 {
+		return offsets, nil
+	}
+	blockSize := int64(l.opts.BlockSize)
+	var res []int64
+	for _, offset := range offsets {
+		if !excluded.coversBlock(offset, blockSize, sourceSize) {
+			res = append(res, offset)
+			continue
+		}
+		length := min(blockSize, sourceSize-offset)
+		if err := l.opts.Hooks.preWrite(offset, nil); err != nil {
+			return nil, err
+		}
+		if err := holes.add(offset, length); err != nil {
+			return nil, err
+		}
+		l.stats.Update(func(s *Stats) {
+			s.HolesTransferred++
+			s.HoleBytes += length
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,110 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("excluded range tests", func() {
+	It("should parse and merge the ranges", func() {
+		ranges, err := ParseExcludedRanges("8192:4096, 0:4096,0x1000:100")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ranges).To(Equal(ExcludedRanges{{Offset: 0, Length: 4096 + 100}, {Offset: 8192, Length: 4096}}))
+		ranges, err = LoadExcludedRanges(strings.NewReader("# swap\n4096 8192\n\n0 4096\n"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ranges).To(Equal(ExcludedRanges{{Offset: 0, Length: 3 * 4096}}))
+		_, err = ParseExcludedRanges("4096")
+		Expect(err).To(HaveOccurred())
+		_, err = LoadExcludedRanges(strings.NewReader("0 -1\n"))
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+	})
+
+	It("should only cover the blocks entirely within a range", func() {
+		ranges := ExcludedRanges{{Offset: 4096, Length: 2*4096 + 100}, {Offset: 6 * 4096, Length: 8192}}
+		Expect(ranges.coversBlock(0, 4096, 8*4096)).To(BeFalse())
+		Expect(ranges.coversBlock(4096, 4096, 8*4096)).To(BeTrue())
+		Expect(ranges.coversBlock(2*4096, 4096, 8*4096)).To(BeTrue())
+		Expect(ranges.coversBlock(3*4096, 4096, 8*4096)).To(BeFalse())
+		// The range covers the partial last block
+		Expect(ranges.coversBlock(7*4096, 4096, 7*4096+100)).To(BeTrue())
+		Expect(ranges.coversBlock(8*4096, 4096, 7*4096+100)).To(BeFalse())
+	})
+
+	Context("with a target", func() {
+		var (
+			sourceFile string
+			targetFile string
+			source     []byte
+			target     []byte
+		)
+
+		BeforeEach(func() {
+			tmpDir := GinkgoT().TempDir()
+			sourceFile = filepath.Join(tmpDir, "source.raw")
+			targetFile = filepath.Join(tmpDir, "target.raw")
+			source = make([]byte, 8*4096)
+			_, _ = rand.Read(source)
+			Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+			target = make([]byte, 8*4096)
+			_, _ = rand.Read(target)
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		})
+
+		sync := func(opts *BlockRsyncOptions) *Stats {
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, opts, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			return client.Stats()
+		}
+
+		It("should leave the excluded blocks of the target alone", func() {
+			excluded := ExcludedRanges{{Offset: 2 * 4096, Length: 2*4096 + 100}}
+			stats := sync(&BlockRsyncOptions{BlockSize: 4096, ExcludeRanges: excluded})
+			Expect(stats.DifferentBlocks).To(Equal(int64(6)))
+			synced, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(synced[:2*4096]).To(Equal(source[:2*4096]))
+			Expect(synced[2*4096 : 4*4096]).To(Equal(target[2*4096 : 4*4096]))
+			// The block that is only partly excluded is synced
+			Expect(synced[4*4096:]).To(Equal(source[4*4096:]))
+		})
+
+		It("should empty the excluded blocks of the target once", func() {
+			opts := &BlockRsyncOptions{BlockSize: 4096, ExcludeRanges: ExcludedRanges{{Offset: 2 * 4096, Length: 2 * 4096}}, ZeroExcluded: true}
+			stats := sync(opts)
+			Expect(stats.HolesTransferred).To(Equal(int64(2)))
+			synced, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			expected := bytes.Clone(source)
+			clear(expected[2*4096 : 4*4096])
+			Expect(synced).To(Equal(expected))
+
+			_, _ = rand.Read(source[2*4096 : 3*4096])
+			Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+			stats = sync(opts)
+			Expect(stats.DifferentBlocks).To(BeZero())
+		})
+
+		It("should empty the excluded blocks of a local copy", func() {
+			opts := &BlockRsyncOptions{BlockSize: 4096, ExcludeRanges: ExcludedRanges{{Offset: 0, Length: 4096}}, ZeroExcluded: true}
+			Expect(NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy")).Copy()).To(Succeed())
+			synced, err := os.ReadFile(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(synced[:4096]).To(Equal(make([]byte, 4096)))
+			Expect(synced[4096:]).To(Equal(source[4096:]))
+		})
+	})
+})
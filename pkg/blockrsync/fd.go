@@ -0,0 +1,163 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// FDPrefix names a file that was opened by another process instead of a
+	// path, so the sync can run unprivileged while a privileged parent opens
+	// the device. fd:<number> is a descriptor inherited from the parent,
+	// fd:<name> a descriptor passed by systemd with that name in
+	// LISTEN_FDNAMES, and fd:unix:<socket> a descriptor received with
+	// SCM_RIGHTS from a process listening on the unix socket.
+	FDPrefix       = "fd:"
+	fdUnixPrefix   = "unix:"
+	systemdFDStart = 3
+)
+
+var (
+	passedFilesMu sync.Mutex
+	// The passed descriptors by name, the callers get duplicates of them so
+	// every caller can close its file
+	passedFiles = make(map[string]*os.File)
+)
+
+// IsPassedFile returns true if the name is a descriptor opened by another
+// process.
+func IsPassedFile(name string) bool {
+	return strings.HasPrefix(name, FDPrefix)
+}
+
+// openFile opens the file by name like os.OpenFile, or duplicates the
+// descriptor passed for it. A passed descriptor must have been opened for
+// writing if flag writes.
+func openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if !IsPassedFile(name) {
+		return os.OpenFile(name, flag, perm)
+	}
+	passed, err := passedFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		mode, err := fcntl(passed.Fd(), syscall.F_GETFL, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "fcntl", Path: name, Err: err}
+		}
+		if mode&syscall.O_ACCMODE == syscall.O_RDONLY {
+			return nil, fmt.Errorf("%s was opened read only", name)
+		}
+	}
+	fd, err := fcntl(passed.Fd(), syscall.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "dup", Path: name, Err: err}
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+func fcntl(fd uintptr, cmd, arg int) (int, error) {
+	res, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd, uintptr(cmd), uintptr(arg))
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(res), nil
+}
+
+// passedFile returns the descriptor passed for the name, it is looked up or
+// received the first time.
+func passedFile(name string) (*os.File, error) {
+	passedFilesMu.Lock()
+	defer passedFilesMu.Unlock()
+	if f, ok := passedFiles[name]; ok {
+		return f, nil
+	}
+	var f *os.File
+	var err error
+	spec := strings.TrimPrefix(name, FDPrefix)
+	if socket, ok := strings.CutPrefix(spec, fdUnixPrefix); ok {
+		f, err = receiveFile(socket, name)
+	} else {
+		f, err = inheritedFile(spec, name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get the descriptor of %s: %w", name, err)
+	}
+	passedFiles[name] = f
+	return f, nil
+}
+
+// inheritedFile returns the descriptor with the number, or the one systemd
+// passed with the name.
+func inheritedFile(spec, name string) (*os.File, error) {
+	fd, err := strconv.Atoi(spec)
+	if err != nil {
+		if fd, err = systemdFD(spec); err != nil {
+			return nil, err
+		}
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("invalid descriptor %d", fd)
+	}
+	if _, err := fcntl(uintptr(fd), syscall.F_GETFD, 0); err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// systemdFD finds the descriptor systemd passed with the name, they start at
+// 3 in the order of LISTEN_FDNAMES.
+func systemdFD(fdName string) (int, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return 0, errors.New("no descriptors were passed by systemd")
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid LISTEN_FDS: %w", err)
+	}
+	index := slices.Index(strings.Split(os.Getenv("LISTEN_FDNAMES"), ":"), fdName)
+	if index < 0 || index >= count {
+		return 0, fmt.Errorf("no descriptor named %s was passed by systemd", fdName)
+	}
+	return systemdFDStart + index, nil
+}
+
+// receiveFile connects to the unix socket and receives a descriptor sent with
+// SCM_RIGHTS.
+func receiveFile(socket, name string) (*os.File, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	buf := make([]byte, 1)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		fds, err := syscall.ParseUnixRights(&message)
+		if err != nil || len(fds) == 0 {
+			continue
+		}
+		for _, fd := range fds[1:] {
+			syscall.Close(fd)
+		}
+		syscall.CloseOnExec(fds[0])
+		return os.NewFile(uintptr(fds[0]), name), nil
+	}
+	return nil, errors.New("no descriptor received")
+}
@@ -0,0 +1,113 @@
+package blockrsync
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("passed descriptor tests", func() {
+	var (
+		fileName string
+	)
+
+	BeforeEach(func() {
+		fileName = filepath.Join(GinkgoT().TempDir(), "disk.img")
+		Expect(os.WriteFile(fileName, []byte("0123456789"), 0644)).To(Succeed())
+	})
+
+	// forget closes the passed descriptor so the names can be reused, and the
+	// descriptor isn't closed by a finalizer once its number was reused.
+	forget := func(name string) {
+		passedFilesMu.Lock()
+		defer passedFilesMu.Unlock()
+		if f, ok := passedFiles[name]; ok {
+			f.Close()
+		}
+		delete(passedFiles, name)
+	}
+
+	readAll := func(name string) string {
+		f, err := openFile(name, os.O_RDONLY, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		data := make([]byte, 4)
+		_, err = f.ReadAt(data, 2)
+		Expect(err).ToNot(HaveOccurred())
+		return string(data)
+	}
+
+	It("should duplicate an inherited descriptor", func() {
+		f, err := os.Open(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		// The passed descriptor is owned by the cache
+		fd, err := syscall.Dup(int(f.Fd()))
+		Expect(err).ToNot(HaveOccurred())
+		name := fmt.Sprintf("fd:%d", fd)
+		DeferCleanup(forget, name)
+		Expect(IsPassedFile(name)).To(BeTrue())
+		Expect(readAll(name)).To(Equal("2345"))
+		// The duplicate was closed, the descriptor is still usable
+		Expect(readAll(name)).To(Equal("2345"))
+		_, err = openFile(name, os.O_RDWR, 0)
+		Expect(err).To(MatchError(ContainSubstring("read only")))
+	})
+
+	It("should find a descriptor passed by systemd by name", func() {
+		GinkgoT().Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		GinkgoT().Setenv("LISTEN_FDS", "2")
+		GinkgoT().Setenv("LISTEN_FDNAMES", "source:target")
+		fd, err := systemdFD("target")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(fd).To(Equal(4))
+		_, err = systemdFD("other")
+		Expect(err).To(HaveOccurred())
+		GinkgoT().Setenv("LISTEN_PID", "1")
+		_, err = systemdFD("target")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should receive a descriptor from a unix socket", func() {
+		socket := filepath.Join(GinkgoT().TempDir(), "opener.sock")
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.AcceptUnix()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			_, _, err = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(f.Fd())), nil)
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		name := "fd:unix:" + socket
+		DeferCleanup(forget, name)
+		Expect(readAll(name)).To(Equal("2345"))
+		f, err := openFile(name, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		_, err = f.WriteAt([]byte("ab"), 0)
+		Expect(err).ToNot(HaveOccurred())
+		data, err := io.ReadAll(io.NewSectionReader(f, 0, 4))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("ab23"))
+	})
+
+	It("should fail for a descriptor that is not open", func() {
+		_, err := openFile("fd:1000000", os.O_RDONLY, 0)
+		Expect(err).To(HaveOccurred())
+		_, err = openFile("fd:unix:"+filepath.Join(GinkgoT().TempDir(), "missing.sock"), os.O_RDONLY, 0)
+		Expect(err).To(HaveOccurred())
+	})
+})
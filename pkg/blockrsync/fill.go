@@ -0,0 +1,72 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxFillPatternLength is the longest fill pattern, a pattern repeats from the
+// start of every 4096 byte sector so its length must divide it.
+const maxFillPatternLength = 4096
+
+// FillPatterns are byte patterns some arrays return for unmapped regions
+// instead of zeroes, like 0xff. A block filled with one of them is a hole, it
+// is sent as a hole and hashed like the zeroes the hole leaves.
+type FillPatterns [][]byte
+
+// ParseFillPatterns parses a comma separated list of hex patterns, like ff or
+// 0xdeadbeef.
+func ParseFillPatterns(s string) (FillPatterns, error) {
+	var res FillPatterns
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		pattern, err := hex.DecodeString(strings.TrimPrefix(strings.ToLower(value), "0x"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid fill pattern %q: %w", value, err)
+		}
+		res = append(res, pattern)
+	}
+	return res, res.Validate()
+}
+
+func (p FillPatterns) Validate() error {
+	for _, pattern := range p {
+		if len(pattern) == 0 || maxFillPatternLength%len(pattern) != 0 {
+			return fmt.Errorf("fill pattern %x must be 1 to %d bytes long and divide %d bytes", pattern, maxFillPatternLength, maxFillPatternLength)
+		}
+		if isEmptyBlock(pattern) {
+			return errors.New("a fill pattern of zeroes is always a hole")
+		}
+	}
+	return nil
+}
+
+// isHole returns true if the block holds only zeroes, or is filled with one of
+// the patterns.
+func (p FillPatterns) isHole(buf []byte) bool {
+	return isEmptyBlock(buf) || p.filled(buf)
+}
+
+// filled returns true if the block is filled with one of the patterns.
+func (p FillPatterns) filled(buf []byte) bool {
+	for _, pattern := range p {
+		if isFilledBlock(buf, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFilledBlock returns true if the block repeats the pattern from its start.
+// A block that starts with the pattern and equals itself shifted by the length
+// of the pattern repeats it, so it is compared with bytes.Equal like
+// isEmptyBlock.
+func isFilledBlock(buf, pattern []byte) bool {
+	if len(buf) <= len(pattern) {
+		return bytes.Equal(buf, pattern[:len(buf)])
+	}
+	return bytes.Equal(buf[:len(pattern)], pattern) && bytes.Equal(buf[len(pattern):], buf[:len(buf)-len(pattern)])
+}
@@ -0,0 +1,72 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("fill pattern tests", func() {
+	It("should parse the fill patterns", func() {
+		Expect(ParseFillPatterns("ff, 0xDEADBEEF")).To(Equal(FillPatterns{{0xff}, {0xde, 0xad, 0xbe, 0xef}}))
+		for _, invalid := range []string{"", "f", "xyz", "00", "010203"} {
+			_, err := ParseFillPatterns(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("should find the blocks filled with a pattern", func() {
+		patterns := FillPatterns{{0xff}, {0xde, 0xad, 0xbe, 0xef}}
+		Expect(patterns.isHole(make([]byte, 4096))).To(BeTrue())
+		Expect(patterns.isHole(bytes.Repeat([]byte{0xff}, 4096))).To(BeTrue())
+		Expect(patterns.isHole(bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 1024))).To(BeTrue())
+		// A partial block at the end of the file
+		Expect(patterns.isHole(bytes.Repeat([]byte{0xde, 0xad, 0xbe, 0xef}, 10)[:38])).To(BeTrue())
+		Expect(patterns.isHole(bytes.Repeat([]byte{0xad, 0xbe, 0xef, 0xde}, 1024))).To(BeFalse())
+		mixed := bytes.Repeat([]byte{0xff}, 4096)
+		mixed[4095] = 0
+		Expect(patterns.isHole(mixed)).To(BeFalse())
+		Expect(FillPatterns(nil).isHole(bytes.Repeat([]byte{0xff}, 4096))).To(BeFalse())
+	})
+
+	It("should sync the blocks filled with a pattern as holes", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := bytes.Repeat([]byte{0xff}, 8*4096)
+		_, _ = rand.Read(source[2*4096 : 3*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+
+		sync := func() *BlockrsyncClient {
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			opts := &BlockRsyncOptions{BlockSize: 4096, FillPatterns: FillPatterns{{0xff}}}
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, opts, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, opts, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			Expect(client.ConnectToTarget()).To(Succeed())
+			Expect(<-serverDone).To(Succeed())
+			return client
+		}
+		client := sync()
+		Expect(client.Stats().BlocksTransferred).To(Equal(int64(1)))
+		Expect(client.Stats().HolesTransferred).To(Equal(int64(7)))
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		expected := make([]byte, len(source))
+		copy(expected[2*4096:3*4096], source[2*4096:3*4096])
+		Expect(target).To(Equal(expected))
+
+		// The holes of the target match the patterns of the source
+		client = sync()
+		Expect(client.Stats().BlocksTransferred).To(BeZero())
+		Expect(client.Stats().HolesTransferred).To(BeZero())
+	})
+})
@@ -0,0 +1,266 @@
+package blockrsync
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/crypto/blake2b"
+)
+
+var (
+	ErrGenerationDowngrade = errors.New("target holds a newer generation")
+)
+
+// Generation records what the target holds, it is written alongside the
+// target after every pass.
+type Generation struct {
+	Generation int64 `json:"generation"`
+	Pass       int64 `json:"pass"`
+	// Complete is false while blocks are applied, the target then matches
+	// neither the previous nor the new source
+	Complete bool `json:"complete"`
+	// SourceDigest is a digest of the block hashes of the source the target
+	// matches when complete
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	SourceSize   int64  `json:"sourceSize"`
+	BlockSize    int64  `json:"blockSize"`
+	Time         string `json:"time"`
+}
+
+// ReadGeneration reads a generation file, it returns nil if the file does not
+// exist.
+func ReadGeneration(fileName string) (*Generation, error) {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	generation := &Generation{}
+	if err := json.Unmarshal(data, generation); err != nil {
+		return nil, fmt.Errorf("invalid generation file %s: %w", fileName, err)
+	}
+	return generation, nil
+}
+
+// WriteFile replaces the file atomically, so a crash leaves either the
+// previous or the new generation.
+func (g *Generation) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+func writeFileAtomic(fileName string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// hashesDigest returns a digest of the block hashes below size.
+func hashesDigest(hashes map[int64][]byte, size int64) string {
+	h, _ := blake2b.New256(nil)
+	offsets := make([]int64, 0, len(hashes))
+	for offset := range hashes {
+		offsets = append(offsets, offset)
+	}
+	slices.SortFunc(offsets, int64SortFunc)
+	buf := make([]byte, 8)
+	for _, offset := range offsets {
+		if offset >= size {
+			continue
+		}
+		binary.LittleEndian.PutUint64(buf, uint64(offset))
+		h.Write(buf)
+		h.Write(hashes[offset])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// generationTracker keeps the block hashes of the target up to date while
+// blocks are applied, and writes the generation file at the end of every
+// pass. With a manifest, the hashes are written to it once a pass completed,
+// and it is removed while blocks are applied. Without a file name only the
+// manifest is written.
+type generationTracker struct {
+	fileName   string
+	manifest   string
+	generation int64
+	blockSize  int64
+	sourceSize int64
+	// algorithm hashes the applied blocks like the target was hashed
+	algorithm HashAlgorithm
+	hashes    map[int64][]byte
+	pass      int64
+	complete  bool
+	log       logr.Logger
+}
+
+// newGenerationTracker checks the generation in the file when the target
+// starts. A generation of 0 continues with the next generation, or with the
+// generation in the file if the sync of it did not complete, so running a
+// sync that failed again doesn't skip a generation.
+func newGenerationTracker(fileName string, generation int64, allowDowngrade bool, blockSize int64, algorithm HashAlgorithm, log logr.Logger) (*generationTracker, error) {
+	var current *Generation
+	if fileName != "" {
+		var err error
+		if current, err = ReadGeneration(fileName); err != nil {
+			return nil, err
+		}
+	}
+	if current != nil {
+		log.Info("Target holds generation", "generation", current.Generation, "pass", current.Pass, "complete", current.Complete, "source digest", current.SourceDigest)
+		if generation == 0 && !current.Complete {
+			generation = current.Generation
+		} else if generation == 0 {
+			generation = current.Generation + 1
+		} else if generation < current.Generation && !allowDowngrade {
+			return nil, fmt.Errorf("%w %d, refusing to sync generation %d", ErrGenerationDowngrade, current.Generation, generation)
+		}
+	} else if generation == 0 {
+		generation = 1
+	}
+	return &generationTracker{
+		fileName:   fileName,
+		generation: generation,
+		blockSize:  blockSize,
+		algorithm:  algorithm,
+		complete:   true,
+		log:        log,
+	}, nil
+}
+
+// start records the hashes of the target and the size of the source.
+func (g *generationTracker) start(targetHashes map[int64][]byte, sourceSize int64) {
+	g.hashes = maps.Clone(targetHashes)
+	g.sourceSize = sourceSize
+}
+
+func (g *generationTracker) resize(size int64) {
+	for offset := range g.hashes {
+		if offset >= size {
+			delete(g.hashes, offset)
+		}
+	}
+	g.sourceSize = size
+}
+
+// applying marks the generation incomplete before the first block of a pass
+// is applied.
+func (g *generationTracker) applying() error {
+	if !g.complete {
+		return nil
+	}
+	g.complete = false
+	return g.write()
+}
+
+func (g *generationTracker) applyBlock(offset int64, block []byte) {
+	g.hashes[offset] = g.algorithm.sum(block)
+}
+
+func (g *generationTracker) applyHole(offset int64) {
+	g.applyBlock(offset, make([]byte, min(g.blockSize, g.sourceSize-offset)))
+}
+
+// finish records the generation at the end of the sync. When the client ends
+// its passes explicitly, a sync that stopped in the middle of a pass stays
+// incomplete.
+func (g *generationTracker) finish(targetHashes map[int64][]byte, targetSize int64, explicitEnd bool) error {
+	switch {
+	case g.hashes == nil:
+		// The client found no differences, the target matches the source
+		g.start(targetHashes, targetSize)
+		return g.passComplete()
+	case g.complete && (g.pass > 0 || explicitEnd):
+		return nil
+	case explicitEnd:
+		g.log.Info("Sync stopped before the pass completed, the generation is incomplete", "generation", g.generation)
+		return nil
+	default:
+		return g.passComplete()
+	}
+}
+
+// passComplete must be called once the pass is synced to the target.
+func (g *generationTracker) passComplete() error {
+	g.pass++
+	g.complete = true
+	return g.write()
+}
+
+func (g *generationTracker) write() error {
+	if err := g.writeManifest(); err != nil {
+		return err
+	}
+	if g.fileName == "" {
+		return nil
+	}
+	generation := &Generation{
+		Generation: g.generation,
+		Pass:       g.pass,
+		Complete:   g.complete,
+		SourceSize: g.sourceSize,
+		BlockSize:  g.blockSize,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+	}
+	if g.complete {
+		generation.SourceDigest = hashesDigest(g.hashes, g.sourceSize)
+	}
+	if err := generation.WriteFile(g.fileName); err != nil {
+		return err
+	}
+	g.log.V(3).Info("Wrote generation", "generation", g.generation, "pass", g.pass, "complete", g.complete)
+	return nil
+}
+
+// writeManifest writes the hashes of the target to the manifest when
+// complete, and removes it otherwise since the target matches no hashes.
+func (g *generationTracker) writeManifest() error {
+	if g.manifest == "" {
+		return nil
+	}
+	if !g.complete {
+		if err := os.Remove(g.manifest); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	hashes := make(map[int64][]byte, len(g.hashes))
+	for offset, hash := range g.hashes {
+		if offset < g.sourceSize {
+			hashes[offset] = hash
+		}
+	}
+	if err := newHashManifest(hashes, g.blockSize, g.sourceSize, g.algorithm).WriteFile(g.manifest); err != nil {
+		return err
+	}
+	g.log.V(3).Info("Wrote hash manifest", "file", g.manifest, "blocks", len(hashes))
+	return nil
+}
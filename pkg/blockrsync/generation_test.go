@@ -0,0 +1,128 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var _ = Describe("generation tests", func() {
+	var (
+		tmpDir         string
+		sourceFile     string
+		targetFile     string
+		generationFile string
+	)
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		generationFile = filepath.Join(tmpDir, "target.generation")
+		data := make([]byte, 8*4096+100)
+		_, _ = rand.Read(data)
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+	})
+
+	sync := func(clientOpts, serverOpts *BlockRsyncOptions) (error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, clientOpts, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, serverOpts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		err = client.ConnectToTarget()
+		return err, <-serverDone
+	}
+
+	sourceDigest := func() string {
+		hasher := NewFileHasher(4096, GinkgoLogr)
+		size, err := hasher.HashFile(sourceFile)
+		Expect(err).ToNot(HaveOccurred())
+		return hashesDigest(hasher.GetHashes(), size)
+	}
+
+	It("should record the generation after every sync", func() {
+		serverOpts := &BlockRsyncOptions{BlockSize: 4096, GenerationFile: generationFile}
+		clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096}, serverOpts)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		generation, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Generation).To(Equal(int64(1)))
+		Expect(generation.Pass).To(Equal(int64(1)))
+		Expect(generation.Complete).To(BeTrue())
+		Expect(generation.SourceSize).To(Equal(int64(8*4096 + 100)))
+		Expect(generation.SourceDigest).To(Equal(sourceDigest()))
+
+		// Nothing changed, the target still matches the source
+		clientErr, serverErr = sync(&BlockRsyncOptions{BlockSize: 4096}, serverOpts)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		generation, err = ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Generation).To(Equal(int64(2)))
+		Expect(generation.Complete).To(BeTrue())
+		Expect(generation.SourceDigest).To(Equal(sourceDigest()))
+	})
+
+	It("should record every pass of an iterative sync", func() {
+		clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096, Passes: 3}, &BlockRsyncOptions{BlockSize: 4096, GenerationFile: generationFile, Generation: 5})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		generation, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Generation).To(Equal(int64(5)))
+		Expect(generation.Pass).To(Equal(int64(2)))
+		Expect(generation.Complete).To(BeTrue())
+		Expect(generation.SourceDigest).To(Equal(sourceDigest()))
+	})
+
+	It("should leave the generation incomplete when the budget stops the sync", func() {
+		clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096, MaxBytes: 2 * 4096}, &BlockRsyncOptions{BlockSize: 4096, GenerationFile: generationFile})
+		Expect(clientErr).To(MatchError(ErrBudgetExhausted))
+		Expect(serverErr).ToNot(HaveOccurred())
+		generation, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Complete).To(BeFalse())
+		Expect(generation.SourceDigest).To(BeEmpty())
+	})
+
+	It("should leave the generation incomplete when a record is rejected", func() {
+		Expect(os.WriteFile(targetFile, make([]byte, 2*4096), 0644)).To(Succeed())
+		Expect((&Generation{Generation: 3, Complete: true}).WriteFile(generationFile)).To(Succeed())
+		err := sendRecords(targetFile, &BlockRsyncOptions{BlockSize: 4096, GenerationFile: generationFile}, 2*4096, func(e *codec.Encoder) {
+			Expect(e.WriteBlock(0, make([]byte, 4096))).To(Succeed())
+			Expect(e.WriteBlock(100000, make([]byte, 4096))).To(Succeed())
+		})
+		Expect(err).To(MatchError(ContainSubstring("outside of the source size")))
+		generation, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Generation).To(Equal(int64(4)))
+		Expect(generation.Complete).To(BeFalse())
+		Expect(generation.SourceDigest).To(BeEmpty())
+	})
+
+	It("should refuse to sync an older generation", func() {
+		Expect((&Generation{Generation: 3, Complete: true}).WriteFile(generationFile)).To(Succeed())
+		_, err := newGenerationTracker(generationFile, 2, false, 4096, HashBLAKE2b, GinkgoLogr)
+		Expect(err).To(MatchError(ErrGenerationDowngrade))
+		tracker, err := newGenerationTracker(generationFile, 0, false, 4096, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(tracker.generation).To(Equal(int64(4)))
+
+		clientErr, serverErr := sync(&BlockRsyncOptions{BlockSize: 4096}, &BlockRsyncOptions{BlockSize: 4096, GenerationFile: generationFile, Generation: 2, AllowDowngrade: true})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		generation, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(generation.Generation).To(Equal(int64(2)))
+	})
+})
@@ -0,0 +1,117 @@
+package blockrsync
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/sys/cpu"
+)
+
+// HashAlgorithm is how blocks are hashed, both sides must use the same
+// algorithm. The hashes of all algorithms are codec.HashLength bytes.
+type HashAlgorithm string
+
+const (
+	// HashBLAKE2b is BLAKE2b-512, it is the default and fastest where it has
+	// an assembly implementation, like amd64
+	HashBLAKE2b HashAlgorithm = "blake2b"
+	// HashSHA512 is SHA-512, it is computed by the CPU on arm64 with the SHA512
+	// extension and on s390x with CPACF
+	HashSHA512 HashAlgorithm = "sha512"
+	// HashAuto picks SHA-512 if the CPU computes it, and BLAKE2b otherwise
+	HashAuto HashAlgorithm = "auto"
+)
+
+// ParseHashAlgorithm parses a hash algorithm, or a comma separated list of
+// <arch>=<algorithm> defaults of which the one of the running architecture is
+// used, BLAKE2b if it is not listed. Auto is resolved for the running CPU.
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	return parseHashAlgorithm(s, runtime.GOARCH, sha512Accelerated())
+}
+
+func parseHashAlgorithm(s, arch string, accelerated bool) (HashAlgorithm, error) {
+	spec := s
+	if strings.Contains(s, "=") {
+		spec = string(HashBLAKE2b)
+		for _, entry := range strings.Split(s, ",") {
+			entryArch, algorithm, ok := strings.Cut(entry, "=")
+			if !ok || entryArch == "" {
+				return "", fmt.Errorf("invalid hash algorithm default %q, expected <arch>=<algorithm>", entry)
+			}
+			if _, err := parseHashAlgorithm(algorithm, arch, accelerated); err != nil {
+				return "", err
+			}
+			if entryArch == arch {
+				spec = algorithm
+			}
+		}
+	}
+	switch algorithm := HashAlgorithm(spec); algorithm {
+	case HashBLAKE2b, HashSHA512:
+		return algorithm, nil
+	case HashAuto:
+		return algorithm.resolve(accelerated), nil
+	}
+	return "", fmt.Errorf("invalid hash algorithm %q, must be auto, blake2b or sha512", s)
+}
+
+// sha512Accelerated returns true if the CPU has instructions computing
+// SHA-512, that crypto/sha512 uses.
+func sha512Accelerated() bool {
+	switch runtime.GOARCH {
+	case "arm64":
+		return cpu.ARM64.HasSHA512
+	case "s390x":
+		return cpu.S390X.HasSHA512
+	}
+	return false
+}
+
+// resolve returns the algorithm auto stands for, BLAKE2b if empty.
+func (a HashAlgorithm) resolve(accelerated bool) HashAlgorithm {
+	switch a {
+	case "":
+		return HashBLAKE2b
+	case HashAuto:
+		if accelerated {
+			return HashSHA512
+		}
+		return HashBLAKE2b
+	}
+	return a
+}
+
+func (a HashAlgorithm) new() hash.Hash {
+	if a == HashSHA512 {
+		return sha512.New()
+	}
+	h, _ := blake2b.New512(nil)
+	return h
+}
+
+func (a HashAlgorithm) sum(block []byte) []byte {
+	if a == HashSHA512 {
+		hash := sha512.Sum512(block)
+		return hash[:]
+	}
+	hash := blake2b.Sum512(block)
+	return hash[:]
+}
+
+// hashAlgorithm returns the algorithm the options hash blocks with.
+func (o *BlockRsyncOptions) hashAlgorithm() HashAlgorithm {
+	return o.HashAlgorithm.resolve(sha512Accelerated())
+}
+
+// hashAlgorithmOf returns the algorithm of the hashes of a hasher, the hashes
+// of other hashers than FileHasher are treated as BLAKE2b hashes.
+func hashAlgorithmOf(hasher Hasher) HashAlgorithm {
+	if f, ok := hasher.(*FileHasher); ok {
+		return f.algorithm
+	}
+	return HashBLAKE2b
+}
@@ -0,0 +1,77 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var _ = Describe("hash algorithm tests", func() {
+	DescribeTable("should parse hash algorithms for the architecture", func(spec, arch string, accelerated bool, expected HashAlgorithm) {
+		Expect(parseHashAlgorithm(spec, arch, accelerated)).To(Equal(expected))
+	},
+		Entry("blake2b", "blake2b", "s390x", true, HashBLAKE2b),
+		Entry("sha512", "sha512", "amd64", false, HashSHA512),
+		Entry("auto with SHA-512 instructions", "auto", "s390x", true, HashSHA512),
+		Entry("auto without SHA-512 instructions", "auto", "amd64", false, HashBLAKE2b),
+		Entry("default of the architecture", "s390x=sha512,arm64=auto", "s390x", false, HashSHA512),
+		Entry("auto default of the architecture", "s390x=sha512,arm64=auto", "arm64", true, HashSHA512),
+		Entry("architecture without a default", "s390x=sha512", "amd64", true, HashBLAKE2b),
+	)
+
+	DescribeTable("should reject invalid hash algorithms", func(spec string) {
+		_, err := parseHashAlgorithm(spec, "amd64", false)
+		Expect(err).To(HaveOccurred())
+	},
+		Entry("unknown", "md5"),
+		Entry("unknown default", "amd64=md5"),
+		Entry("missing architecture", "=sha512"),
+		Entry("not a default", "s390x=sha512,blake2b"),
+	)
+
+	It("should hash and sync with SHA-512 on both sides", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		data := make([]byte, 8*4096)
+		_, _ = rand.Read(data[:4*4096])
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		opts := &BlockRsyncOptions{BlockSize: 4096, HashAlgorithm: HashSHA512}
+		serverSide := NewBlockrsyncServer(targetFile, port, opts, GinkgoLogr.WithName("server"))
+		clientSide := NewBlockrsyncClient(sourceFile, "localhost", port, opts, GinkgoLogr.WithName("client"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- serverSide.StartServer()
+		}()
+		Expect(clientSide.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+		Expect(clientSide.protocol.Features.Has(codec.FeatureSHA512Hashes)).To(BeTrue())
+		first := sha512.Sum512(data[:4096])
+		Expect(clientSide.hasher.GetHashes()[0]).To(Equal(first[:]))
+	})
+
+	It("should refuse a peer hashing with another algorithm", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		Expect(os.WriteFile(sourceFile, make([]byte, 4096), 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		serverSide := NewBlockrsyncServer(filepath.Join(tmpDir, "target.raw"), port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("server"))
+		clientSide := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, HashAlgorithm: HashSHA512, ConnectRetries: 1}, GinkgoLogr.WithName("client"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- serverSide.StartServer()
+		}()
+		Expect(clientSide.ConnectToTarget()).To(MatchError(ContainSubstring("missing required features sha512-hashes")))
+		Eventually(serverDone).Should(Receive(HaveOccurred()))
+	})
+})
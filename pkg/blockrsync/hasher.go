@@ -3,7 +3,6 @@ package blockrsync
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash"
@@ -15,21 +14,51 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
-	"golang.org/x/crypto/blake2b"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 const (
-	DefaultBlockSize   = int64(64 * 1024)
-	defaultConcurrency = 25
+	DefaultBlockSize = int64(64 * 1024)
 )
 
 type Hasher interface {
 	HashFile(file string) (int64, error)
 	GetHashes() map[int64][]byte
-	DiffHashes(int64, map[int64][]byte) ([]int64, error)
-	SerializeHashes(io.Writer) error
-	DeserializeHashes(io.Reader) (int64, map[int64][]byte, error)
+	DiffHashes(int64, map[int64][]byte) ([]BlockDiff, error)
+	SerializeHashes(*codec.Encoder) error
+	DeserializeHashes(*codec.Decoder) (int64, map[int64][]byte, error)
 	BlockSize() int64
+	// IsDevice returns true if the hashed file is a block or character device
+	IsDevice() bool
+}
+
+// HashIterator is implemented by hashers that can call a function with the
+// hashes in offset order, without the caller building a sorted list of them.
+// FileHasher implements it, it still keeps the map GetHashes returns.
+type HashIterator interface {
+	IterateHashes(func(offset int64, hash []byte) error) error
+}
+
+// iterateHashes calls fn with the hashes of the hasher in offset order, with
+// IterateHashes if the hasher implements HashIterator.
+func iterateHashes(hasher Hasher, fn func(offset int64, hash []byte) error) error {
+	if iterator, ok := hasher.(HashIterator); ok {
+		return iterator.IterateHashes(fn)
+	}
+	hashes := hasher.GetHashes()
+	offsets := make([]int64, 0, len(hashes))
+	for offset := range hashes {
+		offsets = append(offsets, offset)
+	}
+	slices.SortFunc(offsets, int64SortFunc)
+	for _, offset := range offsets {
+		if err := fn(offset, hashes[offset]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type OffsetHash struct {
@@ -43,49 +72,148 @@ type FileHasher struct {
 	res       chan OffsetHash
 	blockSize int64
 	fileSize  int64
+	isDevice  bool
 	log       logr.Logger
+	// readLimiter limits the bytes read per second, nil is unlimited
+	readLimiter *transport.Limiter
+	// traceBlocks logs every serialized hash instead of a sample
+	traceBlocks bool
+	// progress reports the bytes hashed, nil doesn't report
+	progress Progress
+	// audit records the operations on the hashed file
+	audit *auditor
+	// concurrency is the number of blocks hashed in parallel, limit tunes
+	// how many of them hash at once when adaptive
+	concurrency int
+	limit       *adaptiveLimit
+	// algorithm hashes the blocks
+	algorithm HashAlgorithm
+	// cpu pauses hashing while the process is over its CPU limit
+	cpu *cpuPacer
+	// affinity pins the workers to CPUs, see BlockRsyncOptions.HashAffinity.
+	// backing is the number of the device holding the file
+	affinity string
+	backing  uint64
+	// precomputed hashes are not calculated from the file
+	precomputed bool
+	// excluded blocks are not hashed, nor compared, unless zeroExcluded
+	// empties them on the peer
+	excluded     ExcludedRanges
+	zeroExcluded bool
+	// resumed are the hashes of blocks known to be on the file, such as from
+	// a resume journal, they are not read again
+	resumed map[int64][]byte
+	// fillPatterns are hashed like zeroes
+	fillPatterns FillPatterns
+	// digest folds the hashes into a digest of the file, if set
+	digest *fileDigest
+	// stop stops hashing once closed, HashFile returns the size of the file
+	// and ErrCancelled
+	stop <-chan struct{}
+	// start and end limit hashing to the blocks of a shard of the file, an
+	// end of 0 is the end of the file
+	start int64
+	end   int64
+	// mu guards the hashes while HashFile runs, hashed is the end of the
+	// blocks hashed from the start of the file. sized is set once the size of
+	// the file is known and done once HashFile returned.
+	mu     sync.Mutex
+	cond   *sync.Cond
+	hashed int64
+	sized  bool
+	done   bool
 }
 
 func NewFileHasher(blockSize int64, log logr.Logger) Hasher {
-	return &FileHasher{
-		blockSize: blockSize,
-		queue:     make(chan int64, defaultConcurrency),
-		res:       make(chan OffsetHash, defaultConcurrency),
-		hashes:    make(map[int64][]byte),
-		log:       log,
+	return newFileHasher(blockSize, nil, log)
+}
+
+// NewPrecomputedHasher returns a hasher with the hashes of the blocks of a
+// file of size bytes, keyed by offset, such as from a manifest. HashFile
+// doesn't read the file.
+func NewPrecomputedHasher(blockSize, size int64, hashes map[int64][]byte, isDevice bool, log logr.Logger) Hasher {
+	f := newFileHasher(blockSize, nil, log)
+	f.hashes = hashes
+	f.fileSize = size
+	f.isDevice = isDevice
+	f.precomputed = true
+	f.sized, f.done = true, true
+	return f
+}
+
+func newFileHasher(blockSize int64, readLimiter *transport.Limiter, log logr.Logger) *FileHasher {
+	f := &FileHasher{
+		blockSize:   blockSize,
+		queue:       make(chan int64, DefaultHashConcurrency),
+		res:         make(chan OffsetHash, DefaultHashConcurrency),
+		hashes:      make(map[int64][]byte),
+		log:         log,
+		readLimiter: readLimiter,
+		algorithm:   HashBLAKE2b,
+		concurrency: DefaultHashConcurrency,
 	}
+	f.cond = sync.NewCond(&f.mu)
+	return f
 }
 
 func (f *FileHasher) HashFile(fileName string) (int64, error) {
+	if f.precomputed {
+		f.log.V(3).Info("Using precomputed hashes", "file", fileName, "blocks", len(f.hashes))
+		return f.fileSize, nil
+	}
+	defer f.update(func() { f.done = true })
 	f.log.V(3).Info("Hashing file", "file", fileName)
 	t := time.Now()
 	defer func() {
 		f.log.V(3).Info("Hashing took", "milliseconds", time.Since(t).Milliseconds())
 	}()
-	done := make(chan struct{})
 	size, err := f.getFileSize(fileName)
 	if err != nil {
 		return 0, err
 	}
-	f.fileSize = size
-	go f.calculateOffsets(f.fileSize)
+	start, end := f.bounds(size)
+	excludedBlocks := 0
+	f.update(func() {
+		f.fileSize = size
+		for offset, hash := range f.resumed {
+			if offset >= start && offset < end {
+				f.hashes[offset] = hash
+			}
+		}
+		f.hashed = start
+		f.advance(end)
+		f.sized = true
+	})
+	if len(f.excluded) > 0 {
+		for offset := start; offset < end; offset += f.blockSize {
+			if f.excluded.coversBlock(offset, f.blockSize, size) {
+				excludedBlocks++
+			}
+		}
+		f.log.V(3).Info("Skipping excluded blocks", "blocks", excludedBlocks)
+	}
+	go f.calculateOffsets(start, end)
 
-	count := f.concurrentHashCount(f.fileSize)
+	cpus, err := affinityCPUs(f.affinity, f.backing)
+	if err != nil {
+		f.log.Info("Unable to find the CPUs to pin the hash workers to, hashing on any CPU", "affinity", f.affinity, "error", err.Error())
+	} else if len(cpus) > 0 {
+		f.log.V(3).Info("Pinning the hash workers", "affinity", f.affinity, "cpus", len(cpus))
+	}
+	count := f.concurrentHashCount(end - start)
 	wg := sync.WaitGroup{}
-	go func() {
-		wg.Wait()
-		done <- struct{}{}
-	}()
-
 	for i := 0; i < count; i++ {
 		wg.Add(1)
-		h, err := blake2b.New512(nil)
-		if err != nil {
-			return 0, err
-		}
+		h := f.algorithm.new()
 		go func(h hash.Hash) {
 			defer wg.Done()
-			osFile, err := os.Open(fileName)
+			defer enterStage("", StageHash)()
+			if len(cpus) > 0 {
+				if err := pinThread(cpus); err != nil {
+					f.log.V(3).Info("Unable to pin the hash worker", "error", err.Error())
+				}
+			}
+			osFile, err := f.audit.open(fileName, os.O_RDONLY, 0)
 			if err != nil {
 				f.log.Info("Failed to open file", "error", err)
 				return
@@ -93,29 +221,105 @@ func (f *FileHasher) HashFile(fileName string) (int64, error) {
 			for offset := range f.queue {
 				h.Reset()
 				defer osFile.Close()
-				if err := f.calculateHash(offset, osFile, h); err != nil {
+				if !f.limit.acquire(f.stop) {
+					return
+				}
+				t := time.Now()
+				err := f.calculateHash(offset, osFile, h)
+				f.limit.release(f.blockSize, time.Since(t))
+				if err != nil {
 					f.log.Info("Failed to calculate hash", "offset", offset, "error", err)
 					return
 				}
 			}
 		}(h)
 	}
-	for {
-		select {
-		case offsetHash := <-f.res:
+	go func() {
+		wg.Wait()
+		close(f.res)
+	}()
+	if f.progress != nil {
+		f.progress.Start(end - start)
+	}
+	for offsetHash := range f.res {
+		var count int
+		f.update(func() {
 			f.hashes[offsetHash.Offset] = offsetHash.Hash
-		case <-done:
-			return f.fileSize, nil
+			f.advance(end)
+			count = len(f.hashes) + excludedBlocks
+		})
+		if f.progress != nil {
+			f.progress.Update(min(int64(count)*f.blockSize, end-start))
 		}
 	}
+	if cancelled(f.stop) {
+		return f.fileSize, ErrCancelled
+	}
+	return f.fileSize, nil
+}
+
+// update changes the hashing state and wakes the callers waiting for it.
+func (f *FileHasher) update(change func()) {
+	f.mu.Lock()
+	change()
+	f.mu.Unlock()
+	f.cond.Broadcast()
+}
+
+// advance moves hashed past the blocks that are hashed or excluded, and folds
+// their hashes into the digest in order.
+func (f *FileHasher) advance(end int64) {
+	for f.hashed < end && (f.hashes[f.hashed] != nil || f.excluded.coversBlock(f.hashed, f.blockSize, f.fileSize)) {
+		f.digest.add(f.hashed, f.hashes[f.hashed])
+		f.hashed += f.blockSize
+	}
+}
+
+// waitSize waits for HashFile to find the size of the file, it returns false
+// if HashFile failed before.
+func (f *FileHasher) waitSize() (int64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.sized && !f.done {
+		f.cond.Wait()
+	}
+	return f.fileSize, f.sized
+}
+
+// waitHash waits for the block at offset to be hashed while HashFile runs, it
+// returns false if the block was not hashed.
+func (f *FileHasher) waitHash(offset int64) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for offset >= f.hashed && !f.done {
+		f.cond.Wait()
+	}
+	hash, ok := f.hashes[offset]
+	return hash, ok
 }
 
 func (f *FileHasher) getFileSize(fileName string) (int64, error) {
-	file, err := os.Open(fileName)
+	file, err := f.audit.open(fileName, os.O_RDONLY, 0)
 	if err != nil {
 		return int64(0), err
 	}
 	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return int64(0), err
+	}
+	f.isDevice = isDevice(info)
+	f.backing, _ = backingDevice(info)
+	if info.Mode()&os.ModeDevice != 0 && info.Mode()&os.ModeCharDevice == 0 {
+		// Seeking to the end is unreliable on some block devices
+		f.audit.ioctl(file, "BLKGETSIZE64")
+		size, err := deviceSize(file)
+		if err == nil && size > 0 {
+			f.log.V(5).Info("Device size", "bytes", size)
+			return size, nil
+		}
+		f.log.V(3).Info("Unable to get the device size, seeking to the end", "error", err)
+	}
 	size, err := file.Seek(0, io.SeekEnd)
 	if err != nil {
 		return int64(0), err
@@ -128,31 +332,71 @@ func (f *FileHasher) getFileSize(fileName string) (int64, error) {
 	return size, nil
 }
 
+// forRange returns a hasher of the blocks of the file from start to end, with
+// the settings of f.
+func (f *FileHasher) forRange(start, end int64) *FileHasher {
+	hasher := newFileHasher(f.blockSize, f.readLimiter, f.log)
+	hasher.audit = f.audit
+	hasher.concurrency = f.concurrency
+	hasher.limit = f.limit
+	hasher.cpu = f.cpu
+	hasher.algorithm = f.algorithm
+	hasher.affinity = f.affinity
+	hasher.traceBlocks = f.traceBlocks
+	hasher.stop = f.stop
+	hasher.excluded = f.excluded
+	hasher.zeroExcluded = f.zeroExcluded
+	hasher.start = start
+	hasher.end = end
+	return hasher
+}
+
+// bounds returns the range of a file of size bytes that is hashed.
+func (f *FileHasher) bounds(size int64) (int64, int64) {
+	if f.end > 0 {
+		size = min(size, f.end)
+	}
+	return f.start, max(size, f.start)
+}
+
 func (f *FileHasher) concurrentHashCount(fileSize int64) int {
-	return int(math.Min(float64(defaultConcurrency), float64(int(fileSize/f.blockSize))))
+	// A partial block at the end needs a worker too
+	blocks := (fileSize + f.blockSize - 1) / f.blockSize
+	return int(math.Min(float64(f.concurrency), float64(blocks)))
 }
 
-func (f *FileHasher) calculateOffsets(size int64) {
+func (f *FileHasher) calculateOffsets(start, end int64) {
 	var i int64
 	defer close(f.queue)
 	f.log.V(5).Info("blocksize", "size", f.blockSize)
-	for i = 0; i < size; i += f.blockSize {
-		f.queue <- i
+	for i = start; i < end; i += f.blockSize {
+		if f.excluded.coversBlock(i, f.blockSize, f.fileSize) || f.resumed[i] != nil {
+			continue
+		}
+		select {
+		case f.queue <- i:
+		case <-f.stop:
+			return
+		}
 	}
 }
 
-func (f *FileHasher) calculateHash(offset int64, rs io.ReadSeeker, h hash.Hash) error {
-	_, err := rs.Seek(int64(offset), 0)
-	if err != nil {
-		f.log.V(5).Info("Failed to seek")
-		return err
-	}
+// calculateHash reads the block at offset with ReadAt, so the workers can
+// share the offset of a duplicated descriptor.
+func (f *FileHasher) calculateHash(offset int64, r io.ReaderAt, h hash.Hash) error {
 	buf := make([]byte, f.blockSize)
-	n, err := rs.Read(buf)
-	if err != nil {
+	if f.readLimiter != nil {
+		f.readLimiter.WaitN(len(buf))
+	}
+	n, err := r.ReadAt(buf, offset)
+	if err != nil && (err != io.EOF || n == 0) {
 		f.log.V(5).Info("Failed to read")
 		return err
 	}
+	if f.fillPatterns.filled(buf[:n]) {
+		// The peer holds the zeroes of the hole the block is sent as
+		clear(buf[:n])
+	}
 	n, err = h.Write(buf[:n])
 	if err != nil {
 		f.log.V(5).Info("Failed to write to hash")
@@ -165,6 +409,7 @@ func (f *FileHasher) calculateHash(offset int64, rs io.ReadSeeker, h hash.Hash)
 		Offset: offset,
 		Hash:   h.Sum(nil),
 	}
+	f.cpu.pace()
 	f.res <- offsetHash
 	return nil
 }
@@ -173,46 +418,77 @@ func (f *FileHasher) GetHashes() map[int64][]byte {
 	return f.hashes
 }
 
-func (f *FileHasher) DiffHashes(blockSize int64, cmpHash map[int64][]byte) ([]int64, error) {
+// IterateHashes calls fn with the hash of every block in offset order, and
+// stops at the first error fn returns. While HashFile runs it waits for the
+// blocks to be hashed, so the start of the file can be consumed while the
+// rest is hashed, it must be called once HashFile started. Blocks that are
+// excluded or could not be hashed are skipped.
+func (f *FileHasher) IterateHashes(fn func(offset int64, hash []byte) error) error {
+	size, ok := f.waitSize()
+	if !ok {
+		return nil
+	}
+	start, end := f.bounds(size)
+	for offset := start; offset < end; offset += f.blockSize {
+		hash, ok := f.waitHash(offset)
+		if !ok {
+			continue
+		}
+		if err := fn(offset, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffHashes compares the hashes of the file with the hashes of the peer, and
+// returns the blocks that differ sorted by offset, every offset once, with
+// the reason and both hashes. Hashes of the peer at or past the end of the
+// file are ignored, the peer is truncated or resized separately. cmpHash is
+// not modified.
+func (f *FileHasher) DiffHashes(blockSize int64, cmpHash map[int64][]byte) ([]BlockDiff, error) {
 	if blockSize != f.blockSize {
 		return nil, errors.New("block size mismatch")
 	}
-	var diff []int64
+	var diff []BlockDiff
 	f.log.V(5).Info("Size of hashes ", "hash", len(f.hashes), "incoming hash", len(cmpHash))
 	for k, v := range f.hashes {
-		if _, ok := cmpHash[k]; !ok {
+		if f.excluded.coversBlock(k, f.blockSize, f.fileSize) {
+			continue
+		}
+		if cmp, ok := cmpHash[k]; !ok {
 			// Hash not found in cmpHash
-			diff = append(diff, k)
-		} else {
-			if !bytes.Equal(v, cmpHash[k]) {
-				// Hashes don't match
-				diff = append(diff, k)
-			}
-			delete(cmpHash, k)
+			diff = append(diff, BlockDiff{Offset: k, Reason: DiffMissing, NewHash: v})
+		} else if !bytes.Equal(v[:min(len(v), len(cmp))], cmp) {
+			// Hashes don't match, the peer may have sent truncated hashes
+			diff = append(diff, BlockDiff{Offset: k, Reason: DiffMismatch, OldHash: cmp, NewHash: v})
 		}
 	}
-	for k := range cmpHash {
-		// remaining hashes in cmpHash, if the offset is < size of source file
-		if k < f.fileSize {
-			diff = append(diff, k)
+	for k, v := range cmpHash {
+		// hashes only in cmpHash, if the offset is < size of source file
+		if _, ok := f.hashes[k]; !ok && k < f.fileSize && !f.excluded.coversBlock(k, f.blockSize, f.fileSize) {
+			diff = append(diff, BlockDiff{Offset: k, Reason: DiffExtra, OldHash: v})
 		}
 	}
+	if f.zeroExcluded {
+		diff = append(diff, f.excludedDiff(cmpHash)...)
+	}
+	slices.SortFunc(diff, func(a, b BlockDiff) int {
+		return int64SortFunc(a.Offset, b.Offset)
+	})
 	return diff, nil
 }
 
-func (f *FileHasher) SerializeHashes(w io.Writer) error {
+func (f *FileHasher) SerializeHashes(encoder *codec.Encoder) error {
 	f.log.V(3).Info("Serializing hashes")
 	t := time.Now()
 	defer func() {
 		f.log.V(3).Info("Serializing took", "milliseconds", time.Since(t).Milliseconds())
 	}()
 
-	if err := binary.Write(w, binary.LittleEndian, int64(f.blockSize)); err != nil {
-		return err
-	}
 	length := len(f.hashes)
 	f.log.V(5).Info("Number of blocks", "size", length)
-	if err := binary.Write(w, binary.LittleEndian, int64(length)); err != nil {
+	if err := encoder.WriteHashHeader(f.blockSize, int64(length)); err != nil {
 		return err
 	}
 	keys := make([]int64, 0, len(f.hashes))
@@ -220,54 +496,71 @@ func (f *FileHasher) SerializeHashes(w io.Writer) error {
 		keys = append(keys, k)
 	}
 	slices.SortFunc(keys, int64SortFunc)
+	blockLog := newBlockLogger(f.log, "Writing offset", f.traceBlocks)
+	defer blockLog.flush()
 	for _, k := range keys {
-		f.log.V(5).Info("Writing offset", "offset", k)
-		if err := binary.Write(w, binary.LittleEndian, k); err != nil {
+		blockLog.add(k, f.blockSize)
+		if err := encoder.WriteHash(k, f.hashes[k]); err != nil {
 			return err
 		}
-		if len(f.hashes[k]) != 64 {
-			return errors.New("invalid hash length")
+	}
+	f.log.V(5).Info("Finished writing hashes")
+	return nil
+}
+
+// streamHashes writes the hashes in offset order while HashFile runs, so the
+// peer can use the hashes of the start of the file while the rest is hashed.
+// A block that could not be hashed is sent with an empty hash, which never
+// matches.
+func (f *FileHasher) streamHashes(encoder *codec.Encoder) error {
+	f.log.V(3).Info("Streaming hashes")
+	size, _ := f.waitSize()
+	start, end := f.bounds(size)
+	if err := encoder.WriteHashHeader(f.blockSize, (end-start+f.blockSize-1)/f.blockSize); err != nil {
+		return err
+	}
+	blockLog := newBlockLogger(f.log, "Writing offset", f.traceBlocks)
+	defer blockLog.flush()
+	missing := make([]byte, codec.HashLength)
+	for offset := start; offset < end; offset += f.blockSize {
+		hash, ok := f.waitHash(offset)
+		if !ok {
+			hash = missing
 		}
-		if n, err := w.Write(f.hashes[k]); err != nil {
+		blockLog.add(offset, f.blockSize)
+		if err := encoder.WriteHash(offset, hash); err != nil {
 			return err
-		} else {
-			f.log.V(5).Info("Wrote hash", "bytes", n)
 		}
 	}
-	f.log.V(5).Info("Finished writing hashes")
+	f.log.V(5).Info("Finished streaming hashes")
 	return nil
 }
 
-func (f *FileHasher) DeserializeHashes(r io.Reader) (int64, map[int64][]byte, error) {
+func (f *FileHasher) DeserializeHashes(decoder *codec.Decoder) (int64, map[int64][]byte, error) {
 	f.log.V(3).Info("Deserializing hashes")
 	t := time.Now()
 	defer func() {
 		f.log.V(3).Info("Deserializing took", "milliseconds", time.Since(t).Milliseconds())
 	}()
-	var blockSize int64
-	if err := binary.Read(r, binary.LittleEndian, &blockSize); err != nil {
-		return 0, nil, err
-	}
-	var length int64
-	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+	blockSize, length, err := decoder.ReadHashHeader()
+	if err != nil {
 		return 0, nil, err
 	}
 	f.log.V(3).Info("Number of blocks to receive", "size", length)
 	hashes := make(map[int64][]byte)
+	blockLog := newBlockLogger(f.log, "Reading offset", f.traceBlocks)
+	defer blockLog.flush()
 	for i := int64(0); i < length; i++ {
-		var offset int64
-		if err := binary.Read(r, binary.LittleEndian, &offset); err != nil {
+		offset, hash, err := decoder.ReadHash()
+		if err != nil {
 			return 0, nil, err
 		}
-		f.log.V(5).Info("Reading offset", "offset", offset)
+		blockLog.add(offset, blockSize)
 		if offset < 0 || offset > length*blockSize {
 			return 0, nil, fmt.Errorf("invalid offset %d", offset)
 		}
-		hash := make([]byte, 64)
-		if n, err := io.ReadFull(r, hash); err != nil {
-			return 0, nil, err
-		} else {
-			f.log.V(5).Info("Read hash", "bytes", n, "hash", base64.StdEncoding.EncodeToString(hash))
+		if blockLog.tracing {
+			blockLog.trace("Read hash", "hash", base64.StdEncoding.EncodeToString(hash))
 		}
 		hashes[offset] = hash
 	}
@@ -275,6 +568,10 @@ func (f *FileHasher) DeserializeHashes(r io.Reader) (int64, map[int64][]byte, er
 	return blockSize, hashes, nil
 }
 
+func (f *FileHasher) IsDevice() bool {
+	return f.isDevice
+}
+
 func (f *FileHasher) BlockSize() int64 {
 	return f.blockSize
 }
@@ -2,11 +2,17 @@ package blockrsync
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"maps"
+	"os"
 	"path/filepath"
+	"slices"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
 )
 
 const (
@@ -32,6 +38,17 @@ var _ = Describe("hasher tests", func() {
 		Expect(fileSize).To(Equal(int64(testFileSize)))
 	})
 
+	It("should detect devices", func() {
+		_, err := hasher.(*FileHasher).getFileSize(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hasher.IsDevice()).To(BeFalse())
+		// A character device, the size falls back to seeking
+		size, err := hasher.HashFile(os.DevNull)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(size).To(BeZero())
+		Expect(hasher.IsDevice()).To(BeTrue())
+	})
+
 	It("should error on invalid file", func() {
 		size, err := hasher.(*FileHasher).getFileSize("invalid")
 		Expect(err).ToNot(BeNil())
@@ -42,7 +59,7 @@ var _ = Describe("hasher tests", func() {
 		hasher = NewFileHasher(blockSize, GinkgoLogr.WithName("hasher"))
 		concurrency := hasher.(*FileHasher).concurrentHashCount(fileSize)
 		Expect(concurrency).To(Equal(expectedConcurrency))
-	}, Entry("file size > 25 * block size", int64(testFileSize), int64(4096), defaultConcurrency),
+	}, Entry("file size > 25 * block size", int64(testFileSize), int64(4096), DefaultHashConcurrency),
 		Entry("file size = block size", int64(4096), int64(4096), 1),
 		Entry("file size < block size", int64(40960), int64(4096), 10),
 	)
@@ -60,18 +77,105 @@ var _ = Describe("hasher tests", func() {
 		Expect(n).To(Equal(int64(testFileSize)))
 		var b bytes.Buffer
 		w := io.Writer(&b)
-		err = hasher.SerializeHashes(w)
+		err = hasher.SerializeHashes(codec.NewEncoder(w, codec.CurrentVersion, 0))
 		Expect(err).ToNot(HaveOccurred())
 		hashes := hasher.GetHashes()
 		// 16 for the blocksize and length, 72 for each hash
 		Expect(b.Len()).To(Equal(72*len(hashes) + 16))
 		r := io.Reader(&b)
-		blockSize, h, err := hasher.DeserializeHashes(r)
+		blockSize, h, err := hasher.DeserializeHashes(codec.NewDecoder(r, codec.CurrentVersion, 0))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(blockSize).To(Equal(DefaultBlockSize))
 		Expect(h).To(HaveLen(len(hashes)))
 	})
 
+	It("should stream the hashes in offset order while the file is hashed", func() {
+		var b bytes.Buffer
+		streamed := make(chan error, 1)
+		go func() {
+			streamed <- hasher.(*FileHasher).streamHashes(codec.NewEncoder(&b, codec.CurrentVersion, 0))
+		}()
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-streamed).To(Succeed())
+		decoder := codec.NewDecoder(&b, codec.CurrentVersion, 0)
+		blockSize, count, err := decoder.ReadHashHeader()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(blockSize).To(Equal(DefaultBlockSize))
+		Expect(count).To(Equal(int64(testFileSize / DefaultBlockSize)))
+		hashes := hasher.GetHashes()
+		for i := int64(0); i < count; i++ {
+			offset, hash, err := decoder.ReadHash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(offset).To(Equal(i * blockSize))
+			Expect(hash).To(Equal(hashes[offset]))
+		}
+	})
+
+	It("should iterate the hashes in offset order while the file is hashed", func() {
+		var offsets []int64
+		iterated := make(chan error, 1)
+		go func() {
+			defer GinkgoRecover()
+			iterated <- hasher.(HashIterator).IterateHashes(func(offset int64, hash []byte) error {
+				Expect(hash).ToNot(BeEmpty())
+				offsets = append(offsets, offset)
+				return nil
+			})
+		}()
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-iterated).To(Succeed())
+		Expect(offsets).To(HaveLen(len(hasher.GetHashes())))
+		Expect(slices.IsSorted(offsets)).To(BeTrue())
+
+		errStop := errors.New("stop")
+		count := 0
+		Expect(hasher.(HashIterator).IterateHashes(func(offset int64, hash []byte) error {
+			Expect(hash).To(Equal(hasher.GetHashes()[offset]))
+			if count++; count == 3 {
+				return errStop
+			}
+			return nil
+		})).To(MatchError(errStop))
+		Expect(count).To(Equal(3))
+	})
+
+	It("should iterate the hashes of a hasher without IterateHashes in offset order", func() {
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		// Only has the methods of Hasher
+		custom := struct{ Hasher }{hasher}
+		_, ok := Hasher(custom).(HashIterator)
+		Expect(ok).To(BeFalse())
+		var offsets []int64
+		Expect(iterateHashes(custom, func(offset int64, hash []byte) error {
+			Expect(hash).To(Equal(hasher.GetHashes()[offset]))
+			offsets = append(offsets, offset)
+			return nil
+		})).To(Succeed())
+		Expect(offsets).To(HaveLen(len(hasher.GetHashes())))
+		Expect(slices.IsSorted(offsets)).To(BeTrue())
+	})
+
+	It("should diff against compact truncated hashes", func() {
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		var b bytes.Buffer
+		encoder := codec.NewEncoder(&b, codec.CurrentVersion, codec.FeatureCompactHashes)
+		Expect(encoder.SetHashLength(codec.MinHashLength)).To(Succeed())
+		Expect(hasher.SerializeHashes(encoder)).To(Succeed())
+		hashes := hasher.GetHashes()
+		// 17 for the blocksize, length and hash length, 1 byte offset delta per hash
+		Expect(b.Len()).To(Equal((1+codec.MinHashLength)*len(hashes) + 17))
+		blockSize, h, err := hasher.DeserializeHashes(codec.NewDecoder(&b, codec.CurrentVersion, codec.FeatureCompactHashes))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(h).To(HaveLen(len(hashes)))
+		diff, err := hasher.DiffHashes(blockSize, h)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(BeEmpty())
+	})
+
 	getCirrosHashes := func() map[int64][]byte {
 		cirrosHasher := NewFileHasher(DefaultBlockSize, GinkgoLogr.WithName("cirros hasher"))
 		n, err := cirrosHasher.HashFile(filepath.Join(testImagePath, testFileName))
@@ -98,20 +202,66 @@ var _ = Describe("hasher tests", func() {
 		return res
 	}
 
-	DescribeTable("It should properly determine differences between hashes", func(cmpHash map[int64][]byte, expected []int64) {
+	DescribeTable("It should properly determine differences between hashes", func(cmpHash map[int64][]byte, expected []int64, reason DiffReason) {
 		n, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
 		Expect(err).ToNot(HaveOccurred())
 		Expect(n).To(Equal(int64(testFileSize)))
 		diff, err := hasher.DiffHashes(DefaultBlockSize, cmpHash)
 		Expect(err).ToNot(HaveOccurred())
-		Expect(diff).To(Equal(expected))
+		Expect(diffOffsets(diff)).To(Equal(expected))
+		for _, block := range diff {
+			Expect(block.Reason).To(Equal(reason))
+			Expect(block.NewHash).To(Equal(hasher.GetHashes()[block.Offset]))
+		}
 	},
-		Entry("no differences", getCirrosHashes(), nil),
-		Entry("single differences", getCirrosHashesModified(), []int64{0}),
-		Entry("single differences, removed", getCirrosHashesEntryRemoved(), []int64{0}),
-		Entry("larger comparison, should strip", getLargerCirrosHashes(), nil),
+		Entry("no differences", getCirrosHashes(), nil, DiffReason("")),
+		Entry("single differences", getCirrosHashesModified(), []int64{0}, DiffMismatch),
+		Entry("single differences, removed", getCirrosHashesEntryRemoved(), []int64{0}, DiffMissing),
+		Entry("larger comparison, should strip", getLargerCirrosHashes(), nil, DiffReason("")),
 	)
 
+	getCirrosHashesSmaller := func() map[int64][]byte {
+		res := getCirrosHashes()
+		for offset := range res {
+			if offset >= 10*DefaultBlockSize {
+				delete(res, offset)
+			}
+		}
+		res[3*DefaultBlockSize] = []byte("modified")
+		return res
+	}
+
+	It("should return the differences sorted by offset once", func() {
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		cmpHash := getCirrosHashesSmaller()
+		cmpHash[DefaultBlockSize*1000] = []byte("past the end")
+		before := maps.Clone(cmpHash)
+		diff, err := hasher.DiffHashes(DefaultBlockSize, cmpHash)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(cmpHash).To(Equal(before))
+		offsets := diffOffsets(diff)
+		Expect(slices.IsSorted(offsets)).To(BeTrue())
+		Expect(slices.Compact(slices.Clone(offsets))).To(Equal(offsets))
+		Expect(offsets[0]).To(Equal(3 * DefaultBlockSize))
+		Expect(diff[0].Reason).To(Equal(DiffMismatch))
+		Expect(offsets).To(HaveLen(len(hasher.GetHashes()) - 10 + 1))
+		for _, block := range diff[1:] {
+			Expect(block.Offset).To(BeNumerically(">=", 10*DefaultBlockSize))
+			Expect(block.Reason).To(Equal(DiffMissing))
+		}
+	})
+
+	It("should report hashes only the peer has as extra", func() {
+		_, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
+		Expect(err).ToNot(HaveOccurred())
+		cmpHash := getCirrosHashes()
+		delete(hasher.GetHashes(), DefaultBlockSize)
+		diff, err := hasher.DiffHashes(DefaultBlockSize, cmpHash)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(diff).To(Equal([]BlockDiff{{Offset: DefaultBlockSize, Reason: DiffExtra, OldHash: getCirrosHashes()[DefaultBlockSize]}}))
+	})
+
 	It("should fail if block size is different", func() {
 		n, err := hasher.HashFile(filepath.Join(testImagePath, testFileName))
 		Expect(err).ToNot(HaveOccurred())
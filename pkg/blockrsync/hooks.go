@@ -0,0 +1,72 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrHookRejected = errors.New("rejected")
+)
+
+// Hooks are called at the stages of a sync, so an embedder can observe them
+// or enforce a policy. A hook that returns an error stops the sync with an
+// error wrapping ErrHookRejected and the error of the hook. Hooks that are
+// nil are skipped.
+type Hooks struct {
+	// PreHash is called before a local file is hashed
+	PreHash func(file string) error
+	// PostDiff is called with the offsets of the blocks that differ in
+	// order, before they are sent, it must not modify them. Pass is 1 unless
+	// the sync is iterative. Blocks missing from the Bloom filter of the target may
+	// already have been sent when PostDiff is called for the first pass. A
+	// pipelined first pass or a sharded sync calls PostDiff for every shard
+	PostDiff func(pass int, offsets []int64) error
+	// PreWrite is called on the target before a block is written, the data
+	// is nil for a hole. Blocks cloned by a local copy are not written
+	PreWrite func(offset int64, data []byte) error
+	// PostSync is called once the sync ended, err is nil if it succeeded
+	PostSync func(stats *Stats, err error)
+}
+
+func hookError(stage string, err error) error {
+	return fmt.Errorf("%w by the %s hook: %w", ErrHookRejected, stage, err)
+}
+
+func (h *Hooks) preHash(file string) error {
+	if h.PreHash == nil {
+		return nil
+	}
+	if err := h.PreHash(file); err != nil {
+		return hookError("pre-hash", err)
+	}
+	return nil
+}
+
+func (h *Hooks) postDiff(pass int, offsets []int64) error {
+	if h.PostDiff == nil {
+		return nil
+	}
+	if err := h.PostDiff(pass, offsets); err != nil {
+		return hookError("post-diff", err)
+	}
+	return nil
+}
+
+func (h *Hooks) preWrite(offset int64, data []byte) error {
+	if h.PreWrite == nil {
+		return nil
+	}
+	if err := h.PreWrite(offset, data); err != nil {
+		return hookError("pre-write", err)
+	}
+	return nil
+}
+
+// postSync calls PostSync with the result of the sync and returns it.
+func (h *Hooks) postSync(stats *Stats, err error) error {
+	if h.PostSync != nil {
+		h.PostSync(stats, err)
+	}
+	return err
+}
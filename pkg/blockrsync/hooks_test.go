@@ -0,0 +1,152 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("hook tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+		target     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 8*4096)
+		_, _ = rand.Read(source[:6*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		target = bytes.Clone(source)
+		_, _ = rand.Read(target[4096 : 2*4096])
+		_, _ = rand.Read(target[6*4096:])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+	})
+
+	sync := func(clientHooks, serverHooks Hooks) (error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithHooks(serverHooks), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithHooks(clientHooks), WithLogger(GinkgoLogr.WithName("client")))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return clientErr, <-serverDone
+	}
+
+	It("should call the hooks of every stage", func() {
+		var hashed []string
+		var diffs [][]int64
+		var writes []int64
+		var holes int
+		var clientStats, serverStats *Stats
+		clientErr, serverErr := sync(Hooks{
+			PreHash: func(file string) error {
+				hashed = append(hashed, file)
+				return nil
+			},
+			PostDiff: func(pass int, offsets []int64) error {
+				Expect(pass).To(Equal(1))
+				diffs = append(diffs, offsets)
+				return nil
+			},
+			PostSync: func(stats *Stats, err error) {
+				Expect(err).ToNot(HaveOccurred())
+				clientStats = stats
+			},
+		}, Hooks{
+			PreHash: func(file string) error {
+				hashed = append(hashed, file)
+				return nil
+			},
+			PreWrite: func(offset int64, data []byte) error {
+				writes = append(writes, offset)
+				if data == nil {
+					holes++
+				}
+				return nil
+			},
+			PostSync: func(stats *Stats, err error) {
+				Expect(err).ToNot(HaveOccurred())
+				serverStats = stats
+			},
+		})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(hashed).To(ConsistOf(sourceFile, targetFile))
+		Expect(diffs).To(HaveLen(1))
+		Expect(diffs[0]).To(ConsistOf(int64(4096), int64(6*4096), int64(7*4096)))
+		Expect(writes).To(ConsistOf(int64(4096), int64(6*4096), int64(7*4096)))
+		Expect(holes).To(Equal(2))
+		Expect(clientStats.DifferentBlocks).To(Equal(int64(3)))
+		Expect(serverStats.BlocksTransferred).To(Equal(int64(1)))
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+
+	It("should stop the sync when the diff is rejected", func() {
+		quota := errors.New("more than 2 blocks changed")
+		var syncErr error
+		clientErr, _ := sync(Hooks{
+			PostDiff: func(pass int, offsets []int64) error {
+				if len(offsets) > 2 {
+					return quota
+				}
+				return nil
+			},
+			PostSync: func(stats *Stats, err error) {
+				syncErr = err
+			},
+		}, Hooks{})
+		Expect(clientErr).To(MatchError(ErrHookRejected))
+		Expect(clientErr).To(MatchError(quota))
+		Expect(syncErr).To(Equal(clientErr))
+		Expect(os.ReadFile(targetFile)).To(Equal(target))
+	})
+
+	It("should stop the sync when a write is rejected", func() {
+		_, serverErr := sync(Hooks{}, Hooks{
+			PreWrite: func(offset int64, data []byte) error {
+				if offset == 4096 {
+					return errors.New("read only block")
+				}
+				return nil
+			},
+		})
+		Expect(serverErr).To(MatchError(ErrHookRejected))
+		Expect(serverErr).To(MatchError(ContainSubstring("pre-write hook: read only block")))
+	})
+
+	It("should call the hooks of a local copy", func() {
+		var writes []int64
+		opts := &BlockRsyncOptions{BlockSize: 4096, Hooks: Hooks{
+			PreWrite: func(offset int64, data []byte) error {
+				writes = append(writes, offset)
+				return nil
+			},
+		}}
+		localCopy := NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy"))
+		Expect(localCopy.Copy()).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		if localCopy.Stats().BytesCloned == 0 {
+			Expect(writes).To(ConsistOf(int64(4096), int64(6*4096), int64(7*4096)))
+		}
+
+		opts.Hooks.PreHash = func(file string) error {
+			return errors.New("not allowed")
+		}
+		Expect(NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr).Copy()).To(MatchError(ErrHookRejected))
+	})
+})
@@ -0,0 +1,306 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	journalMagic   = "BRUJ"
+	journalVersion = uint16(1)
+	// journalHeaderLength is the magic, version, block size and original size
+	journalHeaderLength = 4 + 2 + 8 + 8
+	// journalEntryHeaderLength is the offset, type, length and checksum
+	journalEntryHeaderLength = 8 + 1 + 4 + 4
+)
+
+const (
+	journalData byte = iota
+	journalZero
+)
+
+// undoJournal saves the previous contents of target blocks before they are
+// overwritten, so Rollback can restore the target to its state before the
+// syncs that used the journal. Each block is saved once, and synced to the
+// journal before the target block is replaced.
+type undoJournal struct {
+	f            *os.File
+	w            *bufio.Writer
+	target       *os.File
+	blockSize    int64
+	originalSize int64
+	saved        map[int64]bool
+	log          logr.Logger
+}
+
+type journalEntry struct {
+	offset    int64
+	entryType byte
+	length    int64
+	data      []byte
+}
+
+// openUndoJournal creates the journal, or continues an existing one so
+// running the sync again keeps the state before the first sync.
+func openUndoJournal(fileName string, target *os.File, targetSize, blockSize int64, log logr.Logger) (*undoJournal, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &undoJournal{
+		f:            f,
+		target:       target,
+		blockSize:    blockSize,
+		originalSize: targetSize,
+		saved:        make(map[int64]bool),
+		log:          log,
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < journalHeaderLength {
+		// The header is synced before the target changes, a sync that
+		// stopped while writing it left the target alone
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if err := j.writeHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
+	} else if err := j.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("unable to continue undo journal %s: %w", fileName, err)
+	}
+	j.w = bufio.NewWriter(f)
+	return j, nil
+}
+
+func (j *undoJournal) writeHeader() error {
+	header := bytes.NewBuffer(make([]byte, 0, journalHeaderLength))
+	header.WriteString(journalMagic)
+	_ = binary.Write(header, binary.LittleEndian, journalVersion)
+	_ = binary.Write(header, binary.LittleEndian, j.blockSize)
+	_ = binary.Write(header, binary.LittleEndian, j.originalSize)
+	if _, err := j.f.Write(header.Bytes()); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// load reads the saved blocks of an existing journal and drops an entry that
+// was partially written when the previous sync stopped.
+func (j *undoJournal) load() error {
+	r := bufio.NewReader(j.f)
+	blockSize, originalSize, err := readJournalHeader(r)
+	if err != nil {
+		return err
+	}
+	if blockSize != j.blockSize {
+		return fmt.Errorf("journal block size %d does not match block size %d", blockSize, j.blockSize)
+	}
+	j.originalSize = originalSize
+	end := int64(journalHeaderLength)
+	for {
+		entry, err := readJournalEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			j.log.Info("Dropping incomplete journal entry", "position", end, "error", err.Error())
+			break
+		}
+		j.saved[entry.offset] = true
+		end += journalEntryHeaderLength + int64(len(entry.data))
+	}
+	if err := j.f.Truncate(end); err != nil {
+		return err
+	}
+	_, err = j.f.Seek(end, io.SeekStart)
+	return err
+}
+
+// save journals the block at offset if it was not saved before.
+func (j *undoJournal) save(offset int64) error {
+	if j.saved[offset] {
+		return nil
+	}
+	length := min(j.blockSize, j.originalSize-offset)
+	if length <= 0 {
+		// Past the end of the original target, rollback truncates it
+		j.saved[offset] = true
+		return nil
+	}
+	data := make([]byte, length)
+	if _, err := j.target.ReadAt(data, offset); err != nil && err != io.EOF {
+		return err
+	}
+	entryType := journalData
+	if isEmptyBlock(data) {
+		entryType = journalZero
+	}
+	if err := j.writeEntry(offset, entryType, data); err != nil {
+		return err
+	}
+	j.saved[offset] = true
+	return nil
+}
+
+// saveRange journals the blocks between start and end.
+func (j *undoJournal) saveRange(start, end int64) error {
+	for offset := start - start%j.blockSize; offset < end; offset += j.blockSize {
+		if err := j.save(offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *undoJournal) writeEntry(offset int64, entryType byte, data []byte) error {
+	header := make([]byte, journalEntryHeaderLength)
+	binary.LittleEndian.PutUint64(header[0:8], uint64(offset))
+	header[8] = entryType
+	binary.LittleEndian.PutUint32(header[9:13], uint32(len(data)))
+	if entryType == journalZero {
+		data = nil
+	}
+	binary.LittleEndian.PutUint32(header[13:17], crc32.ChecksumIEEE(data))
+	if _, err := j.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := j.w.Write(data); err != nil {
+		return err
+	}
+	if err := j.w.Flush(); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+func (j *undoJournal) Close() error {
+	if err := j.w.Flush(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+func readJournalHeader(r io.Reader) (int64, int64, error) {
+	header := make([]byte, journalHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, 0, err
+	}
+	if string(header[:4]) != journalMagic {
+		return 0, 0, errors.New("not an undo journal")
+	}
+	if version := binary.LittleEndian.Uint16(header[4:6]); version != journalVersion {
+		return 0, 0, fmt.Errorf("unsupported undo journal version %d", version)
+	}
+	blockSize := int64(binary.LittleEndian.Uint64(header[6:14]))
+	originalSize := int64(binary.LittleEndian.Uint64(header[14:22]))
+	return blockSize, originalSize, nil
+}
+
+func readJournalEntry(r io.Reader) (*journalEntry, error) {
+	header := make([]byte, journalEntryHeaderLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated entry header")
+		}
+		return nil, err
+	}
+	entry := &journalEntry{
+		offset:    int64(binary.LittleEndian.Uint64(header[0:8])),
+		entryType: header[8],
+		length:    int64(binary.LittleEndian.Uint32(header[9:13])),
+	}
+	switch entry.entryType {
+	case journalData:
+		entry.data = make([]byte, entry.length)
+		if _, err := io.ReadFull(r, entry.data); err != nil {
+			return nil, errors.New("truncated entry data")
+		}
+	case journalZero:
+	default:
+		return nil, fmt.Errorf("invalid entry type %d", entry.entryType)
+	}
+	if crc32.ChecksumIEEE(entry.data) != binary.LittleEndian.Uint32(header[13:17]) {
+		return nil, errors.New("entry checksum mismatch")
+	}
+	return entry, nil
+}
+
+// Rollback restores the blocks saved in the undo journal to the target, and
+// truncates a target file back to its original size.
+func Rollback(journalFile, targetFile string, log logr.Logger) error {
+	journal, err := os.Open(journalFile)
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+	target, err := openFile(targetFile, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+
+	r := bufio.NewReader(journal)
+	_, originalSize, err := readJournalHeader(r)
+	if err != nil {
+		return err
+	}
+	restored := 0
+	for {
+		entry, err := readJournalEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// The block of an incomplete entry was not overwritten yet
+			log.Info("Ignoring incomplete journal entry", "error", err.Error())
+			break
+		}
+		if err := restoreEntry(target, entry); err != nil {
+			return err
+		}
+		restored++
+	}
+	info, err := target.Stat()
+	if err != nil {
+		return err
+	}
+	if !isDevice(info) && info.Size() != originalSize {
+		log.Info("Truncating target to its original size", "size", originalSize)
+		if err := target.Truncate(originalSize); err != nil {
+			return err
+		}
+	}
+	if err := target.Sync(); err != nil {
+		return err
+	}
+	log.Info("Rolled back target", "file", targetFile, "blocks", restored)
+	return nil
+}
+
+func restoreEntry(target *os.File, entry *journalEntry) error {
+	if entry.entryType == journalZero {
+		if err := PunchHole(target, entry.offset, entry.length); err == nil {
+			return nil
+		}
+		// Write the zeroes if the hole can't be punched
+		entry.data = make([]byte, entry.length)
+	}
+	_, err := target.WriteAt(entry.data, entry.offset)
+	return err
+}
@@ -0,0 +1,124 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("undo journal tests", func() {
+	var (
+		tmpDir      string
+		targetFile  string
+		journalFile string
+	)
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		journalFile = filepath.Join(tmpDir, "journal")
+	})
+
+	randomData := func(size int) []byte {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+		return data
+	}
+
+	sync := func(source []byte) {
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, UndoJournal: journalFile}, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal(source))
+	}
+
+	It("should roll back the target to its state before the first sync", func() {
+		original := randomData(8 * 4096)
+		copy(original[4096:], make([]byte, 4096))
+		Expect(os.WriteFile(targetFile, original, 0644)).To(Succeed())
+
+		source := bytes.Clone(original)
+		copy(source[0:], randomData(4096))
+		// Overwrite the block that was zero
+		copy(source[4096:], randomData(4096))
+		sync(source)
+		// Run again with a grown source, the journal keeps the original blocks
+		source = append(bytes.Clone(source[:3*4096]), randomData(7*4096)...)
+		sync(source)
+
+		Expect(Rollback(journalFile, targetFile, GinkgoLogr)).To(Succeed())
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal(original))
+	})
+
+	It("should restore blocks removed when truncating the target", func() {
+		original := randomData(8 * 4096)
+		Expect(os.WriteFile(targetFile, original, 0644)).To(Succeed())
+		sync(original[:2*4096+100])
+
+		Expect(Rollback(journalFile, targetFile, GinkgoLogr)).To(Succeed())
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal(original))
+	})
+
+	It("should ignore an incomplete entry", func() {
+		original := randomData(4 * 4096)
+		Expect(os.WriteFile(targetFile, original, 0644)).To(Succeed())
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		journal, err := openUndoJournal(journalFile, f, int64(len(original)), 4096, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(journal.save(0)).To(Succeed())
+		Expect(journal.save(4096)).To(Succeed())
+		Expect(journal.Close()).To(Succeed())
+		_, err = f.WriteAt(randomData(4096), 0)
+		Expect(err).ToNot(HaveOccurred())
+
+		// Cut the last entry in half as if the server stopped while writing it
+		info, err := os.Stat(journalFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.Truncate(journalFile, info.Size()-2048)).To(Succeed())
+		journal, err = openUndoJournal(journalFile, f, int64(len(original)), 4096, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(journal.saved).To(Equal(map[int64]bool{0: true}))
+		Expect(journal.Close()).To(Succeed())
+		info, err = os.Stat(journalFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(journalHeaderLength + journalEntryHeaderLength + 4096)))
+
+		Expect(Rollback(journalFile, targetFile, GinkgoLogr)).To(Succeed())
+		target, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal(original))
+	})
+
+	It("should reject a journal with a different block size", func() {
+		Expect(os.WriteFile(targetFile, randomData(4096), 0644)).To(Succeed())
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		journal, err := openUndoJournal(journalFile, f, 4096, 4096, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(journal.Close()).To(Succeed())
+		_, err = openUndoJournal(journalFile, f, 4096, 8192, GinkgoLogr)
+		Expect(err).To(MatchError(ContainSubstring("block size")))
+	})
+})
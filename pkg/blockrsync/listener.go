@@ -0,0 +1,61 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ListenerOptions are an address the target listens on besides its port.
+type ListenerOptions struct {
+	// Address is the host:port to listen on
+	Address string
+	// TLS of the connections accepted on the address, the TLS of the options
+	// if nil. Empty TLSOptions accept plaintext connections
+	TLS *TLSOptions
+}
+
+func (o *ListenerOptions) Validate() error {
+	if _, _, err := net.SplitHostPort(o.Address); err != nil {
+		return fmt.Errorf("invalid listener address %q: %w", o.Address, err)
+	}
+	if o.TLS == nil {
+		return nil
+	}
+	if o.TLS.CAFile != "" && o.TLS.CertFile == "" {
+		return fmt.Errorf("listener %s needs a TLS certificate to verify clients", o.Address)
+	}
+	return o.TLS.Validate()
+}
+
+// ParseListener parses <host:port>[,cert=<file>,key=<file>][,ca=<file>] or
+// <host:port>,plaintext. The listener uses the TLS of the options without any
+// setting.
+func ParseListener(s string) (ListenerOptions, error) {
+	fields := strings.Split(s, ",")
+	res := ListenerOptions{Address: fields[0]}
+	for _, field := range fields[1:] {
+		if res.TLS == nil {
+			res.TLS = &TLSOptions{}
+		}
+		if field == "plaintext" {
+			if len(fields) != 2 {
+				return ListenerOptions{}, errors.New("a plaintext listener has no TLS settings")
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		switch {
+		case ok && key == "cert":
+			res.TLS.CertFile = value
+		case ok && key == "key":
+			res.TLS.KeyFile = value
+		case ok && key == "ca":
+			res.TLS.CAFile = value
+		default:
+			return ListenerOptions{}, fmt.Errorf("invalid listener setting %q, expected cert=, key=, ca= or plaintext", field)
+		}
+	}
+	return res, res.Validate()
+}
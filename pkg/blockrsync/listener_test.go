@@ -0,0 +1,116 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+var _ = Describe("multiple listener tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 4*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	// sync connects the client to the target port and the server listens on
+	// the port
+	sync := func(targetPort, port int, clientOpts, serverOpts *BlockRsyncOptions) {
+		client := NewBlockrsyncClient(sourceFile, "localhost", targetPort, clientOpts, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, serverOpts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	}
+
+	It("should parse the listeners", func() {
+		Expect(ParseListener("10.0.0.1:8000")).To(Equal(ListenerOptions{Address: "10.0.0.1:8000"}))
+		Expect(ParseListener(":8000,plaintext")).To(Equal(ListenerOptions{Address: ":8000", TLS: &TLSOptions{}}))
+		Expect(ParseListener(":8000,cert=tls.crt,key=tls.key,ca=ca.crt")).To(Equal(ListenerOptions{
+			Address: ":8000",
+			TLS:     &TLSOptions{CertFile: "tls.crt", KeyFile: "tls.key", CAFile: "ca.crt"},
+		}))
+		for _, invalid := range []string{"8000", ":8000,plaintext,cert=tls.crt", ":8000,cert=tls.crt", ":8000,ca=ca.crt", ":8000,tls"} {
+			_, err := ParseListener(invalid)
+			Expect(err).To(HaveOccurred(), invalid)
+		}
+	})
+
+	It("should sync over the plaintext listener of a TLS target", func() {
+		ca := newTestCA(GinkgoT().TempDir(), "ca")
+		certFile, keyFile := ca.issue("localhost", x509.ExtKeyUsageServerAuth)
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		extraPort, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		serverOpts := &BlockRsyncOptions{
+			BlockSize: 4096,
+			TLS:       TLSOptions{CertFile: certFile, KeyFile: keyFile},
+			Listeners: []ListenerOptions{{Address: fmt.Sprintf("localhost:%d", extraPort), TLS: &TLSOptions{}}},
+		}
+		sync(extraPort, port, &BlockRsyncOptions{BlockSize: 4096}, serverOpts)
+	})
+
+	It("should sync over an alternate target when the target address can't be reached", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		unreachable, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		clientOpts := &BlockRsyncOptions{
+			BlockSize:        4096,
+			AlternateTargets: []string{fmt.Sprintf("127.0.0.1:%d", port)},
+			ConnectRetries:   1,
+			RetryInterval:    10 * time.Millisecond,
+		}
+		sync(unreachable, port, clientOpts, &BlockRsyncOptions{BlockSize: 4096})
+	})
+
+	It("should skip the paths the source didn't pick", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		clientOpts := &BlockRsyncOptions{
+			BlockSize:        4096,
+			AlternateTargets: []string{fmt.Sprintf("127.0.0.1:%d", port), fmt.Sprintf("[::1]:%d", port)},
+			RetryInterval:    10 * time.Millisecond,
+		}
+		sync(port, port, clientOpts, &BlockRsyncOptions{BlockSize: 4096})
+	})
+
+	It("should sync over a unix socket", func() {
+		socket := filepath.Join(GinkgoT().TempDir(), "blockrsync.sock")
+		clientOpts := &BlockRsyncOptions{BlockSize: 4096, ConnectSocket: socket, RetryInterval: 10 * time.Millisecond}
+		serverOpts := &BlockRsyncOptions{BlockSize: 4096, ListenSocket: socket}
+		sync(0, 0, clientOpts, serverOpts)
+		Expect(socket).ToNot(BeAnExistingFile())
+	})
+
+	It("should sync over the pipes of a command", func() {
+		toServer, fromClient := io.Pipe()
+		toClient, fromServer := io.Pipe()
+		clientOpts := &BlockRsyncOptions{BlockSize: 4096, Transport: transport.NewPipe(toClient, fromClient)}
+		serverOpts := &BlockRsyncOptions{BlockSize: 4096, Transport: transport.NewPipe(toServer, fromServer)}
+		sync(0, 0, clientOpts, serverOpts)
+	})
+})
@@ -0,0 +1,346 @@
+package blockrsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"syscall"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+// LocalCopy syncs a source to a target on the same host without the network.
+// When both are files on the same reflink capable filesystem, a new target
+// clones the whole source and the changed blocks of an existing target are
+// cloned instead of copied.
+type LocalCopy struct {
+	sourceFile  string
+	targetFile  string
+	opts        *BlockRsyncOptions
+	log         logr.Logger
+	stats       *Stats
+	readLimiter *transport.Limiter
+	reflink     bool
+	overall     *overallProgress
+	audit       *auditor
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+func NewLocalCopy(sourceFile, targetFile string, opts *BlockRsyncOptions, logger logr.Logger) *LocalCopy {
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := NewStats()
+	return &LocalCopy{
+		sourceFile:  sourceFile,
+		targetFile:  targetFile,
+		opts:        opts,
+		log:         logger,
+		stats:       stats,
+		readLimiter: opts.readLimiter(),
+		overall:     opts.overallProgress(localProgressPhases...),
+		audit:       newAuditor(opts.Audit, stats, logger.WithName("audit")),
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (l *LocalCopy) Stats() *Stats {
+	return l.stats
+}
+
+// Cancel stops the copy, Copy writes the copied blocks to disk and returns
+// ErrCancelled.
+func (l *LocalCopy) Cancel() {
+	l.cancel()
+}
+
+func (l *LocalCopy) Copy() error {
+	err := l.copy()
+	if err == nil {
+		l.overall.complete()
+		if serr := recordSavings(l.opts.SavingsFile, l.stats); serr != nil {
+			l.log.Error(serr, "Unable to record savings", "file", l.opts.SavingsFile)
+		}
+	}
+	return l.opts.Hooks.postSync(l.stats, err)
+}
+
+// recordDiff writes the blocks that differ to the diff file.
+func (l *LocalCopy) recordDiff(diff []BlockDiff) error {
+	diffs, err := openDiffRecorder(l.opts.DiffFile)
+	if err != nil {
+		return err
+	}
+	if err := diffs.record(1, diff); err != nil {
+		diffs.close()
+		return err
+	}
+	return diffs.close()
+}
+
+func (l *LocalCopy) copy() error {
+	source, err := l.audit.open(l.sourceFile, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	target, err := l.audit.open(l.targetFile, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	l.reflink, err = sameFilesystem(source, target)
+	if err != nil {
+		return err
+	}
+	if l.reflink && len(l.opts.ExcludeRanges) == 0 {
+		cloned, err := l.seed(source, target)
+		if err != nil || cloned {
+			return err
+		}
+	}
+
+	if err := l.opts.Hooks.preHash(l.sourceFile); err != nil {
+		return err
+	}
+	sourceHasher := l.opts.newHasher(l.readLimiter, ProgressHashSource, l.overall, l.audit, l.ctx.Done(), l.log.WithName("source-hasher"))
+	stopPhase := l.stats.StartPhase(PhaseHashSource, l.log)
+	sourceSize, err := sourceHasher.HashFile(l.sourceFile)
+	stopPhase()
+	if err != nil {
+		return err
+	}
+	if err := l.opts.Hooks.preHash(l.targetFile); err != nil {
+		return err
+	}
+	targetHasher := l.opts.newHasher(nil, ProgressHashTarget, l.overall, l.audit, l.ctx.Done(), l.log.WithName("target-hasher"))
+	stopPhase = l.stats.StartPhase(PhaseHashTarget, l.log)
+	targetSize, err := targetHasher.HashFile(l.targetFile)
+	stopPhase()
+	if err != nil {
+		return err
+	}
+	l.stats.Update(func(s *Stats) {
+		s.SourceSize = sourceSize
+		s.TargetSize = targetSize
+	})
+	if err := l.resize(target, targetHasher, sourceSize, targetSize); err != nil {
+		return err
+	}
+
+	stopPhase = l.stats.StartPhase(PhaseDiff, l.log)
+	endStage := enterStage("", StageDiff)
+	diff, err := sourceHasher.DiffHashes(sourceHasher.BlockSize(), targetHasher.GetHashes())
+	endStage()
+	stopPhase()
+	if err != nil {
+		return err
+	}
+	l.stats.Update(func(s *Stats) { s.DifferentBlocks = int64(len(diff)) })
+	if err := l.recordDiff(diff); err != nil {
+		return fmt.Errorf("unable to record the diff: %w", err)
+	}
+	offsets := diffOffsets(diff)
+	if err := l.opts.Hooks.postDiff(1, offsets); err != nil {
+		return err
+	}
+	l.log.Info("Differences found", "count", len(diff), "reflink", l.reflink)
+	holes, err := newHoleWriter(target, l.opts, targetHasher, targetSize, l.stats, l.audit, l.log)
+	if err != nil {
+		return err
+	}
+	if targetHasher.IsDevice() && targetSize > sourceSize {
+		if err := holes.emptyTail(l.opts.TailPolicy, sourceSize, targetSize-sourceSize); err != nil {
+			return err
+		}
+	}
+	stopPhase = l.stats.StartPhase(PhaseTransfer, l.log)
+	err = l.copyBlocks(source, target, holes, offsets, sourceSize)
+	stopPhase()
+	if errors.Is(err, ErrCancelled) {
+		return syncCancelled(target, l.stats, l.audit, l.log)
+	}
+	if err != nil {
+		return err
+	}
+	stopPhase = l.stats.StartPhase(PhaseFsync, l.log)
+	defer stopPhase()
+	return l.audit.fsync(target)
+}
+
+// seed clones the whole source into a new or empty target file.
+func (l *LocalCopy) seed(source, target *os.File) (bool, error) {
+	info, err := target.Stat()
+	if err != nil {
+		return false, err
+	}
+	if info.Size() != 0 {
+		return false, nil
+	}
+	l.audit.ioctl(target, "FICLONE")
+	if err := cloneFile(target, source); err != nil {
+		if reflinkNotSupported(err) {
+			l.log.Info("The filesystem does not support reflinks, copying blocks", "error", err.Error())
+			l.reflink = false
+			return false, nil
+		}
+		return false, fmt.Errorf("unable to clone %s: %w", l.sourceFile, err)
+	}
+	if err := l.audit.fsync(target); err != nil {
+		return false, err
+	}
+	info, err = target.Stat()
+	if err != nil {
+		return false, err
+	}
+	l.stats.Update(func(s *Stats) {
+		s.SourceSize = info.Size()
+		s.BytesCloned = info.Size()
+	})
+	l.log.Info("Cloned source into the empty target", "size", info.Size())
+	return true, nil
+}
+
+// resize makes the size of a target file match the source, a device must be
+// large enough. The end of a larger device is handled by the tail policy once
+// the hole strategy is known.
+func (l *LocalCopy) resize(target *os.File, targetHasher Hasher, sourceSize, targetSize int64) error {
+	if targetHasher.IsDevice() {
+		if sourceSize > targetSize {
+			return fmt.Errorf("source size %d is larger than the target device size %d", sourceSize, targetSize)
+		}
+		return nil
+	}
+	if sourceSize != targetSize {
+		l.log.V(3).Info("Resizing target", "from", targetSize, "to", sourceSize)
+		if err := l.audit.truncate(target, sourceSize); err != nil {
+			return err
+		}
+	}
+	if l.opts.PreallocateTarget {
+		l.audit.fallocate(target, "0")
+		if err := preallocate(target, sourceSize); err != nil {
+			return fmt.Errorf("unable to preallocate %d bytes for the target: %w", sourceSize, err)
+		}
+	}
+	return nil
+}
+
+// copyBlocks clones or copies the runs of different blocks. A run the
+// filesystem refuses to clone is copied.
+func (l *LocalCopy) copyBlocks(source, target *os.File, holes *holeWriter, offsets []int64, sourceSize int64) error {
+	defer enterStage("", StageWrite)()
+	blockSize := int64(l.opts.BlockSize)
+	offsets, err := l.emptyExcluded(holes, offsets, sourceSize)
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(offsets, int64SortFunc)
+	copyProgress := l.opts.progress(ProgressCopy, l.overall, l.log)
+	copyProgress.Start(int64(len(offsets)) * blockSize)
+	var copied int64
+	buf := make([]byte, blockSize*int64(l.opts.maxCoalescedBlocks(blockSize)))
+	for _, run := range coalesceOffsets(offsets, blockSize, l.opts.maxCoalescedBlocks(blockSize)) {
+		if l.ctx.Err() != nil {
+			if err := holes.flush(); err != nil {
+				return err
+			}
+			return ErrCancelled
+		}
+		copyProgress.Update(copied)
+		copied += int64(len(run)) * blockSize
+		start := run[0]
+		size := min(int64(len(run))*blockSize, sourceSize-start)
+		if l.reflink {
+			l.audit.ioctl(target, "FICLONERANGE")
+			err := cloneRange(target, source, start, size)
+			if err == nil {
+				l.stats.Update(func(s *Stats) { s.BytesCloned += size })
+				continue
+			}
+			if reflinkNotSupported(err) {
+				l.log.Info("The filesystem does not support reflinks, copying blocks", "error", err.Error())
+				l.reflink = false
+			} else {
+				l.log.V(3).Info("Unable to clone run, copying it", "offset", start, "size", size, "error", err.Error())
+			}
+		}
+		if err := l.copyRun(source, target, holes, buf[:size], start); err != nil {
+			return err
+		}
+	}
+	copyProgress.Update(copied)
+	return holes.flush()
+}
+
+func (l *LocalCopy) copyRun(source, target *os.File, holes *holeWriter, buf []byte, start int64) error {
+	if l.readLimiter != nil {
+		l.readLimiter.WaitN(len(buf))
+	}
+	n, err := source.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	buf = buf[:n]
+	blockSize := int64(l.opts.BlockSize)
+	for pos := int64(0); pos < int64(len(buf)); pos += blockSize {
+		block := buf[pos:min(pos+blockSize, int64(len(buf)))]
+		if l.opts.FillPatterns.isHole(block) {
+			if err := l.opts.Hooks.preWrite(start+pos, nil); err != nil {
+				return err
+			}
+			if err := holes.add(start+pos, int64(len(block))); err != nil {
+				return err
+			}
+			l.stats.Update(func(s *Stats) {
+				s.HolesTransferred++
+				s.HoleBytes += int64(len(block))
+			})
+			continue
+		}
+		if err := l.opts.Hooks.preWrite(start+pos, block); err != nil {
+			return err
+		}
+		if err := holes.flush(); err != nil {
+			return err
+		}
+		if _, err := target.WriteAt(block, start+pos); err != nil {
+			return err
+		}
+		l.stats.Update(func(s *Stats) {
+			s.BlocksTransferred++
+			s.BytesTransferred += int64(len(block))
+		})
+	}
+	return nil
+}
+
+// sameFilesystem returns true if both are regular files on the same
+// filesystem, so the target can share the extents of the source.
+func sameFilesystem(source, target *os.File) (bool, error) {
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return false, err
+	}
+	targetInfo, err := target.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !sourceInfo.Mode().IsRegular() || !targetInfo.Mode().IsRegular() {
+		return false, nil
+	}
+	sourceStat, ok := sourceInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+	targetStat, ok := targetInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false, nil
+	}
+	return sourceStat.Dev == targetStat.Dev, nil
+}
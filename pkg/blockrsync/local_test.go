@@ -0,0 +1,75 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("local copy tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 8*4096+100)
+		_, _ = rand.Read(source[:6*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	copyFiles := func() *Stats {
+		localCopy := NewLocalCopy(sourceFile, targetFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("copy"))
+		Expect(localCopy.Copy()).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		return localCopy.Stats()
+	}
+
+	It("should copy to a new target", func() {
+		stats := copyFiles()
+		// Unless the temporary directory supports reflinks every block is copied
+		Expect(stats.BytesTransferred + stats.BytesCloned).To(BeNumerically(">=", 6*4096))
+	})
+
+	It("should only copy the changed blocks of an existing target", func() {
+		target := bytes.Clone(source)
+		_, _ = rand.Read(target[4096 : 2*4096])
+		_, _ = rand.Read(target[7*4096:])
+		target = append(target, make([]byte, 4096)...)
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		stats := copyFiles()
+		Expect(stats.DifferentBlocks).To(Equal(int64(3)))
+		Expect(stats.TargetSize).To(Equal(int64(len(target))))
+		if stats.BytesCloned == 0 {
+			Expect(stats.BlocksTransferred).To(Equal(int64(1)))
+			Expect(stats.HolesTransferred).To(Equal(int64(2)))
+		}
+	})
+
+	It("should report the overall progress of the copy", func() {
+		var reported []float64
+		opts := &BlockRsyncOptions{BlockSize: 4096, OnProgress: func(percent float64) {
+			reported = append(reported, percent)
+		}}
+		Expect(NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy")).Copy()).To(Succeed())
+		Expect(reported).ToNot(BeEmpty())
+		Expect(slices.IsSorted(reported)).To(BeTrue())
+		Expect(reported[len(reported)-1]).To(Equal(float64(100)))
+	})
+
+	It("should not change a target that matches the source", func() {
+		Expect(os.WriteFile(targetFile, source, 0644)).To(Succeed())
+		stats := copyFiles()
+		Expect(stats.DifferentBlocks).To(BeZero())
+		Expect(stats.BytesTransferred + stats.BytesCloned).To(BeZero())
+	})
+})
@@ -0,0 +1,123 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+var (
+	ErrHashManifestMismatch = errors.New("hash manifest doesn't match the sync")
+)
+
+// HashManifest holds the block hashes of a file, written by the hash command
+// or by a target after a completed sync. A target that is known to be
+// unchanged since, like a freshly restored snapshot, uses it instead of
+// reading the whole target to hash it.
+type HashManifest struct {
+	BlockSize int64         `json:"blockSize"`
+	Size      int64         `json:"size"`
+	Algorithm HashAlgorithm `json:"algorithm"`
+	Time      string        `json:"time"`
+	// Hashes are keyed by offset
+	Hashes map[int64][]byte `json:"hashes"`
+}
+
+// ReadHashManifest reads a hash manifest file.
+func ReadHashManifest(fileName string) (*HashManifest, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &HashManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid hash manifest %s: %w", fileName, err)
+	}
+	if manifest.BlockSize <= 0 || manifest.Size < 0 {
+		return nil, fmt.Errorf("invalid hash manifest %s: block size %d, size %d", fileName, manifest.BlockSize, manifest.Size)
+	}
+	return manifest, nil
+}
+
+// WriteFile replaces the file atomically, so a crash leaves either the
+// previous or the new manifest.
+func (m *HashManifest) WriteFile(fileName string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+// HashToManifest hashes the file with the block size and hash algorithm of
+// the options.
+func HashToManifest(fileName string, opts *BlockRsyncOptions, log logr.Logger) (*HashManifest, error) {
+	hasher := opts.newHasher(opts.readLimiter(), ProgressHashSource, nil, nil, nil, log)
+	size, err := hasher.HashFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return newHashManifest(hasher.GetHashes(), hasher.BlockSize(), size, hashAlgorithmOf(hasher)), nil
+}
+
+func newHashManifest(hashes map[int64][]byte, blockSize, size int64, algorithm HashAlgorithm) *HashManifest {
+	return &HashManifest{
+		BlockSize: blockSize,
+		Size:      size,
+		Algorithm: algorithm.resolve(false),
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Hashes:    hashes,
+	}
+}
+
+// check returns ErrHashManifestMismatch if the hashes can't be compared with
+// hashes of the options.
+func (m *HashManifest) check(blockSize int64, algorithm HashAlgorithm) error {
+	if m.BlockSize != blockSize {
+		return fmt.Errorf("%w, it has a block size of %d, not %d", ErrHashManifestMismatch, m.BlockSize, blockSize)
+	}
+	if m.Algorithm.resolve(false) != algorithm.resolve(false) {
+		return fmt.Errorf("%w, it has %s hashes, not %s", ErrHashManifestMismatch, m.Algorithm, algorithm)
+	}
+	return nil
+}
+
+// hasher returns a hasher with the hashes of the manifest, that doesn't read
+// the file.
+func (m *HashManifest) hasher(isDevice bool, log logr.Logger) *FileHasher {
+	f := NewPrecomputedHasher(m.BlockSize, m.Size, m.Hashes, isDevice, log).(*FileHasher)
+	f.algorithm = m.Algorithm.resolve(false)
+	return f
+}
+
+// useHashManifest replaces the hasher of the target with the hashes of the
+// manifest in HashesFrom. A target of another size than the manifest has
+// changed since, it is hashed instead.
+func (b *BlockrsyncServer) useHashManifest() error {
+	manifest, err := ReadHashManifest(b.opts.HashesFrom)
+	if err != nil {
+		return err
+	}
+	hasher, err := fileHasher(b.hasher)
+	if err != nil {
+		return err
+	}
+	if err := manifest.check(hasher.BlockSize(), hasher.algorithm); err != nil {
+		return err
+	}
+	size, err := hasher.getFileSize(b.targetFile)
+	if err != nil {
+		return err
+	}
+	if size != manifest.Size {
+		b.log.Info("The target size doesn't match the hash manifest, hashing the target", "manifest", b.opts.HashesFrom, "target size", size, "manifest size", manifest.Size)
+		return nil
+	}
+	b.log.Info("Using the hashes of the manifest instead of hashing the target", "manifest", b.opts.HashesFrom, "hashed", manifest.Time, "blocks", len(manifest.Hashes))
+	b.hasher = manifest.hasher(hasher.IsDevice(), b.log.WithName("hasher"))
+	return nil
+}
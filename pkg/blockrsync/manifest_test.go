@@ -0,0 +1,115 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("hash manifest tests", func() {
+	var (
+		sourceFile   string
+		targetFile   string
+		manifestFile string
+		source       []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		manifestFile = filepath.Join(tmpDir, "target.manifest")
+		source = make([]byte, 8*4096+100)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	sync := func(serverOpts *BlockRsyncOptions) (*Stats, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, serverOpts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		return client.Stats(), <-serverDone
+	}
+
+	It("should write and read the hashes of a file", func() {
+		manifest, err := HashToManifest(sourceFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Size).To(Equal(int64(len(source))))
+		Expect(manifest.Algorithm).To(Equal(HashBLAKE2b))
+		Expect(manifest.Hashes).To(HaveLen(9))
+		Expect(manifest.WriteFile(manifestFile)).To(Succeed())
+		read, err := ReadHashManifest(manifestFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(manifest))
+	})
+
+	It("should use the hashes of the manifest instead of hashing the target", func() {
+		target := bytes.Clone(source)
+		_, _ = rand.Read(target[2*4096 : 3*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		manifest, err := HashToManifest(targetFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.WriteFile(manifestFile)).To(Succeed())
+		// Only the manifest is used, a change after it was taken is not noticed
+		_, _ = rand.Read(target[5*4096 : 6*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+
+		stats, err := sync(&BlockRsyncOptions{BlockSize: 4096, HashesFrom: manifestFile})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.DifferentBlocks).To(Equal(int64(1)))
+		target, err = os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target[5*4096 : 6*4096]).ToNot(Equal(source[5*4096 : 6*4096]))
+	})
+
+	It("should hash a target whose size doesn't match the manifest", func() {
+		Expect(os.WriteFile(targetFile, source, 0644)).To(Succeed())
+		manifest, err := HashToManifest(targetFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.WriteFile(manifestFile)).To(Succeed())
+		Expect(os.WriteFile(targetFile, append(bytes.Clone(source), make([]byte, 4096)...), 0644)).To(Succeed())
+
+		_, err = sync(&BlockRsyncOptions{BlockSize: 4096, HashesFrom: manifestFile})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+
+	It("should refuse a manifest of another block size", func() {
+		manifest, err := HashToManifest(sourceFile, &BlockRsyncOptions{BlockSize: 8192}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.WriteFile(manifestFile)).To(Succeed())
+		server := NewBlockrsyncServer(targetFile, 0, &BlockRsyncOptions{BlockSize: 4096, HashesFrom: manifestFile}, GinkgoLogr.WithName("server"))
+		Expect(server.StartServer()).To(MatchError(ErrHashManifestMismatch))
+	})
+
+	It("should write the hashes of the target after a sync for the next one", func() {
+		_, err := sync(&BlockRsyncOptions{BlockSize: 4096, HashesTo: manifestFile})
+		Expect(err).ToNot(HaveOccurred())
+		written, err := ReadHashManifest(manifestFile)
+		Expect(err).ToNot(HaveOccurred())
+		hashed, err := HashToManifest(targetFile, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written.Size).To(Equal(hashed.Size))
+		Expect(written.Hashes).To(Equal(hashed.Hashes))
+
+		_, _ = rand.Read(source[4096 : 2*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		stats, err := sync(&BlockRsyncOptions{BlockSize: 4096, HashesFrom: manifestFile, HashesTo: manifestFile})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.DifferentBlocks).To(Equal(int64(1)))
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		written, err = ReadHashManifest(manifestFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written.Hashes[4096]).To(Equal(HashBLAKE2b.sum(source[4096 : 2*4096])))
+	})
+})
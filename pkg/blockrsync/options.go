@@ -0,0 +1,677 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	DefaultHashConcurrency = 25
+	DefaultReadAhead       = 2
+	DefaultMaxReadSize     = 4 * 1024 * 1024
+	DefaultConnectRetries  = 30
+	DefaultRetryInterval   = time.Second
+)
+
+type BlockRsyncOptions struct {
+	Preallocation bool
+	BlockSize     int
+	Transport     transport.Transport
+	// Compat forces an older protocol, only "v0" is supported
+	Compat string
+	// Compression is whether the hashes and blocks are compressed, by default
+	// they are not compressed on loopback and compressed connections
+	Compression CompressionMode
+	// CompressionChunkSize is the uncompressed size of a snappy chunk, at most
+	// MaxCompressionChunkSize
+	CompressionChunkSize int
+	// ProbeRecordSize probes the path to the peer when the session starts,
+	// and chooses the size of the writes and of the compressed chunks for
+	// it, at most CompressionChunkSize
+	ProbeRecordSize bool
+	// FlushInterval flushes partially filled chunks when the sender pauses, 0
+	// disables periodic flushes
+	FlushInterval time.Duration
+	// HashLength truncates the hashes sent to the client when compact hashes are
+	// negotiated, 0 sends complete hashes
+	HashLength int
+	// BloomFilter sends a Bloom filter of the target hashes first, so the source
+	// can start sending blocks that are definitely different while the complete
+	// hash list is transferred
+	BloomFilter bool
+	// StreamChecksum compares a CRC32C of the record stream at the end of every
+	// pass, or a CRC32 with peers that don't support CRC32C. It must be set on
+	// both sides
+	StreamChecksum bool
+	// SourceDigest computes a digest of the source from the reads that hash
+	// it, the target compares it with a digest of the target once the sync
+	// is on disk. Must be set on both sides
+	SourceDigest bool
+	// HoleStrategy is how holes are applied to the target, by default the
+	// target is probed. Preallocation writes zeroes
+	HoleStrategy HoleStrategy
+	// TailPolicy is what happens to the end of a target device that is
+	// larger than the source, by default it is emptied like a hole
+	TailPolicy TailPolicy
+	// BestEffortHoles records the holes the target fails to empty in the
+	// stats as degraded regions instead of failing the sync, they may hold
+	// stale data
+	BestEffortHoles bool
+	// StreamTarget writes the target in ascending offset order, so it can be
+	// a pipe or an append only stream. The target is not hashed, every block
+	// of the source is sent
+	StreamTarget bool
+	// PreallocateTarget allocates the whole target file before blocks are
+	// written, so the filesystem can't run out of space during the sync.
+	// Holes are written with zeroes
+	PreallocateTarget bool
+	// SkipSpaceCheck accepts a sync the target filesystem may not have the
+	// space for
+	SkipSpaceCheck bool
+	// MaxSourceSize is the largest source the target accepts, MaxTargetGrowth
+	// the most bytes a target file may grow by, 0 is unlimited
+	MaxSourceSize   int64
+	MaxTargetGrowth int64
+	// Guard limits the connections the target accepts until one completes the
+	// handshake, the zero value accepts the first connection
+	Guard transport.GuardOptions
+	// TLS encrypts the connection between the source and the target
+	TLS TLSOptions
+	// Listeners are more addresses the target listens on, like the address
+	// of a migration network next to the management network
+	Listeners []ListenerOptions
+	// AlternateTargets are more host:port addresses of the target, the
+	// source connects to all of them and syncs over the path that completes
+	// the connection and the TLS handshake first
+	AlternateTargets []string
+	// ListenSocket is the path of a unix domain socket the target listens on
+	// in place of the port, and ConnectSocket the socket the source connects
+	// to in place of the target address, when both run on the same host
+	ListenSocket  string
+	ConnectSocket string
+	// Audit records the open flags, fallocate modes, ioctls, fsyncs and
+	// truncates of the synced files in the stats, and logs the first of each
+	// at AuditVerbosity
+	Audit bool
+	// TraceBlocks logs every block at V(5), otherwise the blocks are logged
+	// every few thousand blocks or once a second
+	TraceBlocks bool
+	// Passes is the maximum number of passes of an iterative sync, passes
+	// continue until the dirty blocks of a pass are at most ConvergeBlocks.
+	// 0 defaults to a single pass
+	Passes         int
+	ConvergeBlocks int64
+	// OnPass replaces the ConvergeBlocks check to decide whether to run another
+	// pass
+	OnPass PassCallback
+	// Cutover runs a final pass after the passes converged, once the barrier
+	// is released. The final pass is not counted in Passes
+	Cutover CutoverBarrier
+	// Priorities sends the blocks that change most often last
+	Priorities BlockPriorities
+	// ExcludeRanges are regions of the source that are neither hashed nor
+	// sent, the target keeps what it holds there unless ZeroExcluded, which
+	// empties them like holes
+	ExcludeRanges ExcludedRanges
+	ZeroExcluded  bool
+	// FillPatterns are the patterns blocks of unmapped regions hold besides
+	// zeroes, those blocks are holes. Both sides must set the same patterns so
+	// they hash the blocks the same way
+	FillPatterns FillPatterns
+	// Hooks observe or veto the stages of the sync
+	Hooks Hooks
+	// NewHasher creates the hasher of a local file instead of a FileHasher,
+	// for instance from precomputed hashes. Both sides must hash blocks the
+	// same way, the hashes of empty blocks are only recognized if they are
+	// BLAKE2b-512 hashes. HashAlgorithm, ReadLimit and NewProgress don't
+	// apply to it
+	NewHasher func(blockSize int64, log logr.Logger) Hasher
+	// NewProgress creates the progress of a phase, such as a progress bar.
+	// When nil the progress of the transfers is logged
+	NewProgress func(phase string) Progress
+	// OnProgress is called with the overall percentage of the sync as it
+	// increases, the phases count by ProgressWeights, DefaultProgressWeights
+	// when nil
+	OnProgress      func(percent float64)
+	ProgressWeights ProgressWeights
+	// MaxDuration and MaxBytes stop the sync cleanly with ErrBudgetExhausted
+	// once exceeded, 0 is unlimited. The progress is written to CheckpointFile
+	MaxDuration    time.Duration
+	MaxBytes       int64
+	CheckpointFile string
+	// ApplyWindow is the number of received blocks to buffer and apply in
+	// offset order, 0 applies blocks as they arrive
+	ApplyWindow int
+	// ReadLimit is the bytes per second read from the local file, 0 is
+	// unlimited
+	ReadLimit int64
+	// UndoJournal saves the blocks of the target before they are overwritten,
+	// so Rollback can restore the target
+	UndoJournal string
+	// GenerationFile records the generation the target holds after every
+	// pass. Generation is the generation to sync, 0 is the next one, syncing
+	// an older generation than the target holds fails unless AllowDowngrade
+	GenerationFile string
+	Generation     int64
+	AllowDowngrade bool
+	// HashesFrom is a hash manifest of the target, its hashes are used
+	// instead of hashing the target, which must not have changed since.
+	// HashesTo writes the hashes of the target to a manifest after every
+	// completed pass, for the next sync
+	HashesFrom string
+	HashesTo   string
+	// Seed is a local image copied onto the target before it is hashed, so
+	// only the blocks the seed is missing are sent. It is cloned when both are
+	// files on the same reflink capable filesystem. SeedCandidates are
+	// hashed instead, and the one that misses the fewest blocks of the source
+	// is copied, the source sends its hashes to the target for it
+	Seed           string
+	SeedCandidates []string
+	// HashConcurrency is the number of blocks hashed in parallel
+	HashConcurrency int
+	// MaxCPU is the number of CPUs the sync uses at most, 2 is 200%, 0 is
+	// unlimited. The blocks hashed in parallel are limited to it, and hashing
+	// and compression pause while the process used more CPU time
+	MaxCPU float64
+	// HashAlgorithm hashes the blocks, both sides must use the same
+	// algorithm. Empty is HashBLAKE2b, HashAuto is resolved for the CPU
+	HashAlgorithm HashAlgorithm
+	// HashAffinity pins the hash workers to CPUs, so hashing on a large host
+	// doesn't read the blocks across NUMA nodes. HashAffinityDevice uses the
+	// CPUs of the NUMA node the hashed device is attached to, otherwise it is
+	// a CPU list like 0-7,16-23. Empty doesn't pin the workers
+	HashAffinity string
+	// ReadAhead is the number of runs of dirty blocks read ahead of the
+	// network writer, MaxReadSize is the largest read of contiguous dirty
+	// blocks
+	ReadAhead   int
+	MaxReadSize int
+	// Adaptive tunes the blocks hashed in parallel, the runs read ahead and
+	// the apply window while syncing, from the throughput and latency they
+	// see. HashConcurrency, ReadAhead and ApplyWindow are where they start,
+	// the apply window doesn't grow past ApplyWindow
+	Adaptive bool
+	// PipelineShardSize diffs and sends the first pass in shards of this many
+	// bytes as soon as both sides hashed them, so the source is hashed while
+	// the blocks of earlier shards are sent. 0 hashes the source first
+	PipelineShardSize int64
+	// ShardSize syncs the source in shards of this many bytes, every shard is
+	// hashed, diffed and acknowledged on its own so only the hashes of a few
+	// shards are held. It must be set on both sides, the shard size of the
+	// source is used. ShardStateFile records the shards the target completed,
+	// so a sync that stopped resumes after them if the source didn't change
+	ShardSize      int64
+	ShardStateFile string
+	// Resume doesn't read the blocks the target applied before a sync of the
+	// same source stopped again, it must be set on both sides. The target
+	// records the hashes of the blocks it synced to disk in ResumeJournal,
+	// <target>.resume when empty, and removes it once the sync completed. The
+	// source is hashed whole, blocks that changed between the syncs are sent
+	// again
+	Resume        bool
+	ResumeJournal string
+	// ConnectRetries is how many times the source tries to connect to the
+	// target, RetryInterval apart
+	ConnectRetries int
+	RetryInterval  time.Duration
+	// SavingsFile adds up the savings of the completed syncs, so the bytes
+	// incremental syncs of a target did not send can be compared with full
+	// copies
+	SavingsFile string
+	// DiffFile writes a JSON line for every block that differs, with the
+	// pass, the reason and the hashes of both sides. The side that diffs
+	// writes it, the source or a local copy
+	DiffFile string
+	// BitmapFile writes a TransferBitmap of the blocks sent in every pass to
+	// BitmapFile.<pass>, source only
+	BitmapFile string
+}
+
+func (o *BlockRsyncOptions) readLimiter() *transport.Limiter {
+	if o.ReadLimit <= 0 {
+		return nil
+	}
+	return transport.NewLimiter(o.ReadLimit)
+}
+
+// progress returns the progress of a transfer phase, that is also counted
+// in the overall progress.
+func (o *BlockRsyncOptions) progress(phase string, overall *overallProgress, log logr.Logger) Progress {
+	if o.NewProgress != nil {
+		return overall.track(phase, o.NewProgress(phase))
+	}
+	return overall.track(phase, &progress{
+		progressType: phase + " progress",
+		logger:       log,
+	})
+}
+
+// overallProgress returns the overall progress of the phases of a side, nil
+// without OnProgress.
+func (o *BlockRsyncOptions) overallProgress(phases ...string) *overallProgress {
+	weights := o.ProgressWeights
+	if weights == nil {
+		weights = DefaultProgressWeights()
+	}
+	return newOverallProgress(weights, o.OnProgress, phases...)
+}
+
+// newHasher creates the hasher of a local file with NewHasher, or a
+// FileHasher that reports the progress of hashing as phase, audits its
+// operations and stops once stop is closed.
+func (o *BlockRsyncOptions) newHasher(readLimiter *transport.Limiter, phase string, overall *overallProgress, audit *auditor, stop <-chan struct{}, log logr.Logger) Hasher {
+	if o.NewHasher != nil {
+		return o.NewHasher(int64(o.BlockSize), log)
+	}
+	hasher := newFileHasher(int64(o.BlockSize), readLimiter, log)
+	hasher.audit = audit
+	hasher.limit, hasher.concurrency = o.hashLimit(log)
+	hasher.cpu = newCPUPacer(o.MaxCPU)
+	hasher.affinity = o.HashAffinity
+	hasher.algorithm = o.hashAlgorithm()
+	hasher.traceBlocks = o.TraceBlocks
+	hasher.excluded = o.ExcludeRanges.normalized()
+	hasher.zeroExcluded = o.ZeroExcluded
+	hasher.fillPatterns = o.FillPatterns
+	var hashProgress Progress
+	if o.NewProgress != nil {
+		hashProgress = o.NewProgress(phase)
+	}
+	hasher.progress = overall.track(phase, hashProgress)
+	hasher.stop = stop
+	return hasher
+}
+
+// DefaultBlockRsyncOptions returns the options the command line uses by
+// default.
+func DefaultBlockRsyncOptions() *BlockRsyncOptions {
+	opts := &BlockRsyncOptions{
+		CompressionChunkSize: MaxCompressionChunkSize,
+		FlushInterval:        DefaultFlushInterval,
+		Passes:               1,
+	}
+	opts.setDefaults()
+	return opts
+}
+
+// setDefaults sets the options that have no meaning when 0 to their defaults.
+func (o *BlockRsyncOptions) setDefaults() {
+	if o.BlockSize == 0 {
+		o.BlockSize = int(DefaultBlockSize)
+	}
+	if o.CompressionChunkSize == 0 {
+		o.CompressionChunkSize = MaxCompressionChunkSize
+	}
+	if o.Passes == 0 {
+		o.Passes = 1
+	}
+	if o.HashConcurrency == 0 {
+		o.HashConcurrency = DefaultHashConcurrency
+	}
+	if o.ReadAhead == 0 {
+		o.ReadAhead = DefaultReadAhead
+	}
+	if o.MaxReadSize == 0 {
+		o.MaxReadSize = DefaultMaxReadSize
+	}
+	if o.ConnectRetries == 0 {
+		o.ConnectRetries = DefaultConnectRetries
+	}
+	if o.RetryInterval == 0 {
+		o.RetryInterval = DefaultRetryInterval
+	}
+}
+
+// Validate returns an error if the options are invalid or conflict.
+func (o *BlockRsyncOptions) Validate() error {
+	switch {
+	case o.BlockSize <= 0 || o.BlockSize%4096 != 0:
+		return errors.New("block size must be > 0 and a multiple of 4096")
+	case o.CompressionChunkSize < 0 || o.CompressionChunkSize > MaxCompressionChunkSize:
+		return fmt.Errorf("compression chunk size must be > 0 and <= %d", MaxCompressionChunkSize)
+	case o.HashLength != 0 && (o.HashLength < codec.MinHashLength || o.HashLength > codec.HashLength):
+		return fmt.Errorf("hash length must be between %d and %d", codec.MinHashLength, codec.HashLength)
+	case o.FlushInterval < 0:
+		return errors.New("flush interval must be >= 0")
+	case o.Passes < 1:
+		return errors.New("passes must be >= 1")
+	case o.ConvergeBlocks < 0:
+		return errors.New("converge blocks must be >= 0")
+	case o.MaxDuration < 0 || o.MaxBytes < 0:
+		return errors.New("max duration and max bytes must be >= 0")
+	case o.ApplyWindow < 0:
+		return errors.New("apply window must be >= 0")
+	case o.ReadLimit < 0:
+		return errors.New("read limit must be >= 0")
+	case o.Generation < 0:
+		return errors.New("generation must be >= 0")
+	case o.MaxCPU < 0:
+		return errors.New("max cpu must be >= 0")
+	case o.HashConcurrency < 0 || o.ReadAhead < 0 || o.MaxReadSize < 0:
+		return errors.New("hash concurrency, read ahead and max read size must be >= 0")
+	case o.PipelineShardSize < 0:
+		return errors.New("pipeline shard size must be >= 0")
+	case o.PipelineShardSize > 0 && o.BloomFilter:
+		return errors.New("a pipelined sync cannot use a bloom filter")
+	case o.ShardSize < 0 || o.ShardSize%int64(o.BlockSize) != 0:
+		return errors.New("shard size must be >= 0 and a multiple of the block size")
+	case o.ShardSize > 0 && (o.iterative() || o.BloomFilter || o.PipelineShardSize > 0 || o.GenerationFile != ""):
+		return errors.New("a sharded sync cannot use passes, a bloom filter, a pipeline or a generation file")
+	case o.ShardSize > 0 && o.Compat == codec.CompatV0:
+		return fmt.Errorf("shards require protocol negotiation, they cannot be used with compat %s", codec.CompatV0)
+	case o.MaxSourceSize < 0 || o.MaxTargetGrowth < 0:
+		return errors.New("max source size and max target growth must be >= 0")
+	case o.ConnectRetries < 0 || o.RetryInterval < 0:
+		return errors.New("connect retries and retry interval must be >= 0")
+	case o.Compat != "" && o.Compat != codec.CompatV0:
+		return fmt.Errorf("compat must be %s", codec.CompatV0)
+	case o.iterative() && o.Compat == codec.CompatV0:
+		return fmt.Errorf("passes requires protocol negotiation, it cannot be used with compat %s", codec.CompatV0)
+	case o.hashAlgorithm() == HashSHA512 && o.Compat == codec.CompatV0:
+		return fmt.Errorf("SHA-512 hashes require protocol negotiation, they cannot be used with compat %s", codec.CompatV0)
+	case o.Seed != "" && len(o.SeedCandidates) > 0:
+		return errors.New("a seed and seed candidates cannot be used together")
+	case (o.Seed != "" || len(o.SeedCandidates) > 0) && (o.UndoJournal != "" || o.GenerationFile != "" || o.ShardStateFile != ""):
+		return errors.New("a seed cannot be used with an undo journal, a generation file or a shard state file")
+	case len(o.SeedCandidates) > 0 && (o.ShardSize > 0 || o.Compat == codec.CompatV0):
+		return fmt.Errorf("seed candidates need the hashes of the source, they cannot be used with shards or compat %s", codec.CompatV0)
+	case o.StreamTarget && (o.Seed != "" || len(o.SeedCandidates) > 0 || o.UndoJournal != "" || o.GenerationFile != "" || o.ShardSize > 0 || o.PreallocateTarget):
+		return errors.New("a streaming target cannot be used with a seed, an undo journal, a generation file, shards or preallocation")
+	case (o.HashesFrom != "" || o.HashesTo != "") && (o.Seed != "" || len(o.SeedCandidates) > 0 || o.ShardSize > 0 || o.StreamTarget):
+		return errors.New("a hash manifest cannot be used with a seed, shards or a streaming target")
+	case len(o.AlternateTargets) > 0 && o.Compat == codec.CompatV0:
+		return fmt.Errorf("alternate targets require protocol negotiation, they cannot be used with compat %s", codec.CompatV0)
+	case o.PreallocateTarget && o.HoleStrategy != HoleStrategyAuto && o.HoleStrategy != HoleStrategyZero:
+		return errors.New("preallocating the target requires the zero hole strategy")
+	case o.Resume && (o.iterative() || o.ShardSize > 0 || o.PipelineShardSize > 0 || o.StreamTarget || o.Seed != "" || len(o.SeedCandidates) > 0):
+		return errors.New("resuming cannot be used with passes, shards, a pipeline, a streaming target or a seed")
+	case o.Resume && (o.HashesFrom != "" || o.HashesTo != "" || o.GenerationFile != "" || o.UndoJournal != "" || o.ZeroExcluded || o.NewHasher != nil):
+		return errors.New("resuming skips blocks, it cannot be used with a hash manifest, a generation file, an undo journal, zeroing excluded ranges or a custom hasher")
+	case o.Resume && o.Compat == codec.CompatV0:
+		return fmt.Errorf("resuming requires protocol negotiation, it cannot be used with compat %s", codec.CompatV0)
+	case o.SourceDigest && (o.iterative() || o.ShardSize > 0 || o.StreamTarget || o.Resume || len(o.ExcludeRanges) > 0 || o.HashesFrom != "" || o.NewHasher != nil):
+		return errors.New("a source digest needs every block of the source hashed once, it cannot be used with passes, shards, a streaming target, resuming, excluded ranges, a hash manifest or a custom hasher")
+	case o.SourceDigest && o.Compat == codec.CompatV0:
+		return fmt.Errorf("a source digest requires protocol negotiation, it cannot be used with compat %s", codec.CompatV0)
+	case (o.ListenSocket != "" || o.ConnectSocket != "") && o.TLS.Enabled():
+		return errors.New("a unix socket is local to the host, it cannot be used with TLS")
+	case o.ConnectSocket != "" && len(o.AlternateTargets) > 0:
+		return errors.New("a unix socket cannot be used with alternate targets")
+	}
+	if _, err := ParseHoleStrategy(string(o.HoleStrategy)); err != nil {
+		return err
+	}
+	if _, err := ParseTailPolicy(string(o.TailPolicy)); err != nil {
+		return err
+	}
+	if _, err := ParseCompressionMode(string(o.Compression)); err != nil {
+		return err
+	}
+	switch o.HashAlgorithm {
+	case "", HashBLAKE2b, HashSHA512, HashAuto:
+	default:
+		return fmt.Errorf("invalid hash algorithm %q, must be auto, blake2b or sha512", o.HashAlgorithm)
+	}
+	if err := validateHashAffinity(o.HashAffinity); err != nil {
+		return fmt.Errorf("hash affinity must be %s or a CPU list: %w", HashAffinityDevice, err)
+	}
+	if err := o.FillPatterns.Validate(); err != nil {
+		return err
+	}
+	if err := o.TLS.Validate(); err != nil {
+		return err
+	}
+	for _, listener := range o.Listeners {
+		if err := listener.Validate(); err != nil {
+			return err
+		}
+	}
+	return o.Guard.Validate()
+}
+
+// WithBlockSize sets the block size, it must be a multiple of 4096.
+func (o *BlockRsyncOptions) WithBlockSize(blockSize int) *BlockRsyncOptions {
+	o.BlockSize = blockSize
+	return o
+}
+
+// WithTransport sets the transport connections are made with.
+func (o *BlockRsyncOptions) WithTransport(t transport.Transport) *BlockRsyncOptions {
+	o.Transport = t
+	return o
+}
+
+// WithPasses runs up to passes passes, until a pass has at most
+// convergeBlocks dirty blocks.
+func (o *BlockRsyncOptions) WithPasses(passes int, convergeBlocks int64) *BlockRsyncOptions {
+	o.Passes = passes
+	o.ConvergeBlocks = convergeBlocks
+	return o
+}
+
+// WithHoleStrategy sets how holes are applied to the target.
+func (o *BlockRsyncOptions) WithHoleStrategy(strategy HoleStrategy) *BlockRsyncOptions {
+	o.HoleStrategy = strategy
+	return o
+}
+
+// WithReadLimit limits the bytes per second read from the local file.
+func (o *BlockRsyncOptions) WithReadLimit(bytesPerSecond int64) *BlockRsyncOptions {
+	o.ReadLimit = bytesPerSecond
+	return o
+}
+
+// WithBudget stops the sync after maxDuration or maxBytes, and records the
+// remaining blocks in checkpointFile.
+func (o *BlockRsyncOptions) WithBudget(maxDuration time.Duration, maxBytes int64, checkpointFile string) *BlockRsyncOptions {
+	o.MaxDuration = maxDuration
+	o.MaxBytes = maxBytes
+	o.CheckpointFile = checkpointFile
+	return o
+}
+
+// WithConnectRetries sets how often the source tries to connect to the target.
+func (o *BlockRsyncOptions) WithConnectRetries(retries int, interval time.Duration) *BlockRsyncOptions {
+	o.ConnectRetries = retries
+	o.RetryInterval = interval
+	return o
+}
+
+// validated returns a copy of the options with the defaults set, or an error
+// if they are invalid.
+func (o *BlockRsyncOptions) validated() (*BlockRsyncOptions, error) {
+	opts := *o
+	opts.setDefaults()
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+func (o *BlockRsyncOptions) hashConcurrency() int {
+	concurrency := o.HashConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultHashConcurrency
+	}
+	if o.MaxCPU > 0 {
+		concurrency = min(concurrency, int(math.Ceil(o.MaxCPU)))
+	}
+	return concurrency
+}
+
+func (o *BlockRsyncOptions) readAhead() int {
+	if o.ReadAhead <= 0 {
+		return DefaultReadAhead
+	}
+	return o.ReadAhead
+}
+
+// maxCoalescedBlocks returns how many contiguous blocks are read at once.
+func (o *BlockRsyncOptions) maxCoalescedBlocks(blockSize int64) int {
+	maxReadSize := int64(o.MaxReadSize)
+	if maxReadSize <= 0 {
+		maxReadSize = DefaultMaxReadSize
+	}
+	return int(max(1, maxReadSize/blockSize))
+}
+
+func (o *BlockRsyncOptions) connectRetries() (int, time.Duration) {
+	retries, interval := o.ConnectRetries, o.RetryInterval
+	if retries <= 0 {
+		retries = DefaultConnectRetries
+	}
+	if interval <= 0 {
+		interval = DefaultRetryInterval
+	}
+	return retries, interval
+}
+
+// Option customizes a client or server created with NewClient or NewServer.
+type Option func(*constructorConfig)
+
+type constructorConfig struct {
+	opts               BlockRsyncOptions
+	log                logr.Logger
+	targetAddress      string
+	port               int
+	hasher             Hasher
+	connectionProvider ConnectionProvider
+}
+
+// WithOptions starts from a copy of opts instead of DefaultBlockRsyncOptions,
+// it should be the first option.
+func WithOptions(opts *BlockRsyncOptions) Option {
+	return func(c *constructorConfig) {
+		c.opts = *opts
+	}
+}
+
+// WithLogger sets the logger, by default nothing is logged.
+func WithLogger(log logr.Logger) Option {
+	return func(c *constructorConfig) {
+		c.log = log
+	}
+}
+
+// WithTarget sets the address and port the client connects to, or the port
+// the server listens on. The default is localhost:8000.
+func WithTarget(address string, port int) Option {
+	return func(c *constructorConfig) {
+		c.targetAddress = address
+		c.port = port
+	}
+}
+
+// WithTransport sets the transport connections are made with.
+func WithTransport(t transport.Transport) Option {
+	return func(c *constructorConfig) {
+		c.opts.Transport = t
+	}
+}
+
+// WithConnectionProvider replaces how the client connects to the target, the
+// target address and transport are not used.
+func WithConnectionProvider(provider ConnectionProvider) Option {
+	return func(c *constructorConfig) {
+		c.connectionProvider = provider
+	}
+}
+
+// WithHasher replaces the hasher of the local file, its block size is used.
+// Later passes of an iterative sync hash the source with NewHasher of the
+// options, or a FileHasher.
+func WithHasher(hasher Hasher) Option {
+	return func(c *constructorConfig) {
+		c.hasher = hasher
+	}
+}
+
+// WithProgress reports the progress of every phase to p.
+func WithProgress(p Progress) Option {
+	return func(c *constructorConfig) {
+		c.opts.NewProgress = func(string) Progress {
+			return p
+		}
+	}
+}
+
+// WithHooks sets the hooks called at the stages of the sync.
+func WithHooks(hooks Hooks) Option {
+	return func(c *constructorConfig) {
+		c.opts.Hooks = hooks
+	}
+}
+
+// WithOverallProgress reports the overall percentage of the sync to report,
+// the phases count by weights, DefaultProgressWeights when nil.
+func WithOverallProgress(weights ProgressWeights, report func(percent float64)) Option {
+	return func(c *constructorConfig) {
+		c.opts.ProgressWeights = weights
+		c.opts.OnProgress = report
+	}
+}
+
+// WithBlockSize sets the block size, it must be a multiple of 4096.
+func WithBlockSize(blockSize int) Option {
+	return func(c *constructorConfig) {
+		c.opts.BlockSize = blockSize
+	}
+}
+
+func newConstructorConfig(options []Option) (*constructorConfig, *BlockRsyncOptions, error) {
+	c := &constructorConfig{
+		opts:          *DefaultBlockRsyncOptions(),
+		log:           logr.Discard(),
+		targetAddress: "localhost",
+		port:          8000,
+	}
+	for _, option := range options {
+		option(c)
+	}
+	if c.hasher != nil {
+		c.opts.BlockSize = int(c.hasher.BlockSize())
+	}
+	opts, err := c.opts.validated()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, opts, nil
+}
+
+// NewClient creates a client that syncs sourceFile to the target, customized
+// by the options.
+func NewClient(sourceFile string, options ...Option) (*BlockrsyncClient, error) {
+	c, opts, err := newConstructorConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	client := NewBlockrsyncClient(sourceFile, c.targetAddress, c.port, opts, c.log)
+	if c.hasher != nil {
+		client.hasher = c.hasher
+	}
+	if c.connectionProvider != nil {
+		client.connectionProvider = c.connectionProvider
+	}
+	return client, nil
+}
+
+// NewServer creates a server that syncs targetFile from a client, customized
+// by the options.
+func NewServer(targetFile string, options ...Option) (*BlockrsyncServer, error) {
+	c, opts, err := newConstructorConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	server := NewBlockrsyncServer(targetFile, c.port, opts, c.log)
+	if c.hasher != nil {
+		server.hasher = c.hasher
+	}
+	return server, nil
+}
@@ -0,0 +1,169 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var _ = Describe("options tests", func() {
+	It("should return valid default options", func() {
+		opts := DefaultBlockRsyncOptions()
+		Expect(opts.Validate()).To(Succeed())
+		Expect(opts.BlockSize).To(Equal(int(DefaultBlockSize)))
+		Expect(opts.HashConcurrency).To(Equal(DefaultHashConcurrency))
+		Expect(opts.ConnectRetries).To(Equal(DefaultConnectRetries))
+	})
+
+	DescribeTable("should reject invalid options", func(update func(*BlockRsyncOptions), message string) {
+		opts := DefaultBlockRsyncOptions()
+		update(opts)
+		Expect(opts.Validate()).To(MatchError(ContainSubstring(message)))
+	},
+		Entry("block size", func(o *BlockRsyncOptions) { o.BlockSize = 1000 }, "block size"),
+		Entry("compression chunk size", func(o *BlockRsyncOptions) { o.CompressionChunkSize = MaxCompressionChunkSize + 1 }, "compression chunk size"),
+		Entry("hash length", func(o *BlockRsyncOptions) { o.HashLength = 8 }, "hash length"),
+		Entry("read limit", func(o *BlockRsyncOptions) { o.ReadLimit = -1 }, "read limit"),
+		Entry("hash concurrency", func(o *BlockRsyncOptions) { o.HashConcurrency = -1 }, "hash concurrency"),
+		Entry("max cpu", func(o *BlockRsyncOptions) { o.MaxCPU = -1 }, "max cpu"),
+		Entry("hash affinity", func(o *BlockRsyncOptions) { o.HashAffinity = "numa" }, "hash affinity"),
+		Entry("hash algorithm", func(o *BlockRsyncOptions) { o.HashAlgorithm = "md5" }, "hash algorithm"),
+		Entry("compat", func(o *BlockRsyncOptions) { o.Compat = "v9" }, "compat"),
+		Entry("no passes", func(o *BlockRsyncOptions) { o.Passes = 0 }, "passes must be >= 1"),
+		Entry("negative passes", func(o *BlockRsyncOptions) { o.Passes = -1 }, "passes must be >= 1"),
+		Entry("passes with compat", func(o *BlockRsyncOptions) { o.WithPasses(3, 0).Compat = codec.CompatV0 }, "protocol negotiation"),
+		Entry("pipeline shard size", func(o *BlockRsyncOptions) { o.PipelineShardSize = -1 }, "pipeline shard size"),
+		Entry("pipeline with bloom filter", func(o *BlockRsyncOptions) {
+			o.PipelineShardSize = 1 << 20
+			o.BloomFilter = true
+		}, "bloom filter"),
+		Entry("shard size", func(o *BlockRsyncOptions) { o.ShardSize = 4096 }, "shard size"),
+		Entry("shards with passes", func(o *BlockRsyncOptions) { o.WithPasses(2, 0).ShardSize = 1 << 30 }, "sharded sync"),
+		Entry("max target growth", func(o *BlockRsyncOptions) { o.MaxTargetGrowth = -1 }, "max target growth"),
+		Entry("seed with undo journal", func(o *BlockRsyncOptions) { o.Seed, o.UndoJournal = "seed.raw", "target.journal" }, "seed"),
+		Entry("seed candidates with shards", func(o *BlockRsyncOptions) {
+			o.SeedCandidates, o.ShardSize = []string{"seed.raw"}, 1<<30
+		}, "seed candidates"),
+		Entry("hole strategy", func(o *BlockRsyncOptions) { o.HoleStrategy = "trim" }, "trim"),
+		Entry("preallocate with punch", func(o *BlockRsyncOptions) {
+			o.WithHoleStrategy(HoleStrategyPunch).PreallocateTarget = true
+		}, "zero hole strategy"),
+		Entry("stream target with undo journal", func(o *BlockRsyncOptions) {
+			o.StreamTarget, o.UndoJournal = true, "target.journal"
+		}, "streaming target"),
+		Entry("resume with passes", func(o *BlockRsyncOptions) { o.WithPasses(2, 0).Resume = true }, "resuming"),
+		Entry("resume with zero excluded", func(o *BlockRsyncOptions) { o.Resume, o.ZeroExcluded = true, true }, "resuming"),
+		Entry("source digest with passes", func(o *BlockRsyncOptions) { o.WithPasses(2, 0).SourceDigest = true }, "source digest"),
+		Entry("source digest with compat", func(o *BlockRsyncOptions) { o.SourceDigest, o.Compat = true, codec.CompatV0 }, "protocol negotiation"),
+		Entry("unix socket with TLS", func(o *BlockRsyncOptions) {
+			o.ListenSocket, o.TLS.CertFile = "blockrsync.sock", "tls.crt"
+		}, "unix socket"),
+		Entry("unix socket with alternate targets", func(o *BlockRsyncOptions) {
+			o.ConnectSocket, o.AlternateTargets = "blockrsync.sock", []string{"10.0.0.1:8000"}
+		}, "unix socket"),
+		Entry("fill pattern of 3 bytes", func(o *BlockRsyncOptions) { o.FillPatterns = FillPatterns{{1, 2, 3}} }, "fill pattern"),
+	)
+
+	It("should set the defaults on a copy of the options", func() {
+		opts := (&BlockRsyncOptions{}).WithConnectRetries(3, 10*time.Millisecond).WithReadLimit(1 << 20)
+		client, err := NewBlockrsyncClientWithOptions("source", "localhost", 8000, opts, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(opts.BlockSize).To(BeZero())
+		Expect(client.opts.BlockSize).To(Equal(int(DefaultBlockSize)))
+		Expect(client.opts.ReadLimit).To(Equal(int64(1 << 20)))
+		Expect(client.opts.Passes).To(Equal(1))
+		provider := client.connectionProvider.(*NetworkConnectionProvider)
+		Expect(provider.retries).To(Equal(3))
+		Expect(provider.retryInterval).To(Equal(10 * time.Millisecond))
+	})
+
+	It("should fail to create a client or server with invalid options", func() {
+		_, err := NewBlockrsyncClientWithOptions("source", "localhost", 8000, (&BlockRsyncOptions{}).WithBlockSize(100), GinkgoLogr)
+		Expect(err).To(HaveOccurred())
+		_, err = NewBlockrsyncServerWithOptions("target", 8000, (&BlockRsyncOptions{}).WithBlockSize(100), GinkgoLogr)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should read contiguous blocks up to the max read size", func() {
+		opts := DefaultBlockRsyncOptions()
+		Expect(opts.maxCoalescedBlocks(65536)).To(Equal(64))
+		opts.MaxReadSize = 4096
+		Expect(opts.maxCoalescedBlocks(65536)).To(Equal(1))
+	})
+
+	It("should sync with a client and server created with functional options", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		data := make([]byte, 16*4096)
+		_, _ = rand.Read(data[:8*4096])
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+
+		provider := &countingProvider{address: net.JoinHostPort("localhost", strconv.Itoa(port))}
+		progress := &recordingProgress{}
+		client, err := NewClient(sourceFile, WithBlockSize(4096), WithConnectionProvider(provider), WithProgress(progress), WithLogger(GinkgoLogr.WithName("client")))
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(provider.connects).To(Equal(1))
+		Expect(progress.starts).To(ContainElement(int64(len(data))))
+		Expect(progress.last).To(Equal(progress.starts[len(progress.starts)-1]))
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+	})
+
+	It("should use the block size of a custom hasher", func() {
+		client, err := NewClient("source", WithHasher(NewFileHasher(8192, GinkgoLogr)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.opts.BlockSize).To(Equal(8192))
+		_, err = NewServer("target", WithBlockSize(100))
+		Expect(err).To(MatchError(ContainSubstring("block size")))
+	})
+})
+
+type countingProvider struct {
+	address  string
+	connects int
+}
+
+func (c *countingProvider) Connect() (io.ReadWriteCloser, error) {
+	c.connects++
+	var conn net.Conn
+	var err error
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial("tcp", c.address); err == nil {
+			return conn, nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil, err
+}
+
+type recordingProgress struct {
+	starts []int64
+	last   int64
+}
+
+func (r *recordingProgress) Start(size int64) {
+	r.starts = append(r.starts, size)
+}
+
+func (r *recordingProgress) Update(pos int64) {
+	r.last = pos
+}
@@ -0,0 +1,100 @@
+package blockrsync
+
+import (
+	"slices"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+type pendingRecord struct {
+	offset int64
+	hole   bool
+	data   []byte
+}
+
+// orderedApplier buffers a window of received records and applies them in
+// ascending offset order, merging adjacent blocks into a single write. This
+// avoids seeking back and forth on rotational or seek-sensitive targets.
+type orderedApplier struct {
+	window int
+	// limit tunes the window when adaptive
+	limit      *adaptiveLimit
+	pending    []pendingRecord
+	applyHole  func(offset int64) error
+	applyBlock func(data []byte, offset int64) error
+	log        logr.Logger
+}
+
+func newOrderedApplier(window int, applyHole func(int64) error, applyBlock func([]byte, int64) error, log logr.Logger) *orderedApplier {
+	return &orderedApplier{
+		window:     window,
+		pending:    make([]pendingRecord, 0, window),
+		applyHole:  applyHole,
+		applyBlock: applyBlock,
+		log:        log,
+	}
+}
+
+// add queues a record, the data is copied since the block reader reuses its
+// buffer.
+func (o *orderedApplier) add(offset int64, hole bool, data []byte) error {
+	record := pendingRecord{offset: offset, hole: hole}
+	if !hole {
+		record.data = slices.Clone(data)
+	}
+	o.pending = append(o.pending, record)
+	if len(o.pending) >= o.windowSize() {
+		return o.flush()
+	}
+	return nil
+}
+
+// windowSize returns the number of records applied at once.
+func (o *orderedApplier) windowSize() int {
+	if o.limit != nil {
+		return o.limit.value()
+	}
+	return o.window
+}
+
+func (o *orderedApplier) flush() error {
+	if len(o.pending) == 0 {
+		return nil
+	}
+	t := time.Now()
+	var bytes int64
+	defer func() {
+		o.limit.observe(bytes, time.Since(t))
+	}()
+	slices.SortStableFunc(o.pending, func(a, b pendingRecord) int {
+		if a.offset < b.offset {
+			return -1
+		} else if a.offset > b.offset {
+			return 1
+		}
+		return 0
+	})
+	o.log.V(5).Info("Applying window", "records", len(o.pending))
+	for i := 0; i < len(o.pending); {
+		record := o.pending[i]
+		i++
+		if record.hole {
+			if err := o.applyHole(record.offset); err != nil {
+				return err
+			}
+			continue
+		}
+		data := record.data
+		for i < len(o.pending) && !o.pending[i].hole && o.pending[i].offset == record.offset+int64(len(data)) {
+			data = append(data, o.pending[i].data...)
+			i++
+		}
+		if err := o.applyBlock(data, record.offset); err != nil {
+			return err
+		}
+		bytes += int64(len(data))
+	}
+	o.pending = o.pending[:0]
+	return nil
+}
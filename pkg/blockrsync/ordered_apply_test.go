@@ -0,0 +1,51 @@
+package blockrsync
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ordered apply tests", func() {
+	type write struct {
+		offset int64
+		data   []byte
+	}
+	var (
+		holes  []int64
+		writes []write
+	)
+
+	newApplier := func(window int) *orderedApplier {
+		holes = nil
+		writes = nil
+		return newOrderedApplier(window, func(offset int64) error {
+			holes = append(holes, offset)
+			return nil
+		}, func(data []byte, offset int64) error {
+			writes = append(writes, write{offset: offset, data: data})
+			return nil
+		}, GinkgoLogr)
+	}
+
+	It("should apply blocks in offset order and merge adjacent blocks", func() {
+		applier := newApplier(4)
+		buf := []byte{3, 3}
+		Expect(applier.add(4, false, buf)).To(Succeed())
+		// The applier must copy the data, the block reader reuses its buffer
+		buf[0], buf[1] = 1, 1
+		Expect(applier.add(0, false, buf)).To(Succeed())
+		Expect(applier.add(8, true, nil)).To(Succeed())
+		Expect(writes).To(BeEmpty())
+		Expect(applier.add(2, false, []byte{2, 2})).To(Succeed())
+		Expect(writes).To(Equal([]write{{offset: 0, data: []byte{1, 1, 2, 2, 3, 3}}}))
+		Expect(holes).To(Equal([]int64{8}))
+	})
+
+	It("should flush a partial window", func() {
+		applier := newApplier(10)
+		Expect(applier.add(8, false, []byte{1})).To(Succeed())
+		Expect(applier.add(0, false, []byte{2})).To(Succeed())
+		Expect(applier.flush()).To(Succeed())
+		Expect(writes).To(Equal([]write{{offset: 0, data: []byte{2}}, {offset: 8, data: []byte{1}}}))
+	})
+})
@@ -0,0 +1,184 @@
+package blockrsync
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"time"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var (
+	ErrStreamChecksumMismatch = errors.New("stream checksum mismatch")
+)
+
+// PassReport describes a completed pass of an iterative sync.
+type PassReport struct {
+	Pass                 int   `json:"pass"`
+	DirtyBlocks          int64 `json:"dirtyBlocks"`
+	BytesTransferred     int64 `json:"bytesTransferred"`
+	DurationMilliseconds int64 `json:"durationMilliseconds"`
+}
+
+// PassCallback is called after every pass of an iterative sync, it returns
+// true to run another pass.
+type PassCallback func(report PassReport) bool
+
+func (o *BlockRsyncOptions) iterative() bool {
+	return o.Passes > 1 || o.Cutover != nil
+}
+
+func (b *BlockrsyncClient) continuePasses(report PassReport) bool {
+	if report.Pass >= max(b.opts.Passes, 1) {
+		return false
+	}
+	if b.opts.OnPass != nil {
+		return b.opts.OnPass(report)
+	}
+	return report.DirtyBlocks > b.opts.ConvergeBlocks
+}
+
+// runPasses ends the first pass, then syncs the blocks that changed since the
+// previous pass until the passes converge. With a cutover barrier one more
+// pass runs once the barrier is released.
+func (b *BlockrsyncClient) runPasses(f io.ReaderAt, encoder *codec.Encoder, writer *compressedWriter, acks *codec.Decoder, start time.Time, dirty int64) error {
+	report, err := b.endPass(1, start, 0, dirty, encoder, writer, acks)
+	if err != nil {
+		return err
+	}
+	for b.continuePasses(report) {
+		if report, err = b.runPass(report.Pass+1, f, encoder, writer, acks); err != nil {
+			return err
+		}
+	}
+	if b.opts.Cutover == nil {
+		return nil
+	}
+	if err := b.opts.Cutover.Wait(b.ctx); err != nil {
+		if b.ctx.Err() != nil {
+			return ErrCancelled
+		}
+		return err
+	}
+	report, err = b.runPass(report.Pass+1, f, encoder, writer, acks)
+	b.opts.Cutover.Done(report, err)
+	return err
+}
+
+func (b *BlockrsyncClient) runPass(pass int, f io.ReaderAt, encoder *codec.Encoder, writer *compressedWriter, acks *codec.Decoder) (PassReport, error) {
+	start := time.Now()
+	var bytesBefore int64
+	b.stats.Update(func(s *Stats) { bytesBefore = s.BytesTransferred })
+	diff, size, err := b.nextPassDiff(pass)
+	if err != nil {
+		return PassReport{}, err
+	}
+	if size != b.sourceSize {
+		b.log.Info("Source size changed", "from", b.sourceSize, "to", size)
+		if err := encoder.WriteResize(size); err != nil {
+			return PassReport{}, err
+		}
+		b.sourceSize = size
+		b.stats.Update(func(s *Stats) { s.SourceSize = size })
+	}
+	offsets, err := b.reportDiff(pass, diff)
+	if err != nil {
+		return PassReport{}, err
+	}
+	b.log.Info("Starting pass", "pass", pass, "dirty blocks", len(diff))
+	if err := b.sendBlocks(encoder, offsets, f, b.opts.progress(fmt.Sprintf("pass %d sync", pass), b.overall, b.log)); err != nil {
+		return PassReport{}, err
+	}
+	return b.endPass(pass, start, bytesBefore, int64(len(diff)), encoder, writer, acks)
+}
+
+// endPass waits for the server to acknowledge the pass is on disk.
+func (b *BlockrsyncClient) endPass(pass int, start time.Time, bytesBefore, dirty int64, encoder *codec.Encoder, writer *compressedWriter, acks *codec.Decoder) (PassReport, error) {
+	if err := b.waitPassAck(int64(pass), encoder, writer, acks); err != nil {
+		return PassReport{}, err
+	}
+	report := PassReport{
+		Pass:                 pass,
+		DirtyBlocks:          dirty,
+		DurationMilliseconds: time.Since(start).Milliseconds(),
+	}
+	b.stats.Update(func(s *Stats) {
+		report.BytesTransferred = s.BytesTransferred - bytesBefore
+		s.Passes = append(s.Passes, report)
+	})
+	if err := b.writeBitmap(); err != nil {
+		return PassReport{}, err
+	}
+	b.log.Info("Pass complete", "pass", pass, "dirty blocks", report.DirtyBlocks, "bytes", report.BytesTransferred, "milliseconds", report.DurationMilliseconds)
+	return report, nil
+}
+
+// waitPassAck ends a pass of the record stream and waits for the server to
+// acknowledge it.
+func (b *BlockrsyncClient) waitPassAck(pass int64, encoder *codec.Encoder, writer *compressedWriter, acks *codec.Decoder) error {
+	if err := encoder.WritePassEnd(pass); err != nil {
+		return err
+	}
+	digests := b.protocol.Features.Has(codec.FeatureSourceDigest)
+	if digests {
+		if err := encoder.WriteDigest(b.sourceDigest()); err != nil {
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	ack, checksum, err := acks.ReadPassAck()
+	if err != nil {
+		return err
+	}
+	if ack != pass {
+		return fmt.Errorf("server acknowledged pass %d, expected %d", ack, pass)
+	}
+	if b.protocol.Features.Has(codec.FeatureStreamChecksum) && checksum != encoder.PassChecksum() {
+		return fmt.Errorf("%w in pass %d, sent %08x, server received %08x", ErrStreamChecksumMismatch, pass, encoder.PassChecksum(), checksum)
+	}
+	if !digests {
+		return nil
+	}
+	target, err := acks.ReadDigest()
+	if err != nil {
+		return err
+	}
+	if len(target) > 0 {
+		b.log.Info("Target computed its digest", "digest", hex.EncodeToString(target))
+	}
+	return compareDigests(b.sourceDigest(), target, b.stats)
+}
+
+// nextPassDiff hashes the source again and compares it with what the target
+// holds after the previous pass, it also returns the current size of the
+// source.
+func (b *BlockrsyncClient) nextPassDiff(pass int) ([]BlockDiff, int64, error) {
+	target := maps.Clone(b.hasher.GetHashes())
+	maps.Copy(target, b.sentHashes)
+	b.sentHashes = make(map[int64][]byte)
+
+	if err := b.opts.Hooks.preHash(b.sourceFile); err != nil {
+		return nil, 0, err
+	}
+	hasher := b.opts.newHasher(b.readLimiter, fmt.Sprintf("pass %d %s", pass, ProgressHashSource), b.overall, b.audit, b.ctx.Done(), b.log.WithName("hasher"))
+	stopPhase := b.stats.StartPhase(PhaseHashSource, b.log)
+	size, err := hasher.HashFile(b.sourceFile)
+	stopPhase()
+	if err != nil {
+		return nil, 0, err
+	}
+	if size != b.sourceSize && !b.protocol.Features.Has(codec.FeatureResize) {
+		return nil, 0, fmt.Errorf("source size changed from %d to %d between passes, the target does not support resizing", b.sourceSize, size)
+	}
+	b.hasher = hasher
+	stopPhase = b.stats.StartPhase(PhaseDiff, b.log)
+	defer stopPhase()
+	defer enterStage("", StageDiff)()
+	diff, err := hasher.DiffHashes(hasher.BlockSize(), target)
+	return diff, size, err
+}
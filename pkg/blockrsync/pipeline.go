@@ -0,0 +1,151 @@
+package blockrsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// pipelineHasher returns the hasher of the source if the first pass is
+// pipelined, the source is then hashed while the blocks are diffed and sent.
+func (b *BlockrsyncClient) pipelineHasher() *FileHasher {
+	if b.opts.PipelineShardSize <= 0 || b.opts.BloomFilter {
+		return nil
+	}
+	hasher, ok := b.hasher.(*FileHasher)
+	if !ok || hasher.precomputed {
+		return nil
+	}
+	return hasher
+}
+
+// hashInBackground hashes the source until it is hashed or stop is closed. It
+// returns the size of the source once known, and the channel the result of
+// the hashing is sent on.
+func (b *BlockrsyncClient) hashInBackground(hasher *FileHasher, stop <-chan struct{}) (int64, <-chan error, error) {
+	hasher.stop = stop
+	hashed := make(chan error, 1)
+	go func() {
+		stopPhase := b.stats.StartPhase(PhaseHashSource, b.log)
+		_, err := hasher.HashFile(b.sourceFile)
+		stopPhase()
+		hashed <- err
+	}()
+	size, ok := hasher.waitSize()
+	if !ok {
+		return 0, nil, <-hashed
+	}
+	return size, hashed, nil
+}
+
+// diffShards compares the hashes of the target as they arrive with the hashes
+// of the source as they are computed, both in offset order, and sends the
+// blocks that differ a shard at a time. The channel is closed after the last
+// shard or an error.
+func (b *BlockrsyncClient) diffShards(decoder *codec.Decoder, hasher *FileHasher, shards chan<- diffResult, stop <-chan struct{}) {
+	defer close(shards)
+	// send returns false once the sync stopped
+	send := func(shard diffResult) bool {
+		select {
+		case shards <- shard:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	defer enterStage("", StageDiff)()
+	stopPhase := b.stats.StartPhase(PhaseDiff, b.log)
+	defer stopPhase()
+	blockSize, count, err := decoder.ReadHashHeader()
+	if err != nil {
+		send(diffResult{err: err})
+		return
+	}
+	if blockSize != hasher.BlockSize() {
+		send(diffResult{err: fmt.Errorf("block size mismatch, source %d, target %d", hasher.BlockSize(), blockSize)})
+		return
+	}
+	size := b.sourceSize
+	shardSize := max(b.opts.PipelineShardSize/blockSize, 1) * blockSize
+	var diff []BlockDiff
+	var next int64
+	shardEnd := shardSize
+	// compare diffs the source block at next, a nil hash is missing from the
+	// target. It returns false once the sync stopped
+	compare := func(targetHash []byte) bool {
+		hash, ok := hasher.waitHash(next)
+		if targetHash == nil {
+			diff = append(diff, BlockDiff{Offset: next, Reason: DiffMissing, NewHash: hash})
+		} else if !ok || !bytes.Equal(hash[:min(len(hash), len(targetHash))], targetHash) {
+			diff = append(diff, BlockDiff{Offset: next, Reason: DiffMismatch, OldHash: targetHash, NewHash: hash})
+		}
+		next += blockSize
+		if next < shardEnd && next < size {
+			return true
+		}
+		shard := diffResult{diff: diff, end: min(next, size)}
+		diff = nil
+		shardEnd += shardSize
+		return send(shard)
+	}
+	for i := int64(0); i < count; i++ {
+		offset, hash, err := decoder.ReadHash()
+		if err != nil {
+			send(diffResult{err: err})
+			return
+		}
+		if offset < next || offset%blockSize != 0 {
+			send(diffResult{err: fmt.Errorf("invalid offset %d, the hashes of a pipelined sync must be in offset order", offset)})
+			return
+		}
+		for next < offset && next < size {
+			if !compare(nil) {
+				return
+			}
+		}
+		if offset < size && !compare(hash) {
+			return
+		}
+	}
+	for next < size {
+		if !compare(nil) {
+			return
+		}
+	}
+}
+
+// sendShards sends the blocks of every shard as it is diffed, and returns the
+// number of blocks that differ.
+func (b *BlockrsyncClient) sendShards(encoder *codec.Encoder, shards <-chan diffResult, f io.ReaderAt) (int64, error) {
+	syncProgress := b.opts.progress(ProgressSync, b.overall, b.log)
+	syncProgress.Start(b.sourceSize)
+	var dirty int64
+	for {
+		var shard diffResult
+		var ok bool
+		select {
+		case shard, ok = <-shards:
+		case <-b.ctx.Done():
+			return dirty, ErrCancelled
+		}
+		if !ok {
+			break
+		}
+		if shard.err != nil {
+			return dirty, shard.err
+		}
+		offsets, err := b.reportDiff(1, shard.diff)
+		if err != nil {
+			return dirty, err
+		}
+		if err := b.sendBlocks(encoder, offsets, f, nil); err != nil {
+			return dirty, err
+		}
+		dirty += int64(len(offsets))
+		syncProgress.Update(shard.end)
+	}
+	b.stats.Update(func(s *Stats) { s.DifferentBlocks = dirty })
+	return dirty, nil
+}
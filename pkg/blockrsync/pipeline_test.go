@@ -0,0 +1,93 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"slices"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pipeline tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 64*4096)
+		_, _ = rand.Read(source[:40*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	sync := func(passes int, postDiff func(pass int, offsets []int64) error) (*Stats, error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithHooks(Hooks{PostDiff: postDiff}), WithLogger(GinkgoLogr.WithName("client")),
+			func(c *constructorConfig) {
+				c.opts.PipelineShardSize = 8 * 4096
+				c.opts.HashConcurrency = 3
+				c.opts.WithPasses(passes, 0)
+			})
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return client.Stats(), clientErr, <-serverDone
+	}
+
+	DescribeTable("should diff and send the source a shard at a time", func(targetSize int, dirty []int64) {
+		target := make([]byte, targetSize)
+		copy(target, source)
+		for _, offset := range dirty {
+			_, _ = rand.Read(target[offset : offset+4096])
+		}
+		// The blocks missing from the target differ too
+		for offset := int64(targetSize); offset < int64(len(source)); offset += 4096 {
+			dirty = append(dirty, offset)
+		}
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		var shards int
+		var diff []int64
+		stats, clientErr, serverErr := sync(1, func(pass int, offsets []int64) error {
+			Expect(pass).To(Equal(1))
+			shards++
+			diff = append(diff, offsets...)
+			return nil
+		})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(shards).To(Equal(8))
+		slices.Sort(diff)
+		Expect(diff).To(Equal(dirty))
+		Expect(stats.DifferentBlocks).To(Equal(int64(len(dirty))))
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	},
+		Entry("same size", 64*4096, []int64{0, 9 * 4096, 10 * 4096, 39 * 4096, 50 * 4096, 63 * 4096}),
+		Entry("smaller target", 20*4096, []int64{5 * 4096}),
+		Entry("larger target", 80*4096, []int64{4096, 60 * 4096}),
+	)
+
+	It("should run the passes of a pipelined iterative sync", func() {
+		target := bytes.Clone(source)
+		_, _ = rand.Read(target[12*4096 : 14*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		stats, clientErr, serverErr := sync(3, nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(stats.DifferentBlocks).To(Equal(int64(2)))
+		Expect(stats.Passes).ToNot(BeEmpty())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+})
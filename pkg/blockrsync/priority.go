@@ -0,0 +1,74 @@
+package blockrsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// BlockPriorities are hints of how often blocks change, keyed by block
+// offset. Blocks with a higher priority are sent last in each pass, so the
+// hottest regions are the ones left dirty for the final pass.
+type BlockPriorities map[int64]int
+
+// LoadBlockPriorities reads a priority file of lines with a byte offset, a
+// length and an optional weight, for instance extracted from blktrace. Every
+// block overlapping a range gets the weight added, empty lines and lines
+// starting with # are ignored.
+func LoadBlockPriorities(r io.Reader, blockSize int64) (BlockPriorities, error) {
+	res := make(BlockPriorities)
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: expected offset, length and optional weight", lineNumber)
+		}
+		values := []int64{0, 0, 1}
+		for i, field := range fields {
+			value, err := strconv.ParseInt(field, 0, 64)
+			if err != nil || value < 0 {
+				return nil, fmt.Errorf("line %d: invalid value %q", lineNumber, field)
+			}
+			values[i] = value
+		}
+		offset, length, weight := values[0], values[1], int(values[2])
+		for block := offset - offset%blockSize; block < offset+length; block += blockSize {
+			res[block] += weight
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func LoadBlockPrioritiesFile(fileName string, blockSize int64) (BlockPriorities, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadBlockPriorities(f, blockSize)
+}
+
+// sort orders sorted offsets by ascending priority, keeping the offset order
+// for blocks of the same priority so contiguous blocks are still read
+// together.
+func (p BlockPriorities) sort(offsets []int64) {
+	if len(p) == 0 {
+		return
+	}
+	slices.SortStableFunc(offsets, func(a, b int64) int {
+		return p[a] - p[b]
+	})
+}
@@ -0,0 +1,29 @@
+package blockrsync
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("block priority tests", func() {
+	It("should load the weights of the blocks overlapping each range", func() {
+		priorities, err := LoadBlockPriorities(strings.NewReader("# hot regions\n4096 4096\n\n6000 5000 3\n"), 4096)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(priorities).To(Equal(BlockPriorities{4096: 4, 8192: 3}))
+	})
+
+	It("should reject invalid lines", func() {
+		_, err := LoadBlockPriorities(strings.NewReader("4096\n"), 4096)
+		Expect(err).To(MatchError(ContainSubstring("line 1")))
+		_, err = LoadBlockPriorities(strings.NewReader("4096 -1\n"), 4096)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should send the hottest blocks last", func() {
+		offsets := []int64{0, 4096, 8192, 12288}
+		BlockPriorities{4096: 5, 12288: 1}.sort(offsets)
+		Expect(offsets).To(Equal([]int64{0, 8192, 12288, 4096}))
+	})
+})
@@ -0,0 +1,107 @@
+package blockrsync
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// standardMSS is the segment payload of a 1500 byte MTU path with TCP
+	// timestamps, a path with smaller segments goes through a tunnel, like
+	// an overlay network or a VPN
+	standardMSS = 1448
+	// tunnelRecordSegments is the most segments of a record on a tunnel, so
+	// a lost segment holds back less data
+	tunnelRecordSegments = 16
+)
+
+// PathProbe are the characteristics of the path to the peer measured when
+// the session starts, and the record size chosen for it.
+type PathProbe struct {
+	// MSS is the payload of a TCP segment, and PathMTU the MTU found by path
+	// MTU discovery
+	MSS     int `json:"mss"`
+	PathMTU int `json:"pathMTU"`
+	// RTTMicroseconds is the smoothed round trip time of the handshake
+	RTTMicroseconds int64 `json:"rttMicroseconds"`
+	// RecordSize is the size of the writes to the connection, and of the
+	// compressed chunks
+	RecordSize int `json:"recordSize"`
+}
+
+// probePath reads the characteristics of the path of a TCP connection, or a
+// connection wrapping one. It returns false if the connection isn't TCP.
+func probePath(conn io.Writer) (PathProbe, bool) {
+	netConn, ok := conn.(net.Conn)
+	for ok {
+		if _, isTCP := netConn.(*net.TCPConn); isTCP {
+			break
+		}
+		wrapper, isWrapper := netConn.(interface{ NetConn() net.Conn })
+		if !isWrapper {
+			return PathProbe{}, false
+		}
+		netConn = wrapper.NetConn()
+	}
+	if !ok {
+		return PathProbe{}, false
+	}
+	raw, err := netConn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		return PathProbe{}, false
+	}
+	var info *unix.TCPInfo
+	var infoErr error
+	if err := raw.Control(func(fd uintptr) {
+		info, infoErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil || infoErr != nil {
+		return PathProbe{}, false
+	}
+	return PathProbe{
+		MSS:             int(info.Snd_mss),
+		PathMTU:         int(info.Pmtu),
+		RTTMicroseconds: int64(info.Rtt),
+	}, info.Snd_mss > 0
+}
+
+// chooseRecordSize returns a record size for the path, up to maxSize. The
+// records of a path through a tunnel are a few whole segments, so a record
+// doesn't end with a small segment and a lost segment holds back less data.
+func chooseRecordSize(probe PathProbe, maxSize int) int {
+	if probe.MSS <= 0 || probe.MSS >= standardMSS {
+		return maxSize
+	}
+	if size := probe.MSS * tunnelRecordSegments; size <= maxSize {
+		return size
+	}
+	if maxSize < probe.MSS {
+		return maxSize
+	}
+	return maxSize / probe.MSS * probe.MSS
+}
+
+// recordSize returns the size of the records written to the connection, the
+// compression chunk size of the options unless the path is probed.
+func (o *BlockRsyncOptions) recordSize(conn io.Writer, stats *Stats, log logr.Logger) int {
+	size := o.CompressionChunkSize
+	if size <= 0 || size > MaxCompressionChunkSize {
+		size = MaxCompressionChunkSize
+	}
+	if !o.ProbeRecordSize {
+		return size
+	}
+	probe, ok := probePath(conn)
+	if !ok {
+		log.V(3).Info("Unable to probe the path, using the compression chunk size", "record size", size)
+		return size
+	}
+	probe.RecordSize = chooseRecordSize(probe, size)
+	stats.Update(func(s *Stats) { s.Path = &probe })
+	log.Info("Probed path", "mss", probe.MSS, "path mtu", probe.PathMTU, "rtt", time.Duration(probe.RTTMicroseconds)*time.Microsecond, "record size", probe.RecordSize)
+	return probe.RecordSize
+}
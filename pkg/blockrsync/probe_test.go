@@ -0,0 +1,73 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("path probe tests", func() {
+	DescribeTable("should choose the record size of the path", func(mss, maxSize, expected int) {
+		Expect(chooseRecordSize(PathProbe{MSS: mss}, maxSize)).To(Equal(expected))
+	},
+		Entry("unknown path", 0, MaxCompressionChunkSize, MaxCompressionChunkSize),
+		Entry("standard path", 1448, MaxCompressionChunkSize, MaxCompressionChunkSize),
+		Entry("loopback", 65483, MaxCompressionChunkSize, MaxCompressionChunkSize),
+		Entry("VXLAN overlay", 1398, MaxCompressionChunkSize, 1398*16),
+		Entry("tunnel with a small chunk size", 1348, 8192, 1348*6),
+		Entry("tunnel with a chunk size below the MSS", 1348, 1024, 1024),
+	)
+
+	It("should probe a TCP connection and fall back on other connections", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		probe, ok := probePath(conn)
+		Expect(ok).To(BeTrue())
+		Expect(probe.MSS).To(BeNumerically(">", 0))
+
+		opts := &BlockRsyncOptions{CompressionChunkSize: 4096, ProbeRecordSize: true}
+		stats := NewStats()
+		Expect(opts.recordSize(conn, stats, GinkgoLogr)).To(Equal(chooseRecordSize(probe, 4096)))
+		Expect(stats.Path).ToNot(BeNil())
+
+		pipe, other := net.Pipe()
+		defer pipe.Close()
+		defer other.Close()
+		_, ok = probePath(pipe)
+		Expect(ok).To(BeFalse())
+		Expect(opts.recordSize(pipe, NewStats(), GinkgoLogr)).To(Equal(4096))
+		opts.ProbeRecordSize = false
+		Expect(opts.recordSize(conn, NewStats(), GinkgoLogr)).To(Equal(4096))
+	})
+
+	It("should sync with a probed record size", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, 16*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		opts := &BlockRsyncOptions{BlockSize: 4096, ProbeRecordSize: true}
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, opts, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, opts, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(client.Stats().Path).ToNot(BeNil())
+		Expect(client.Stats().Path.MSS).To(BeNumerically(">", 0))
+	})
+})
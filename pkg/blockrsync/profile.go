@@ -0,0 +1,46 @@
+package blockrsync
+
+import (
+	"context"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// StageLabel is the pprof label of the stage of the pipeline a goroutine
+// runs, so CPU profiles can be broken down by stage.
+const StageLabel = "blockrsync_stage"
+
+// The stages of the pipeline, they are also the names of the runtime/trace
+// regions.
+const (
+	StageHash     = "hash"
+	StageExchange = "exchange"
+	StageDiff     = "diff"
+	StageRead     = "read"
+	StageSend     = "send"
+	StageCompress = "compress"
+	StageWrite    = "write"
+)
+
+var stageContexts = map[string]context.Context{}
+
+func init() {
+	for _, stage := range []string{StageHash, StageExchange, StageDiff, StageRead, StageSend, StageCompress, StageWrite} {
+		stageContexts[stage] = pprof.WithLabels(context.Background(), pprof.Labels(StageLabel, stage))
+	}
+	stageContexts[""] = context.Background()
+}
+
+// enterStage labels the goroutine with the stage and starts a trace region,
+// goroutines started in the stage inherit the label. The returned function
+// ends the region and labels the goroutine with the parent stage, which is
+// empty at the top of a goroutine.
+func enterStage(parent, stage string) func() {
+	ctx := stageContexts[stage]
+	pprof.SetGoroutineLabels(ctx)
+	region := trace.StartRegion(ctx, stage)
+	return func() {
+		region.End()
+		pprof.SetGoroutineLabels(stageContexts[parent])
+	}
+}
@@ -0,0 +1,49 @@
+package blockrsync
+
+import (
+	"bytes"
+	"runtime/pprof"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("profile tests", func() {
+	goroutineLabels := func() string {
+		buf := &bytes.Buffer{}
+		Expect(pprof.Lookup("goroutine").WriteTo(buf, 1)).To(Succeed())
+		return buf.String()
+	}
+
+	It("should label the goroutines of a stage", func() {
+		entered := make(chan struct{})
+		compressed := make(chan struct{})
+		release := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			defer enterStage("", StageSend)()
+			close(entered)
+			<-release
+			endStage := enterStage(StageSend, StageCompress)
+			compressed <- struct{}{}
+			<-release
+			endStage()
+			compressed <- struct{}{}
+			<-release
+		}()
+		<-entered
+		Expect(goroutineLabels()).To(ContainSubstring(`"blockrsync_stage":"send"`))
+		release <- struct{}{}
+		<-compressed
+		Expect(goroutineLabels()).To(ContainSubstring(`"blockrsync_stage":"compress"`))
+		release <- struct{}{}
+		<-compressed
+		labels := goroutineLabels()
+		Expect(labels).ToNot(ContainSubstring(`"blockrsync_stage":"compress"`))
+		Expect(labels).To(ContainSubstring(`"blockrsync_stage":"send"`))
+		close(release)
+		<-done
+		Expect(goroutineLabels()).ToNot(ContainSubstring(`"blockrsync_stage":"send"`))
+	})
+})
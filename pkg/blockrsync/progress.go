@@ -2,11 +2,60 @@ package blockrsync
 
 import (
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 )
 
+const (
+	progressBarWidth    = 30
+	progressBarInterval = 100 * time.Millisecond
+	// overallProgressStep is the smallest change of the overall percentage
+	// that is reported
+	overallProgressStep = 0.1
+	// throughputInterval is how often the throughput is sampled, each sample
+	// counts throughputSmoothing in the moving average
+	throughputInterval  = time.Second
+	throughputSmoothing = 0.3
+)
+
+// The phases the progress is reported for. The passes after the first of an
+// iterative sync are reported as "pass 2 sync" and so on.
+const (
+	ProgressHashSource = "hash source"
+	ProgressHashTarget = "hash target"
+	ProgressEarlySync  = "early sync"
+	ProgressSync       = "sync"
+	ProgressCopy       = "copy"
+	ProgressVerify     = "verify"
+)
+
+var (
+	clientProgressPhases = []string{ProgressHashSource, ProgressEarlySync, ProgressSync}
+	serverProgressPhases = []string{ProgressHashTarget}
+	localProgressPhases  = []string{ProgressHashSource, ProgressHashTarget, ProgressCopy}
+)
+
+// ProgressWeights are the shares of the phases in the overall progress of a
+// sync, only the phases that run on a side and have a weight count. The
+// progress of every phase is in bytes.
+type ProgressWeights map[string]float64
+
+// DefaultProgressWeights counts hashing and sending the blocks of the first
+// pass, the blocks sent early aren't counted.
+func DefaultProgressWeights() ProgressWeights {
+	return ProgressWeights{
+		ProgressHashSource: 1,
+		ProgressHashTarget: 1,
+		ProgressSync:       2,
+		ProgressCopy:       2,
+	}
+}
+
 type Progress interface {
 	Start(size int64)
 	Update(pos int64)
@@ -18,20 +67,269 @@ type progress struct {
 	progressType string
 	lastUpdate   time.Time
 	logger       logr.Logger
-	start        float64
+	rate         throughput
+	done         bool
 }
 
 func (p *progress) Start(size int64) {
 	p.total = size
 	p.current = int64(0)
 	p.lastUpdate = time.Now()
-	p.logger.Info(fmt.Sprintf("%s total size %d", p.progressType, p.total))
+	p.rate = throughput{start: p.lastUpdate, lastSample: p.lastUpdate}
+	p.done = false
+	p.logger.Info(fmt.Sprintf("%s total size %d bytes", p.progressType, p.total))
 }
 
+// Update logs the progress once a second and when the phase completes. The
+// percentage and the bytes done never go back, the throughput is a moving
+// average.
 func (p *progress) Update(pos int64) {
-	p.current = pos
-	if time.Since(p.lastUpdate).Seconds() > time.Second.Seconds() || pos == p.total {
-		p.logger.Info(fmt.Sprintf("%s %.0f%%", p.progressType, (float64(p.current) / float64(p.total) * 100)))
-		p.lastUpdate = time.Now()
+	if p.done {
+		return
+	}
+	p.current = max(p.current, min(pos, p.total))
+	now := time.Now()
+	p.rate.sample(now, p.current)
+	if now.Sub(p.lastUpdate) > time.Second || p.current >= p.total {
+		p.logger.Info(fmt.Sprintf("%s %.0f%%", p.progressType, percent(p.current, p.total)),
+			"bytes", p.current, "remaining", p.total-p.current, "bytesPerSecond", int64(p.rate.bytesPerSecond(now, p.current)))
+		p.lastUpdate = now
+		p.done = p.current >= p.total
+	}
+}
+
+// throughput is an exponential moving average of the bytes per second,
+// sampled every throughputInterval.
+type throughput struct {
+	start      time.Time
+	lastSample time.Time
+	lastPos    int64
+	rate       float64
+	sampled    bool
+}
+
+func (t *throughput) sample(now time.Time, pos int64) {
+	elapsed := now.Sub(t.lastSample)
+	if elapsed < throughputInterval {
+		return
+	}
+	rate := float64(pos-t.lastPos) / elapsed.Seconds()
+	if t.sampled {
+		rate = throughputSmoothing*rate + (1-throughputSmoothing)*t.rate
+	}
+	t.rate = rate
+	t.sampled = true
+	t.lastSample = now
+	t.lastPos = pos
+}
+
+// bytesPerSecond returns the moving average, or the average since the start
+// before the first sample.
+func (t *throughput) bytesPerSecond(now time.Time, pos int64) float64 {
+	if t.sampled {
+		return t.rate
+	}
+	if elapsed := now.Sub(t.start); elapsed > 0 {
+		return float64(pos) / elapsed.Seconds()
+	}
+	return 0
+}
+
+// progressBar renders the progress of a phase in place on a terminal, with
+// the throughput and the estimated time left.
+type progressBar struct {
+	w        io.Writer
+	phase    string
+	total    int64
+	current  int64
+	start    time.Time
+	lastDraw time.Time
+	rate     throughput
+	done     bool
+}
+
+// NewProgressBar returns a progress that draws a bar for the phase on w, w
+// should be a terminal.
+func NewProgressBar(w io.Writer, phase string) Progress {
+	return &progressBar{
+		w:     w,
+		phase: phase,
+	}
+}
+
+func (p *progressBar) Start(size int64) {
+	p.total = size
+	p.current = 0
+	p.start = time.Now()
+	p.lastDraw = time.Time{}
+	p.rate = throughput{start: p.start, lastSample: p.start}
+	p.done = false
+	p.Update(0)
+}
+
+func (p *progressBar) Update(pos int64) {
+	if p.done {
+		return
+	}
+	p.current = max(p.current, min(pos, p.total))
+	p.rate.sample(time.Now(), p.current)
+	if p.current >= p.total {
+		p.draw()
+		_, _ = fmt.Fprintln(p.w)
+		p.done = true
+		return
+	}
+	if time.Since(p.lastDraw) >= progressBarInterval {
+		p.draw()
+	}
+}
+
+func (p *progressBar) draw() {
+	p.lastDraw = time.Now()
+	done := percent(p.current, p.total)
+	filled := min(int(done/100*progressBarWidth), progressBarWidth)
+	elapsed := time.Since(p.start)
+	rate := p.rate.bytesPerSecond(p.lastDraw, p.current)
+	eta := "--"
+	if p.current >= p.total {
+		eta = elapsed.Round(time.Second).String()
+	} else if rate > 0 {
+		eta = time.Duration(float64(p.total-p.current) / rate * float64(time.Second)).Round(time.Second).String()
+	}
+	label := "ETA"
+	if p.current >= p.total {
+		label = "in"
+	}
+	_, _ = fmt.Fprintf(p.w, "\r%-16s [%s%s] %3.0f%% %10s/s %s %-8s", p.phase,
+		strings.Repeat("=", filled), strings.Repeat(" ", progressBarWidth-filled), done, formatBytes(rate), label, eta)
+}
+
+// ParseProgressWeights parses a comma separated list of phase=weight, a dash
+// in a phase stands for a space.
+func ParseProgressWeights(s string) (ProgressWeights, error) {
+	weights := make(ProgressWeights)
+	for _, field := range strings.Split(s, ",") {
+		phase, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid progress weight %q, must be phase=weight", field)
+		}
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q of phase %s, must be a number >= 0", value, phase)
+		}
+		weights[strings.ReplaceAll(phase, "-", " ")] = weight
+	}
+	return weights, nil
+}
+
+// overallProgress combines the progress of the weighted phases of one side
+// of a sync into a percentage.
+type overallProgress struct {
+	mu       sync.Mutex
+	weights  ProgressWeights
+	total    float64
+	done     map[string]float64
+	report   func(percent float64)
+	reported float64
+}
+
+// newOverallProgress returns the overall progress of the phases, it is nil
+// if report is nil or none of the phases has a weight.
+func newOverallProgress(weights ProgressWeights, report func(percent float64), phases ...string) *overallProgress {
+	if report == nil {
+		return nil
+	}
+	o := &overallProgress{
+		weights:  make(ProgressWeights),
+		done:     make(map[string]float64),
+		report:   report,
+		reported: -1,
+	}
+	for _, phase := range phases {
+		if weight := weights[phase]; weight > 0 {
+			o.weights[phase] = weight
+			o.total += weight
+		}
+	}
+	if o.total == 0 {
+		return nil
+	}
+	return o
+}
+
+// track returns a progress that reports p and counts the phase in the
+// overall progress, p may be nil.
+func (o *overallProgress) track(phase string, p Progress) Progress {
+	if o == nil || o.weights[phase] == 0 {
+		return p
+	}
+	return &phaseProgress{overall: o, phase: phase, progress: p}
+}
+
+func (o *overallProgress) set(phase string, fraction float64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.done[phase] = max(o.done[phase], min(fraction, 1))
+	var sum float64
+	for phase, fraction := range o.done {
+		sum += o.weights[phase] * fraction
+	}
+	o.update(sum / o.total * 100)
+}
+
+// complete reports 100%, the phases that didn't run had nothing to do.
+func (o *overallProgress) complete() {
+	if o == nil {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.update(100)
+}
+
+func (o *overallProgress) update(percent float64) {
+	if percent-o.reported >= overallProgressStep || (percent == 100 && o.reported < 100) {
+		o.reported = percent
+		o.report(percent)
+	}
+}
+
+type phaseProgress struct {
+	overall  *overallProgress
+	phase    string
+	progress Progress
+	total    int64
+}
+
+func (p *phaseProgress) Start(size int64) {
+	p.total = size
+	if p.progress != nil {
+		p.progress.Start(size)
+	}
+	p.overall.set(p.phase, percent(0, size)/100)
+}
+
+func (p *phaseProgress) Update(pos int64) {
+	if p.progress != nil {
+		p.progress.Update(pos)
+	}
+	p.overall.set(p.phase, percent(pos, p.total)/100)
+}
+
+func percent(current, total int64) float64 {
+	if total <= 0 {
+		return 100
+	}
+	return float64(current) / float64(total) * 100
+}
+
+// formatBytes formats a number of bytes with a binary unit.
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for bytes >= 1024 && i < len(units)-1 {
+		bytes /= 1024
+		i++
 	}
+	return fmt.Sprintf("%.1f %s", bytes, units[i])
 }
@@ -1,6 +1,8 @@
 package blockrsync
 
 import (
+	"bytes"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -19,4 +21,99 @@ var _ = Describe("progress tests", func() {
 		p.Update(100)
 		Expect(p.current).To(Equal(int64(100)))
 	})
+
+	It("should never move the progress back", func() {
+		p := progress{
+			logger: GinkgoLogr.WithName("progress"),
+		}
+		p.Start(100)
+		p.Update(60)
+		p.Update(40)
+		Expect(p.current).To(Equal(int64(60)))
+		p.Update(150)
+		Expect(p.current).To(Equal(int64(100)))
+		Expect(p.done).To(BeTrue())
+	})
+
+	It("should smooth the throughput", func() {
+		start := time.Now()
+		t := throughput{start: start, lastSample: start}
+		Expect(t.bytesPerSecond(start.Add(500*time.Millisecond), 500)).To(Equal(float64(1000)))
+		t.sample(start.Add(500*time.Millisecond), 500)
+		Expect(t.sampled).To(BeFalse())
+		t.sample(start.Add(time.Second), 1000)
+		Expect(t.bytesPerSecond(start.Add(time.Second), 1000)).To(Equal(float64(1000)))
+		// A burst only moves the average part of the way
+		t.sample(start.Add(2*time.Second), 11000)
+		Expect(t.bytesPerSecond(start.Add(2*time.Second), 11000)).To(BeNumerically("~", 3700, 0.01))
+		t.sample(start.Add(3*time.Second), 11000)
+		Expect(t.bytesPerSecond(start.Add(3*time.Second), 11000)).To(BeNumerically("~", 2590, 0.01))
+	})
+
+	It("should draw a progress bar in place", func() {
+		out := &bytes.Buffer{}
+		p := NewProgressBar(out, "sync")
+		p.Start(4 << 20)
+		p.Update(1 << 20)
+		Expect(out.String()).To(HavePrefix("\rsync"))
+		Expect(out.String()).ToNot(ContainSubstring("\n"))
+		p.Update(4 << 20)
+		lines := strings.Split(out.String(), "\r")
+		Expect(lines[len(lines)-1]).To(ContainSubstring("[" + strings.Repeat("=", progressBarWidth) + "] 100%"))
+		Expect(out.String()).To(HaveSuffix("\n"))
+		p.Update(4 << 20)
+		Expect(strings.Count(out.String(), "\n")).To(Equal(1))
+	})
+
+	It("should complete an empty phase right away", func() {
+		out := &bytes.Buffer{}
+		p := NewProgressBar(out, "sync")
+		p.Start(0)
+		Expect(out.String()).To(ContainSubstring("100%"))
+		Expect(out.String()).To(HaveSuffix("\n"))
+	})
+
+	It("should weight the phases in the overall progress", func() {
+		var reported []float64
+		overall := newOverallProgress(ProgressWeights{ProgressHashSource: 1, ProgressSync: 3, ProgressCopy: 1}, func(percent float64) {
+			reported = append(reported, percent)
+		}, clientProgressPhases...)
+		hash := overall.track(ProgressHashSource, nil)
+		hash.Start(100)
+		hash.Update(50)
+		hash.Update(100)
+		Expect(reported).To(Equal([]float64{0, 12.5, 25}))
+		// Phases without a weight don't count
+		Expect(overall.track(ProgressEarlySync, nil)).To(BeNil())
+		sync := overall.track(ProgressSync, &progress{logger: GinkgoLogr})
+		sync.Start(4096)
+		sync.Update(2048)
+		Expect(reported[len(reported)-1]).To(Equal(62.5))
+		overall.complete()
+		Expect(reported[len(reported)-1]).To(Equal(float64(100)))
+		sync.Update(4096)
+		Expect(reported).To(HaveLen(5))
+	})
+
+	It("should only report the overall progress with weighted phases", func() {
+		report := func(float64) {}
+		Expect(newOverallProgress(DefaultProgressWeights(), nil, clientProgressPhases...)).To(BeNil())
+		Expect(newOverallProgress(ProgressWeights{ProgressCopy: 1}, report, serverProgressPhases...)).To(BeNil())
+		Expect(newOverallProgress(DefaultProgressWeights(), report, serverProgressPhases...)).ToNot(BeNil())
+	})
+
+	It("should parse progress weights", func() {
+		weights, err := ParseProgressWeights("hash-source=1, sync=2.5")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(weights).To(Equal(ProgressWeights{ProgressHashSource: 1, ProgressSync: 2.5}))
+		_, err = ParseProgressWeights("sync")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseProgressWeights("sync=-1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should format bytes with binary units", func() {
+		Expect(formatBytes(512)).To(Equal("512.0 B"))
+		Expect(formatBytes(3 << 20)).To(Equal("3.0 MiB"))
+	})
 })
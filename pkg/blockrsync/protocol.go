@@ -0,0 +1,195 @@
+package blockrsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+// localFeatures returns the protocol features enabled by the options.
+func (o *BlockRsyncOptions) localFeatures() codec.Features {
+	features := codec.FeatureCompactHashes | codec.FeatureIterative | codec.FeatureResize | codec.FeaturePreflight | codec.FeatureCancel | codec.FeatureRecordLengths
+	if o.BloomFilter {
+		features |= codec.FeatureBloomFilter
+	}
+	if o.StreamChecksum {
+		// Peers that don't support CRC32C fall back to IEEE
+		features |= codec.FeatureStreamChecksum | codec.FeatureCRC32C
+	}
+	if o.ShardSize > 0 {
+		features |= codec.FeatureShards
+	}
+	if o.hashAlgorithm() == HashSHA512 {
+		features |= codec.FeatureSHA512Hashes
+	}
+	if len(o.SeedCandidates) > 0 {
+		features |= codec.FeatureSeedHashes
+	}
+	if o.Resume {
+		features |= codec.FeatureResume
+	}
+	if o.SourceDigest {
+		features |= codec.FeatureSourceDigest
+	}
+	return features
+}
+
+// connFeatures returns the local features on the connection.
+func (o *BlockRsyncOptions) connFeatures(conn io.ReadWriter) codec.Features {
+	features := o.localFeatures()
+	if o.Compression.skipCompression(conn) {
+		features |= codec.FeatureNoCompression
+	}
+	return features
+}
+
+// requiredFeatures returns the features the peer must enable.
+func (o *BlockRsyncOptions) requiredFeatures() codec.Features {
+	var features codec.Features
+	if o.iterative() {
+		features |= codec.FeatureIterative
+	}
+	if o.ShardSize > 0 {
+		features |= codec.FeatureShards | codec.FeatureIterative
+	}
+	if o.hashAlgorithm() == HashSHA512 {
+		features |= codec.FeatureSHA512Hashes
+	}
+	if len(o.SeedCandidates) > 0 {
+		features |= codec.FeatureSeedHashes
+	}
+	return features
+}
+
+func validateCompat(compat string) error {
+	if compat != "" && compat != codec.CompatV0 {
+		return fmt.Errorf("unsupported compat mode %q, only %s is supported", compat, codec.CompatV0)
+	}
+	return nil
+}
+
+// clientHandshake negotiates the protocol with the server, unless talking to
+// an old peer was requested with the v0 compat mode.
+func clientHandshake(rw io.ReadWriter, opts *BlockRsyncOptions) (codec.Hello, error) {
+	if err := validateCompat(opts.Compat); err != nil {
+		return codec.Hello{}, err
+	}
+	if opts.Compat == codec.CompatV0 {
+		return codec.Hello{Version: codec.Version0}, nil
+	}
+	features := opts.connFeatures(rw)
+	if opts.ShardSize == 0 && opts.PipelineShardSize == 0 {
+		// The source is hashed before connecting, so its hashes can be sent
+		// to a target picking a seed
+		features |= codec.FeatureSeedHashes
+	}
+	return codec.ClientHandshake(rw, codec.LocalHello(features), opts.requiredFeatures())
+}
+
+func serverHandshake(rw io.ReadWriter, opts *BlockRsyncOptions) (codec.Hello, error) {
+	if err := validateCompat(opts.Compat); err != nil {
+		return codec.Hello{}, err
+	}
+	if opts.Compat == codec.CompatV0 {
+		return codec.Hello{Version: codec.Version0}, nil
+	}
+	return codec.ServerHandshake(rw, codec.LocalHello(opts.connFeatures(rw)), opts.requiredFeatures())
+}
+
+// closedBeforeHandshake returns true if the handshake failed because the peer
+// closed the connection before it sent anything, like the paths a source
+// with alternate targets didn't pick.
+func closedBeforeHandshake(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// acceptClient accepts the connection of the client and negotiates the
+// protocol. With a guard the connections handshake concurrently until one
+// succeeds, so connections that are not from a client don't fail the sync.
+// Without one, connections closed before the handshake are skipped.
+func (b *BlockrsyncServer) acceptClient(listener net.Listener) (net.Conn, codec.Hello, error) {
+	if !b.opts.Guard.Enabled() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return nil, codec.Hello{}, err
+			}
+			hello, err := serverHandshake(conn, b.opts)
+			if err == nil {
+				return conn, hello, nil
+			}
+			conn.Close()
+			if !closedBeforeHandshake(err) {
+				return nil, codec.Hello{}, err
+			}
+			b.log.Info("Skipping connection closed before the handshake", "remote", conn.RemoteAddr())
+		}
+	}
+	type client struct {
+		conn  net.Conn
+		hello codec.Hello
+	}
+	listener = transport.Guard(listener, b.opts.Guard, b.log.WithName("guard"))
+	defer listener.Close()
+	clients := make(chan client)
+	acceptErr := make(chan error, 1)
+	done := make(chan struct{})
+	var mu sync.Mutex
+	pending := make(map[net.Conn]struct{})
+	defer func() {
+		close(done)
+		mu.Lock()
+		defer mu.Unlock()
+		for conn := range pending {
+			conn.Close()
+		}
+	}()
+	handshake := func(conn net.Conn) {
+		hello, err := serverHandshake(conn, b.opts)
+		mu.Lock()
+		delete(pending, conn)
+		mu.Unlock()
+		if err == nil && transport.Authenticated(conn) {
+			select {
+			case clients <- client{conn: conn, hello: hello}:
+				return
+			case <-done:
+			}
+		} else if err != nil {
+			b.log.Info("Closing connection that failed the handshake", "remote", conn.RemoteAddr(), "error", err.Error())
+		}
+		conn.Close()
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			mu.Lock()
+			select {
+			case <-done:
+				mu.Unlock()
+				conn.Close()
+				return
+			default:
+				pending[conn] = struct{}{}
+			}
+			mu.Unlock()
+			go handshake(conn)
+		}
+	}()
+	select {
+	case c := <-clients:
+		return c.conn, c.hello, nil
+	case err := <-acceptErr:
+		return nil, codec.Hello{}, err
+	}
+}
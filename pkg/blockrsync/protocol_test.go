@@ -0,0 +1,94 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+var _ = Describe("protocol tests", func() {
+	It("should negotiate the protocol between client and server", func() {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		errChan := make(chan error, 1)
+		go func() {
+			_, err := serverHandshake(serverConn, &BlockRsyncOptions{})
+			errChan <- err
+		}()
+		hello, err := clientHandshake(clientConn, &BlockRsyncOptions{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-errChan).ToNot(HaveOccurred())
+		Expect(hello.Version).To(Equal(codec.CurrentVersion))
+	})
+
+	It("should skip the handshake in v0 compat mode", func() {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		hello, err := clientHandshake(clientConn, &BlockRsyncOptions{Compat: codec.CompatV0})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hello.Version).To(Equal(codec.Version0))
+		hello, err = serverHandshake(serverConn, &BlockRsyncOptions{Compat: codec.CompatV0})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hello.Version).To(Equal(codec.Version0))
+	})
+
+	It("should reject unknown compat modes", func() {
+		_, err := clientHandshake(nil, &BlockRsyncOptions{Compat: "v7"})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("guarded accept tests", func() {
+	It("should sync with the client after connections that fail the handshake", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		data := make([]byte, 8*4096)
+		_, _ = rand.Read(data)
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+		Expect(os.WriteFile(targetFile, nil, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		guard := transport.GuardOptions{MaxPending: 4, HandshakeTimeout: 500 * time.Millisecond}
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, Guard: guard}, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		address := net.JoinHostPort("localhost", strconv.Itoa(port))
+		var garbage net.Conn
+		Eventually(func() error {
+			garbage, err = net.Dial("tcp", address)
+			return err
+		}).Should(Succeed())
+		defer garbage.Close()
+		_, err = garbage.Write(bytes.Repeat([]byte{0xff}, 64))
+		Expect(err).ToNot(HaveOccurred())
+		// Never handshakes, it is closed by the timeout or once the client connected
+		silent, err := net.Dial("tcp", address)
+		Expect(err).ToNot(HaveOccurred())
+		defer silent.Close()
+
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+		Expect(silent.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		// The server hello is followed by the end of the connection
+		_, err = io.Copy(io.Discard, silent)
+		Expect(err).ToNot(HaveOccurred())
+	})
+})
@@ -0,0 +1,51 @@
+package blockrsync
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	FICLONE      = 0x40049409 /* clone a whole file (int arg) */
+	FICLONERANGE = 0x4020940d /* clone a range (struct file_clone_range *arg) */
+)
+
+// fileCloneRange matches struct file_clone_range.
+type fileCloneRange struct {
+	srcFd      int64
+	srcOffset  uint64
+	srcLength  uint64
+	destOffset uint64
+}
+
+// cloneFile makes the target share all the extents of the source.
+func cloneFile(target, source *os.File) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), FICLONE, source.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// cloneRange makes the range of the target share the extents of the same
+// range of the source. The range must be aligned to the filesystem block size
+// unless it ends at the end of the source.
+func cloneRange(target, source *os.File, offset, size int64) error {
+	r := fileCloneRange{
+		srcFd:      int64(source.Fd()),
+		srcOffset:  uint64(offset),
+		srcLength:  uint64(size),
+		destOffset: uint64(offset),
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), FICLONERANGE, uintptr(unsafe.Pointer(&r))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// reflinkNotSupported returns true if the filesystem can't share extents
+// between the files, rather than the range being invalid.
+func reflinkNotSupported(err error) bool {
+	return errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.EXDEV) || errors.Is(err, syscall.ENOTTY)
+}
@@ -0,0 +1,148 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// A sync that stopped at any point must converge when it is run again with
+// the same options, without cleaning up the target or its state files.
+var _ = Describe("re-run tests", func() {
+	var (
+		tmpDir         string
+		sourceFile     string
+		targetFile     string
+		generationFile string
+		journalFile    string
+		source         []byte
+		target         []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		generationFile = filepath.Join(tmpDir, "target.generation")
+		journalFile = filepath.Join(tmpDir, "target.journal")
+		// The source has a hole in the middle, and is smaller than the target
+		source = make([]byte, 12*4096)
+		_, _ = rand.Read(source[:4*4096])
+		_, _ = rand.Read(source[8*4096:])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		target = make([]byte, 16*4096)
+		_, _ = rand.Read(target)
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		Expect((&Generation{Generation: 1, Complete: true}).WriteFile(generationFile)).To(Succeed())
+	})
+
+	sync := func(preWrite func(offset int64, data []byte) error) (*Stats, error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithHooks(Hooks{PreWrite: preWrite}), WithLogger(GinkgoLogr.WithName("server")),
+			func(c *constructorConfig) {
+				c.opts.GenerationFile = generationFile
+				c.opts.UndoJournal = journalFile
+			})
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return server.Stats(), clientErr, <-serverDone
+	}
+
+	expectConverged := func(generation int64) {
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		current, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(current.Generation).To(Equal(generation))
+		Expect(current.Complete).To(BeTrue())
+		// Running it again changes nothing
+		stats, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(stats.BlocksTransferred + stats.HolesTransferred).To(BeZero())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	}
+
+	expectRollback := func() {
+		Expect(Rollback(journalFile, targetFile, GinkgoLogr)).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(target))
+	}
+
+	It("should converge when the previous sync stopped after resizing the target", func() {
+		died := errors.New("died")
+		_, _, serverErr := sync(func(offset int64, data []byte) error {
+			return died
+		})
+		Expect(serverErr).To(MatchError(died))
+		info, err := os.Stat(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(len(source))))
+		current, err := ReadGeneration(generationFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(current.Generation).To(Equal(int64(2)))
+		Expect(current.Complete).To(BeFalse())
+
+		_, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		expectConverged(2)
+		expectRollback()
+	})
+
+	It("should converge when the previous sync stopped while applying holes", func() {
+		holes := 0
+		died := errors.New("died")
+		_, _, serverErr := sync(func(offset int64, data []byte) error {
+			if data == nil {
+				if holes++; holes > 2 {
+					return died
+				}
+			}
+			return nil
+		})
+		Expect(serverErr).To(MatchError(died))
+		written, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(written).ToNot(Equal(source))
+
+		_, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		expectConverged(2)
+		expectRollback()
+	})
+
+	It("should converge when the previous sync stopped while creating the journal", func() {
+		Expect(os.WriteFile(journalFile, []byte(journalMagic), 0600)).To(Succeed())
+		_, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		expectConverged(2)
+		expectRollback()
+	})
+
+	It("should converge with a partially emptied hole", func() {
+		// A hole punched in part, as if the target stopped in the middle of it
+		partial := bytes.Clone(source)
+		copy(partial[12*4096:], target[12*4096:])
+		_, _ = rand.Read(partial[6*4096 : 8*4096])
+		Expect(os.WriteFile(targetFile, partial, 0644)).To(Succeed())
+		Expect((&Generation{Generation: 2, Pass: 0, Complete: false}).WriteFile(generationFile)).To(Succeed())
+
+		_, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		expectConverged(2)
+	})
+})
@@ -0,0 +1,328 @@
+package blockrsync
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+const (
+	resumeMagic   = "BRRJ"
+	resumeVersion = uint16(2)
+	// resumeHeaderLength is the magic, version, block size and source size
+	resumeHeaderLength = 4 + 2 + 8 + 8
+	// resumeEntryLength is the offset and the hash of an applied block
+	resumeEntryLength = 8 + codec.HashLength
+	// resumeCommitBytes are the bytes applied between commits of the resume
+	// journal, the target is synced before every commit
+	resumeCommitBytes = 64 << 20
+)
+
+// resumeJournal records the blocks of the target that are on disk, so a sync
+// of the same source that stopped doesn't read them from the target again.
+// The offsets and hashes of the applied blocks are appended once the target
+// was synced, and the journal is removed once the sync completed.
+type resumeJournal struct {
+	fileName   string
+	f          *os.File
+	blockSize  int64
+	sourceSize int64
+	// algorithm hashes the applied blocks like the target is hashed, the
+	// blocks of a journal of another algorithm never match and are sent again
+	algorithm HashAlgorithm
+	// committed are the hashes of the blocks in the journal by offset,
+	// pending the blocks applied since the last commit
+	committed map[int64][]byte
+	pending   []OffsetHash
+	log       logr.Logger
+}
+
+// resumeJournal returns the resume journal of the target, next to it unless
+// ResumeJournal is set.
+func (o *BlockRsyncOptions) resumeJournal(targetFile string) string {
+	if o.ResumeJournal != "" {
+		return o.ResumeJournal
+	}
+	return targetFile + ".resume"
+}
+
+// openResumeJournal opens the journal of an interrupted sync, or creates an
+// empty one.
+func openResumeJournal(fileName string, algorithm HashAlgorithm, log logr.Logger) (*resumeJournal, error) {
+	f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &resumeJournal{fileName: fileName, f: f, algorithm: algorithm, log: log}
+	if err := j.load(); err != nil {
+		// The journal is only an optimization, the sync starts over
+		log.Info("Ignoring unreadable resume journal", "file", fileName, "error", err.Error())
+		j.blockSize, j.sourceSize, j.committed = 0, 0, nil
+	}
+	return j, nil
+}
+
+// load reads the header and the entries, an entry that was partially written
+// when the previous sync stopped is dropped.
+func (j *resumeJournal) load() error {
+	data, err := io.ReadAll(j.f)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if len(data) < resumeHeaderLength {
+		return errors.New("truncated header")
+	}
+	r := bytes.NewReader(data)
+	magic := make([]byte, len(resumeMagic))
+	_, _ = r.Read(magic)
+	var version uint16
+	_ = binary.Read(r, binary.LittleEndian, &version)
+	if string(magic) != resumeMagic || version != resumeVersion {
+		return fmt.Errorf("not a version %d resume journal", resumeVersion)
+	}
+	_ = binary.Read(r, binary.LittleEndian, &j.blockSize)
+	_ = binary.Read(r, binary.LittleEndian, &j.sourceSize)
+	j.committed = make(map[int64][]byte, r.Len()/resumeEntryLength)
+	for r.Len() >= resumeEntryLength {
+		var offset int64
+		_ = binary.Read(r, binary.LittleEndian, &offset)
+		hash := make([]byte, codec.HashLength)
+		_, _ = r.Read(hash)
+		j.committed[offset] = hash
+	}
+	if r.Len() > 0 {
+		j.log.Info("Dropping incomplete resume journal entry", "position", len(data)-r.Len())
+	}
+	return nil
+}
+
+// start returns the hashes of the blocks the journal has for a sync of
+// sourceSize bytes in blocks of blockSize, by offset. A journal of another
+// sync is emptied, the sync starts over.
+func (j *resumeJournal) start(sourceSize, blockSize int64) (map[int64][]byte, error) {
+	if j.blockSize == blockSize && j.sourceSize == sourceSize {
+		hashes := make(map[int64][]byte, len(j.committed))
+		for offset, hash := range j.committed {
+			if offset >= 0 && offset < sourceSize && offset%blockSize == 0 {
+				hashes[offset] = hash
+			}
+		}
+		return hashes, nil
+	}
+	if j.blockSize != 0 {
+		j.log.Info("Resume journal is of another sync, starting over", "file", j.fileName, "source size", j.sourceSize, "block size", j.blockSize)
+	}
+	j.blockSize, j.sourceSize, j.committed = blockSize, sourceSize, nil
+	if err := j.f.Truncate(0); err != nil {
+		return nil, err
+	}
+	header := bytes.NewBuffer(make([]byte, 0, resumeHeaderLength))
+	header.WriteString(resumeMagic)
+	_ = binary.Write(header, binary.LittleEndian, resumeVersion)
+	_ = binary.Write(header, binary.LittleEndian, blockSize)
+	_ = binary.Write(header, binary.LittleEndian, sourceSize)
+	if _, err := j.f.WriteAt(header.Bytes(), 0); err != nil {
+		return nil, err
+	}
+	return nil, j.f.Sync()
+}
+
+// applied records the block at offset was written to the target, it is
+// committed with the next commit.
+func (j *resumeJournal) applied(offset int64, block []byte) {
+	j.pending = append(j.pending, OffsetHash{Offset: offset, Hash: j.algorithm.sum(block)})
+}
+
+// appliedHole records the block at offset was emptied on the target.
+func (j *resumeJournal) appliedHole(offset int64) {
+	j.applied(offset, make([]byte, min(j.blockSize, j.sourceSize-offset)))
+}
+
+// due returns true once enough blocks were applied since the last commit.
+func (j *resumeJournal) due() bool {
+	return int64(len(j.pending))*j.blockSize >= resumeCommitBytes
+}
+
+// commit appends the pending blocks to the journal, the target must have
+// been synced since they were applied.
+func (j *resumeJournal) commit() error {
+	if len(j.pending) == 0 {
+		return nil
+	}
+	info, err := j.f.Stat()
+	if err != nil {
+		return err
+	}
+	// Entries are written whole, a torn entry is overwritten
+	end := resumeHeaderLength + (info.Size()-resumeHeaderLength)/resumeEntryLength*resumeEntryLength
+	buf := make([]byte, resumeEntryLength*len(j.pending))
+	for i, block := range j.pending {
+		binary.LittleEndian.PutUint64(buf[resumeEntryLength*i:], uint64(block.Offset))
+		copy(buf[resumeEntryLength*i+8:resumeEntryLength*(i+1)], block.Hash)
+	}
+	if _, err := j.f.WriteAt(buf, end); err != nil {
+		return err
+	}
+	if err := j.f.Sync(); err != nil {
+		return err
+	}
+	if j.committed == nil {
+		j.committed = make(map[int64][]byte, len(j.pending))
+	}
+	for _, block := range j.pending {
+		j.committed[block.Offset] = block.Hash
+	}
+	j.log.V(3).Info("Committed resume journal", "blocks", len(j.pending))
+	j.pending = nil
+	return nil
+}
+
+// remove deletes the journal once the sync completed, or when the target
+// changes without it.
+func (j *resumeJournal) remove() error {
+	if j.f == nil {
+		return nil
+	}
+	j.f.Close()
+	j.f = nil
+	if err := os.Remove(j.fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (j *resumeJournal) Close() error {
+	if j.f == nil {
+		return nil
+	}
+	err := j.f.Close()
+	j.f = nil
+	return err
+}
+
+// startResume tells the client which ranges the target applied before the
+// sync stopped, and hashes them with the hashes in the journal instead of
+// reading them from the target. The client compares them with the source like
+// any other block, so blocks of the source that changed since are sent again.
+func (b *BlockrsyncServer) startResume(conn io.ReadWriter) error {
+	if !b.protocol.Features.Has(codec.FeatureResume) {
+		b.log.Info("Client did not enable resume, the sync starts over")
+		err := b.resume.remove()
+		b.resume = nil
+		return err
+	}
+	sourceSize, blockSize, err := codec.NewDecoder(conn, b.protocol.Version, b.protocol.Features).ReadResume()
+	if err != nil {
+		return err
+	}
+	if blockSize != b.hasher.BlockSize() {
+		return fmt.Errorf("client block size %d does not match block size %d", blockSize, b.hasher.BlockSize())
+	}
+	hashes, err := b.resume.start(sourceSize, blockSize)
+	if err != nil {
+		return err
+	}
+	hasher, err := fileHasher(b.hasher)
+	if err != nil {
+		return err
+	}
+	hasher.resumed = hashes
+	ranges := resumedRanges(hashes, blockSize, sourceSize)
+	wire := make([]codec.Range, len(ranges))
+	for i, r := range ranges {
+		wire[i] = codec.Range{Offset: r.Offset, Length: r.Length}
+	}
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WriteResumeRanges(wire); err != nil {
+		return err
+	}
+	logResumed(ranges, b.stats, b.log)
+	return nil
+}
+
+// resumedRanges returns the ranges of the source the blocks cover.
+func resumedRanges(hashes map[int64][]byte, blockSize, sourceSize int64) ExcludedRanges {
+	ranges := make(ExcludedRanges, 0, len(hashes))
+	for offset := range hashes {
+		ranges = append(ranges, ByteRange{Offset: offset, Length: min(blockSize, sourceSize-offset)})
+	}
+	return ranges.normalized()
+}
+
+// keepResume syncs the target and commits the blocks applied since the last
+// commit, when the sync stopped before it completed.
+func (b *BlockrsyncServer) keepResume(f *os.File) {
+	if b.resume == nil {
+		return
+	}
+	if err := b.holes.flush(); err != nil {
+		b.log.Error(err, "Unable to apply the holes, the resume journal is not updated")
+		return
+	}
+	if err := b.commitResume(f); err != nil {
+		b.log.Error(err, "Unable to update the resume journal", "file", b.resume.fileName)
+		return
+	}
+	b.log.Info("Recorded the applied blocks in the resume journal", "file", b.resume.fileName, "blocks", len(b.resume.committed))
+}
+
+// commitResume syncs the target, then commits the resume journal.
+func (b *BlockrsyncServer) commitResume(f *os.File) error {
+	if err := b.audit.fsync(f); err != nil {
+		return err
+	}
+	return b.resume.commit()
+}
+
+// resume asks the target which ranges of the source it applied before the
+// sync stopped. They are hashed and diffed like the rest of the source, the
+// target hashes them from its journal.
+func (b *BlockrsyncClient) resume(conn io.ReadWriter) error {
+	if !b.protocol.Features.Has(codec.FeatureResume) {
+		b.log.Info("Target did not enable resume, the sync starts over")
+		return nil
+	}
+	hasher, err := fileHasher(b.hasher)
+	if err != nil {
+		return err
+	}
+	size, err := hasher.getFileSize(b.sourceFile)
+	if err != nil {
+		return err
+	}
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WriteResume(size, b.hasher.BlockSize()); err != nil {
+		return err
+	}
+	wire, err := codec.NewDecoder(conn, b.protocol.Version, b.protocol.Features).ReadResumeRanges()
+	if err != nil {
+		return err
+	}
+	ranges := make(ExcludedRanges, len(wire))
+	for i, r := range wire {
+		ranges[i] = ByteRange{Offset: r.Offset, Length: r.Length}
+	}
+	logResumed(ranges, b.stats, b.log)
+	return nil
+}
+
+// logResumed records the bytes applied before the sync stopped.
+func logResumed(ranges ExcludedRanges, stats *Stats, log logr.Logger) {
+	if len(ranges) == 0 {
+		return
+	}
+	var resumed int64
+	for _, r := range ranges {
+		resumed += r.Length
+	}
+	stats.Update(func(s *Stats) { s.BytesResumed = resumed })
+	log.Info("Resuming an interrupted sync", "bytes applied", resumed, "ranges", len(ranges))
+}
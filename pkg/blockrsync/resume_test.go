@@ -0,0 +1,153 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("resume journal tests", func() {
+	It("should keep the committed blocks of the same sync", func() {
+		fileName := filepath.Join(GinkgoT().TempDir(), "target.resume")
+		j, err := openResumeJournal(fileName, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(j.start(10*4096+100, 4096)).To(BeEmpty())
+		block := make([]byte, 4096)
+		_, _ = rand.Read(block)
+		for _, offset := range []int64{0, 4096, 3 * 4096} {
+			j.applied(offset, block)
+		}
+		j.appliedHole(10 * 4096)
+		Expect(j.commit()).To(Succeed())
+		// Not committed
+		j.applied(5*4096, block)
+		Expect(j.Close()).To(Succeed())
+
+		// A torn entry is dropped
+		f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = f.Write([]byte{1, 2, 3})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		j, err = openResumeJournal(fileName, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		hashes, err := j.start(10*4096+100, 4096)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resumedRanges(hashes, 4096, 10*4096+100)).To(Equal(ExcludedRanges{
+			{Offset: 0, Length: 2 * 4096},
+			{Offset: 3 * 4096, Length: 4096},
+			{Offset: 10 * 4096, Length: 100},
+		}))
+		Expect(hashes[3*4096]).To(Equal(HashBLAKE2b.sum(block)))
+		Expect(hashes[10*4096]).To(Equal(HashBLAKE2b.sum(make([]byte, 100))))
+		j.applied(4*4096, block)
+		Expect(j.commit()).To(Succeed())
+		Expect(j.Close()).To(Succeed())
+
+		j, err = openResumeJournal(fileName, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(j.start(10*4096+100, 4096)).To(HaveLen(5))
+		Expect(j.Close()).To(Succeed())
+
+		// Another source starts over
+		j, err = openResumeJournal(fileName, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(j.start(20*4096, 4096)).To(BeEmpty())
+		Expect(j.remove()).To(Succeed())
+		Expect(fileName).ToNot(BeAnExistingFile())
+	})
+
+	It("should ignore an unreadable journal", func() {
+		fileName := filepath.Join(GinkgoT().TempDir(), "target.resume")
+		Expect(os.WriteFile(fileName, []byte("not a resume journal at all"), 0600)).To(Succeed())
+		j, err := openResumeJournal(fileName, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		defer j.Close()
+		Expect(j.start(4096, 4096)).To(BeEmpty())
+	})
+
+	DescribeTable("should resume a sync that stopped after the blocks it applied", func(changed bool, transferred int64) {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, 16*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+
+		sync := func(serverOpts *BlockRsyncOptions) (*BlockrsyncClient, *BlockrsyncServer, error) {
+			port, err := getFreePort()
+			Expect(err).ToNot(HaveOccurred())
+			client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, Resume: true}, GinkgoLogr.WithName("client"))
+			server := NewBlockrsyncServer(targetFile, port, serverOpts, GinkgoLogr.WithName("server"))
+			serverDone := make(chan error, 1)
+			go func() {
+				serverDone <- server.StartServer()
+			}()
+			_ = client.ConnectToTarget()
+			return client, server, <-serverDone
+		}
+
+		writes := 0
+		serverOpts := &BlockRsyncOptions{BlockSize: 4096, Resume: true}
+		serverOpts.Hooks.PreWrite = func(offset int64, data []byte) error {
+			if writes++; writes > 5 {
+				return errors.New("connection lost")
+			}
+			return nil
+		}
+		_, _, err := sync(serverOpts)
+		Expect(err).To(MatchError(ErrHookRejected))
+		Expect(targetFile + ".resume").To(BeAnExistingFile())
+		if changed {
+			// A block the target applied before the sync stopped
+			_, _ = rand.Read(source[4096 : 2*4096])
+			Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		}
+
+		client, server, err := sync(&BlockRsyncOptions{BlockSize: 4096, Resume: true})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(server.Stats().BytesResumed).To(Equal(int64(5 * 4096)))
+		Expect(client.Stats().BytesResumed).To(Equal(int64(5 * 4096)))
+		Expect(client.Stats().BlocksTransferred).To(Equal(transferred))
+		Expect(targetFile + ".resume").ToNot(BeAnExistingFile())
+	},
+		Entry("of the same source", false, int64(11)),
+		Entry("of a source that changed since", true, int64(12)),
+	)
+
+	It("should start over without resume on the client", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		journal := filepath.Join(tmpDir, "journal")
+		source := make([]byte, 4*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		j, err := openResumeJournal(journal, HashBLAKE2b, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(j.start(int64(len(source)), 4096)).To(BeEmpty())
+		j.applied(0, source[:4096])
+		Expect(j.commit()).To(Succeed())
+		Expect(j.Close()).To(Succeed())
+
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, Resume: true, ResumeJournal: journal}, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(server.Stats().BytesResumed).To(BeZero())
+		Expect(journal).ToNot(BeAnExistingFile())
+	})
+})
@@ -0,0 +1,88 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Savings are the bytes of the source that were not sent as data compared
+// with a full copy, because the target held them already, they were empty and
+// sent as holes, or they were cloned.
+type Savings struct {
+	// Runs is the number of completed syncs the savings add up
+	Runs         int64 `json:"runs"`
+	SourceBytes  int64 `json:"sourceBytes"`
+	BytesSent    int64 `json:"bytesSent"`
+	BytesMatched int64 `json:"bytesMatched"`
+	HoleBytes    int64 `json:"holeBytes"`
+	BytesCloned  int64 `json:"bytesCloned"`
+}
+
+// ReadSavings reads a savings file, it returns empty savings if the file does
+// not exist.
+func ReadSavings(fileName string) (*Savings, error) {
+	savings := &Savings{}
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return savings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, savings); err != nil {
+		return nil, fmt.Errorf("invalid savings file %s: %w", fileName, err)
+	}
+	return savings, nil
+}
+
+// WriteFile replaces the file atomically.
+func (s *Savings) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+func (s *Savings) add(other Savings) {
+	s.Runs += other.Runs
+	s.SourceBytes += other.SourceBytes
+	s.BytesSent += other.BytesSent
+	s.BytesMatched += other.BytesMatched
+	s.HoleBytes += other.HoleBytes
+	s.BytesCloned += other.BytesCloned
+}
+
+// recordSavings sets the bytes the target held already once a sync completed,
+// they are the bytes of the source that were not sent or cloned. Blocks sent
+// again by later passes are subtracted again, so the matched bytes of an
+// iterative sync are a lower bound. With a savings file, the savings are added
+// to it and the totals recorded in the stats.
+func recordSavings(fileName string, stats *Stats) error {
+	var run Savings
+	stats.Update(func(s *Stats) {
+		s.BytesMatched = max(0, s.SourceSize-s.BytesTransferred-s.HoleBytes-s.BytesCloned)
+		run = Savings{
+			Runs:         1,
+			SourceBytes:  s.SourceSize,
+			BytesSent:    s.BytesTransferred,
+			BytesMatched: s.BytesMatched,
+			HoleBytes:    s.HoleBytes,
+			BytesCloned:  s.BytesCloned,
+		}
+	})
+	if fileName == "" {
+		return nil
+	}
+	savings, err := ReadSavings(fileName)
+	if err != nil {
+		return err
+	}
+	savings.add(run)
+	if err := savings.WriteFile(fileName); err != nil {
+		return err
+	}
+	stats.Update(func(s *Stats) { s.Cumulative = savings })
+	return nil
+}
@@ -0,0 +1,55 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("savings tests", func() {
+	It("should add up the savings of the syncs of a target", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		savingsFile := filepath.Join(tmpDir, "target.savings")
+		// The target holds the first 2 blocks, the last 4 blocks of the
+		// source are empty
+		source := make([]byte, 8*4096)
+		_, _ = rand.Read(source[:4*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		target := make([]byte, 8*4096)
+		_, _ = rand.Read(target)
+		copy(target, source[:2*4096])
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		opts := &BlockRsyncOptions{BlockSize: 4096, SavingsFile: savingsFile}
+
+		localCopy := NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy"))
+		Expect(localCopy.Copy()).To(Succeed())
+		stats := localCopy.Stats()
+		Expect(stats.BytesTransferred + stats.BytesCloned).To(Equal(int64(2 * 4096)))
+		Expect(stats.HoleBytes).To(Equal(int64(4 * 4096)))
+		Expect(stats.BytesMatched).To(Equal(int64(2 * 4096)))
+		Expect(stats.Summary()).To(ContainSubstring("8192 bytes matched"))
+
+		localCopy = NewLocalCopy(sourceFile, targetFile, opts, GinkgoLogr.WithName("copy"))
+		Expect(localCopy.Copy()).To(Succeed())
+		Expect(localCopy.Stats().BytesMatched).To(Equal(int64(8 * 4096)))
+		savings, err := ReadSavings(savingsFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(savings).To(Equal(localCopy.Stats().Cumulative))
+		Expect(savings.Runs).To(Equal(int64(2)))
+		Expect(savings.SourceBytes).To(Equal(int64(16 * 4096)))
+		Expect(savings.BytesMatched).To(Equal(int64(10 * 4096)))
+		Expect(savings.HoleBytes).To(Equal(int64(4 * 4096)))
+		Expect(savings.BytesSent + savings.BytesCloned).To(Equal(int64(2 * 4096)))
+	})
+
+	It("should read missing savings as empty", func() {
+		savings, err := ReadSavings(filepath.Join(GinkgoT().TempDir(), "missing"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(savings).To(Equal(&Savings{}))
+	})
+})
@@ -0,0 +1,169 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// SeedReport describes the seed copied onto the target before it was hashed.
+type SeedReport struct {
+	File            string `json:"file"`
+	DifferentBlocks int64  `json:"differentBlocks"`
+	BytesCopied     int64  `json:"bytesCopied"`
+	BytesCloned     int64  `json:"bytesCloned,omitempty"`
+	// Candidates are the seeds the seed was picked from
+	Candidates []SeedCandidate `json:"candidates,omitempty"`
+}
+
+// SeedCandidate is a seed the target could copy, and how many blocks of the
+// source it is estimated to miss.
+type SeedCandidate struct {
+	File            string `json:"file"`
+	DifferentBlocks int64  `json:"differentBlocks"`
+}
+
+// seed copies the seed onto the target with a local copy, so the diff with
+// the source only has the blocks the seed is missing. The seed is cloned when
+// both are files on the same reflink capable filesystem.
+func (b *BlockrsyncServer) seed(file string) (*SeedReport, error) {
+	stopPhase := b.stats.StartPhase(PhaseSeed, b.log)
+	defer stopPhase()
+	opts := *b.opts
+	// The hooks, overall progress and diff file are those of the sync
+	opts.Hooks = Hooks{}
+	opts.OnProgress = nil
+	opts.DiffFile = ""
+	localCopy := NewLocalCopy(file, b.targetFile, &opts, b.log.WithName("seed"))
+	localCopy.audit = b.audit
+	stopCopy := context.AfterFunc(b.ctx, localCopy.Cancel)
+	defer stopCopy()
+	if err := localCopy.Copy(); err != nil {
+		return nil, fmt.Errorf("unable to seed the target from %s: %w", file, err)
+	}
+	report := &SeedReport{File: file}
+	localCopy.Stats().Update(func(s *Stats) {
+		report.DifferentBlocks = s.DifferentBlocks
+		report.BytesCopied = s.BytesTransferred
+		report.BytesCloned = s.BytesCloned
+	})
+	b.log.Info("Seeded target", "seed", report.File, "bytes copied", report.BytesCopied, "bytes cloned", report.BytesCloned)
+	return report, nil
+}
+
+type hashedCandidates struct {
+	hashes []map[int64][]byte
+	err    error
+}
+
+// hashSeedCandidates hashes the seed candidates while the server waits for
+// the client.
+func (b *BlockrsyncServer) hashSeedCandidates() <-chan hashedCandidates {
+	res := make(chan hashedCandidates, 1)
+	go func() {
+		defer close(res)
+		stopPhase := b.stats.StartPhase(PhaseSeed, b.log)
+		defer stopPhase()
+		var hashed hashedCandidates
+		for _, file := range b.opts.SeedCandidates {
+			hasher := b.opts.newHasher(b.opts.readLimiter(), ProgressHashTarget, nil, b.audit, b.ctx.Done(), b.log.WithName("seed-hasher"))
+			if _, err := hasher.HashFile(file); err != nil {
+				res <- hashedCandidates{err: fmt.Errorf("unable to hash seed candidate %s: %w", file, err)}
+				return
+			}
+			hashed.hashes = append(hashed.hashes, hasher.GetHashes())
+		}
+		res <- hashed
+	}()
+	return res
+}
+
+// seedClosest reads the hashes of the source, and copies the candidate that
+// misses the fewest of its blocks onto the target. The client waits for the
+// answer, so nothing it sends after the hashes is read ahead.
+func (b *BlockrsyncServer) seedClosest(conn io.ReadWriter, candidates <-chan hashedCandidates) error {
+	report, seedErr := b.pickSeed(conn, candidates)
+	message := ""
+	if seedErr != nil {
+		message = seedErr.Error()
+	}
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WritePreflightResult(message); err != nil {
+		return err
+	}
+	if seedErr != nil {
+		return seedErr
+	}
+	b.stats.Update(func(s *Stats) { s.Seed = report })
+	return nil
+}
+
+func (b *BlockrsyncServer) pickSeed(conn io.Reader, candidates <-chan hashedCandidates) (*SeedReport, error) {
+	decoder := codec.NewDecoder(bufio.NewReader(conn), b.protocol.Version, b.protocol.Features)
+	blockSize, source, err := b.hasher.DeserializeHashes(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if blockSize != b.hasher.BlockSize() {
+		return nil, fmt.Errorf("the source block size %d does not match the target block size %d", blockSize, b.hasher.BlockSize())
+	}
+	var hashed hashedCandidates
+	select {
+	case hashed = <-candidates:
+	case <-b.ctx.Done():
+		return nil, ErrCancelled
+	}
+	if hashed.err != nil {
+		return nil, hashed.err
+	}
+	closest := 0
+	report := make([]SeedCandidate, len(b.opts.SeedCandidates))
+	for i, file := range b.opts.SeedCandidates {
+		report[i] = SeedCandidate{File: file, DifferentBlocks: seedDifferences(source, hashed.hashes[i])}
+		b.log.Info("Seed candidate", "seed", file, "different blocks", report[i].DifferentBlocks)
+		if report[i].DifferentBlocks < report[closest].DifferentBlocks {
+			closest = i
+		}
+	}
+	seed, err := b.seed(report[closest].File)
+	if err != nil {
+		return nil, err
+	}
+	seed.Candidates = report
+	return seed, nil
+}
+
+// seedDifferences returns the number of blocks of the source the seed
+// doesn't hold.
+func seedDifferences(source, seed map[int64][]byte) int64 {
+	var different int64
+	for offset, hash := range source {
+		if !bytes.Equal(seed[offset], hash) {
+			different++
+		}
+	}
+	return different
+}
+
+// sendSeedHashes sends the hashes of the source to a target picking a seed,
+// and waits for it to copy the seed.
+func (b *BlockrsyncClient) sendSeedHashes(conn io.Writer, connReader io.Reader) error {
+	writer := bufio.NewWriter(conn)
+	if err := b.hasher.SerializeHashes(codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	message, err := codec.NewDecoder(connReader, b.protocol.Version, b.protocol.Features).ReadPreflightResult()
+	if err != nil {
+		return err
+	}
+	if message != "" {
+		return fmt.Errorf("the target was unable to pick a seed: %s", message)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("seed tests", func() {
+	var (
+		sourceFile string
+		seedFile   string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		seedFile = filepath.Join(tmpDir, "seed.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 16*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		// The seed is a stale copy of the source with 2 changed blocks
+		seed := append([]byte(nil), source...)
+		_, _ = rand.Read(seed[3*4096 : 4*4096])
+		_, _ = rand.Read(seed[9*4096 : 10*4096])
+		Expect(os.WriteFile(seedFile, seed, 0644)).To(Succeed())
+	})
+
+	sync := func(target []byte, seed string, candidates ...string) (*Stats, error, error) {
+		if target != nil {
+			Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		}
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")),
+			func(c *constructorConfig) {
+				c.opts.Seed = seed
+				c.opts.SeedCandidates = candidates
+			})
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return server.Stats(), clientErr, <-serverDone
+	}
+
+	DescribeTable("should only send the blocks the seed is missing", func(target []byte) {
+		stats, clientErr, serverErr := sync(target, seedFile)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(stats.BlocksTransferred).To(Equal(int64(2)))
+		Expect(stats.Seed).ToNot(BeNil())
+		Expect(stats.Seed.File).To(Equal(seedFile))
+		Expect(stats.Seed.BytesCopied + stats.Seed.BytesCloned).ToNot(BeZero())
+		Expect(stats.PhaseMilliseconds).To(HaveKey(PhaseSeed))
+	},
+		Entry("into a new target", nil),
+		Entry("into an existing target", make([]byte, 4*4096)),
+	)
+
+	It("should copy the candidate closest to the source", func() {
+		unrelated := filepath.Join(filepath.Dir(seedFile), "unrelated.raw")
+		data := make([]byte, 16*4096)
+		_, _ = rand.Read(data)
+		Expect(os.WriteFile(unrelated, data, 0644)).To(Succeed())
+		stats, clientErr, serverErr := sync(nil, "", unrelated, seedFile)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(stats.BlocksTransferred).To(Equal(int64(2)))
+		Expect(stats.Seed).ToNot(BeNil())
+		Expect(stats.Seed.File).To(Equal(seedFile))
+		Expect(stats.Seed.Candidates).To(Equal([]SeedCandidate{
+			{File: unrelated, DifferentBlocks: 16},
+			{File: seedFile, DifferentBlocks: 2},
+		}))
+	})
+
+	It("should fail the client if a candidate does not exist", func() {
+		_, clientErr, serverErr := sync(nil, "", filepath.Join(filepath.Dir(seedFile), "missing.raw"))
+		Expect(clientErr).To(MatchError(ContainSubstring("unable to pick a seed")))
+		Expect(serverErr).To(MatchError(ContainSubstring("unable to hash seed candidate")))
+	})
+
+	It("should fail if the seed does not exist", func() {
+		server, err := NewServer(targetFile, WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")),
+			func(c *constructorConfig) { c.opts.Seed = filepath.Join(filepath.Dir(seedFile), "missing.raw") })
+		Expect(err).ToNot(HaveOccurred())
+		Expect(server.StartServer()).To(MatchError(ContainSubstring("unable to seed the target")))
+	})
+})
@@ -0,0 +1,205 @@
+package blockrsync
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	CheckRead      = "read"
+	CheckWrite     = "write"
+	CheckHoles     = "holes"
+	CheckDirectIO  = "direct-io"
+	CheckBandwidth = "bandwidth"
+
+	// directIOAlignment is the alignment of O_DIRECT reads, the logical block
+	// size of devices is at most 4096 bytes
+	directIOAlignment = 4096
+	// bandwidthChunkSize is the size of the chunks sent by the bandwidth check
+	bandwidthChunkSize = 1024 * 1024
+)
+
+// CheckResult is the outcome of a check of a self check.
+type CheckResult struct {
+	Check  string `json:"check"`
+	Passed bool   `json:"passed"`
+	Detail string `json:"detail"`
+}
+
+func checkPassed(check, detail string) CheckResult {
+	return CheckResult{Check: check, Passed: true, Detail: detail}
+}
+
+func checkFailed(check string, err error) CheckResult {
+	return CheckResult{Check: check, Detail: err.Error()}
+}
+
+// SelfCheck checks a file or device can be synced: it can be read and
+// written, holes can be punched or discarded, and it can be read with
+// O_DIRECT. Nothing is changed, holes are only probed past the end of a file.
+func SelfCheck(path string) []CheckResult {
+	f, err := openFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return []CheckResult{checkFailed(CheckRead, err)}
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return []CheckResult{checkFailed(CheckRead, err)}
+	}
+	size := info.Size()
+	if isDevice(info) {
+		if size, err = deviceSize(f); err != nil {
+			return []CheckResult{checkFailed(CheckRead, err)}
+		}
+	}
+	results := []CheckResult{checkPassed(CheckRead, fmt.Sprintf("%d bytes", size))}
+	w, err := openFile(path, os.O_RDWR, 0)
+	if err != nil {
+		results = append(results, checkFailed(CheckWrite, fmt.Errorf("%w, it can only be a source", err)))
+	} else {
+		defer w.Close()
+		results = append(results, checkPassed(CheckWrite, "it can be a target"))
+		results = append(results, checkHoles(w, isDevice(info), size))
+	}
+	return append(results, checkDirectIO(path, size))
+}
+
+// checkHoles checks the holes of a target can be punched, or discarded on a
+// device. Punching a device is not probed, it needs a block that is known to
+// be empty.
+func checkHoles(f *os.File, device bool, size int64) CheckResult {
+	if device {
+		properties, err := readDeviceProperties(f)
+		if err != nil {
+			return checkFailed(CheckHoles, fmt.Errorf("unable to read the device properties: %w", err))
+		}
+		if !properties.canDiscard() {
+			return checkFailed(CheckHoles, fmt.Errorf("%s does not support discard, holes are written as zeroes unless punching them is supported", properties.name))
+		}
+		if !properties.discardZeroes {
+			return checkFailed(CheckHoles, fmt.Errorf("discarded blocks of %s may not read back as zeroes, holes are written as zeroes unless punching them is supported", properties.name))
+		}
+		return checkPassed(CheckHoles, fmt.Sprintf("%s frees discarded blocks", properties.name))
+	}
+	strategy, reason, err := probePunchHole(f, size, directIOAlignment, nil)
+	if err != nil {
+		return checkFailed(CheckHoles, err)
+	}
+	if strategy != HoleStrategyPunch {
+		return checkFailed(CheckHoles, fmt.Errorf("%s, holes are written as zeroes", reason))
+	}
+	return checkPassed(CheckHoles, reason)
+}
+
+// checkDirectIO reads the first block with O_DIRECT.
+func checkDirectIO(path string, size int64) CheckResult {
+	f, err := openFile(path, os.O_RDONLY|syscall.O_DIRECT, 0)
+	if err != nil {
+		return checkFailed(CheckDirectIO, err)
+	}
+	defer f.Close()
+	if size < directIOAlignment {
+		return checkPassed(CheckDirectIO, "opened, too small to read a block")
+	}
+	buf := make([]byte, 2*directIOAlignment)
+	if offset := int(uintptr(unsafe.Pointer(&buf[0])) % directIOAlignment); offset != 0 {
+		buf = buf[directIOAlignment-offset:]
+	}
+	if _, err := f.ReadAt(buf[:directIOAlignment], 0); err != nil {
+		return checkFailed(CheckDirectIO, err)
+	}
+	return checkPassed(CheckDirectIO, "supported")
+}
+
+// CheckBandwidthTo sends data for the duration to a self check serving the
+// bandwidth check on the address, and reports the throughput once the peer
+// received all of it.
+func CheckBandwidthTo(address string, port int, opts *BlockRsyncOptions, duration time.Duration) CheckResult {
+	retries, retryInterval := opts.connectRetries()
+	conn, err := transport.DialRetry(transport.OrDefault(opts.Transport), net.JoinHostPort(address, strconv.Itoa(port)), retries, retryInterval)
+	if err != nil {
+		return checkFailed(CheckBandwidth, err)
+	}
+	defer conn.Close()
+	sent, elapsed, err := sendBandwidthCheck(conn, duration)
+	if err != nil {
+		return checkFailed(CheckBandwidth, err)
+	}
+	return checkPassed(CheckBandwidth, fmt.Sprintf("%d bytes per second to %s", int64(float64(sent)/elapsed.Seconds()), address))
+}
+
+// sendBandwidthCheck sends chunks, each preceded by a 1, until the duration
+// passed, then a 0 and waits for the peer to answer with the number of bytes
+// it received.
+func sendBandwidthCheck(conn io.ReadWriter, duration time.Duration) (int64, time.Duration, error) {
+	chunk := make([]byte, 1+bandwidthChunkSize)
+	chunk[0] = 1
+	var sent int64
+	start := time.Now()
+	for time.Since(start) < duration {
+		if _, err := conn.Write(chunk); err != nil {
+			return 0, 0, err
+		}
+		sent += bandwidthChunkSize
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return 0, 0, err
+	}
+	var received int64
+	if err := binary.Read(conn, binary.LittleEndian, &received); err != nil {
+		return 0, 0, err
+	}
+	if received != sent {
+		return 0, 0, fmt.Errorf("sent %d bytes, the peer received %d", sent, received)
+	}
+	return sent, time.Since(start), nil
+}
+
+// ServeBandwidthCheck accepts a bandwidth check on the port and discards what
+// it receives.
+func ServeBandwidthCheck(port int, opts *BlockRsyncOptions) error {
+	listener, err := transport.OrDefault(opts.Transport).Listen(fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	conn, err := listener.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return receiveBandwidthCheck(conn)
+}
+
+func receiveBandwidthCheck(conn io.ReadWriter) error {
+	marker := make([]byte, 1)
+	var received int64
+	for {
+		if _, err := io.ReadFull(conn, marker); err != nil {
+			return err
+		}
+		switch marker[0] {
+		case 0:
+			return binary.Write(conn, binary.LittleEndian, received)
+		case 1:
+			n, err := io.CopyN(io.Discard, conn, bandwidthChunkSize)
+			received += n
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("invalid bandwidth check, the peer is not a self check")
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package blockrsync
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("self check tests", func() {
+	checks := func(results []CheckResult) []string {
+		var names []string
+		for _, result := range results {
+			names = append(names, result.Check)
+		}
+		return names
+	}
+
+	It("should check a file can be read and written", func() {
+		file := filepath.Join(GinkgoT().TempDir(), "target.raw")
+		Expect(os.WriteFile(file, make([]byte, 4*4096), 0644)).To(Succeed())
+		results := SelfCheck(file)
+		Expect(checks(results)).To(Equal([]string{CheckRead, CheckWrite, CheckHoles, CheckDirectIO}))
+		Expect(results[0]).To(Equal(CheckResult{Check: CheckRead, Passed: true, Detail: "16384 bytes"}))
+		Expect(results[1].Passed).To(BeTrue())
+	})
+
+	It("should fail to read a missing file", func() {
+		results := SelfCheck(filepath.Join(GinkgoT().TempDir(), "missing.raw"))
+		Expect(results).To(HaveLen(1))
+		Expect(results[0].Check).To(Equal(CheckRead))
+		Expect(results[0].Passed).To(BeFalse())
+	})
+
+	It("should measure the bandwidth to a peer", func() {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		opts := &BlockRsyncOptions{}
+		served := make(chan error, 1)
+		go func() {
+			served <- ServeBandwidthCheck(port, opts)
+		}()
+		result := CheckBandwidthTo("localhost", port, opts, 100*time.Millisecond)
+		Expect(result.Passed).To(BeTrue(), result.Detail)
+		Expect(result.Detail).To(ContainSubstring("bytes per second"))
+		Expect(<-served).To(Succeed())
+	})
+})
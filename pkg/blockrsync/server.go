@@ -2,7 +2,8 @@ package blockrsync
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -10,158 +11,698 @@ import (
 
 	"github.com/go-logr/logr"
 	"github.com/golang/snappy"
-)
 
-type BlockRsyncOptions struct {
-	Preallocation bool
-	BlockSize     int
-}
+	"github.com/awels/blockrsync/pkg/codec"
+)
 
 type BlockrsyncServer struct {
 	targetFile     string
 	targetFileSize int64
+	sourceSize     int64
 	port           int
 	hasher         Hasher
 	opts           *BlockRsyncOptions
 	log            logr.Logger
+	stats          *Stats
+	protocol       codec.Hello
+	journal        *undoJournal
+	resume         *resumeJournal
+	generation     *generationTracker
+	shards         *shardTracker
+	holes          *holeWriter
+	blockLog       *blockLogger
+	overall        *overallProgress
+	audit          *auditor
+	// applyLimit tunes the apply window when adaptive
+	applyLimit *adaptiveLimit
+	// hashed is closed once the target is hashed
+	hashed <-chan struct{}
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 func NewBlockrsyncServer(targetFile string, port int, opts *BlockRsyncOptions, logger logr.Logger) *BlockrsyncServer {
+	overall := opts.overallProgress(serverProgressPhases...)
+	ctx, cancel := context.WithCancel(context.Background())
+	stats := NewStats()
+	audit := newAuditor(opts.Audit, stats, logger.WithName("audit"))
 	return &BlockrsyncServer{
 		targetFile: targetFile,
 		port:       port,
 		opts:       opts,
 		log:        logger,
-		hasher:     NewFileHasher(int64(opts.BlockSize), logger.WithName("hasher")),
+		hasher:     opts.newHasher(opts.readLimiter(), ProgressHashTarget, overall, audit, ctx.Done(), logger.WithName("hasher")),
+		stats:      stats,
+		blockLog:   newBlockLogger(logger, "Applying data", opts.TraceBlocks),
+		overall:    overall,
+		audit:      audit,
+		applyLimit: opts.applyWindowLimit(logger.WithName("adaptive")),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// NewBlockrsyncServerWithOptions creates a server with a copy of opts, the
+// options that are not set use their defaults. It fails if the options are
+// invalid.
+func NewBlockrsyncServerWithOptions(targetFile string, port int, opts *BlockRsyncOptions, logger logr.Logger) (*BlockrsyncServer, error) {
+	opts, err := opts.validated()
+	if err != nil {
+		return nil, err
+	}
+	return NewBlockrsyncServer(targetFile, port, opts, logger), nil
+}
+
+func (b *BlockrsyncServer) Stats() *Stats {
+	return b.stats
+}
+
+// Cancel stops the server, StartServer writes the blocks it received to disk
+// and returns ErrCancelled. The connection is closed, so the client fails
+// with a connection error.
+func (b *BlockrsyncServer) Cancel() {
+	b.cancel()
+}
+
+// listenTarget listens for the client on the port, or on the unix socket of
+// the options if it is set.
+func (o *BlockRsyncOptions) listenTarget(port int, log logr.Logger) (net.Listener, error) {
+	if o.ListenSocket != "" {
+		log.Info("Listening for unix socket connection", "socket", o.ListenSocket)
+	} else {
+		log.Info("Listening for tcp connection", "port", fmt.Sprintf(":%d", port))
 	}
+	return o.listen(fmt.Sprintf(":%d", port))
 }
 
 func (b *BlockrsyncServer) StartServer() error {
-	f, err := os.OpenFile(b.targetFile, os.O_RDWR|os.O_CREATE, 0666)
+	err := b.startServer()
+	if err != nil && !errors.Is(err, ErrCancelled) && b.ctx.Err() != nil {
+		// Cancelling closes the connection, which fails the current stage
+		b.log.V(3).Info("Stopped by cancel", "error", err.Error())
+		err = ErrCancelled
+	}
+	if err == nil {
+		b.overall.complete()
+		if serr := recordSavings(b.opts.SavingsFile, b.stats); serr != nil {
+			b.log.Error(serr, "Unable to record savings", "file", b.opts.SavingsFile)
+		}
+	}
+	return b.opts.Hooks.postSync(b.stats, err)
+}
+
+func (b *BlockrsyncServer) startServer() error {
+	if b.opts.StreamTarget {
+		return b.streamTarget()
+	}
+	if b.opts.Seed != "" {
+		report, err := b.seed(b.opts.Seed)
+		if err != nil {
+			return err
+		}
+		b.stats.Update(func(s *Stats) { s.Seed = report })
+	}
+	f, err := b.audit.open(b.targetFile, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	readyChan := make(chan struct{})
-
-	go func() {
-		defer func() { readyChan <- struct{}{} }()
-		size, err := b.hasher.HashFile(b.targetFile)
+	if b.opts.HashesFrom != "" {
+		if err := b.useHashManifest(); err != nil {
+			return err
+		}
+	}
+	if b.opts.GenerationFile != "" || b.opts.HashesTo != "" {
+		b.generation, err = newGenerationTracker(b.opts.GenerationFile, b.opts.Generation, b.opts.AllowDowngrade, b.hasher.BlockSize(), hashAlgorithmOf(b.hasher), b.log.WithName("generation"))
 		if err != nil {
-			b.log.Error(err, "Failed to hash file")
-			return
+			return err
 		}
-		b.targetFileSize = size
-		b.log.Info("Hashed file with size", "filename", b.targetFile, "size", b.targetFileSize)
-	}()
+		b.generation.manifest = b.opts.HashesTo
+	}
+	if err := b.opts.Hooks.preHash(b.targetFile); err != nil {
+		return err
+	}
+	hashed := make(chan struct{})
+	b.hashed = hashed
+	var hashedSize int64
+	var candidates <-chan hashedCandidates
+	sharded := b.opts.ShardSize > 0
+	if sharded {
+		// The shards are hashed as they are synced
+		hasher, err := fileHasher(b.hasher)
+		if err != nil {
+			return err
+		}
+		if hashedSize, err = hasher.getFileSize(b.targetFile); err != nil {
+			return err
+		}
+		b.stats.Update(func(s *Stats) { s.TargetSize = hashedSize })
+		close(hashed)
+	} else if len(b.opts.SeedCandidates) > 0 {
+		// The target is hashed once the candidate closest to the source was
+		// copied onto it
+		candidates = b.hashSeedCandidates()
+	} else if b.opts.Resume {
+		// The target is hashed once the client told which sync it resumes
+		if b.resume, err = openResumeJournal(b.opts.resumeJournal(b.targetFile), hashAlgorithmOf(b.hasher), b.log.WithName("resume")); err != nil {
+			return err
+		}
+		defer b.resume.Close()
+	} else {
+		go b.hashTarget(hashed, &hashedSize)
+	}
 
-	b.log.Info("Listening for tcp connection", "port", fmt.Sprintf(":%d", b.port))
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", b.port))
+	listener, err := b.opts.listenTarget(b.port, b.log)
 	if err != nil {
 		return err
 	}
-	conn, err := listener.Accept()
+	// Closing a unix socket listener removes the socket
+	defer listener.Close()
+	stopListener := context.AfterFunc(b.ctx, func() { listener.Close() })
+	defer stopListener()
+	conn, protocol, err := b.acceptClient(listener)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
-	writer := snappy.NewBufferedWriter(conn)
-	<-readyChan
-
-	if err := b.writeHashes(writer); err != nil {
+	stopConn := context.AfterFunc(b.ctx, func() { conn.Close() })
+	defer stopConn()
+	b.protocol = protocol
+	b.log.Info("Negotiated protocol", "version", b.protocol.Version, "features", b.protocol.Features)
+	if candidates != nil {
+		if err := b.seedClosest(conn, candidates); err != nil {
+			return err
+		}
+		go b.hashTarget(hashed, &hashedSize)
+	}
+	if b.resume != nil {
+		if err := b.startResume(conn); err != nil {
+			return err
+		}
+		go b.hashTarget(hashed, &hashedSize)
+	}
+	recordSize := b.opts.recordSize(conn, b.stats, b.log)
+	var writer flushWriteCloser
+	if b.protocol.Features.Has(codec.FeatureCompactHashes) || b.protocol.Features.Has(codec.FeatureNoCompression) {
+		// Hashes don't compress, skip snappy
+		writer = &bufferedWriteCloser{Writer: bufio.NewWriter(conn)}
+	} else {
+		writer = newCompressedWriter(conn, recordSize, b.opts.FlushInterval, StageExchange, newCPUPacer(b.opts.MaxCPU))
+	}
+	if sharded {
+		b.targetFileSize = hashedSize
+	} else if hasher := b.streamingHasher(); hasher != nil {
+		// The hashes are sent while the target is hashed
+		b.targetFileSize, _ = hasher.waitSize()
+	} else {
+		<-hashed
+		b.targetFileSize = hashedSize
+	}
+	if b.hasher.IsDevice() && b.opts.HoleStrategy == HoleStrategyAuto {
+		// Probing a device looks for an empty block in the hashes
+		<-hashed
+	}
+	if b.holes, err = newHoleWriter(f, b.opts, b.hasher, b.targetFileSize, b.stats, b.audit, b.log); err != nil {
 		return err
 	}
-	b.log.Info("Wrote hashes to client, starting diff reader")
-	reader := bufio.NewReader(snappy.NewReader(conn))
-	if err := b.writeBlocksToFile(f, reader); err != nil {
+	if b.protocol.Features.Has(codec.FeaturePreflight) {
+		if err := b.preflight(conn, f); err != nil {
+			return err
+		}
+	}
+	if sharded {
+		if b.shards, err = b.startShards(conn); err != nil {
+			return err
+		}
+	}
+	if b.opts.UndoJournal != "" {
+		b.journal, err = openUndoJournal(b.opts.UndoJournal, f, b.targetFileSize, b.hasher.BlockSize(), b.log.WithName("journal"))
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := b.journal.Close(); err != nil {
+				b.log.Error(err, "Unable to close undo journal", "file", b.opts.UndoJournal)
+			}
+		}()
+	}
+
+	// The client may start sending blocks before it received all hashes
+	var hashErr error
+	hashesDone := make(chan struct{})
+	recordsCtx, stopRecords := context.WithCancel(b.ctx)
+	defer stopRecords()
+	go func() {
+		defer close(hashesDone)
+		stopPhase := b.stats.StartPhase(PhaseExchange, b.log)
+		if b.shards != nil {
+			// Stops hashing the shards once the records end
+			hashErr = b.writeShardHashes(writer, b.shards, recordsCtx.Done())
+		} else {
+			hashErr = b.writeHashes(writer)
+		}
+		stopPhase()
+		if hashErr != nil {
+			conn.Close()
+		}
+	}()
+	ackEncoder := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features)
+	passEnd := func(pass int64, sent, received uint32, digest []byte) error {
+		if b.shards == nil {
+			<-hashesDone
+		}
+		if sent != received {
+			// Tell the client what was received, so it reports the mismatch too
+			_ = ackEncoder.WritePassAck(pass, received)
+			return fmt.Errorf("%w in pass %d, client sent %08x, received %08x", ErrStreamChecksumMismatch, pass, sent, received)
+		}
+		stopPhase := b.stats.StartPhase(PhaseFsync, b.log)
+		err := b.audit.fsync(f)
+		stopPhase()
+		if err != nil {
+			return err
+		}
+		if b.shards != nil {
+			if err := b.shards.complete(pass); err != nil {
+				return err
+			}
+			b.stats.Update(func(s *Stats) { s.Shards++ })
+			if err := ackEncoder.WritePassAck(pass, received); err != nil {
+				return err
+			}
+			if err := b.writeDigest(ackEncoder, nil); err != nil {
+				return err
+			}
+			b.shards.acked <- struct{}{}
+			return nil
+		}
+		b.log.Info("Pass complete", "pass", pass)
+		if b.resume != nil {
+			// The sync completed, the next one starts over
+			if err := b.resume.remove(); err != nil {
+				return err
+			}
+			b.resume = nil
+		}
+		if b.generation != nil {
+			if err := b.generation.passComplete(); err != nil {
+				return err
+			}
+		}
+		var target []byte
+		var verifyErr error
+		if b.protocol.Features.Has(codec.FeatureSourceDigest) {
+			if target, verifyErr = b.verifyTarget(digest); verifyErr != nil && target == nil {
+				return verifyErr
+			}
+		}
+		if err := ackEncoder.WritePassAck(pass, received); err != nil {
+			return err
+		}
+		// The client compares the digests too, so it reports a mismatch
+		if err := b.writeDigest(ackEncoder, target); err != nil {
+			return err
+		}
+		return verifyErr
+	}
+	b.log.Info("Starting diff reader")
+	var records io.Reader = conn
+	if !b.protocol.Features.Has(codec.FeatureNoCompression) {
+		records = snappy.NewReader(conn)
+	}
+	reader := bufio.NewReader(records)
+	stopPhase := b.stats.StartPhase(PhaseTransfer, b.log)
+	err = b.writeBlocksToFile(f, reader, passEnd)
+	stopPhase()
+	stopRecords()
+	<-hashesDone
+	b.keepResume(f)
+	if errors.Is(err, ErrCancelled) || b.ctx.Err() != nil {
+		return syncCancelled(f, b.stats, b.audit, b.log)
+	}
+	if hashErr != nil {
+		return hashErr
+	}
+	if err != nil {
 		return err
 	}
 
-	if err := f.Sync(); err != nil {
+	stopPhase = b.stats.StartPhase(PhaseFsync, b.log)
+	defer stopPhase()
+	if err := b.audit.fsync(f); err != nil {
 		return err
 	}
+	if b.shards != nil {
+		return b.shards.finish()
+	}
+	if b.generation != nil {
+		// Clients that negotiated passes end every sync with a pass end
+		return b.generation.finish(b.hasher.GetHashes(), b.targetFileSize, b.protocol.Features.Has(codec.FeatureIterative))
+	}
 	return nil
 }
 
+// hashTarget hashes the target and closes hashed, size is set to the size of
+// the target if it was hashed.
+func (b *BlockrsyncServer) hashTarget(hashed chan<- struct{}, size *int64) {
+	defer close(hashed)
+	stopPhase := b.stats.StartPhase(PhaseHashTarget, b.log)
+	hashedSize, err := b.hasher.HashFile(b.targetFile)
+	stopPhase()
+	if err != nil {
+		b.log.Error(err, "Failed to hash file")
+		return
+	}
+	*size = hashedSize
+	b.stats.Update(func(s *Stats) { s.TargetSize = hashedSize })
+	b.log.Info("Hashed file with size", "filename", b.targetFile, "size", hashedSize)
+}
+
+// preflight checks the target has space for the source before any block is
+// accepted, and tells the client why the sync is refused.
+func (b *BlockrsyncServer) preflight(conn io.ReadWriter, f *os.File) error {
+	sourceSize, data, err := codec.NewDecoder(conn, b.protocol.Version, b.protocol.Features).ReadPreflight()
+	if err != nil {
+		return err
+	}
+	checkErr := b.checkSourceSize(sourceSize)
+	if checkErr == nil && !b.opts.SkipSpaceCheck {
+		checkErr = checkSpace(f, b.hasher.IsDevice(), b.targetFileSize, sourceSize, data, b.holes.strategy == HoleStrategyZero)
+	}
+	message := ""
+	if checkErr != nil {
+		message = checkErr.Error()
+	}
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WritePreflightResult(message); err != nil {
+		return err
+	}
+	if checkErr == nil {
+		b.log.Info("Preflight check passed", "source size", sourceSize, "data bytes", data)
+	}
+	return checkErr
+}
+
 func (b *BlockrsyncServer) writeHashes(writer io.WriteCloser) error {
+	defer enterStage("", StageExchange)()
 	defer writer.Close()
-	if err := b.hasher.SerializeHashes(writer); err != nil {
+	encoder := codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
+	if b.protocol.Features.Has(codec.FeatureBloomFilter) {
+		hashes := b.hasher.GetHashes()
+		filter := newBloomFilter(len(hashes))
+		for offset, hash := range hashes {
+			filter.add(offset, hash)
+		}
+		if err := encoder.WriteBloomFilter(filter.hashCount, filter.words); err != nil {
+			return err
+		}
+		b.log.Info("Wrote bloom filter to client", "bytes", len(filter.words)*8)
+	}
+	if b.opts.HashLength > 0 {
+		if err := encoder.SetHashLength(b.opts.HashLength); err != nil {
+			return err
+		}
+	}
+	if hasher := b.streamingHasher(); hasher != nil {
+		if err := hasher.streamHashes(encoder); err != nil {
+			return err
+		}
+	} else if err := b.hasher.SerializeHashes(encoder); err != nil {
 		return err
 	}
 	b.log.Info("Wrote hashes to client")
 	return nil
 }
 
-func (b *BlockrsyncServer) writeBlocksToFile(f *os.File, reader io.Reader) error {
+// streamingHasher returns the hasher of the target if its hashes can be sent
+// while it is hashed, the Bloom filter needs all of them first.
+func (b *BlockrsyncServer) streamingHasher() *FileHasher {
+	hasher, ok := b.hasher.(*FileHasher)
+	if !ok || hasher.precomputed || b.protocol.Features.Has(codec.FeatureBloomFilter) {
+		return nil
+	}
+	return hasher
+}
+
+// writeBlocksToFile applies the records to the file, passEnd is called with
+// the stream checksums and the digest of the source for every pass end record
+// once the pass has been applied.
+func (b *BlockrsyncServer) writeBlocksToFile(f *os.File, reader io.Reader, passEnd func(pass int64, sent, received uint32, digest []byte) error) error {
+	defer enterStage("", StageWrite)()
+	blockReader := newBlockReader(codec.NewDecoder(reader, b.protocol.Version, b.protocol.Features), int(b.hasher.BlockSize()), b.log.WithName("block-reader"))
 	// Read the size of the source file
-	var sourceSize int64
-	if err := binary.Read(reader, binary.LittleEndian, &sourceSize); err != nil {
+	sourceSize, err := blockReader.ReadSourceSize()
+	if err != nil {
 		_, err = handleReadError(err, nocallback)
 		return err
 	}
+	if err := b.checkSourceSize(sourceSize); err != nil {
+		return err
+	}
+	b.sourceSize = sourceSize
+	b.stats.Update(func(s *Stats) { s.SourceSize = sourceSize })
+	if b.generation != nil || sourceSize < b.targetFileSize {
+		// A client that diffs the hashes as they arrive sends blocks while
+		// the target is hashed, which only changes blocks that were hashed.
+		// The generation needs all hashes, and the end of the target must be
+		// hashed before it is removed.
+		<-b.hashed
+	}
+	if b.generation != nil {
+		b.generation.start(b.hasher.GetHashes(), sourceSize)
+		if sourceSize != b.targetFileSize {
+			// Before resizing, so a sync that stops while the target is
+			// resized leaves the generation incomplete
+			if err := b.generation.applying(); err != nil {
+				return err
+			}
+		}
+	}
 	if err := b.truncateFileIfNeeded(f, sourceSize, b.targetFileSize); err != nil {
 		_, err = handleReadError(err, nocallback)
 		return err
 	}
 
-	blockReader := NewBlockReader(reader, int(b.hasher.BlockSize()), b.log.WithName("block-reader"))
+	beforeApply := func(offset int64, block []byte) error {
+		if err := b.opts.Hooks.preWrite(offset, block); err != nil {
+			return err
+		}
+		if b.generation != nil {
+			if err := b.generation.applying(); err != nil {
+				return err
+			}
+		}
+		if b.journal != nil {
+			return b.journal.save(offset)
+		}
+		return nil
+	}
+	applyHole := func(offset int64) error {
+		if err := beforeApply(offset, nil); err != nil {
+			return err
+		}
+		if b.generation != nil {
+			b.generation.applyHole(offset)
+		}
+		if err := b.handleEmptyBlock(offset, f); err != nil {
+			return err
+		}
+		if b.resume != nil {
+			b.resume.appliedHole(offset)
+		}
+		return nil
+	}
+	applyBlock := func(block []byte, offset int64) error {
+		if err := beforeApply(offset, block); err != nil {
+			return err
+		}
+		if b.generation != nil {
+			b.generation.applyBlock(offset, block)
+		}
+		if err := b.holes.flush(); err != nil {
+			return err
+		}
+		if err := b.writeBlockToOffset(block, offset, f); err != nil {
+			return err
+		}
+		if b.resume != nil {
+			b.resume.applied(offset, block)
+		}
+		return nil
+	}
+	var applier *orderedApplier
+	if b.opts.ApplyWindow > 0 {
+		applier = newOrderedApplier(b.opts.ApplyWindow, applyHole, applyBlock, b.log.WithName("ordered-apply"))
+		applier.limit = b.applyLimit
+		applyHole = func(offset int64) error {
+			return applier.add(offset, true, nil)
+		}
+		applyBlock = func(block []byte, offset int64) error {
+			return applier.add(offset, false, block)
+		}
+	}
+	// flush applies the buffered blocks and holes
+	flush := func() error {
+		b.blockLog.flush()
+		if applier != nil {
+			if err := applier.flush(); err != nil {
+				return err
+			}
+		}
+		return b.holes.flush()
+	}
 	cont := true
-	var err error
 	for cont {
 		cont, err = blockReader.Next()
 		if err != nil {
-			// Ignore error
-			return nil
+			return err
+		}
+		if blockReader.IsEnd() {
+			break
+		}
+		if blockReader.IsCancel() || b.ctx.Err() != nil {
+			if blockReader.IsCancel() {
+				b.log.Info("Client cancelled the sync")
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			return ErrCancelled
+		}
+		if blockReader.IsPassEnd() {
+			if err := flush(); err != nil {
+				return err
+			}
+			sent, received, err := blockReader.PassChecksum()
+			if err != nil {
+				return err
+			}
+			var digest []byte
+			if b.protocol.Features.Has(codec.FeatureSourceDigest) {
+				if digest, err = blockReader.Digest(); err != nil {
+					return err
+				}
+			}
+			if err := passEnd(blockReader.Offset(), sent, received, digest); err != nil {
+				return err
+			}
+			continue
+		}
+		if blockReader.IsResize() {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := b.resize(f, blockReader); err != nil {
+				return err
+			}
+			continue
 		}
 		if blockReader.IsHole() {
-			if err := b.handleEmptyBlock(blockReader.Offset(), f); err != nil {
+			if err := applyHole(blockReader.Offset()); err != nil {
 				return err
 			}
+			b.blockLog.add(blockReader.Offset(), 0)
+			holeSize := min(b.sourceSize-blockReader.Offset(), b.hasher.BlockSize())
+			b.stats.Update(func(s *Stats) {
+				s.HolesTransferred++
+				s.HoleBytes += holeSize
+			})
 		} else {
-			if err := b.writeBlockToOffset(blockReader.Block(), blockReader.Offset(), f); err != nil {
+			b.blockLog.add(blockReader.Offset(), int64(len(blockReader.Block())))
+			if err := applyBlock(blockReader.Block(), blockReader.Offset()); err != nil {
+				return err
+			}
+			b.stats.Update(func(s *Stats) {
+				s.BlocksTransferred++
+				s.BytesTransferred += int64(len(blockReader.Block()))
+			})
+		}
+		if b.resume != nil && b.resume.due() {
+			if err := flush(); err != nil {
+				return err
+			}
+			if err := b.commitResume(f); err != nil {
 				return err
 			}
 		}
 	}
+	return flush()
+}
+
+// resize applies a change of the source size between passes.
+func (b *BlockrsyncServer) resize(f *os.File, blockReader *BlockReader) error {
+	size := blockReader.Offset()
+	if err := b.checkSourceSize(size); err != nil {
+		return err
+	}
+	b.log.Info("Source size changed", "from", b.sourceSize, "to", size)
+	if b.generation != nil {
+		if err := b.generation.applying(); err != nil {
+			return err
+		}
+		b.generation.resize(size)
+	}
+	if err := b.truncateFileIfNeeded(f, size, b.sourceSize); err != nil {
+		return err
+	}
+	b.sourceSize = size
+	blockReader.SetSourceSize(size)
+	b.stats.Update(func(s *Stats) { s.SourceSize = size })
 	return nil
 }
 
+// truncateFileIfNeeded makes the size of the target match the source. A file
+// is truncated or extended, the end of a device is handled by the tail
+// policy.
 func (b *BlockrsyncServer) truncateFileIfNeeded(f *os.File, sourceSize, targetSize int64) error {
-	info, err := f.Stat()
-	if err != nil {
-		return err
+	if sourceSize > targetSize {
+		if b.hasher.IsDevice() {
+			if sourceSize > b.targetFileSize {
+				return fmt.Errorf("source size %d is larger than the target device size %d", sourceSize, b.targetFileSize)
+			}
+		} else {
+			// Holes at the end of the source don't extend the file
+			b.log.V(5).Info("Source is larger than target, extending file", "size", sourceSize)
+			if err := b.audit.truncate(f, sourceSize); err != nil {
+				return err
+			}
+		}
 	}
-	if targetSize > sourceSize {
+	preserveTail := b.hasher.IsDevice() && b.opts.TailPolicy == TailPolicyPreserve
+	if targetSize > sourceSize && !preserveTail {
 		b.log.V(5).Info("Source size", "size", sourceSize)
-		if info.Mode()&(os.ModeDevice|os.ModeCharDevice) == 0 {
+		if b.journal != nil {
+			if err := b.journal.saveRange(sourceSize, targetSize); err != nil {
+				return err
+			}
+		}
+		if !b.hasher.IsDevice() {
 			// Not a block device, truncate the file if it is larger than the source file
 			// Truncate the target file if it is larger than the source file
 			b.log.V(5).Info("Source is smaller than target, truncating file")
-			if err := f.Truncate(sourceSize); err != nil {
+			if err := b.audit.truncate(f, sourceSize); err != nil {
 				return err
 			}
-		} else {
-			// empty out existing blocks
-			PunchHole(f, sourceSize, targetSize-sourceSize)
+		} else if err := b.holes.emptyTail(b.opts.TailPolicy, sourceSize, targetSize-sourceSize); err != nil {
+			return err
+		}
+	}
+	if b.opts.PreallocateTarget && !b.hasher.IsDevice() {
+		b.log.V(3).Info("Preallocating target", "size", sourceSize)
+		b.audit.fallocate(f, "0")
+		if err := preallocate(f, sourceSize); err != nil {
+			return fmt.Errorf("unable to preallocate %d bytes for the target: %w", sourceSize, err)
 		}
 	}
 	return nil
 }
 
 func (b *BlockrsyncServer) handleEmptyBlock(offset int64, f *os.File) error {
-	b.log.V(5).Info("Skipping hole", "offset", offset)
-	emptySize := min(b.targetFileSize-offset, b.hasher.BlockSize())
-	if b.opts.Preallocation {
-		b.log.V(5).Info("Preallocating hole", "offset", offset)
-		preallocBuffer := make([]byte, emptySize)
-		if n, err := f.WriteAt(preallocBuffer, offset); err != nil || int64(n) != emptySize {
-			return err
-		}
-	} else {
-		b.log.V(5).Info("Punching hole", "offset", offset, "size", b.hasher.BlockSize())
-		PunchHole(f, offset, b.hasher.BlockSize())
+	emptySize := min(b.sourceSize-offset, b.hasher.BlockSize())
+	if emptySize <= 0 {
+		return fmt.Errorf("hole offset %d is outside of the source size %d", offset, b.sourceSize)
 	}
-	return nil
+	b.blockLog.trace("Applying hole", "offset", offset, "size", emptySize, "strategy", b.holes.strategy)
+	return b.holes.add(offset, emptySize)
 }
 
 func (b *BlockrsyncServer) writeBlockToOffset(block []byte, offset int64, ws io.WriteSeeker) error {
@@ -172,7 +713,7 @@ func (b *BlockrsyncServer) writeBlockToOffset(block []byte, offset int64, ws io.
 	if n, err := ws.Write(block); err != nil {
 		return err
 	} else {
-		b.log.V(5).Info("Wrote", "bytes", n)
+		b.blockLog.trace("Wrote", "bytes", n)
 	}
 	return nil
 }
@@ -0,0 +1,78 @@
+package blockrsync
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/snappy"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// sendRecords starts a server on the target and connects a client that sends
+// the source size and the records, it returns the error of the server.
+func sendRecords(targetFile string, opts *BlockRsyncOptions, sourceSize int64, records func(e *codec.Encoder)) error {
+	port, err := getFreePort()
+	Expect(err).ToNot(HaveOccurred())
+	server := NewBlockrsyncServer(targetFile, port, opts, GinkgoLogr.WithName("server"))
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.StartServer()
+	}()
+	var conn net.Conn
+	Eventually(func() error {
+		conn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
+		return err
+	}).Should(Succeed())
+	defer conn.Close()
+	hello, err := codec.ClientHandshake(conn, codec.LocalHello(codec.FeatureRecordLengths), 0)
+	Expect(err).ToNot(HaveOccurred())
+	// The hashes of the target are not needed
+	go func() {
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+	writer := snappy.NewBufferedWriter(conn)
+	e := codec.NewEncoder(writer, hello.Version, hello.Features)
+	Expect(e.WriteSourceSize(sourceSize)).To(Succeed())
+	records(e)
+	Expect(writer.Close()).To(Succeed())
+	Expect(conn.(*net.TCPConn).CloseWrite()).To(Succeed())
+	return <-serverDone
+}
+
+var _ = Describe("server record tests", func() {
+	var targetFile string
+
+	BeforeEach(func() {
+		targetFile = filepath.Join(GinkgoT().TempDir(), "target.raw")
+		Expect(os.WriteFile(targetFile, make([]byte, 2*4096), 0644)).To(Succeed())
+	})
+
+	It("should apply valid records", func() {
+		block := make([]byte, 4096)
+		block[0] = 1
+		Expect(sendRecords(targetFile, &BlockRsyncOptions{BlockSize: 4096}, 2*4096, func(e *codec.Encoder) {
+			Expect(e.WriteBlock(4096, block)).To(Succeed())
+		})).To(Succeed())
+		data, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(data[4096:]).To(Equal(block))
+	})
+
+	DescribeTable("should fail the sync on an invalid record", func(records func(e *codec.Encoder), expected string) {
+		err := sendRecords(targetFile, &BlockRsyncOptions{BlockSize: 4096}, 2*4096, records)
+		Expect(err).To(MatchError(ContainSubstring(expected)))
+	},
+		Entry("with a bad length", func(e *codec.Encoder) {
+			Expect(e.WriteBlock(0, make([]byte, 100))).To(Succeed())
+		}, "has length 100, expected 4096"),
+		Entry("with a bad offset", func(e *codec.Encoder) {
+			Expect(e.WriteBlock(100000, make([]byte, 4096))).To(Succeed())
+		}, "outside of the source size"),
+	)
+})
@@ -0,0 +1,345 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var (
+	ErrShardsNeedFileHasher = errors.New("a sharded sync hashes the file, it cannot use a custom or precomputed hasher")
+)
+
+// ShardState is written alongside the target after every shard of a sharded
+// sync, a sync of a source of the same size with the same shard size resumes
+// after the completed shards.
+type ShardState struct {
+	ShardSize  int64  `json:"shardSize"`
+	SourceSize int64  `json:"sourceSize"`
+	Completed  int64  `json:"completed"`
+	Time       string `json:"time"`
+}
+
+// ReadShardState reads a shard state file, it returns nil if the file does
+// not exist.
+func ReadShardState(fileName string) (*ShardState, error) {
+	data, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &ShardState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("invalid shard state %s: %w", fileName, err)
+	}
+	return state, nil
+}
+
+// WriteFile replaces the file atomically.
+func (s *ShardState) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fileName, data)
+}
+
+// shardPlan splits a source of size bytes into shards, the shards before
+// first are on the target.
+type shardPlan struct {
+	shardSize int64
+	size      int64
+	first     int64
+	count     int64
+}
+
+func newShardPlan(shardSize, size int64) shardPlan {
+	return shardPlan{shardSize: shardSize, size: size, count: (size + shardSize - 1) / shardSize}
+}
+
+func (p shardPlan) bounds(shard int64) (int64, int64) {
+	start := shard * p.shardSize
+	return start, min(start+p.shardSize, p.size)
+}
+
+func fileHasher(hasher Hasher) (*FileHasher, error) {
+	fileHasher, ok := hasher.(*FileHasher)
+	if !ok || fileHasher.precomputed {
+		return nil, ErrShardsNeedFileHasher
+	}
+	return fileHasher, nil
+}
+
+// startShards sends the shard size and learns from the target which shard to
+// start from.
+func (b *BlockrsyncClient) startShards(w io.Writer, r io.Reader) (shardPlan, error) {
+	plan := newShardPlan(b.opts.ShardSize, b.sourceSize)
+	if err := codec.NewEncoder(w, b.protocol.Version, b.protocol.Features).WriteShards(plan.shardSize, plan.size); err != nil {
+		return plan, err
+	}
+	first, err := codec.NewDecoder(r, b.protocol.Version, b.protocol.Features).ReadShardResume()
+	if err != nil {
+		return plan, err
+	}
+	if first < 0 || first > plan.count {
+		return plan, fmt.Errorf("target asked for shard %d of %d", first, plan.count)
+	}
+	plan.first = first
+	if first > 0 {
+		b.log.Info("Resuming sharded sync", "completed shards", first, "shards", plan.count)
+	}
+	b.stats.Update(func(s *Stats) { s.ShardsSkipped = first })
+	return plan, nil
+}
+
+type hashedShard struct {
+	hasher *FileHasher
+	err    error
+}
+
+// hashShards hashes the shards of the source in order, one shard ahead of
+// the shard being synced.
+func (b *BlockrsyncClient) hashShards(plan shardPlan, hasher *FileHasher, hashed chan<- hashedShard, stop <-chan struct{}) {
+	for shard := plan.first; shard < plan.count; shard++ {
+		shardHasher := hasher.forRange(plan.bounds(shard))
+		stopPhase := b.stats.StartPhase(PhaseHashSource, b.log)
+		_, err := shardHasher.HashFile(b.sourceFile)
+		stopPhase()
+		select {
+		case hashed <- hashedShard{hasher: shardHasher, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendShardByShard diffs every shard with the hashes the target sends for it,
+// sends the blocks that differ and waits for the target to acknowledge the
+// shard is on disk. It returns the number of blocks that differ.
+func (b *BlockrsyncClient) sendShardByShard(plan shardPlan, hasher *FileHasher, decoder, acks *codec.Decoder, encoder *codec.Encoder, writer *compressedWriter, f io.ReaderAt) (int64, error) {
+	hashed := make(chan hashedShard, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go b.hashShards(plan, hasher, hashed, stop)
+	syncProgress := b.opts.progress(ProgressSync, b.overall, b.log)
+	syncProgress.Start(plan.size)
+	var dirty int64
+	for shard := plan.first; shard < plan.count; shard++ {
+		var source hashedShard
+		select {
+		case source = <-hashed:
+		case <-b.ctx.Done():
+			return dirty, ErrCancelled
+		}
+		if source.err != nil {
+			return dirty, source.err
+		}
+		start, end := plan.bounds(shard)
+		stopPhase := b.stats.StartPhase(PhaseExchange, b.log)
+		target, err := readShardHashes(decoder, hasher.BlockSize(), start, end)
+		stopPhase()
+		if err != nil {
+			return dirty, err
+		}
+		diff, err := source.hasher.DiffHashes(hasher.BlockSize(), target)
+		if err != nil {
+			return dirty, err
+		}
+		offsets, err := b.reportDiff(1, diff)
+		if err != nil {
+			return dirty, err
+		}
+		if err := b.sendBlocks(encoder, offsets, f, nil); err != nil {
+			return dirty, err
+		}
+		// The pass ends of a sharded sync count the shards from 1
+		if err := b.waitPassAck(shard+1, encoder, writer, acks); err != nil {
+			return dirty, err
+		}
+		dirty += int64(len(diff))
+		b.stats.Update(func(s *Stats) {
+			s.Shards++
+			s.DifferentBlocks = dirty
+		})
+		b.log.Info("Shard complete", "shard", shard, "of", plan.count, "dirty blocks", len(diff))
+		syncProgress.Update(end)
+	}
+	return dirty, nil
+}
+
+// readShardHashes reads the hashes of the target blocks from start to end.
+func readShardHashes(decoder *codec.Decoder, blockSize, start, end int64) (map[int64][]byte, error) {
+	targetBlockSize, count, err := decoder.ReadHashHeader()
+	if err != nil {
+		return nil, err
+	}
+	if targetBlockSize != blockSize {
+		return nil, fmt.Errorf("block size mismatch, source %d, target %d", blockSize, targetBlockSize)
+	}
+	if count < 0 || count > (end-start+blockSize-1)/blockSize {
+		return nil, fmt.Errorf("invalid hash count %d for the shard from %d to %d", count, start, end)
+	}
+	hashes := make(map[int64][]byte, count)
+	for i := int64(0); i < count; i++ {
+		offset, hash, err := decoder.ReadHash()
+		if err != nil {
+			return nil, err
+		}
+		if offset < start || offset >= end || offset%blockSize != 0 {
+			return nil, fmt.Errorf("invalid offset %d for the shard from %d to %d", offset, start, end)
+		}
+		hashes[offset] = hash
+	}
+	return hashes, nil
+}
+
+// shardTracker records the shards of a sharded sync the target completed.
+type shardTracker struct {
+	plan      shardPlan
+	stateFile string
+	completed int64
+	// acked is signaled once a shard is acknowledged, the hashes of the next
+	// shard follow the ack
+	acked chan struct{}
+	log   logr.Logger
+}
+
+// startShards reads the shard size from the client and tells it the first
+// shard to sync.
+func (b *BlockrsyncServer) startShards(conn io.ReadWriter) (*shardTracker, error) {
+	shardSize, sourceSize, err := codec.NewDecoder(conn, b.protocol.Version, b.protocol.Features).ReadShards()
+	if err != nil {
+		return nil, err
+	}
+	if shardSize <= 0 || shardSize%b.hasher.BlockSize() != 0 {
+		return nil, fmt.Errorf("invalid shard size %d for a source of %d bytes", shardSize, sourceSize)
+	}
+	if err := b.checkSourceSize(sourceSize); err != nil {
+		return nil, err
+	}
+	shards := &shardTracker{
+		plan:      newShardPlan(shardSize, sourceSize),
+		stateFile: b.opts.ShardStateFile,
+		acked:     make(chan struct{}, 1),
+		log:       b.log.WithName("shards"),
+	}
+	if shards.stateFile != "" {
+		state, err := ReadShardState(shards.stateFile)
+		if err != nil {
+			return nil, err
+		}
+		if state != nil && state.ShardSize == shardSize && state.SourceSize == sourceSize {
+			shards.plan.first = min(max(state.Completed, 0), shards.plan.count)
+			shards.log.Info("Resuming sharded sync", "completed shards", shards.plan.first, "shards", shards.plan.count)
+		}
+	}
+	shards.completed = shards.plan.first
+	b.stats.Update(func(s *Stats) { s.ShardsSkipped = shards.plan.first })
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WriteShardResume(shards.plan.first); err != nil {
+		return nil, err
+	}
+	return shards, nil
+}
+
+// complete records the shard is on disk, the pass end of a shard is its
+// index + 1.
+func (s *shardTracker) complete(pass int64) error {
+	if pass != s.completed+1 {
+		return fmt.Errorf("client ended shard %d, expected shard %d", pass-1, s.completed)
+	}
+	s.completed = pass
+	s.log.Info("Shard complete", "shard", pass-1, "of", s.plan.count)
+	if s.stateFile == "" {
+		return nil
+	}
+	state := &ShardState{
+		ShardSize:  s.plan.shardSize,
+		SourceSize: s.plan.size,
+		Completed:  s.completed,
+		Time:       time.Now().UTC().Format(time.RFC3339),
+	}
+	return state.WriteFile(s.stateFile)
+}
+
+// finish removes the shard state once all shards completed, so the next sync
+// starts from the first shard.
+func (s *shardTracker) finish() error {
+	if s.completed < s.plan.count {
+		s.log.Info("Sharded sync stopped", "completed shards", s.completed, "shards", s.plan.count)
+		return nil
+	}
+	if s.stateFile == "" {
+		return nil
+	}
+	if err := os.Remove(s.stateFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeShardHashes sends the hashes of every shard, the hashes of a shard are
+// sent once the previous shard was acknowledged and the shard is hashed
+// while the previous shard is synced.
+func (b *BlockrsyncServer) writeShardHashes(writer flushWriteCloser, shards *shardTracker, stop <-chan struct{}) error {
+	defer enterStage("", StageExchange)()
+	defer writer.Close()
+	encoder := codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
+	if b.opts.HashLength > 0 {
+		if err := encoder.SetHashLength(b.opts.HashLength); err != nil {
+			return err
+		}
+	}
+	hasher, err := fileHasher(b.hasher)
+	if err != nil {
+		return err
+	}
+	hashShard := func(shard int64) *FileHasher {
+		shardHasher := hasher.forRange(shards.plan.bounds(shard))
+		shardHasher.stop = stop
+		go func() {
+			stopPhase := b.stats.StartPhase(PhaseHashTarget, b.log)
+			defer stopPhase()
+			if _, err := shardHasher.HashFile(b.targetFile); err != nil && !errors.Is(err, ErrCancelled) {
+				// The blocks that could not be hashed are sent
+				b.log.Error(err, "Failed to hash shard", "shard", shard)
+			}
+		}()
+		return shardHasher
+	}
+	plan := shards.plan
+	if plan.first == plan.count {
+		return nil
+	}
+	current := hashShard(plan.first)
+	for shard := plan.first; shard < plan.count; shard++ {
+		if err := current.streamHashes(encoder); err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		if shard+1 == plan.count {
+			break
+		}
+		current = hashShard(shard + 1)
+		select {
+		case <-shards.acked:
+		case <-stop:
+			return nil
+		}
+	}
+	b.log.Info("Wrote hashes of all shards to client")
+	return nil
+}
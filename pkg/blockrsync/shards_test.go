@@ -0,0 +1,161 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("shard tests", func() {
+	const shardSize = 8 * 4096
+	var (
+		sourceFile string
+		targetFile string
+		stateFile  string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		stateFile = filepath.Join(tmpDir, "target.shards")
+		// 4 full shards and a partial one ending with a partial block
+		source = make([]byte, 4*shardSize+3*4096+100)
+		_, _ = rand.Read(source[:2*shardSize])
+		_, _ = rand.Read(source[3*shardSize:])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	sync := func(postDiff func(pass int, offsets []int64) error) (*Stats, *Stats, error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")),
+			func(c *constructorConfig) {
+				c.opts.ShardSize = 4096
+				c.opts.ShardStateFile = stateFile
+			})
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithHooks(Hooks{PostDiff: postDiff}), WithLogger(GinkgoLogr.WithName("client")),
+			func(c *constructorConfig) {
+				c.opts.ShardSize = shardSize
+				c.opts.HashConcurrency = 3
+			})
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return client.Stats(), server.Stats(), clientErr, <-serverDone
+	}
+
+	DescribeTable("should sync the source shard by shard", func(targetSize int, dirty []int64) {
+		target := make([]byte, targetSize)
+		copy(target, source)
+		for _, offset := range dirty {
+			_, _ = rand.Read(target[offset : offset+4096])
+		}
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		var diffs [][]int64
+		clientStats, serverStats, clientErr, serverErr := sync(func(pass int, offsets []int64) error {
+			diffs = append(diffs, offsets)
+			return nil
+		})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(diffs).To(HaveLen(5))
+		Expect(clientStats.Shards).To(Equal(int64(5)))
+		Expect(serverStats.Shards).To(Equal(int64(5)))
+		var all []int64
+		for _, diff := range diffs {
+			all = append(all, diff...)
+		}
+		Expect(all).To(ContainElements(dirty))
+		// The target is resized while the first shards are hashed, the end of
+		// the target changes depending on when it is hashed
+		end := int64(min(targetSize, len(source))) / 4096 * 4096
+		for _, offset := range all {
+			if offset < end {
+				Expect(dirty).To(ContainElement(offset))
+			}
+		}
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(stateFile).ToNot(BeAnExistingFile())
+	},
+		Entry("same size", 4*shardSize+3*4096+100, []int64{0, 9 * 4096, 30 * 4096, 4 * shardSize}),
+		Entry("smaller target", shardSize+4096, []int64{4096}),
+		Entry("larger target", 6*shardSize, []int64{2 * shardSize}),
+	)
+
+	It("should resume after the shards the target completed", func() {
+		target := make([]byte, len(source))
+		_, _ = rand.Read(target)
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		stop := errors.New("stop")
+		var shards int
+		_, serverStats, clientErr, _ := sync(func(pass int, offsets []int64) error {
+			if shards++; shards == 3 {
+				return stop
+			}
+			return nil
+		})
+		Expect(clientErr).To(MatchError(stop))
+		Expect(serverStats.Shards).To(Equal(int64(2)))
+		state, err := ReadShardState(stateFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(state.Completed).To(Equal(int64(2)))
+		Expect(state.ShardSize).To(Equal(int64(shardSize)))
+		partial, err := os.ReadFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(partial[:2*shardSize]).To(Equal(source[:2*shardSize]))
+		Expect(bytes.Equal(partial[2*shardSize:], source[2*shardSize:])).To(BeFalse())
+
+		var offsets []int64
+		clientStats, serverStats, clientErr, serverErr := sync(func(pass int, diff []int64) error {
+			offsets = append(offsets, diff...)
+			return nil
+		})
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(clientStats.ShardsSkipped).To(Equal(int64(2)))
+		Expect(clientStats.Shards).To(Equal(int64(3)))
+		Expect(serverStats.ShardsSkipped).To(Equal(int64(2)))
+		Expect(slices.Min(offsets)).To(BeNumerically(">=", 2*shardSize))
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(stateFile).ToNot(BeAnExistingFile())
+	})
+
+	It("should start over if the source size changed", func() {
+		Expect(os.WriteFile(targetFile, make([]byte, len(source)), 0644)).To(Succeed())
+		Expect((&ShardState{ShardSize: shardSize, SourceSize: int64(len(source)) + 1, Completed: 4}).WriteFile(stateFile)).To(Succeed())
+		clientStats, _, clientErr, serverErr := sync(nil)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(clientStats.ShardsSkipped).To(BeZero())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+
+	It("should refuse a sharded sync with a target that doesn't shard", func() {
+		Expect(os.WriteFile(targetFile, nil, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")),
+			func(c *constructorConfig) { c.opts.ShardSize = shardSize })
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(MatchError(ContainSubstring("shards")))
+		<-serverDone
+	})
+})
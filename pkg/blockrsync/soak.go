@@ -0,0 +1,337 @@
+package blockrsync
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	// DefaultSoakSourceSize is the size of the scratch source created for a
+	// soak test
+	DefaultSoakSourceSize = 256 * 1024 * 1024
+	// DefaultSoakMutatedBlocks is the number of blocks of the source changed
+	// before every sync
+	DefaultSoakMutatedBlocks = 64
+	// maxSoakMismatches is the most mismatched blocks reported per iteration
+	maxSoakMismatches = 100
+	// soakPort is the port the in-memory server of an iteration listens on
+	soakPort = 1
+	// soakRetryInterval is the time between attempts to connect to the
+	// server, which listens right away unless the soak test was cancelled
+	soakRetryInterval = 10 * time.Millisecond
+)
+
+// SoakOptions configure a soak test, the zero value runs until cancelled.
+type SoakOptions struct {
+	// Iterations stops after this many syncs, Duration once it ran for this
+	// long, 0 doesn't stop
+	Iterations int
+	Duration   time.Duration
+	// SourceSize is the size of the scratch source created when it doesn't
+	// exist, DefaultSoakSourceSize if 0
+	SourceSize int64
+	// MutatedBlocks is the number of blocks of the source changed before
+	// every sync, a quarter of them emptied, DefaultSoakMutatedBlocks if 0
+	MutatedBlocks int
+	// Seed picks the mutated blocks, so the same blocks are mutated again
+	Seed int64
+	// StopOnFailure stops at the first iteration that fails
+	StopOnFailure bool
+}
+
+// SoakIteration is a sync of the soak test that failed.
+type SoakIteration struct {
+	Iteration int `json:"iteration"`
+	// Mismatches are the offsets of the first blocks the target didn't match
+	// the source at after the sync
+	Mismatches []int64 `json:"mismatches,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// SoakReport sums up the iterations of a soak test.
+type SoakReport struct {
+	Iterations        int             `json:"iterations"`
+	Failures          int             `json:"failures"`
+	BlocksTransferred int64           `json:"blocksTransferred"`
+	HolesTransferred  int64           `json:"holesTransferred"`
+	BytesTransferred  int64           `json:"bytesTransferred"`
+	MinMilliseconds   int64           `json:"minMilliseconds"`
+	MaxMilliseconds   int64           `json:"maxMilliseconds"`
+	TotalMilliseconds int64           `json:"totalMilliseconds"`
+	Failed            []SoakIteration `json:"failed,omitempty"`
+}
+
+// Summary describes the soak test on a single line.
+func (r *SoakReport) Summary() string {
+	average := int64(0)
+	if r.Iterations > 0 {
+		average = r.TotalMilliseconds / int64(r.Iterations)
+	}
+	return fmt.Sprintf("%d iterations, %d failed, %d blocks and %d holes transferred, %d bytes sent, sync took %d/%d/%d ms min/avg/max",
+		r.Iterations, r.Failures, r.BlocksTransferred, r.HolesTransferred, r.BytesTransferred, r.MinMilliseconds, average, r.MaxMilliseconds)
+}
+
+// SoakTest qualifies the storage of a target by mutating a scratch source,
+// syncing it to the target through the client and server in one process, and
+// comparing the target with the source, over and over.
+type SoakTest struct {
+	sourceFile string
+	targetFile string
+	soak       SoakOptions
+	opts       *BlockRsyncOptions
+	log        logr.Logger
+	random     *mathrand.Rand
+	mu         sync.Mutex
+	stats      *Stats
+	cancelSync func()
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+func NewSoakTest(sourceFile, targetFile string, soak SoakOptions, opts *BlockRsyncOptions, logger logr.Logger) *SoakTest {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &SoakTest{
+		sourceFile: sourceFile,
+		targetFile: targetFile,
+		soak:       soak,
+		opts:       opts,
+		log:        logger,
+		random:     mathrand.New(mathrand.NewSource(soak.Seed)),
+		stats:      NewStats(),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// Stats returns the statistics of the current or last sync.
+func (s *SoakTest) Stats() *Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
+
+// Cancel stops the soak test, the sync in flight is cancelled and Run returns
+// the report of the completed iterations.
+func (s *SoakTest) Cancel() {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancelSync != nil {
+		s.cancelSync()
+	}
+}
+
+// Run runs the iterations until one of the limits is reached, or the soak test
+// is cancelled. Failed iterations are reported, Run only fails if the source
+// can't be prepared or mutated.
+func (s *SoakTest) Run() (*SoakReport, error) {
+	report := &SoakReport{}
+	if err := s.prepareSource(); err != nil {
+		return report, err
+	}
+	start := time.Now()
+	for i := 1; s.soak.Iterations == 0 || i <= s.soak.Iterations; i++ {
+		if s.soak.Duration > 0 && time.Since(start) >= s.soak.Duration {
+			break
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+		if err := s.mutate(); err != nil {
+			return report, err
+		}
+		t := time.Now()
+		stats, err := s.sync()
+		if err != nil && s.ctx.Err() != nil {
+			// Cancelling closes the connections, the sync fails with any error
+			break
+		}
+		elapsed := time.Since(t).Milliseconds()
+		var mismatches []int64
+		if err == nil {
+			mismatches, err = s.verify()
+		}
+		report.add(i, elapsed, stats, mismatches, err)
+		if err != nil || len(mismatches) > 0 {
+			s.log.Info("Soak iteration failed", "iteration", i, "mismatches", len(mismatches), "error", err)
+			if s.soak.StopOnFailure {
+				break
+			}
+			continue
+		}
+		s.log.Info("Soak iteration passed", "iteration", i, "milliseconds", elapsed, "blocks", stats.BlocksTransferred)
+	}
+	return report, nil
+}
+
+func (r *SoakReport) add(iteration int, milliseconds int64, stats *Stats, mismatches []int64, err error) {
+	if r.Iterations == 0 || milliseconds < r.MinMilliseconds {
+		r.MinMilliseconds = milliseconds
+	}
+	r.MaxMilliseconds = max(r.MaxMilliseconds, milliseconds)
+	r.TotalMilliseconds += milliseconds
+	r.Iterations++
+	stats.Update(func(s *Stats) {
+		r.BlocksTransferred += s.BlocksTransferred
+		r.HolesTransferred += s.HolesTransferred
+		r.BytesTransferred += s.BytesTransferred
+	})
+	if err == nil && len(mismatches) == 0 {
+		return
+	}
+	r.Failures++
+	failed := SoakIteration{Iteration: iteration, Mismatches: mismatches}
+	if err != nil {
+		failed.Error = err.Error()
+	}
+	r.Failed = append(r.Failed, failed)
+}
+
+// prepareSource creates a scratch source of random data if it doesn't exist.
+func (s *SoakTest) prepareSource() error {
+	if _, err := os.Stat(s.sourceFile); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	size := s.soak.SourceSize
+	if size <= 0 {
+		size = DefaultSoakSourceSize
+	}
+	s.log.Info("Creating scratch source", "file", s.sourceFile, "size", size)
+	f, err := os.OpenFile(s.sourceFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, rand.Reader, size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mutate writes random data to random blocks of the source, and zeroes to a
+// quarter of them so holes are synced too.
+func (s *SoakTest) mutate() error {
+	f, err := os.OpenFile(s.sourceFile, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	blockSize := int64(s.opts.BlockSize)
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	blocks := (size + blockSize - 1) / blockSize
+	if blocks == 0 {
+		return nil
+	}
+	count := s.soak.MutatedBlocks
+	if count <= 0 {
+		count = DefaultSoakMutatedBlocks
+	}
+	buf := make([]byte, blockSize)
+	for i := 0; i < count; i++ {
+		offset := s.random.Int63n(blocks) * blockSize
+		data := buf[:min(blockSize, size-offset)]
+		if i%4 == 3 {
+			clear(data)
+		} else {
+			s.random.Read(data)
+		}
+		if _, err := f.WriteAt(data, offset); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// sync syncs the source to the target over an in-memory transport.
+func (s *SoakTest) sync() (*Stats, error) {
+	opts := *s.opts
+	opts.Transport = transport.NewMemory(0)
+	opts.RetryInterval = soakRetryInterval
+	server := NewBlockrsyncServer(s.targetFile, soakPort, &opts, s.log.WithName("server"))
+	client := NewBlockrsyncClient(s.sourceFile, "localhost", soakPort, &opts, s.log.WithName("client"))
+	s.mu.Lock()
+	s.stats = client.Stats()
+	s.cancelSync = func() {
+		client.Cancel()
+		server.Cancel()
+	}
+	s.mu.Unlock()
+	if s.ctx.Err() != nil {
+		return client.Stats(), ErrCancelled
+	}
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- server.StartServer()
+	}()
+	err := client.ConnectToTarget()
+	if err != nil {
+		server.Cancel()
+	}
+	if serr := <-serverDone; err == nil {
+		err = serr
+	}
+	return client.Stats(), err
+}
+
+// verify compares the target with the source, and returns the offsets of the
+// first blocks that differ. Only the size of the source is compared on a
+// device target.
+func (s *SoakTest) verify() ([]int64, error) {
+	source, err := os.Open(s.sourceFile)
+	if err != nil {
+		return nil, err
+	}
+	defer source.Close()
+	target, err := os.Open(s.targetFile)
+	if err != nil {
+		return nil, err
+	}
+	defer target.Close()
+	sourceInfo, err := source.Stat()
+	if err != nil {
+		return nil, err
+	}
+	targetInfo, err := target.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if targetInfo.Mode().IsRegular() && targetInfo.Size() != sourceInfo.Size() {
+		return nil, fmt.Errorf("the target is %d bytes, the source %d bytes", targetInfo.Size(), sourceInfo.Size())
+	}
+	blockSize := int64(s.opts.BlockSize)
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	var mismatches []int64
+	sourceBuf, targetBuf := make([]byte, blockSize), make([]byte, blockSize)
+	for offset := int64(0); offset < sourceInfo.Size() && len(mismatches) < maxSoakMismatches; offset += blockSize {
+		n, err := source.ReadAt(sourceBuf, offset)
+		if err != nil && err != io.EOF {
+			return mismatches, err
+		}
+		if _, err := target.ReadAt(targetBuf[:n], offset); err != nil && err != io.EOF {
+			return mismatches, err
+		}
+		if !bytes.Equal(sourceBuf[:n], targetBuf[:n]) {
+			mismatches = append(mismatches, offset)
+		}
+	}
+	return mismatches, nil
+}
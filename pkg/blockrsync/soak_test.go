@@ -0,0 +1,58 @@
+package blockrsync
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("soak tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+	})
+
+	It("should create the source, and sync and verify every iteration", func() {
+		soak := SoakOptions{Iterations: 3, SourceSize: 16*4096 + 100, MutatedBlocks: 4, Seed: 1}
+		report, err := NewSoakTest(sourceFile, targetFile, soak, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("soak")).Run()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Iterations).To(Equal(3))
+		Expect(report.Failures).To(BeZero())
+		Expect(report.Failed).To(BeEmpty())
+		Expect(report.BlocksTransferred).To(BeNumerically(">", 0))
+		Expect(report.MaxMilliseconds).To(BeNumerically(">=", report.MinMilliseconds))
+		Expect(os.ReadFile(targetFile)).To(Equal(must(os.ReadFile(sourceFile))))
+	})
+
+	It("should report the blocks of the target that don't match the source", func() {
+		Expect(os.WriteFile(sourceFile, make([]byte, 4*4096), 0644)).To(Succeed())
+		soakTest := NewSoakTest(sourceFile, targetFile, SoakOptions{}, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("soak"))
+		target := make([]byte, 4*4096)
+		target[2*4096] = 1
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		Expect(soakTest.verify()).To(Equal([]int64{2 * 4096}))
+	})
+
+	It("should stop when cancelled", func() {
+		soak := SoakOptions{SourceSize: 16 * 4096, MutatedBlocks: 1}
+		soakTest := NewSoakTest(sourceFile, targetFile, soak, &BlockRsyncOptions{BlockSize: 4096}, GinkgoLogr.WithName("soak"))
+		time.AfterFunc(200*time.Millisecond, soakTest.Cancel)
+		report, err := soakTest.Run()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.Failures).To(BeZero())
+	})
+})
+
+func must[T any](v T, err error) T {
+	Expect(err).ToNot(HaveOccurred())
+	return v
+}
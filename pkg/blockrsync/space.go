@@ -0,0 +1,103 @@
+package blockrsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var (
+	ErrInsufficientSpace = errors.New("not enough space for the source on the target")
+	ErrPreflightRefused  = errors.New("target refused the sync")
+	ErrSourceSizeRefused = errors.New("target refused the size of the source")
+)
+
+// dataSize returns the bytes of the source that are not holes, from its block
+// hashes.
+func dataSize(hashes map[int64][]byte, blockSize, size int64, algorithm HashAlgorithm) int64 {
+	emptyHash := algorithm.sum(make([]byte, blockSize))
+	lastEmptyHash := algorithm.sum(make([]byte, size%blockSize))
+	var data int64
+	for offset, hash := range hashes {
+		length := min(blockSize, size-offset)
+		if length <= 0 {
+			continue
+		}
+		empty := emptyHash
+		if length < blockSize {
+			empty = lastEmptyHash
+		}
+		if !bytes.Equal(hash, empty) {
+			data += length
+		}
+	}
+	return data
+}
+
+// allocatedSize returns the bytes allocated to the file, at most size, as the
+// data of a source that is not hashed yet. A device has size bytes of data.
+func allocatedSize(f *os.File, size int64) int64 {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeDevice != 0 {
+		return size
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return size
+	}
+	return min(size, stat.Blocks*512)
+}
+
+// checkSpace returns ErrInsufficientSpace if the target can't hold the
+// source. A file needs the data of the source allocated, or the whole source
+// if holes are written with zeroes, the blocks the file already has are
+// reused.
+func checkSpace(f *os.File, isDevice bool, targetSize, sourceSize, data int64, allocateHoles bool) error {
+	if isDevice {
+		if sourceSize > targetSize {
+			return fmt.Errorf("%w: the source is %d bytes, the target device is %d bytes", ErrInsufficientSpace, sourceSize, targetSize)
+		}
+		return nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	var fs syscall.Statfs_t
+	if err := syscall.Fstatfs(int(f.Fd()), &fs); err != nil {
+		return err
+	}
+	needed := data
+	if allocateHoles {
+		needed = sourceSize
+	}
+	needed -= stat.Blocks * 512
+	available := int64(fs.Bavail) * int64(fs.Bsize)
+	if needed > available {
+		return fmt.Errorf("%w: the filesystem has %d bytes available, the sync needs %d more bytes (source %d bytes, %d bytes of data)", ErrInsufficientSpace, available, needed, sourceSize, data)
+	}
+	return nil
+}
+
+// checkSourceSize returns ErrSourceSizeRefused if the target can't take a
+// source of size bytes, the size comes from the peer and is checked before
+// the target is resized.
+func (b *BlockrsyncServer) checkSourceSize(size int64) error {
+	switch {
+	case size < 0:
+		return fmt.Errorf("%w: invalid size %d", ErrSourceSizeRefused, size)
+	case b.hasher.IsDevice() && size > b.targetFileSize:
+		return fmt.Errorf("%w: the source is %d bytes, the target device is %d bytes", ErrSourceSizeRefused, size, b.targetFileSize)
+	case b.opts.MaxSourceSize > 0 && size > b.opts.MaxSourceSize:
+		return fmt.Errorf("%w: the source is %d bytes, at most %d bytes are accepted", ErrSourceSizeRefused, size, b.opts.MaxSourceSize)
+	case b.opts.MaxTargetGrowth > 0 && !b.hasher.IsDevice() && size-b.targetFileSize > b.opts.MaxTargetGrowth:
+		return fmt.Errorf("%w: the source is %d bytes, the target of %d bytes may grow by at most %d bytes", ErrSourceSizeRefused, size, b.targetFileSize, b.opts.MaxTargetGrowth)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("space check tests", func() {
+	var f *os.File
+
+	BeforeEach(func() {
+		var err error
+		f, err = os.Create(filepath.Join(GinkgoT().TempDir(), "target.raw"))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(f.Close)
+	})
+
+	It("should count the data of the source", func() {
+		sourceFile := filepath.Join(GinkgoT().TempDir(), "source.raw")
+		data := make([]byte, 4*4096+100)
+		_, _ = rand.Read(data[4096 : 2*4096])
+		_, _ = rand.Read(data[4*4096:])
+		Expect(os.WriteFile(sourceFile, data, 0644)).To(Succeed())
+		hasher := NewFileHasher(4096, GinkgoLogr.WithName("hasher"))
+		size, err := hasher.HashFile(sourceFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dataSize(hasher.GetHashes(), 4096, size, HashBLAKE2b)).To(Equal(int64(4096 + 100)))
+	})
+
+	It("should accept a source that fits", func() {
+		Expect(checkSpace(f, false, 0, 1<<20, 1<<20, false)).To(Succeed())
+	})
+
+	It("should refuse a source larger than the available space", func() {
+		err := checkSpace(f, false, 0, 1<<60, 1<<60, false)
+		Expect(err).To(MatchError(ErrInsufficientSpace))
+	})
+
+	It("should only count the data of the source unless holes are allocated", func() {
+		Expect(checkSpace(f, false, 0, 1<<60, 1<<20, false)).To(Succeed())
+		Expect(checkSpace(f, false, 0, 1<<60, 1<<20, true)).To(MatchError(ErrInsufficientSpace))
+	})
+
+	It("should refuse a source larger than the target device", func() {
+		Expect(checkSpace(f, true, 1<<20, 1<<20, 1<<20, false)).To(Succeed())
+		Expect(checkSpace(f, true, 1<<20, 1<<20+4096, 0, false)).To(MatchError(ErrInsufficientSpace))
+	})
+})
+
+var _ = Describe("source size tests", func() {
+	DescribeTable("should check the size of the source", func(opts BlockRsyncOptions, size int64, refused bool) {
+		opts.BlockSize = 4096
+		server := NewBlockrsyncServer(filepath.Join(GinkgoT().TempDir(), "target.raw"), 0, &opts, GinkgoLogr.WithName("server"))
+		server.targetFileSize = 1 << 20
+		if refused {
+			Expect(server.checkSourceSize(size)).To(MatchError(ErrSourceSizeRefused))
+		} else {
+			Expect(server.checkSourceSize(size)).To(Succeed())
+		}
+	},
+		Entry("unlimited", BlockRsyncOptions{}, int64(1<<40), false),
+		Entry("negative", BlockRsyncOptions{}, int64(-1), true),
+		Entry("at the maximum size", BlockRsyncOptions{MaxSourceSize: 1 << 21}, int64(1<<21), false),
+		Entry("above the maximum size", BlockRsyncOptions{MaxSourceSize: 1 << 21}, int64(1<<21+1), true),
+		Entry("within the growth", BlockRsyncOptions{MaxTargetGrowth: 4096}, int64(1<<20+4096), false),
+		Entry("beyond the growth", BlockRsyncOptions{MaxTargetGrowth: 4096}, int64(1<<20+4097), true),
+		Entry("shrinking with a growth limit", BlockRsyncOptions{MaxTargetGrowth: 4096}, int64(0), false),
+	)
+
+	DescribeTable("should not resize the target for a refused source", func(compat string) {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		Expect(os.WriteFile(sourceFile, make([]byte, 4*4096), 0644)).To(Succeed())
+		Expect(os.WriteFile(targetFile, make([]byte, 4096), 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, Compat: compat, MaxTargetGrowth: 2 * 4096}, GinkgoLogr.WithName("server"))
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, Compat: compat}, GinkgoLogr.WithName("client"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		Expect(<-serverDone).To(MatchError(ErrSourceSizeRefused))
+		if compat == "" {
+			Expect(clientErr).To(MatchError(ErrPreflightRefused))
+		}
+		info, err := os.Stat(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(4096)))
+	},
+		Entry("in the preflight", ""),
+		Entry("in the record stream", "v0"),
+	)
+})
@@ -1,20 +1,78 @@
 package blockrsync
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"os"
 	"syscall"
+
+	"github.com/go-logr/logr"
 )
 
 const (
 	FALLOC_FL_KEEP_SIZE  = 0x01 /* default is extend size */
 	FALLOC_FL_PUNCH_HOLE = 0x02 /* de-allocates range */
+
+	// maxZeroWriteSize limits the buffer used to write zeroes
+	maxZeroWriteSize = 1024 * 1024
 )
 
 var (
 	ErrPunchHoleNotSupported = errors.New("this filesystem does not support punching holes. Use xfs, ext4, btrfs or such")
 )
 
+// HoleStrategy is how the server empties the target blocks of source holes.
+type HoleStrategy string
+
+const (
+	// HoleStrategyAuto probes the target, and punches holes if it can or
+	// writes zeroes
+	HoleStrategyAuto  HoleStrategy = ""
+	HoleStrategyPunch HoleStrategy = "punch"
+	HoleStrategyZero  HoleStrategy = "zero"
+	// HoleStrategyDiscard discards the blocks of a device, the unaligned
+	// parts of a hole are written with zeroes
+	HoleStrategyDiscard HoleStrategy = "discard"
+	// HoleStrategySkip leaves the target blocks alone, it is only correct if
+	// they are known to be empty
+	HoleStrategySkip HoleStrategy = "skip"
+)
+
+func ParseHoleStrategy(s string) (HoleStrategy, error) {
+	switch strategy := HoleStrategy(s); strategy {
+	case HoleStrategyPunch, HoleStrategyZero, HoleStrategyDiscard, HoleStrategySkip:
+		return strategy, nil
+	case "auto", HoleStrategyAuto:
+		return HoleStrategyAuto, nil
+	}
+	return "", fmt.Errorf("invalid hole strategy %q, must be auto, punch, zero, discard or skip", s)
+}
+
+// TailPolicy is what happens to the end of a target device that is larger
+// than the source.
+type TailPolicy string
+
+const (
+	// TailPolicyPunch empties the end with the hole strategy of the target
+	TailPolicyPunch TailPolicy = ""
+	// TailPolicyZero writes zeroes to the end, whatever the hole strategy
+	TailPolicyZero TailPolicy = "zero"
+	// TailPolicyPreserve leaves the end alone, for metadata stored past the
+	// replicated region
+	TailPolicyPreserve TailPolicy = "preserve"
+)
+
+func ParseTailPolicy(s string) (TailPolicy, error) {
+	switch policy := TailPolicy(s); policy {
+	case TailPolicyZero, TailPolicyPreserve:
+		return policy, nil
+	case "punch", TailPolicyPunch:
+		return TailPolicyPunch, nil
+	}
+	return "", fmt.Errorf("invalid tail policy %q, must be punch, zero or preserve", s)
+}
+
 func PunchHole(f *os.File, offset, size int64) error {
 	err := syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE|FALLOC_FL_PUNCH_HOLE, offset, size)
 
@@ -24,3 +82,203 @@ func PunchHole(f *os.File, offset, size int64) error {
 
 	return err
 }
+
+// preallocate allocates the file up to size, the allocated blocks read as
+// zeroes.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(f.Fd()), 0, 0, size)
+}
+
+// writeZeroes writes the zeroes in chunks aligned to maxZeroWriteSize.
+func writeZeroes(f *os.File, offset, size int64) error {
+	zeroes := make([]byte, min(size, maxZeroWriteSize))
+	for size > 0 {
+		n := min(size, maxZeroWriteSize-offset%maxZeroWriteSize)
+		if _, err := f.WriteAt(zeroes[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		size -= n
+	}
+	return nil
+}
+
+// holeWriter applies holes to the target with a strategy. Contiguous holes
+// are collected and applied as one range, so they are emptied in large
+// chunks.
+type holeWriter struct {
+	f        *os.File
+	strategy HoleStrategy
+	device   *deviceProperties
+	audit    *auditor
+	start    int64
+	end      int64
+	// bestEffort records the ranges that could not be emptied in the stats
+	// instead of failing
+	bestEffort bool
+	stats      *Stats
+	log        logr.Logger
+}
+
+func (h *holeWriter) add(offset, size int64) error {
+	if h.end > h.start && offset == h.end {
+		h.end += size
+		return nil
+	}
+	if err := h.flush(); err != nil {
+		return err
+	}
+	h.start, h.end = offset, offset+size
+	return nil
+}
+
+// flush applies the collected holes, it must be called before the target is
+// written or synced.
+func (h *holeWriter) flush() error {
+	if h.end <= h.start {
+		return nil
+	}
+	start, end := h.start, h.end
+	h.start, h.end = 0, 0
+	if err := h.emptyRange(start, end-start); err != nil {
+		return h.failed(start, end-start, fmt.Errorf("unable to apply holes from offset %d to %d with the %s hole strategy: %w", start, end, h.strategy, err))
+	}
+	return nil
+}
+
+// failed returns the error of a range that could not be emptied, or records
+// it as degraded with best effort holes.
+func (h *holeWriter) failed(offset, size int64, err error) error {
+	if !h.bestEffort {
+		return err
+	}
+	h.log.Info("Unable to empty a range of the target, it may hold stale data", "offset", offset, "size", size, "error", err.Error())
+	h.stats.Update(func(s *Stats) {
+		s.DegradedRegions = append(s.DegradedRegions, DegradedRegion{Offset: offset, Size: size, Error: err.Error()})
+	})
+	return nil
+}
+
+// emptyRange empties the range of the target with the strategy.
+func (h *holeWriter) emptyRange(offset, size int64) error {
+	switch h.strategy {
+	case HoleStrategyPunch:
+		h.audit.fallocate(h.f, punchHoleMode)
+		return PunchHole(h.f, offset, size)
+	case HoleStrategyZero:
+		return writeZeroes(h.f, offset, size)
+	case HoleStrategyDiscard:
+		h.audit.ioctl(h.f, "BLKDISCARD")
+		return discardRange(h.f, h.device, offset, size)
+	}
+	return nil
+}
+
+// emptyTail applies the tail policy to the end of a device past the source.
+func (h *holeWriter) emptyTail(policy TailPolicy, offset, size int64) error {
+	switch policy {
+	case TailPolicyPreserve:
+		return nil
+	case TailPolicyZero:
+		if err := writeZeroes(h.f, offset, size); err != nil {
+			return h.failed(offset, size, fmt.Errorf("unable to write zeroes to the end of the target: %w", err))
+		}
+		return nil
+	}
+	if err := h.emptyRange(offset, size); err != nil {
+		return h.failed(offset, size, fmt.Errorf("unable to empty the end of the target with the %s hole strategy: %w", h.strategy, err))
+	}
+	return nil
+}
+
+// newHoleWriter picks how holes are applied to the target, unless the options
+// set it. A device is probed with the hashes of the target.
+func newHoleWriter(f *os.File, opts *BlockRsyncOptions, hasher Hasher, size int64, stats *Stats, audit *auditor, log logr.Logger) (*holeWriter, error) {
+	holes := &holeWriter{
+		f:          f,
+		strategy:   opts.HoleStrategy,
+		audit:      audit,
+		bestEffort: opts.BestEffortHoles,
+		stats:      stats,
+		log:        log,
+	}
+	if hasher.IsDevice() {
+		device, err := readDeviceProperties(f)
+		if err != nil {
+			log.Info("Unable to read the device properties", "error", err.Error())
+		} else {
+			log.V(3).Info("Device properties", "name", device.name, "discard granularity", device.discardGranularity, "discard max bytes", device.discardMaxBytes)
+			holes.device = device
+		}
+	}
+	reason := "set by the options"
+	switch {
+	case holes.strategy == HoleStrategyAuto && (opts.Preallocation || opts.PreallocateTarget):
+		holes.strategy = HoleStrategyZero
+		reason = "the target is preallocated"
+	case holes.strategy == HoleStrategyAuto:
+		var err error
+		if holes.strategy, reason, err = probeHoleStrategy(f, hasher, holes.device, size, audit); err != nil {
+			return nil, err
+		}
+	case holes.strategy == HoleStrategyDiscard:
+		if holes.device == nil || !holes.device.canDiscard() {
+			return nil, errors.New("the discard hole strategy requires a block device that supports discard")
+		}
+		if !holes.device.discardZeroes {
+			log.Info("Discarded blocks may not read back as zeroes", "device", holes.device.name)
+		}
+	}
+	log.Info("Selected hole strategy", "strategy", holes.strategy, "reason", reason)
+	return holes, nil
+}
+
+// probeHoleStrategy picks the hole strategy of the target, and returns the
+// reason for it. Device properties are nil for files, or if they could not be
+// read.
+func probeHoleStrategy(f *os.File, hasher Hasher, device *deviceProperties, size int64, audit *auditor) (HoleStrategy, string, error) {
+	if !hasher.IsDevice() {
+		// Punching past the end of a file keeps its contents
+		return probePunchHole(f, size, hasher.BlockSize(), audit)
+	}
+	strategy, reason := HoleStrategyZero, "the device has no empty block to probe"
+	// Punching a block that is already empty keeps the contents of a device
+	if offset, ok := findEmptyBlock(hasher, size); ok {
+		var err error
+		if strategy, reason, err = probePunchHole(f, offset, hasher.BlockSize(), audit); err != nil || strategy == HoleStrategyPunch {
+			return strategy, reason, err
+		}
+	}
+	if device != nil && device.discardZeroes && device.canDiscard() {
+		return HoleStrategyDiscard, fmt.Sprintf("%s frees discarded blocks", device.name), nil
+	}
+	return strategy, reason, nil
+}
+
+func probePunchHole(f *os.File, offset, size int64, audit *auditor) (HoleStrategy, string, error) {
+	audit.fallocate(f, punchHoleMode)
+	err := PunchHole(f, offset, size)
+	if err == nil {
+		return HoleStrategyPunch, "punching holes is supported", nil
+	}
+	if errors.Is(err, ErrPunchHoleNotSupported) {
+		return HoleStrategyZero, "punching holes is not supported", nil
+	}
+	return "", "", fmt.Errorf("unable to probe punching holes: %w", err)
+}
+
+// findEmptyBlock returns the offset of a complete block of the target that
+// only holds zeroes, or a fill pattern that is a hole as well.
+func findEmptyBlock(hasher Hasher, size int64) (int64, bool) {
+	blockSize := hasher.BlockSize()
+	emptyHash := hashAlgorithmOf(hasher).sum(make([]byte, blockSize))
+	for offset, hash := range hasher.GetHashes() {
+		if offset+blockSize <= size && bytes.Equal(hash, emptyHash) {
+			return offset, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,206 @@
+package blockrsync
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("hole strategy tests", func() {
+	var (
+		targetFile string
+		data       []byte
+	)
+
+	BeforeEach(func() {
+		targetFile = filepath.Join(GinkgoT().TempDir(), "target.raw")
+		data = make([]byte, 4*4096)
+		_, _ = rand.Read(data[:2*4096])
+		Expect(os.WriteFile(targetFile, data, 0644)).To(Succeed())
+	})
+
+	DescribeTable("should parse hole strategies", func(s string, expected HoleStrategy) {
+		Expect(ParseHoleStrategy(s)).To(Equal(expected))
+	},
+		Entry("auto", "auto", HoleStrategyAuto),
+		Entry("empty", "", HoleStrategyAuto),
+		Entry("punch", "punch", HoleStrategyPunch),
+		Entry("zero", "zero", HoleStrategyZero),
+		Entry("discard", "discard", HoleStrategyDiscard),
+		Entry("skip", "skip", HoleStrategySkip),
+	)
+
+	It("should reject unknown hole strategies", func() {
+		_, err := ParseHoleStrategy("trim")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should probe a file without changing it", func() {
+		hasher := NewFileHasher(4096, GinkgoLogr.WithName("hasher"))
+		size, err := hasher.HashFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		strategy, _, err := probeHoleStrategy(f, hasher, nil, size, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strategy).To(Or(Equal(HoleStrategyPunch), Equal(HoleStrategyZero)))
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+	})
+
+	It("should find an empty block of the target", func() {
+		hasher := NewFileHasher(4096, GinkgoLogr.WithName("hasher"))
+		size, err := hasher.HashFile(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		offset, ok := findEmptyBlock(hasher, size)
+		Expect(ok).To(BeTrue())
+		Expect(offset).To(BeNumerically(">=", 2*4096))
+		_, ok = findEmptyBlock(hasher, 2*4096)
+		Expect(ok).To(BeFalse())
+	})
+
+	DescribeTable("should empty a range", func(strategy HoleStrategy) {
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		holes := &holeWriter{f: f, strategy: strategy}
+		Expect(holes.emptyRange(4096, 4096)).To(Succeed())
+		expected := bytes.Clone(data)
+		if strategy != HoleStrategySkip {
+			copy(expected[4096:2*4096], make([]byte, 4096))
+		}
+		Expect(os.ReadFile(targetFile)).To(Equal(expected))
+	},
+		Entry("punch", HoleStrategyPunch),
+		Entry("zero", HoleStrategyZero),
+		Entry("skip", HoleStrategySkip),
+	)
+
+	DescribeTable("should parse tail policies", func(s string, expected TailPolicy) {
+		Expect(ParseTailPolicy(s)).To(Equal(expected))
+	},
+		Entry("empty", "", TailPolicyPunch),
+		Entry("punch", "punch", TailPolicyPunch),
+		Entry("zero", "zero", TailPolicyZero),
+		Entry("preserve", "preserve", TailPolicyPreserve),
+	)
+
+	It("should reject unknown tail policies", func() {
+		_, err := ParseTailPolicy("truncate")
+		Expect(err).To(HaveOccurred())
+	})
+
+	DescribeTable("should apply the tail policy to the end of the target", func(policy TailPolicy, strategy HoleStrategy, emptied bool) {
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		holes := &holeWriter{f: f, strategy: strategy}
+		Expect(holes.emptyTail(policy, 4096, 3*4096)).To(Succeed())
+		expected := bytes.Clone(data)
+		if emptied {
+			copy(expected[4096:], make([]byte, 3*4096))
+		}
+		Expect(os.ReadFile(targetFile)).To(Equal(expected))
+	},
+		Entry("punch", TailPolicyPunch, HoleStrategyPunch, true),
+		Entry("punch with holes skipped", TailPolicyPunch, HoleStrategySkip, false),
+		Entry("zero with holes skipped", TailPolicyZero, HoleStrategySkip, true),
+		Entry("preserve", TailPolicyPreserve, HoleStrategyZero, false),
+	)
+
+	It("should apply contiguous holes as one range", func() {
+		f, err := os.OpenFile(targetFile, os.O_RDWR, 0)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		holes := &holeWriter{f: f, strategy: HoleStrategyZero}
+		Expect(holes.add(0, 4096)).To(Succeed())
+		Expect(holes.add(4096, 4096)).To(Succeed())
+		Expect(holes.start).To(BeZero())
+		Expect(holes.end).To(Equal(int64(2 * 4096)))
+		Expect(os.ReadFile(targetFile)).To(Equal(data))
+		Expect(holes.flush()).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(make([]byte, len(data))))
+		Expect(holes.end).To(BeZero())
+	})
+
+	DescribeTable("should fail holes that can't be applied, unless best effort", func(bestEffort bool) {
+		// Writing zeroes to a read only file fails
+		f, err := os.Open(targetFile)
+		Expect(err).ToNot(HaveOccurred())
+		defer f.Close()
+		stats := NewStats()
+		holes := &holeWriter{f: f, strategy: HoleStrategyZero, bestEffort: bestEffort, stats: stats, log: GinkgoLogr}
+		Expect(holes.add(0, 4096)).To(Succeed())
+		err = holes.flush()
+		if !bestEffort {
+			Expect(err).To(MatchError(ContainSubstring("unable to apply holes from offset 0 to 4096")))
+			Expect(stats.DegradedRegions).To(BeEmpty())
+			return
+		}
+		Expect(err).ToNot(HaveOccurred())
+		Expect(stats.DegradedRegions).To(HaveLen(1))
+		Expect(stats.DegradedRegions[0].Offset).To(BeZero())
+		Expect(stats.DegradedRegions[0].Size).To(Equal(int64(4096)))
+		Expect(stats.Summary()).To(ContainSubstring("1 degraded regions"))
+	},
+		Entry("fatal", false),
+		Entry("best effort", true),
+	)
+
+	DescribeTable("should align discards to the granularity", func(offset, size, start, end int64) {
+		alignedStart, alignedEnd := alignDiscard(offset, size, 8192)
+		Expect(alignedStart).To(Equal(start))
+		Expect(alignedEnd).To(Equal(end))
+	},
+		Entry("aligned", int64(8192), int64(16384), int64(8192), int64(24576)),
+		Entry("unaligned start", int64(4096), int64(16384), int64(8192), int64(16384)),
+		Entry("smaller than the granularity", int64(4096), int64(4096), int64(8192), int64(8192)),
+	)
+})
+
+var _ = Describe("device property tests", func() {
+	var sysfs string
+
+	BeforeEach(func() {
+		sysfs = GinkgoT().TempDir()
+	})
+
+	writeQueue := func(dir string, granularity, maxBytes string) {
+		queue := filepath.Join(sysfs, dir, "queue")
+		Expect(os.MkdirAll(queue, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(queue, "discard_granularity"), []byte(granularity+"\n"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(queue, "discard_max_bytes"), []byte(maxBytes+"\n"), 0644)).To(Succeed())
+	}
+
+	It("should detect a zvol that supports discard", func() {
+		writeQueue("zd0", "8192", "2147483648")
+		device, err := readDevicePropertiesDir(filepath.Join(sysfs, "zd0"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device.name).To(Equal("zd0"))
+		Expect(device.discardZeroes).To(BeTrue())
+		Expect(device.canDiscard()).To(BeTrue())
+		Expect(device.discardGranularity).To(Equal(int64(8192)))
+	})
+
+	It("should use the queue of the disk for a partition", func() {
+		writeQueue("zd16", "16384", "1048576")
+		Expect(os.MkdirAll(filepath.Join(sysfs, "zd16", "zd16p1"), 0755)).To(Succeed())
+		device, err := readDevicePropertiesDir(filepath.Join(sysfs, "zd16", "zd16p1"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device.name).To(Equal("zd16p1"))
+		Expect(device.discardZeroes).To(BeTrue())
+		Expect(device.discardMaxBytes).To(Equal(int64(1048576)))
+	})
+
+	It("should detect a device without discard", func() {
+		writeQueue("sda", "0", "0")
+		device, err := readDevicePropertiesDir(filepath.Join(sysfs, "sda"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(device.discardZeroes).To(BeFalse())
+		Expect(device.canDiscard()).To(BeFalse())
+	})
+})
@@ -0,0 +1,135 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+type Phase string
+
+const (
+	PhaseHashSource Phase = "hash-source"
+	PhaseHashTarget Phase = "hash-target"
+	PhaseExchange   Phase = "exchange"
+	PhaseDiff       Phase = "diff"
+	PhaseTransfer   Phase = "transfer"
+	PhaseFsync      Phase = "fsync"
+	PhaseVerify     Phase = "verify"
+	PhaseSeed       Phase = "seed"
+)
+
+// Stats collects the results of a sync, it is safe for concurrent use.
+type Stats struct {
+	mu                sync.Mutex
+	PhaseMilliseconds map[Phase]int64 `json:"phaseMilliseconds"`
+	SourceSize        int64           `json:"sourceSize"`
+	TargetSize        int64           `json:"targetSize"`
+	DifferentBlocks   int64           `json:"differentBlocks"`
+	EarlyBlocks       int64           `json:"earlyBlocks,omitempty"`
+	BlocksTransferred int64           `json:"blocksTransferred"`
+	HolesTransferred  int64           `json:"holesTransferred"`
+	BytesTransferred  int64           `json:"bytesTransferred"`
+	BytesCloned       int64           `json:"bytesCloned,omitempty"`
+	// HoleBytes are the bytes of the empty blocks sent as holes, BytesMatched
+	// the bytes of the source the target held already once the sync completed
+	HoleBytes    int64        `json:"holeBytes"`
+	BytesMatched int64        `json:"bytesMatched"`
+	Passes       []PassReport `json:"passes,omitempty"`
+	// Shards are the shards of a sharded sync that were synced, the shards
+	// before them were on the target already
+	Shards        int64 `json:"shards,omitempty"`
+	ShardsSkipped int64 `json:"shardsSkipped,omitempty"`
+	// BytesResumed are the bytes of the source an interrupted sync applied,
+	// that a resumed sync didn't read from the target
+	BytesResumed int64 `json:"bytesResumed,omitempty"`
+	// SourceDigest is the digest of the source folded from its block hashes,
+	// and TargetDigest the digest of the target once the sync was on disk
+	SourceDigest string `json:"sourceDigest,omitempty"`
+	TargetDigest string `json:"targetDigest,omitempty"`
+	// Seed is the seed copied onto the target before it was hashed
+	Seed *SeedReport `json:"seed,omitempty"`
+	// Cumulative are the savings of all the syncs of the target, with a
+	// savings file
+	Cumulative *Savings `json:"cumulative,omitempty"`
+	// Audit are the operations on the synced files that need a permission,
+	// when auditing
+	Audit []AuditRecord `json:"audit,omitempty"`
+	// DegradedRegions are the holes the target failed to empty with best
+	// effort holes, they may hold stale data
+	DegradedRegions []DegradedRegion `json:"degradedRegions,omitempty"`
+	// Path is the probed path to the peer, with record size probing
+	Path *PathProbe `json:"path,omitempty"`
+}
+
+// DegradedRegion is a range of the target that could not be emptied.
+type DegradedRegion struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	Error  string `json:"error"`
+}
+
+func NewStats() *Stats {
+	return &Stats{
+		PhaseMilliseconds: make(map[Phase]int64),
+	}
+}
+
+// StartPhase starts timing a phase, the returned function stops the timer
+// and records the duration.
+func (s *Stats) StartPhase(phase Phase, log logr.Logger) func() {
+	t := time.Now()
+	return func() {
+		elapsed := time.Since(t).Milliseconds()
+		s.mu.Lock()
+		s.PhaseMilliseconds[phase] += elapsed
+		s.mu.Unlock()
+		log.V(3).Info("Phase complete", "phase", phase, "milliseconds", elapsed)
+	}
+}
+
+func (s *Stats) Update(f func(s *Stats)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	type stats Stats
+	return json.Marshal((*stats)(s))
+}
+
+// Summary describes the sync on a single line.
+func (s *Stats) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := fmt.Sprintf("%d byte source, %d different blocks, %d blocks and %d holes transferred, %d bytes sent",
+		s.SourceSize, s.DifferentBlocks, s.BlocksTransferred, s.HolesTransferred, s.BytesTransferred)
+	if s.BytesMatched > 0 {
+		summary += fmt.Sprintf(", %d bytes matched", s.BytesMatched)
+	}
+	if s.BytesCloned > 0 {
+		summary += fmt.Sprintf(", %d bytes cloned", s.BytesCloned)
+	}
+	if len(s.Passes) > 1 {
+		summary += fmt.Sprintf(", %d passes", len(s.Passes))
+	}
+	if len(s.DegradedRegions) > 0 {
+		summary += fmt.Sprintf(", %d degraded regions", len(s.DegradedRegions))
+	}
+	return summary
+}
+
+func (s *Stats) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
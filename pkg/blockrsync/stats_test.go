@@ -0,0 +1,50 @@
+package blockrsync
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("stats tests", func() {
+	It("should record phase timings", func() {
+		stats := NewStats()
+		stop := stats.StartPhase(PhaseDiff, GinkgoLogr)
+		stop()
+		Expect(stats.PhaseMilliseconds).To(HaveKey(PhaseDiff))
+	})
+
+	It("should write the stats to a file", func() {
+		tmpDir, err := os.MkdirTemp("", "stats")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(tmpDir)
+		stats := NewStats()
+		stats.Update(func(s *Stats) { s.BlocksTransferred = 5 })
+		stats.StartPhase(PhaseTransfer, GinkgoLogr)()
+		fileName := filepath.Join(tmpDir, "stats.json")
+		Expect(stats.WriteFile(fileName)).To(Succeed())
+		data, err := os.ReadFile(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		res := map[string]interface{}{}
+		Expect(json.Unmarshal(data, &res)).To(Succeed())
+		Expect(res).To(HaveKeyWithValue("blocksTransferred", BeNumerically("==", 5)))
+		Expect(res).To(HaveKeyWithValue("phaseMilliseconds", HaveKey(string(PhaseTransfer))))
+	})
+
+	It("should summarize the stats on one line", func() {
+		stats := NewStats()
+		stats.Update(func(s *Stats) {
+			s.SourceSize = 1 << 20
+			s.DifferentBlocks = 3
+			s.BlocksTransferred = 2
+			s.HolesTransferred = 1
+			s.BytesTransferred = 8192
+		})
+		Expect(stats.Summary()).To(Equal("1048576 byte source, 3 different blocks, 2 blocks and 1 holes transferred, 8192 bytes sent"))
+		stats.Update(func(s *Stats) { s.Passes = []PassReport{{Pass: 1}, {Pass: 2}} })
+		Expect(stats.Summary()).To(HaveSuffix(", 2 passes"))
+	})
+})
@@ -0,0 +1,270 @@
+package blockrsync
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/snappy"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+var ErrOutOfOrder = errors.New("a streaming target needs the blocks in ascending offset order")
+
+// streamTarget syncs to a target that can only be written in order, like a
+// pipe. The target is not hashed, so the client sends every block, and the
+// blocks are written in ascending offset order. Holes and gaps are written as
+// zeroes, or skipped over in a regular file that is truncated to the source
+// size at the end.
+func (b *BlockrsyncServer) streamTarget() error {
+	f, err := b.audit.open(b.targetFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	listener, err := b.opts.listenTarget(b.port, b.log)
+	if err != nil {
+		return err
+	}
+	// Closing a unix socket listener removes the socket
+	defer listener.Close()
+	stopListener := context.AfterFunc(b.ctx, func() { listener.Close() })
+	defer stopListener()
+	conn, protocol, err := b.acceptClient(listener)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stopConn := context.AfterFunc(b.ctx, func() { conn.Close() })
+	defer stopConn()
+	b.protocol = protocol
+	b.log.Info("Negotiated protocol", "version", b.protocol.Version, "features", b.protocol.Features)
+	if b.protocol.Features.Has(codec.FeaturePreflight) {
+		if err := b.streamPreflight(conn); err != nil {
+			return err
+		}
+	}
+	if err := b.writeNoHashes(conn); err != nil {
+		return err
+	}
+	var records io.Reader = conn
+	if !b.protocol.Features.Has(codec.FeatureNoCompression) {
+		records = snappy.NewReader(conn)
+	}
+	out := &sequentialWriter{w: bufio.NewWriter(f), seekable: info.Mode().IsRegular(), f: f}
+	stopPhase := b.stats.StartPhase(PhaseTransfer, b.log)
+	err = b.streamBlocks(out, bufio.NewReader(records), codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features))
+	stopPhase()
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+	if errors.Is(err, ErrCancelled) || b.ctx.Err() != nil {
+		b.log.Info("Sync cancelled, the target stream is incomplete", "bytes", out.end())
+		return ErrCancelled
+	}
+	return err
+}
+
+// streamPreflight only checks the size of the source, a stream has no space
+// to check.
+func (b *BlockrsyncServer) streamPreflight(conn io.ReadWriter) error {
+	sourceSize, _, err := codec.NewDecoder(conn, b.protocol.Version, b.protocol.Features).ReadPreflight()
+	if err != nil {
+		return err
+	}
+	checkErr := b.checkSourceSize(sourceSize)
+	message := ""
+	if checkErr != nil {
+		message = checkErr.Error()
+	}
+	if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WritePreflightResult(message); err != nil {
+		return err
+	}
+	return checkErr
+}
+
+// writeNoHashes tells the client the target holds no block.
+func (b *BlockrsyncServer) writeNoHashes(conn io.Writer) error {
+	defer enterStage("", StageExchange)()
+	recordSize := b.opts.recordSize(conn, b.stats, b.log)
+	var writer flushWriteCloser
+	if b.protocol.Features.Has(codec.FeatureCompactHashes) || b.protocol.Features.Has(codec.FeatureNoCompression) {
+		writer = &bufferedWriteCloser{Writer: bufio.NewWriter(conn)}
+	} else {
+		writer = newCompressedWriter(conn, recordSize, b.opts.FlushInterval, StageExchange, newCPUPacer(b.opts.MaxCPU))
+	}
+	encoder := codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
+	if b.protocol.Features.Has(codec.FeatureBloomFilter) {
+		filter := newBloomFilter(0)
+		if err := encoder.WriteBloomFilter(filter.hashCount, filter.words); err != nil {
+			return err
+		}
+	}
+	if b.opts.HashLength > 0 {
+		if err := encoder.SetHashLength(b.opts.HashLength); err != nil {
+			return err
+		}
+	}
+	if err := encoder.WriteHashHeader(b.hasher.BlockSize(), 0); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// streamBlocks writes the records to the target in order, and acknowledges
+// the pass ends.
+func (b *BlockrsyncServer) streamBlocks(out *sequentialWriter, reader io.Reader, acks *codec.Encoder) error {
+	defer enterStage("", StageWrite)()
+	blockReader := newBlockReader(codec.NewDecoder(reader, b.protocol.Version, b.protocol.Features), int(b.hasher.BlockSize()), b.log.WithName("block-reader"))
+	sourceSize, err := blockReader.ReadSourceSize()
+	if err != nil {
+		_, err = handleReadError(err, nocallback)
+		return err
+	}
+	if err := b.checkSourceSize(sourceSize); err != nil {
+		return err
+	}
+	b.sourceSize = sourceSize
+	b.stats.Update(func(s *Stats) { s.SourceSize = sourceSize })
+	for {
+		cont, err := blockReader.Next()
+		if err != nil {
+			return err
+		}
+		if blockReader.IsEnd() {
+			break
+		}
+		switch {
+		case blockReader.IsCancel() || b.ctx.Err() != nil:
+			if blockReader.IsCancel() {
+				b.log.Info("Client cancelled the sync")
+			}
+			return ErrCancelled
+		case blockReader.IsPassEnd():
+			sent, received, err := blockReader.PassChecksum()
+			if err != nil {
+				return err
+			}
+			if sent != received {
+				_ = acks.WritePassAck(blockReader.Offset(), received)
+				return fmt.Errorf("%w in pass %d, client sent %08x, received %08x", ErrStreamChecksumMismatch, blockReader.Offset(), sent, received)
+			}
+			if err := out.flush(); err != nil {
+				return err
+			}
+			if err := acks.WritePassAck(blockReader.Offset(), received); err != nil {
+				return err
+			}
+		case blockReader.IsResize():
+			return errors.New("the source size changed, a streaming target cannot be resized")
+		case blockReader.IsHole():
+			holeSize := min(b.sourceSize-blockReader.Offset(), b.hasher.BlockSize())
+			if err := out.skipTo(blockReader.Offset() + holeSize); err != nil {
+				return err
+			}
+			b.blockLog.add(blockReader.Offset(), 0)
+			b.stats.Update(func(s *Stats) {
+				s.HolesTransferred++
+				s.HoleBytes += holeSize
+			})
+		default:
+			if err := out.write(blockReader.Offset(), blockReader.Block()); err != nil {
+				return err
+			}
+			b.blockLog.add(blockReader.Offset(), int64(len(blockReader.Block())))
+			b.stats.Update(func(s *Stats) {
+				s.BlocksTransferred++
+				s.BytesTransferred += int64(len(blockReader.Block()))
+			})
+		}
+		if !cont {
+			break
+		}
+	}
+	b.blockLog.flush()
+	return out.skipTo(b.sourceSize)
+}
+
+// sequentialWriter writes a target in ascending offset order.
+type sequentialWriter struct {
+	w *bufio.Writer
+	// seekable skips over holes in a regular file instead of writing zeroes
+	seekable bool
+	f        *os.File
+	pos      int64
+	// skipped is the position a seekable target was skipped to
+	skipped int64
+}
+
+// end is the offset the next block can be written at.
+func (s *sequentialWriter) end() int64 {
+	return max(s.pos, s.skipped)
+}
+
+func (s *sequentialWriter) write(offset int64, data []byte) error {
+	if err := s.skipTo(offset); err != nil {
+		return err
+	}
+	if s.skipped > s.pos {
+		if err := s.seek(); err != nil {
+			return err
+		}
+	}
+	n, err := s.w.Write(data)
+	s.pos += int64(n)
+	s.skipped = s.pos
+	return err
+}
+
+// skipTo moves the target to the offset, zeroes are written unless the target
+// is seekable. Moving back fails with ErrOutOfOrder.
+func (s *sequentialWriter) skipTo(offset int64) error {
+	if offset < s.end() {
+		return fmt.Errorf("%w, offset %d is before offset %d", ErrOutOfOrder, offset, s.end())
+	}
+	if s.seekable {
+		s.skipped = offset
+		return nil
+	}
+	zeroes := make([]byte, min(offset-s.pos, maxZeroWriteSize))
+	for s.pos < offset {
+		n, err := s.w.Write(zeroes[:min(offset-s.pos, int64(len(zeroes)))])
+		s.pos += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	s.skipped = s.pos
+	return nil
+}
+
+func (s *sequentialWriter) seek() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := s.f.Seek(s.skipped, io.SeekStart); err != nil {
+		return err
+	}
+	s.pos = s.skipped
+	return nil
+}
+
+// flush writes what is buffered, and sizes a seekable target to the end of
+// the last hole.
+func (s *sequentialWriter) flush() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.seekable && s.skipped > s.pos {
+		return s.f.Truncate(s.skipped)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package blockrsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("streaming target tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		// Holes in the middle and at the end, and a partial last block
+		source = make([]byte, 16*4096+100)
+		_, _ = rand.Read(source[:4*4096])
+		_, _ = rand.Read(source[8*4096 : 12*4096])
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+	})
+
+	sync := func() *Stats {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")),
+			func(c *constructorConfig) { c.opts.StreamTarget = true })
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient(sourceFile, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		return server.Stats()
+	}
+
+	It("should write the source to a pipe", func() {
+		Expect(syscall.Mkfifo(targetFile, 0644)).To(Succeed())
+		received := make(chan []byte, 1)
+		go func() {
+			defer GinkgoRecover()
+			f, err := os.Open(targetFile)
+			Expect(err).ToNot(HaveOccurred())
+			defer f.Close()
+			data, err := io.ReadAll(f)
+			Expect(err).ToNot(HaveOccurred())
+			received <- data
+		}()
+		stats := sync()
+		Expect(<-received).To(Equal(source))
+		Expect(stats.HolesTransferred).ToNot(BeZero())
+	})
+
+	It("should skip over the holes of a regular file", func() {
+		Expect(os.WriteFile(targetFile, bytes.Repeat([]byte{1}, 32*4096), 0644)).To(Succeed())
+		stats := sync()
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+		Expect(stats.BlocksTransferred).To(Equal(int64(8)))
+	})
+
+	It("should refuse blocks out of order", func() {
+		var buf bytes.Buffer
+		out := &sequentialWriter{w: bufio.NewWriter(&buf)}
+		Expect(out.write(4096, []byte("block"))).To(Succeed())
+		Expect(out.write(0, []byte("block"))).To(MatchError(ErrOutOfOrder))
+		Expect(out.skipTo(2 * 4096)).To(Succeed())
+		Expect(out.flush()).To(Succeed())
+		Expect(buf.Len()).To(Equal(2 * 4096))
+		Expect(buf.Bytes()[4096:4101]).To(Equal([]byte("block")))
+	})
+})
@@ -0,0 +1,209 @@
+package blockrsync
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+// TLSOptions encrypt the blocks and hashes in transit. The source connects
+// with TLS if any is set, the target requires TLS if it has a certificate.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM certificate and key presented to the
+	// peer, the target needs one, the source presents one for mutual TLS
+	CertFile string
+	KeyFile  string
+	// CAFile is the PEM file of the CA certificates the peer is verified
+	// with. The source verifies the target with the system roots without
+	// it, the target requires a client certificate signed by them with it
+	CAFile string
+	// ServerName is the name the source verifies in the certificate of the
+	// target, the target address if empty
+	ServerName string
+}
+
+// Enabled returns true if the source connects with TLS.
+func (o *TLSOptions) Enabled() bool {
+	return *o != TLSOptions{}
+}
+
+func (o *TLSOptions) Validate() error {
+	if (o.CertFile == "") != (o.KeyFile == "") {
+		return errors.New("a TLS certificate and key must be used together")
+	}
+	return nil
+}
+
+// certificates loads the certificate and the CA certificates of the files
+// that are set.
+func (o *TLSOptions) certificates() ([]tls.Certificate, *x509.CertPool, error) {
+	var certificates []tls.Certificate
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to load the TLS certificate: %w", err)
+		}
+		certificates = append(certificates, cert)
+	}
+	if o.CAFile == "" {
+		return certificates, nil, nil
+	}
+	pem, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates in TLS CA file %s", o.CAFile)
+	}
+	return certificates, pool, nil
+}
+
+func (o *TLSOptions) clientConfig(targetAddress string) (*tls.Config, error) {
+	certificates, roots, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+	serverName := o.ServerName
+	if serverName == "" {
+		serverName = targetAddress
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   serverName,
+		Certificates: certificates,
+		RootCAs:      roots,
+	}, nil
+}
+
+func (o *TLSOptions) serverConfig() (*tls.Config, error) {
+	certificates, clientCAs, err := o.certificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("the target needs a TLS certificate and key")
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: certificates,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// connectionProvider returns a TLSConnectionProvider over the provider if
+// TLS is enabled.
+func (o *TLSOptions) connectionProvider(provider *NetworkConnectionProvider) ConnectionProvider {
+	if !o.Enabled() {
+		return provider
+	}
+	return &TLSConnectionProvider{
+		provider: provider,
+		options:  *o,
+	}
+}
+
+// TLSConnectionProvider connects to the target with TLS, the handshake
+// completes before Connect returns, so a certificate the peer refuses fails
+// the connection.
+type TLSConnectionProvider struct {
+	provider *NetworkConnectionProvider
+	options  TLSOptions
+}
+
+// NewTLSConnectionProvider connects to the target address and port over the
+// transport, retrying like the client does by default.
+func NewTLSConnectionProvider(targetAddress string, port int, t transport.Transport, options TLSOptions) *TLSConnectionProvider {
+	return &TLSConnectionProvider{
+		provider: &NetworkConnectionProvider{
+			targetAddress: targetAddress,
+			port:          port,
+			transport:     transport.OrDefault(t),
+			retries:       DefaultConnectRetries,
+			retryInterval: DefaultRetryInterval,
+		},
+		options: options,
+	}
+}
+
+func (t *TLSConnectionProvider) Connect() (io.ReadWriteCloser, error) {
+	return t.provider.dial(func(conn net.Conn, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		config, err := t.options.clientConfig(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with %s failed: %w", conn.RemoteAddr(), err)
+		}
+		return tlsConn, nil
+	})
+}
+
+// listen listens on the address and the addresses of the listeners with the
+// transport of the options, and requires TLS on those with a certificate. The
+// unix socket of the options replaces the address.
+func (o *BlockRsyncOptions) listen(address string) (net.Listener, error) {
+	first := o.Transport
+	if o.ListenSocket != "" {
+		first, address = transport.Unix, o.ListenSocket
+	}
+	listeners := append([]ListenerOptions{{Address: address, TLS: &o.TLS}}, o.Listeners...)
+	var res []net.Listener
+	for i, options := range listeners {
+		tlsOptions := options.TLS
+		if tlsOptions == nil {
+			tlsOptions = &o.TLS
+		}
+		t := o.Transport
+		if i == 0 {
+			t = first
+		}
+		listener, err := listenTLS(t, options.Address, tlsOptions)
+		if err != nil {
+			for _, l := range res {
+				l.Close()
+			}
+			return nil, err
+		}
+		res = append(res, listener)
+	}
+	return transport.Merge(res...), nil
+}
+
+// listenTLS listens on the address, with TLS if the options have a
+// certificate. The TLS handshake happens on the first read, so a guard limits
+// the connections that don't complete it.
+func listenTLS(t transport.Transport, address string, options *TLSOptions) (net.Listener, error) {
+	var config *tls.Config
+	if options.CertFile != "" {
+		var err error
+		if config, err = options.serverConfig(); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := transport.OrDefault(t).Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return listener, nil
+	}
+	return tls.NewListener(listener, config), nil
+}
@@ -0,0 +1,132 @@
+package blockrsync
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// testCA signs certificates for the TLS tests.
+type testCA struct {
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// file is the PEM file of the CA certificate
+	file string
+}
+
+func newTestCA(dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	file := filepath.Join(dir, name+".crt")
+	Expect(os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	return &testCA{dir: dir, cert: cert, key: key, file: file}
+}
+
+// issue writes a certificate for the name signed by the CA and its key, and
+// returns the files.
+func (c *testCA) issue(name string, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, c.cert, &key.PublicKey, c.key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	certFile, keyFile := filepath.Join(c.dir, name+".crt"), filepath.Join(c.dir, name+".key")
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+var _ = Describe("TLS tests", func() {
+	var (
+		sourceFile string
+		targetFile string
+		source     []byte
+		ca         *testCA
+		serverTLS  TLSOptions
+	)
+
+	BeforeEach(func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile = filepath.Join(tmpDir, "source.raw")
+		targetFile = filepath.Join(tmpDir, "target.raw")
+		source = make([]byte, 4*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		ca = newTestCA(tmpDir, "ca")
+		certFile, keyFile := ca.issue("localhost", x509.ExtKeyUsageServerAuth)
+		serverTLS = TLSOptions{CertFile: certFile, KeyFile: keyFile}
+	})
+
+	sync := func(clientTLS TLSOptions) (error, error) {
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		client := NewBlockrsyncClient(sourceFile, "localhost", port, &BlockRsyncOptions{BlockSize: 4096, TLS: clientTLS}, GinkgoLogr.WithName("client"))
+		server := NewBlockrsyncServer(targetFile, port, &BlockRsyncOptions{BlockSize: 4096, TLS: serverTLS}, GinkgoLogr.WithName("server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.ConnectToTarget()
+		return clientErr, <-serverDone
+	}
+
+	It("should sync over TLS", func() {
+		Expect(sync(TLSOptions{CAFile: ca.file})).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+
+	It("should refuse a target signed by another CA", func() {
+		other := newTestCA(GinkgoT().TempDir(), "other")
+		clientErr, _ := sync(TLSOptions{CAFile: other.file})
+		Expect(clientErr).To(MatchError(ContainSubstring("TLS handshake")))
+	})
+
+	It("should verify the certificate of the source with mutual TLS", func() {
+		serverTLS.CAFile = ca.file
+		certFile, keyFile := ca.issue("source", x509.ExtKeyUsageClientAuth)
+		Expect(sync(TLSOptions{CAFile: ca.file, CertFile: certFile, KeyFile: keyFile})).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+
+		_, serverErr := sync(TLSOptions{CAFile: ca.file})
+		Expect(serverErr).To(MatchError(ContainSubstring("certificate")))
+	})
+
+	It("should need a certificate and a key", func() {
+		Expect((&TLSOptions{CertFile: "tls.crt"}).Validate()).ToNot(Succeed())
+		Expect((&TLSOptions{CAFile: ca.file}).serverConfig()).Error().To(HaveOccurred())
+	})
+})
@@ -0,0 +1,142 @@
+package blockrsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+
+	"github.com/golang/snappy"
+
+	"github.com/awels/blockrsync/pkg/codec"
+)
+
+// Wipe empties every block of the target with hole records, without a source.
+// The target applies them like the holes of a sync, so its hole strategy
+// discards, punches out or zeroes the whole target. The size of the target is
+// taken from its hashes, a target that is not a whole number of blocks grows
+// to the end of its last block, a device refuses the wipe.
+func (b *BlockrsyncClient) Wipe() error {
+	err := b.wipe()
+	if err == nil {
+		b.overall.complete()
+		if serr := recordSavings(b.opts.SavingsFile, b.stats); serr != nil {
+			b.log.Error(serr, "Unable to record savings", "file", b.opts.SavingsFile)
+		}
+	}
+	return b.opts.Hooks.postSync(b.stats, err)
+}
+
+func (b *BlockrsyncClient) wipe() error {
+	if b.opts.ShardSize > 0 || b.pipelineHasher() != nil {
+		return errors.New("a wipe cannot be sharded or pipelined")
+	}
+	b.startTime = time.Now()
+	start := b.startTime
+	conn, err := b.connectionProvider.Connect()
+	if err != nil {
+		if b.ctx.Err() != nil {
+			return ErrCancelled
+		}
+		return err
+	}
+	defer conn.Close()
+	b.protocol, err = clientHandshake(conn, b.opts)
+	if err != nil {
+		return err
+	}
+	b.log.Info("Negotiated protocol", "version", b.protocol.Version, "features", b.protocol.Features)
+	connReader := bufio.NewReader(conn)
+	if b.protocol.Features.Has(codec.FeatureSeedHashes) {
+		// The target is wiped, any seed will do
+		if err := b.sendSeedHashes(conn, connReader); err != nil {
+			return err
+		}
+	}
+	if b.protocol.Features.Has(codec.FeaturePreflight) {
+		// The size of the target is not known yet, and wiping needs no space
+		if err := codec.NewEncoder(conn, b.protocol.Version, b.protocol.Features).WritePreflight(0, 0); err != nil {
+			return err
+		}
+		message, err := codec.NewDecoder(connReader, b.protocol.Version, b.protocol.Features).ReadPreflightResult()
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			return fmt.Errorf("%w: %s", ErrPreflightRefused, message)
+		}
+	}
+	var reader io.Reader = connReader
+	if !b.protocol.Features.Has(codec.FeatureCompactHashes) && !b.protocol.Features.Has(codec.FeatureNoCompression) {
+		reader = snappy.NewReader(connReader)
+	}
+	decoder := codec.NewDecoder(reader, b.protocol.Version, b.protocol.Features)
+	if b.protocol.Features.Has(codec.FeatureBloomFilter) {
+		if _, _, err := decoder.ReadBloomFilter(); err != nil {
+			return err
+		}
+	}
+	stopPhase := b.stats.StartPhase(PhaseExchange, b.log)
+	blockSize, hashes, err := b.hasher.DeserializeHashes(decoder)
+	stopPhase()
+	if err != nil {
+		return err
+	}
+	offsets := make([]int64, 0, len(hashes))
+	for offset := range hashes {
+		offsets = append(offsets, offset)
+		b.sourceSize = max(b.sourceSize, offset+blockSize)
+	}
+	slices.SortFunc(offsets, int64SortFunc)
+	b.stats.Update(func(s *Stats) { s.DifferentBlocks = int64(len(offsets)) })
+	b.log.Info("Wiping target", "blocks", len(offsets), "size", b.sourceSize)
+
+	recordSize := b.opts.recordSize(conn, b.stats, b.log)
+	var writer *compressedWriter
+	if b.protocol.Features.Has(codec.FeatureNoCompression) {
+		writer = newUncompressedWriter(conn, recordSize, b.opts.FlushInterval, StageSend)
+	} else {
+		writer = newCompressedWriter(conn, recordSize, b.opts.FlushInterval, StageSend, newCPUPacer(b.opts.MaxCPU))
+	}
+	defer writer.Close()
+	encoder := codec.NewEncoder(writer, b.protocol.Version, b.protocol.Features)
+	stopTransfer := b.stats.StartPhase(PhaseTransfer, b.log)
+	defer stopTransfer()
+	if err := encoder.WriteSourceSize(b.sourceSize); err != nil {
+		return err
+	}
+	progress := b.opts.progress(ProgressSync, b.overall, b.log)
+	if progress != nil {
+		progress.Start(b.sourceSize)
+	}
+	for _, offset := range offsets {
+		if b.ctx.Err() != nil {
+			if b.protocol.Features.Has(codec.FeatureCancel) {
+				// All hashes were received
+				received := make(chan diffResult)
+				close(received)
+				b.cancelTarget(encoder, writer, received, connReader)
+			}
+			return ErrCancelled
+		}
+		length := min(blockSize, b.sourceSize-offset)
+		if err := encoder.WriteHole(offset, int(length)); err != nil {
+			return err
+		}
+		b.stats.Update(func(s *Stats) {
+			s.HolesTransferred++
+			s.HoleBytes += length
+		})
+		if progress != nil {
+			progress.Update(offset + length)
+		}
+	}
+	if b.protocol.Features.Has(codec.FeatureIterative) {
+		acks := codec.NewDecoder(connReader, b.protocol.Version, b.protocol.Features)
+		_, err := b.endPass(1, start, 0, int64(len(offsets)), encoder, writer, acks)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package blockrsync
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("wipe tests", func() {
+	var targetFile string
+
+	BeforeEach(func() {
+		targetFile = filepath.Join(GinkgoT().TempDir(), "target.raw")
+	})
+
+	wipe := func(size int, options ...Option) (*Stats, error, error) {
+		target := make([]byte, size)
+		_, _ = rand.Read(target)
+		Expect(os.WriteFile(targetFile, target, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server, err := NewServer(targetFile, append(options, WithTarget("", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("server")))...)
+		Expect(err).ToNot(HaveOccurred())
+		client, err := NewClient("", append(options, WithTarget("localhost", port), WithBlockSize(4096), WithLogger(GinkgoLogr.WithName("client")))...)
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		clientErr := client.Wipe()
+		return client.Stats(), clientErr, <-serverDone
+	}
+
+	DescribeTable("should empty every block of the target", func(options ...Option) {
+		stats, clientErr, serverErr := wipe(8*4096, options...)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(make([]byte, 8*4096)))
+		Expect(stats.HolesTransferred).To(Equal(int64(8)))
+		Expect(stats.HoleBytes).To(Equal(int64(8 * 4096)))
+		Expect(stats.BlocksTransferred).To(BeZero())
+	},
+		Entry("with the default options"),
+		Entry("with the bloom filter and stream checksum", WithOptions(&BlockRsyncOptions{BloomFilter: true, StreamChecksum: true})),
+	)
+
+	It("should grow a target to the end of its last block", func() {
+		_, clientErr, serverErr := wipe(8*4096 + 100)
+		Expect(clientErr).ToNot(HaveOccurred())
+		Expect(serverErr).ToNot(HaveOccurred())
+		Expect(os.ReadFile(targetFile)).To(Equal(make([]byte, 9*4096)))
+	})
+
+	It("should refuse a sharded wipe", func() {
+		client, err := NewClient("", WithOptions(&BlockRsyncOptions{ShardSize: 8 * 4096}), WithTarget("localhost", 1), WithBlockSize(4096))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.Wipe()).To(MatchError(ContainSubstring("cannot be sharded")))
+	})
+})
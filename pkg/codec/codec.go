@@ -0,0 +1,731 @@
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"strings"
+)
+
+// Version is the version of the on-wire format. Version0 is the original
+// un-versioned format, Version1 adds the Hello handshake.
+type Version uint16
+
+const (
+	Version0       Version = 0
+	Version1       Version = 1
+	CurrentVersion         = Version1
+)
+
+// Features is a set of optional protocol features, negotiated by the peers.
+type Features uint32
+
+func (f Features) Has(feature Features) bool {
+	return f&feature == feature
+}
+
+const (
+	// FeatureCompactHashes sends the hash list uncompressed, with varint offset
+	// deltas and optionally truncated hashes.
+	FeatureCompactHashes Features = 1 << iota
+	// FeatureBloomFilter sends a Bloom filter of the target hashes before the
+	// hash list.
+	FeatureBloomFilter
+	// FeatureIterative ends every pass of the record stream with a pass end
+	// record, acknowledged by the server once the pass is on disk.
+	FeatureIterative
+	// FeatureResize sends a resize record when the size of the source changed
+	// between passes.
+	FeatureResize
+	// FeatureStreamChecksum keeps a CRC32 of the record stream, sent with
+	// every pass end and returned with the pass ack.
+	FeatureStreamChecksum
+	// FeaturePreflight sends the size of the source after the handshake, so
+	// the server can refuse a sync the target has no space for.
+	FeaturePreflight
+	// FeatureCancel sends a cancel record when the client cancels the sync,
+	// so the server can tell a cancelled sync from a lost connection.
+	FeatureCancel
+	// FeatureShards syncs the source in shards, each with its own hash list
+	// and pass end, after the client sent the shard size and the server the
+	// first shard to sync.
+	FeatureShards
+	// FeatureRecordLengths sends the length of the data of every block and
+	// hole record, so the short last block of a source is framed explicitly
+	// instead of being inferred from the source size or the end of the stream.
+	FeatureRecordLengths
+	// FeatureNoCompression sends the hash list and the record stream without
+	// snappy framing, for connections that are local or already compressed.
+	FeatureNoCompression
+	// FeatureSHA512Hashes hashes the blocks with SHA-512 instead of BLAKE2b,
+	// it must be enabled by both peers.
+	FeatureSHA512Hashes
+	// FeatureCRC32C computes the stream checksum with the Castagnoli
+	// polynomial instead of IEEE, which CPUs with SSE4.2 or the ARMv8 CRC32
+	// instructions compute in hardware.
+	FeatureCRC32C
+	// FeatureSeedHashes sends the hash list of the source to the target after
+	// the handshake, so the target can pick the seed closest to the source. The
+	// target answers with a preflight result once it copied the seed.
+	FeatureSeedHashes
+	// FeatureResume sends the size of the source and the block size after the
+	// handshake, the server answers with the ranges of the target an
+	// interrupted sync of the same source already applied, which neither
+	// peer hashes nor sends again.
+	FeatureResume
+	// FeatureSourceDigest follows every pass end record with a digest of the
+	// source, and every pass ack with a digest of the target once the pass
+	// is on disk. An empty digest was not computed.
+	FeatureSourceDigest
+)
+
+// featureNames is used to describe features in error messages.
+var featureNames = map[Features]string{
+	FeatureCompactHashes:  "compact-hashes",
+	FeatureBloomFilter:    "bloom-filter",
+	FeatureIterative:      "iterative",
+	FeatureResize:         "resize",
+	FeatureStreamChecksum: "stream-checksum",
+	FeaturePreflight:      "preflight",
+	FeatureCancel:         "cancel",
+	FeatureShards:         "shards",
+	FeatureRecordLengths:  "record-lengths",
+	FeatureNoCompression:  "no-compression",
+	FeatureSHA512Hashes:   "sha512-hashes",
+	FeatureCRC32C:         "crc32c",
+	FeatureSeedHashes:     "seed-hashes",
+	FeatureResume:         "resume",
+	FeatureSourceDigest:   "source-digest",
+}
+
+func (f Features) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var names []string
+	for bit := Features(1); bit != 0; bit <<= 1 {
+		if !f.Has(bit) {
+			continue
+		}
+		if name, ok := featureNames[bit]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("0x%x", uint32(bit)))
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+const (
+	// HashLength is the length of a block hash on the wire.
+	HashLength = 64
+	// MinHashLength is the shortest truncated hash allowed with compact hashes.
+	MinHashLength = 16
+	// MaxBloomFilterWords limits the size of a received Bloom filter to 1GiB.
+	MaxBloomFilterWords = 1 << 27
+	// MaxPreflightMessageLength is the longest message refusing a sync.
+	MaxPreflightMessageLength = 1<<16 - 1
+	// MaxResumeRanges limits the ranges of a received resume answer to 256MiB.
+	MaxResumeRanges = 1 << 24
+)
+
+// Range is a range of bytes of the target.
+type Range struct {
+	Offset int64
+	Length int64
+}
+
+// Record types sent from the client to the server.
+const (
+	RecordHole byte = iota
+	RecordBlock
+	// RecordPassEnd ends a pass in iterative mode, the offset is the pass number.
+	RecordPassEnd
+	// RecordResize changes the size of the target, the offset is the new size
+	// of the source.
+	RecordResize
+	// RecordCancel ends the record stream of a cancelled sync, the offset is 0.
+	RecordCancel
+)
+
+// Encoder writes protocol elements. Every element is written with separate
+// writes for each field, matching the original implementation.
+type Encoder struct {
+	w          io.Writer
+	version    Version
+	features   Features
+	hashLength int
+	nextOffset int64
+	blockSize  int64
+	checksum   hash.Hash32
+	// passChecksum is the checksum sent with the last pass end
+	passChecksum uint32
+}
+
+func NewEncoder(w io.Writer, version Version, features Features) *Encoder {
+	return &Encoder{
+		w:          w,
+		version:    version,
+		features:   features,
+		hashLength: HashLength,
+	}
+}
+
+// SetHashLength truncates the hashes written with compact hashes.
+func (e *Encoder) SetHashLength(length int) error {
+	if length < MinHashLength || length > HashLength {
+		return fmt.Errorf("invalid hash length %d, must be between %d and %d", length, MinHashLength, HashLength)
+	}
+	e.hashLength = length
+	return nil
+}
+
+func (e *Encoder) Version() Version {
+	return e.version
+}
+
+func (e *Encoder) Features() Features {
+	return e.features
+}
+
+// WriteHashHeader starts the hash list sent from the server to the client.
+// With compact hashes the header is followed by the hash length.
+func (e *Encoder) WriteHashHeader(blockSize, count int64) error {
+	if err := binary.Write(e.w, binary.LittleEndian, blockSize); err != nil {
+		return err
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, count); err != nil {
+		return err
+	}
+	if e.features.Has(FeatureCompactHashes) {
+		e.blockSize = blockSize
+		e.nextOffset = 0
+		_, err := e.w.Write([]byte{byte(e.hashLength)})
+		return err
+	}
+	return nil
+}
+
+// WriteHash writes an offset and its hash. With compact hashes the offsets
+// must be increasing, and the offset is written as the varint distance from
+// the block following the previous hash, so contiguous blocks take one byte.
+func (e *Encoder) WriteHash(offset int64, hash []byte) error {
+	if len(hash) != HashLength {
+		return fmt.Errorf("invalid hash length %d", len(hash))
+	}
+	if e.features.Has(FeatureCompactHashes) {
+		if offset < e.nextOffset {
+			return fmt.Errorf("offset %d is not increasing", offset)
+		}
+		buf := binary.AppendUvarint(make([]byte, 0, binary.MaxVarintLen64+e.hashLength), uint64(offset-e.nextOffset))
+		buf = append(buf, hash[:e.hashLength]...)
+		e.nextOffset = offset + e.blockSize
+		_, err := e.w.Write(buf)
+		return err
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, offset); err != nil {
+		return err
+	}
+	_, err := e.w.Write(hash)
+	return err
+}
+
+// WriteBloomFilter writes the number of hash functions and the filter bits,
+// sent before the hash header.
+func (e *Encoder) WriteBloomFilter(hashCount uint8, words []uint64) error {
+	if _, err := e.w.Write([]byte{hashCount}); err != nil {
+		return err
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, uint64(len(words))); err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, words)
+}
+
+// WritePreflight is sent by the client after the handshake, with the size of
+// the source and the bytes of it that are not holes.
+func (e *Encoder) WritePreflight(sourceSize, dataSize int64) error {
+	if err := binary.Write(e.w, binary.LittleEndian, sourceSize); err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, dataSize)
+}
+
+// WritePreflightResult answers the preflight, an empty message accepts the
+// sync.
+func (e *Encoder) WritePreflightResult(message string) error {
+	if len(message) > MaxPreflightMessageLength {
+		message = message[:MaxPreflightMessageLength]
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, uint16(len(message))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(e.w, message)
+	return err
+}
+
+// WriteShards is sent by the client after the preflight with the shards
+// feature, with the shard size and the size of the source.
+func (e *Encoder) WriteShards(shardSize, sourceSize int64) error {
+	if !e.features.Has(FeatureShards) {
+		return fmt.Errorf("shards require the %s feature", FeatureShards)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, shardSize); err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, sourceSize)
+}
+
+// WriteShardResume answers WriteShards with the index of the first shard to
+// sync, the shards before it are on the target.
+func (e *Encoder) WriteShardResume(shard int64) error {
+	return binary.Write(e.w, binary.LittleEndian, shard)
+}
+
+// WriteResume is sent by the client after the handshake with the resume
+// feature, with the size of the source and the block size.
+func (e *Encoder) WriteResume(sourceSize, blockSize int64) error {
+	if !e.features.Has(FeatureResume) {
+		return fmt.Errorf("resuming requires the %s feature", FeatureResume)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, sourceSize); err != nil {
+		return err
+	}
+	return binary.Write(e.w, binary.LittleEndian, blockSize)
+}
+
+// WriteResumeRanges answers WriteResume with the ranges the target already
+// applied, none if the sync starts over.
+func (e *Encoder) WriteResumeRanges(ranges []Range) error {
+	if len(ranges) > MaxResumeRanges {
+		return fmt.Errorf("%d resume ranges exceed the maximum of %d", len(ranges), MaxResumeRanges)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, uint32(len(ranges))); err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if err := binary.Write(e.w, binary.LittleEndian, r.Offset); err != nil {
+			return err
+		}
+		if err := binary.Write(e.w, binary.LittleEndian, r.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteDigest follows a pass end record with the digest of the source, or a
+// pass ack with the digest of the target.
+func (e *Encoder) WriteDigest(digest []byte) error {
+	if !e.features.Has(FeatureSourceDigest) {
+		return fmt.Errorf("digests require the %s feature", FeatureSourceDigest)
+	}
+	if len(digest) > HashLength {
+		return fmt.Errorf("digest of %d bytes exceeds the maximum of %d", len(digest), HashLength)
+	}
+	if _, err := e.w.Write([]byte{byte(len(digest))}); err != nil {
+		return err
+	}
+	_, err := e.w.Write(digest)
+	return err
+}
+
+// castagnoli is the table of the CRC32C stream checksum.
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// newStreamChecksum returns the stream checksum of the features.
+func newStreamChecksum(features Features) hash.Hash32 {
+	if features.Has(FeatureCRC32C) {
+		return crc32.New(castagnoli)
+	}
+	return crc32.NewIEEE()
+}
+
+// WriteSourceSize starts the record stream sent from the client to the server.
+// With the stream checksum feature, the checksum covers the stream from the
+// source size on.
+func (e *Encoder) WriteSourceSize(size int64) error {
+	if e.features.Has(FeatureStreamChecksum) {
+		e.checksum = newStreamChecksum(e.features)
+		e.w = io.MultiWriter(e.w, e.checksum)
+	}
+	return binary.Write(e.w, binary.LittleEndian, size)
+}
+
+// WriteHole writes a hole of length bytes, the length is only sent with the
+// record lengths feature.
+func (e *Encoder) WriteHole(offset int64, length int) error {
+	if err := binary.Write(e.w, binary.LittleEndian, offset); err != nil {
+		return err
+	}
+	if _, err := e.w.Write([]byte{RecordHole}); err != nil {
+		return err
+	}
+	return e.writeRecordLength(length)
+}
+
+func (e *Encoder) WriteBlock(offset int64, data []byte) error {
+	if err := binary.Write(e.w, binary.LittleEndian, offset); err != nil {
+		return err
+	}
+	if _, err := e.w.Write([]byte{RecordBlock}); err != nil {
+		return err
+	}
+	if err := e.writeRecordLength(len(data)); err != nil {
+		return err
+	}
+	_, err := e.w.Write(data)
+	return err
+}
+
+func (e *Encoder) writeRecordLength(length int) error {
+	if !e.features.Has(FeatureRecordLengths) {
+		return nil
+	}
+	if length < 0 || int64(length) > math.MaxUint32 {
+		return fmt.Errorf("invalid record length %d", length)
+	}
+	return binary.Write(e.w, binary.LittleEndian, uint32(length))
+}
+
+func (e *Encoder) WritePassEnd(pass int64) error {
+	if !e.features.Has(FeatureIterative) {
+		return fmt.Errorf("pass end requires the %s feature", FeatureIterative)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, pass); err != nil {
+		return err
+	}
+	if _, err := e.w.Write([]byte{RecordPassEnd}); err != nil {
+		return err
+	}
+	if e.checksum == nil {
+		return nil
+	}
+	e.passChecksum = e.checksum.Sum32()
+	return binary.Write(e.w, binary.LittleEndian, e.passChecksum)
+}
+
+// PassChecksum returns the stream checksum sent with the last pass end.
+func (e *Encoder) PassChecksum() uint32 {
+	return e.passChecksum
+}
+
+func (e *Encoder) WriteResize(size int64) error {
+	if !e.features.Has(FeatureResize) {
+		return fmt.Errorf("resize requires the %s feature", FeatureResize)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	_, err := e.w.Write([]byte{RecordResize})
+	return err
+}
+
+func (e *Encoder) WriteCancel() error {
+	if !e.features.Has(FeatureCancel) {
+		return fmt.Errorf("cancel requires the %s feature", FeatureCancel)
+	}
+	if err := binary.Write(e.w, binary.LittleEndian, int64(0)); err != nil {
+		return err
+	}
+	_, err := e.w.Write([]byte{RecordCancel})
+	return err
+}
+
+// WritePassAck is sent by the server once a pass has been synced to disk.
+// With the stream checksum feature it is followed by the checksum of the
+// received stream.
+func (e *Encoder) WritePassAck(pass int64, checksum uint32) error {
+	if err := binary.Write(e.w, binary.LittleEndian, pass); err != nil {
+		return err
+	}
+	if !e.features.Has(FeatureStreamChecksum) {
+		return nil
+	}
+	return binary.Write(e.w, binary.LittleEndian, checksum)
+}
+
+// Decoder reads protocol elements written by an Encoder.
+type Decoder struct {
+	r          io.Reader
+	version    Version
+	features   Features
+	hashLength int
+	nextOffset int64
+	blockSize  int64
+	checksum   hash.Hash32
+}
+
+func NewDecoder(r io.Reader, version Version, features Features) *Decoder {
+	return &Decoder{
+		r:          r,
+		version:    version,
+		features:   features,
+		hashLength: HashLength,
+	}
+}
+
+func (d *Decoder) Version() Version {
+	return d.version
+}
+
+func (d *Decoder) Features() Features {
+	return d.features
+}
+
+func (d *Decoder) ReadHashHeader() (int64, int64, error) {
+	var blockSize int64
+	if err := binary.Read(d.r, binary.LittleEndian, &blockSize); err != nil {
+		return 0, 0, err
+	}
+	var count int64
+	if err := binary.Read(d.r, binary.LittleEndian, &count); err != nil {
+		return 0, 0, err
+	}
+	if d.features.Has(FeatureCompactHashes) {
+		hashLength := make([]byte, 1)
+		if _, err := io.ReadFull(d.r, hashLength); err != nil {
+			return 0, 0, err
+		}
+		if hashLength[0] < MinHashLength || hashLength[0] > HashLength {
+			return 0, 0, fmt.Errorf("invalid hash length %d", hashLength[0])
+		}
+		d.hashLength = int(hashLength[0])
+		d.blockSize = blockSize
+		d.nextOffset = 0
+	}
+	return blockSize, count, nil
+}
+
+// HashLength returns the length of the hashes returned by ReadHash, shorter
+// than HashLength if the peer truncated them.
+func (d *Decoder) HashLength() int {
+	return d.hashLength
+}
+
+// ReadHash reads an offset and its hash, the hash is read into a new slice.
+func (d *Decoder) ReadHash() (int64, []byte, error) {
+	var offset int64
+	if d.features.Has(FeatureCompactHashes) {
+		delta, err := binary.ReadUvarint(byteReader{d.r})
+		if err != nil {
+			return 0, nil, err
+		}
+		offset = d.nextOffset + int64(delta)
+		d.nextOffset = offset + d.blockSize
+	} else if err := binary.Read(d.r, binary.LittleEndian, &offset); err != nil {
+		return 0, nil, err
+	}
+	hash := make([]byte, d.hashLength)
+	if _, err := io.ReadFull(d.r, hash); err != nil {
+		return 0, nil, err
+	}
+	return offset, hash, nil
+}
+
+// byteReader reads single bytes from a reader, callers should buffer the
+// reader to avoid small reads.
+type byteReader struct {
+	io.Reader
+}
+
+func (b byteReader) ReadByte() (byte, error) {
+	if br, ok := b.Reader.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(b.Reader, buf)
+	return buf[0], err
+}
+
+func (d *Decoder) ReadBloomFilter() (uint8, []uint64, error) {
+	hashCount := make([]byte, 1)
+	if _, err := io.ReadFull(d.r, hashCount); err != nil {
+		return 0, nil, err
+	}
+	var count uint64
+	if err := binary.Read(d.r, binary.LittleEndian, &count); err != nil {
+		return 0, nil, err
+	}
+	if count > MaxBloomFilterWords {
+		return 0, nil, fmt.Errorf("bloom filter of %d words too large", count)
+	}
+	words := make([]uint64, count)
+	if err := binary.Read(d.r, binary.LittleEndian, words); err != nil {
+		return 0, nil, err
+	}
+	return hashCount[0], words, nil
+}
+
+func (d *Decoder) ReadPreflight() (int64, int64, error) {
+	var sourceSize, dataSize int64
+	if err := binary.Read(d.r, binary.LittleEndian, &sourceSize); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(d.r, binary.LittleEndian, &dataSize); err != nil {
+		return 0, 0, err
+	}
+	return sourceSize, dataSize, nil
+}
+
+func (d *Decoder) ReadPreflightResult() (string, error) {
+	var length uint16
+	if err := binary.Read(d.r, binary.LittleEndian, &length); err != nil {
+		return "", err
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(d.r, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+func (d *Decoder) ReadShards() (int64, int64, error) {
+	var shardSize, sourceSize int64
+	if err := binary.Read(d.r, binary.LittleEndian, &shardSize); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(d.r, binary.LittleEndian, &sourceSize); err != nil {
+		return 0, 0, err
+	}
+	return shardSize, sourceSize, nil
+}
+
+func (d *Decoder) ReadShardResume() (int64, error) {
+	var shard int64
+	err := binary.Read(d.r, binary.LittleEndian, &shard)
+	return shard, err
+}
+
+func (d *Decoder) ReadResume() (int64, int64, error) {
+	var sourceSize, blockSize int64
+	if err := binary.Read(d.r, binary.LittleEndian, &sourceSize); err != nil {
+		return 0, 0, err
+	}
+	if err := binary.Read(d.r, binary.LittleEndian, &blockSize); err != nil {
+		return 0, 0, err
+	}
+	return sourceSize, blockSize, nil
+}
+
+func (d *Decoder) ReadResumeRanges() ([]Range, error) {
+	var count uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &count); err != nil {
+		return nil, err
+	}
+	if count > MaxResumeRanges {
+		return nil, fmt.Errorf("%d resume ranges exceed the maximum of %d", count, MaxResumeRanges)
+	}
+	ranges := make([]Range, count)
+	for i := range ranges {
+		if err := binary.Read(d.r, binary.LittleEndian, &ranges[i].Offset); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(d.r, binary.LittleEndian, &ranges[i].Length); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+func (d *Decoder) ReadDigest() ([]byte, error) {
+	var length [1]byte
+	if _, err := io.ReadFull(d.r, length[:]); err != nil {
+		return nil, err
+	}
+	if length[0] > HashLength {
+		return nil, fmt.Errorf("digest of %d bytes exceeds the maximum of %d", length[0], HashLength)
+	}
+	digest := make([]byte, length[0])
+	if _, err := io.ReadFull(d.r, digest); err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+func (d *Decoder) ReadSourceSize() (int64, error) {
+	if d.features.Has(FeatureStreamChecksum) {
+		d.checksum = newStreamChecksum(d.features)
+		d.r = io.TeeReader(d.r, d.checksum)
+	}
+	var size int64
+	err := binary.Read(d.r, binary.LittleEndian, &size)
+	return size, err
+}
+
+// ReadRecordOffset reads the offset of the next record, followed by
+// ReadRecordType. For a block record the caller then reads the data with
+// ReadBlockData.
+func (d *Decoder) ReadRecordOffset() (int64, error) {
+	var offset int64
+	err := binary.Read(d.r, binary.LittleEndian, &offset)
+	return offset, err
+}
+
+func (d *Decoder) ReadRecordType() (byte, error) {
+	recordType := make([]byte, 1)
+	if n, err := d.r.Read(recordType); err != nil || n != 1 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return recordType[0], nil
+}
+
+// ReadRecordLength follows a block or hole record with the record lengths
+// feature, it returns the length of the data of the record. The record is
+// complete, the end of the stream is io.ErrUnexpectedEOF.
+func (d *Decoder) ReadRecordLength() (int, error) {
+	if !d.features.Has(FeatureRecordLengths) {
+		return 0, fmt.Errorf("record lengths require the %s feature", FeatureRecordLengths)
+	}
+	var length uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// ReadPassChecksum follows a pass end record, it returns the checksum sent by
+// the peer and the checksum of the stream received before it. Both are 0
+// without the stream checksum feature.
+func (d *Decoder) ReadPassChecksum() (uint32, uint32, error) {
+	if d.checksum == nil {
+		return 0, 0, nil
+	}
+	received := d.checksum.Sum32()
+	var sent uint32
+	if err := binary.Read(d.r, binary.LittleEndian, &sent); err != nil {
+		return 0, 0, err
+	}
+	return sent, received, nil
+}
+
+// ReadPassAck returns the acknowledged pass, and the checksum of the stream
+// the server received with the stream checksum feature.
+func (d *Decoder) ReadPassAck() (int64, uint32, error) {
+	var pass int64
+	if err := binary.Read(d.r, binary.LittleEndian, &pass); err != nil {
+		return 0, 0, err
+	}
+	var checksum uint32
+	if d.features.Has(FeatureStreamChecksum) {
+		if err := binary.Read(d.r, binary.LittleEndian, &checksum); err != nil {
+			return 0, 0, err
+		}
+	}
+	return pass, checksum, nil
+}
+
+// ReadBlockData fills buf with block data, a short read at the end of the
+// stream returns the number of bytes read and io.ErrUnexpectedEOF.
+func (d *Decoder) ReadBlockData(buf []byte) (int, error) {
+	return io.ReadFull(d.r, buf)
+}
@@ -0,0 +1,440 @@
+package codec
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+type testHash struct {
+	offset int64
+	hash   []byte
+}
+
+type testRecord struct {
+	offset     int64
+	recordType byte
+	data       []byte
+}
+
+const (
+	testBlockSize  = int64(4096)
+	testSourceSize = int64(12288)
+)
+
+func testHashes() []testHash {
+	res := []testHash{}
+	for i := int64(0); i < 2; i++ {
+		hash := make([]byte, HashLength)
+		for j := range hash {
+			hash[j] = byte(int64(j) + i*HashLength)
+		}
+		res = append(res, testHash{offset: i * testBlockSize, hash: hash})
+	}
+	return res
+}
+
+func testRecords() []testRecord {
+	return []testRecord{
+		{offset: 0, recordType: RecordHole},
+		{offset: testBlockSize, recordType: RecordBlock, data: bytes.Repeat([]byte{0xAB}, int(testBlockSize))},
+		{offset: 2 * testBlockSize, recordType: RecordBlock, data: []byte("short tail")},
+	}
+}
+
+func goldenName(name string, features Features) string {
+	if features != 0 {
+		return name + "-" + features.String()
+	}
+	return name
+}
+
+func goldenFile(version Version, name string) string {
+	return filepath.Join("testdata", fmt.Sprintf("v%d", version), name+".golden")
+}
+
+func compareGolden(version Version, name string, data []byte) {
+	fileName := goldenFile(version, name)
+	if *update {
+		Expect(os.MkdirAll(filepath.Dir(fileName), 0755)).To(Succeed())
+		Expect(os.WriteFile(fileName, data, 0644)).To(Succeed())
+	}
+	golden, err := os.ReadFile(fileName)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(data).To(Equal(golden), "encoding of %s changed, if this is intended bump the protocol version", fileName)
+}
+
+func encodeHashes(e *Encoder) {
+	hashes := testHashes()
+	Expect(e.WriteHashHeader(testBlockSize, int64(len(hashes)))).To(Succeed())
+	for _, h := range hashes {
+		Expect(e.WriteHash(h.offset, h.hash)).To(Succeed())
+	}
+}
+
+func encodeRecords(e *Encoder) {
+	Expect(e.WriteSourceSize(testSourceSize)).To(Succeed())
+	for _, r := range testRecords() {
+		if r.recordType == RecordHole {
+			Expect(e.WriteHole(r.offset, int(testBlockSize))).To(Succeed())
+		} else {
+			Expect(e.WriteBlock(r.offset, r.data)).To(Succeed())
+		}
+	}
+}
+
+func decodeHashes(d *Decoder) {
+	blockSize, count, err := d.ReadHashHeader()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(blockSize).To(Equal(testBlockSize))
+	expected := testHashes()
+	Expect(count).To(Equal(int64(len(expected))))
+	for _, h := range expected {
+		offset, hash, err := d.ReadHash()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(offset).To(Equal(h.offset))
+		Expect(hash).To(Equal(h.hash))
+	}
+}
+
+func decodeRecords(d *Decoder) {
+	size, err := d.ReadSourceSize()
+	Expect(err).ToNot(HaveOccurred())
+	Expect(size).To(Equal(testSourceSize))
+	for _, r := range testRecords() {
+		offset, err := d.ReadRecordOffset()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(offset).To(Equal(r.offset))
+		recordType, err := d.ReadRecordType()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(recordType).To(Equal(r.recordType))
+		if d.Features().Has(FeatureRecordLengths) {
+			length, err := d.ReadRecordLength()
+			Expect(err).ToNot(HaveOccurred())
+			if recordType == RecordHole {
+				Expect(length).To(Equal(int(testBlockSize)))
+				continue
+			}
+			Expect(length).To(Equal(len(r.data)))
+			buf := make([]byte, length)
+			Expect(d.ReadBlockData(buf)).To(Equal(length))
+			Expect(buf).To(Equal(r.data))
+			continue
+		}
+		if recordType == RecordBlock {
+			buf := make([]byte, testBlockSize)
+			n, err := d.ReadBlockData(buf)
+			if len(r.data) < int(testBlockSize) {
+				Expect(err).To(Equal(io.ErrUnexpectedEOF))
+			} else {
+				Expect(err).ToNot(HaveOccurred())
+			}
+			Expect(buf[:n]).To(Equal(r.data))
+		}
+	}
+	_, err = d.ReadRecordOffset()
+	Expect(err).To(Equal(io.EOF))
+}
+
+var _ = Describe("codec golden file tests", func() {
+	DescribeTable("should match the golden files", func(version Version, features Features) {
+		buf := &bytes.Buffer{}
+		encodeHashes(NewEncoder(buf, version, features))
+		compareGolden(version, goldenName("hashes", features), buf.Bytes())
+		buf.Reset()
+		encodeRecords(NewEncoder(buf, version, features))
+		compareGolden(version, goldenName("records", features&^FeatureCompactHashes), buf.Bytes())
+	},
+		Entry("version 0", Version0, Features(0)),
+		Entry("version 1", Version1, Features(0)),
+		Entry("version 1 with compact hashes", Version1, FeatureCompactHashes),
+		Entry("version 1 with record lengths", Version1, FeatureRecordLengths),
+	)
+
+	DescribeTable("should decode the golden files", func(version Version, features Features) {
+		data, err := os.ReadFile(goldenFile(version, goldenName("hashes", features)))
+		Expect(err).ToNot(HaveOccurred())
+		decodeHashes(NewDecoder(bytes.NewReader(data), version, features))
+		data, err = os.ReadFile(goldenFile(version, goldenName("records", features&^FeatureCompactHashes)))
+		Expect(err).ToNot(HaveOccurred())
+		decodeRecords(NewDecoder(bytes.NewReader(data), version, features))
+	},
+		Entry("version 0", Version0, Features(0)),
+		Entry("version 1", Version1, Features(0)),
+		Entry("version 1 with compact hashes", Version1, FeatureCompactHashes),
+		Entry("version 1 with record lengths", Version1, FeatureRecordLengths),
+	)
+
+	It("should match the hello golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(WriteHello(buf, Hello{Version: Version1, Features: 0})).To(Succeed())
+		compareGolden(Version1, "hello", buf.Bytes())
+		hello, err := ReadHello(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hello).To(Equal(Hello{Version: Version1}))
+	})
+
+	It("should truncate compact hashes and encode contiguous offsets in one byte", func() {
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, FeatureCompactHashes)
+		Expect(e.SetHashLength(8)).ToNot(Succeed())
+		Expect(e.SetHashLength(MinHashLength)).To(Succeed())
+		encodeHashes(e)
+		// 16 for the header, 1 for the hash length, 1 + hash length per hash
+		Expect(buf.Len()).To(Equal(17 + 2*(1+MinHashLength)))
+		d := NewDecoder(buf, CurrentVersion, FeatureCompactHashes)
+		_, _, err := d.ReadHashHeader()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.HashLength()).To(Equal(MinHashLength))
+		for _, h := range testHashes() {
+			offset, hash, err := d.ReadHash()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(offset).To(Equal(h.offset))
+			Expect(hash).To(Equal(h.hash[:MinHashLength]))
+		}
+	})
+
+	It("should reject decreasing offsets with compact hashes", func() {
+		e := NewEncoder(io.Discard, CurrentVersion, FeatureCompactHashes)
+		Expect(e.WriteHashHeader(testBlockSize, 2)).To(Succeed())
+		Expect(e.WriteHash(testBlockSize, testHashes()[0].hash)).To(Succeed())
+		Expect(e.WriteHash(0, testHashes()[0].hash)).ToNot(Succeed())
+	})
+
+	It("should match the bloom filter golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, FeatureBloomFilter).WriteBloomFilter(7, []uint64{1, 0xdeadbeef})).To(Succeed())
+		compareGolden(Version1, "bloom-filter", buf.Bytes())
+		hashCount, words, err := NewDecoder(buf, CurrentVersion, FeatureBloomFilter).ReadBloomFilter()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(hashCount).To(Equal(uint8(7)))
+		Expect(words).To(Equal([]uint64{1, 0xdeadbeef}))
+	})
+
+	It("should match the pass golden file", func() {
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, FeatureIterative)
+		Expect(e.WriteHole(0, int(testBlockSize))).To(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		Expect(e.WritePassAck(1, 0)).To(Succeed())
+		compareGolden(Version1, "pass", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureIterative)
+		_, err := d.ReadRecordOffset()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(d.ReadRecordType()).To(Equal(RecordHole))
+		Expect(d.ReadRecordOffset()).To(Equal(int64(1)))
+		Expect(d.ReadRecordType()).To(Equal(RecordPassEnd))
+		pass, _, err := d.ReadPassAck()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pass).To(Equal(int64(1)))
+	})
+
+	It("should match the stream checksum golden file", func() {
+		features := FeatureIterative | FeatureStreamChecksum
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, features)
+		Expect(e.WriteSourceSize(testBlockSize)).To(Succeed())
+		Expect(e.WriteBlock(0, []byte{1, 2, 3, 4})).To(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		Expect(e.PassChecksum()).ToNot(BeZero())
+		Expect(e.WritePassAck(1, e.PassChecksum())).To(Succeed())
+		compareGolden(Version1, "stream-checksum", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, features)
+		Expect(d.ReadSourceSize()).To(Equal(int64(testBlockSize)))
+		Expect(d.ReadRecordOffset()).To(Equal(int64(0)))
+		Expect(d.ReadRecordType()).To(Equal(RecordBlock))
+		data := make([]byte, 4)
+		Expect(d.ReadBlockData(data)).To(Equal(4))
+		Expect(d.ReadRecordOffset()).To(Equal(int64(1)))
+		Expect(d.ReadRecordType()).To(Equal(RecordPassEnd))
+		sent, received, err := d.ReadPassChecksum()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sent).To(Equal(e.PassChecksum()))
+		Expect(received).To(Equal(sent))
+		pass, checksum, err := d.ReadPassAck()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pass).To(Equal(int64(1)))
+		Expect(checksum).To(Equal(e.PassChecksum()))
+	})
+
+	It("should match the CRC32C stream checksum golden file", func() {
+		features := FeatureIterative | FeatureStreamChecksum | FeatureCRC32C
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, features)
+		Expect(e.WriteSourceSize(testBlockSize)).To(Succeed())
+		Expect(e.WriteBlock(0, []byte{1, 2, 3, 4})).To(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		ieee := &bytes.Buffer{}
+		ieeeEncoder := NewEncoder(ieee, CurrentVersion, FeatureIterative|FeatureStreamChecksum)
+		Expect(ieeeEncoder.WriteSourceSize(testBlockSize)).To(Succeed())
+		Expect(ieeeEncoder.WriteBlock(0, []byte{1, 2, 3, 4})).To(Succeed())
+		Expect(ieeeEncoder.WritePassEnd(1)).To(Succeed())
+		Expect(e.PassChecksum()).ToNot(Equal(ieeeEncoder.PassChecksum()))
+		compareGolden(Version1, "stream-checksum-crc32c", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, features)
+		Expect(d.ReadSourceSize()).To(Equal(int64(testBlockSize)))
+		Expect(d.ReadRecordOffset()).To(Equal(int64(0)))
+		Expect(d.ReadRecordType()).To(Equal(RecordBlock))
+		Expect(d.ReadBlockData(make([]byte, 4))).To(Equal(4))
+		Expect(d.ReadRecordOffset()).To(Equal(int64(1)))
+		Expect(d.ReadRecordType()).To(Equal(RecordPassEnd))
+		sent, received, err := d.ReadPassChecksum()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sent).To(Equal(e.PassChecksum()))
+		Expect(received).To(Equal(sent))
+	})
+
+	It("should detect a corrupted stream with the stream checksum", func() {
+		features := FeatureIterative | FeatureStreamChecksum
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, features)
+		Expect(e.WriteSourceSize(testBlockSize)).To(Succeed())
+		Expect(e.WriteBlock(0, []byte{1, 2, 3, 4})).To(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		data := buf.Bytes()
+		data[8+8+1] ^= 0xff
+		d := NewDecoder(bytes.NewReader(data), CurrentVersion, features)
+		_, err := d.ReadSourceSize()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = d.ReadRecordOffset()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = d.ReadRecordType()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = d.ReadBlockData(make([]byte, 4))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = d.ReadRecordOffset()
+		Expect(err).ToNot(HaveOccurred())
+		_, err = d.ReadRecordType()
+		Expect(err).ToNot(HaveOccurred())
+		sent, received, err := d.ReadPassChecksum()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).ToNot(Equal(sent))
+	})
+
+	It("should match the resize golden file", func() {
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, FeatureIterative|FeatureResize)
+		Expect(e.WriteResize(1 << 20)).To(Succeed())
+		Expect(e.WriteBlock(1<<20-2, []byte{1, 2})).To(Succeed())
+		Expect(e.WritePassEnd(2)).To(Succeed())
+		compareGolden(Version1, "resize", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureIterative|FeatureResize)
+		Expect(d.ReadRecordOffset()).To(Equal(int64(1 << 20)))
+		Expect(d.ReadRecordType()).To(Equal(RecordResize))
+	})
+
+	It("should match the cancel golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, 0).WriteCancel()).To(HaveOccurred())
+		e := NewEncoder(buf, CurrentVersion, FeatureCancel)
+		Expect(e.WriteBlock(0, []byte{1, 2})).To(Succeed())
+		Expect(e.WriteCancel()).To(Succeed())
+		compareGolden(Version1, "cancel", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureCancel)
+		Expect(d.ReadRecordOffset()).To(BeZero())
+		Expect(d.ReadRecordType()).To(Equal(RecordBlock))
+		Expect(d.ReadBlockData(make([]byte, 2))).To(Equal(2))
+		Expect(d.ReadRecordOffset()).To(BeZero())
+		Expect(d.ReadRecordType()).To(Equal(RecordCancel))
+	})
+
+	It("should match the preflight golden file", func() {
+		buf := &bytes.Buffer{}
+		e := NewEncoder(buf, CurrentVersion, FeaturePreflight)
+		Expect(e.WritePreflight(1<<20, 1<<16)).To(Succeed())
+		Expect(e.WritePreflightResult("no space")).To(Succeed())
+		Expect(e.WritePreflightResult("")).To(Succeed())
+		compareGolden(Version1, "preflight", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeaturePreflight)
+		sourceSize, dataSize, err := d.ReadPreflight()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sourceSize).To(Equal(int64(1 << 20)))
+		Expect(dataSize).To(Equal(int64(1 << 16)))
+		Expect(d.ReadPreflightResult()).To(Equal("no space"))
+		Expect(d.ReadPreflightResult()).To(BeEmpty())
+	})
+
+	It("should match the shards golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, 0).WriteShards(1<<20, 1<<22)).ToNot(Succeed())
+		e := NewEncoder(buf, CurrentVersion, FeatureShards)
+		Expect(e.WriteShards(1<<20, 1<<22)).To(Succeed())
+		Expect(e.WriteShardResume(3)).To(Succeed())
+		compareGolden(Version1, "shards", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureShards)
+		shardSize, sourceSize, err := d.ReadShards()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(shardSize).To(Equal(int64(1 << 20)))
+		Expect(sourceSize).To(Equal(int64(1 << 22)))
+		Expect(d.ReadShardResume()).To(Equal(int64(3)))
+	})
+
+	It("should match the resume golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, 0).WriteResume(1<<22, 1<<16)).ToNot(Succeed())
+		e := NewEncoder(buf, CurrentVersion, FeatureResume)
+		Expect(e.WriteResume(1<<22, 1<<16)).To(Succeed())
+		Expect(e.WriteResumeRanges([]Range{{Offset: 0, Length: 1 << 17}, {Offset: 1 << 20, Length: 1 << 16}})).To(Succeed())
+		Expect(e.WriteResumeRanges(nil)).To(Succeed())
+		compareGolden(Version1, "resume", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureResume)
+		sourceSize, blockSize, err := d.ReadResume()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(sourceSize).To(Equal(int64(1 << 22)))
+		Expect(blockSize).To(Equal(int64(1 << 16)))
+		Expect(d.ReadResumeRanges()).To(Equal([]Range{{Offset: 0, Length: 1 << 17}, {Offset: 1 << 20, Length: 1 << 16}}))
+		Expect(d.ReadResumeRanges()).To(BeEmpty())
+	})
+
+	It("should match the source digest golden file", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, 0).WriteDigest([]byte{1})).ToNot(Succeed())
+		e := NewEncoder(buf, CurrentVersion, FeatureIterative|FeatureSourceDigest)
+		Expect(e.WriteDigest(make([]byte, HashLength+1))).ToNot(Succeed())
+		Expect(e.WritePassEnd(1)).To(Succeed())
+		Expect(e.WriteDigest(bytes.Repeat([]byte{0xab}, HashLength))).To(Succeed())
+		Expect(e.WritePassAck(1, 0)).To(Succeed())
+		Expect(e.WriteDigest(nil)).To(Succeed())
+		compareGolden(Version1, "source-digest", buf.Bytes())
+		d := NewDecoder(buf, CurrentVersion, FeatureIterative|FeatureSourceDigest)
+		Expect(d.ReadRecordOffset()).To(Equal(int64(1)))
+		Expect(d.ReadRecordType()).To(Equal(RecordPassEnd))
+		Expect(d.ReadDigest()).To(Equal(bytes.Repeat([]byte{0xab}, HashLength)))
+		pass, _, err := d.ReadPassAck()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pass).To(Equal(int64(1)))
+		Expect(d.ReadDigest()).To(BeEmpty())
+	})
+
+	It("should not write resize records without the resize feature", func() {
+		Expect(NewEncoder(io.Discard, CurrentVersion, FeatureIterative).WriteResize(1)).ToNot(Succeed())
+	})
+
+	It("should not write pass end records without the iterative feature", func() {
+		Expect(NewEncoder(io.Discard, CurrentVersion, 0).WritePassEnd(1)).ToNot(Succeed())
+	})
+
+	It("should not end a record stream in the middle of a record length", func() {
+		buf := &bytes.Buffer{}
+		Expect(NewEncoder(buf, CurrentVersion, FeatureRecordLengths).WriteBlock(0, []byte{1, 2})).To(Succeed())
+		d := NewDecoder(bytes.NewReader(buf.Bytes()[:8+1+2]), CurrentVersion, FeatureRecordLengths)
+		Expect(d.ReadRecordOffset()).To(BeZero())
+		Expect(d.ReadRecordType()).To(Equal(RecordBlock))
+		_, err := d.ReadRecordLength()
+		Expect(err).To(Equal(io.ErrUnexpectedEOF))
+		_, err = NewDecoder(buf, CurrentVersion, 0).ReadRecordLength()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject hashes of the wrong length", func() {
+		Expect(NewEncoder(io.Discard, CurrentVersion, 0).WriteHash(0, []byte("short"))).ToNot(Succeed())
+	})
+})
@@ -0,0 +1,138 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// MinHandshakeVersion is the first version that exchanges a Hello.
+	MinHandshakeVersion = Version1
+	// CompatV0 forces the original un-versioned format without a handshake.
+	CompatV0 = "v0"
+)
+
+var (
+	Magic = [4]byte{'B', 'R', 'S', 'Y'}
+	// snappyMagic starts the stream of a peer that does not know the handshake.
+	snappyMagic = []byte{0xff, 0x06, 0x00, 0x00}
+)
+
+// VersionSkewError is returned when the peers cannot agree on a protocol.
+type VersionSkewError struct {
+	Local  Hello
+	Remote Hello
+	// Missing are the required features the remote did not enable.
+	Missing Features
+}
+
+func (e *VersionSkewError) Error() string {
+	msg := fmt.Sprintf("incompatible peer: local protocol version %d (features %s), peer protocol version %d (features %s)",
+		e.Local.Version, e.Local.Features, e.Remote.Version, e.Remote.Features)
+	if e.Missing != 0 {
+		msg += fmt.Sprintf(", peer is missing required features %s", e.Missing)
+	}
+	return msg + ": " + e.Remediation()
+}
+
+// Remediation suggests how to make the peers compatible.
+func (e *VersionSkewError) Remediation() string {
+	switch {
+	case e.Remote.Version == Version0:
+		return fmt.Sprintf("upgrade the peer, or run this side with --compat=%s", CompatV0)
+	case e.Remote.Version < e.Local.Version:
+		return "upgrade the peer to the same version as this side"
+	case e.Remote.Version > e.Local.Version:
+		return "upgrade this side to the same version as the peer"
+	default:
+		return "enable the missing features on the peer"
+	}
+}
+
+// Hello is exchanged at the start of every connection, the server writes its
+// Hello first and the client answers with its own.
+type Hello struct {
+	Version  Version
+	Features Features
+}
+
+func LocalHello(features Features) Hello {
+	return Hello{
+		Version:  CurrentVersion,
+		Features: features,
+	}
+}
+
+func WriteHello(w io.Writer, hello Hello) error {
+	buf := bytes.NewBuffer(make([]byte, 0, len(Magic)+6))
+	buf.Write(Magic[:])
+	_ = binary.Write(buf, binary.LittleEndian, hello.Version)
+	_ = binary.Write(buf, binary.LittleEndian, hello.Features)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func ReadHello(r io.Reader) (Hello, error) {
+	buf := make([]byte, len(Magic)+6)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return Hello{}, fmt.Errorf("peer closed the connection during the handshake, it may be an older version without protocol negotiation, upgrade it or run this side with --compat=%s: %w", CompatV0, err)
+		}
+		return Hello{}, err
+	}
+	if bytes.HasPrefix(buf, snappyMagic) {
+		return Hello{}, &VersionSkewError{Local: LocalHello(0), Remote: Hello{Version: Version0}}
+	}
+	if !bytes.Equal(buf[:len(Magic)], Magic[:]) {
+		return Hello{}, fmt.Errorf("invalid handshake magic %q", buf[:len(Magic)])
+	}
+	return Hello{
+		Version:  Version(binary.LittleEndian.Uint16(buf[len(Magic):])),
+		Features: Features(binary.LittleEndian.Uint32(buf[len(Magic)+2:])),
+	}, nil
+}
+
+// Negotiate picks the highest version both peers support and the features
+// both peers enabled. The required features must be enabled by the remote.
+func Negotiate(local, remote Hello, required Features) (Hello, error) {
+	res := Hello{
+		Version:  min(local.Version, remote.Version),
+		Features: local.Features & remote.Features,
+	}
+	missing := required &^ remote.Features
+	if res.Version < MinHandshakeVersion || missing != 0 {
+		return Hello{}, &VersionSkewError{Local: local, Remote: remote, Missing: missing}
+	}
+	return res, nil
+}
+
+// ServerHandshake sends the local Hello, then reads the client Hello.
+func ServerHandshake(rw io.ReadWriter, local Hello, required Features) (Hello, error) {
+	if err := WriteHello(rw, local); err != nil {
+		return Hello{}, err
+	}
+	remote, err := ReadHello(rw)
+	if err != nil {
+		return Hello{}, err
+	}
+	return Negotiate(local, remote, required)
+}
+
+// ClientHandshake reads the server Hello, then answers with the local Hello.
+func ClientHandshake(rw io.ReadWriter, local Hello, required Features) (Hello, error) {
+	remote, err := ReadHello(rw)
+	if err != nil {
+		var skew *VersionSkewError
+		if errors.As(err, &skew) {
+			skew.Local = local
+		}
+		return Hello{}, err
+	}
+	if err := WriteHello(rw, local); err != nil {
+		return Hello{}, err
+	}
+	return Negotiate(local, remote, required)
+}
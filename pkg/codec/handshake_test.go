@@ -0,0 +1,76 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("handshake tests", func() {
+	It("should negotiate the lowest version and common features", func() {
+		res, err := Negotiate(Hello{Version: 3, Features: 0x3}, Hello{Version: Version1, Features: 0x6}, 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal(Hello{Version: Version1, Features: 0x2}))
+	})
+
+	It("should refuse versions without a handshake", func() {
+		_, err := Negotiate(LocalHello(0), Hello{Version: Version0}, 0)
+		var skew *VersionSkewError
+		Expect(errors.As(err, &skew)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("--compat=v0"))
+	})
+
+	It("should report missing required features", func() {
+		_, err := Negotiate(LocalHello(FeatureCompactHashes|FeatureIterative), Hello{Version: CurrentVersion, Features: FeatureCompactHashes}, FeatureIterative|1<<20)
+		var skew *VersionSkewError
+		Expect(errors.As(err, &skew)).To(BeTrue())
+		Expect(skew.Missing).To(Equal(FeatureIterative | 1<<20))
+		Expect(err.Error()).To(ContainSubstring("missing required features iterative,0x100000"))
+	})
+
+	DescribeTable("should suggest which side to upgrade", func(local, remote Version, expected string) {
+		err := &VersionSkewError{Local: Hello{Version: local}, Remote: Hello{Version: remote}}
+		Expect(err.Remediation()).To(ContainSubstring(expected))
+	},
+		Entry("old peer", Version(2), Version1, "upgrade the peer"),
+		Entry("old local", Version1, Version(2), "upgrade this side"),
+		Entry("peer without handshake", Version1, Version0, "--compat=v0"),
+	)
+
+	It("should detect a peer that does not know the handshake", func() {
+		_, err := ClientHandshake(&bytes.Buffer{}, LocalHello(0), 0)
+		Expect(err).To(MatchError(ContainSubstring("older version")))
+		rw := &struct {
+			io.Reader
+			io.Writer
+		}{bytes.NewReader([]byte("\xff\x06\x00\x00sNaPpY")), io.Discard}
+		_, err = ClientHandshake(rw, LocalHello(0), 0)
+		var skew *VersionSkewError
+		Expect(errors.As(err, &skew)).To(BeTrue())
+		Expect(skew.Remote.Version).To(Equal(Version0))
+	})
+
+	It("should reject an invalid magic", func() {
+		_, err := ReadHello(bytes.NewReader([]byte("NOPE\x01\x00\x00\x00\x00\x00")))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should complete a handshake between client and server", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			defer GinkgoRecover()
+			res, err := ServerHandshake(server, LocalHello(0x1), 0)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.Features).To(Equal(Features(0x1)))
+		}()
+		res, err := ClientHandshake(client, LocalHello(0x3), 0)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal(Hello{Version: CurrentVersion, Features: 0x1}))
+	})
+})
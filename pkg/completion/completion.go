@@ -0,0 +1,159 @@
+package completion
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Shells are the shells a completion script can be written for.
+var Shells = []string{"bash", "zsh", "fish"}
+
+// Command describes what the completion script of a command completes
+// besides its flags. Device and file paths are completed by the shell.
+type Command struct {
+	// Name is the name of the binary
+	Name string
+	// Subcommands are completed as the first argument, the completion
+	// subcommand completes the shells
+	Subcommands []string
+	// Values are the values completed for flags that only accept a few
+	Values map[string][]string
+	// DirValues complete a flag with the names of the files in the directory
+	// given to another flag, read when completing, like the identifiers of
+	// the identifier map directory of the proxy
+	DirValues map[string]string
+}
+
+// Write writes the completion script of the command and its flags for the
+// shell.
+func Write(w io.Writer, shell string, cmd Command, flags *pflag.FlagSet) error {
+	switch shell {
+	case "bash":
+		return writeBash(w, cmd, flags)
+	case "zsh":
+		if _, err := fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit"); err != nil {
+			return err
+		}
+		return writeBash(w, cmd, flags)
+	case "fish":
+		return writeFish(w, cmd, flags)
+	}
+	return fmt.Errorf("unsupported shell %q, must be one of %s", shell, strings.Join(Shells, ", "))
+}
+
+// functionName returns the prefix of the shell functions of the command.
+func (c Command) functionName() string {
+	return "_" + strings.NewReplacer("-", "_", ".", "_").Replace(c.Name)
+}
+
+func writeBash(w io.Writer, cmd Command, flags *pflag.FlagSet) error {
+	var names, fileFlags, valueFlags []string
+	fn := cmd.functionName()
+	cases := &strings.Builder{}
+	flags.VisitAll(func(f *pflag.Flag) {
+		names = append(names, "--"+f.Name)
+		if values, ok := cmd.Values[f.Name]; ok {
+			fmt.Fprintf(cases, "\t--%s)\n\t\tCOMPREPLY=($(compgen -W %q -- \"$cur\"))\n\t\treturn\n\t\t;;\n", f.Name, strings.Join(values, " "))
+		} else if dirFlag, ok := cmd.DirValues[f.Name]; ok {
+			fmt.Fprintf(cases, "\t--%s)\n\t\tCOMPREPLY=($(compgen -W \"$(%s_dir_values %s)\" -- \"$cur\"))\n\t\treturn\n\t\t;;\n", f.Name, fn, dirFlag)
+		} else if f.Value.Type() == "string" {
+			fileFlags = append(fileFlags, "--"+f.Name)
+		} else if f.Value.Type() != "bool" {
+			valueFlags = append(valueFlags, "--"+f.Name)
+		}
+	})
+	if len(fileFlags) > 0 {
+		fmt.Fprintf(cases, "\t%s)\n\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n\t\treturn\n\t\t;;\n", strings.Join(fileFlags, "|"))
+	}
+	if len(valueFlags) > 0 {
+		fmt.Fprintf(cases, "\t%s)\n\t\tCOMPREPLY=()\n\t\treturn\n\t\t;;\n", strings.Join(valueFlags, "|"))
+	}
+	if len(cmd.DirValues) > 0 {
+		// The value of the directory flag follows it, or an = that is a
+		// word of its own
+		if _, err := fmt.Fprintf(w, `%[1]s_dir_values() {
+	local i dir
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		if [[ "${COMP_WORDS[i]}" == --$1 || "${COMP_WORDS[i]}" == -$1 ]]; then
+			dir="${COMP_WORDS[i+1]}"
+			if [[ "$dir" == = ]]; then
+				dir="${COMP_WORDS[i+2]}"
+			fi
+		fi
+	done
+	if [[ -d "$dir" ]]; then
+		(cd "$dir" && ls)
+	fi
+}
+`, fn); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, `%[1]s() {
+	local cur="${COMP_WORDS[COMP_CWORD]}"
+	local prev="${COMP_WORDS[COMP_CWORD-1]}"
+	case "$prev" in
+%[2]s	esac
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W %[3]q -- "$cur"))
+	elif [[ $COMP_CWORD -eq 1 ]]; then
+		COMPREPLY=($(compgen -W %[4]q -- "$cur") $(compgen -f -- "$cur"))
+	elif [[ "${COMP_WORDS[1]}" == completion ]]; then
+		COMPREPLY=($(compgen -W %[5]q -- "$cur"))
+	else
+		COMPREPLY=($(compgen -f -- "$cur"))
+	fi
+}
+complete -o filenames -F %[1]s %[6]s
+`, fn, cases.String(), strings.Join(names, " "), strings.Join(cmd.Subcommands, " "), strings.Join(Shells, " "), cmd.Name)
+	return err
+}
+
+func writeFish(w io.Writer, cmd Command, flags *pflag.FlagSet) error {
+	fn := "_" + cmd.functionName()
+	if len(cmd.DirValues) > 0 {
+		if _, err := fmt.Fprintf(w, `function %s_dir_values
+	set -l words (commandline -opc)
+	set -l dir
+	for i in (seq (count $words))
+		if contains -- $words[$i] --$argv[1] -$argv[1]
+			set dir $words[(math $i + 1)]
+		else if string match -q -- "--$argv[1]=*" $words[$i]
+			set dir (string split -m 1 = -- $words[$i])[2]
+		end
+	end
+	test -d "$dir"; and ls $dir
+end
+`, fn); err != nil {
+			return err
+		}
+	}
+	lines := []string{
+		fmt.Sprintf("complete -c %s -n __fish_use_subcommand -a %q", cmd.Name, strings.Join(cmd.Subcommands, " ")),
+		fmt.Sprintf("complete -c %s -n '__fish_seen_subcommand_from completion' -f -a %q", cmd.Name, strings.Join(Shells, " ")),
+	}
+	flags.VisitAll(func(f *pflag.Flag) {
+		line := fmt.Sprintf("complete -c %s -l %s -d %s", cmd.Name, f.Name, fishQuote(f.Usage))
+		if values, ok := cmd.Values[f.Name]; ok {
+			line += fmt.Sprintf(" -x -a %q", strings.Join(values, " "))
+		} else if dirFlag, ok := cmd.DirValues[f.Name]; ok {
+			line += fmt.Sprintf(" -x -a '(%s_dir_values %s)'", fn, dirFlag)
+		} else if f.Value.Type() == "string" {
+			line += " -r -F"
+		} else if f.Value.Type() != "bool" {
+			line += " -x"
+		}
+		lines = append(lines, line)
+	})
+	sort.Strings(lines[2:])
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s) + "'"
+}
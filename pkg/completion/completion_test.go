@@ -0,0 +1,116 @@
+package completion
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("completion tests", func() {
+	var (
+		flags *pflag.FlagSet
+		cmd   Command
+	)
+
+	BeforeEach(func() {
+		flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+		flags.String("target-file", "", "file of the target")
+		flags.String("hole-strategy", "auto", "how holes are written")
+		flags.String("map-dir", "", "directory of the identifiers")
+		flags.String("identifier", "", "identifier of the file")
+		flags.Bool("verbose", false, "log what's done")
+		flags.Int("port", 8000, "port to listen on")
+		cmd = Command{
+			Name:        "test-cmd",
+			Subcommands: []string{"copy", "completion"},
+			Values:      map[string][]string{"hole-strategy": {"auto", "punch"}},
+			DirValues:   map[string]string{"identifier": "map-dir"},
+		}
+	})
+
+	generate := func(shell string) string {
+		var b bytes.Buffer
+		Expect(Write(&b, shell, cmd, flags)).To(Succeed())
+		return b.String()
+	}
+
+	// complete runs the bash completion of the words, the last one is the
+	// word being completed, and returns the completions.
+	complete := func(words ...string) []string {
+		if _, err := exec.LookPath("bash"); err != nil {
+			Skip("bash is not installed")
+		}
+		script := filepath.Join(GinkgoT().TempDir(), "completion.bash")
+		Expect(os.WriteFile(script, []byte(generate("bash")), 0644)).To(Succeed())
+		quoted := make([]string, len(words))
+		for i, word := range words {
+			quoted[i] = "'" + word + "'"
+		}
+		out, err := exec.Command("bash", "-c", `source "$1"
+COMP_WORDS=(`+strings.Join(quoted, " ")+`)
+COMP_CWORD=$((${#COMP_WORDS[@]} - 1))
+_test_cmd
+printf '%s\n' "${COMPREPLY[@]}"`, "bash", script).CombinedOutput()
+		Expect(err).ToNot(HaveOccurred(), string(out))
+		return strings.Fields(string(out))
+	}
+
+	It("should write the flags, subcommands and values for bash", func() {
+		script := generate("bash")
+		Expect(script).To(ContainSubstring("complete -o filenames -F _test_cmd test-cmd"))
+		Expect(script).To(ContainSubstring(`"--hole-strategy --identifier --map-dir --port --target-file --verbose"`))
+		Expect(script).To(ContainSubstring(`compgen -W "auto punch"`))
+		Expect(script).To(ContainSubstring("\t--map-dir|--target-file)\n\t\tCOMPREPLY=($(compgen -f"))
+		Expect(script).To(ContainSubstring("\t--port)\n\t\tCOMPREPLY=()"))
+		Expect(script).To(ContainSubstring(`compgen -W "copy completion"`))
+		Expect(script).To(ContainSubstring(`compgen -W "bash zsh fish"`))
+		Expect(script).To(ContainSubstring("_test_cmd_dir_values map-dir"))
+	})
+
+	It("should complete with the bash script", func() {
+		Expect(complete("test-cmd", "--ver")).To(Equal([]string{"--verbose"}))
+		Expect(complete("test-cmd", "--hole-strategy", "p")).To(Equal([]string{"punch"}))
+		Expect(complete("test-cmd", "--port", "")).To(BeEmpty())
+		Expect(complete("test-cmd", "completion", "z")).To(Equal([]string{"zsh"}))
+	})
+
+	It("should complete identifiers from the directory given on the command line", func() {
+		dir := GinkgoT().TempDir()
+		for _, name := range []string{"disk-a", "disk-b", "other", "..data"} {
+			Expect(os.WriteFile(filepath.Join(dir, name), []byte("/dev/vdb"), 0644)).To(Succeed())
+		}
+		Expect(complete("test-cmd", "--map-dir", dir, "--identifier", "disk")).To(Equal([]string{"disk-a", "disk-b"}))
+		Expect(complete("test-cmd", "--map-dir", "=", dir, "--identifier", "")).To(Equal([]string{"disk-a", "disk-b", "other"}))
+		Expect(complete("test-cmd", "--identifier", "")).To(BeEmpty())
+	})
+
+	It("should load the bash script with bashcompinit for zsh", func() {
+		script := generate("zsh")
+		first, rest, _ := strings.Cut(script, "\n")
+		Expect(first).To(Equal("autoload -U +X bashcompinit && bashcompinit"))
+		Expect(rest).To(Equal(generate("bash")))
+	})
+
+	It("should write the flags, subcommands and values for fish", func() {
+		script := generate("fish")
+		Expect(script).To(ContainSubstring("function __test_cmd_dir_values\n"))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -n __fish_use_subcommand -a "copy completion"`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -n '__fish_seen_subcommand_from completion' -f -a "bash zsh fish"`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -l hole-strategy -d 'how holes are written' -x -a "auto punch"`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -l identifier -d 'identifier of the file' -x -a '(__test_cmd_dir_values map-dir)'`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -l target-file -d 'file of the target' -r -F`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -l port -d 'port to listen on' -x`))
+		Expect(script).To(ContainSubstring(`complete -c test-cmd -l verbose -d 'log what\'s done'` + "\n"))
+	})
+
+	It("should refuse other shells", func() {
+		Expect(Write(&bytes.Buffer{}, "csh", cmd, flags)).To(MatchError(ContainSubstring(`unsupported shell "csh"`)))
+	})
+})
@@ -0,0 +1,379 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	ServiceType    = "_blockrsync._tcp"
+	mdnsDomain     = "local."
+	mdnsAddress    = "224.0.0.251:5353"
+	mdnsTTL        = 120
+	mdnsMaxPacket  = 9000
+	unicastBit     = 1 << 15
+	readPollPeriod = 500 * time.Millisecond
+)
+
+var (
+	ErrServiceNotFound = errors.New("no matching service found")
+)
+
+// Service is a blockrsync proxy advertised through DNS-SD over multicast DNS.
+type Service struct {
+	Instance string
+	Host     string
+	Port     int
+	Addrs    []net.IP
+	Text     []string
+}
+
+// HasText returns true if the service advertises the TXT entry.
+func (s *Service) HasText(entry string) bool {
+	return slices.Contains(s.Text, entry)
+}
+
+// Address returns the first known address of the service.
+func (s *Service) Address() string {
+	if len(s.Addrs) > 0 {
+		return s.Addrs[0].String()
+	}
+	return strings.TrimSuffix(s.Host, ".")
+}
+
+func serviceName() string {
+	return ServiceType + "." + mdnsDomain
+}
+
+func instanceName(instance string) string {
+	return instance + "." + serviceName()
+}
+
+type Advertiser struct {
+	service Service
+	log     logr.Logger
+}
+
+// NewAdvertiser creates an advertiser for an instance listening on port,
+// using the addresses of all non loopback IPv4 interfaces.
+func NewAdvertiser(instance string, port int, text []string, log logr.Logger) (*Advertiser, error) {
+	if instance == "" || strings.Contains(instance, ".") {
+		return nil, fmt.Errorf("invalid instance name %q", instance)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := localAddresses()
+	if err != nil {
+		return nil, err
+	}
+	return &Advertiser{
+		service: Service{
+			Instance: instance,
+			Host:     strings.Split(hostname, ".")[0] + "." + mdnsDomain,
+			Port:     port,
+			Addrs:    addrs,
+			Text:     text,
+		},
+		log: log,
+	}, nil
+}
+
+func localAddresses() ([]net.IP, error) {
+	interfaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var res []net.IP
+	for _, addr := range interfaceAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			res = append(res, ipNet.IP.To4())
+		}
+	}
+	return res, nil
+}
+
+// Run answers queries for the service until the context is cancelled.
+func (a *Advertiser) Run(ctx context.Context) error {
+	groupAddr, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	a.log.Info("Advertising service", "instance", a.service.Instance, "port", a.service.Port, "addresses", a.service.Addrs)
+
+	announcement, err := a.buildResponse(0)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteToUDP(announcement, groupAddr); err != nil {
+		a.log.Info("Unable to announce service", "error", err.Error())
+	}
+	buf := make([]byte, mdnsMaxPacket)
+	for ctx.Err() == nil {
+		if err := conn.SetReadDeadline(time.Now().Add(readPollPeriod)); err != nil {
+			return err
+		}
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		response, unicast, err := a.response(buf[:n])
+		if err != nil || response == nil {
+			continue
+		}
+		dest := groupAddr
+		if unicast || src.Port != groupAddr.Port {
+			dest = src
+		}
+		a.log.V(3).Info("Answering query", "source", src.String())
+		if _, err := conn.WriteToUDP(response, dest); err != nil {
+			a.log.Info("Unable to answer query", "error", err.Error())
+		}
+	}
+	return nil
+}
+
+// response returns the answer to a query if it asks about the advertised
+// service, and whether the querier requested a unicast response.
+func (a *Advertiser) response(query []byte) ([]byte, bool, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, false, err
+	}
+	if header.Response {
+		return nil, false, nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, false, err
+	}
+	names := []string{serviceName(), instanceName(a.service.Instance), a.service.Host}
+	for _, q := range questions {
+		if slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(name, q.Name.String()) }) {
+			response, err := a.buildResponse(header.ID)
+			return response, uint16(q.Class)&unicastBit != 0, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (a *Advertiser) buildResponse(id uint16) ([]byte, error) {
+	service, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	instance, err := dnsmessage.NewName(instanceName(a.service.Instance))
+	if err != nil {
+		return nil, err
+	}
+	host, err := dnsmessage.NewName(a.service.Host)
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	resourceHeader := func(name dnsmessage.Name, t dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: name, Type: t, Class: dnsmessage.ClassINET, TTL: mdnsTTL}
+	}
+	if err := b.PTRResource(resourceHeader(service, dnsmessage.TypePTR), dnsmessage.PTRResource{PTR: instance}); err != nil {
+		return nil, err
+	}
+	if err := b.SRVResource(resourceHeader(instance, dnsmessage.TypeSRV), dnsmessage.SRVResource{Port: uint16(a.service.Port), Target: host}); err != nil {
+		return nil, err
+	}
+	text := a.service.Text
+	if len(text) == 0 {
+		// A TXT record must contain at least one string
+		text = []string{""}
+	}
+	if err := b.TXTResource(resourceHeader(instance, dnsmessage.TypeTXT), dnsmessage.TXTResource{TXT: text}); err != nil {
+		return nil, err
+	}
+	for _, addr := range a.service.Addrs {
+		var a4 [4]byte
+		copy(a4[:], addr.To4())
+		if err := b.AResource(resourceHeader(host, dnsmessage.TypeA), dnsmessage.AResource{A: a4}); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+func buildQuery() ([]byte, error) {
+	service, err := dnsmessage.NewName(serviceName())
+	if err != nil {
+		return nil, err
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET | unicastBit}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// Browse queries the local network for advertised services, collecting answers
+// until the timeout expires.
+func Browse(ctx context.Context, timeout time.Duration) ([]Service, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp4", mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	query, err := buildQuery()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteToUDP(query, groupAddr); err != nil {
+		return nil, err
+	}
+	services := make(map[string]*Service)
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, mdnsMaxPacket)
+	for ctx.Err() == nil && time.Now().Before(deadline) {
+		if err := conn.SetReadDeadline(time.Now().Add(readPollPeriod)); err != nil {
+			return nil, err
+		}
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return nil, err
+		}
+		// Ignore malformed packets from other responders
+		_ = parseResponse(buf[:n], src.IP, services)
+	}
+	res := make([]Service, 0, len(services))
+	for _, service := range services {
+		if service.Port != 0 {
+			res = append(res, *service)
+		}
+	}
+	slices.SortFunc(res, func(a, b Service) int { return strings.Compare(a.Instance, b.Instance) })
+	return res, nil
+}
+
+// Discover browses for services and returns the first one accepted by match.
+func Discover(ctx context.Context, timeout time.Duration, match func(*Service) bool) (*Service, error) {
+	services, err := Browse(ctx, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for i := range services {
+		if match(&services[i]) {
+			return &services[i], nil
+		}
+	}
+	return nil, ErrServiceNotFound
+}
+
+func parseResponse(msg []byte, src net.IP, services map[string]*Service) error {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return err
+	}
+	if !header.Response {
+		return nil
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return err
+	}
+	suffix := "." + serviceName()
+	touched := make(map[string]*Service)
+	getService := func(name string) *Service {
+		if !strings.HasSuffix(strings.ToLower(name), suffix) {
+			return nil
+		}
+		instance := name[:len(name)-len(suffix)]
+		if services[instance] == nil {
+			services[instance] = &Service{Instance: instance}
+		}
+		touched[instance] = services[instance]
+		return services[instance]
+	}
+	hostAddrs := make(map[string][]net.IP)
+	for {
+		h, err := p.AnswerHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch h.Type {
+		case dnsmessage.TypePTR:
+			r, err := p.PTRResource()
+			if err != nil {
+				return err
+			}
+			getService(r.PTR.String())
+		case dnsmessage.TypeSRV:
+			r, err := p.SRVResource()
+			if err != nil {
+				return err
+			}
+			if service := getService(h.Name.String()); service != nil {
+				service.Port = int(r.Port)
+				service.Host = r.Target.String()
+			}
+		case dnsmessage.TypeTXT:
+			r, err := p.TXTResource()
+			if err != nil {
+				return err
+			}
+			if service := getService(h.Name.String()); service != nil {
+				service.Text = r.TXT
+			}
+		case dnsmessage.TypeA:
+			r, err := p.AResource()
+			if err != nil {
+				return err
+			}
+			hostAddrs[strings.ToLower(h.Name.String())] = append(hostAddrs[strings.ToLower(h.Name.String())], net.IP(r.A[:]))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return err
+			}
+		}
+	}
+	for _, service := range touched {
+		if addrs, ok := hostAddrs[strings.ToLower(service.Host)]; ok {
+			service.Addrs = addrs
+		} else if len(service.Addrs) == 0 && service.Host != "" {
+			service.Addrs = []net.IP{src}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package discovery
+
+import (
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mDNS tests", func() {
+	var (
+		advertiser *Advertiser
+	)
+
+	BeforeEach(func() {
+		advertiser = &Advertiser{
+			service: Service{
+				Instance: "target-proxy",
+				Host:     "target.local.",
+				Port:     9080,
+				Addrs:    []net.IP{net.ParseIP("10.0.0.5").To4()},
+				Text:     []string{"id=0123456789abcdef0123456789abcdef"},
+			},
+			log: GinkgoLogr.WithName("advertiser"),
+		}
+	})
+
+	It("should answer a service query with a parsable response", func() {
+		query, err := buildQuery()
+		Expect(err).ToNot(HaveOccurred())
+		response, unicast, err := advertiser.response(query)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(unicast).To(BeTrue())
+		Expect(response).ToNot(BeNil())
+
+		services := make(map[string]*Service)
+		Expect(parseResponse(response, net.ParseIP("10.0.0.9"), services)).To(Succeed())
+		Expect(services).To(HaveKey("target-proxy"))
+		service := services["target-proxy"]
+		Expect(service.Port).To(Equal(9080))
+		Expect(service.Host).To(Equal("target.local."))
+		Expect(service.Address()).To(Equal("10.0.0.5"))
+		Expect(service.HasText("id=0123456789abcdef0123456789abcdef")).To(BeTrue())
+	})
+
+	It("should ignore responses", func() {
+		response, err := advertiser.buildResponse(0)
+		Expect(err).ToNot(HaveOccurred())
+		answer, _, err := advertiser.response(response)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(answer).To(BeNil())
+	})
+
+	It("should fall back to the source address without A records", func() {
+		advertiser.service.Addrs = nil
+		response, err := advertiser.buildResponse(0)
+		Expect(err).ToNot(HaveOccurred())
+		services := make(map[string]*Service)
+		Expect(parseResponse(response, net.ParseIP("10.0.0.9"), services)).To(Succeed())
+		Expect(services["target-proxy"].Address()).To(Equal("10.0.0.9"))
+	})
+
+	It("should reject invalid instance names", func() {
+		_, err := NewAdvertiser("a.b", 9080, nil, GinkgoLogr)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,207 @@
+package kubestatus
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	// DefaultProgressInterval is how often the progress is patched at most
+	DefaultProgressInterval = 10 * time.Second
+	requestTimeout          = 10 * time.Second
+
+	PhaseRunning = "running"
+)
+
+var (
+	ErrNotInCluster = errors.New("not running in a cluster, KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set")
+)
+
+// Resource is a namespaced custom resource with a status subresource.
+type Resource struct {
+	Group     string
+	Version   string
+	Resource  string
+	Namespace string
+	Name      string
+}
+
+// ParseResource parses <group>/<version>/<resource>/<name>, the namespace is
+// set separately.
+func ParseResource(value string) (Resource, error) {
+	fields := strings.Split(value, "/")
+	if len(fields) != 4 || slices.Contains(fields, "") {
+		return Resource{}, fmt.Errorf("invalid resource %q, expected <group>/<version>/<resource>/<name>", value)
+	}
+	return Resource{Group: fields[0], Version: fields[1], Resource: fields[2], Name: fields[3]}, nil
+}
+
+func (r Resource) statusPath() string {
+	return fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s/status", r.Group, r.Version, r.Namespace, r.Resource, r.Name)
+}
+
+// Status is merged into the status of the resource, empty fields are left
+// alone.
+type Status struct {
+	Phase    string `json:"phase,omitempty"`
+	Progress string `json:"progress,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Client patches the status subresource of a resource with the phase,
+// progress and error of a sync, so controllers don't have to scrape logs or
+// control files.
+type Client struct {
+	client           *http.Client
+	host             string
+	tokenFile        string
+	resource         Resource
+	progressInterval time.Duration
+	log              logr.Logger
+
+	mu           sync.Mutex
+	lastProgress time.Time
+	finished     bool
+	// Serializes the patches so the final status is patched last
+	patchMu sync.Mutex
+}
+
+// NewInClusterClient returns a client that authenticates with the service
+// account of the pod, the namespace of the pod is used if the namespace of
+// the resource is empty.
+func NewInClusterClient(resource Resource, log logr.Logger) (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, ErrNotInCluster
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the CA of the service account")
+	}
+	if resource.Namespace == "" {
+		namespace, err := os.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		if err != nil {
+			return nil, err
+		}
+		resource.Namespace = strings.TrimSpace(string(namespace))
+	}
+	client := &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+		},
+	}
+	return NewClient(client, "https://"+net.JoinHostPort(host, port), filepath.Join(serviceAccountDir, "token"), resource, log), nil
+}
+
+// NewClient returns a client that patches the resource on the API server
+// at host with the bearer token in tokenFile, no token is sent if it is
+// empty. The token is read for every patch since it is rotated.
+func NewClient(client *http.Client, host, tokenFile string, resource Resource, log logr.Logger) *Client {
+	return &Client{
+		client:           client,
+		host:             host,
+		tokenFile:        tokenFile,
+		resource:         resource,
+		progressInterval: DefaultProgressInterval,
+		log:              log,
+	}
+}
+
+// Progress patches the overall progress in the background, at most once per
+// progress interval unless it is complete. Updates while a patch is in flight
+// are dropped.
+func (r *Client) Progress(percent float64) {
+	r.mu.Lock()
+	if r.finished || (time.Since(r.lastProgress) < r.progressInterval && percent < 100) {
+		r.mu.Unlock()
+		return
+	}
+	r.lastProgress = time.Now()
+	r.mu.Unlock()
+	go func() {
+		if !r.patchMu.TryLock() {
+			return
+		}
+		defer r.patchMu.Unlock()
+		r.mu.Lock()
+		finished := r.finished
+		r.mu.Unlock()
+		if finished {
+			return
+		}
+		if err := r.patch(Status{Phase: PhaseRunning, Progress: fmt.Sprintf("%.1f%%", percent)}); err != nil {
+			r.log.Error(err, "Unable to report progress")
+		}
+	}()
+}
+
+// Report patches the status and waits for it, a status with an empty or
+// running phase can be followed by other reports, any other phase is final.
+func (r *Client) Report(status Status) error {
+	r.mu.Lock()
+	if r.finished {
+		r.mu.Unlock()
+		return nil
+	}
+	r.finished = status.Phase != "" && status.Phase != PhaseRunning
+	r.mu.Unlock()
+	r.patchMu.Lock()
+	defer r.patchMu.Unlock()
+	return r.patch(status)
+}
+
+func (r *Client) patch(status Status) error {
+	body, err := json.Marshal(struct {
+		Status Status `json:"status"`
+	}{status})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPatch, r.host+r.resource.statusPath(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	if r.tokenFile != "" {
+		token, err := os.ReadFile(r.tokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("patching the status of %s/%s failed: %s: %s", r.resource.Namespace, r.resource.Name, resp.Status, strings.TrimSpace(string(message)))
+	}
+	r.log.V(1).Info("Reported status", "phase", status.Phase, "progress", status.Progress)
+	return nil
+}
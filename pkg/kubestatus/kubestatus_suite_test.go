@@ -0,0 +1,13 @@
+package kubestatus
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestKubestatus(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "kubestatus Suite")
+}
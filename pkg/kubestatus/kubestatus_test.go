@@ -0,0 +1,101 @@
+package kubestatus
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("status client tests", func() {
+	type patch struct {
+		path, contentType, authorization string
+		status                           Status
+	}
+	var (
+		mu      sync.Mutex
+		patches []patch
+		server  *httptest.Server
+		token   string
+	)
+
+	BeforeEach(func() {
+		patches = nil
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer GinkgoRecover()
+			Expect(r.Method).To(Equal(http.MethodPatch))
+			body, err := io.ReadAll(r.Body)
+			Expect(err).ToNot(HaveOccurred())
+			var object struct {
+				Status Status `json:"status"`
+			}
+			Expect(json.Unmarshal(body, &object)).To(Succeed())
+			if object.Status.Phase == "forbidden" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			mu.Lock()
+			patches = append(patches, patch{r.URL.Path, r.Header.Get("Content-Type"), r.Header.Get("Authorization"), object.Status})
+			mu.Unlock()
+		}))
+		DeferCleanup(server.Close)
+		token = filepath.Join(GinkgoT().TempDir(), "token")
+		Expect(os.WriteFile(token, []byte("secret\n"), 0600)).To(Succeed())
+	})
+
+	client := func() *Client {
+		resource, err := ParseResource("migrations.example.com/v1/diskmigrations/disk-1")
+		Expect(err).ToNot(HaveOccurred())
+		resource.Namespace = "vms"
+		return NewClient(server.Client(), server.URL, token, resource, GinkgoLogr)
+	}
+
+	recorded := func() []patch {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]patch(nil), patches...)
+	}
+
+	It("should merge the status into the status subresource", func() {
+		Expect(client().Report(Status{Phase: "completed"})).To(Succeed())
+		Expect(recorded()).To(Equal([]patch{{
+			path:          "/apis/migrations.example.com/v1/namespaces/vms/diskmigrations/disk-1/status",
+			contentType:   "application/merge-patch+json",
+			authorization: "Bearer secret",
+			status:        Status{Phase: "completed"},
+		}}))
+	})
+
+	It("should throttle the progress and drop it after the final status", func() {
+		r := client()
+		r.Progress(10)
+		Eventually(recorded).Should(HaveLen(1))
+		r.Progress(20)
+		Consistently(recorded, "100ms").Should(HaveLen(1))
+		r.Progress(100)
+		Eventually(recorded).Should(HaveLen(2))
+		Expect(recorded()[1].status).To(Equal(Status{Phase: PhaseRunning, Progress: "100.0%"}))
+		Expect(r.Report(Status{Phase: "failed", Error: "boom"})).To(Succeed())
+		r.Progress(100)
+		Expect(r.Report(Status{Phase: "completed"})).To(Succeed())
+		Consistently(recorded, "100ms").Should(HaveLen(3))
+		Expect(recorded()[2].status).To(Equal(Status{Phase: "failed", Error: "boom"}))
+	})
+
+	It("should return the error of the API server", func() {
+		Expect(client().Report(Status{Phase: "forbidden"})).To(MatchError(ContainSubstring("403")))
+	})
+
+	It("should reject invalid resources", func() {
+		_, err := ParseResource("diskmigrations/disk-1")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseResource("migrations.example.com//diskmigrations/disk-1")
+		Expect(err).To(HaveOccurred())
+	})
+})
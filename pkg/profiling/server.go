@@ -0,0 +1,35 @@
+package profiling
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+
+	"github.com/go-logr/logr"
+)
+
+// Serve serves the net/http/pprof endpoints under /debug/pprof/ on port of
+// the loopback interface in the background, 0 picks a free port. It returns
+// the address it listens on, the endpoints are served until the process
+// exits.
+func Serve(port int, log logr.Logger) (net.Addr, error) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error(err, "Unable to serve pprof", "address", listener.Addr().String())
+		}
+	}()
+	log.Info("Serving pprof", "address", listener.Addr().String())
+	return listener.Addr(), nil
+}
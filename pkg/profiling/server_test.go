@@ -0,0 +1,32 @@
+package profiling
+
+import (
+	"io"
+	"net"
+	"net/http"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pprof server tests", func() {
+	It("should serve pprof on the loopback interface", func() {
+		addr, err := Serve(0, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(addr.(*net.TCPAddr).IP.IsLoopback()).To(BeTrue())
+		resp, err := http.Get("http://" + addr.String() + "/debug/pprof/goroutine?debug=1")
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("goroutine profile"))
+	})
+
+	It("should fail if the port is in use", func() {
+		addr, err := Serve(0, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = Serve(addr.(*net.TCPAddr).Port, GinkgoLogr)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -1,26 +1,41 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"io"
 	"net"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/discovery"
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	defaultDiscoverTimeout = 5 * time.Second
+	connectRetries         = 30
 )
 
 type ProxyClient struct {
 	listenPort    int
 	targetPort    int
 	targetAddress string
+	opts          *ProxyOptions
 	log           logr.Logger
+	summary       *SessionSummary
 }
 
-func NewProxyClient(listenPort, targetPort int, targetAddress string, logger logr.Logger) *ProxyClient {
+func NewProxyClient(listenPort, targetPort int, targetAddress string, opts *ProxyOptions, logger logr.Logger) *ProxyClient {
 	return &ProxyClient{
 		listenPort:    listenPort,
 		targetPort:    targetPort,
 		targetAddress: targetAddress,
+		opts:          opts,
 		log:           logger,
 	}
 }
@@ -29,12 +44,19 @@ func (b *ProxyClient) ConnectToTarget(identifier string) error {
 	if len(identifier) != identifierLength {
 		return fmt.Errorf("identifier must be %d characters", identifierLength)
 	}
-	b.log.Info("Listening:", "host", "localhost", "port", b.listenPort)
-	// Create a listener on the desired port
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", b.listenPort))
+	if b.opts.SessionSummary && b.opts.Resumable {
+		return errors.New("session summaries cannot be used with resumable sessions")
+	}
+	if b.targetAddress == "" && b.opts.Discover {
+		if err := b.discoverTarget(identifier); err != nil {
+			return err
+		}
+	}
+	listener, err := b.listen()
 	if err != nil {
 		return err
 	}
+	defer listener.Close()
 
 	// Accept incoming connections
 	inConn, err := listener.Accept()
@@ -44,40 +66,207 @@ func (b *ProxyClient) ConnectToTarget(identifier string) error {
 	defer inConn.Close()
 
 	b.log.Info("Connecting to target", "address", b.targetAddress, "port", b.targetPort)
-	retry := true
-	var outConn net.Conn
-	retryCount := 0
-	for retry {
-		outConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", b.targetAddress, b.targetPort))
-		retry = err != nil
-		if err != nil {
-			b.log.Error(err, "Unable to connect to target")
-		}
-		if retry {
-			retryCount++
-			time.Sleep(time.Second)
-			if retryCount > 30 {
-				return fmt.Errorf("unable to connect to target after %d retries", retryCount)
-			}
-		}
+	if b.opts.Resumable {
+		return b.resumableTransfer(inConn, identifier)
 	}
-	defer outConn.Close()
-
-	// Write the header to the writer
-	_, err = outConn.Write([]byte(identifier))
+	outConn, err := b.dialTarget(inConn, identifier)
 	if err != nil {
 		return err
 	}
+	defer outConn.Close()
+	if b.opts.SessionSummary {
+		return b.transferWithSummary(inConn, outConn)
+	}
 
 	go func() {
-		n, _ := io.Copy(inConn, outConn)
+		n, _ := pump(inConn, outConn)
 		b.log.Info("bytes copied from server to client", "count", n)
 	}()
 
-	n, err := io.Copy(outConn, inConn)
+	n, err := pump(outConn, inConn)
 	if err != nil {
 		return err
 	}
 	b.log.Info("bytes copied", "count", n)
 	return nil
 }
+
+// listen listens for the blockrsync client on the port, or on the socket of
+// the options if it is set.
+func (b *ProxyClient) listen() (net.Listener, error) {
+	if b.opts.ListenSocket != "" {
+		b.log.Info("Listening:", "socket", b.opts.ListenSocket)
+		return transport.Unix.Listen(b.opts.ListenSocket)
+	}
+	b.log.Info("Listening:", "host", "localhost", "port", b.listenPort)
+	// Create a listener on the desired port
+	return transport.TCP.Listen(net.JoinHostPort("localhost", strconv.Itoa(b.listenPort)))
+}
+
+// Summary returns the summary of the session relayed by the server, nil
+// without SessionSummary or if the tunnel closed before it.
+func (b *ProxyClient) Summary() *SessionSummary {
+	return b.summary
+}
+
+// transferWithSummary tunnels the local connection until the server sent the
+// summary of the session, it fails if the blockrsync server failed.
+func (b *ProxyClient) transferWithSummary(inConn, outConn net.Conn) error {
+	go func() {
+		n, _ := pump(outConn, inConn)
+		b.log.Info("bytes copied", "count", n)
+	}()
+	summary, err := readDataFrames(inConn, outConn)
+	if err != nil {
+		return err
+	}
+	b.summary = summary
+	b.log.Info("Received session summary", "identifier", summary.Identifier, "exit code", summary.ExitCode)
+	if summary.ExitCode != 0 {
+		return fmt.Errorf("%w with exit code %d: %s", ErrSessionFailed, summary.ExitCode, summary.Error)
+	}
+	return nil
+}
+
+// discoverTarget looks for a proxy server advertising the identifier.
+func (b *ProxyClient) discoverTarget(identifier string) error {
+	timeout := b.opts.DiscoverTimeout
+	if timeout <= 0 {
+		timeout = defaultDiscoverTimeout
+	}
+	b.log.Info("Discovering target", "identifier", identifier, "timeout", timeout)
+	service, err := discovery.Discover(context.Background(), timeout, func(s *discovery.Service) bool {
+		return advertisesIdentifier(s, identifier)
+	})
+	if err != nil {
+		return fmt.Errorf("unable to discover target for identifier %s: %w", identifier, err)
+	}
+	b.targetAddress = service.Address()
+	b.targetPort = service.Port
+	b.log.Info("Discovered target", "instance", service.Instance, "address", b.targetAddress, "port", b.targetPort)
+	return nil
+}
+
+// dialTarget connects to the proxy server and sends the connection headers.
+// With alternate targets the identifier is sent on the path that connected
+// first.
+func (b *ProxyClient) dialTarget(inConn net.Conn, identifier string) (net.Conn, error) {
+	addresses := append([]string{net.JoinHostPort(b.targetAddress, strconv.Itoa(b.targetPort))}, b.opts.AlternateTargets...)
+	outConn, err := transport.DialFirst(addresses, func(address string) (net.Conn, error) {
+		return b.dialSecure(inConn, address)
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Write the header to the writer
+	if b.opts.SignIdentifiers {
+		err = writeSignedIdentifier(outConn, identifier, time.Now())
+	} else {
+		_, err = outConn.Write([]byte(identifier))
+	}
+	if err != nil {
+		outConn.Close()
+		return nil, err
+	}
+	return outConn, nil
+}
+
+// dialSecure connects to the address of the proxy server with the TLS of the
+// options.
+func (b *ProxyClient) dialSecure(inConn net.Conn, address string) (net.Conn, error) {
+	outConn, err := b.dialPlaintext(inConn, address)
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.TLSConfig != nil && b.opts.TLSPolicy != TLSPolicyDisable {
+		tlsConn := tls.Client(outConn, b.opts.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			outConn.Close()
+			if b.opts.TLSPolicy != TLSPolicyPrefer || !plaintextPeer(err) {
+				return nil, err
+			}
+			b.log.Info("Target doesn't speak TLS, falling back to plaintext", "address", address, "error", err.Error())
+			if outConn, err = b.dialPlaintext(inConn, address); err != nil {
+				return nil, err
+			}
+		} else {
+			outConn = tlsConn
+		}
+	}
+	return outConn, nil
+}
+
+// dialPlaintext connects to the address of the proxy server and sends the
+// PROXY protocol header.
+func (b *ProxyClient) dialPlaintext(inConn net.Conn, address string) (net.Conn, error) {
+	outConn, err := transport.DialRetry(transport.OrDefault(b.opts.Transport), address, connectRetries, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if b.opts.SendProxyProtocol {
+		if err := writeProxyProtocolHeader(outConn, inConn.RemoteAddr(), outConn.RemoteAddr()); err != nil {
+			outConn.Close()
+			return nil, err
+		}
+	}
+	return outConn, nil
+}
+
+// resumableTransfer tunnels the local connection through a resumable session,
+// reconnecting to the target whenever the tunnel drops.
+func (b *ProxyClient) resumableTransfer(inConn net.Conn, identifier string) error {
+	token, err := newResumeToken()
+	if err != nil {
+		return err
+	}
+	session := newResumableSession(token, inConn, b.log.WithName("session"))
+	exchange := func(outConn net.Conn) func(uint64) (uint64, error) {
+		return func(received uint64) (uint64, error) {
+			if err := writeResumeHello(outConn, token, received); err != nil {
+				return 0, err
+			}
+			var peerReceived uint64
+			if err := binary.Read(outConn, binary.LittleEndian, &peerReceived); err != nil {
+				return 0, err
+			}
+			return peerReceived, nil
+		}
+	}
+	outConn, err := b.dialTarget(inConn, identifier)
+	if err != nil {
+		return err
+	}
+	if err := session.resume(outConn, exchange(outConn)); err != nil {
+		outConn.Close()
+		return err
+	}
+	go session.pumpLocal()
+	for {
+		select {
+		case <-session.done:
+			if session.err == nil {
+				b.log.Info("Resumable transfer complete")
+			}
+			return session.err
+		case <-session.disconnected:
+			if session.connected() {
+				continue
+			}
+			b.log.Info("Lost connection to target, reconnecting", "address", b.targetAddress, "port", b.targetPort)
+			outConn, err := b.dialTarget(inConn, identifier)
+			if err != nil {
+				session.finish(err)
+				continue
+			}
+			if err := session.resume(outConn, exchange(outConn)); err != nil {
+				outConn.Close()
+				if err == errSessionClosed || err == ErrResumeWindowExceeded {
+					session.finish(err)
+				} else {
+					b.log.Error(err, "Unable to resume session")
+					session.requestReconnect()
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/awels/blockrsync/pkg/discovery"
+)
+
+const (
+	identifierNonceLength = 16
+	// The time, the nonce and the HMAC-SHA256 of both keyed by the identifier
+	signedIdentifierLength  = 8 + identifierNonceLength + sha256.Size
+	DefaultIdentifierWindow = 5 * time.Minute
+	advertiseSaltLength     = 16
+)
+
+var (
+	ErrIdentifierUnknown  = errors.New("signed identifier matches no identifier of the server")
+	ErrIdentifierExpired  = errors.New("signed identifier is outside the validity window of the identifier")
+	ErrIdentifierReplayed = errors.New("signed identifier was already used")
+)
+
+// writeSignedIdentifier is sent by the client instead of the identifier, it
+// carries the time and a random nonce signed with the identifier so a captured
+// exchange doesn't reveal the identifier and is only accepted once.
+func writeSignedIdentifier(w io.Writer, identifier string, now time.Time) error {
+	signed := bytes.NewBuffer(make([]byte, 0, signedIdentifierLength))
+	_ = binary.Write(signed, binary.LittleEndian, now.UnixNano())
+	nonce := make([]byte, identifierNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	signed.Write(nonce)
+	signed.Write(signIdentifier(identifier, signed.Bytes()))
+	_, err := w.Write(signed.Bytes())
+	return err
+}
+
+func signIdentifier(identifier string, message []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(identifier))
+	mac.Write(message)
+	return mac.Sum(nil)
+}
+
+// advertisedText returns the DNS-SD text entries of the identifiers, a random
+// salt and the HMAC-SHA256 of it keyed by every identifier, so the identifiers
+// are not advertised to everyone on the network.
+func advertisedText(identifiers []string) ([]string, error) {
+	salt := make([]byte, advertiseSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	text := []string{"salt=" + hex.EncodeToString(salt)}
+	for _, identifier := range identifiers {
+		text = append(text, identifierText(identifier, salt))
+	}
+	return text, nil
+}
+
+func identifierText(identifier string, salt []byte) string {
+	return "id=" + hex.EncodeToString(signIdentifier(identifier, salt))
+}
+
+// advertisesIdentifier returns true if the service advertises the identifier
+// with the salt it advertises.
+func advertisesIdentifier(s *discovery.Service, identifier string) bool {
+	for _, entry := range s.Text {
+		if value, ok := strings.CutPrefix(entry, "salt="); ok {
+			salt, err := hex.DecodeString(value)
+			return err == nil && s.HasText(identifierText(identifier, salt))
+		}
+	}
+	return false
+}
+
+// identifierVerifier finds the identifier a signed identifier was signed
+// with, and accepts it once within the validity window of the identifier.
+type identifierVerifier struct {
+	identifiers   []string
+	windows       map[string]time.Duration
+	defaultWindow time.Duration
+
+	mu sync.Mutex
+	// Signatures accepted so far, until they are out of their window
+	seen map[string]time.Time
+}
+
+// newIdentifierVerifier returns an error if a window is not positive, or is
+// for an identifier the server doesn't sync.
+func newIdentifierVerifier(identifiers []string, defaultWindow time.Duration, windows map[string]time.Duration) (*identifierVerifier, error) {
+	if defaultWindow <= 0 {
+		defaultWindow = DefaultIdentifierWindow
+	}
+	for identifier, window := range windows {
+		if !slices.Contains(identifiers, identifier) {
+			return nil, fmt.Errorf("identifier window for identifier %s the server doesn't sync", identifier)
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("identifier window of %s must be > 0", identifier)
+		}
+	}
+	return &identifierVerifier{
+		identifiers:   identifiers,
+		windows:       windows,
+		defaultWindow: defaultWindow,
+		seen:          make(map[string]time.Time),
+	}, nil
+}
+
+func (v *identifierVerifier) window(identifier string) time.Duration {
+	if window, ok := v.windows[identifier]; ok {
+		return window
+	}
+	return v.defaultWindow
+}
+
+func (v *identifierVerifier) read(r io.Reader, now time.Time) (string, error) {
+	signed := make([]byte, signedIdentifierLength)
+	if _, err := io.ReadFull(r, signed); err != nil {
+		return "", err
+	}
+	return v.verify(signed, now)
+}
+
+// verify returns the identifier the signed identifier was signed with.
+func (v *identifierVerifier) verify(signed []byte, now time.Time) (string, error) {
+	message, signature := signed[:len(signed)-sha256.Size], signed[len(signed)-sha256.Size:]
+	index := slices.IndexFunc(v.identifiers, func(identifier string) bool {
+		return hmac.Equal(signIdentifier(identifier, message), signature)
+	})
+	if index < 0 {
+		return "", ErrIdentifierUnknown
+	}
+	identifier := v.identifiers[index]
+	signedAt := time.Unix(0, int64(binary.LittleEndian.Uint64(message)))
+	window := v.window(identifier)
+	// The window goes both ways as the clocks of the proxies may differ
+	if now.Sub(signedAt).Abs() > window {
+		return "", fmt.Errorf("%w, signed at %s", ErrIdentifierExpired, signedAt.UTC().Format(time.RFC3339))
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, expiry := range v.seen {
+		if now.After(expiry) {
+			delete(v.seen, key)
+		}
+	}
+	if _, ok := v.seen[string(signature)]; ok {
+		return "", ErrIdentifierReplayed
+	}
+	v.seen[string(signature)] = signedAt.Add(window)
+	return identifier, nil
+}
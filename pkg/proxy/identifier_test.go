@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/discovery"
+)
+
+var _ = Describe("signed identifier tests", func() {
+	const otherIdentifier = "fedcba9876543210fedcba9876543210"
+
+	sign := func(identifier string, at time.Time) *bytes.Buffer {
+		buf := &bytes.Buffer{}
+		Expect(writeSignedIdentifier(buf, identifier, at)).To(Succeed())
+		Expect(buf.Len()).To(Equal(signedIdentifierLength))
+		Expect(buf.String()).ToNot(ContainSubstring(identifier))
+		return buf
+	}
+
+	It("should accept a signed identifier once", func() {
+		verifier, err := newIdentifierVerifier([]string{otherIdentifier, testIdentifier}, 0, nil)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		signed := sign(testIdentifier, now)
+		replay := bytes.Clone(signed.Bytes())
+		Expect(verifier.read(signed, now)).To(Equal(testIdentifier))
+		_, err = verifier.verify(replay, now.Add(time.Second))
+		Expect(err).To(MatchError(ErrIdentifierReplayed))
+		Expect(verifier.read(sign(testIdentifier, now), now)).To(Equal(testIdentifier))
+	})
+
+	It("should refuse a signed identifier outside the window of its identifier", func() {
+		verifier, err := newIdentifierVerifier([]string{otherIdentifier, testIdentifier}, time.Minute, map[string]time.Duration{
+			testIdentifier: time.Hour,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		Expect(verifier.read(sign(testIdentifier, now.Add(-30*time.Minute)), now)).To(Equal(testIdentifier))
+		_, err = verifier.read(sign(testIdentifier, now.Add(2*time.Hour)), now)
+		Expect(err).To(MatchError(ErrIdentifierExpired))
+		_, err = verifier.read(sign(otherIdentifier, now.Add(-30*time.Minute)), now)
+		Expect(err).To(MatchError(ErrIdentifierExpired))
+		Expect(verifier.read(sign(otherIdentifier, now.Add(30*time.Second)), now)).To(Equal(otherIdentifier))
+	})
+
+	It("should forget signed identifiers out of their window", func() {
+		verifier, err := newIdentifierVerifier([]string{testIdentifier}, time.Minute, nil)
+		Expect(err).ToNot(HaveOccurred())
+		now := time.Now()
+		Expect(verifier.read(sign(testIdentifier, now), now)).To(Equal(testIdentifier))
+		Expect(verifier.seen).To(HaveLen(1))
+		Expect(verifier.read(sign(testIdentifier, now.Add(2*time.Minute)), now.Add(2*time.Minute))).To(Equal(testIdentifier))
+		Expect(verifier.seen).To(HaveLen(1))
+	})
+
+	It("should refuse an identifier signed with another identifier", func() {
+		verifier, err := newIdentifierVerifier([]string{testIdentifier}, 0, nil)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = verifier.read(sign(otherIdentifier, time.Now()), time.Now())
+		Expect(err).To(MatchError(ErrIdentifierUnknown))
+		_, err = verifier.read(bytes.NewBufferString(testIdentifier), time.Now())
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refuse windows of identifiers the server doesn't sync", func() {
+		_, err := newIdentifierVerifier([]string{testIdentifier}, 0, map[string]time.Duration{otherIdentifier: time.Minute})
+		Expect(err).To(HaveOccurred())
+		_, err = newIdentifierVerifier([]string{testIdentifier}, 0, map[string]time.Duration{testIdentifier: 0})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should advertise the identifiers without revealing them", func() {
+		text, err := advertisedText([]string{testIdentifier})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(strings.Join(text, " ")).ToNot(ContainSubstring(testIdentifier))
+		service := &discovery.Service{Text: text}
+		Expect(advertisesIdentifier(service, testIdentifier)).To(BeTrue())
+		Expect(advertisesIdentifier(service, otherIdentifier)).To(BeFalse())
+
+		// Every server advertises another salt
+		other, err := advertisedText([]string{testIdentifier})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(other).ToNot(ContainElement(text[1]))
+		Expect(advertisesIdentifier(&discovery.Service{Text: text[1:]}, testIdentifier)).To(BeFalse())
+	})
+})
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// IdentifiersFromDir returns the identifiers mapped in a directory like a
+// mounted ConfigMap, the entries kubelet uses to update it atomically are
+// skipped.
+func IdentifiersFromDir(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var identifiers []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "..") || entry.IsDir() {
+			continue
+		}
+		identifiers = append(identifiers, entry.Name())
+	}
+	sort.Strings(identifiers)
+	return identifiers, nil
+}
+
+// targetFile returns the target of the identifier from the identifier map
+// directory, or from the environment if the directory doesn't map it.
+func (b *ProxyServer) targetFile(identifier string) (string, error) {
+	if b.opts.IdentifierMapDir == "" {
+		return resolveIdentifier(identifier)
+	}
+	if filepath.Base(identifier) != identifier || strings.HasPrefix(identifier, ".") {
+		return "", fmt.Errorf("invalid identifier %q", identifier)
+	}
+	data, err := os.ReadFile(filepath.Join(b.opts.IdentifierMapDir, identifier))
+	if os.IsNotExist(err) {
+		return resolveIdentifier(identifier)
+	}
+	if err != nil {
+		return "", err
+	}
+	file := strings.TrimSpace(string(data))
+	if file == "" {
+		return "", fmt.Errorf("no filepath found for %s in %s", identifier, b.opts.IdentifierMapDir)
+	}
+	return file, nil
+}
+
+// reloadCredentialsEvery reloads the credentials that changed until stop is
+// closed, so certificates rotated in a mounted Secret are picked up.
+func (b *ProxyServer) reloadCredentialsEvery(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := b.ReloadCredentials(); err != nil {
+				b.log.Error(err, "Unable to reload credentials, keeping the current ones")
+			}
+		}
+	}
+}
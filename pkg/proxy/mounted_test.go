@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("mounted identifier map tests", func() {
+	var (
+		mapDir string
+		server *ProxyServer
+	)
+
+	BeforeEach(func() {
+		mapDir = GinkgoT().TempDir()
+		// The layout kubelet mounts a ConfigMap with
+		data := filepath.Join(mapDir, "..2026_10_15_10_00_00.000000001")
+		Expect(os.Mkdir(data, 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(data, testIdentifier), []byte("/dev/vdb\n"), 0644)).To(Succeed())
+		Expect(os.Symlink(filepath.Base(data), filepath.Join(mapDir, "..data"))).To(Succeed())
+		Expect(os.Symlink(filepath.Join("..data", testIdentifier), filepath.Join(mapDir, testIdentifier))).To(Succeed())
+		server = NewProxyServer("/blockrsync", 4096, 9080, []string{testIdentifier}, &ProxyOptions{
+			IdentifierMapDir: mapDir,
+		}, GinkgoLogr.WithName("server"))
+	})
+
+	It("should list the identifiers of the directory", func() {
+		Expect(IdentifiersFromDir(mapDir)).To(Equal([]string{testIdentifier}))
+	})
+
+	It("should read the target from the directory before the environment", func() {
+		GinkgoT().Setenv(testIdentifier, "/dev/vdc")
+		Expect(server.targetFile(testIdentifier)).To(Equal("/dev/vdb"))
+		Expect(os.WriteFile(filepath.Join(mapDir, "..data", testIdentifier), []byte("/dev/vdd"), 0644)).To(Succeed())
+		Expect(server.targetFile(testIdentifier)).To(Equal("/dev/vdd"))
+		GinkgoT().Setenv("other", "/dev/vde")
+		Expect(server.targetFile("other")).To(Equal("/dev/vde"))
+	})
+
+	It("should refuse identifiers that are not a name in the directory", func() {
+		_, err := server.targetFile("../" + testIdentifier)
+		Expect(err).To(HaveOccurred())
+		_, err = server.targetFile("..data")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+const (
+	proxyProtocolHeaderLength = 16
+	proxyProtocolVersion2     = 0x20
+	proxyProtocolCmdLocal     = 0x00
+	proxyProtocolCmdProxy     = 0x01
+	proxyProtocolTCP4         = 0x11
+	proxyProtocolTCP6         = 0x21
+	proxyProtocolTCP4AddrLen  = 12
+	proxyProtocolTCP6AddrLen  = 36
+	// Upper bound on the address block we are willing to read, TLVs included.
+	proxyProtocolMaxAddrLen = 536
+)
+
+var (
+	proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+	ErrNoProxyProtocolHeader = errors.New("connection did not start with a PROXY protocol v2 header")
+)
+
+// proxyProtocolConn overrides the addresses of a connection with the ones
+// received in a PROXY protocol header.
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (p *proxyProtocolConn) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+func (p *proxyProtocolConn) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+// readProxyProtocolHeader consumes a PROXY protocol v2 header from the
+// connection and returns a connection reporting the original addresses. The
+// header is read without buffering so no payload bytes are consumed.
+func readProxyProtocolHeader(conn net.Conn) (net.Conn, error) {
+	header := make([]byte, proxyProtocolHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)], proxyProtocolV2Signature) {
+		return nil, ErrNoProxyProtocolHeader
+	}
+	if header[12]&0xF0 != proxyProtocolVersion2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0F
+	if command != proxyProtocolCmdLocal && command != proxyProtocolCmdProxy {
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", command)
+	}
+	addrLen := int(binary.BigEndian.Uint16(header[14:16]))
+	if addrLen > proxyProtocolMaxAddrLen {
+		return nil, fmt.Errorf("PROXY protocol address length %d too large", addrLen)
+	}
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(conn, addr); err != nil {
+		return nil, err
+	}
+	res := &proxyProtocolConn{
+		Conn:       conn,
+		remoteAddr: conn.RemoteAddr(),
+		localAddr:  conn.LocalAddr(),
+	}
+	if command == proxyProtocolCmdLocal {
+		// Health checks from the load balancer itself, keep the real addresses
+		return res, nil
+	}
+	switch header[13] {
+	case proxyProtocolTCP4:
+		if addrLen < proxyProtocolTCP4AddrLen {
+			return nil, fmt.Errorf("PROXY protocol address length %d too short for TCP4", addrLen)
+		}
+		res.remoteAddr = &net.TCPAddr{IP: net.IP(addr[0:4]), Port: int(binary.BigEndian.Uint16(addr[8:10]))}
+		res.localAddr = &net.TCPAddr{IP: net.IP(addr[4:8]), Port: int(binary.BigEndian.Uint16(addr[10:12]))}
+	case proxyProtocolTCP6:
+		if addrLen < proxyProtocolTCP6AddrLen {
+			return nil, fmt.Errorf("PROXY protocol address length %d too short for TCP6", addrLen)
+		}
+		res.remoteAddr = &net.TCPAddr{IP: net.IP(addr[0:16]), Port: int(binary.BigEndian.Uint16(addr[32:34]))}
+		res.localAddr = &net.TCPAddr{IP: net.IP(addr[16:32]), Port: int(binary.BigEndian.Uint16(addr[34:36]))}
+	default:
+		// Unspecified or unsupported family, keep the real addresses
+	}
+	return res, nil
+}
+
+// writeProxyProtocolHeader writes a PROXY protocol v2 header describing a
+// connection from src to dst. If the addresses are not both TCP addresses of
+// the same family a LOCAL header is written.
+func writeProxyProtocolHeader(w io.Writer, src, dst net.Addr) error {
+	header := bytes.NewBuffer(make([]byte, 0, proxyProtocolHeaderLength+proxyProtocolTCP6AddrLen))
+	header.Write(proxyProtocolV2Signature)
+	srcTCP, srcOk := src.(*net.TCPAddr)
+	dstTCP, dstOk := dst.(*net.TCPAddr)
+	switch {
+	case srcOk && dstOk && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil:
+		header.Write([]byte{proxyProtocolVersion2 | proxyProtocolCmdProxy, proxyProtocolTCP4})
+		_ = binary.Write(header, binary.BigEndian, uint16(proxyProtocolTCP4AddrLen))
+		header.Write(srcTCP.IP.To4())
+		header.Write(dstTCP.IP.To4())
+		_ = binary.Write(header, binary.BigEndian, uint16(srcTCP.Port))
+		_ = binary.Write(header, binary.BigEndian, uint16(dstTCP.Port))
+	case srcOk && dstOk && srcTCP.IP.To4() == nil && dstTCP.IP.To4() == nil:
+		header.Write([]byte{proxyProtocolVersion2 | proxyProtocolCmdProxy, proxyProtocolTCP6})
+		_ = binary.Write(header, binary.BigEndian, uint16(proxyProtocolTCP6AddrLen))
+		header.Write(srcTCP.IP.To16())
+		header.Write(dstTCP.IP.To16())
+		_ = binary.Write(header, binary.BigEndian, uint16(srcTCP.Port))
+		_ = binary.Write(header, binary.BigEndian, uint16(dstTCP.Port))
+	default:
+		header.Write([]byte{proxyProtocolVersion2 | proxyProtocolCmdLocal, 0x00})
+		_ = binary.Write(header, binary.BigEndian, uint16(0))
+	}
+	_, err := w.Write(header.Bytes())
+	return err
+}
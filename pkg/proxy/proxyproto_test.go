@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("PROXY protocol tests", func() {
+	DescribeTable("should round trip addresses", func(src, dst *net.TCPAddr) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			defer GinkgoRecover()
+			Expect(writeProxyProtocolHeader(client, src, dst)).To(Succeed())
+			_, err := client.Write([]byte("payload"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		conn, err := readProxyProtocolHeader(server)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.RemoteAddr().String()).To(Equal(src.String()))
+		Expect(conn.LocalAddr().String()).To(Equal(dst.String()))
+		payload := make([]byte, 7)
+		_, err = conn.Read(payload)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(payload)).To(Equal("payload"))
+	},
+		Entry("tcp4", &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 9080}),
+		Entry("tcp6", &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1234}, &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 9080}),
+	)
+
+	It("should keep the original addresses for a LOCAL header", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			defer GinkgoRecover()
+			Expect(writeProxyProtocolHeader(client, &net.UnixAddr{}, &net.UnixAddr{})).To(Succeed())
+		}()
+		conn, err := readProxyProtocolHeader(server)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.RemoteAddr()).To(Equal(server.RemoteAddr()))
+	})
+
+	It("should reject connections without a header", func() {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go func() {
+			_, _ = client.Write(bytes.Repeat([]byte{'a'}, identifierLength))
+		}()
+		_, err := readProxyProtocolHeader(server)
+		Expect(err).To(MatchError(ErrNoProxyProtocolHeader))
+	})
+})
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"io"
+	"net"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+// addressConn is implemented by connections that only change the addresses
+// reported for the connection they wrap, the data can be copied from and to
+// the wrapped connection.
+type addressConn interface {
+	net.Conn
+	wrapped() net.Conn
+}
+
+func (p *proxyProtocolConn) wrapped() net.Conn {
+	return p.Conn
+}
+
+// pump copies from src to dst until the end of src. Copies between TCP
+// connections are spliced in the kernel on Linux, so connections are
+// unwrapped down to the TCP connection when the data isn't changed.
+func pump(dst io.Writer, src io.Reader) (int64, error) {
+	if conn, ok := dst.(net.Conn); ok {
+		dst = unwrapConn(conn)
+	}
+	if conn, ok := src.(net.Conn); ok {
+		src = unwrapConn(conn)
+	}
+	return io.Copy(dst, src)
+}
+
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		switch wrapper := conn.(type) {
+		case addressConn:
+			conn = wrapper.wrapped()
+		case transport.PassthroughConn:
+			conn = wrapper.Passthrough()
+		default:
+			return conn
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer listener.Close()
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	accepted, err := listener.Accept()
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(dialed.Close)
+	DeferCleanup(accepted.Close)
+	return dialed, accepted
+}
+
+var _ = Describe("pump tests", func() {
+	It("should unwrap connections that only change the addresses", func() {
+		client, _ := tcpPair()
+		wrapped := &proxyProtocolConn{Conn: client}
+		Expect(unwrapConn(wrapped)).To(BeIdenticalTo(client))
+		pipe, _ := net.Pipe()
+		defer pipe.Close()
+		Expect(unwrapConn(pipe)).To(BeIdenticalTo(pipe))
+	})
+
+	It("should copy between TCP connections", func() {
+		inClient, inServer := tcpPair()
+		outClient, outServer := tcpPair()
+		data := make([]byte, 4<<20)
+		_, _ = rand.Read(data)
+		go func() {
+			defer GinkgoRecover()
+			_, err := inClient.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(inClient.(*net.TCPConn).CloseWrite()).To(Succeed())
+		}()
+		copied := make(chan int64, 1)
+		go func() {
+			defer GinkgoRecover()
+			n, err := pump(outClient, &proxyProtocolConn{Conn: inServer})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(outClient.(*net.TCPConn).CloseWrite()).To(Succeed())
+			copied <- n
+		}()
+		received, err := io.ReadAll(outServer)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(bytes.Equal(received, data)).To(BeTrue())
+		Expect(<-copied).To(Equal(int64(len(data))))
+	})
+})
@@ -0,0 +1,350 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	resumeMagic            = "RSUM"
+	resumeTokenLength      = 16
+	resumeReplayBufferSize = 32 * 1024 * 1024
+	maxFramePayload        = 256 * 1024
+	frameHeaderLength      = 5
+	DefaultResumeTimeout   = 30 * time.Second
+)
+
+const (
+	frameData byte = iota
+	frameEnd
+)
+
+var (
+	ErrResumeWindowExceeded = errors.New("peer is missing data that is no longer buffered, unable to resume")
+	ErrResumeTimeout        = errors.New("timed out waiting for the peer to reconnect")
+	errSessionClosed        = errors.New("session closed")
+)
+
+func newResumeToken() ([]byte, error) {
+	token := make([]byte, resumeTokenLength)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// writeResumeHello is sent by the client after the identifier, it carries the
+// session token and the number of tunnel bytes the client has received so far.
+func writeResumeHello(w io.Writer, token []byte, received uint64) error {
+	hello := bytes.NewBuffer(make([]byte, 0, len(resumeMagic)+resumeTokenLength+8))
+	hello.WriteString(resumeMagic)
+	hello.Write(token)
+	_ = binary.Write(hello, binary.LittleEndian, received)
+	_, err := w.Write(hello.Bytes())
+	return err
+}
+
+func readResumeHello(r io.Reader) ([]byte, uint64, error) {
+	hello := make([]byte, len(resumeMagic)+resumeTokenLength+8)
+	if _, err := io.ReadFull(r, hello); err != nil {
+		return nil, 0, err
+	}
+	if string(hello[:len(resumeMagic)]) != resumeMagic {
+		return nil, 0, errors.New("peer did not send a resume hello, is it running with --resumable?")
+	}
+	token := hello[len(resumeMagic) : len(resumeMagic)+resumeTokenLength]
+	received := binary.LittleEndian.Uint64(hello[len(resumeMagic)+resumeTokenLength:])
+	return token, received, nil
+}
+
+// resumeRequest is a new tunnel for an existing session, received by the server.
+type resumeRequest struct {
+	conn         net.Conn
+	peerReceived uint64
+}
+
+// replayBuffer keeps the last bytes written to the tunnel so they can be
+// replayed to a peer that reconnects after losing data in flight.
+type replayBuffer struct {
+	buf []byte
+	end uint64
+	max int
+}
+
+func (r *replayBuffer) append(p []byte) {
+	r.buf = append(r.buf, p...)
+	r.end += uint64(len(p))
+	if len(r.buf) > r.max {
+		r.buf = r.buf[len(r.buf)-r.max:]
+		if cap(r.buf) > 2*r.max {
+			r.buf = append(make([]byte, 0, r.max), r.buf...)
+		}
+	}
+}
+
+// from returns a copy of the bytes from stream position pos to the end.
+func (r *replayBuffer) from(pos uint64) ([]byte, error) {
+	start := r.end - uint64(len(r.buf))
+	if pos < start || pos > r.end {
+		return nil, ErrResumeWindowExceeded
+	}
+	return bytes.Clone(r.buf[pos-start:]), nil
+}
+
+// resumableSession pumps data between a stable local connection and a tunnel
+// that can be replaced when it drops. Data is framed on the tunnel so the end
+// of the stream is explicit, and both sides track how many tunnel bytes they
+// received so a new tunnel can pick up where the old one left off.
+type resumableSession struct {
+	token []byte
+	local io.ReadWriteCloser
+	log   logr.Logger
+
+	writeMu      sync.Mutex
+	mu           sync.Mutex
+	cond         *sync.Cond
+	conn         net.Conn
+	generation   int
+	readerDone   chan struct{}
+	replay       replayBuffer
+	received     uint64
+	sentEnd      bool
+	receivedEnd  bool
+	disconnected chan struct{}
+	reattach     chan resumeRequest
+	done         chan struct{}
+	err          error
+	finishOnce   sync.Once
+}
+
+func newResumableSession(token []byte, local io.ReadWriteCloser, log logr.Logger) *resumableSession {
+	s := &resumableSession{
+		token:        token,
+		local:        local,
+		log:          log,
+		replay:       replayBuffer{max: resumeReplayBufferSize},
+		disconnected: make(chan struct{}, 1),
+		reattach:     make(chan resumeRequest),
+		done:         make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// resume waits for the previous tunnel to be fully torn down, exchanges the
+// received counters with the peer and continues the session on conn.
+func (s *resumableSession) resume(conn net.Conn, exchange func(received uint64) (uint64, error)) error {
+	s.mu.Lock()
+	if s.conn != nil {
+		// The peer reconnected before we noticed the old tunnel was gone
+		s.log.Info("Replacing tunnel", "generation", s.generation)
+		s.conn.Close()
+		s.conn = nil
+	}
+	readerDone := s.readerDone
+	s.mu.Unlock()
+	if readerDone != nil {
+		<-readerDone
+	}
+	s.mu.Lock()
+	received := s.received
+	s.mu.Unlock()
+	peerReceived, err := exchange(received)
+	if err != nil {
+		return err
+	}
+	return s.attach(conn, peerReceived)
+}
+
+func (s *resumableSession) attach(conn net.Conn, peerReceived uint64) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.Lock()
+	if s.isDone() {
+		s.mu.Unlock()
+		return errSessionClosed
+	}
+	resend, err := s.replay.from(peerReceived)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.generation++
+	s.conn = conn
+	s.readerDone = make(chan struct{})
+	go s.readFrames(conn, s.generation, s.readerDone)
+	generation := s.generation
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.log.Info("Attached tunnel", "generation", generation, "replaying bytes", len(resend))
+	if _, err := conn.Write(resend); err != nil {
+		s.markDisconnected(generation, err)
+	}
+	return nil
+}
+
+// pumpLocal copies data from the local connection into the tunnel.
+func (s *resumableSession) pumpLocal() {
+	buf := make([]byte, maxFramePayload)
+	for {
+		n, err := s.local.Read(buf)
+		if n > 0 {
+			if werr := s.writeFrame(frameData, buf[:n]); werr != nil {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				s.finish(err)
+				return
+			}
+			if werr := s.writeFrame(frameEnd, nil); werr != nil {
+				return
+			}
+			s.mu.Lock()
+			s.sentEnd = true
+			s.checkComplete()
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *resumableSession) writeFrame(frameType byte, payload []byte) error {
+	frame := make([]byte, frameHeaderLength+len(payload))
+	frame[0] = frameType
+	binary.LittleEndian.PutUint32(frame[1:frameHeaderLength], uint32(len(payload)))
+	copy(frame[frameHeaderLength:], payload)
+
+	s.mu.Lock()
+	for s.conn == nil && !s.isDone() {
+		s.cond.Wait()
+	}
+	if s.isDone() {
+		s.mu.Unlock()
+		return errSessionClosed
+	}
+	s.replay.append(frame)
+	conn, generation := s.conn, s.generation
+	s.mu.Unlock()
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if _, err := conn.Write(frame); err != nil {
+		// The frame is in the replay buffer and will be resent on the next tunnel
+		s.markDisconnected(generation, err)
+	}
+	return nil
+}
+
+func (s *resumableSession) readFrames(conn net.Conn, generation int, done chan struct{}) {
+	defer close(done)
+	header := make([]byte, frameHeaderLength)
+	payload := make([]byte, maxFramePayload)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			s.markDisconnected(generation, err)
+			return
+		}
+		length := binary.LittleEndian.Uint32(header[1:])
+		if length > maxFramePayload {
+			s.finish(fmt.Errorf("invalid frame length %d", length))
+			return
+		}
+		if _, err := io.ReadFull(conn, payload[:length]); err != nil {
+			s.markDisconnected(generation, err)
+			return
+		}
+		switch header[0] {
+		case frameData:
+			if _, err := s.local.Write(payload[:length]); err != nil {
+				s.finish(err)
+				return
+			}
+		case frameEnd:
+			if cw, ok := s.local.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			}
+		default:
+			s.finish(fmt.Errorf("invalid frame type %d", header[0]))
+			return
+		}
+		s.mu.Lock()
+		s.received += uint64(frameHeaderLength + length)
+		if header[0] == frameEnd {
+			s.receivedEnd = true
+			s.checkComplete()
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *resumableSession) markDisconnected(generation int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation != s.generation || s.conn == nil || s.isDone() {
+		return
+	}
+	s.log.Info("Tunnel disconnected", "generation", generation, "error", err.Error())
+	s.conn.Close()
+	s.conn = nil
+	s.requestReconnect()
+}
+
+func (s *resumableSession) connected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+func (s *resumableSession) requestReconnect() {
+	select {
+	case s.disconnected <- struct{}{}:
+	default:
+	}
+}
+
+// checkComplete must be called with mu held.
+func (s *resumableSession) checkComplete() {
+	if s.sentEnd && s.receivedEnd {
+		s.finishLocked(nil)
+	}
+}
+
+func (s *resumableSession) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.finishLocked(err)
+}
+
+func (s *resumableSession) finishLocked(err error) {
+	s.finishOnce.Do(func() {
+		s.err = err
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+		s.cond.Broadcast()
+	})
+}
+
+// isDone must be called with mu held.
+func (s *resumableSession) isDone() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
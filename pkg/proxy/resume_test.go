@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// forwardDroppingFirst forwards the connections to the port to the target
+// port, and closes the first one once the client sent limit bytes, like a
+// dropped tunnel.
+func forwardDroppingFirst(port, targetPort int, limit int64) {
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(listener.Close)
+	go func() {
+		for first := true; ; first = false {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			target, err := net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(targetPort)))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, target)
+				conn.Close()
+			}()
+			go func(first bool) {
+				if first {
+					_, _ = io.Copy(target, io.LimitReader(conn, limit))
+					conn.Close()
+					target.Close()
+					return
+				}
+				_, _ = io.Copy(target, conn)
+				_ = target.(*net.TCPConn).CloseWrite()
+			}(first)
+		}
+	}()
+}
+
+var _ = Describe("resumable session tests", func() {
+	It("should round trip the resume hello", func() {
+		buf := bytes.NewBuffer([]byte{})
+		token, err := newResumeToken()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(writeResumeHello(buf, token, 1234)).To(Succeed())
+		resToken, received, err := readResumeHello(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(resToken).To(Equal(token))
+		Expect(received).To(Equal(uint64(1234)))
+	})
+
+	It("should not replay bytes that were dropped from the buffer", func() {
+		r := replayBuffer{max: 4}
+		r.append([]byte{1, 2, 3})
+		r.append([]byte{4, 5, 6})
+		res, err := r.from(2)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal([]byte{3, 4, 5, 6}))
+		_, err = r.from(1)
+		Expect(err).To(MatchError(ErrResumeWindowExceeded))
+	})
+
+	It("should survive a dropped tunnel", func() {
+		token, err := newResumeToken()
+		Expect(err).ToNot(HaveOccurred())
+		clientLocal, clientApp := net.Pipe()
+		serverLocal, serverApp := net.Pipe()
+		client := newResumableSession(token, clientLocal, GinkgoLogr.WithName("client"))
+		server := newResumableSession(token, serverLocal, GinkgoLogr.WithName("server"))
+
+		connect := func() {
+			clientTunnel, serverTunnel := net.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer GinkgoRecover()
+				defer close(done)
+				err := server.resume(serverTunnel, func(received uint64) (uint64, error) {
+					var peerReceived uint64
+					if err := binary.Read(serverTunnel, binary.LittleEndian, &peerReceived); err != nil {
+						return 0, err
+					}
+					return peerReceived, binary.Write(serverTunnel, binary.LittleEndian, received)
+				})
+				Expect(err).ToNot(HaveOccurred())
+			}()
+			err := client.resume(clientTunnel, func(received uint64) (uint64, error) {
+				if err := binary.Write(clientTunnel, binary.LittleEndian, received); err != nil {
+					return 0, err
+				}
+				var peerReceived uint64
+				return peerReceived, binary.Read(clientTunnel, binary.LittleEndian, &peerReceived)
+			})
+			Expect(err).ToNot(HaveOccurred())
+			<-done
+		}
+		connect()
+		go client.pumpLocal()
+		go server.pumpLocal()
+
+		data := make([]byte, 4*maxFramePayload)
+		_, err = rand.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			_, err := clientApp.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			clientApp.Close()
+		}()
+
+		received := make([]byte, len(data))
+		_, err = io.ReadFull(serverApp, received[:len(data)/2])
+		Expect(err).ToNot(HaveOccurred())
+		By("dropping the tunnel")
+		client.mu.Lock()
+		client.conn.Close()
+		client.mu.Unlock()
+		Eventually(client.disconnected).Should(Receive())
+		connect()
+		_, err = io.ReadFull(serverApp, received[len(data)/2:])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+
+		serverApp.Close()
+		Eventually(client.done).Should(BeClosed())
+		Eventually(server.done).Should(BeClosed())
+		Expect(client.err).ToNot(HaveOccurred())
+		Expect(server.err).ToNot(HaveOccurred())
+	})
+
+	It("should reattach a reconnecting client to its running session", func() {
+		GinkgoT().Setenv(testIdentifier, filepath.Join(GinkgoT().TempDir(), "disk.img"))
+		// Stand in for the blockrsync server, echoing what it receives
+		listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(blockRsyncPort+1)))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+			_ = conn.(*net.TCPConn).CloseWrite()
+		}()
+		serverPort, serverDone := startProxyServer("true", []string{testIdentifier}, &ProxyOptions{
+			Resumable:           true,
+			MissingTargetPolicy: MissingTargetCreate,
+		})
+		freePort := func() int {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			defer listener.Close()
+			return listener.Addr().(*net.TCPAddr).Port
+		}
+		tunnelPort, listenPort := freePort(), freePort()
+		forwardDroppingFirst(tunnelPort, serverPort, 256*1024)
+		client := NewProxyClient(listenPort, tunnelPort, "localhost", &ProxyOptions{Resumable: true}, GinkgoLogr.WithName("client"))
+		clientDone := make(chan error, 1)
+		go func() {
+			clientDone <- client.ConnectToTarget(testIdentifier)
+		}()
+
+		app := dialProxy(listenPort)
+		// Fail rather than hang if nothing accepts the reconnect
+		Expect(app.SetReadDeadline(time.Now().Add(20 * time.Second))).To(Succeed())
+		data := make([]byte, 4*maxFramePayload)
+		_, err = rand.Read(data)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			_, err := app.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(app.(*net.TCPConn).CloseWrite()).To(Succeed())
+		}()
+		received, err := io.ReadAll(app)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+		Eventually(clientDone, 10*time.Second).Should(Receive(BeNil()))
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+	})
+})
@@ -1,105 +1,550 @@
 package proxy
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"maps"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/discovery"
+	"github.com/awels/blockrsync/pkg/transport"
 )
 
 const (
 	identifierLength = 32 // Length of the md5sum
 	blockRsyncPort   = 3222
+
+	MissingTargetFail   = "fail"
+	MissingTargetCreate = "create"
+
+	// DefaultHandshakeTimeout is how long an inbound connection has to send
+	// its identifier
+	DefaultHandshakeTimeout = 30 * time.Second
 )
 
+type ProxyOptions struct {
+	// Expect a PROXY protocol v2 header on inbound connections
+	ProxyProtocol bool
+	// Emit a PROXY protocol v2 header on outbound connections
+	SendProxyProtocol bool
+	// Extra arguments passed to every blockrsync child process
+	BlockrsyncExtraArgs []string
+	// Extra arguments passed to the blockrsync child process of a specific identifier
+	IdentifierExtraArgs map[string][]string
+	// What to do when the target file of an identifier does not exist at startup
+	MissingTargetPolicy string
+	// File created once all identifiers are validated and the server is listening
+	ReadyFile string
+	// Tunnel data through a session that survives reconnects of the client
+	Resumable bool
+	// How long the server waits for a client to reconnect to a resumable session
+	ResumeTimeout time.Duration
+	// Advertise the server through DNS-SD with this instance name
+	AdvertiseName string
+	// Find the target through DNS-SD if no target address is given
+	Discover bool
+	// How long to wait for DNS-SD answers
+	DiscoverTimeout time.Duration
+	// Transport used between the proxy client and server, TCP if not set
+	Transport transport.Transport
+	// Terminate TLS on inbound connections after the PROXY protocol header,
+	// the route is picked by the server name the client asked for, target only
+	TLSRoutes []TLSRoute
+	// Connect to the proxy server with TLS after the PROXY protocol header,
+	// source only
+	TLSConfig *tls.Config
+	// Whether the client falls back to plaintext when the target doesn't
+	// speak TLS, TLSPolicyRequire if empty, source only
+	TLSPolicy string
+	// Limit the inbound connections until they sent a valid identifier,
+	// target only
+	Guard transport.GuardOptions
+	// How long an inbound connection has to send the PROXY protocol header,
+	// its identifier and its resume hello before it is closed, the TLS
+	// handshake has its own timeout. DefaultHandshakeTimeout if not set,
+	// target only
+	HandshakeTimeout time.Duration
+	// Send the identifier signed with the time and a nonce, so it is only
+	// accepted once within its validity window
+	SignIdentifiers bool
+	// Validity window of the signed identifiers, DefaultIdentifierWindow if
+	// not set, and of specific identifiers, target only
+	IdentifierWindow  time.Duration
+	IdentifierWindows map[string]time.Duration
+	// Directory with a file per identifier holding the path of its target,
+	// like a mounted ConfigMap. It is read before the environment on every
+	// connection so updates apply to the next one, target only
+	IdentifierMapDir string
+	// How often the files of the TLS routes are checked for new
+	// certificates, like a mounted Secret being updated, 0 disables
+	CredentialsReloadInterval time.Duration
+	// Require the clients of the TLS routes to present a certificate the
+	// CAs verify, whose common name or a DNS name is the identifier they
+	// sync. Every listener needs TLS routes, target only
+	ClientCAs *x509.CertPool
+	// Relay the exit code and stats of the blockrsync server of a session to
+	// the client before the tunnel closes, so the source can record the
+	// outcome of every disk. Must be set on both client and server, not with
+	// Resumable
+	SessionSummary bool
+	// Most identifiers synced at once, the clients of the others wait for a
+	// session to finish. All identifiers if not set, target only
+	MaxConcurrentSessions int
+	// More addresses the server listens on, like the address of a migration
+	// network next to the management network, target only
+	Listeners []ProxyListener
+	// Directory of the unix domain sockets the blockrsync servers listen on
+	// instead of a port each, target only
+	SocketDir string
+	// Unix domain socket the client listens on for the blockrsync client
+	// instead of its port, source only
+	ListenSocket string
+	// More host:port addresses of the server, the client connects to all of
+	// them and uses the path that completes the connection and the TLS
+	// handshake first, source only
+	AlternateTargets []string
+}
+
+// ProxyListener is an address the proxy server listens on besides its port.
+type ProxyListener struct {
+	Address string
+	// TLS routes of the connections accepted on the address, the TLSRoutes of
+	// the options if empty
+	TLSRoutes []TLSRoute
+	// Accept plaintext connections on the address even with TLS routes
+	Plaintext bool
+}
+
 type ProxyServer struct {
 	listenPort     int    // Port to listen on
 	blockrsyncPath string // Path to blockrsync binary
 	blockSize      int    // Block size to use
+	opts           *ProxyOptions
 	log            logr.Logger
 	identifiers    []string
 	wg             sync.WaitGroup
+	children       sync.WaitGroup // Running blockrsync servers
+	sessionsMu     sync.Mutex
+	sessions       map[string]*resumableSession
+	statsMu        sync.Mutex
+	stats          map[string]json.RawMessage
+	tlsMu          sync.Mutex
+	tls            []*tlsRouter // TLS router of every listener, nil for plaintext
+	verifier       *identifierVerifier
+	processingMu   sync.Mutex
+	processing     map[string]bool // Identifiers being synced, or synced
+	slots          chan struct{}   // Running sessions, nil if unlimited
 }
 
-func NewProxyServer(blockrsyncPath string, blockSize, listenPort int, identifiers []string, logger logr.Logger) *ProxyServer {
+func NewProxyServer(blockrsyncPath string, blockSize, listenPort int, identifiers []string, opts *ProxyOptions, logger logr.Logger) *ProxyServer {
 	return &ProxyServer{
 		listenPort:     listenPort,
 		blockrsyncPath: blockrsyncPath,
+		opts:           opts,
 		log:            logger,
 		identifiers:    identifiers,
 		blockSize:      blockSize,
+		sessions:       make(map[string]*resumableSession),
+		stats:          make(map[string]json.RawMessage),
+		processing:     make(map[string]bool),
+	}
+}
+
+// ChildStats returns the statistics reported by the blockrsync servers that
+// finished, keyed by identifier.
+func (b *ProxyServer) ChildStats() map[string]json.RawMessage {
+	b.statsMu.Lock()
+	defer b.statsMu.Unlock()
+	return maps.Clone(b.stats)
+}
+
+// ReloadCredentials loads the certificates of the TLS routes whose files
+// changed, new connections are accepted with them while the sessions in flight
+// carry on. The certificates are kept if any fails to load.
+func (b *ProxyServer) ReloadCredentials() error {
+	b.tlsMu.Lock()
+	routers := slices.Clone(b.tls)
+	b.tlsMu.Unlock()
+	reloaded := 0
+	seen := make(map[*tlsRouter]bool)
+	for _, router := range routers {
+		// Listeners share the router of the TLS routes of the options
+		if router == nil || seen[router] {
+			continue
+		}
+		seen[router] = true
+		n, err := router.reload()
+		if err != nil {
+			return err
+		}
+		reloaded += n
+	}
+	if reloaded > 0 {
+		b.log.Info("Reloaded credentials", "certificates", reloaded)
 	}
+	return nil
 }
 
 func (b *ProxyServer) StartServer() error {
-	for _, identifier := range b.identifiers {
-		if len(identifier) != identifierLength {
-			return fmt.Errorf("identifier must be %d characters", identifierLength)
+	if err := b.validateIdentifiers(); err != nil {
+		return err
+	}
+	if err := b.opts.Guard.Validate(); err != nil {
+		return err
+	}
+	if b.opts.HandshakeTimeout < 0 {
+		return errors.New("handshake timeout must be >= 0")
+	}
+	if b.opts.MaxConcurrentSessions < 0 {
+		return errors.New("max concurrent sessions must be >= 0")
+	}
+	if b.opts.SessionSummary && b.opts.Resumable {
+		return errors.New("session summaries cannot be used with resumable sessions")
+	}
+	routers, err := b.tlsRouters()
+	if err != nil {
+		return err
+	}
+	b.tlsMu.Lock()
+	b.tls = routers
+	b.tlsMu.Unlock()
+	if slices.ContainsFunc(routers, func(r *tlsRouter) bool { return r != nil }) {
+		if b.opts.CredentialsReloadInterval > 0 {
+			stop := make(chan struct{})
+			defer close(stop)
+			go b.reloadCredentialsEvery(b.opts.CredentialsReloadInterval, stop)
 		}
 	}
+	if b.opts.SignIdentifiers {
+		verifier, err := newIdentifierVerifier(b.identifiers, b.opts.IdentifierWindow, b.opts.IdentifierWindows)
+		if err != nil {
+			return err
+		}
+		b.verifier = verifier
+	}
 	b.log.Info("Listening:", "host", "localhost", "port", b.listenPort)
 	// Create a listener on the desired port
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", b.listenPort))
+	listener, err := b.listen()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	mu := &sync.Mutex{}
-	processingMap := make(map[string]int)
-
-	for i := 1; i <= len(b.identifiers); i++ {
-		b.wg.Add(1)
-		go b.processConnection(listener, processingMap, mu, i)
+	if b.opts.Guard.Enabled() {
+		guard := b.opts.Guard
+		// Behind a load balancer every connection comes from its address, the
+		// rate is limited by the address of the PROXY protocol header
+		guard.DeferRate = b.opts.ProxyProtocol
+		listener = transport.Guard(listener, guard, b.log.WithName("guard"))
+	}
+	defer listener.Close()
+	if b.opts.AdvertiseName != "" {
+		if err := b.advertise(); err != nil {
+			return err
+		}
+	}
+	if b.opts.ReadyFile != "" {
+		b.log.Info("Writing ready file", "file", b.opts.ReadyFile)
+		if err := CreateFile(b.opts.ReadyFile, nil); err != nil {
+			return err
+		}
+	}
+	if b.opts.MaxConcurrentSessions > 0 {
+		b.slots = make(chan struct{}, b.opts.MaxConcurrentSessions)
 	}
+
+	b.wg.Add(len(b.identifiers))
+	go b.acceptConnections(listener)
 	b.wg.Wait()
+	// The stats of the blockrsync servers are collected once they exited
+	b.children.Wait()
 	return nil
 }
 
-func (b *ProxyServer) processConnection(listener net.Listener, processing map[string]int, mu *sync.Mutex, i int) {
-	keepTrying := true
-	for keepTrying {
+// acceptConnections handles every connection concurrently, so neither a slow
+// handshake nor a running session keeps the server from accepting the next
+// connection, like a client reconnecting to its resumable session.
+func (b *ProxyServer) acceptConnections(listener net.Listener) {
+	for {
 		b.log.Info("Waiting for connection")
-		// Accept incoming connections
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// The server finished
+			return
+		}
 		if err != nil {
 			b.log.Error(err, "Unable to accept connection")
+			continue
+		}
+		go b.processConnection(conn)
+	}
+}
+
+// childPort returns the port of the blockrsync server of the identifier,
+// every identifier has its own so their sessions run concurrently.
+func (b *ProxyServer) childPort(identifier string) int {
+	return blockRsyncPort + 1 + slices.Index(b.identifiers, identifier)
+}
+
+// childSocket returns the unix socket of the blockrsync server of the
+// identifier in the socket directory.
+func (b *ProxyServer) childSocket(identifier string) string {
+	return filepath.Join(b.opts.SocketDir, fmt.Sprintf("blockrsync-%s.sock", identifier))
+}
+
+// claim marks the identifier as being synced, it returns false if it is
+// already being synced or was synced.
+func (b *ProxyServer) claim(identifier string) bool {
+	b.processingMu.Lock()
+	defer b.processingMu.Unlock()
+	if b.processing[identifier] {
+		return false
+	}
+	b.processing[identifier] = true
+	return true
+}
+
+// release lets a client sync the identifier again after its session failed.
+func (b *ProxyServer) release(identifier string) {
+	b.processingMu.Lock()
+	defer b.processingMu.Unlock()
+	delete(b.processing, identifier)
+}
+
+func (b *ProxyServer) handshakeTimeout() time.Duration {
+	if b.opts.HandshakeTimeout <= 0 {
+		return DefaultHandshakeTimeout
+	}
+	return b.opts.HandshakeTimeout
+}
+
+// tlsRouters returns the TLS router of the port and of every listener.
+func (b *ProxyServer) tlsRouters() ([]*tlsRouter, error) {
+	var primary *tlsRouter
+	if len(b.opts.TLSRoutes) > 0 {
+		var err error
+		if primary, err = newTLSRouter(b.opts.TLSRoutes, b.identifiers); err != nil {
+			return nil, err
+		}
+	}
+	routers := []*tlsRouter{primary}
+	for _, listener := range b.opts.Listeners {
+		router := primary
+		if listener.Plaintext {
+			router = nil
+		} else if len(listener.TLSRoutes) > 0 {
+			var err error
+			if router, err = newTLSRouter(listener.TLSRoutes, b.identifiers); err != nil {
+				return nil, fmt.Errorf("listener %s: %w", listener.Address, err)
+			}
+		}
+		routers = append(routers, router)
+	}
+	if b.opts.ClientCAs != nil {
+		// A plaintext path would let any client past the certificates
+		for i, router := range routers {
+			if router == nil {
+				address := fmt.Sprintf(":%d", b.listenPort)
+				if i > 0 {
+					address = b.opts.Listeners[i-1].Address
+				}
+				return nil, fmt.Errorf("client certificates need TLS routes on every listener, %s has none", address)
+			}
+			router.verifyClients(b.opts.ClientCAs)
+		}
+	}
+	return routers, nil
+}
+
+// listen listens on the port and the addresses of the listeners.
+func (b *ProxyServer) listen() (net.Listener, error) {
+	t := transport.OrDefault(b.opts.Transport)
+	listener, err := t.Listen(fmt.Sprintf(":%d", b.listenPort))
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{listener}
+	for _, options := range b.opts.Listeners {
+		b.log.Info("Listening:", "address", options.Address)
+		listener, err := t.Listen(options.Address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return transport.Merge(listeners...), nil
+}
+
+func (b *ProxyServer) advertise() error {
+	text, err := advertisedText(b.identifiers)
+	if err != nil {
+		return err
+	}
+	advertiser, err := discovery.NewAdvertiser(b.opts.AdvertiseName, b.listenPort, text, b.log.WithName("advertiser"))
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := advertiser.Run(context.Background()); err != nil {
+			b.log.Error(err, "Unable to advertise service")
 		}
-		file, header, err := b.getTargetFileFromIdentifier(conn)
+	}()
+	return nil
+}
+
+// processConnection reads the headers of the connection and runs the session
+// of its identifier, or hands the connection to the running resumable session.
+func (b *ProxyServer) processConnection(conn net.Conn) {
+	accepted := conn
+	// A connection that sends nothing, like a port scanner, would be held
+	// forever
+	deadline := time.Now().Add(b.handshakeTimeout())
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		b.log.Error(err, "Unable to set handshake deadline", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if b.opts.ProxyProtocol {
+		proxyConn, err := readProxyProtocolHeader(conn)
 		if err != nil {
-			b.log.Error(err, "Unable to get target file from identifier")
+			b.log.Error(err, "Unable to read PROXY protocol header", "remote", conn.RemoteAddr())
 			conn.Close()
+			return
 		}
-		mu.Lock()
-		if processing[header] > 0 {
-			// Someone else is processing same header, ignore this connection
-			b.log.Info("other thread is processing header", "thread", processing[header], "header", header)
-			mu.Unlock()
+		if err := transport.Admit(accepted, proxyConn.RemoteAddr()); err != nil {
+			b.log.Info("Refusing connection", "remote", proxyConn.RemoteAddr(), "reason", err.Error())
 			conn.Close()
-			continue
-		} else {
-			b.log.Info("processing header", "header", header, "thread", i)
-			processing[header] = i
-			mu.Unlock()
+			return
 		}
-
-		b.log.Info("Accepted connection, starting blockrsync server", "port", blockRsyncPort+i)
-		err = b.startsBlockrsyncServer(conn, file, blockRsyncPort+i)
+		conn = proxyConn
+	}
+	var route *TLSRoute
+	if router := b.tls[transport.ListenerIndex(accepted)]; router != nil {
+		tlsConn, tlsRoute, err := router.accept(conn)
+		if err != nil {
+			b.log.Error(err, "TLS handshake failed", "remote", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		conn, route = tlsConn, tlsRoute
+		// The TLS handshake cleared the deadline
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			b.log.Error(err, "Unable to set handshake deadline", "remote", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+	}
+	b.log.Info("Accepted connection", "remote", conn.RemoteAddr())
+	file, header, err := b.getTargetFileFromIdentifier(conn)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.log.Info("Closing connection that did not send its identifier in time", "remote", conn.RemoteAddr(), "timeout", b.handshakeTimeout())
+		conn.Close()
+		return
+	}
+	if err != nil {
+		b.log.Error(err, "Unable to get target file from identifier", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if route != nil && !route.allows(header) {
+		b.log.Error(ErrIdentifierNotRouted, "Refusing connection", "identifier", header, "server name", route.ServerName, "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if b.opts.ClientCAs != nil {
+		if err := verifyIdentity(conn, header); err != nil {
+			b.log.Error(err, "Refusing connection", "identifier", header, "remote", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+	}
+	var token []byte
+	var peerReceived uint64
+	if b.opts.Resumable {
+		token, peerReceived, err = readResumeHello(conn)
 		if err != nil {
-			b.log.Error(err, "Unable to start blockrsync server")
-		} else {
-			b.wg.Done()
-			keepTrying = false
+			b.log.Error(err, "Unable to read resume hello", "remote", conn.RemoteAddr())
+			conn.Close()
+			return
 		}
 	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		b.log.Error(err, "Unable to clear handshake deadline", "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if !transport.Authenticated(accepted) {
+		conn.Close()
+		return
+	}
+	if b.opts.Resumable {
+		if b.reattachSession(header, token, conn, peerReceived) {
+			return
+		}
+	}
+	if !b.claim(header) {
+		// Another connection is syncing the identifier, or synced it
+		b.log.Info("Identifier is already being synced", "identifier", header, "remote", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	if b.slots != nil {
+		select {
+		case b.slots <- struct{}{}:
+		default:
+			b.log.Info("Waiting for a session to finish", "identifier", header, "max concurrent sessions", cap(b.slots))
+			b.slots <- struct{}{}
+		}
+		defer func() { <-b.slots }()
+	}
+
+	port := b.childPort(header)
+	if b.opts.SocketDir != "" {
+		b.log.Info("Accepted connection, starting blockrsync server", "identifier", header, "socket", b.childSocket(header))
+	} else {
+		b.log.Info("Accepted connection, starting blockrsync server", "identifier", header, "port", port)
+	}
+	if b.opts.Resumable {
+		err = b.startResumableBlockrsyncServer(conn, file, header, token, peerReceived, port)
+	} else {
+		err = b.startsBlockrsyncServer(conn, file, header, port)
+	}
+	if err != nil {
+		b.log.Error(err, "Unable to start blockrsync server", "identifier", header)
+		b.release(header)
+		return
+	}
+	b.wg.Done()
 }
 
 func (b *ProxyServer) getTargetFileFromIdentifier(conn net.Conn) (string, string, error) {
+	if b.verifier != nil {
+		identifier, err := b.verifier.read(conn, time.Now())
+		if err != nil {
+			return "", "", err
+		}
+		file, err := b.targetFile(identifier)
+		if err != nil {
+			return "", "", err
+		}
+		return file, identifier, nil
+	}
 	header := make([]byte, identifierLength)
 	n, err := io.ReadFull(conn, header)
 	if err != nil {
@@ -108,45 +553,86 @@ func (b *ProxyServer) getTargetFileFromIdentifier(conn net.Conn) (string, string
 	if n != identifierLength {
 		return "", "", fmt.Errorf("expected %d bytes, got %d", identifierLength, n)
 	}
-	file := os.Getenv(string(header))
+	file, err := b.targetFile(string(header))
+	if err != nil {
+		return "", "", err
+	}
+	return file, string(header), nil
+}
+
+func resolveIdentifier(identifier string) (string, error) {
+	file := os.Getenv(identifier)
 	if file == "" {
-		file = os.Getenv((fmt.Sprintf("id-%s", header)))
+		file = os.Getenv(fmt.Sprintf("id-%s", identifier))
 		if file == "" {
-			return "", "", fmt.Errorf("no filepath found for %s", string(header))
+			return "", fmt.Errorf("no filepath found for %s", identifier)
 		}
 	}
-	return file, string(header), nil
+	return file, nil
+}
+
+// validateIdentifiers makes sure every identifier maps to a writable target
+// before the server reports ready, so mapping mistakes are found at startup.
+func (b *ProxyServer) validateIdentifiers() error {
+	for _, identifier := range b.identifiers {
+		if len(identifier) != identifierLength {
+			return fmt.Errorf("identifier must be %d characters", identifierLength)
+		}
+		file, err := b.targetFile(identifier)
+		if err != nil {
+			return err
+		}
+		if err := b.validateTargetFile(file); err != nil {
+			return fmt.Errorf("invalid target for identifier %s: %w", identifier, err)
+		}
+		b.log.Info("Validated identifier", "identifier", identifier, "file", file)
+	}
+	return nil
+}
+
+func (b *ProxyServer) validateTargetFile(file string) error {
+	if _, err := os.Stat(file); err != nil {
+		if !os.IsNotExist(err) || b.opts.MissingTargetPolicy != MissingTargetCreate {
+			return err
+		}
+		b.log.Info("Creating missing target file", "file", file)
+		return CreateFile(file, nil)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// CreateFile writes the file with the content, creating its directory if it
+// doesn't exist.
+func CreateFile(fileName string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, content, 0644)
 }
 
-func (b *ProxyServer) startsBlockrsyncServer(rw io.ReadWriteCloser, file string, port int) error {
+func (b *ProxyServer) startsBlockrsyncServer(rw io.ReadWriteCloser, file, identifier string, port int) error {
 	defer rw.Close()
 
 	b.log.Info("writing to file", "file", file)
-	go b.forkProcess(file, port)
-
-	notConnect := true
-	var blockRsyncConn net.Conn
-	var err error
-	for notConnect {
-		b.log.Info("Connecting to blockrsync server", "port", port)
-		blockRsyncConn, err = net.Dial("tcp", fmt.Sprintf("localhost:%d", port))
-		if err != nil {
-			b.log.Info("Waiting to connect to blockrsync server", "error", err)
-			time.Sleep(1 * time.Second)
-		} else {
-			b.log.Info("Connected to blockrsync server")
-			notConnect = false
-		}
+	summary := b.startChild(file, identifier, port)
+
+	blockRsyncConn := b.connectToBlockrsyncServer(identifier, port)
+	if b.opts.SessionSummary {
+		return b.relayWithSummary(rw, blockRsyncConn, summary)
 	}
+	// The blockrsync server exits once its client is gone
+	defer blockRsyncConn.Close()
 	go func() {
-		_, err = io.Copy(rw, blockRsyncConn)
-		if err != nil {
+		if _, err := pump(rw, blockRsyncConn); err != nil {
 			b.log.Error(err, "Unable to copy data from server to client")
 		}
 	}()
 	b.log.Info("Copying data")
-	_, err = io.Copy(blockRsyncConn, rw)
-	if err != nil {
+	if _, err := pump(blockRsyncConn, rw); err != nil {
 		b.log.Error(err, "Unable to copy data from client to server")
 		return err
 	}
@@ -155,19 +641,197 @@ func (b *ProxyServer) startsBlockrsyncServer(rw io.ReadWriteCloser, file string,
 	return nil
 }
 
-func (b *ProxyServer) forkProcess(file string, port int) {
-	arguments := []string{
-		file,
-		"--target",
-		"--port",
-		strconv.Itoa(port),
+// relayWithSummary frames the data of the blockrsync server, so the summary
+// of the session can follow it once the server exited.
+func (b *ProxyServer) relayWithSummary(rw io.ReadWriter, blockRsyncConn net.Conn, summary <-chan SessionSummary) error {
+	defer blockRsyncConn.Close()
+	go func() {
+		if _, err := pump(blockRsyncConn, rw); err != nil {
+			b.log.Error(err, "Unable to copy data from client to server")
+		}
+	}()
+	b.log.Info("Copying data")
+	if err := writeDataFrames(rw, blockRsyncConn); err != nil {
+		b.log.Error(err, "Unable to copy data from server to client")
+		return err
+	}
+	s := <-summary
+	if err := writeSummary(rw, s); err != nil {
+		return err
+	}
+	b.log.Info("Sent session summary", "identifier", s.Identifier, "exit code", s.ExitCode)
+	return nil
+}
+
+// connectToBlockrsyncServer connects to the blockrsync server of the
+// identifier, on its socket if there is a socket directory.
+func (b *ProxyServer) connectToBlockrsyncServer(identifier string, port int) net.Conn {
+	t, address := transport.TCP, net.JoinHostPort("localhost", strconv.Itoa(port))
+	if b.opts.SocketDir != "" {
+		t, address = transport.Unix, b.childSocket(identifier)
+	}
+	b.log.Info("Connecting to blockrsync server", "address", address)
+	// Retrying forever cannot fail
+	blockRsyncConn, _ := transport.DialRetry(t, address, -1, time.Second)
+	b.log.Info("Connected to blockrsync server")
+	return blockRsyncConn
+}
+
+// reattachSession hands the connection to a running resumable session with the
+// same token, returns false if there is no such session.
+func (b *ProxyServer) reattachSession(identifier string, token []byte, conn net.Conn, peerReceived uint64) bool {
+	b.sessionsMu.Lock()
+	session, ok := b.sessions[sessionKey(identifier, token)]
+	b.sessionsMu.Unlock()
+	if !ok {
+		return false
+	}
+	b.log.Info("Reattaching connection to session", "identifier", identifier, "remote", conn.RemoteAddr())
+	select {
+	case session.reattach <- resumeRequest{conn: conn, peerReceived: peerReceived}:
+	case <-session.done:
+		b.log.Info("Session already finished", "identifier", identifier)
+		conn.Close()
+	}
+	return true
+}
+
+func sessionKey(identifier string, token []byte) string {
+	return identifier + string(token)
+}
+
+func (b *ProxyServer) startResumableBlockrsyncServer(conn net.Conn, file, identifier string, token []byte, peerReceived uint64, port int) error {
+	b.log.Info("writing to file", "file", file)
+	b.startChild(file, identifier, port)
+
+	blockRsyncConn := b.connectToBlockrsyncServer(identifier, port)
+	defer blockRsyncConn.Close()
+
+	session := newResumableSession(token, blockRsyncConn, b.log.WithName("session").WithValues("identifier", identifier))
+	key := sessionKey(identifier, token)
+	b.sessionsMu.Lock()
+	b.sessions[key] = session
+	b.sessionsMu.Unlock()
+	defer func() {
+		b.sessionsMu.Lock()
+		delete(b.sessions, key)
+		b.sessionsMu.Unlock()
+	}()
+
+	resume := func(req resumeRequest) {
+		err := session.resume(req.conn, func(received uint64) (uint64, error) {
+			return req.peerReceived, binary.Write(req.conn, binary.LittleEndian, received)
+		})
+		if err != nil {
+			req.conn.Close()
+			if err == ErrResumeWindowExceeded {
+				session.finish(err)
+			} else {
+				b.log.Error(err, "Unable to resume session")
+			}
+		}
+	}
+	resume(resumeRequest{conn: conn, peerReceived: peerReceived})
+	go session.pumpLocal()
+
+	timeout := b.opts.ResumeTimeout
+	if timeout <= 0 {
+		timeout = DefaultResumeTimeout
+	}
+	for {
+		select {
+		case <-session.done:
+			if session.err != nil {
+				return session.err
+			}
+			b.log.Info("Successfully completed sync proxy")
+			return nil
+		case req := <-session.reattach:
+			resume(req)
+		case <-session.disconnected:
+			if session.connected() {
+				continue
+			}
+			b.log.Info("Client disconnected, waiting for it to resume", "timeout", timeout)
+			select {
+			case <-session.done:
+			case req := <-session.reattach:
+				resume(req)
+			case <-time.After(timeout):
+				session.finish(ErrResumeTimeout)
+			}
+		}
+	}
+}
+
+// startChild runs the blockrsync server of the identifier, its final status
+// is sent once it exited and its stats were collected. StartServer waits for
+// it.
+func (b *ProxyServer) startChild(file, identifier string, port int) <-chan SessionSummary {
+	summary := make(chan SessionSummary, 1)
+	b.children.Add(1)
+	go func() {
+		defer b.children.Done()
+		summary <- b.forkProcess(file, identifier, port)
+	}()
+	return summary
+}
+
+// forkProcess runs the blockrsync server of the identifier and returns its
+// final status.
+func (b *ProxyServer) forkProcess(file, identifier string, port int) SessionSummary {
+	statsFile := filepath.Join(os.TempDir(), fmt.Sprintf("blockrsync-stats-%s.json", identifier))
+	arguments := b.blockrsyncArguments(file, identifier, port)
+	arguments = append(arguments, "--stats-file", statsFile)
+	b.log.Info("Starting blockrsync server", "arguments", arguments)
+	summary := SessionSummary{Identifier: identifier}
+	if err := b.runBlockrsync(arguments); err != nil {
+		summary.ExitCode, summary.Error = exitCode(err), err.Error()
+	}
+	summary.Stats = b.collectStats(identifier, statsFile)
+	return summary
+}
+
+func (b *ProxyServer) collectStats(identifier, statsFile string) json.RawMessage {
+	data, err := os.ReadFile(statsFile)
+	if err != nil {
+		b.log.Info("No stats reported by blockrsync server", "identifier", identifier, "error", err.Error())
+		return nil
+	}
+	_ = os.Remove(statsFile)
+	if !json.Valid(data) {
+		b.log.Info("Invalid stats reported by blockrsync server", "identifier", identifier)
+		return nil
+	}
+	b.statsMu.Lock()
+	b.stats[identifier] = data
+	b.statsMu.Unlock()
+	return data
+}
+
+func (b *ProxyServer) blockrsyncArguments(file, identifier string, port int) []string {
+	listen := []string{"--port", strconv.Itoa(port)}
+	if b.opts.SocketDir != "" {
+		listen = []string{"--listen-socket", b.childSocket(identifier)}
+	}
+	arguments := append([]string{file, "--target"}, listen...)
+	arguments = append(arguments,
 		"--zap-log-level",
 		"3",
 		"--block-size",
 		strconv.Itoa(b.blockSize),
-	}
+		// The child is connected to the proxy on loopback, it compresses
+		// for the hop between the proxies
+		"--compression",
+		"snappy",
+	)
+	// Extra arguments come last so they can override the defaults above
+	arguments = append(arguments, b.opts.BlockrsyncExtraArgs...)
+	arguments = append(arguments, b.opts.IdentifierExtraArgs[identifier]...)
+	return arguments
+}
 
-	b.log.Info("Starting blockrsync server", "arguments", arguments)
+func (b *ProxyServer) runBlockrsync(arguments []string) error {
 	cmd := exec.Command(b.blockrsyncPath, arguments...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -176,10 +840,12 @@ func (b *ProxyServer) forkProcess(file string, port int) {
 	err := cmd.Start()
 	if err != nil {
 		b.log.Error(err, "Unable to start blockrsync server")
+		return err
 	}
 	// Wait for the command to finish
 	err = cmd.Wait()
 	if err != nil {
 		b.log.Error(err, "Waiting for blockrsync server to complete")
 	}
+	return err
 }
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	testIdentifier = "0123456789abcdef0123456789abcdef"
+)
+
+var _ = Describe("proxy server tests", func() {
+	It("should append extra arguments after the defaults", func() {
+		server := NewProxyServer("/blockrsync", 4096, 9080, []string{testIdentifier}, &ProxyOptions{
+			BlockrsyncExtraArgs: []string{"--preallocate"},
+			IdentifierExtraArgs: map[string][]string{
+				testIdentifier: {"--block-size", "8192"},
+			},
+		}, GinkgoLogr.WithName("server"))
+		Expect(server.blockrsyncArguments("/dev/vdb", testIdentifier, 3223)).To(Equal([]string{
+			"/dev/vdb", "--target", "--port", "3223", "--zap-log-level", "3", "--block-size", "4096", "--compression", "snappy",
+			"--preallocate", "--block-size", "8192",
+		}))
+		Expect(server.blockrsyncArguments("/dev/vdc", "other", 3224)).To(Equal([]string{
+			"/dev/vdc", "--target", "--port", "3224", "--zap-log-level", "3", "--block-size", "4096", "--compression", "snappy",
+			"--preallocate",
+		}))
+	})
+
+	It("should close connections that don't send their identifier in time", func() {
+		GinkgoT().Setenv(testIdentifier, filepath.Join(GinkgoT().TempDir(), "disk.img"))
+		standInBlockrsync(blockRsyncPort + 1)
+		port, serverDone := startProxyServer("true", []string{testIdentifier}, &ProxyOptions{
+			MissingTargetPolicy: MissingTargetCreate,
+			HandshakeTimeout:    100 * time.Millisecond,
+		})
+
+		for i := 0; i < 2; i++ {
+			scanner := dialProxy(port)
+			Expect(scanner.SetReadDeadline(time.Now().Add(10 * time.Second))).To(Succeed())
+			_, err := scanner.Read(make([]byte, 1))
+			Expect(err).To(MatchError(io.EOF))
+		}
+		client := dialProxy(port)
+		_, err := client.Write([]byte(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		client.Close()
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+	})
+
+	It("should limit the connection rate by the address of the PROXY protocol header", func() {
+		GinkgoT().Setenv(testIdentifier, filepath.Join(GinkgoT().TempDir(), "disk.img"))
+		standInBlockrsync(blockRsyncPort + 1)
+		port, serverDone := startProxyServer("true", []string{testIdentifier}, &ProxyOptions{
+			MissingTargetPolicy: MissingTargetCreate,
+			ProxyProtocol:       true,
+			Guard:               transport.GuardOptions{RatePerIP: 0.001},
+		})
+		// dial connects through a load balancer for the client at the address
+		dial := func(ip string) net.Conn {
+			conn := dialProxy(port)
+			src := &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+			Expect(writeProxyProtocolHeader(conn, src, conn.RemoteAddr())).To(Succeed())
+			return conn
+		}
+		closed := func(conn net.Conn, wait time.Duration) bool {
+			Expect(conn.SetReadDeadline(time.Now().Add(wait))).To(Succeed())
+			_, err := conn.Read(make([]byte, 1))
+			return err == io.EOF
+		}
+
+		first := dial("10.0.0.1")
+		other := dial("10.0.0.2")
+		Expect(closed(other, 200*time.Millisecond)).To(BeFalse())
+		Expect(closed(dial("10.0.0.1"), 10*time.Second)).To(BeTrue())
+		other.Close()
+		_, err := first.Write([]byte(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		first.Close()
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+	})
+
+	It("should run the sessions of distinct identifiers concurrently up to the limit", func() {
+		const otherIdentifier = "fedcba9876543210fedcba9876543210"
+		tmpDir := GinkgoT().TempDir()
+		GinkgoT().Setenv(testIdentifier, filepath.Join(tmpDir, "disk.img"))
+		GinkgoT().Setenv(otherIdentifier, filepath.Join(tmpDir, "other.img"))
+		first := standInBlockrsync(blockRsyncPort + 1)
+		second := standInBlockrsync(blockRsyncPort + 2)
+		port, serverDone := startProxyServer("true", []string{testIdentifier, otherIdentifier}, &ProxyOptions{
+			MissingTargetPolicy:   MissingTargetCreate,
+			MaxConcurrentSessions: 1,
+		})
+
+		firstClient := dialProxy(port)
+		_, err := firstClient.Write([]byte(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		Eventually(first).Should(Receive())
+		secondClient := dialProxy(port)
+		_, err = secondClient.Write([]byte(otherIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		By("waiting for the first session to finish")
+		Consistently(second, 200*time.Millisecond).ShouldNot(Receive())
+		firstClient.Close()
+		Eventually(second).Should(Receive())
+		secondClient.Close()
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+	})
+
+	DescribeTable("should relay the summary of the session to the client", func(command string, exitCode int) {
+		GinkgoT().Setenv(testIdentifier, filepath.Join(GinkgoT().TempDir(), "disk.img"))
+		// The blockrsync server sends its data and closes the connection
+		listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(blockRsyncPort+1)))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Write([]byte("hashes"))
+		}()
+		opts := &ProxyOptions{MissingTargetPolicy: MissingTargetCreate, SessionSummary: true}
+		port, serverDone := startProxyServer(command, []string{testIdentifier}, opts)
+
+		free, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		listenPort := free.Addr().(*net.TCPAddr).Port
+		free.Close()
+		client := NewProxyClient(listenPort, port, "localhost", opts, GinkgoLogr.WithName("client"))
+		clientDone := make(chan error, 1)
+		go func() {
+			clientDone <- client.ConnectToTarget(testIdentifier)
+		}()
+		app := dialProxy(listenPort)
+		Expect(app.SetReadDeadline(time.Now().Add(10 * time.Second))).To(Succeed())
+		data := make([]byte, len("hashes"))
+		_, err = io.ReadFull(app, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("hashes"))
+
+		if exitCode == 0 {
+			Eventually(clientDone, 10*time.Second).Should(Receive(BeNil()))
+		} else {
+			Eventually(clientDone, 10*time.Second).Should(Receive(MatchError(ErrSessionFailed)))
+		}
+		Expect(client.Summary()).ToNot(BeNil())
+		Expect(client.Summary().Identifier).To(Equal(testIdentifier))
+		Expect(client.Summary().ExitCode).To(Equal(exitCode))
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+	},
+		Entry("completed", "true", 0),
+		Entry("failed", "false", 1),
+	)
+
+	It("should tunnel from a unix socket to blockrsync servers on unix sockets", func() {
+		tmpDir := GinkgoT().TempDir()
+		GinkgoT().Setenv(testIdentifier, filepath.Join(tmpDir, "disk.img"))
+		serverOpts := &ProxyOptions{MissingTargetPolicy: MissingTargetCreate, SocketDir: tmpDir}
+		child := NewProxyServer("true", 4096, 0, []string{testIdentifier}, serverOpts, GinkgoLogr)
+		Expect(child.blockrsyncArguments("/dev/vdb", testIdentifier, 3223)).To(Equal([]string{
+			"/dev/vdb", "--target", "--listen-socket", filepath.Join(tmpDir, "blockrsync-"+testIdentifier+".sock"),
+			"--zap-log-level", "3", "--block-size", "4096", "--compression", "snappy",
+		}))
+		// The blockrsync server sends its data and closes the connection
+		listener, err := net.Listen("unix", child.childSocket(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _ = conn.Write([]byte("hashes"))
+		}()
+		port, serverDone := startProxyServer("true", []string{testIdentifier}, serverOpts)
+
+		socket := filepath.Join(tmpDir, "proxy.sock")
+		client := NewProxyClient(0, port, "localhost", &ProxyOptions{ListenSocket: socket}, GinkgoLogr.WithName("client"))
+		clientDone := make(chan error, 1)
+		go func() {
+			clientDone <- client.ConnectToTarget(testIdentifier)
+		}()
+		var app net.Conn
+		Eventually(func() (err error) {
+			app, err = net.Dial("unix", socket)
+			return err
+		}).Should(Succeed())
+		defer app.Close()
+		Expect(app.SetReadDeadline(time.Now().Add(10 * time.Second))).To(Succeed())
+		data := make([]byte, len("hashes"))
+		_, err = io.ReadFull(app, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("hashes"))
+		app.Close()
+		Eventually(clientDone, 10*time.Second).Should(Receive(BeNil()))
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+		Expect(socket).ToNot(BeAnExistingFile())
+	})
+
+	It("should collect the stats of the blockrsync servers before it returns", func() {
+		tmpDir := GinkgoT().TempDir()
+		GinkgoT().Setenv(testIdentifier, filepath.Join(tmpDir, "disk.img"))
+		// The blockrsync server writes its stats to the last argument as it
+		// exits, after its client is gone
+		command := filepath.Join(tmpDir, "blockrsync")
+		Expect(os.WriteFile(command, []byte("#!/bin/sh\nsleep 0.5\nfor last; do :; done\necho '{\"sourceSize\":4096}' > \"$last\"\n"), 0755)).To(Succeed())
+		serverOpts := &ProxyOptions{MissingTargetPolicy: MissingTargetCreate, SocketDir: tmpDir}
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		server := NewProxyServer(command, 4096, port, []string{testIdentifier}, serverOpts, GinkgoLogr.WithName("server"))
+		childListener, err := net.Listen("unix", server.childSocket(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(childListener.Close)
+		go func() {
+			conn, err := childListener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}()
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+
+		conn := dialProxy(port)
+		_, err = conn.Write([]byte(testIdentifier))
+		Expect(err).ToNot(HaveOccurred())
+		conn.Close()
+		Eventually(serverDone, 10*time.Second).Should(Receive(BeNil()))
+		Expect(server.ChildStats()).To(HaveKeyWithValue(testIdentifier, MatchJSON(`{"sourceSize":4096}`)))
+	})
+
+	It("should read the data frames and the summary that follows them", func() {
+		_, err := readDataFrames(io.Discard, strings.NewReader(""))
+		Expect(err).To(MatchError(ErrNoSessionSummary))
+		buf := &bytes.Buffer{}
+		Expect(writeDataFrames(buf, strings.NewReader("data"))).To(Succeed())
+		Expect(writeSummary(buf, SessionSummary{Identifier: testIdentifier, Stats: json.RawMessage(`{"sourceSize":4096}`)})).To(Succeed())
+		out := &bytes.Buffer{}
+		summary, err := readDataFrames(out, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(out.String()).To(Equal("data"))
+		Expect(summary.Stats).To(MatchJSON(`{"sourceSize":4096}`))
+	})
+})
+
+// standInBlockrsync stands in for the blockrsync server on the port, and
+// signals every connection it accepts.
+func standInBlockrsync(port int) <-chan struct{} {
+	listener, err := net.Listen("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(listener.Close)
+	accepted := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	return accepted
+}
+
+// startProxyServer starts a proxy server running the command as its
+// blockrsync binary, like true, and returns its port.
+func startProxyServer(command string, identifiers []string, opts *ProxyOptions) (int, <-chan error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	Expect(err).ToNot(HaveOccurred())
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	server := NewProxyServer(command, 4096, port, identifiers, opts, GinkgoLogr.WithName("server"))
+	done := make(chan error, 1)
+	go func() {
+		done <- server.StartServer()
+	}()
+	return port, done
+}
+
+func dialProxy(port int) net.Conn {
+	var conn net.Conn
+	Eventually(func() (err error) {
+		conn, err = net.Dial("tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		return err
+	}).Should(Succeed())
+	DeferCleanup(func() { conn.Close() })
+	return conn
+}
+
+var _ = Describe("proxy server identifier validation", func() {
+	var (
+		tmpDir string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "proxy")
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tmpDir)
+	})
+
+	It("should resolve identifiers through the environment", func() {
+		file := filepath.Join(tmpDir, "disk.img")
+		GinkgoT().Setenv(fmt.Sprintf("id-%s", testIdentifier), file)
+		res, err := resolveIdentifier(testIdentifier)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(res).To(Equal(file))
+		_, err = resolveIdentifier("unknown")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail validation for a missing target by default", func() {
+		GinkgoT().Setenv(testIdentifier, filepath.Join(tmpDir, "missing.img"))
+		server := NewProxyServer("/blockrsync", 4096, 9080, []string{testIdentifier}, &ProxyOptions{}, GinkgoLogr.WithName("server"))
+		Expect(server.validateIdentifiers()).ToNot(Succeed())
+	})
+
+	It("should fail validation for an unmapped identifier", func() {
+		server := NewProxyServer("/blockrsync", 4096, 9080, []string{testIdentifier}, &ProxyOptions{}, GinkgoLogr.WithName("server"))
+		Expect(server.validateIdentifiers()).ToNot(Succeed())
+	})
+
+	It("should create a missing target with the create policy", func() {
+		file := filepath.Join(tmpDir, "sub", "missing.img")
+		GinkgoT().Setenv(testIdentifier, file)
+		server := NewProxyServer("/blockrsync", 4096, 9080, []string{testIdentifier}, &ProxyOptions{
+			MissingTargetPolicy: MissingTargetCreate,
+		}, GinkgoLogr.WithName("server"))
+		Expect(server.validateIdentifiers()).To(Succeed())
+		Expect(file).To(BeARegularFile())
+	})
+})
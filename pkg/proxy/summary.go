@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+const (
+	// frameSummary carries the SessionSummary, it ends the data the server
+	// sends on a tunnel with session summaries
+	frameSummary byte = frameEnd + 1
+	// maxSummaryLength limits the summary received, the stats of the target
+	// include its audit records
+	maxSummaryLength = 16 * 1024 * 1024
+)
+
+var (
+	ErrNoSessionSummary = errors.New("tunnel closed before the session summary was received")
+	ErrSessionFailed    = errors.New("blockrsync server failed")
+)
+
+// SessionSummary is the final status of the blockrsync server of a session,
+// relayed to the client before the tunnel closes.
+type SessionSummary struct {
+	Identifier string `json:"identifier"`
+	// ExitCode of the blockrsync server, -1 if it didn't run
+	ExitCode int    `json:"exitCode"`
+	Error    string `json:"error,omitempty"`
+	// Stats are the stats the blockrsync server reported, if any
+	Stats json.RawMessage `json:"stats,omitempty"`
+}
+
+func exitCode(err error) int {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// writeDataFrames copies src to w as data frames until the end of src.
+func writeDataFrames(w io.Writer, src io.Reader) error {
+	buf := make([]byte, frameHeaderLength+maxFramePayload)
+	buf[0] = frameData
+	for {
+		n, err := src.Read(buf[frameHeaderLength:])
+		if n > 0 {
+			binary.LittleEndian.PutUint32(buf[1:frameHeaderLength], uint32(n))
+			if _, werr := w.Write(buf[:frameHeaderLength+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeSummary(w io.Writer, summary SessionSummary) error {
+	payload, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, frameHeaderLength, frameHeaderLength+len(payload))
+	frame[0] = frameSummary
+	binary.LittleEndian.PutUint32(frame[1:], uint32(len(payload)))
+	_, err = w.Write(append(frame, payload...))
+	return err
+}
+
+// readDataFrames copies the data frames of r to w, and returns the summary
+// that follows them.
+func readDataFrames(w io.Writer, r io.Reader) (*SessionSummary, error) {
+	header := make([]byte, frameHeaderLength)
+	payload := make([]byte, maxFramePayload)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil, ErrNoSessionSummary
+			}
+			return nil, err
+		}
+		length := binary.LittleEndian.Uint32(header[1:])
+		switch header[0] {
+		case frameData:
+			if length > maxFramePayload {
+				return nil, fmt.Errorf("invalid frame length %d", length)
+			}
+			if _, err := io.ReadFull(r, payload[:length]); err != nil {
+				return nil, err
+			}
+			if _, err := w.Write(payload[:length]); err != nil {
+				return nil, err
+			}
+		case frameSummary:
+			if length > maxSummaryLength {
+				return nil, fmt.Errorf("session summary of %d bytes exceeds the maximum of %d", length, maxSummaryLength)
+			}
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+			summary := &SessionSummary{}
+			if err := json.Unmarshal(data, summary); err != nil {
+				return nil, fmt.Errorf("invalid session summary: %w", err)
+			}
+			return summary, nil
+		default:
+			return nil, fmt.Errorf("invalid frame type %d", header[0])
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultServerName is the server name of the TLS route for clients that
+	// asked for no server name, or one without a route
+	DefaultServerName   = "*"
+	tlsHandshakeTimeout = 30 * time.Second
+
+	// TLSPolicyRequire fails the connection if the TLS handshake fails
+	TLSPolicyRequire = "require"
+	// TLSPolicyPrefer connects in plaintext to a target that doesn't speak
+	// TLS, like an older proxy server without TLS routes
+	TLSPolicyPrefer = "prefer"
+	// TLSPolicyDisable never connects with TLS
+	TLSPolicyDisable = "disable"
+)
+
+var (
+	ErrIdentifierNotRouted = errors.New("identifier can't be synced through the TLS server name")
+	ErrIdentityMismatch    = errors.New("client certificate doesn't name the identifier")
+)
+
+// TLSRoute is a server name the proxy server answers TLS connections for,
+// with the certificate it presents to the clients that ask for it and the
+// identifiers they can sync.
+type TLSRoute struct {
+	ServerName  string
+	Certificate tls.Certificate
+	// Files the certificate is loaded from again when the server reloads its
+	// credentials, the certificate is not reloaded if empty
+	CertFile string
+	KeyFile  string
+	// Identifiers that can be synced through the route, all identifiers of
+	// the server when empty
+	Identifiers []string
+}
+
+func (r *TLSRoute) allows(identifier string) bool {
+	return len(r.Identifiers) == 0 || slices.Contains(r.Identifiers, identifier)
+}
+
+// tlsRouter terminates TLS on the connections of the proxy server, and picks
+// the route by the server name the client asked for.
+type tlsRouter struct {
+	routes map[string]*TLSRoute
+	config *tls.Config
+	// Protects the certificates of the routes
+	mu sync.RWMutex
+	// Serializes the reloads, and the hashes of the files the certificates
+	// were last reloaded from
+	reloadMu     sync.Mutex
+	fingerprints map[*TLSRoute][sha256.Size]byte
+}
+
+// newTLSRouter returns an error if two routes have the same server name, or
+// a route has an identifier the server doesn't sync.
+func newTLSRouter(routes []TLSRoute, identifiers []string) (*tlsRouter, error) {
+	r := &tlsRouter{
+		routes:       make(map[string]*TLSRoute, len(routes)),
+		fingerprints: make(map[*TLSRoute][sha256.Size]byte),
+	}
+	for i := range routes {
+		route := &routes[i]
+		if route.ServerName == "" {
+			return nil, errors.New("a TLS route needs a server name")
+		}
+		if _, ok := r.routes[route.ServerName]; ok {
+			return nil, fmt.Errorf("duplicate TLS route for server name %s", route.ServerName)
+		}
+		for _, identifier := range route.Identifiers {
+			if !slices.Contains(identifiers, identifier) {
+				return nil, fmt.Errorf("TLS route %s has identifier %s the server doesn't sync", route.ServerName, identifier)
+			}
+		}
+		r.routes[route.ServerName] = route
+	}
+	r.config = &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			route, err := r.route(hello.ServerName)
+			if err != nil {
+				return nil, err
+			}
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			certificate := route.Certificate
+			return &certificate, nil
+		},
+	}
+	return r, nil
+}
+
+// reload loads the certificates of the routes that changed in their files,
+// and only replaces them if all loaded. Established connections keep the
+// certificate they were accepted with.
+func (r *tlsRouter) reload() (int, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+	certificates := make(map[*TLSRoute]tls.Certificate)
+	fingerprints := make(map[*TLSRoute][sha256.Size]byte)
+	for _, route := range r.routes {
+		if route.CertFile == "" || route.KeyFile == "" {
+			continue
+		}
+		certPEM, err := os.ReadFile(route.CertFile)
+		if err != nil {
+			return 0, fmt.Errorf("unable to reload the certificate of server name %s: %w", route.ServerName, err)
+		}
+		keyPEM, err := os.ReadFile(route.KeyFile)
+		if err != nil {
+			return 0, fmt.Errorf("unable to reload the certificate of server name %s: %w", route.ServerName, err)
+		}
+		fingerprint := sha256.Sum256(append(certPEM, keyPEM...))
+		if r.fingerprints[route] == fingerprint {
+			continue
+		}
+		certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return 0, fmt.Errorf("unable to reload the certificate of server name %s: %w", route.ServerName, err)
+		}
+		certificates[route] = certificate
+		fingerprints[route] = fingerprint
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for route, certificate := range certificates {
+		route.Certificate = certificate
+	}
+	maps.Copy(r.fingerprints, fingerprints)
+	return len(certificates), nil
+}
+
+func (r *tlsRouter) route(serverName string) (*TLSRoute, error) {
+	if route, ok := r.routes[serverName]; ok {
+		return route, nil
+	}
+	if route, ok := r.routes[DefaultServerName]; ok {
+		return route, nil
+	}
+	return nil, fmt.Errorf("no TLS route for server name %q", serverName)
+}
+
+// accept completes the TLS handshake of the connection, and returns the
+// route the client asked for.
+func (r *tlsRouter) accept(conn net.Conn) (net.Conn, *TLSRoute, error) {
+	tlsConn := tls.Server(conn, r.config)
+	if err := conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout)); err != nil {
+		return nil, nil, err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, nil, err
+	}
+	route, err := r.route(tlsConn.ConnectionState().ServerName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsConn, route, nil
+}
+
+// verifyClients requires the clients to present a certificate the CAs
+// verify.
+func (r *tlsRouter) verifyClients(clientCAs *x509.CertPool) {
+	r.config.ClientAuth = tls.RequireAndVerifyClientCert
+	r.config.ClientCAs = clientCAs
+}
+
+// verifyIdentity returns ErrIdentityMismatch unless the common name or a DNS
+// name of the verified client certificate of the connection is the
+// identifier, so a client can only sync the disk it was issued a certificate
+// for.
+func verifyIdentity(conn net.Conn, identifier string) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ErrIdentityMismatch
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return ErrIdentityMismatch
+	}
+	certificate := chains[0][0]
+	if certificate.Subject.CommonName == identifier || slices.Contains(certificate.DNSNames, identifier) {
+		return nil
+	}
+	return ErrIdentityMismatch
+}
+
+// ValidTLSPolicy returns an error if the policy is not one of the TLS
+// policies, empty is TLSPolicyRequire.
+func ValidTLSPolicy(policy string) error {
+	switch policy {
+	case "", TLSPolicyRequire, TLSPolicyPrefer, TLSPolicyDisable:
+		return nil
+	}
+	return fmt.Errorf("tls policy must be %s, %s or %s", TLSPolicyRequire, TLSPolicyPrefer, TLSPolicyDisable)
+}
+
+// plaintextPeer returns true if the handshake failed because the peer doesn't
+// speak TLS, it hung up on the client hello or answered something else. A
+// peer that refused the handshake with an alert, or a certificate that didn't
+// verify, is not a plaintext peer.
+func plaintextPeer(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.As(err, &recordErr)
+}
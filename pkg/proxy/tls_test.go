@@ -0,0 +1,393 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// selfSignedCertificate returns a certificate for the name that is its own CA.
+func selfSignedCertificate(name string) tls.Certificate {
+	return selfSignedCertificateFor(name, x509.ExtKeyUsageServerAuth)
+}
+
+// selfSignedCertificateFor returns a self-signed certificate for the name and
+// the usage.
+func selfSignedCertificateFor(name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	leaf, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCertificate writes the certificate and its key as PEM files in dir.
+func writeCertificate(dir string, cert tls.Certificate) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)).To(Succeed())
+	Expect(os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600)).To(Succeed())
+	return certFile, keyFile
+}
+
+var _ = Describe("TLS routing tests", func() {
+	var (
+		routes []TLSRoute
+		roots  *x509.CertPool
+	)
+
+	BeforeEach(func() {
+		routes = []TLSRoute{
+			{ServerName: "a.example", Certificate: selfSignedCertificate("a.example"), Identifiers: []string{"disk-a"}},
+			{ServerName: "b.example", Certificate: selfSignedCertificate("b.example")},
+			{ServerName: DefaultServerName, Certificate: selfSignedCertificate("default.example"), Identifiers: []string{"disk-c"}},
+		}
+		roots = x509.NewCertPool()
+		for _, route := range routes {
+			roots.AddCert(route.Certificate.Leaf)
+		}
+	})
+
+	// handshake connects with the server name and returns the route the
+	// server picked and the name of the certificate the client verified.
+	handshake := func(router *tlsRouter, serverName string) (*TLSRoute, string, error) {
+		client, server := tcpPair()
+		verified := make(chan string, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn := tls.Client(client, &tls.Config{ServerName: serverName, RootCAs: roots, InsecureSkipVerify: true})
+			if conn.Handshake() != nil {
+				close(verified)
+				return
+			}
+			cert := conn.ConnectionState().PeerCertificates[0]
+			_, err := cert.Verify(x509.VerifyOptions{DNSName: cert.Subject.CommonName, Roots: roots})
+			Expect(err).ToNot(HaveOccurred())
+			verified <- cert.Subject.CommonName
+		}()
+		_, route, err := router.accept(server)
+		return route, <-verified, err
+	}
+
+	It("should present the certificate of the server name", func() {
+		router, err := newTLSRouter(routes, []string{"disk-a", "disk-b", "disk-c"})
+		Expect(err).ToNot(HaveOccurred())
+		route, name, err := handshake(router, "a.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(route.ServerName).To(Equal("a.example"))
+		Expect(name).To(Equal("a.example"))
+		route, name, err = handshake(router, "b.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(route.ServerName).To(Equal("b.example"))
+		Expect(name).To(Equal("b.example"))
+	})
+
+	It("should use the default route for an unknown or missing server name", func() {
+		router, err := newTLSRouter(routes, []string{"disk-a", "disk-b", "disk-c"})
+		Expect(err).ToNot(HaveOccurred())
+		route, name, err := handshake(router, "other.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(route.ServerName).To(Equal(DefaultServerName))
+		Expect(name).To(Equal("default.example"))
+		route, _, err = handshake(router, "")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(route.ServerName).To(Equal(DefaultServerName))
+	})
+
+	It("should refuse a server name without a route", func() {
+		router, err := newTLSRouter(routes[:2], []string{"disk-a", "disk-b"})
+		Expect(err).ToNot(HaveOccurred())
+		_, _, err = handshake(router, "other.example")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should limit a route to its identifiers", func() {
+		Expect(routes[0].allows("disk-a")).To(BeTrue())
+		Expect(routes[0].allows("disk-b")).To(BeFalse())
+		Expect(routes[1].allows("disk-a")).To(BeTrue())
+		Expect(routes[1].allows("disk-b")).To(BeTrue())
+	})
+
+	It("should reject invalid routes", func() {
+		_, err := newTLSRouter(routes, []string{"disk-a", "disk-b"})
+		Expect(err).To(MatchError(ContainSubstring("disk-c")))
+		_, err = newTLSRouter(append(routes, routes[1]), []string{"disk-a", "disk-b", "disk-c"})
+		Expect(err).To(MatchError(ContainSubstring("duplicate")))
+		_, err = newTLSRouter([]TLSRoute{{}}, nil)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should present reloaded certificates to new connections", func() {
+		certFile, keyFile := writeCertificate(GinkgoT().TempDir(), routes[0].Certificate)
+		routes[0].CertFile, routes[0].KeyFile = certFile, keyFile
+		router, err := newTLSRouter(routes, []string{"disk-a", "disk-b", "disk-c"})
+		Expect(err).ToNot(HaveOccurred())
+		rotated := selfSignedCertificate("rotated.example")
+		roots.AddCert(rotated.Leaf)
+		writeCertificate(filepath.Dir(certFile), rotated)
+		reloaded, err := router.reload()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reloaded).To(Equal(1))
+		Expect(router.reload()).To(Equal(0))
+		_, name, err := handshake(router, "a.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("rotated.example"))
+		_, name, err = handshake(router, "b.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("b.example"))
+	})
+
+	It("should keep the certificates if one fails to reload", func() {
+		certFile, keyFile := writeCertificate(GinkgoT().TempDir(), routes[0].Certificate)
+		routes[0].CertFile, routes[0].KeyFile = certFile, keyFile
+		routes[1].CertFile, routes[1].KeyFile = certFile, filepath.Join(filepath.Dir(certFile), "missing.key")
+		router, err := newTLSRouter(routes, []string{"disk-a", "disk-b", "disk-c"})
+		Expect(err).ToNot(HaveOccurred())
+		writeCertificate(filepath.Dir(certFile), selfSignedCertificate("rotated.example"))
+		_, err = router.reload()
+		Expect(err).To(MatchError(ContainSubstring("b.example")))
+		_, name, err := handshake(router, "a.example")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(name).To(Equal("a.example"))
+	})
+})
+
+var _ = Describe("TLS policy tests", func() {
+	const identifier = "0123456789abcdef0123456789abcdef"
+
+	// oldServer accepts connections like a proxy server without TLS routes,
+	// and returns the identifiers it received.
+	oldServer := func() (int, chan string) {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		received := make(chan string, 4)
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				header := make([]byte, identifierLength)
+				if _, err := io.ReadFull(conn, header); err == nil {
+					received <- string(header)
+				}
+				conn.Close()
+			}
+		}()
+		return listener.Addr().(*net.TCPAddr).Port, received
+	}
+
+	dial := func(port int, policy string) (net.Conn, error) {
+		client := NewProxyClient(0, port, "localhost", &ProxyOptions{
+			TLSConfig: &tls.Config{ServerName: "target.example", MinVersion: tls.VersionTLS12},
+			TLSPolicy: policy,
+		}, GinkgoLogr)
+		return client.dialTarget(nil, identifier)
+	}
+
+	It("should fall back to plaintext with the prefer policy", func() {
+		port, received := oldServer()
+		conn, err := dial(port, TLSPolicyPrefer)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(<-received).ToNot(Equal(identifier))
+		Expect(<-received).To(Equal(identifier))
+	})
+
+	It("should not fall back to plaintext with the require policy", func() {
+		port, received := oldServer()
+		_, err := dial(port, "")
+		Expect(err).To(HaveOccurred())
+		_, err = dial(port, TLSPolicyRequire)
+		Expect(err).To(HaveOccurred())
+		Eventually(received).Should(HaveLen(2))
+		Expect(<-received).ToNot(Equal(identifier))
+	})
+
+	It("should connect in plaintext with the disable policy", func() {
+		port, received := oldServer()
+		conn, err := dial(port, TLSPolicyDisable)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(<-received).To(Equal(identifier))
+	})
+
+	It("should not fall back to plaintext when the certificate doesn't verify", func() {
+		router, err := newTLSRouter([]TLSRoute{{ServerName: DefaultServerName, Certificate: selfSignedCertificate("target.example")}}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		accepted := make(chan error, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, _, err = router.accept(conn)
+			accepted <- err
+		}()
+		_, err = dial(listener.Addr().(*net.TCPAddr).Port, TLSPolicyPrefer)
+		Expect(err).To(HaveOccurred())
+		Expect(plaintextPeer(err)).To(BeFalse())
+		Expect(<-accepted).To(HaveOccurred())
+	})
+
+	It("should validate the policy", func() {
+		Expect(ValidTLSPolicy("")).To(Succeed())
+		Expect(ValidTLSPolicy(TLSPolicyPrefer)).To(Succeed())
+		Expect(ValidTLSPolicy("allow")).To(MatchError(ContainSubstring("require")))
+	})
+})
+
+var _ = Describe("multiple listener tests", func() {
+	It("should pick the TLS routes of every listener", func() {
+		server := NewProxyServer("", 4096, 0, []string{"disk-a"}, &ProxyOptions{
+			TLSRoutes: []TLSRoute{{ServerName: DefaultServerName, Certificate: selfSignedCertificate("target.example")}},
+			Listeners: []ProxyListener{
+				{Address: "10.0.0.1:9080", Plaintext: true},
+				{Address: "10.0.1.1:9080", TLSRoutes: []TLSRoute{{ServerName: DefaultServerName, Certificate: selfSignedCertificate("migration.example")}}},
+				{Address: "10.0.2.1:9080"},
+			},
+		}, GinkgoLogr)
+		routers, err := server.tlsRouters()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routers).To(HaveLen(4))
+		Expect(routers[0]).ToNot(BeNil())
+		Expect(routers[1]).To(BeNil())
+		Expect(routers[2]).ToNot(BeNil())
+		Expect(routers[2]).ToNot(BeIdenticalTo(routers[0]))
+		Expect(routers[3]).To(BeIdenticalTo(routers[0]))
+		Expect(routers[2].routes[DefaultServerName].Certificate.Leaf.Subject.CommonName).To(Equal("migration.example"))
+	})
+
+	It("should send the identifier on one path only", func() {
+		const identifier = "0123456789abcdef0123456789abcdef"
+		received := make(chan string, 4)
+		var addresses []string
+		for i := 0; i < 2; i++ {
+			listener, err := net.Listen("tcp", "localhost:0")
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(listener.Close)
+			addresses = append(addresses, listener.Addr().String())
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				header := make([]byte, identifierLength)
+				if _, err := io.ReadFull(conn, header); err == nil {
+					received <- string(header)
+				}
+			}()
+		}
+		_, port, err := net.SplitHostPort(addresses[0])
+		Expect(err).ToNot(HaveOccurred())
+		targetPort, err := strconv.Atoi(port)
+		Expect(err).ToNot(HaveOccurred())
+		client := NewProxyClient(0, targetPort, "localhost", &ProxyOptions{AlternateTargets: addresses[1:]}, GinkgoLogr)
+		conn, err := client.dialTarget(nil, identifier)
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Eventually(received).Should(Receive(Equal(identifier)))
+		Consistently(received, 100*time.Millisecond).ShouldNot(Receive())
+	})
+})
+
+var _ = Describe("client identity tests", func() {
+	const identifier = "0123456789abcdef0123456789abcdef"
+	var (
+		router    *tlsRouter
+		clientCAs *x509.CertPool
+	)
+
+	BeforeEach(func() {
+		var err error
+		router, err = newTLSRouter([]TLSRoute{{ServerName: DefaultServerName, Certificate: selfSignedCertificate("target.example")}}, []string{identifier})
+		Expect(err).ToNot(HaveOccurred())
+		clientCAs = x509.NewCertPool()
+		router.verifyClients(clientCAs)
+	})
+
+	// accept returns the connection the router accepted from a client with
+	// the certificates.
+	accept := func(certificates ...tls.Certificate) (net.Conn, error) {
+		client, server := tcpPair()
+		go func() {
+			conn := tls.Client(client, &tls.Config{InsecureSkipVerify: true, Certificates: certificates})
+			_ = conn.Handshake()
+			// The server verifies the certificate once the client finished
+			_, _ = conn.Read(make([]byte, 1))
+		}()
+		conn, _, err := router.accept(server)
+		return conn, err
+	}
+
+	It("should accept the identifier of the client certificate", func() {
+		for _, name := range []string{identifier, "disk.example"} {
+			certificate := selfSignedCertificateFor(name, x509.ExtKeyUsageClientAuth)
+			clientCAs.AddCert(certificate.Leaf)
+			conn, err := accept(certificate)
+			Expect(err).ToNot(HaveOccurred())
+			if name == identifier {
+				Expect(verifyIdentity(conn, identifier)).To(Succeed())
+			} else {
+				Expect(verifyIdentity(conn, identifier)).To(MatchError(ErrIdentityMismatch))
+			}
+		}
+	})
+
+	It("should refuse clients without a verified certificate", func() {
+		_, err := accept()
+		Expect(err).To(HaveOccurred())
+		_, err = accept(selfSignedCertificateFor(identifier, x509.ExtKeyUsageClientAuth))
+		Expect(err).To(HaveOccurred())
+		client, _ := tcpPair()
+		Expect(verifyIdentity(client, identifier)).To(MatchError(ErrIdentityMismatch))
+	})
+
+	It("should need TLS routes on every listener", func() {
+		server := NewProxyServer("", 4096, 9080, []string{identifier}, &ProxyOptions{
+			TLSRoutes: []TLSRoute{{ServerName: DefaultServerName, Certificate: selfSignedCertificate("target.example")}},
+			Listeners: []ProxyListener{{Address: "10.0.0.1:9080", Plaintext: true}},
+			ClientCAs: clientCAs,
+		}, GinkgoLogr)
+		_, err := server.tlsRouters()
+		Expect(err).To(MatchError(ContainSubstring("10.0.0.1:9080")))
+		server.opts.Listeners = nil
+		routers, err := server.tlsRouters()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(routers[0].config.ClientAuth).To(Equal(tls.RequireAndVerifyClientCert))
+	})
+})
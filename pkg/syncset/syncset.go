@@ -0,0 +1,388 @@
+package syncset
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	DefaultProgressInterval = 10 * time.Second
+)
+
+// Disk is one source device of a set and the target it is synced to.
+type Disk struct {
+	Name          string `json:"name"`
+	Source        string `json:"source"`
+	TargetAddress string `json:"targetAddress"`
+	Port          int    `json:"port"`
+	// Weight is the share of the set bandwidth limit the disk gets while it
+	// syncs, relative to the other disks. The default is 1
+	Weight int `json:"weight,omitempty"`
+	// BandwidthLimit caps the bytes per second sent for the disk
+	BandwidthLimit int64 `json:"bandwidthLimit,omitempty"`
+	// ReadLimit caps the bytes per second read from the source
+	ReadLimit int64 `json:"readLimit,omitempty"`
+}
+
+func (d *Disk) weight() int {
+	if d.Weight == 0 {
+		return 1
+	}
+	return d.Weight
+}
+
+// Manifest lists the disks synced together, for instance all the disks of a
+// virtual machine.
+type Manifest struct {
+	Disks []Disk `json:"disks"`
+}
+
+func LoadManifest(fileName string) (*Manifest, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", fileName, err)
+	}
+	if err := manifest.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", fileName, err)
+	}
+	return manifest, nil
+}
+
+func (m *Manifest) Validate() error {
+	if len(m.Disks) == 0 {
+		return errors.New("no disks")
+	}
+	names := make(map[string]bool)
+	for i, disk := range m.Disks {
+		if disk.Name == "" || strings.ContainsAny(disk.Name, "/ ") {
+			return fmt.Errorf("disk %d has an invalid name %q", i, disk.Name)
+		}
+		if names[disk.Name] {
+			return fmt.Errorf("duplicate disk name %q", disk.Name)
+		}
+		names[disk.Name] = true
+		if disk.Source == "" || disk.TargetAddress == "" {
+			return fmt.Errorf("disk %s must have a source and a target address", disk.Name)
+		}
+		if disk.Port <= 0 || disk.Port > 65535 {
+			return fmt.Errorf("disk %s has an invalid port %d", disk.Name, disk.Port)
+		}
+		if disk.Weight < 0 || disk.BandwidthLimit < 0 || disk.ReadLimit < 0 {
+			return fmt.Errorf("disk %s must not have a negative weight or limit", disk.Name)
+		}
+	}
+	return nil
+}
+
+type Options struct {
+	// BandwidthLimit is the bytes per second shared by all the disks, 0 is
+	// unlimited. It is split between the disks that are still syncing by
+	// their weights
+	BandwidthLimit int64
+	// ProgressInterval is how often the combined progress is logged
+	ProgressInterval time.Duration
+}
+
+type DiskResult struct {
+	Name  string            `json:"name"`
+	Stats *blockrsync.Stats `json:"stats"`
+	Error string            `json:"error,omitempty"`
+	err   error
+}
+
+type Result struct {
+	Disks []*DiskResult `json:"disks"`
+}
+
+func (r *Result) WriteFile(fileName string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// Summary describes the sync of the set on a single line.
+func (r *Result) Summary() string {
+	var synced, blocks, holes, bytes int64
+	for _, disk := range r.Disks {
+		if disk.Error == "" {
+			synced++
+		}
+		disk.Stats.Update(func(stats *blockrsync.Stats) {
+			blocks += stats.BlocksTransferred
+			holes += stats.HolesTransferred
+			bytes += stats.BytesTransferred
+		})
+	}
+	return fmt.Sprintf("%d of %d disks synced, %d blocks and %d holes transferred, %d bytes sent", synced, len(r.Disks), blocks, holes, bytes)
+}
+
+// SetError is returned when at least one disk did not sync, the set is only
+// complete when every disk synced.
+type SetError struct {
+	Failed []*DiskResult
+}
+
+func (e *SetError) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for _, disk := range e.Failed {
+		failed = append(failed, fmt.Sprintf("%s: %v", disk.Name, disk.err))
+	}
+	return fmt.Sprintf("%d disks did not sync: %s", len(e.Failed), strings.Join(failed, ", "))
+}
+
+func (e *SetError) Unwrap() []error {
+	res := make([]error, 0, len(e.Failed))
+	for _, disk := range e.Failed {
+		res = append(res, disk.err)
+	}
+	return res
+}
+
+// BudgetExhausted returns true if every failed disk stopped because of its
+// transfer budget, so running the set again continues the sync.
+func (e *SetError) BudgetExhausted() bool {
+	for _, disk := range e.Failed {
+		if !errors.Is(disk.err, blockrsync.ErrBudgetExhausted) {
+			return false
+		}
+	}
+	return true
+}
+
+type SyncSet struct {
+	manifest *Manifest
+	opts     *blockrsync.BlockRsyncOptions
+	setOpts  Options
+	log      logr.Logger
+}
+
+// NewSyncSet creates a set that syncs every disk of the manifest with a copy
+// of opts. A checkpoint file is suffixed with the disk name.
+func NewSyncSet(manifest *Manifest, opts *blockrsync.BlockRsyncOptions, setOpts Options, logger logr.Logger) *SyncSet {
+	if setOpts.ProgressInterval <= 0 {
+		setOpts.ProgressInterval = DefaultProgressInterval
+	}
+	return &SyncSet{
+		manifest: manifest,
+		opts:     opts,
+		setOpts:  setOpts,
+		log:      logger,
+	}
+}
+
+// Run syncs all the disks in parallel. If a disk fails the other disks are
+// cancelled, a disk that exhausted its budget does not cancel the others.
+func (s *SyncSet) Run(ctx context.Context) (*Result, error) {
+	if s.opts.Cutover != nil {
+		return nil, errors.New("cutover is not supported with a sync set")
+	}
+	if err := s.manifest.Validate(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	shares := newBandwidthShares(s.setOpts.BandwidthLimit, s.manifest.Disks)
+	result := &Result{}
+	clients := make([]*blockrsync.BlockrsyncClient, 0, len(s.manifest.Disks))
+	for i, disk := range s.manifest.Disks {
+		opts := *s.opts
+		var diskLimiter *transport.Limiter
+		if disk.BandwidthLimit > 0 {
+			diskLimiter = transport.NewLimiter(disk.BandwidthLimit)
+		}
+		opts.Transport = &cancelTransport{
+			ctx:  ctx,
+			base: transport.Wrap(transport.OrDefault(s.opts.Transport), transport.RateLimit(shares.limiter(i), diskLimiter)),
+		}
+		if opts.CheckpointFile != "" {
+			opts.CheckpointFile = opts.CheckpointFile + "." + disk.Name
+		}
+		if opts.SavingsFile != "" {
+			opts.SavingsFile = opts.SavingsFile + "." + disk.Name
+		}
+		if opts.DiffFile != "" {
+			opts.DiffFile = opts.DiffFile + "." + disk.Name
+		}
+		if disk.ReadLimit > 0 {
+			opts.ReadLimit = disk.ReadLimit
+		}
+		client := blockrsync.NewBlockrsyncClient(disk.Source, disk.TargetAddress, disk.Port, &opts, s.log.WithName(disk.Name))
+		clients = append(clients, client)
+		result.Disks = append(result.Disks, &DiskResult{Name: disk.Name, Stats: client.Stats()})
+	}
+
+	progressDone := make(chan struct{})
+	go s.logProgress(result, progressDone)
+	defer close(progressDone)
+
+	wg := sync.WaitGroup{}
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *blockrsync.BlockrsyncClient, disk *DiskResult) {
+			defer wg.Done()
+			err := client.ConnectToTarget()
+			// Give the bandwidth of the disk to the ones still syncing
+			shares.done(i)
+			if err != nil && ctx.Err() != nil && !errors.Is(err, blockrsync.ErrBudgetExhausted) {
+				err = fmt.Errorf("cancelled: %w", err)
+			}
+			disk.err = err
+			if err == nil {
+				s.log.Info("Disk synced", "disk", disk.Name)
+				return
+			}
+			disk.Error = err.Error()
+			if !errors.Is(err, blockrsync.ErrBudgetExhausted) && ctx.Err() == nil {
+				s.log.Error(err, "Disk failed, cancelling the other disks", "disk", disk.Name)
+				cancel()
+			}
+		}(i, client, result.Disks[i])
+	}
+	wg.Wait()
+
+	setErr := &SetError{}
+	for _, disk := range result.Disks {
+		if disk.err != nil {
+			setErr.Failed = append(setErr.Failed, disk)
+		}
+	}
+	if len(setErr.Failed) > 0 {
+		return result, setErr
+	}
+	return result, nil
+}
+
+func (s *SyncSet) logProgress(result *Result, done <-chan struct{}) {
+	ticker := time.NewTicker(s.setOpts.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		var bytes, sent, different int64
+		for _, disk := range result.Disks {
+			disk.Stats.Update(func(stats *blockrsync.Stats) {
+				bytes += stats.BytesTransferred
+				sent += stats.BlocksTransferred + stats.HolesTransferred
+				different += stats.DifferentBlocks
+			})
+		}
+		s.log.Info("Sync set progress", "disks", len(result.Disks), "bytes", bytes, "blocks", sent, "different blocks", different)
+	}
+}
+
+// bandwidthShares splits a bandwidth limit between the disks that are still
+// syncing, in proportion to their weights.
+type bandwidthShares struct {
+	mu       sync.Mutex
+	total    int64
+	weights  []int
+	active   []bool
+	limiters []*transport.Limiter
+}
+
+// newBandwidthShares returns shares with nil limiters if total is 0.
+func newBandwidthShares(total int64, disks []Disk) *bandwidthShares {
+	s := &bandwidthShares{
+		total:    total,
+		weights:  make([]int, len(disks)),
+		active:   make([]bool, len(disks)),
+		limiters: make([]*transport.Limiter, len(disks)),
+	}
+	for i := range disks {
+		s.weights[i] = disks[i].weight()
+		s.active[i] = true
+		if total > 0 {
+			s.limiters[i] = transport.NewLimiter(total)
+		}
+	}
+	s.rebalance()
+	return s
+}
+
+func (s *bandwidthShares) limiter(i int) *transport.Limiter {
+	return s.limiters[i]
+}
+
+func (s *bandwidthShares) done(i int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[i] = false
+	s.rebalance()
+}
+
+// rebalance must be called with mu held, or before the shares are used.
+func (s *bandwidthShares) rebalance() {
+	if s.total <= 0 {
+		return
+	}
+	totalWeight := 0
+	for i, weight := range s.weights {
+		if s.active[i] {
+			totalWeight += weight
+		}
+	}
+	for i, weight := range s.weights {
+		if s.active[i] {
+			s.limiters[i].SetRate(max(1, s.total*int64(weight)/int64(totalWeight)))
+		}
+	}
+}
+
+// cancelTransport closes its connections when the context is cancelled, and
+// refuses new ones.
+type cancelTransport struct {
+	ctx  context.Context
+	base transport.Transport
+}
+
+func (c *cancelTransport) Dial(address string) (net.Conn, error) {
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := c.base.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(c.ctx, func() { conn.Close() })
+	return &cancelConn{Conn: conn, stop: stop}, nil
+}
+
+func (c *cancelTransport) Listen(address string) (net.Listener, error) {
+	return c.base.Listen(address)
+}
+
+type cancelConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *cancelConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *cancelConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,13 @@
+package syncset
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestSyncSet(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "syncset Suite")
+}
@@ -0,0 +1,202 @@
+package syncset
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+)
+
+var _ = Describe("manifest tests", func() {
+	DescribeTable("should validate the manifest", func(disks []Disk, expected string) {
+		err := (&Manifest{Disks: disks}).Validate()
+		if expected == "" {
+			Expect(err).ToNot(HaveOccurred())
+		} else {
+			Expect(err).To(MatchError(ContainSubstring(expected)))
+		}
+	},
+		Entry("valid", []Disk{{Name: "a", Source: "/dev/a", TargetAddress: "host", Port: 8000}, {Name: "b", Source: "/dev/b", TargetAddress: "host", Port: 8001}}, ""),
+		Entry("no disks", nil, "no disks"),
+		Entry("missing name", []Disk{{Source: "/dev/a", TargetAddress: "host", Port: 8000}}, "invalid name"),
+		Entry("duplicate name", []Disk{{Name: "a", Source: "/dev/a", TargetAddress: "host", Port: 8000}, {Name: "a", Source: "/dev/b", TargetAddress: "host", Port: 8001}}, "duplicate"),
+		Entry("missing target", []Disk{{Name: "a", Source: "/dev/a", Port: 8000}}, "target address"),
+		Entry("invalid port", []Disk{{Name: "a", Source: "/dev/a", TargetAddress: "host"}}, "invalid port"),
+		Entry("negative weight", []Disk{{Name: "a", Source: "/dev/a", TargetAddress: "host", Port: 8000, Weight: -1}}, "negative"),
+	)
+
+	It("should load a manifest file", func() {
+		tmpDir := GinkgoT().TempDir()
+		fileName := filepath.Join(tmpDir, "manifest.json")
+		Expect(os.WriteFile(fileName, []byte(`{"disks": [{"name": "root", "source": "/dev/vda", "targetAddress": "host", "port": 8000}]}`), 0644)).To(Succeed())
+		manifest, err := LoadManifest(fileName)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(manifest.Disks).To(Equal([]Disk{{Name: "root", Source: "/dev/vda", TargetAddress: "host", Port: 8000}}))
+	})
+})
+
+var _ = Describe("sync set tests", func() {
+	var (
+		tmpDir string
+		opts   blockrsync.BlockRsyncOptions
+	)
+
+	BeforeEach(func() {
+		tmpDir = GinkgoT().TempDir()
+		opts = blockrsync.BlockRsyncOptions{
+			BlockSize: 4096,
+		}
+	})
+
+	startServer := func(name string) (Disk, <-chan error) {
+		source := filepath.Join(tmpDir, name+".src")
+		data := make([]byte, 16*4096)
+		_, _ = rand.Read(data)
+		Expect(os.WriteFile(source, data, 0644)).To(Succeed())
+		port, err := getFreePort()
+		Expect(err).ToNot(HaveOccurred())
+		server := blockrsync.NewBlockrsyncServer(filepath.Join(tmpDir, name+".dst"), port, &opts, GinkgoLogr.WithName(name+"-server"))
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		return Disk{Name: name, Source: source, TargetAddress: "localhost", Port: port}, serverDone
+	}
+
+	expectSynced := func(name string) {
+		source, err := os.ReadFile(filepath.Join(tmpDir, name+".src"))
+		Expect(err).ToNot(HaveOccurred())
+		target, err := os.ReadFile(filepath.Join(tmpDir, name+".dst"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(target).To(Equal(source))
+	}
+
+	It("should sync all the disks with a shared bandwidth limit", func() {
+		a, aDone := startServer("a")
+		b, bDone := startServer("b")
+		a.Weight = 3
+		b.BandwidthLimit = 512 * 1024
+		b.ReadLimit = 1024 * 1024
+		manifest := &Manifest{Disks: []Disk{a, b}}
+		set := NewSyncSet(manifest, &opts, Options{BandwidthLimit: 1024 * 1024}, GinkgoLogr)
+		result, err := set.Run(context.Background())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(<-aDone).To(Succeed())
+		Expect(<-bDone).To(Succeed())
+		expectSynced("a")
+		expectSynced("b")
+		Expect(result.Disks).To(HaveLen(2))
+		for _, disk := range result.Disks {
+			Expect(disk.Error).To(BeEmpty())
+			Expect(disk.Stats.BlocksTransferred).To(Equal(int64(16)))
+		}
+		Expect(result.Summary()).To(HavePrefix("2 of 2 disks synced, 32 blocks"))
+		statsFile := filepath.Join(tmpDir, "stats.json")
+		Expect(result.WriteFile(statsFile)).To(Succeed())
+		data, err := os.ReadFile(statsFile)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Valid(data)).To(BeTrue())
+	})
+
+	It("should fail the set if a disk fails", func() {
+		good, _ := startServer("good")
+		manifest := &Manifest{Disks: []Disk{
+			good,
+			{Name: "bad", Source: filepath.Join(tmpDir, "missing"), TargetAddress: "localhost", Port: good.Port + 1},
+		}}
+		set := NewSyncSet(manifest, &opts, Options{}, GinkgoLogr)
+		result, err := set.Run(context.Background())
+		var setErr *SetError
+		Expect(errors.As(err, &setErr)).To(BeTrue())
+		Expect(setErr.BudgetExhausted()).To(BeFalse())
+		Expect(err.Error()).To(ContainSubstring("bad: "))
+		Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue())
+		Expect(result.Disks[1].Error).ToNot(BeEmpty())
+		Expect(result.Summary()).ToNot(HavePrefix("2 of 2 disks synced"))
+	})
+
+	It("should reject a cutover barrier", func() {
+		barrier, err := blockrsync.NewCutoverBarrier(blockrsync.CutoverOptions{Signal: true}, GinkgoLogr)
+		Expect(err).ToNot(HaveOccurred())
+		opts.Cutover = barrier
+		set := NewSyncSet(&Manifest{Disks: []Disk{{Name: "a", Source: "/dev/a", TargetAddress: "host", Port: 8000}}}, &opts, Options{}, GinkgoLogr)
+		_, err = set.Run(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("cutover")))
+	})
+})
+
+var _ = Describe("bandwidth share tests", func() {
+	It("should split the bandwidth by weight between the active disks", func() {
+		shares := newBandwidthShares(1000000, []Disk{{Name: "os", Weight: 3}, {Name: "data1"}, {Name: "data2"}})
+		Expect(shares.limiter(0).Rate()).To(Equal(int64(600000)))
+		Expect(shares.limiter(1).Rate()).To(Equal(int64(200000)))
+		Expect(shares.limiter(2).Rate()).To(Equal(int64(200000)))
+		shares.done(0)
+		Expect(shares.limiter(1).Rate()).To(Equal(int64(500000)))
+		Expect(shares.limiter(2).Rate()).To(Equal(int64(500000)))
+		shares.done(1)
+		Expect(shares.limiter(2).Rate()).To(Equal(int64(1000000)))
+	})
+
+	It("should not limit without a bandwidth limit", func() {
+		shares := newBandwidthShares(0, []Disk{{Name: "os", Weight: 3}, {Name: "data"}})
+		Expect(shares.limiter(0)).To(BeNil())
+		shares.done(0)
+		Expect(shares.limiter(1)).To(BeNil())
+	})
+})
+
+var _ = Describe("cancel transport tests", func() {
+	It("should close connections when the context is cancelled", func() {
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			conn, err := listener.Accept()
+			if err == nil {
+				defer conn.Close()
+				_, _ = conn.Read(make([]byte, 1))
+			}
+		}()
+		ctx, cancel := context.WithCancel(context.Background())
+		t := &cancelTransport{ctx: ctx, base: tcp{}}
+		conn, err := t.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		cancel()
+		_, err = conn.Read(make([]byte, 1))
+		Expect(err).To(HaveOccurred())
+		_, err = t.Dial(listener.Addr().String())
+		Expect(err).To(MatchError(context.Canceled))
+	})
+})
+
+type tcp struct{}
+
+func (tcp) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+func (tcp) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func getFreePort() (port int, err error) {
+	var a *net.TCPAddr
+	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
+		var l *net.TCPListener
+		if l, err = net.ListenTCP("tcp", a); err == nil {
+			defer l.Close()
+			return l.Addr().(*net.TCPAddr).Port, nil
+		}
+	}
+	return
+}
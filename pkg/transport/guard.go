@@ -0,0 +1,236 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	// Buckets of addresses that didn't connect for this long are dropped
+	guardBucketExpiry = time.Minute
+)
+
+var (
+	ErrConnectionRate = errors.New("too many connections from the address")
+	ErrTooManyPending = errors.New("too many connections waiting to authenticate")
+)
+
+// GuardOptions limit the connections a listener accepts until they
+// authenticate, the zero value doesn't limit.
+type GuardOptions struct {
+	// RatePerIP is the new connections per second accepted from an IP, and
+	// BurstPerIP the connections an IP can open at once, 1 if not set
+	RatePerIP  float64
+	BurstPerIP int
+	// MaxPending is the most connections that did not authenticate yet
+	MaxPending int
+	// HandshakeTimeout closes the connections that don't authenticate in time
+	HandshakeTimeout time.Duration
+	// DeferRate leaves the rate per IP to Admit, for servers that learn the
+	// address of the client after accepting, like from a PROXY protocol header
+	DeferRate bool
+}
+
+func (o *GuardOptions) Enabled() bool {
+	return o.RatePerIP > 0 || o.MaxPending > 0 || o.HandshakeTimeout > 0
+}
+
+func (o *GuardOptions) Validate() error {
+	if o.RatePerIP < 0 || o.BurstPerIP < 0 || o.MaxPending < 0 || o.HandshakeTimeout < 0 {
+		return errors.New("connection rate, burst, max pending connections and handshake timeout must be >= 0")
+	}
+	return nil
+}
+
+// PassthroughConn is implemented by connections that pass the data of the
+// connection they wrap through unchanged.
+type PassthroughConn interface {
+	net.Conn
+	Passthrough() net.Conn
+}
+
+// Guard returns a listener that closes the connections over the limits of
+// the options as soon as they are accepted. Accepted connections are pending
+// until Authenticated is called with them or they are closed.
+func Guard(listener net.Listener, opts GuardOptions, log logr.Logger) net.Listener {
+	return &guardListener{
+		Listener: listener,
+		opts:     opts,
+		burst:    float64(max(opts.BurstPerIP, 1)),
+		buckets:  make(map[string]*guardBucket),
+		log:      log,
+	}
+}
+
+type guardListener struct {
+	net.Listener
+	opts    GuardOptions
+	burst   float64
+	mu      sync.Mutex
+	pending int
+	buckets map[string]*guardBucket
+	log     logr.Logger
+}
+
+type guardBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (g *guardListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := g.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if err := g.admit(conn.RemoteAddr(), time.Now()); err != nil {
+			g.log.Info("Refusing connection", "remote", conn.RemoteAddr(), "reason", err.Error())
+			conn.Close()
+			continue
+		}
+		guarded := &guardedConn{Conn: conn, listener: g}
+		if g.opts.HandshakeTimeout > 0 {
+			guarded.timer = time.AfterFunc(g.opts.HandshakeTimeout, func() {
+				g.log.Info("Closing connection that did not authenticate in time", "remote", conn.RemoteAddr(), "timeout", g.opts.HandshakeTimeout)
+				guarded.expire()
+			})
+		}
+		return guarded, nil
+	}
+}
+
+// admit takes a token from the bucket of the address and a pending slot.
+func (g *guardListener) admit(addr net.Addr, now time.Time) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.opts.MaxPending > 0 && g.pending >= g.opts.MaxPending {
+		return ErrTooManyPending
+	}
+	if !g.opts.DeferRate {
+		if err := g.takeToken(addr, now); err != nil {
+			return err
+		}
+	}
+	g.pending++
+	return nil
+}
+
+// takeToken takes a token from the bucket of the address, it must be called
+// with mu held.
+func (g *guardListener) takeToken(addr net.Addr, now time.Time) error {
+	if g.opts.RatePerIP <= 0 {
+		return nil
+	}
+	host := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		host = tcpAddr.IP.String()
+	}
+	g.expireBuckets(now)
+	bucket, ok := g.buckets[host]
+	if !ok {
+		bucket = &guardBucket{tokens: g.burst, last: now}
+		g.buckets[host] = bucket
+	}
+	bucket.tokens = min(g.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*g.opts.RatePerIP)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return ErrConnectionRate
+	}
+	bucket.tokens--
+	return nil
+}
+
+// expireBuckets must be called with mu held.
+func (g *guardListener) expireBuckets(now time.Time) {
+	for host, bucket := range g.buckets {
+		if now.Sub(bucket.last) > guardBucketExpiry {
+			delete(g.buckets, host)
+		}
+	}
+}
+
+func (g *guardListener) release() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pending--
+}
+
+type guardedConn struct {
+	net.Conn
+	listener *guardListener
+	timer    *time.Timer
+	once     sync.Once
+	inTime   bool
+}
+
+// authenticate releases the pending slot of the connection, it returns false
+// if the handshake timeout closed it.
+func (c *guardedConn) authenticate() bool {
+	c.once.Do(func() {
+		c.inTime = c.timer == nil || c.timer.Stop()
+		c.listener.release()
+	})
+	return c.inTime
+}
+
+func (c *guardedConn) expire() {
+	c.once.Do(c.listener.release)
+	c.Conn.Close()
+}
+
+func (c *guardedConn) Close() error {
+	c.authenticate()
+	return c.Conn.Close()
+}
+
+func (c *guardedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *guardedConn) Passthrough() net.Conn {
+	return c.Conn
+}
+
+// guardedConnOf returns the guarded connection the connection is or wraps,
+// nil if it was not accepted by a guard.
+func guardedConnOf(conn net.Conn) *guardedConn {
+	for conn != nil {
+		if guarded, ok := conn.(*guardedConn); ok {
+			return guarded
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+	return nil
+}
+
+// Authenticated stops counting the connection, or the guarded connection it
+// wraps, against the limits of the listener that accepted it. It returns
+// false if the handshake timeout closed the connection.
+func Authenticated(conn net.Conn) bool {
+	if guarded := guardedConnOf(conn); guarded != nil {
+		return guarded.authenticate()
+	}
+	return true
+}
+
+// Admit applies the rate per IP to a connection accepted by a guard with
+// DeferRate, addr is the address of the client. The caller closes the
+// connection if it fails.
+func Admit(conn net.Conn, addr net.Addr) error {
+	guarded := guardedConnOf(conn)
+	if guarded == nil || !guarded.listener.opts.DeferRate {
+		return nil
+	}
+	g := guarded.listener
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.takeToken(addr, time.Now())
+}
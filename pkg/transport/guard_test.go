@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("guard tests", func() {
+	listen := func(opts GuardOptions) net.Listener {
+		listener, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		guarded := Guard(listener, opts, GinkgoLogr)
+		DeferCleanup(guarded.Close)
+		return guarded
+	}
+
+	// accept dials the listener and returns the accepted end.
+	accept := func(listener net.Listener) (net.Conn, net.Conn) {
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			accepted <- conn
+		}()
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(dialed.Close)
+		return dialed, <-accepted
+	}
+
+	closed := func(conn net.Conn) bool {
+		Expect(conn.SetReadDeadline(time.Now().Add(5 * time.Second))).To(Succeed())
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	It("should limit the connections that did not authenticate", func() {
+		listener := listen(GuardOptions{MaxPending: 1})
+		_, first := accept(listener)
+		next := make(chan net.Conn, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			next <- conn
+		}()
+		refused, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer refused.Close()
+		Expect(closed(refused)).To(BeTrue())
+		Expect(Authenticated(first)).To(BeTrue())
+		dialed, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer dialed.Close()
+		second := <-next
+		Expect(second.Close()).To(Succeed())
+		_, third := accept(listener)
+		Expect(third).ToNot(BeNil())
+	})
+
+	It("should close connections that don't authenticate in time", func() {
+		listener := listen(GuardOptions{HandshakeTimeout: 100 * time.Millisecond})
+		dialed, accepted := accept(listener)
+		Expect(closed(dialed)).To(BeTrue())
+		Expect(Authenticated(accepted)).To(BeFalse())
+		dialed, accepted = accept(listener)
+		Expect(Authenticated(accepted)).To(BeTrue())
+		time.Sleep(200 * time.Millisecond)
+		_, err := accepted.Write([]byte("x"))
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 1)
+		_, err = io.ReadFull(dialed, buf)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("should limit the connection rate of an address", func() {
+		g := Guard(nil, GuardOptions{RatePerIP: 10, BurstPerIP: 2}, GinkgoLogr).(*guardListener)
+		now := time.Now()
+		a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+		b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+		Expect(g.admit(a, now)).To(Succeed())
+		Expect(g.admit(&net.TCPAddr{IP: a.IP, Port: 1001}, now)).To(Succeed())
+		Expect(g.admit(a, now)).To(MatchError(ErrConnectionRate))
+		Expect(g.admit(b, now)).To(Succeed())
+		Expect(g.admit(a, now.Add(100*time.Millisecond))).To(Succeed())
+		Expect(g.admit(b, now.Add(2*guardBucketExpiry))).To(Succeed())
+		Expect(g.buckets).To(HaveLen(1))
+	})
+
+	It("should leave the connection rate to Admit when it is deferred", func() {
+		listener := listen(GuardOptions{RatePerIP: 0.001, DeferRate: true})
+		a := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+		b := &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}
+		_, first := accept(listener)
+		_, second := accept(listener)
+		_, third := accept(listener)
+		Expect(Admit(first, a)).To(Succeed())
+		Expect(Admit(second, b)).To(Succeed())
+		Expect(Admit(third, a)).To(MatchError(ErrConnectionRate))
+
+		// Without DeferRate the rate was applied when accepting
+		g := Guard(nil, GuardOptions{RatePerIP: 0.001}, GinkgoLogr).(*guardListener)
+		guarded := &guardedConn{listener: g}
+		Expect(Admit(guarded, a)).To(Succeed())
+		Expect(Admit(guarded, a)).To(Succeed())
+	})
+
+	It("should find the guarded connection through wrapping connections", func() {
+		listener := listen(GuardOptions{MaxPending: 1})
+		_, accepted := accept(listener)
+		limited := RateLimit(NewLimiter(1 << 20)).(*rateLimitLayer)
+		wrapped, err := limited.Server(accepted)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(Authenticated(wrapped)).To(BeTrue())
+		Expect(accepted.(PassthroughConn).Passthrough()).ToNot(BeNil())
+		_, next := accept(listener)
+		Expect(next).ToNot(BeNil())
+	})
+
+	It("should reject negative limits", func() {
+		Expect((&GuardOptions{MaxPending: -1}).Validate()).ToNot(Succeed())
+		Expect((&GuardOptions{}).Validate()).To(Succeed())
+		Expect((&GuardOptions{}).Enabled()).To(BeFalse())
+	})
+})
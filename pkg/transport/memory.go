@@ -0,0 +1,335 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMemoryBufferSize is how much a memory connection buffers in each
+	// direction before writes block
+	DefaultMemoryBufferSize = 4 * 1024 * 1024
+	// memoryBacklog is how many dialed connections wait for Accept
+	memoryBacklog = 16
+)
+
+var ErrNoListener = errors.New("nothing listens on the address")
+
+// Memory is a transport connecting the dialers and listeners of the process
+// without sockets, so a client and server can run in one process. Addresses
+// are matched by port, the host is ignored, so a server listening on :8000
+// accepts a client dialing localhost:8000. Listening on port 0 picks a free
+// port.
+type Memory struct {
+	bufferSize int
+	mu         sync.Mutex
+	listeners  map[string]*memoryListener
+	lastPort   int
+}
+
+// NewMemory returns a memory transport whose connections buffer bufferSize
+// bytes in each direction, DefaultMemoryBufferSize if it is 0.
+func NewMemory(bufferSize int) *Memory {
+	if bufferSize <= 0 {
+		bufferSize = DefaultMemoryBufferSize
+	}
+	return &Memory{
+		bufferSize: bufferSize,
+		listeners:  make(map[string]*memoryListener),
+	}
+}
+
+func memoryPort(address string) string {
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		return port
+	}
+	return address
+}
+
+func (m *Memory) Dial(address string) (net.Conn, error) {
+	m.mu.Lock()
+	listener, ok := m.listeners[memoryPort(address)]
+	m.mu.Unlock()
+	if !ok {
+		return nil, &net.OpError{Op: "dial", Net: memoryNetwork, Addr: memoryAddr(address), Err: ErrNoListener}
+	}
+	toServer := newPipeBuffer(m.bufferSize)
+	toClient := newPipeBuffer(m.bufferSize)
+	client := &memoryConn{r: toClient, w: toServer, local: memoryAddr("client"), remote: listener.addr}
+	server := &memoryConn{r: toServer, w: toClient, local: listener.addr, remote: memoryAddr("client")}
+	select {
+	case listener.accept <- server:
+		return client, nil
+	case <-listener.done:
+		return nil, &net.OpError{Op: "dial", Net: memoryNetwork, Addr: memoryAddr(address), Err: ErrNoListener}
+	}
+}
+
+func (m *Memory) Listen(address string) (net.Listener, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	port := memoryPort(address)
+	if port == "0" || port == "" {
+		for {
+			m.lastPort++
+			port = strconv.Itoa(m.lastPort)
+			if _, ok := m.listeners[port]; !ok {
+				break
+			}
+		}
+	}
+	if _, ok := m.listeners[port]; ok {
+		return nil, &net.OpError{Op: "listen", Net: memoryNetwork, Addr: memoryAddr(address), Err: errors.New("address already in use")}
+	}
+	listener := &memoryListener{
+		memory: m,
+		port:   port,
+		addr:   memoryAddr(net.JoinHostPort("", port)),
+		accept: make(chan net.Conn, memoryBacklog),
+		done:   make(chan struct{}),
+	}
+	m.listeners[port] = listener
+	return listener, nil
+}
+
+const memoryNetwork = "memory"
+
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return memoryNetwork
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
+
+type memoryListener struct {
+	memory *Memory
+	port   string
+	addr   memoryAddr
+	accept chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting, and closes the connections that were not accepted.
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		l.memory.mu.Lock()
+		delete(l.memory.listeners, l.port)
+		l.memory.mu.Unlock()
+		close(l.done)
+		for {
+			select {
+			case conn := <-l.accept:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// pipeBuffer holds the data written in one direction of a memory connection.
+// Waiters wait on changed, which is closed and replaced on every change.
+type pipeBuffer struct {
+	mu           sync.Mutex
+	data         []byte
+	size         int
+	writerClosed bool
+	readerClosed bool
+	changed      chan struct{}
+}
+
+func newPipeBuffer(size int) *pipeBuffer {
+	return &pipeBuffer{size: size, changed: make(chan struct{})}
+}
+
+// notify must be called with mu held.
+func (b *pipeBuffer) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+func (b *pipeBuffer) wake() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.notify()
+}
+
+// wait waits for a change, or returns os.ErrDeadlineExceeded once the
+// deadline passed.
+func wait(changed <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-changed
+		return nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-changed:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (b *pipeBuffer) read(p []byte, deadline func() time.Time) (int, error) {
+	for {
+		b.mu.Lock()
+		if b.readerClosed {
+			b.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(b.data) > 0 {
+			n := copy(p, b.data)
+			b.data = b.data[n:]
+			b.notify()
+			b.mu.Unlock()
+			return n, nil
+		}
+		if b.writerClosed {
+			b.mu.Unlock()
+			return 0, io.EOF
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		if err := wait(changed, deadline()); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (b *pipeBuffer) write(p []byte, deadline func() time.Time) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		b.mu.Lock()
+		if b.writerClosed {
+			b.mu.Unlock()
+			return written, net.ErrClosed
+		}
+		if b.readerClosed {
+			b.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if space := b.size - len(b.data); space > 0 {
+			n := min(space, len(p))
+			b.data = append(b.data, p[:n]...)
+			b.notify()
+			b.mu.Unlock()
+			written += n
+			p = p[n:]
+			continue
+		}
+		changed := b.changed
+		b.mu.Unlock()
+		if err := wait(changed, deadline()); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// memoryConn reads from one pipe buffer and writes to the other.
+type memoryConn struct {
+	r, w          *pipeBuffer
+	local, remote net.Addr
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	once          sync.Once
+}
+
+func (c *memoryConn) Read(p []byte) (int, error) {
+	return c.r.read(p, func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.readDeadline
+	})
+}
+
+func (c *memoryConn) Write(p []byte) (int, error) {
+	return c.w.write(p, func() time.Time {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.writeDeadline
+	})
+}
+
+// Close makes the peer read EOF once it read what was written, and fails its
+// writes.
+func (c *memoryConn) Close() error {
+	c.once.Do(func() {
+		c.r.mu.Lock()
+		c.r.readerClosed = true
+		c.r.data = nil
+		c.r.notify()
+		c.r.mu.Unlock()
+		_ = c.CloseWrite()
+	})
+	return nil
+}
+
+// CloseWrite makes the peer read EOF once it read what was written.
+func (c *memoryConn) CloseWrite() error {
+	c.w.mu.Lock()
+	defer c.w.mu.Unlock()
+	c.w.writerClosed = true
+	c.w.notify()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memoryConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.r.wake()
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	c.w.wake()
+	return nil
+}
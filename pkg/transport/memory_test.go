@@ -0,0 +1,98 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("memory transport tests", func() {
+	var memory *Memory
+
+	BeforeEach(func() {
+		memory = NewMemory(16)
+	})
+
+	dial := func(address string) (net.Conn, net.Conn) {
+		listener, err := memory.Listen(":0")
+		Expect(err).ToNot(HaveOccurred())
+		DeferCleanup(listener.Close)
+		_, port, err := net.SplitHostPort(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		client, err := memory.Dial(net.JoinHostPort(address, port))
+		Expect(err).ToNot(HaveOccurred())
+		server, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		return client, server
+	}
+
+	It("should connect a dialer to the listener on the port", func() {
+		client, server := dial("localhost")
+		data := make([]byte, 1024)
+		for i := range data {
+			data[i] = byte(i)
+		}
+		go func() {
+			defer GinkgoRecover()
+			_, err := client.Write(data)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(client.Close()).To(Succeed())
+		}()
+		received, err := io.ReadAll(server)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+	})
+
+	It("should buffer writes in both directions", func() {
+		client, server := dial("")
+		_, err := client.Write([]byte("request"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = server.Write([]byte("response"))
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 8)
+		n, err := client.Read(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("response"))
+		n, err = server.Read(buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf[:n])).To(Equal("request"))
+	})
+
+	It("should fail writes once the peer closed", func() {
+		client, server := dial("")
+		Expect(server.Close()).To(Succeed())
+		_, err := client.Write([]byte("data"))
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+		_, err = server.Read(make([]byte, 1))
+		Expect(err).To(MatchError(net.ErrClosed))
+	})
+
+	It("should time out reads and writes after the deadline", func() {
+		client, _ := dial("")
+		Expect(client.SetDeadline(time.Now().Add(10 * time.Millisecond))).To(Succeed())
+		_, err := client.Read(make([]byte, 1))
+		Expect(err).To(MatchError(os.ErrDeadlineExceeded))
+		// The buffer holds 16 bytes
+		n, err := client.Write(make([]byte, 32))
+		Expect(err).To(MatchError(os.ErrDeadlineExceeded))
+		Expect(n).To(Equal(16))
+	})
+
+	It("should fail to dial a port nothing listens on", func() {
+		_, err := memory.Dial("localhost:8000")
+		Expect(err).To(MatchError(ErrNoListener))
+		listener, err := memory.Listen(":8000")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = memory.Listen("localhost:8000")
+		Expect(err).To(HaveOccurred())
+		Expect(listener.Close()).To(Succeed())
+		_, err = memory.Dial("localhost:8000")
+		Expect(err).To(MatchError(ErrNoListener))
+		_, err = listener.Accept()
+		Expect(err).To(MatchError(net.ErrClosed))
+	})
+})
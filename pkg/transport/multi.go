@@ -0,0 +1,163 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// Merge returns a listener that accepts the connections of all the
+// listeners, like the addresses of a migration network and of a management
+// network. Closing it closes them all, and Accept fails once all of them
+// failed. Its address is the address of the first listener.
+func Merge(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 1 {
+		return listeners[0]
+	}
+	m := &mergedListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+		failed:    make(chan struct{}),
+	}
+	m.pending.Add(len(listeners))
+	for i, listener := range listeners {
+		go m.accept(i, listener)
+	}
+	go func() {
+		m.pending.Wait()
+		close(m.failed)
+	}()
+	return m
+}
+
+type mergedListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	done      chan struct{}
+	// failed is closed once all listeners failed, err is the first error
+	failed    chan struct{}
+	pending   sync.WaitGroup
+	mu        sync.Mutex
+	err       error
+	closeOnce sync.Once
+}
+
+func (m *mergedListener) accept(index int, listener net.Listener) {
+	defer m.pending.Done()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			m.mu.Lock()
+			if m.err == nil {
+				m.err = err
+			}
+			m.mu.Unlock()
+			return
+		}
+		select {
+		case m.conns <- &mergedConn{Conn: conn, index: index}:
+		case <-m.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func (m *mergedListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.conns:
+		return conn, nil
+	case <-m.done:
+		return nil, net.ErrClosed
+	case <-m.failed:
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return nil, m.err
+	}
+}
+
+func (m *mergedListener) Close() error {
+	var errs []error
+	m.closeOnce.Do(func() {
+		close(m.done)
+		for _, listener := range m.listeners {
+			errs = append(errs, listener.Close())
+		}
+	})
+	return errors.Join(errs...)
+}
+
+func (m *mergedListener) Addr() net.Addr {
+	return m.listeners[0].Addr()
+}
+
+// mergedConn remembers the listener of a merged listener that accepted it.
+type mergedConn struct {
+	net.Conn
+	index int
+}
+
+func (c *mergedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// ListenerIndex returns the index of the listener of Merge that accepted the
+// connection, or a connection it wraps, 0 if it wasn't accepted by a merged
+// listener.
+func ListenerIndex(conn net.Conn) int {
+	for conn != nil {
+		if merged, ok := conn.(*mergedConn); ok {
+			return merged.index
+		}
+		switch wrapper := conn.(type) {
+		case interface{ NetConn() net.Conn }:
+			conn = wrapper.NetConn()
+		case PassthroughConn:
+			conn = wrapper.Passthrough()
+		default:
+			return 0
+		}
+	}
+	return 0
+}
+
+// DialFirst dials the addresses at once and returns the connection that
+// completes first, the quickest path to the peer at handshake time. The dial
+// function includes any handshake, like TLS, so the path is chosen before
+// anything is sent on it. The other connections are closed once they
+// complete, the error of every address is returned if all fail.
+func DialFirst(addresses []string, dial func(address string) (net.Conn, error)) (net.Conn, error) {
+	if len(addresses) == 1 {
+		return dial(addresses[0])
+	}
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addresses))
+	for _, address := range addresses {
+		go func(address string) {
+			conn, err := dial(address)
+			results <- result{conn: conn, err: err}
+		}(address)
+	}
+	var errs []error
+	for range addresses {
+		res := <-results
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+		remaining := len(addresses) - len(errs) - 1
+		go func() {
+			for i := 0; i < remaining; i++ {
+				if res := <-results; res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}()
+		return res.conn, nil
+	}
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,83 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("multiple listener tests", func() {
+	It("should accept the connections of every listener", func() {
+		first, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		second, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		merged := Guard(Merge(first, second), GuardOptions{MaxPending: 2}, GinkgoLogr)
+		defer merged.Close()
+		Expect(merged.Addr()).To(Equal(first.Addr()))
+
+		for i, address := range []string{second.Addr().String(), first.Addr().String()} {
+			client, err := TCP.Dial(address)
+			Expect(err).ToNot(HaveOccurred())
+			defer client.Close()
+			conn, err := merged.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(ListenerIndex(conn)).To(Equal(1 - i))
+		}
+
+		Expect(merged.Close()).To(Succeed())
+		_, err = merged.Accept()
+		Expect(err).To(MatchError(net.ErrClosed))
+		_, err = first.Accept()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should fail to accept once all listeners failed", func() {
+		first, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		second, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		merged := Merge(first, second)
+		first.Close()
+		second.Close()
+		_, err = merged.Accept()
+		Expect(err).To(HaveOccurred())
+		Expect(errors.Is(err, net.ErrClosed)).To(BeTrue())
+	})
+
+	It("should use the connection that completes first", func() {
+		listener, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		slow := make(chan net.Conn, 1)
+		conn, err := DialFirst([]string{"slow", listener.Addr().String(), "unreachable"}, func(address string) (net.Conn, error) {
+			switch address {
+			case "slow":
+				time.Sleep(50 * time.Millisecond)
+				conn, err := TCP.Dial(listener.Addr().String())
+				slow <- conn
+				return conn, err
+			case "unreachable":
+				return nil, errors.New("unreachable")
+			}
+			return TCP.Dial(address)
+		})
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		// The slow connection is closed once it completes
+		slowConn := <-slow
+		Eventually(func() error {
+			_, err := slowConn.Write([]byte("x"))
+			return err
+		}).Should(MatchError(net.ErrClosed))
+
+		_, err = DialFirst([]string{"a", "b"}, func(address string) (net.Conn, error) {
+			return nil, errors.New("unreachable " + address)
+		})
+		Expect(err).To(MatchError(And(ContainSubstring("unreachable a"), ContainSubstring("unreachable b"))))
+	})
+})
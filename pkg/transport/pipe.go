@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const pipeNetwork = "pipe"
+
+var ErrPipeUsed = errors.New("the pipe is already connected")
+
+// Pipe is a transport over a reader and a writer of the process, like stdin
+// and stdout, so the client and the server can run at both ends of a command
+// like ssh without a listening port. Addresses are ignored, the first Dial or
+// Accept gets the only connection of the pipe.
+type Pipe struct {
+	mu   sync.Mutex
+	conn *pipeConn
+}
+
+// NewPipe returns a pipe transport reading from r and writing to w, both are
+// closed when the connection is.
+func NewPipe(r io.ReadCloser, w io.WriteCloser) *Pipe {
+	return &Pipe{
+		conn: &pipeConn{r: r, w: w},
+	}
+}
+
+// take returns the connection of the pipe the first time it is called.
+func (p *Pipe) take() (net.Conn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil, ErrPipeUsed
+	}
+	conn := p.conn
+	p.conn = nil
+	return conn, nil
+}
+
+func (p *Pipe) Dial(address string) (net.Conn, error) {
+	conn, err := p.take()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: pipeNetwork, Addr: pipeAddr(address), Err: err}
+	}
+	return conn, nil
+}
+
+// Listen returns a listener that accepts the connection of the pipe, then
+// blocks until it is closed.
+func (p *Pipe) Listen(address string) (net.Listener, error) {
+	return &pipeListener{pipe: p, done: make(chan struct{})}, nil
+}
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return pipeNetwork
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+type pipeListener struct {
+	pipe *Pipe
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	if conn, err := l.pipe.take(); err == nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, net.ErrClosed
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr("stdin")
+}
+
+type pipeConn struct {
+	r    io.ReadCloser
+	w    io.WriteCloser
+	once sync.Once
+	err  error
+}
+
+func (c *pipeConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *pipeConn) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+// Close closes the writer first, so the peer reads the end of the stream
+// even if closing the reader fails.
+func (c *pipeConn) Close() error {
+	c.once.Do(func() {
+		c.err = errors.Join(c.w.Close(), c.r.Close())
+	})
+	return c.err
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr("stdin")
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr("stdout")
+}
+
+// SetDeadline sets the deadlines of the reader and writer if they have them,
+// like the pipes of os.File.
+func (c *pipeConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *pipeConn) SetReadDeadline(t time.Time) error {
+	if d, ok := c.r.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func (c *pipeConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := c.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("pipe transport tests", func() {
+	// pipes returns the pipe transports of both ends of a command, what one
+	// writes the other reads
+	pipes := func() (*Pipe, *Pipe) {
+		toServer, fromClient := io.Pipe()
+		toClient, fromServer := io.Pipe()
+		return NewPipe(toClient, fromClient), NewPipe(toServer, fromServer)
+	}
+
+	It("should connect the dialer to the listener at the other end", func() {
+		client, server := pipes()
+		listener, err := server.Listen("ignored")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		clientConn, err := client.Dial("ignored:8000")
+		Expect(err).ToNot(HaveOccurred())
+		serverConn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+
+		go func() {
+			defer GinkgoRecover()
+			_, err := clientConn.Write([]byte("request"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		buf := make([]byte, 7)
+		_, err = io.ReadFull(serverConn, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("request"))
+
+		go func() {
+			defer GinkgoRecover()
+			_, err := serverConn.Write([]byte("response"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(serverConn.Close()).To(Succeed())
+		}()
+		received, err := io.ReadAll(clientConn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(received)).To(Equal("response"))
+		Expect(clientConn.Close()).To(Succeed())
+	})
+
+	It("should only have one connection", func() {
+		client, _ := pipes()
+		_, err := client.Dial("")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Dial("")
+		Expect(err).To(MatchError(ErrPipeUsed))
+
+		listener, err := client.Listen("")
+		Expect(err).ToNot(HaveOccurred())
+		accepted := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			accepted <- err
+		}()
+		Consistently(accepted).ShouldNot(Receive())
+		Expect(listener.Close()).To(Succeed())
+		Eventually(accepted).Should(Receive(MatchError(net.ErrClosed)))
+	})
+})
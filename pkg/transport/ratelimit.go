@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	minLimiterBurst = 64 * 1024
+)
+
+// Limiter is a token bucket limiting the bytes per second written by all the
+// connections sharing it.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  int
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	burst := max(int(bytesPerSecond/10), minLimiterBurst)
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// SetRate changes the bytes per second, the burst is unchanged.
+func (l *Limiter) SetRate(bytesPerSecond int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = float64(bytesPerSecond)
+}
+
+// refill must be called with mu held.
+func (l *Limiter) refill(now time.Time) {
+	l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+// WaitN blocks until n bytes can be transferred. Callers reserve tokens in
+// order, so waiting callers are served fairly.
+func (l *Limiter) WaitN(n int) {
+	l.mu.Lock()
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// RateLimit returns a layer that limits writes on both ends with every non
+// nil limiter.
+func RateLimit(limiters ...*Limiter) Layer {
+	res := &rateLimitLayer{}
+	for _, limiter := range limiters {
+		if limiter != nil {
+			res.limiters = append(res.limiters, limiter)
+		}
+	}
+	return res
+}
+
+type rateLimitLayer struct {
+	limiters []*Limiter
+}
+
+func (r *rateLimitLayer) Client(conn net.Conn) (net.Conn, error) {
+	return r.wrap(conn), nil
+}
+
+func (r *rateLimitLayer) Server(conn net.Conn) (net.Conn, error) {
+	return r.wrap(conn), nil
+}
+
+func (r *rateLimitLayer) wrap(conn net.Conn) net.Conn {
+	if len(r.limiters) == 0 {
+		return conn
+	}
+	chunk := r.limiters[0].burst
+	for _, limiter := range r.limiters[1:] {
+		chunk = min(chunk, limiter.burst)
+	}
+	return &rateLimitedConn{Conn: conn, limiters: r.limiters, chunk: chunk}
+}
+
+type rateLimitedConn struct {
+	net.Conn
+	limiters []*Limiter
+	chunk    int
+}
+
+func (r *rateLimitedConn) NetConn() net.Conn {
+	return r.Conn
+}
+
+func (r *rateLimitedConn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), r.chunk)
+		for _, limiter := range r.limiters {
+			limiter.WaitN(n)
+		}
+		n, err := r.Conn.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
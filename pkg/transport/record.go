@@ -0,0 +1,193 @@
+package transport
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// recordMagic starts every recording
+	recordMagic = "blockrsync-recording-1\n"
+	// RecordDial and RecordAccept are the roles of the recorded connections,
+	// dialed by a client or accepted by a server
+	RecordDial   = "dial"
+	RecordAccept = "accept"
+
+	frameRead  byte = 1
+	frameWrite byte = 2
+	// frameElided marks a frame recorded without its data
+	frameElided byte = 0x80
+	// frameHeaderSize is the kind, the nanoseconds since the connection was
+	// opened and the length of the data
+	frameHeaderSize = 1 + 8 + 4
+)
+
+var ErrInvalidRecording = errors.New("invalid recording")
+
+// Recorder is a layer that records the bytes every connection reads and
+// writes, with the time since the connection was opened, to a file per
+// connection in a directory, only readable by the user. The connections can be
+// replayed with NewReplay. When elided, only the length of what is read and
+// written is recorded, so a recording holds none of the data of the sync, and
+// only the connections that read nothing can be replayed.
+type Recorder struct {
+	dir   string
+	elide bool
+	mu    sync.Mutex
+	count int
+}
+
+// NewRecorder creates the directory of the recordings.
+func NewRecorder(dir string, elide bool) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, elide: elide}, nil
+}
+
+func (r *Recorder) Client(conn net.Conn) (net.Conn, error) {
+	return r.record(conn, RecordDial)
+}
+
+func (r *Recorder) Server(conn net.Conn) (net.Conn, error) {
+	return r.record(conn, RecordAccept)
+}
+
+func (r *Recorder) record(conn net.Conn, role string) (net.Conn, error) {
+	r.mu.Lock()
+	r.count++
+	name := filepath.Join(r.dir, fmt.Sprintf("%03d-%s.rec", r.count, role))
+	r.mu.Unlock()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	header, err := json.Marshal(recordHeader{
+		Network:    conn.LocalAddr().Network(),
+		Local:      conn.LocalAddr().String(),
+		Remote:     conn.RemoteAddr().String(),
+		Compressed: IsCompressed(conn),
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteString(recordMagic + string(header) + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &recordedConn{Conn: conn, f: f, elide: r.elide, opened: time.Now()}, nil
+}
+
+// recordHeader follows the magic of a recording, it holds what the client and
+// server learn from the connection, so the replayed connection behaves the
+// same, like skipping compression on a loopback connection.
+type recordHeader struct {
+	Network    string `json:"network"`
+	Local      string `json:"local"`
+	Remote     string `json:"remote"`
+	Compressed bool   `json:"compressed,omitempty"`
+}
+
+// recordedConn writes a frame to the recording for every read and write, so
+// the recording is complete up to a crash.
+type recordedConn struct {
+	net.Conn
+	elide  bool
+	opened time.Time
+	mu     sync.Mutex
+	f      *os.File
+	frame  []byte
+	err    error
+}
+
+func (c *recordedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *recordedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.record(frameRead, p[:n])
+	}
+	return n, err
+}
+
+func (c *recordedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.record(frameWrite, p[:n])
+	}
+	return n, err
+}
+
+// record writes a frame, the recording stops at the first error so the
+// connection keeps working.
+func (c *recordedConn) record(kind byte, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil || c.f == nil {
+		return
+	}
+	length := len(data)
+	if c.elide {
+		kind |= frameElided
+		data = nil
+	}
+	c.frame = append(c.frame[:0], kind)
+	c.frame = binary.LittleEndian.AppendUint64(c.frame, uint64(time.Since(c.opened)))
+	c.frame = binary.LittleEndian.AppendUint32(c.frame, uint32(length))
+	c.frame = append(c.frame, data...)
+	_, c.err = c.f.Write(c.frame)
+}
+
+func (c *recordedConn) Close() error {
+	c.mu.Lock()
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// recordedFrame is a read or write of a recorded connection.
+type recordedFrame struct {
+	kind    byte
+	elapsed time.Duration
+	length  int
+	data    []byte
+}
+
+// readFrame returns io.EOF at the end of the recording. A frame cut short,
+// like by a crash, ends the recording too.
+func readFrame(r io.Reader) (recordedFrame, error) {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return recordedFrame{}, io.EOF
+	}
+	frame := recordedFrame{
+		kind:    header[0],
+		elapsed: time.Duration(binary.LittleEndian.Uint64(header[1:9])),
+		length:  int(binary.LittleEndian.Uint32(header[9:])),
+	}
+	switch frame.kind {
+	case frameRead, frameWrite:
+		frame.data = make([]byte, frame.length)
+		if _, err := io.ReadFull(r, frame.data); err != nil {
+			return recordedFrame{}, io.EOF
+		}
+	case frameRead | frameElided, frameWrite | frameElided:
+	default:
+		return recordedFrame{}, fmt.Errorf("%w, unknown frame kind %d", ErrInvalidRecording, frame.kind)
+	}
+	return frame, nil
+}
@@ -0,0 +1,157 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("record and replay tests", func() {
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+	})
+
+	// session records a client sending a request and reading the response.
+	session := func(elide bool) {
+		recorder, err := NewRecorder(dir, elide)
+		Expect(err).ToNot(HaveOccurred())
+		recorded := Wrap(NewMemory(0), recorder)
+		listener, err := recorded.Listen(":0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			request := make([]byte, 7)
+			_, err = io.ReadFull(conn, request)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = conn.Write([]byte("response"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		client, err := recorded.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Write([]byte("request"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(io.ReadAll(client)).To(Equal([]byte("response")))
+		Expect(client.Close()).To(Succeed())
+	}
+
+	It("should replay what the connections read", func() {
+		session(false)
+		files, err := filepath.Glob(filepath.Join(dir, "*.rec"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+		replay, err := NewReplay(dir, false)
+		Expect(err).ToNot(HaveOccurred())
+		client, err := replay.Dial("anywhere:1234")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Write([]byte("request"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(io.ReadAll(client)).To(Equal([]byte("response")))
+		Expect(client.Close()).To(Succeed())
+		written, recorded := replay.Written()
+		Expect(written).To(Equal(int64(7)))
+		Expect(recorded).To(Equal(int64(7)))
+
+		listener, err := replay.Listen(":0")
+		Expect(err).ToNot(HaveOccurred())
+		server, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(io.ReadAll(server)).To(Equal([]byte("request")))
+		Expect(server.Close()).To(Succeed())
+		_, err = listener.Accept()
+		Expect(err).To(MatchError(ErrReplayExhausted))
+		_, err = replay.Dial("anywhere:1234")
+		Expect(err).To(MatchError(ErrReplayExhausted))
+	})
+
+	It("should only record the length of the reads and writes when elided", func() {
+		session(true)
+		files, err := filepath.Glob(filepath.Join(dir, "*.rec"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(files).To(HaveLen(2))
+		for _, file := range files {
+			info, err := os.Stat(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+			recording, err := os.ReadFile(file)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(recording)).ToNot(ContainSubstring("request"))
+			Expect(string(recording)).ToNot(ContainSubstring("response"))
+		}
+		replay, err := NewReplay(dir, false)
+		Expect(err).ToNot(HaveOccurred())
+		client, err := replay.Dial("")
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Write([]byte("longer request"))
+		Expect(err).ToNot(HaveOccurred())
+		_, err = client.Read(make([]byte, 8))
+		Expect(err).To(MatchError(ErrInvalidRecording))
+		Expect(client.Close()).To(Succeed())
+		written, recorded := replay.Written()
+		Expect(written).To(Equal(int64(14)))
+		Expect(recorded).To(Equal(int64(7)))
+	})
+
+	It("should wait for the recorded time with timing", func() {
+		recorder, err := NewRecorder(dir, false)
+		Expect(err).ToNot(HaveOccurred())
+		client, server := net.Pipe()
+		defer server.Close()
+		recordedConn, err := recorder.Client(client)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = server.Write([]byte("late"))
+			server.Close()
+		}()
+		Expect(io.ReadAll(recordedConn)).To(Equal([]byte("late")))
+		Expect(recordedConn.Close()).To(Succeed())
+		replay, err := NewReplay(dir, true)
+		Expect(err).ToNot(HaveOccurred())
+		replayed, err := replay.Dial("")
+		Expect(err).ToNot(HaveOccurred())
+		start := time.Now()
+		Expect(io.ReadAll(replayed)).To(Equal([]byte("late")))
+		Expect(time.Since(start)).To(BeNumerically(">=", 90*time.Millisecond))
+	})
+
+	It("should replay the addresses of a TCP connection", func() {
+		recorder, err := NewRecorder(dir, false)
+		Expect(err).ToNot(HaveOccurred())
+		recorded := Wrap(TCP, recorder)
+		listener, err := recorded.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		}()
+		client, err := recorded.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.Close()).To(Succeed())
+		replay, err := NewReplay(dir, false)
+		Expect(err).ToNot(HaveOccurred())
+		replayed, err := replay.Dial("")
+		Expect(err).ToNot(HaveOccurred())
+		defer replayed.Close()
+		Expect(IsLoopback(replayed)).To(BeTrue())
+		Expect(replayed.RemoteAddr().String()).To(Equal(listener.Addr().String()))
+	})
+
+	It("should refuse a directory without recordings", func() {
+		_, err := NewReplay(dir, false)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,277 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrReplayExhausted = errors.New("no more recorded connections to replay")
+
+// Replay is a transport that plays back the connections of a Recorder, so the
+// client or server that recorded them can be run again offline. Dial returns
+// the next recorded dialed connection and Accept the next recorded accepted
+// connection, whatever the address. A replayed connection reads what the
+// recorded one read, and discards what is written to it. With timing, the
+// reads wait until the time they were recorded at.
+type Replay struct {
+	timing   bool
+	mu       sync.Mutex
+	dialed   []string
+	accepted []string
+	// written and recorded are the bytes written to the replayed connections
+	// that were closed, and the bytes their recordings wrote
+	written  int64
+	recorded int64
+}
+
+// NewReplay returns a replay of the recordings in the directory.
+func NewReplay(dir string, timing bool) (*Replay, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.rec"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recordings in %s", dir)
+	}
+	sort.Strings(files)
+	r := &Replay{timing: timing}
+	for _, file := range files {
+		switch {
+		case strings.HasSuffix(file, "-"+RecordDial+".rec"):
+			r.dialed = append(r.dialed, file)
+		case strings.HasSuffix(file, "-"+RecordAccept+".rec"):
+			r.accepted = append(r.accepted, file)
+		}
+	}
+	return r, nil
+}
+
+// Written returns the bytes written to the replayed connections that were
+// closed, and the bytes their recordings wrote. A difference means the replay
+// didn't behave like the recorded session.
+func (r *Replay) Written() (int64, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.written, r.recorded
+}
+
+func (r *Replay) Dial(address string) (net.Conn, error) {
+	conn, err := r.next(&r.dialed)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: replayNetwork, Addr: replayAddr(address), Err: err}
+	}
+	return conn, nil
+}
+
+func (r *Replay) Listen(address string) (net.Listener, error) {
+	return &replayListener{replay: r, addr: replayAddr(address), done: make(chan struct{})}, nil
+}
+
+// next opens the first recording of the list.
+func (r *Replay) next(files *[]string) (net.Conn, error) {
+	r.mu.Lock()
+	if len(*files) == 0 {
+		r.mu.Unlock()
+		return nil, ErrReplayExhausted
+	}
+	file := (*files)[0]
+	*files = (*files)[1:]
+	r.mu.Unlock()
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(f)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != recordMagic {
+		f.Close()
+		return nil, fmt.Errorf("%w, %s is not a recording", ErrInvalidRecording, file)
+	}
+	line, err := reader.ReadBytes('\n')
+	var header recordHeader
+	if err == nil {
+		err = json.Unmarshal(line, &header)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w, %s has an invalid header: %v", ErrInvalidRecording, file, err)
+	}
+	return &replayConn{
+		replay:     r,
+		f:          f,
+		reader:     reader,
+		opened:     time.Now(),
+		local:      replayedAddr(header.Network, header.Local),
+		remote:     replayedAddr(header.Network, header.Remote),
+		compressed: header.Compressed,
+	}, nil
+}
+
+// replayedAddr returns a TCP address for a recorded TCP connection, so a
+// replayed loopback connection is still seen as one.
+func replayedAddr(network, address string) net.Addr {
+	if network == "tcp" {
+		if addr, err := net.ResolveTCPAddr(network, address); err == nil {
+			return addr
+		}
+	}
+	return replayAddr(address)
+}
+
+const replayNetwork = "replay"
+
+type replayAddr string
+
+func (a replayAddr) Network() string {
+	return replayNetwork
+}
+
+func (a replayAddr) String() string {
+	return string(a)
+}
+
+// replayListener accepts the recorded accepted connections, and fails with
+// ErrReplayExhausted once they were all accepted.
+type replayListener struct {
+	replay *Replay
+	addr   replayAddr
+	done   chan struct{}
+	once   sync.Once
+}
+
+func (l *replayListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.done:
+		return nil, net.ErrClosed
+	default:
+	}
+	return l.replay.next(&l.replay.accepted)
+}
+
+func (l *replayListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *replayListener) Addr() net.Addr {
+	return l.addr
+}
+
+// replayConn reads the read frames of a recording, and counts the bytes of
+// its write frames.
+type replayConn struct {
+	replay        *Replay
+	local, remote net.Addr
+	compressed    bool
+	opened        time.Time
+	mu            sync.Mutex
+	f             *os.File
+	reader        *bufio.Reader
+	pending       []byte
+	err           error
+	written       int64
+	recorded      int64
+	closed        bool
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		frame, err := readFrame(c.reader)
+		if err != nil {
+			c.err = err
+			continue
+		}
+		if frame.kind&^frameElided == frameWrite {
+			c.recorded += int64(frame.length)
+			continue
+		}
+		if frame.kind&frameElided != 0 {
+			c.err = fmt.Errorf("%w, the data read was elided", ErrInvalidRecording)
+			continue
+		}
+		if c.replay.timing {
+			time.Sleep(time.Until(c.opened.Add(frame.elapsed)))
+		}
+		c.pending = frame.data
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+	c.written += int64(len(p))
+	return len(p), nil
+}
+
+// Close counts the writes left in the recording, and adds the bytes written
+// to the replay.
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	for c.err == nil {
+		frame, err := readFrame(c.reader)
+		if err != nil {
+			break
+		}
+		if frame.kind&^frameElided == frameWrite {
+			c.recorded += int64(frame.length)
+		}
+	}
+	c.replay.mu.Lock()
+	c.replay.written += c.written
+	c.replay.recorded += c.recorded
+	c.replay.mu.Unlock()
+	return c.f.Close()
+}
+
+func (c *replayConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *replayConn) Compressed() bool {
+	return c.compressed
+}
+
+func (c *replayConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *replayConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (c *replayConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Transport creates the connections used by the blockrsync client, server and
+// proxy. Implementations can be layered with Wrap, for instance TLS on top of
+// TCP.
+type Transport interface {
+	Dial(address string) (net.Conn, error)
+	Listen(address string) (net.Listener, error)
+}
+
+// Layer wraps connections created by another transport. Client is applied to
+// dialed connections and Server to accepted connections.
+type Layer interface {
+	Client(conn net.Conn) (net.Conn, error)
+	Server(conn net.Conn) (net.Conn, error)
+}
+
+type tcpTransport struct{}
+
+// TCP is the default transport.
+var TCP Transport = &tcpTransport{}
+
+func (t *tcpTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("tcp", address)
+}
+
+func (t *tcpTransport) Listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+type unixTransport struct{}
+
+// Unix connects over unix domain sockets, the address is the path of the
+// socket. It avoids the TCP stack and port allocation when both ends are on
+// the same host.
+var Unix Transport = &unixTransport{}
+
+func (t *unixTransport) Dial(address string) (net.Conn, error) {
+	return net.Dial("unix", address)
+}
+
+// Listen removes a socket left behind by a previous listener before
+// listening, the socket is removed again when the listener is closed.
+func (t *unixTransport) Listen(address string) (net.Listener, error) {
+	if info, err := os.Lstat(address); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if err := os.Remove(address); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", address)
+}
+
+// OrDefault returns the transport, or TCP if it is nil.
+func OrDefault(t Transport) Transport {
+	if t == nil {
+		return TCP
+	}
+	return t
+}
+
+// Wrap returns a transport that applies the layers in order to every
+// connection of the base transport, so the last layer is the outermost.
+func Wrap(base Transport, layers ...Layer) Transport {
+	return &wrappedTransport{
+		base:   base,
+		layers: layers,
+	}
+}
+
+type wrappedTransport struct {
+	base   Transport
+	layers []Layer
+}
+
+func (w *wrappedTransport) Dial(address string) (net.Conn, error) {
+	conn, err := w.base.Dial(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range w.layers {
+		wrapped, err := layer.Client(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+func (w *wrappedTransport) Listen(address string) (net.Listener, error) {
+	listener, err := w.base.Listen(address)
+	if err != nil {
+		return nil, err
+	}
+	return &wrappedListener{
+		Listener: listener,
+		layers:   w.layers,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// wrappedListener applies the layers to every accepted connection in its own
+// goroutine, so a peer that is slow to handshake doesn't hold up the
+// connections accepted after it.
+type wrappedListener struct {
+	net.Listener
+	layers   []Layer
+	accepted chan acceptResult
+	start    sync.Once
+	done     chan struct{}
+	close    sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (w *wrappedListener) Accept() (net.Conn, error) {
+	w.start.Do(func() {
+		go w.acceptLoop()
+	})
+	select {
+	case res := <-w.accepted:
+		return res.conn, res.err
+	case <-w.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// acceptLoop accepts the connections of the base listener until it is
+// closed, and hands them to Accept once the layers were applied.
+func (w *wrappedListener) acceptLoop() {
+	for {
+		conn, err := w.Listener.Accept()
+		if err != nil {
+			if !w.deliver(acceptResult{err: err}) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go func() {
+			conn, err := w.handshake(conn)
+			if !w.deliver(acceptResult{conn: conn, err: err}) && conn != nil {
+				conn.Close()
+			}
+		}()
+	}
+}
+
+func (w *wrappedListener) handshake(conn net.Conn) (net.Conn, error) {
+	for _, layer := range w.layers {
+		wrapped, err := layer.Server(conn)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = wrapped
+	}
+	return conn, nil
+}
+
+// deliver returns false if the listener was closed before Accept took the
+// result.
+func (w *wrappedListener) deliver(res acceptResult) bool {
+	select {
+	case w.accepted <- res:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *wrappedListener) Close() error {
+	w.close.Do(func() {
+		close(w.done)
+	})
+	return w.Listener.Close()
+}
+
+// CompressedConn is implemented by connections that compress what is
+// written to them.
+type CompressedConn interface {
+	Compressed() bool
+}
+
+// IsCompressed returns true if the connection, or a connection it wraps,
+// compresses what is written to it. Wrapping connections are unwrapped with
+// NetConn, like a tls.Conn.
+func IsCompressed(conn net.Conn) bool {
+	for conn != nil {
+		if compressed, ok := conn.(CompressedConn); ok && compressed.Compressed() {
+			return true
+		}
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return false
+		}
+		conn = wrapper.NetConn()
+	}
+	return false
+}
+
+// IsLoopback returns true if the peer of the connection is on a loopback
+// address, or on the other end of a unix domain socket.
+func IsLoopback(conn net.Conn) bool {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	return false
+}
+
+// DialRetry dials the address until it succeeds, waiting delay between
+// attempts. A negative retries value retries forever. Errors caused by a
+// cancelled context are not retried.
+func DialRetry(t Transport, address string, retries int, delay time.Duration) (net.Conn, error) {
+	retryCount := 0
+	for {
+		conn, err := t.Dial(address)
+		if err == nil {
+			return conn, nil
+		}
+		if errors.Is(err, context.Canceled) {
+			return nil, err
+		}
+		if retries >= 0 && retryCount >= retries {
+			return nil, fmt.Errorf("unable to connect to %s after %d retries: %w", address, retryCount, err)
+		}
+		time.Sleep(delay)
+		retryCount++
+	}
+}
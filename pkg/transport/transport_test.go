@@ -0,0 +1,201 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// greetingLayer writes a greeting on every client connection and checks it
+// on every server connection.
+type greetingLayer struct {
+	greeting string
+}
+
+func (g *greetingLayer) Client(conn net.Conn) (net.Conn, error) {
+	_, err := conn.Write([]byte(g.greeting))
+	return conn, err
+}
+
+func (g *greetingLayer) Server(conn net.Conn) (net.Conn, error) {
+	buf := make([]byte, len(g.greeting))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, err
+	}
+	Expect(string(buf)).To(Equal(g.greeting))
+	return conn, nil
+}
+
+var _ = Describe("transport tests", func() {
+	It("should apply layers in order on both ends", func() {
+		t := Wrap(TCP, &greetingLayer{greeting: "first"}, &greetingLayer{greeting: "second"})
+		listener, err := t.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := t.Dial(listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("data"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		conn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("data"))
+	})
+
+	It("should accept a connection while an earlier one is handshaking", func() {
+		t := Wrap(TCP, &greetingLayer{greeting: "greeting"})
+		listener, err := t.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		// Never sends its greeting
+		slow, err := TCP.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer slow.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := t.Dial(listener.Addr().String())
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, err = conn.Write([]byte("data"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			accepted <- conn
+		}()
+		var conn net.Conn
+		Eventually(accepted, 5*time.Second).Should(Receive(&conn))
+		defer conn.Close()
+		data, err := io.ReadAll(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("data"))
+
+		Expect(listener.Close()).To(Succeed())
+		_, err = listener.Accept()
+		Expect(err).To(MatchError(net.ErrClosed))
+	})
+
+	It("should give up dialing after the retries", func() {
+		listener, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		address := listener.Addr().String()
+		listener.Close()
+		_, err = DialRetry(TCP, address, 1, time.Millisecond)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should default to TCP", func() {
+		Expect(OrDefault(nil)).To(Equal(TCP))
+	})
+
+	It("should detect loopback and compressed connections", func() {
+		listener, err := TCP.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		}()
+		conn, err := TCP.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(IsLoopback(conn)).To(BeTrue())
+		Expect(IsCompressed(conn)).To(BeFalse())
+		limited := RateLimit(NewLimiter(1 << 20)).(*rateLimitLayer).wrap(&compressedConn{Conn: conn})
+		Expect(IsCompressed(limited)).To(BeTrue())
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		Expect(IsLoopback(client)).To(BeFalse())
+	})
+
+	It("should connect over a unix socket in place of a stale one", func() {
+		socket := filepath.Join(GinkgoT().TempDir(), "blockrsync.sock")
+		stale, err := net.Listen("unix", socket)
+		Expect(err).ToNot(HaveOccurred())
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+		Expect(socket).To(BeAnExistingFile())
+
+		listener, err := Unix.Listen(socket)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			defer GinkgoRecover()
+			conn, err := Unix.Dial(socket)
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			Expect(IsLoopback(conn)).To(BeTrue())
+			_, err = conn.Write([]byte("data"))
+			Expect(err).ToNot(HaveOccurred())
+		}()
+		conn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		Expect(IsLoopback(conn)).To(BeTrue())
+		data, err := io.ReadAll(conn)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(data)).To(Equal("data"))
+		listener.Close()
+		Expect(socket).ToNot(BeAnExistingFile())
+	})
+})
+
+type compressedConn struct {
+	net.Conn
+}
+
+func (c *compressedConn) Compressed() bool {
+	return true
+}
+
+var _ = Describe("rate limit tests", func() {
+	It("should limit the bytes written per second", func() {
+		limiter := NewLimiter(1024 * 1024)
+		t := Wrap(TCP, RateLimit(limiter, nil))
+		listener, err := t.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		go func() {
+			defer GinkgoRecover()
+			conn, err := listener.Accept()
+			Expect(err).ToNot(HaveOccurred())
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}()
+		conn, err := t.Dial(listener.Addr().String())
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		start := time.Now()
+		// The first burst is free, the rest takes about half a second
+		n, err := conn.Write(make([]byte, 512*1024+limiter.burst))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(512*1024 + limiter.burst))
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+	})
+
+	It("should change the rate", func() {
+		limiter := NewLimiter(1024)
+		limiter.SetRate(1024 * 1024)
+		Expect(limiter.Rate()).To(Equal(int64(1024 * 1024)))
+		start := time.Now()
+		limiter.WaitN(limiter.burst)
+		limiter.WaitN(512 * 1024)
+		Expect(time.Since(start)).To(BeNumerically(">=", 400*time.Millisecond))
+		Expect(time.Since(start)).To(BeNumerically("<", 2*time.Second))
+	})
+})
@@ -0,0 +1,237 @@
+// Package transporttest provides a transport that simulates the conditions of
+// a wide area network, to test migrations against latency, limited bandwidth
+// and dropped connections without a real network.
+package transporttest
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/awels/blockrsync/pkg/transport"
+)
+
+const (
+	// queuedWrites is how many writes can be in flight on a connection before
+	// Write blocks, like the send buffer of a socket
+	queuedWrites = 256
+)
+
+// ErrDropped is returned by the connections the network dropped.
+var ErrDropped = errors.New("connection dropped by the simulated network")
+
+// Conditions describe the simulated network, the zero value is a perfect
+// network.
+type Conditions struct {
+	// Latency delays what is written on a connection before the peer can
+	// read it, Jitter adds a random delay up to its value. Data is delivered
+	// in order, so a delayed write delays the writes after it.
+	Latency time.Duration
+	Jitter  time.Duration
+	// BytesPerSecond caps what every connection writes
+	BytesPerSecond int64
+	// DropAfter drops a connection once it wrote this many bytes
+	DropAfter int64
+	// DropRate is the chance a write drops its connection
+	DropRate float64
+	// MaxDrops is the most connections dropped, 0 doesn't limit them
+	MaxDrops int
+	// Seed seeds the jitter and the drops, so runs that open connections in
+	// the same order and write the same data see the same conditions
+	Seed int64
+}
+
+// Network is a layer simulating the conditions on every connection it wraps.
+type Network struct {
+	conditions Conditions
+	mu         sync.Mutex
+	random     *rand.Rand
+	drops      int
+}
+
+// NewNetwork returns a network with the conditions.
+func NewNetwork(conditions Conditions) *Network {
+	return &Network{
+		conditions: conditions,
+		random:     rand.New(rand.NewSource(conditions.Seed)),
+	}
+}
+
+// NewTransport returns a transport that applies the conditions to the dialed
+// and accepted connections of the base transport, or TCP if it is nil. When
+// both ends use it, the round trip is twice the latency.
+func NewTransport(base transport.Transport, conditions Conditions) transport.Transport {
+	return transport.Wrap(transport.OrDefault(base), NewNetwork(conditions))
+}
+
+// Drops returns the number of connections the network dropped.
+func (n *Network) Drops() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.drops
+}
+
+func (n *Network) Client(conn net.Conn) (net.Conn, error) {
+	return n.wrap(conn), nil
+}
+
+func (n *Network) Server(conn net.Conn) (net.Conn, error) {
+	return n.wrap(conn), nil
+}
+
+func (n *Network) wrap(conn net.Conn) net.Conn {
+	res := &simulatedConn{
+		Conn:    conn,
+		network: n,
+		queue:   make(chan delayedWrite, queuedWrites),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	if n.conditions.BytesPerSecond > 0 {
+		res.limiter = transport.NewLimiter(n.conditions.BytesPerSecond)
+	}
+	go res.deliver()
+	return res
+}
+
+// delay returns the latency of a write.
+func (n *Network) delay() time.Duration {
+	if n.conditions.Jitter <= 0 {
+		return n.conditions.Latency
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.conditions.Latency + time.Duration(n.random.Int63n(int64(n.conditions.Jitter)))
+}
+
+// shouldDrop returns true if a connection that wrote written bytes is
+// dropped, and counts the drop.
+func (n *Network) shouldDrop(written int64) bool {
+	if n.conditions.DropAfter <= 0 && n.conditions.DropRate <= 0 {
+		return false
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.conditions.MaxDrops > 0 && n.drops >= n.conditions.MaxDrops {
+		return false
+	}
+	drop := n.conditions.DropAfter > 0 && written >= n.conditions.DropAfter
+	if n.conditions.DropRate > 0 && n.random.Float64() < n.conditions.DropRate {
+		drop = true
+	}
+	if drop {
+		n.drops++
+	}
+	return drop
+}
+
+type delayedWrite struct {
+	data      []byte
+	deliverAt time.Time
+}
+
+// simulatedConn queues writes until their latency passed, and delivers them
+// in order in the background.
+type simulatedConn struct {
+	net.Conn
+	network   *Network
+	limiter   *transport.Limiter
+	queue     chan delayedWrite
+	done      chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	// writeMu serializes the writes, and mu guards err
+	writeMu sync.Mutex
+	written int64
+	lastAt  time.Time
+	mu      sync.Mutex
+	err     error
+}
+
+func (c *simulatedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *simulatedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := c.error(); err != nil {
+		return 0, err
+	}
+	if c.limiter != nil {
+		c.limiter.WaitN(len(p))
+	}
+	c.written += int64(len(p))
+	if c.network.shouldDrop(c.written) {
+		c.setError(ErrDropped)
+		c.Conn.Close()
+		return 0, ErrDropped
+	}
+	deliverAt := time.Now().Add(c.network.delay())
+	if deliverAt.Before(c.lastAt) {
+		deliverAt = c.lastAt
+	}
+	c.lastAt = deliverAt
+	select {
+	case c.queue <- delayedWrite{data: append([]byte(nil), p...), deliverAt: deliverAt}:
+		return len(p), nil
+	case <-c.done:
+		if err := c.error(); err != nil {
+			return 0, err
+		}
+		return 0, net.ErrClosed
+	case <-c.closing:
+		return 0, net.ErrClosed
+	}
+}
+
+func (c *simulatedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && c.error() == ErrDropped {
+		err = ErrDropped
+	}
+	return n, err
+}
+
+// deliver writes the queued writes to the connection once they are due, until
+// the queue is closed or a write fails.
+func (c *simulatedConn) deliver() {
+	defer close(c.done)
+	for write := range c.queue {
+		time.Sleep(time.Until(write.deliverAt))
+		if _, err := c.Conn.Write(write.data); err != nil {
+			c.setError(err)
+			return
+		}
+	}
+}
+
+func (c *simulatedConn) error() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// setError keeps the first error of the connection.
+func (c *simulatedConn) setError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Close delivers the queued writes before closing the connection, unless it
+// was dropped.
+func (c *simulatedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closing)
+		c.writeMu.Lock()
+		close(c.queue)
+		c.writeMu.Unlock()
+		<-c.done
+	})
+	return c.Conn.Close()
+}
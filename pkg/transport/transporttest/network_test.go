@@ -0,0 +1,144 @@
+package transporttest
+
+import (
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/awels/blockrsync/pkg/blockrsync"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("simulated network tests", func() {
+	// transfer writes the data from a dialed connection, and returns what the
+	// accepted connection read and how long it took.
+	transfer := func(conditions Conditions, data []byte) ([]byte, time.Duration, error) {
+		t := NewTransport(nil, conditions)
+		listener, err := t.Listen("localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		defer listener.Close()
+		writeErr := make(chan error, 1)
+		go func() {
+			conn, err := t.Dial(listener.Addr().String())
+			if err != nil {
+				writeErr <- err
+				return
+			}
+			defer conn.Close()
+			for chunk := 0; chunk < len(data); chunk += 1024 {
+				if _, err := conn.Write(data[chunk:min(chunk+1024, len(data))]); err != nil {
+					writeErr <- err
+					return
+				}
+			}
+			writeErr <- nil
+		}()
+		conn, err := listener.Accept()
+		Expect(err).ToNot(HaveOccurred())
+		defer conn.Close()
+		start := time.Now()
+		received, _ := io.ReadAll(conn)
+		return received, time.Since(start), <-writeErr
+	}
+
+	It("should deliver the data after the latency", func() {
+		data := []byte("data")
+		received, elapsed, err := transfer(Conditions{Latency: 100 * time.Millisecond, Jitter: 20 * time.Millisecond}, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+		Expect(elapsed).To(BeNumerically(">=", 90*time.Millisecond))
+	})
+
+	It("should cap the bandwidth", func() {
+		data := make([]byte, 256*1024)
+		received, elapsed, err := transfer(Conditions{BytesPerSecond: 512 * 1024}, data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(received).To(Equal(data))
+		// The first 64KiB are a burst
+		Expect(elapsed).To(BeNumerically(">=", 300*time.Millisecond))
+	})
+
+	It("should drop the connection after the bytes written", func() {
+		data := make([]byte, 16*1024)
+		received, _, err := transfer(Conditions{DropAfter: 4096}, data)
+		Expect(err).To(MatchError(ErrDropped))
+		Expect(len(received)).To(BeNumerically("<", len(data)))
+	})
+
+	It("should drop the same writes with the same seed", func() {
+		drops := func() []int {
+			network := NewNetwork(Conditions{DropRate: 0.3, Seed: 42})
+			var dropped []int
+			for i := 0; i < 10; i++ {
+				client, server := net.Pipe()
+				conn, err := network.Client(client)
+				Expect(err).ToNot(HaveOccurred())
+				go func() { _, _ = io.Copy(io.Discard, server) }()
+				for write := 0; write < 10; write++ {
+					if _, err := conn.Write([]byte("data")); err != nil {
+						Expect(err).To(MatchError(ErrDropped))
+						dropped = append(dropped, i*10+write)
+						break
+					}
+				}
+				conn.Close()
+				server.Close()
+			}
+			Expect(network.Drops()).To(Equal(len(dropped)))
+			return dropped
+		}
+		first := drops()
+		Expect(first).ToNot(BeEmpty())
+		Expect(drops()).To(Equal(first))
+	})
+
+	It("should stop dropping after the most drops", func() {
+		data := make([]byte, 16*1024)
+		network := NewNetwork(Conditions{DropAfter: 1, MaxDrops: 1})
+		client, server := net.Pipe()
+		conn, err := network.Client(client)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = conn.Write(data)
+		Expect(err).To(MatchError(ErrDropped))
+		server.Close()
+		client, server = net.Pipe()
+		defer server.Close()
+		conn, err = network.Client(client)
+		Expect(err).ToNot(HaveOccurred())
+		go func() { _, _ = io.Copy(io.Discard, server) }()
+		_, err = conn.Write(data)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(conn.Close()).To(Succeed())
+		Expect(network.Drops()).To(Equal(1))
+	})
+
+	It("should sync a target over the simulated network", func() {
+		tmpDir := GinkgoT().TempDir()
+		sourceFile := filepath.Join(tmpDir, "source.raw")
+		targetFile := filepath.Join(tmpDir, "target.raw")
+		source := make([]byte, 64*4096)
+		_, _ = rand.Read(source)
+		Expect(os.WriteFile(sourceFile, source, 0644)).To(Succeed())
+		listener, err := net.Listen("tcp", "localhost:0")
+		Expect(err).ToNot(HaveOccurred())
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		t := NewTransport(nil, Conditions{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond, BytesPerSecond: 4 * 1024 * 1024})
+		server, err := blockrsync.NewServer(targetFile, blockrsync.WithTarget("", port), blockrsync.WithBlockSize(4096), blockrsync.WithTransport(t), blockrsync.WithLogger(GinkgoLogr))
+		Expect(err).ToNot(HaveOccurred())
+		client, err := blockrsync.NewClient(sourceFile, blockrsync.WithTarget("localhost", port), blockrsync.WithBlockSize(4096), blockrsync.WithTransport(t), blockrsync.WithLogger(GinkgoLogr))
+		Expect(err).ToNot(HaveOccurred())
+		serverDone := make(chan error, 1)
+		go func() {
+			serverDone <- server.StartServer()
+		}()
+		Expect(client.ConnectToTarget()).To(Succeed())
+		Expect(<-serverDone).To(Succeed())
+		Expect(os.ReadFile(targetFile)).To(Equal(source))
+	})
+})
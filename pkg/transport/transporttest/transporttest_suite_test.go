@@ -0,0 +1,13 @@
+package transporttest
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestTransporttest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "transporttest Suite")
+}